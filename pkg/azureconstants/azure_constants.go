@@ -22,6 +22,9 @@ import (
 
 const (
 	AzureDiskCSIDriverName            = "azuredisk_csi_driver"
+	AutoExpandMaxGiBField             = "autoexpandmaxgib"
+	AutoExpandStepGiBField            = "autoexpandstepgib"
+	AutoExpandThresholdPercentField   = "autoexpandthresholdpercent"
 	CachingModeField                  = "cachingmode"
 	DefaultAzureCredentialFileEnv     = "AZURE_CREDENTIAL_FILE"
 	DefaultCredFilePathLinux          = "/etc/kubernetes/azure.json"
@@ -34,13 +37,30 @@ const (
 	DiskMBPSReadWriteField            = "diskmbpsreadwrite"
 	DiskNameField                     = "diskname"
 	EnableBurstingField               = "enablebursting"
+	EncryptionField                   = "encryption"
+	EncryptionLuks2                   = "luks2"
+	EncryptionNone                    = "none"
+	EdgeZoneTopologyKey               = "topology.disk.csi.azure.com/edgezone"
 	ErrDiskNotFound                   = "not found"
+	ExtendedLocationField             = "extendedlocation"
+	FsckPolicyField                   = "fsckpolicy"
+	FsckPolicyCheck                   = "check"
+	FsckPolicyNone                    = "none"
+	FsckPolicyRepair                  = "repair"
 	FsTypeField                       = "fstype"
 	IncrementalField                  = "incremental"
 	KindField                         = "kind"
 	LocationField                     = "location"
 	LogicalSectorSizeField            = "logicalsectorsize"
+	LocalCacheField                   = "localcache"
+	LocalCacheBcache                  = "bcache"
+	LocalCacheDmCache                 = "dm-cache"
+	LocalCacheNone                    = "none"
+	LocalCacheSizeGiBField            = "localcachesizegib"
+	DefaultLocalCacheSizeGiB          = 10
 	LUN                               = "LUN"
+	LuksKeyFileSecretKey              = "luksKeyFile"
+	LuksPassphraseSecretKey           = "luksPassphrase"
 	MaxSharesField                    = "maxshares"
 	MinimumDiskSizeGiB                = 1
 	NetworkAccessPolicyField          = "networkaccesspolicy"
@@ -48,7 +68,12 @@ const (
 	NotFound                          = "NotFound"
 	PerfProfileBasic                  = "basic"
 	PerfProfileAdvanced               = "advanced"
+	PerfProfileAuto                   = "auto"
 	PerfProfileField                  = "perfprofile"
+	PersistentReservationField        = "enablepersistentreservation"
+	PodIOPSLimitField                 = "podiopslimit"
+	PodIOLimitAuto                    = "auto"
+	PodMBpsLimitField                 = "podmbpslimit"
 	PerfProfileNone                   = "none"
 	PremiumAccountPrefix              = "premium"
 	PvcNameKey                        = "csi.storage.k8s.io/pvc/name"
@@ -69,6 +94,13 @@ const (
 	SourceSnapshot                    = "snapshot"
 	SourceVolume                      = "volume"
 	StandardSsdAccountPrefix          = "standardssd"
+	StripeCountField                  = "stripecount"
+	StripeLUNs                        = "stripeLUNs"
+	StripeSizeKiBField                = "stripesizekib"
+	StripedVolumeIDPrefix             = "stripe#"
+	StripedVolumeIDSeparator          = "#"
+	DefaultStripeSizeKiB              = 64
+	MaxStripeCount                    = 16
 	StorageAccountTypeField           = "storageaccounttype"
 	TagsField                         = "tags"
 	GetDiskThrottlingKey              = "getdiskthrottlingKey"
@@ -98,6 +130,7 @@ const (
 	// define different sleep time when hit throttling
 	SnapshotOpThrottlingSleepSec    = 50
 	MaxThrottlingSleepSec           = 1200
+	RateLimitRemainingHeaderPrefix  = "x-ms-ratelimit-remaining-"
 	AgentNotReadyNodeTaintKeySuffix = "/agent-not-ready"
 )
 
@@ -0,0 +1,678 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	// the requests of a class throttled by ARM without Retry-After are rejected for this long
+	armDefaultRetryAfter = 10 * time.Second
+
+	armRejectRetryAfter = "throttled by ARM"
+	armRejectBudget     = "over the request budget"
+)
+
+// armOperation is the class of an ARM request, the classes are scheduled in the order of their priority
+type armOperation int
+
+const (
+	armOperationDetach armOperation = iota
+	armOperationAttach
+	armOperationWrite
+	armOperationRead
+	armOperationList
+	armOperationCount
+)
+
+var (
+	armOperationNames = [armOperationCount]string{"detach", "attach", "write", "read", "list"}
+	// the share of the request budget each class may use, detach and attach may use the whole budget
+	armOperationShares = [armOperationCount]float64{1, 1, 0.5, 0.5, 0.1}
+
+	registerARMSchedulerMetricsOnce sync.Once
+
+	armRequestsRejected = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_arm_requests_rejected_total",
+			Help:           "Number of ARM requests rejected by the request scheduler before they were sent",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "reason"},
+	)
+	armRequestsThrottled = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_arm_requests_throttled_total",
+			Help:           "Number of ARM requests throttled by ARM",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+)
+
+func (o armOperation) String() string {
+	return armOperationNames[o]
+}
+
+// isRead returns true if the requests of the class count against the read limits of ARM, the others count against the write limits
+func (o armOperation) isRead() bool {
+	return o == armOperationRead || o == armOperationList
+}
+
+// tokenBucket holds up to burst tokens, which are refilled at rate tokens per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// delay returns how long it takes until the bucket holds n tokens
+func (b *tokenBucket) delay(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+type armOperationState struct {
+	bucket *tokenBucket
+	// the requests of the class are rejected until then, after ARM throttled a request
+	blockedUntil time.Time
+}
+
+// armRequest is a request waiting for a token in the queue of the scheduler
+type armRequest struct {
+	operation armOperation
+	// closed when the request is dispatched or rejected
+	ready chan struct{}
+	// the retry delay of a rejected request
+	rejected   bool
+	retryAfter time.Duration
+}
+
+// armScheduler paces the ARM requests of the disk, snapshot and VM clients with a global request budget shared by
+// per-class token buckets. The queued requests get the tokens in the order of the priority of their class,
+// detach before attach before the other writes before read before list.
+// A request is rejected with Unavailable and a retry delay instead of waiting longer than maxWait,
+// and the requests of a class are rejected until the Retry-After of a request of the class throttled by ARM.
+type armScheduler struct {
+	clock   clock.Clock
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	budget  *tokenBucket
+	classes [armOperationCount]*armOperationState
+	// ordered by priority, then by arrival
+	queue []*armRequest
+}
+
+// newARMScheduler returns a scheduler sending up to qps requests per second with bursts of burst requests
+func newARMScheduler(qps float64, burst int, maxWait time.Duration) *armScheduler {
+	return newARMSchedulerWithClock(qps, burst, maxWait, clock.RealClock{})
+}
+
+func newARMSchedulerWithClock(qps float64, burst int, maxWait time.Duration, clk clock.Clock) *armScheduler {
+	registerARMSchedulerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(armRequestsRejected, armRequestsThrottled)
+	})
+	now := clk.Now()
+	s := &armScheduler{
+		clock:   clk,
+		maxWait: maxWait,
+		budget:  newTokenBucket(qps, float64(burst), now),
+	}
+	for i := range s.classes {
+		s.classes[i] = &armOperationState{
+			bucket: newTokenBucket(qps*armOperationShares[i], math.Max(1, float64(burst)*armOperationShares[i]), now),
+		}
+	}
+	return s
+}
+
+// acquire waits until the request may be sent, it returns an *armThrottledError if the request is rejected
+func (s *armScheduler) acquire(ctx context.Context, operation armOperation) error {
+	s.mu.Lock()
+	now := s.clock.Now()
+	if retryAfter := s.classes[operation].blockedUntil.Sub(now); retryAfter > 0 {
+		s.mu.Unlock()
+		return s.reject(ctx, operation, retryAfter, armRejectRetryAfter)
+	}
+	r := &armRequest{operation: operation, ready: make(chan struct{})}
+	s.enqueue(r)
+	s.dispatch(now)
+	if !s.isQueued(r) {
+		s.mu.Unlock()
+		return s.result(ctx, r)
+	}
+	if wait := s.estimateWait(r); wait > s.maxWait {
+		s.remove(r)
+		s.mu.Unlock()
+		return s.reject(ctx, operation, wait, armRejectBudget)
+	}
+	s.mu.Unlock()
+
+	deadline := s.clock.NewTimer(s.maxWait)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		next := s.nextDispatch(r, s.clock.Now())
+		s.mu.Unlock()
+		timer := s.clock.NewTimer(next)
+		select {
+		case <-r.ready:
+			timer.Stop()
+			return s.result(ctx, r)
+		case <-timer.C():
+			s.mu.Lock()
+			s.dispatch(s.clock.Now())
+			s.mu.Unlock()
+		case <-deadline.C():
+			timer.Stop()
+			s.mu.Lock()
+			wait := s.estimateWait(r)
+			removed := s.remove(r)
+			s.mu.Unlock()
+			if !removed {
+				return s.result(ctx, r)
+			}
+			return s.reject(ctx, operation, wait, armRejectBudget)
+		case <-ctx.Done():
+			timer.Stop()
+			s.mu.Lock()
+			removed := s.remove(r)
+			s.mu.Unlock()
+			if !removed {
+				return s.result(ctx, r)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// result returns the result of a request which left the queue
+func (s *armScheduler) result(ctx context.Context, r *armRequest) error {
+	if r.rejected {
+		return s.reject(ctx, r.operation, r.retryAfter, armRejectRetryAfter)
+	}
+	return nil
+}
+
+func (s *armScheduler) reject(ctx context.Context, operation armOperation, retryAfter time.Duration, reason string) error {
+	armRequestsRejected.WithLabelValues(operation.String(), reason).Inc()
+	setARMRetryHint(ctx, retryAfter)
+	err := &armThrottledError{operation: operation, retryAfter: retryAfter, reason: reason}
+	klog.V(4).Infof("%v", err)
+	return err
+}
+
+// enqueue inserts the request after the queued requests of the same or a higher priority, s.mu must be held
+func (s *armScheduler) enqueue(r *armRequest) {
+	i := len(s.queue)
+	for i > 0 && s.queue[i-1].operation > r.operation {
+		i--
+	}
+	s.queue = append(s.queue, nil)
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = r
+}
+
+// remove removes the request from the queue, false is returned if it was already dispatched or rejected, s.mu must be held
+func (s *armScheduler) remove(r *armRequest) bool {
+	for i, queued := range s.queue {
+		if queued == r {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *armScheduler) isQueued(r *armRequest) bool {
+	for _, queued := range s.queue {
+		if queued == r {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch hands out the available tokens to the queued requests in the order of the queue,
+// and rejects the queued requests of the blocked classes, s.mu must be held
+func (s *armScheduler) dispatch(now time.Time) {
+	s.budget.refill(now)
+	for _, state := range s.classes {
+		state.bucket.refill(now)
+	}
+	waiting := s.queue[:0]
+	for _, r := range s.queue {
+		state := s.classes[r.operation]
+		switch {
+		case state.blockedUntil.After(now):
+			r.rejected = true
+			r.retryAfter = state.blockedUntil.Sub(now)
+			close(r.ready)
+		case s.budget.tokens >= 1 && state.bucket.tokens >= 1:
+			s.budget.tokens--
+			state.bucket.tokens--
+			close(r.ready)
+		default:
+			waiting = append(waiting, r)
+		}
+	}
+	for i := len(waiting); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = waiting
+}
+
+// estimateWait returns how long the queued request waits for the tokens of the requests ahead of it and its own, s.mu must be held
+func (s *armScheduler) estimateWait(r *armRequest) time.Duration {
+	ahead, sameClass := 0, 0
+	for _, queued := range s.queue {
+		ahead++
+		if queued.operation == r.operation {
+			sameClass++
+		}
+		if queued == r {
+			break
+		}
+	}
+	wait := s.budget.delay(float64(ahead))
+	if classWait := s.classes[r.operation].bucket.delay(float64(sameClass)); classWait > wait {
+		wait = classWait
+	}
+	return wait
+}
+
+// nextDispatch returns when the next token the request needs is refilled, s.mu must be held
+func (s *armScheduler) nextDispatch(r *armRequest, now time.Time) time.Duration {
+	s.budget.refill(now)
+	bucket := s.classes[r.operation].bucket
+	bucket.refill(now)
+	next := s.budget.delay(1)
+	if classNext := bucket.delay(1); classNext > next {
+		next = classNext
+	}
+	if next < time.Millisecond {
+		next = time.Millisecond
+	}
+	return next
+}
+
+// observe blocks the classes counting against the same ARM limits as the request if ARM throttled it
+func (s *armScheduler) observe(ctx context.Context, operation armOperation, err error) {
+	if err == nil || !azureutils.IsThrottlingError(err) {
+		return
+	}
+	retryAfter := azureutils.GetRetryAfter(err)
+	if retryAfter <= 0 {
+		retryAfter = armDefaultRetryAfter
+	}
+	armRequestsThrottled.WithLabelValues(operation.String()).Inc()
+	klog.Warningf("ARM %s request is throttled, reject the %s requests for %v: %v", operation, readOrWrite(operation.isRead()), retryAfter, err)
+	setARMRetryHint(ctx, retryAfter)
+	s.block(operation.isRead(), retryAfter)
+}
+
+// observeResponse lowers the tokens of the classes counting against the limits of the request to the remaining requests
+// in the x-ms-ratelimit-remaining-* headers, and blocks them until the Retry-After if none is left or the request is throttled
+func (s *armScheduler) observeResponse(method string, resp *http.Response) {
+	read := method == http.MethodGet || method == http.MethodHead
+	remaining, ok := azureutils.GetRateLimitRemaining(resp.Header)
+	if !ok && resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	if ok {
+		s.mu.Lock()
+		for i, state := range s.classes {
+			if armOperation(i).isRead() == read && float64(remaining) < state.bucket.tokens {
+				state.bucket.tokens = math.Max(0, float64(remaining))
+			}
+		}
+		s.mu.Unlock()
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || (ok && remaining <= 0) {
+		retryAfter, found := azureutils.ParseRetryAfterHeader(resp.Header, s.clock.Now())
+		if !found || retryAfter <= 0 {
+			retryAfter = armDefaultRetryAfter
+		}
+		klog.Warningf("%s requests are throttled by ARM (status code %d, remaining requests %d), reject them for %v", readOrWrite(read), resp.StatusCode, remaining, retryAfter)
+		s.block(read, retryAfter)
+	}
+}
+
+// block rejects the requests of the read or the write classes for retryAfter
+func (s *armScheduler) block(read bool, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	until := now.Add(retryAfter)
+	for i, state := range s.classes {
+		if armOperation(i).isRead() == read && until.After(state.blockedUntil) {
+			state.blockedUntil = until
+		}
+	}
+	s.dispatch(now)
+}
+
+// isThrottled returns true if the requests of the class are rejected after ARM throttled a request
+func (s *armScheduler) isThrottled(operation armOperation) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.classes[operation].blockedUntil.After(s.clock.Now())
+}
+
+func readOrWrite(read bool) string {
+	if read {
+		return "read"
+	}
+	return "write"
+}
+
+// armThrottledError is returned for a request rejected by the scheduler, its gRPC status is Unavailable with the retry delay.
+// Its message contains "client throttled" and the RetryAfter, so that it's handled like the throttling errors of the clients.
+type armThrottledError struct {
+	operation  armOperation
+	retryAfter time.Duration
+	reason     string
+}
+
+func (e *armThrottledError) Error() string {
+	return fmt.Sprintf("%s: ARM %s requests are %s, RetryAfter: %ds", consts.ClientThrottled, e.operation, e.reason, retryAfterSeconds(e.retryAfter))
+}
+
+func (e *armThrottledError) GRPCStatus() *status.Status {
+	return unavailableStatus(e.Error(), e.retryAfter)
+}
+
+// retryAfterSeconds rounds the retry delay up to seconds, which is at least 1s
+func retryAfterSeconds(retryAfter time.Duration) int64 {
+	if seconds := int64(math.Ceil(retryAfter.Seconds())); seconds > 1 {
+		return seconds
+	}
+	return 1
+}
+
+// unavailableStatus returns an Unavailable status whose RetryInfo detail holds the retry delay
+func unavailableStatus(message string, retryAfter time.Duration) *status.Status {
+	st := status.New(codes.Unavailable, message)
+	withDetails, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(retryAfterSeconds(retryAfter)) * time.Second)})
+	if err != nil {
+		return st
+	}
+	return withDetails
+}
+
+type armRetryHintKey struct{}
+
+// armRetryHint records the longest retry delay of the ARM requests of a CSI call which were throttled or rejected
+type armRetryHint struct {
+	mu         sync.Mutex
+	retryAfter time.Duration
+	set        bool
+}
+
+func withARMRetryHint(ctx context.Context) (context.Context, *armRetryHint) {
+	hint := &armRetryHint{}
+	return context.WithValue(ctx, armRetryHintKey{}, hint), hint
+}
+
+func setARMRetryHint(ctx context.Context, retryAfter time.Duration) {
+	if ctx == nil {
+		return
+	}
+	hint, ok := ctx.Value(armRetryHintKey{}).(*armRetryHint)
+	if !ok {
+		return
+	}
+	hint.mu.Lock()
+	defer hint.mu.Unlock()
+	if !hint.set || retryAfter > hint.retryAfter {
+		hint.retryAfter = retryAfter
+	}
+	hint.set = true
+}
+
+func (h *armRetryHint) get() (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.retryAfter, h.set
+}
+
+// unaryInterceptor returns Unavailable with the retry delay if an ARM request of the call was throttled or rejected,
+// unless the handler returned a more specific code than Internal or Unknown
+func (s *armScheduler) unaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, hint := withARMRetryHint(ctx)
+	resp, err := handler(ctx, req)
+	if err == nil {
+		return resp, nil
+	}
+	if retryAfter, ok := hint.get(); ok {
+		switch st := status.Convert(err); st.Code() {
+		case codes.Internal, codes.Unknown, codes.Unavailable:
+			return resp, unavailableStatus(st.Message(), retryAfter).Err()
+		}
+	}
+	return resp, err
+}
+
+// armRateLimitPolicy passes every ARM response to the scheduler, which follows the Retry-After and x-ms-ratelimit-remaining-* headers
+type armRateLimitPolicy struct {
+	scheduler *armScheduler
+}
+
+func (p armRateLimitPolicy) Do(req *policy.Request) (*http.Response, error) {
+	resp, err := req.Next()
+	if resp != nil {
+		p.scheduler.observeResponse(req.Raw().Method, resp)
+	}
+	return resp, err
+}
+
+// schedule sends the request of the class when the scheduler allows it
+func schedule[T any](ctx context.Context, s *armScheduler, operation armOperation, request func() (T, error)) (T, error) {
+	if err := s.acquire(ctx, operation); err != nil {
+		var empty T
+		return empty, err
+	}
+	result, err := request()
+	s.observe(ctx, operation, err)
+	return result, err
+}
+
+func scheduleErr(ctx context.Context, s *armScheduler, operation armOperation, request func() error) error {
+	_, err := schedule(ctx, s, operation, func() (struct{}, error) {
+		return struct{}{}, request()
+	})
+	return err
+}
+
+// wrapClientFactory returns a client factory whose disk and snapshot clients are paced by the scheduler,
+// the factory is returned as is if the scheduler is disabled
+func (s *armScheduler) wrapClientFactory(factory azclient.ClientFactory) azclient.ClientFactory {
+	if s == nil || factory == nil {
+		return factory
+	}
+	return &scheduledClientFactory{ClientFactory: factory, scheduler: s}
+}
+
+// wrapVMSet returns a VMSet whose disk attach/detach and VM updates are paced by the scheduler,
+// the VMSet is returned as is if the scheduler is disabled
+func (s *armScheduler) wrapVMSet(vmset provider.VMSet) provider.VMSet {
+	if s == nil || vmset == nil {
+		return vmset
+	}
+	return &scheduledVMSet{VMSet: vmset, scheduler: s}
+}
+
+type scheduledClientFactory struct {
+	azclient.ClientFactory
+	scheduler *armScheduler
+}
+
+func (f *scheduledClientFactory) GetDiskClient() diskclient.Interface {
+	return &scheduledDiskClient{Interface: f.ClientFactory.GetDiskClient(), scheduler: f.scheduler}
+}
+
+func (f *scheduledClientFactory) GetDiskClientForSub(subscriptionID string) (diskclient.Interface, error) {
+	client, err := f.ClientFactory.GetDiskClientForSub(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return &scheduledDiskClient{Interface: client, scheduler: f.scheduler}, nil
+}
+
+func (f *scheduledClientFactory) GetSnapshotClient() snapshotclient.Interface {
+	return &scheduledSnapshotClient{Interface: f.ClientFactory.GetSnapshotClient(), scheduler: f.scheduler}
+}
+
+func (f *scheduledClientFactory) GetSnapshotClientForSub(subscriptionID string) (snapshotclient.Interface, error) {
+	client, err := f.ClientFactory.GetSnapshotClientForSub(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return &scheduledSnapshotClient{Interface: client, scheduler: f.scheduler}, nil
+}
+
+type scheduledDiskClient struct {
+	diskclient.Interface
+	scheduler *armScheduler
+}
+
+func (c *scheduledDiskClient) Get(ctx context.Context, resourceGroupName string, diskName string) (*armcompute.Disk, error) {
+	return schedule(ctx, c.scheduler, armOperationRead, func() (*armcompute.Disk, error) {
+		return c.Interface.Get(ctx, resourceGroupName, diskName)
+	})
+}
+
+func (c *scheduledDiskClient) List(ctx context.Context, resourceGroupName string) ([]*armcompute.Disk, error) {
+	return schedule(ctx, c.scheduler, armOperationList, func() ([]*armcompute.Disk, error) {
+		return c.Interface.List(ctx, resourceGroupName)
+	})
+}
+
+func (c *scheduledDiskClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, diskName string, disk armcompute.Disk) (*armcompute.Disk, error) {
+	return schedule(ctx, c.scheduler, armOperationWrite, func() (*armcompute.Disk, error) {
+		return c.Interface.CreateOrUpdate(ctx, resourceGroupName, diskName, disk)
+	})
+}
+
+func (c *scheduledDiskClient) Patch(ctx context.Context, resourceGroupName string, diskName string, update armcompute.DiskUpdate) (*armcompute.Disk, error) {
+	return schedule(ctx, c.scheduler, armOperationWrite, func() (*armcompute.Disk, error) {
+		return c.Interface.Patch(ctx, resourceGroupName, diskName, update)
+	})
+}
+
+func (c *scheduledDiskClient) Delete(ctx context.Context, resourceGroupName string, diskName string) error {
+	return scheduleErr(ctx, c.scheduler, armOperationWrite, func() error {
+		return c.Interface.Delete(ctx, resourceGroupName, diskName)
+	})
+}
+
+type scheduledSnapshotClient struct {
+	snapshotclient.Interface
+	scheduler *armScheduler
+}
+
+func (c *scheduledSnapshotClient) Get(ctx context.Context, resourceGroupName string, snapshotName string) (*armcompute.Snapshot, error) {
+	return schedule(ctx, c.scheduler, armOperationRead, func() (*armcompute.Snapshot, error) {
+		return c.Interface.Get(ctx, resourceGroupName, snapshotName)
+	})
+}
+
+func (c *scheduledSnapshotClient) List(ctx context.Context, resourceGroupName string) ([]*armcompute.Snapshot, error) {
+	return schedule(ctx, c.scheduler, armOperationList, func() ([]*armcompute.Snapshot, error) {
+		return c.Interface.List(ctx, resourceGroupName)
+	})
+}
+
+func (c *scheduledSnapshotClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, snapshotName string, snapshot armcompute.Snapshot) (*armcompute.Snapshot, error) {
+	return schedule(ctx, c.scheduler, armOperationWrite, func() (*armcompute.Snapshot, error) {
+		return c.Interface.CreateOrUpdate(ctx, resourceGroupName, snapshotName, snapshot)
+	})
+}
+
+func (c *scheduledSnapshotClient) Delete(ctx context.Context, resourceGroupName string, snapshotName string) error {
+	return scheduleErr(ctx, c.scheduler, armOperationWrite, func() error {
+		return c.Interface.Delete(ctx, resourceGroupName, snapshotName)
+	})
+}
+
+// scheduledVMSet paces the VM updates, the reads of the VMs are served by the VM cache and pass through
+type scheduledVMSet struct {
+	provider.VMSet
+	scheduler *armScheduler
+}
+
+func (vmset *scheduledVMSet) AttachDisk(ctx context.Context, nodeName types.NodeName, diskMap map[string]*provider.AttachDiskOptions) error {
+	return scheduleErr(ctx, vmset.scheduler, armOperationAttach, func() error {
+		return vmset.VMSet.AttachDisk(ctx, nodeName, diskMap)
+	})
+}
+
+func (vmset *scheduledVMSet) DetachDisk(ctx context.Context, nodeName types.NodeName, diskMap map[string]string, forceDetach bool) error {
+	return scheduleErr(ctx, vmset.scheduler, armOperationDetach, func() error {
+		return vmset.VMSet.DetachDisk(ctx, nodeName, diskMap, forceDetach)
+	})
+}
+
+func (vmset *scheduledVMSet) UpdateVM(ctx context.Context, nodeName types.NodeName) error {
+	return scheduleErr(ctx, vmset.scheduler, armOperationWrite, func() error {
+		return vmset.VMSet.UpdateVM(ctx, nodeName)
+	})
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/types"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+func newTestARMScheduler(qps float64, burst int, maxWait time.Duration) (*armScheduler, *clocktesting.FakeClock) {
+	clk := clocktesting.NewFakeClock(time.Now())
+	return newARMSchedulerWithClock(qps, burst, maxWait, clk), clk
+}
+
+// acquireAsync acquires a token in the background, and waits until the request is queued
+func acquireAsync(t *testing.T, s *armScheduler, operation armOperation) <-chan error {
+	s.mu.Lock()
+	queued := len(s.queue)
+	s.mu.Unlock()
+	result := make(chan error, 1)
+	go func() {
+		result <- s.acquire(context.Background(), operation)
+	}()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.queue) > queued
+	}, 5*time.Second, time.Millisecond)
+	return result
+}
+
+// stepUntil advances the clock until the request is done
+func stepUntil(t *testing.T, clk *clocktesting.FakeClock, step time.Duration, result <-chan error) error {
+	for i := 0; i < 100; i++ {
+		assert.Eventually(t, clk.HasWaiters, 5*time.Second, time.Millisecond)
+		clk.Step(step)
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatalf("request is not done")
+	return nil
+}
+
+func assertRetryInfo(t *testing.T, err error, retryAfter time.Duration) {
+	st := status.Convert(err)
+	assert.Equal(t, codes.Unavailable, st.Code(), err)
+	var found bool
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			found = true
+			assert.Equal(t, retryAfter, info.RetryDelay.AsDuration())
+		}
+	}
+	assert.True(t, found, "RetryInfo is missing in %v", st)
+}
+
+func TestARMSchedulerBudget(t *testing.T) {
+	s, clk := newTestARMScheduler(1, 2, 5*time.Second)
+	ctx := context.Background()
+	assert.NoError(t, s.acquire(ctx, armOperationDetach))
+	assert.NoError(t, s.acquire(ctx, armOperationDetach))
+
+	// the third request waits for the budget to be refilled
+	result := acquireAsync(t, s, armOperationDetach)
+	assert.NoError(t, stepUntil(t, clk, 500*time.Millisecond, result))
+
+	// the request fails fast instead of waiting longer than maxWait
+	s.maxWait = 500 * time.Millisecond
+	err := s.acquire(ctx, armOperationDetach)
+	var throttled *armThrottledError
+	assert.True(t, errors.As(err, &throttled))
+	assert.Equal(t, armRejectBudget, throttled.reason)
+	assertRetryInfo(t, err, time.Second)
+	assert.Empty(t, s.queue)
+}
+
+func TestARMSchedulerClassShare(t *testing.T) {
+	s, _ := newTestARMScheduler(10, 20, 0)
+	ctx := context.Background()
+	// the list requests may use a tenth of the budget
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, s.acquire(ctx, armOperationList))
+	}
+	assert.Error(t, s.acquire(ctx, armOperationList))
+	// which leaves the budget to the other classes
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, s.acquire(ctx, armOperationRead))
+	}
+	assert.Error(t, s.acquire(ctx, armOperationRead))
+	for i := 0; i < 8; i++ {
+		assert.NoError(t, s.acquire(ctx, armOperationAttach))
+	}
+	assert.Error(t, s.acquire(ctx, armOperationDetach))
+}
+
+func TestARMSchedulerPriority(t *testing.T) {
+	s, clk := newTestARMScheduler(1, 1, time.Minute)
+	assert.NoError(t, s.acquire(context.Background(), armOperationDetach))
+
+	list := acquireAsync(t, s, armOperationList)
+	attach := acquireAsync(t, s, armOperationAttach)
+	s.mu.Lock()
+	assert.Equal(t, []armOperation{armOperationAttach, armOperationList}, []armOperation{s.queue[0].operation, s.queue[1].operation})
+	s.mu.Unlock()
+
+	// the attach queued after the list gets the next token
+	assert.NoError(t, stepUntil(t, clk, time.Second, attach))
+	select {
+	case err := <-list:
+		t.Fatalf("list is dispatched before attach: %v", err)
+	default:
+	}
+	assert.NoError(t, stepUntil(t, clk, time.Second, list))
+}
+
+func TestARMSchedulerCancel(t *testing.T) {
+	s, _ := newTestARMScheduler(1, 1, time.Minute)
+	assert.NoError(t, s.acquire(context.Background(), armOperationWrite))
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- s.acquire(ctx, armOperationWrite)
+	}()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.queue) == 1
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-result)
+	assert.Empty(t, s.queue)
+}
+
+func TestARMSchedulerRetryAfter(t *testing.T) {
+	s, clk := newTestARMScheduler(10, 20, time.Minute)
+	ctx, hint := withARMRetryHint(context.Background())
+
+	s.observe(ctx, armOperationRead, fmt.Errorf("Retriable: true, RetryAfter: 30s, HTTPStatusCode: 429, RawError: TooManyRequests"))
+	retryAfter, ok := hint.get()
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, retryAfter)
+
+	// the read requests fail fast, the write requests are sent
+	assert.True(t, s.isThrottled(armOperationRead))
+	assert.True(t, s.isThrottled(armOperationList))
+	assert.False(t, s.isThrottled(armOperationAttach))
+	err := s.acquire(context.Background(), armOperationList)
+	var throttled *armThrottledError
+	assert.True(t, errors.As(err, &throttled))
+	assert.Equal(t, armRejectRetryAfter, throttled.reason)
+	assert.Equal(t, 30*time.Second, throttled.retryAfter)
+	assert.NoError(t, s.acquire(context.Background(), armOperationAttach))
+
+	clk.Step(30 * time.Second)
+	assert.False(t, s.isThrottled(armOperationRead))
+	assert.NoError(t, s.acquire(context.Background(), armOperationRead))
+
+	// the other errors are ignored, the throttling errors without RetryAfter block the class for the default delay
+	s.observe(ctx, armOperationWrite, fmt.Errorf("disk not found"))
+	assert.False(t, s.isThrottled(armOperationWrite))
+	s.observe(ctx, armOperationWrite, fmt.Errorf("TooManyRequests"))
+	assert.True(t, s.isThrottled(armOperationDetach))
+	clk.Step(armDefaultRetryAfter)
+	assert.False(t, s.isThrottled(armOperationDetach))
+}
+
+func TestARMSchedulerRejectsQueuedRequestsOfThrottledClass(t *testing.T) {
+	s, _ := newTestARMScheduler(1, 1, time.Minute)
+	assert.NoError(t, s.acquire(context.Background(), armOperationWrite))
+	result := acquireAsync(t, s, armOperationWrite)
+	s.block(false, 20*time.Second)
+	err := <-result
+	var throttled *armThrottledError
+	assert.True(t, errors.As(err, &throttled))
+	assert.Equal(t, 20*time.Second, throttled.retryAfter)
+}
+
+func TestARMSchedulerObserveResponse(t *testing.T) {
+	tests := []struct {
+		desc           string
+		method         string
+		statusCode     int
+		header         http.Header
+		readThrottled  bool
+		writeThrottled bool
+		readTokens     float64
+	}{
+		{
+			desc:       "no rate limit headers",
+			method:     http.MethodGet,
+			statusCode: http.StatusOK,
+			header:     http.Header{},
+			readTokens: 10,
+		},
+		{
+			desc:       "remaining reads lower the read tokens",
+			method:     http.MethodGet,
+			statusCode: http.StatusOK,
+			header:     http.Header{"X-Ms-Ratelimit-Remaining-Subscription-Reads": []string{"3"}},
+			readTokens: 3,
+		},
+		{
+			desc:           "no remaining writes",
+			method:         http.MethodPut,
+			statusCode:     http.StatusOK,
+			header:         http.Header{"X-Ms-Ratelimit-Remaining-Subscription-Writes": []string{"0"}, "Retry-After": []string{"5"}},
+			writeThrottled: true,
+			readTokens:     10,
+		},
+		{
+			desc:          "throttled read",
+			method:        http.MethodGet,
+			statusCode:    http.StatusTooManyRequests,
+			header:        http.Header{},
+			readThrottled: true,
+			readTokens:    10,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			s, _ := newTestARMScheduler(10, 20, time.Minute)
+			s.observeResponse(test.method, &http.Response{StatusCode: test.statusCode, Header: test.header})
+			assert.Equal(t, test.readThrottled, s.isThrottled(armOperationRead))
+			assert.Equal(t, test.writeThrottled, s.isThrottled(armOperationDetach))
+			assert.Equal(t, test.readTokens, s.classes[armOperationRead].bucket.tokens)
+		})
+	}
+}
+
+func TestARMThrottledError(t *testing.T) {
+	err := &armThrottledError{operation: armOperationAttach, retryAfter: 2500 * time.Millisecond, reason: armRejectBudget}
+	assert.Equal(t, "client throttled: ARM attach requests are over the request budget, RetryAfter: 3s", err.Error())
+	assert.True(t, azureutils.IsThrottlingError(err))
+	assert.Equal(t, 3*time.Second, azureutils.GetRetryAfter(err))
+	assertRetryInfo(t, err, 3*time.Second)
+}
+
+func TestARMSchedulerUnaryInterceptor(t *testing.T) {
+	s, _ := newTestARMScheduler(10, 20, time.Minute)
+	tests := []struct {
+		desc     string
+		handler  grpc.UnaryHandler
+		expected codes.Code
+	}{
+		{
+			desc: "internal error of a throttled call",
+			handler: func(ctx context.Context, _ interface{}) (interface{}, error) {
+				setARMRetryHint(ctx, 10*time.Second)
+				return nil, status.Error(codes.Internal, "attach failed")
+			},
+			expected: codes.Unavailable,
+		},
+		{
+			desc: "specific error of a throttled call",
+			handler: func(ctx context.Context, _ interface{}) (interface{}, error) {
+				setARMRetryHint(ctx, 10*time.Second)
+				return nil, status.Error(codes.NotFound, "disk not found")
+			},
+			expected: codes.NotFound,
+		},
+		{
+			desc: "internal error",
+			handler: func(_ context.Context, _ interface{}) (interface{}, error) {
+				return nil, status.Error(codes.Internal, "attach failed")
+			},
+			expected: codes.Internal,
+		},
+		{
+			desc: "success",
+			handler: func(ctx context.Context, _ interface{}) (interface{}, error) {
+				setARMRetryHint(ctx, 10*time.Second)
+				return "ok", nil
+			},
+			expected: codes.OK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := s.unaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, test.handler)
+			assert.Equal(t, test.expected, status.Code(err))
+			if test.expected == codes.Unavailable {
+				assertRetryInfo(t, err, 10*time.Second)
+			}
+		})
+	}
+}
+
+func TestARMSchedulerWrappers(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	var s *armScheduler
+	factory := mock_azclient.NewMockClientFactory(cntl)
+	vmset := provider.NewMockVMSet(cntl)
+	assert.Equal(t, factory, s.wrapClientFactory(factory))
+	assert.Equal(t, vmset, s.wrapVMSet(vmset))
+	assert.False(t, s.isThrottled(armOperationRead))
+
+	s, _ = newTestARMScheduler(10, 20, time.Minute)
+	diskClient := mock_diskclient.NewMockInterface(cntl)
+	factory.EXPECT().GetDiskClient().Return(diskClient).AnyTimes()
+	client := s.wrapClientFactory(factory).GetDiskClient()
+	ctx := context.Background()
+
+	// a throttled write blocks the writes, the reads are still sent
+	diskClient.EXPECT().CreateOrUpdate(gomock.Any(), "rg", "disk", gomock.Any()).Return(nil, fmt.Errorf("Retriable: true, RetryAfter: 60s, HTTPStatusCode: 429, RawError: TooManyRequests")).Times(1)
+	_, err := client.CreateOrUpdate(ctx, "rg", "disk", armcompute.Disk{})
+	assert.Error(t, err)
+	assert.Error(t, client.Delete(ctx, "rg", "disk"))
+	diskClient.EXPECT().Get(gomock.Any(), "rg", "disk").Return(&armcompute.Disk{}, nil).Times(1)
+	_, err = client.Get(ctx, "rg", "disk")
+	assert.NoError(t, err)
+
+	// the VM updates are writes too
+	wrapped := s.wrapVMSet(vmset)
+	assert.Error(t, wrapped.DetachDisk(ctx, types.NodeName("node"), map[string]string{}, false))
+	assert.Error(t, wrapped.UpdateVM(ctx, types.NodeName("node")))
+	vmset.EXPECT().GetDataDisks(types.NodeName("node"), gomock.Any()).Return(nil, nil, nil).Times(1)
+	_, _, err = wrapped.GetDataDisks(types.NodeName("node"), azcache.CacheReadTypeDefault)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,461 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
+)
+
+const (
+	// autoExpandInterval is the interval to report the usage of volumes on the node and to expand them on the controller
+	autoExpandInterval = time.Minute
+	// the auto expansion parameters in the PVC annotations are refreshed on the node at this interval
+	autoExpandConfigRefreshInterval = 5 * time.Minute
+	// the usage of a volume above the threshold is reported again at this interval if its capacity doesn't change
+	volumeUsageReportInterval = 5 * time.Minute
+	// defaultAutoExpandStepPercent is the step of a volume without autoExpandStepGiB in percent of its size
+	defaultAutoExpandStepPercent = 20
+
+	autoExpandThresholdPercentAnnotation = consts.DefaultDriverName + "/autoExpandThresholdPercent"
+	autoExpandStepGiBAnnotation          = consts.DefaultDriverName + "/autoExpandStepGiB"
+	autoExpandMaxGiBAnnotation           = consts.DefaultDriverName + "/autoExpandMaxGiB"
+	// volumeUsageAnnotation is the file system usage of the staged volumes crossing the threshold reported by the node
+	// in its annotation, in JSON of <volume handle, volumeUsage>
+	volumeUsageAnnotation = consts.DefaultDriverName + "/volumeUsage"
+	// volumeUsageLabel labels the nodes reporting volume usage, which are watched by the controller
+	volumeUsageLabel = consts.DefaultDriverName + "/volumeUsageReported"
+	// lastAutoExpandAnnotation is the last expansion of a volume made by the controller
+	lastAutoExpandAnnotation = consts.DefaultDriverName + "/lastAutoExpand"
+)
+
+// autoExpandConfig is the auto expansion parameters of a volume
+type autoExpandConfig struct {
+	thresholdPercent int
+	stepGiB          int64
+	maxGiB           int64
+}
+
+// parseAutoExpandConfig returns the auto expansion parameters of a volume from the storage class parameters in its
+// volume attributes, which are overridden by the PVC annotations, it returns nil if the auto expansion is not enabled
+// or the threshold annotation of the PVC is 0
+func parseAutoExpandConfig(attributes, annotations map[string]string) (*autoExpandConfig, error) {
+	values := map[string]string{}
+	for k, v := range attributes {
+		switch field := strings.ToLower(k); field {
+		case consts.AutoExpandThresholdPercentField, consts.AutoExpandStepGiBField, consts.AutoExpandMaxGiBField:
+			values[field] = v
+		}
+	}
+	for annotation, field := range map[string]string{
+		autoExpandThresholdPercentAnnotation: consts.AutoExpandThresholdPercentField,
+		autoExpandStepGiBAnnotation:          consts.AutoExpandStepGiBField,
+		autoExpandMaxGiBAnnotation:           consts.AutoExpandMaxGiBField,
+	} {
+		if v, ok := annotations[annotation]; ok {
+			values[field] = v
+		}
+	}
+	if values[consts.AutoExpandThresholdPercentField] == "" || values[consts.AutoExpandThresholdPercentField] == "0" {
+		return nil, nil
+	}
+
+	config := &autoExpandConfig{}
+	for field, v := range values {
+		value, err := azureutils.ParseAutoExpandValue(field, v)
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case consts.AutoExpandThresholdPercentField:
+			config.thresholdPercent = value
+		case consts.AutoExpandStepGiBField:
+			config.stepGiB = int64(value)
+		case consts.AutoExpandMaxGiBField:
+			config.maxGiB = int64(value)
+		}
+	}
+	return config, nil
+}
+
+// volumeUsage is the file system usage of a volume reported by the node in the node annotation
+type volumeUsage struct {
+	UsedBytes     int64     `json:"usedBytes"`
+	CapacityBytes int64     `json:"capacityBytes"`
+	Time          time.Time `json:"time"`
+}
+
+// isAboveThreshold checks whether the used percent of a volume is at or above the threshold
+func (u *volumeUsage) isAboveThreshold(thresholdPercent int) bool {
+	return u.CapacityBytes > 0 && u.UsedBytes*100 >= int64(thresholdPercent)*u.CapacityBytes
+}
+
+// autoExpansion is the last expansion of a volume made by the controller in the PVC annotation
+type autoExpansion struct {
+	FromGiB int64 `json:"fromGiB"`
+	ToGiB   int64 `json:"toGiB"`
+	// CapacityBytes is the file system capacity in the usage which triggers the expansion,
+	// the usage is ignored until the file system is expanded
+	CapacityBytes int64     `json:"capacityBytes"`
+	Time          time.Time `json:"time"`
+}
+
+// autoExpandVolume is a staged file system volume whose usage is reported for auto expansion
+type autoExpandVolume struct {
+	pvcNamespace string
+	pvcName      string
+	attributes   map[string]string
+
+	// usage is the latest usage returned by NodeGetVolumeStats
+	mu    sync.Mutex
+	usage volumeUsage
+
+	// the fields below are only accessed by the reporting loop
+	config     *autoExpandConfig
+	configTime time.Time
+	// reported is zero if the usage is not reported
+	reported volumeUsage
+}
+
+// trackAutoExpand starts reporting the usage of a staged file system volume, the PVC is taken from the volume context,
+// which has the PVC name if the external provisioner runs with --extra-create-metadata
+func (d *DriverCore) trackAutoExpand(volumeID string, volumeContext map[string]string, volumeCapability *csi.VolumeCapability) {
+	if !d.enableAutoExpand || volumeCapability.GetBlock() != nil {
+		return
+	}
+	pvcNamespace, pvcName := volumeContext[consts.PvcNamespaceKey], volumeContext[consts.PvcNameKey]
+	if pvcNamespace == "" || pvcName == "" {
+		klog.V(4).Infof("trackAutoExpand: volume %s is not auto expanded since its PVC is unknown", volumeID)
+		return
+	}
+	d.autoExpandVolumes.LoadOrStore(volumeID, &autoExpandVolume{pvcNamespace: pvcNamespace, pvcName: pvcName, attributes: volumeContext})
+}
+
+// untrackAutoExpand stops reporting the usage of an unstaged volume
+func (d *DriverCore) untrackAutoExpand(volumeID string) {
+	d.autoExpandVolumes.Delete(volumeID)
+}
+
+// recordVolumeUsage keeps the file system usage returned by NodeGetVolumeStats of a volume for the reporting loop
+func (d *DriverCore) recordVolumeUsage(volumeID string, usage []*csi.VolumeUsage) {
+	value, ok := d.autoExpandVolumes.Load(volumeID)
+	if !ok {
+		return
+	}
+	v := value.(*autoExpandVolume)
+	for _, u := range usage {
+		if u.GetUnit() == csi.VolumeUsage_BYTES && u.GetTotal() > 0 {
+			v.mu.Lock()
+			v.usage = volumeUsage{UsedBytes: u.GetUsed(), CapacityBytes: u.GetTotal(), Time: time.Now()}
+			v.mu.Unlock()
+		}
+	}
+}
+
+// reportVolumeUsage reports the usage of the staged volumes crossing the threshold in the annotation of the node for the controller to expand them
+func (d *DriverCore) reportVolumeUsage(ctx context.Context) {
+	if d.kubeClient == nil {
+		return
+	}
+	now := time.Now()
+	reports := map[string]volumeUsage{}
+	d.autoExpandVolumes.Range(func(key, value interface{}) bool {
+		v := value.(*autoExpandVolume)
+		if err := d.updateVolumeUsageReport(ctx, v, now); err != nil {
+			klog.Warningf("reportVolumeUsage: failed to report usage of volume %s: %v", key, err)
+		}
+		if !v.reported.Time.IsZero() {
+			reports[key.(string)] = v.reported
+		}
+		return true
+	})
+	// the reports left by the last run of the driver are removed on the first run
+	if d.reportedVolumeUsage != nil && reflect.DeepEqual(reports, d.reportedVolumeUsage) {
+		return
+	}
+
+	var annotation, label interface{}
+	if len(reports) > 0 {
+		value, err := json.Marshal(reports)
+		if err != nil {
+			klog.Warningf("reportVolumeUsage: %v", err)
+			return
+		}
+		annotation, label = string(value), "true"
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{volumeUsageAnnotation: annotation},
+			"labels":      map[string]interface{}{volumeUsageLabel: label},
+		},
+	})
+	if err != nil {
+		klog.Warningf("reportVolumeUsage: %v", err)
+		return
+	}
+	if _, err := d.kubeClient.CoreV1().Nodes().Patch(ctx, d.NodeID, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		klog.Warningf("reportVolumeUsage: failed to report usage of %d volumes on node %s: %v", len(reports), d.NodeID, err)
+		return
+	}
+	d.reportedVolumeUsage = reports
+}
+
+// updateVolumeUsageReport updates the reported usage of a volume with its latest usage if it crosses the threshold
+func (d *DriverCore) updateVolumeUsageReport(ctx context.Context, v *autoExpandVolume, now time.Time) error {
+	v.mu.Lock()
+	usage := v.usage
+	v.mu.Unlock()
+	if !usage.Time.After(v.reported.Time) {
+		return nil
+	}
+	if usage.CapacityBytes == v.reported.CapacityBytes && now.Sub(v.reported.Time) < volumeUsageReportInterval {
+		return nil
+	}
+
+	if now.Sub(v.configTime) >= autoExpandConfigRefreshInterval {
+		pvc, err := d.kubeClient.CoreV1().PersistentVolumeClaims(v.pvcNamespace).Get(ctx, v.pvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		// an invalid annotation is not checked again until the next refresh
+		v.config, v.configTime = nil, now
+		if v.config, err = parseAutoExpandConfig(v.attributes, pvc.Annotations); err != nil {
+			v.reported = volumeUsage{}
+			return err
+		}
+	}
+	if v.config == nil || !usage.isAboveThreshold(v.config.thresholdPercent) {
+		v.reported = volumeUsage{}
+		return nil
+	}
+	klog.V(2).Infof("reportVolumeUsage: %d of %d bytes of PVC %s/%s are used", usage.UsedBytes, usage.CapacityBytes, v.pvcNamespace, v.pvcName)
+	v.reported = usage
+	return nil
+}
+
+// autoExpand expands the volumes whose usage reported by the nodes crosses the threshold, it only runs on the controller leader.
+// The usage reported by a node is only accepted for the volumes attached to the node.
+func (d *DriverCore) autoExpand(ctx context.Context) {
+	if d.volumeUsageNodeLister == nil || !d.leader.isLeader() {
+		return
+	}
+	nodes, err := d.volumeUsageNodeLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("autoExpand: failed to list nodes: %v", err)
+		return
+	}
+	vas, err := d.volumeAttachmentLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("autoExpand: failed to list volume attachments: %v", err)
+		return
+	}
+	attached := map[string][]string{}
+	for pvName, pvAttachments := range d.groupVolumeAttachments(vas) {
+		for _, va := range pvAttachments {
+			if va.Status.Attached {
+				attached[va.Spec.NodeName] = append(attached[va.Spec.NodeName], pvName)
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		var reports map[string]volumeUsage
+		if err := json.Unmarshal([]byte(node.Annotations[volumeUsageAnnotation]), &reports); err != nil {
+			klog.Warningf("autoExpand: invalid annotation %s of node %s: %v", volumeUsageAnnotation, node.Name, err)
+			continue
+		}
+		for volumeHandle, usage := range reports {
+			if err := d.autoExpandVolume(ctx, volumeHandle, usage, node.Name, attached[node.Name]); err != nil {
+				klog.Warningf("autoExpand: failed to expand volume %s reported by node %s: %v", volumeHandle, node.Name, err)
+			}
+		}
+	}
+}
+
+// autoExpandVolume expands the PVC of a volume attached to the node which reports its usage
+func (d *DriverCore) autoExpandVolume(ctx context.Context, volumeHandle string, usage volumeUsage, nodeName string, pvNames []string) error {
+	for _, pvName := range pvNames {
+		volume, err := d.getAttachedVolume(ctx, pvName)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(volume.volumeHandle, volumeHandle) {
+			continue
+		}
+		if volume.claimName == "" {
+			return nil
+		}
+		pvc, err := d.kubeClient.CoreV1().PersistentVolumeClaims(volume.claimNamespace).Get(ctx, volume.claimName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pvc.Spec.VolumeName != pvName {
+			return nil
+		}
+		return d.autoExpandPVC(ctx, pvc, volume.attributes, usage)
+	}
+	return fmt.Errorf("volume is not attached to node %s", nodeName)
+}
+
+// autoExpandPVC expands the PVC of a volume with the attributes of its PV if the usage crosses the threshold
+func (d *DriverCore) autoExpandPVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim, attributes map[string]string, usage volumeUsage) error {
+	var last autoExpansion
+	if value, ok := pvc.Annotations[lastAutoExpandAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &last); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", lastAutoExpandAnnotation, err)
+		}
+	}
+	// the usage is reported before the file system is expanded
+	if usage.CapacityBytes <= last.CapacityBytes {
+		return nil
+	}
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	capacity := pvc.Status.Capacity[corev1.ResourceStorage]
+	if requested.Cmp(capacity) > 0 {
+		return nil
+	}
+	for _, condition := range pvc.Status.Conditions {
+		if condition.Type == corev1.PersistentVolumeClaimResizing || condition.Type == corev1.PersistentVolumeClaimFileSystemResizePending {
+			return nil
+		}
+	}
+
+	config, err := parseAutoExpandConfig(attributes, pvc.Annotations)
+	if err != nil {
+		return err
+	}
+	if config == nil || !usage.isAboveThreshold(config.thresholdPercent) {
+		return nil
+	}
+
+	currentGiB := volumehelper.RoundUpGiB(capacity.Value())
+	sizeGiB, limit := getAutoExpandSize(currentGiB, config, attributes)
+	if sizeGiB <= currentGiB {
+		// the warning is recorded once for each size of the PVC
+		if warned, ok := d.autoExpandLimitWarnings.Load(pvc.UID); !ok || warned.(int64) != currentGiB {
+			d.autoExpandLimitWarnings.Store(pvc.UID, currentGiB)
+			d.recordAutoExpandEvent(pvc, corev1.EventTypeWarning, "AutoExpandLimitReached",
+				fmt.Sprintf("volume of %dGiB could not be expanded further, it's capped by %s", currentGiB, limit))
+		}
+		return nil
+	}
+
+	value, err := json.Marshal(autoExpansion{FromGiB: currentGiB, ToGiB: sizeGiB, CapacityBytes: usage.CapacityBytes, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	// the resource version makes the patch fail if the PVC is changed after it's read
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": pvc.ResourceVersion,
+			"annotations":     map[string]string{lastAutoExpandAnnotation: string(value)},
+		},
+		"spec": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requests": map[string]string{string(corev1.ResourceStorage): fmt.Sprintf("%dGi", sizeGiB)},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := d.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(ctx, pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	d.recordAutoExpandEvent(pvc, corev1.EventTypeNormal, "AutoExpand",
+		fmt.Sprintf("expanding volume from %dGiB to %dGiB since %d of %d bytes are used", currentGiB, sizeGiB, usage.UsedBytes, usage.CapacityBytes))
+	return nil
+}
+
+func (d *DriverCore) recordAutoExpandEvent(pvc *corev1.PersistentVolumeClaim, eventType, reason, message string) {
+	klog.V(2).Infof("autoExpand: PVC %s/%s: %s", pvc.Namespace, pvc.Name, message)
+	if d.eventRecorder != nil {
+		d.eventRecorder.Event(pvc, eventType, reason, message)
+	}
+}
+
+// getAutoExpandSize returns the size in GiB to expand a volume to, and the limit it's capped by if it's not larger than the current size
+func getAutoExpandSize(currentGiB int64, config *autoExpandConfig, attributes map[string]string) (int64, string) {
+	diskCount := int64(1)
+	var sku string
+	for k, v := range attributes {
+		switch strings.ToLower(k) {
+		case consts.StripeCountField:
+			if count, err := strconv.Atoi(v); err == nil && count > 1 {
+				diskCount = int64(count)
+			}
+		case consts.SkuNameField, consts.StorageAccountTypeField:
+			sku = v
+		}
+	}
+
+	stepGiB := config.stepGiB
+	if stepGiB == 0 {
+		stepGiB = (currentGiB*defaultAutoExpandStepPercent + 99) / 100
+	}
+	sizeGiB, limit := currentGiB+stepGiB, ""
+	if config.maxGiB > 0 && sizeGiB > config.maxGiB {
+		sizeGiB, limit = config.maxGiB, fmt.Sprintf("autoExpandMaxGiB(%d)", config.maxGiB)
+	}
+	// the size of a striped volume is split among its disks
+	if maxDiskGiB := getMaxDiskSizeGiB(sku); maxDiskGiB > 0 && sizeGiB > maxDiskGiB*diskCount {
+		sizeGiB, limit = maxDiskGiB*diskCount, fmt.Sprintf("the maximum disk size %dGiB of %s", maxDiskGiB, sku)
+	}
+	// AttachDisk turns off host caching on disks of 4 TiB and larger, so a cached disk is not expanded across the boundary
+	cachingLimitGiB := (diskCachingLimit - 1) * diskCount
+	if cachingMode, err := azureutils.GetCachingMode(attributes); err == nil && cachingMode != armcompute.CachingTypesNone &&
+		!isProvisionedPerfSku(sku) && currentGiB <= cachingLimitGiB && sizeGiB > cachingLimitGiB {
+		sizeGiB, limit = cachingLimitGiB, fmt.Sprintf("the host caching limit %dGiB of each disk with cachingMode %s", diskCachingLimit-1, cachingMode)
+	}
+	return sizeGiB, limit
+}
+
+// getMaxDiskSizeGiB returns the largest disk size of a SKU in the SKU catalog, or 0 if the SKU is unknown
+func getMaxDiskSizeGiB(sku string) int64 {
+	var maxSizeGiB int
+	for _, info := range optimization.GetDiskSkuInfoMap()[strings.ToLower(sku)] {
+		if info.MaxSizeGiB > maxSizeGiB {
+			maxSizeGiB = info.MaxSizeGiB
+		}
+	}
+	return int64(maxSizeGiB)
+}
+
+// isProvisionedPerfSku checks whether a SKU has provisioned performance, e.g. PremiumV2_LRS and UltraSSD_LRS, which doesn't support host caching
+func isProvisionedPerfSku(sku string) bool {
+	sku = strings.ToLower(sku)
+	return strings.HasPrefix(sku, "premiumv2") || strings.HasPrefix(sku, "ultrassd")
+}
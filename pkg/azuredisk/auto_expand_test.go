@@ -0,0 +1,336 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+func TestParseAutoExpandConfig(t *testing.T) {
+	tests := []struct {
+		desc          string
+		attributes    map[string]string
+		annotations   map[string]string
+		expected      *autoExpandConfig
+		expectedError bool
+	}{
+		{
+			desc:     "not enabled",
+			expected: nil,
+		},
+		{
+			desc:       "storage class parameters",
+			attributes: map[string]string{"autoExpandThresholdPercent": "80", "autoExpandStepGiB": "10", "skuName": "Premium_LRS"},
+			expected:   &autoExpandConfig{thresholdPercent: 80, stepGiB: 10},
+		},
+		{
+			desc:        "PVC annotations override storage class parameters",
+			attributes:  map[string]string{"autoExpandThresholdPercent": "80", "autoExpandStepGiB": "10"},
+			annotations: map[string]string{autoExpandThresholdPercentAnnotation: "90", autoExpandMaxGiBAnnotation: "1024"},
+			expected:    &autoExpandConfig{thresholdPercent: 90, stepGiB: 10, maxGiB: 1024},
+		},
+		{
+			desc:        "disabled by PVC annotation",
+			attributes:  map[string]string{"autoExpandThresholdPercent": "80"},
+			annotations: map[string]string{autoExpandThresholdPercentAnnotation: "0"},
+			expected:    nil,
+		},
+		{
+			desc:          "invalid PVC annotation",
+			annotations:   map[string]string{autoExpandThresholdPercentAnnotation: "80", autoExpandStepGiBAnnotation: "-1"},
+			expectedError: true,
+		},
+	}
+	for _, test := range tests {
+		config, err := parseAutoExpandConfig(test.attributes, test.annotations)
+		assert.Equal(t, test.expectedError, err != nil, test.desc)
+		assert.Equal(t, test.expected, config, test.desc)
+	}
+}
+
+func TestGetAutoExpandSize(t *testing.T) {
+	tests := []struct {
+		desc          string
+		currentGiB    int64
+		config        autoExpandConfig
+		attributes    map[string]string
+		expected      int64
+		expectedLimit string
+	}{
+		{
+			desc:       "default step",
+			currentGiB: 100,
+			attributes: map[string]string{"skuName": "Premium_LRS", "cachingMode": "None"},
+			expected:   120,
+		},
+		{
+			desc:       "default step is at least 1GiB",
+			currentGiB: 1,
+			expected:   2,
+		},
+		{
+			desc:          "capped by autoExpandMaxGiB",
+			currentGiB:    100,
+			config:        autoExpandConfig{stepGiB: 50, maxGiB: 120},
+			expected:      120,
+			expectedLimit: "autoExpandMaxGiB(120)",
+		},
+		{
+			desc:          "capped by the maximum disk size of the SKU",
+			currentGiB:    32000,
+			config:        autoExpandConfig{stepGiB: 1000},
+			attributes:    map[string]string{"skuName": "Premium_LRS", "cachingMode": "None"},
+			expected:      32767,
+			expectedLimit: "the maximum disk size 32767GiB of Premium_LRS",
+		},
+		{
+			desc:          "cached disk is not expanded across the host caching limit",
+			currentGiB:    4000,
+			config:        autoExpandConfig{stepGiB: 200},
+			attributes:    map[string]string{"skuName": "Premium_LRS"},
+			expected:      4095,
+			expectedLimit: "the host caching limit 4095GiB of each disk with cachingMode ReadOnly",
+		},
+		{
+			desc:          "striped volume is capped by the host caching limit of each disk",
+			currentGiB:    8000,
+			config:        autoExpandConfig{stepGiB: 1000},
+			attributes:    map[string]string{"skuName": "Premium_LRS", "cachingMode": "ReadWrite", "stripeCount": "2"},
+			expected:      8190,
+			expectedLimit: "the host caching limit 4095GiB of each disk with cachingMode ReadWrite",
+		},
+		{
+			desc:       "disk without host caching",
+			currentGiB: 4000,
+			config:     autoExpandConfig{stepGiB: 200},
+			attributes: map[string]string{"skuName": "Premium_LRS", "cachingMode": "None"},
+			expected:   4200,
+		},
+		{
+			desc:       "disk without host caching support",
+			currentGiB: 4000,
+			config:     autoExpandConfig{stepGiB: 200},
+			attributes: map[string]string{"skuName": "PremiumV2_LRS"},
+			expected:   4200,
+		},
+	}
+	for _, test := range tests {
+		sizeGiB, limit := getAutoExpandSize(test.currentGiB, &test.config, test.attributes)
+		assert.Equal(t, test.expected, sizeGiB, test.desc)
+		assert.Equal(t, test.expectedLimit, limit, test.desc)
+	}
+}
+
+func TestReportVolumeUsage(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pvc-1"},
+	}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{volumeUsageLabel: "true"},
+			Annotations: map[string]string{volumeUsageAnnotation: `{"vol-unstaged":{}}`}},
+	}
+	d := &DriverCore{}
+	d.NodeID = "node-1"
+	d.enableAutoExpand = true
+	d.kubeClient = fake.NewSimpleClientset(pvc, node)
+	volumeContext := map[string]string{consts.PvcNamespaceKey: "default", consts.PvcNameKey: "pvc-1", "autoExpandThresholdPercent": "80"}
+	mountCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+	blockCapability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+
+	// block volumes and volumes without PVC are not tracked
+	d.trackAutoExpand("vol-block", volumeContext, blockCapability)
+	d.trackAutoExpand("vol-static", map[string]string{"autoExpandThresholdPercent": "80"}, mountCapability)
+	d.trackAutoExpand("vol-1", volumeContext, mountCapability)
+	for volumeID, expected := range map[string]bool{"vol-block": false, "vol-static": false, "vol-1": true} {
+		_, ok := d.autoExpandVolumes.Load(volumeID)
+		assert.Equal(t, expected, ok, volumeID)
+	}
+
+	getReports := func() (map[string]volumeUsage, bool) {
+		node, err := d.kubeClient.CoreV1().Nodes().Get(context.TODO(), "node-1", metav1.GetOptions{})
+		assert.NoError(t, err)
+		value, ok := node.Annotations[volumeUsageAnnotation]
+		if !ok {
+			assert.Empty(t, node.Labels[volumeUsageLabel])
+			return nil, false
+		}
+		assert.Equal(t, "true", node.Labels[volumeUsageLabel])
+		var reports map[string]volumeUsage
+		assert.NoError(t, json.Unmarshal([]byte(value), &reports))
+		return reports, true
+	}
+
+	// the usage below the threshold is not reported, and the reports left by the last run are removed
+	d.recordVolumeUsage("vol-1", []*csi.VolumeUsage{
+		{Unit: csi.VolumeUsage_BYTES, Used: 70, Total: 100},
+		{Unit: csi.VolumeUsage_INODES, Used: 90, Total: 100},
+	})
+	d.reportVolumeUsage(context.TODO())
+	_, ok := getReports()
+	assert.False(t, ok)
+
+	d.recordVolumeUsage("vol-1", []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Used: 85, Total: 100}})
+	d.reportVolumeUsage(context.TODO())
+	reports, _ := getReports()
+	assert.Equal(t, int64(85), reports["vol-1"].UsedBytes)
+	assert.Equal(t, int64(100), reports["vol-1"].CapacityBytes)
+
+	// the usage of the same capacity is not reported again until the report interval
+	d.recordVolumeUsage("vol-1", []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Used: 90, Total: 100}})
+	d.reportVolumeUsage(context.TODO())
+	reports, _ = getReports()
+	assert.Equal(t, int64(85), reports["vol-1"].UsedBytes)
+
+	// the report of an unstaged volume is removed
+	d.untrackAutoExpand("vol-1")
+	_, ok = d.autoExpandVolumes.Load("vol-1")
+	assert.False(t, ok)
+	d.reportVolumeUsage(context.TODO())
+	_, ok = getReports()
+	assert.False(t, ok)
+}
+
+func TestAutoExpand(t *testing.T) {
+	report := func(node *corev1.Node, usage volumeUsage) *corev1.Node {
+		value, _ := json.Marshal(map[string]volumeUsage{"/disks/pv-1": usage})
+		node.Labels = map[string]string{volumeUsageLabel: "true"}
+		node.Annotations = map[string]string{volumeUsageAnnotation: string(value)}
+		return node
+	}
+	usage := volumeUsage{UsedBytes: 90 * 1024 * 1024 * 1024, CapacityBytes: 98 * 1024 * 1024 * 1024, Time: time.Now()}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pvc-1", UID: "uid-1"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			VolumeName: "pv-1",
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("100Gi")},
+			},
+		},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("100Gi")},
+		},
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:           consts.DefaultDriverName,
+					VolumeHandle:     "/disks/pv-1",
+					VolumeAttributes: map[string]string{"skuName": "Premium_LRS", "autoExpandThresholdPercent": "80", "autoExpandMaxGiB": "130"},
+				},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "pvc-1"},
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	d, kubeClient := newTestLeaderDriver(t, pvc, pv,
+		report(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}, usage),
+		// the volume is not attached to node-2
+		report(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}}, volumeUsage{UsedBytes: 100, CapacityBytes: 100, Time: time.Now()}),
+		newTestVolumeAttachment("pv-1", "node-1", "0"),
+	)
+	d.eventRecorder = recorder
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.volumeUsageInformers = informers.NewSharedInformerFactory(kubeClient, 0)
+	d.volumeUsageNodeLister = d.volumeUsageInformers.Core().V1().Nodes().Lister()
+	d.volumeUsageInformers.Start(ctx.Done())
+	d.volumeUsageInformers.WaitForCacheSync(ctx.Done())
+
+	getPVC := func() *corev1.PersistentVolumeClaim {
+		pvc, err := kubeClient.CoreV1().PersistentVolumeClaims("default").Get(context.TODO(), "pvc-1", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return pvc
+	}
+	updateReport := func(usage volumeUsage) {
+		_, err := kubeClient.CoreV1().Nodes().Update(context.TODO(), report(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}, usage), metav1.UpdateOptions{})
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			node, err := d.volumeUsageNodeLister.Get("node-1")
+			return err == nil && strings.Contains(node.Annotations[volumeUsageAnnotation], strconv.FormatInt(usage.UsedBytes, 10))
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// only the leader expands the volumes
+	leaderLease := d.leader.lease
+	d.leader.lease = nil
+	d.autoExpand(context.TODO())
+	size := getPVC().Spec.Resources.Requests[corev1.ResourceStorage]
+	assert.Equal(t, "100Gi", size.String())
+	d.leader.lease = leaderLease
+
+	d.autoExpand(context.TODO())
+	expanded := getPVC()
+	size = expanded.Spec.Resources.Requests[corev1.ResourceStorage]
+	assert.Equal(t, "120Gi", size.String())
+	var last autoExpansion
+	assert.NoError(t, json.Unmarshal([]byte(expanded.Annotations[lastAutoExpandAnnotation]), &last))
+	assert.Equal(t, autoExpansion{FromGiB: 100, ToGiB: 120, CapacityBytes: 98 * 1024 * 1024 * 1024, Time: last.Time}, last)
+
+	// the volume is not expanded again until the file system is expanded
+	expanded.Status.Capacity[corev1.ResourceStorage] = resource.MustParse("120Gi")
+	_, err := kubeClient.CoreV1().PersistentVolumeClaims("default").UpdateStatus(context.TODO(), expanded, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	d.autoExpand(context.TODO())
+	size = getPVC().Spec.Resources.Requests[corev1.ResourceStorage]
+	assert.Equal(t, "120Gi", size.String())
+
+	// the volume is capped by autoExpandMaxGiB
+	updateReport(volumeUsage{UsedBytes: 110 * 1024 * 1024 * 1024, CapacityBytes: 118 * 1024 * 1024 * 1024, Time: time.Now()})
+	d.autoExpand(context.TODO())
+	size = getPVC().Spec.Resources.Requests[corev1.ResourceStorage]
+	assert.Equal(t, "130Gi", size.String())
+
+	// the limit is warned once
+	expanded = getPVC()
+	expanded.Status.Capacity[corev1.ResourceStorage] = resource.MustParse("130Gi")
+	_, err = kubeClient.CoreV1().PersistentVolumeClaims("default").UpdateStatus(context.TODO(), expanded, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	updateReport(volumeUsage{UsedBytes: 125 * 1024 * 1024 * 1024, CapacityBytes: 128 * 1024 * 1024 * 1024, Time: time.Now()})
+	d.autoExpand(context.TODO())
+	d.autoExpand(context.TODO())
+	size = getPVC().Spec.Resources.Requests[corev1.ResourceStorage]
+	assert.Equal(t, "130Gi", size.String())
+
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.Equal(t, []string{
+		"Normal AutoExpand expanding volume from 100GiB to 120GiB since 96636764160 of 105226698752 bytes are used",
+		"Normal AutoExpand expanding volume from 120GiB to 130GiB since 118111600640 of 126701535232 bytes are used",
+		"Warning AutoExpandLimitReached volume of 130GiB could not be expanded further, it's capped by autoExpandMaxGiB(130)",
+	}, events)
+}
@@ -36,7 +36,17 @@ import (
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
 )
 
-const sysClassBlockPath = "/sys/class/block/"
+const (
+	sysClassBlockPath = "/sys/class/block/"
+
+	// nvmeDataDiskByLunPath is populated by the udev rules of azure-vm-utils with the links of data disks, e.g. /dev/disk/azure/data/by-lun/0
+	nvmeDataDiskByLunPath = "/dev/disk/azure/data/by-lun"
+	sysClassNVMePath      = "/sys/class/nvme"
+	// data disks are namespaces of the NVMe controller of remote disks on the VMs without SCSI, the namespace ID of a data disk
+	// is its LUN plus nvmeDataDiskNamespaceOffset since the namespace 1 is the OS disk
+	azureRemoteDiskNVMeModel    = "MSFT NVMe Accelerator v1.0"
+	nvmeDataDiskNamespaceOffset = 2
+)
 
 // exclude those used by azure as resource and OS root in /dev/disk/azure, /dev/disk/azure/scsi0
 // "/dev/disk/azure/scsi0" dir is populated in Standard_DC4s/DC2s on Ubuntu 18.04
@@ -98,7 +108,55 @@ func scsiHostRescan(io azureutils.IOHandler, _ *mount.SafeFormatAndMount) {
 
 func findDiskByLun(lun int, io azureutils.IOHandler, _ *mount.SafeFormatAndMount) (string, error) {
 	azureDisks := listAzureDiskPath(io)
-	return findDiskByLunWithConstraint(lun, io, azureDisks)
+	devicePath, err := findDiskByLunWithConstraint(lun, io, azureDisks)
+	if err != nil || devicePath != "" {
+		return devicePath, err
+	}
+	return findNVMeDiskByLun(lun, io)
+}
+
+// findNVMeDiskByLun finds the data disk with the LUN on the VMs which expose remote disks as NVMe namespaces,
+// e.g. /dev/nvme0n2 for LUN 0, an empty path is returned if the disk is not found
+func findNVMeDiskByLun(lun int, io azureutils.IOHandler) (string, error) {
+	linkPath := filepath.Join(nvmeDataDiskByLunPath, strconv.Itoa(lun))
+	if target, err := io.Readlink(linkPath); err == nil && strings.HasPrefix(filepath.Base(target), "nvme") {
+		klog.V(4).Infof("azureDisk - found %s by lun %d", linkPath, lun)
+		return linkPath, nil
+	}
+
+	controllers, err := io.ReadDir(sysClassNVMePath)
+	if err != nil {
+		klog.V(6).Infof("azureDisk - failed to read %s, err %v", sysClassNVMePath, err)
+		return "", nil
+	}
+	for _, controller := range controllers {
+		controllerPath := filepath.Join(sysClassNVMePath, controller.Name())
+		model, err := io.ReadFile(filepath.Join(controllerPath, "model"))
+		if err != nil || strings.TrimSpace(string(model)) != azureRemoteDiskNVMeModel {
+			continue
+		}
+		namespaces, err := io.ReadDir(controllerPath)
+		if err != nil {
+			klog.Warningf("failed to read %s, err %v", controllerPath, err)
+			continue
+		}
+		for _, namespace := range namespaces {
+			// look for namespaces like /sys/class/nvme/nvme0/nvme0n2
+			if !strings.HasPrefix(namespace.Name(), controller.Name()+"n") {
+				continue
+			}
+			nsid, err := io.ReadFile(filepath.Join(controllerPath, namespace.Name(), "nsid"))
+			if err != nil {
+				klog.Warningf("failed to read the namespace ID of %s, err %v", namespace.Name(), err)
+				continue
+			}
+			if id, err := strconv.Atoi(strings.TrimSpace(string(nsid))); err == nil && id == lun+nvmeDataDiskNamespaceOffset {
+				klog.V(4).Infof("azureDisk - found /dev/%s by lun %d on NVMe controller %s", namespace.Name(), lun, controller.Name())
+				return "/dev/" + namespace.Name(), nil
+			}
+		}
+	}
+	return "", nil
 }
 
 func formatAndMount(source, target, fstype string, options []string, m *mount.SafeFormatAndMount) error {
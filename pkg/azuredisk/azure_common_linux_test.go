@@ -17,9 +17,14 @@ limitations under the License.
 package azuredisk
 
 import (
+	"fmt"
+	"os"
 	"runtime"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
 )
 
@@ -32,3 +37,92 @@ func TestRescanAllVolumes(t *testing.T) {
 		t.Errorf("rescanAllVolumes failed with error: %v", err)
 	}
 }
+
+// nvmeIOHandler serves the sysfs of a VM which exposes remote disks as NVMe namespaces, without any SCSI data disk
+type nvmeIOHandler struct {
+	azureutils.IOHandler
+	dirs  map[string][]string
+	files map[string]string
+	links map[string]string
+}
+
+func (h *nvmeIOHandler) ReadDir(dirname string) ([]os.DirEntry, error) {
+	names, ok := h.dirs[dirname]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", dirname)
+	}
+	var entries []os.DirEntry
+	for _, name := range names {
+		entries = append(entries, nvmeDirEntry(name))
+	}
+	return entries, nil
+}
+
+func (h *nvmeIOHandler) ReadFile(filename string) ([]byte, error) {
+	if content, ok := h.files[filename]; ok {
+		return []byte(content), nil
+	}
+	return nil, fmt.Errorf("%s not found", filename)
+}
+
+func (h *nvmeIOHandler) Readlink(name string) (string, error) {
+	if target, ok := h.links[name]; ok {
+		return target, nil
+	}
+	return "", fmt.Errorf("%s not found", name)
+}
+
+func (h *nvmeIOHandler) WriteFile(string, []byte, os.FileMode) error {
+	return nil
+}
+
+type nvmeDirEntry string
+
+func (e nvmeDirEntry) Name() string               { return string(e) }
+func (e nvmeDirEntry) IsDir() bool                { return true }
+func (e nvmeDirEntry) Type() os.FileMode          { return os.ModeDir }
+func (e nvmeDirEntry) Info() (os.FileInfo, error) { return nil, fmt.Errorf("not supported") }
+
+func TestGetDevicePathWithLUNOfNVMe(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+
+	handler := &nvmeIOHandler{
+		dirs: map[string][]string{
+			"/sys/bus/scsi/devices": {},
+			"/sys/class/nvme":       {"nvme0", "nvme1"},
+			// the local temp disk is on another controller
+			"/sys/class/nvme/nvme0": {"nvme0n1", "nvme0n2", "nvme0n3", "device"},
+			"/sys/class/nvme/nvme1": {"nvme1n1"},
+		},
+		files: map[string]string{
+			"/sys/class/nvme/nvme0/model":        "MSFT NVMe Accelerator v1.0              \n",
+			"/sys/class/nvme/nvme0/nvme0n1/nsid": "1\n",
+			"/sys/class/nvme/nvme0/nvme0n2/nsid": "2\n",
+			"/sys/class/nvme/nvme0/nvme0n3/nsid": "3\n",
+			"/sys/class/nvme/nvme1/model":        "Microsoft NVMe Direct Disk              \n",
+			"/sys/class/nvme/nvme1/nvme1n1/nsid": "1\n",
+		},
+		links: map[string]string{},
+	}
+	d.ioHandler = handler
+
+	devicePath, err := d.getDevicePathWithLUN("0")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/nvme0n2", devicePath)
+	devicePath, err = d.getDevicePathWithLUN("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/nvme0n3", devicePath)
+
+	// the links of azure-vm-utils are preferred
+	handler.links["/dev/disk/azure/data/by-lun/1"] = "../../../../nvme0n3"
+	devicePath, err = d.getDevicePathWithLUN("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/disk/azure/data/by-lun/1", devicePath)
+
+	// a data disk which is not attached yet is not found on the controller of the temp disk
+	devicePath, err = findDiskByLun(2, handler, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, devicePath)
+}
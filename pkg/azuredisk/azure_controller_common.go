@@ -32,6 +32,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
 
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/apimachinery/pkg/types"
 	kwait "k8s.io/apimachinery/pkg/util/wait"
 	cloudprovider "k8s.io/cloud-provider"
@@ -102,6 +103,12 @@ type controllerCommon struct {
 	// AttachDetachInitialDelayInMs determines initial delay in milliseconds for batch disk attach/detach
 	AttachDetachInitialDelayInMs int
 	ForceDetachBackoff           bool
+	// records the disk attach/detach and the VM updates instead of executing them in the dry run, nil if the dry run is disabled
+	dryRun *dryRunRecorder
+	// paces the disk attach/detach and the VM updates, nil if the ARM request scheduler is disabled
+	armScheduler *armScheduler
+	// guards cloud and clientFactory, which are swapped when the cloud config is reloaded
+	cloudMutex sync.RWMutex
 }
 
 // ExtendedLocation contains additional info about the location of resources.
@@ -112,84 +119,82 @@ type ExtendedLocation struct {
 	Type string `json:"type,omitempty"`
 }
 
+// getCloud returns the cloud provider of the controller
+func (c *controllerCommon) getCloud() *provider.Cloud {
+	c.cloudMutex.RLock()
+	defer c.cloudMutex.RUnlock()
+	return c.cloud
+}
+
+// getClientFactory returns the client factory of the disks
+func (c *controllerCommon) getClientFactory() azclient.ClientFactory {
+	c.cloudMutex.RLock()
+	defer c.cloudMutex.RUnlock()
+	return c.clientFactory
+}
+
+// getNodeVMSet returns the VMSet of the node, the VM updates are paced by the ARM request scheduler and recorded instead of executed in the dry run
+func (c *controllerCommon) getNodeVMSet(nodeName types.NodeName, crt azcache.AzureCacheReadType) (provider.VMSet, error) {
+	vmset, err := c.getCloud().GetNodeVMSet(nodeName, crt)
+	if err != nil {
+		return nil, err
+	}
+	return c.dryRun.wrapVMSet(c.armScheduler.wrapVMSet(vmset)), nil
+}
+
+// setCloud swaps the cloud provider and the client factory, the disk attach/detach queues and the node locks are kept
+func (c *controllerCommon) setCloud(cloud *provider.Cloud, clientFactory azclient.ClientFactory) {
+	c.cloudMutex.Lock()
+	defer c.cloudMutex.Unlock()
+	c.cloud = cloud
+	c.clientFactory = clientFactory
+}
+
 // AttachDisk attaches a disk to vm
 // occupiedLuns is used to avoid conflict with other disk attach in k8s VolumeAttachments
 // return (lun, error)
 func (c *controllerCommon) AttachDisk(ctx context.Context, diskName, diskURI string, nodeName types.NodeName,
 	cachingMode armcompute.CachingTypes, disk *armcompute.Disk, occupiedLuns []int) (int32, error) {
-	diskEncryptionSetID := ""
-	writeAcceleratorEnabled := false
-
-	// there is possibility that disk is nil when GetDisk is throttled
-	// don't check disk state when GetDisk is throttled
-	if disk != nil {
-		if disk.ManagedBy != nil && (disk.Properties == nil || disk.Properties.MaxShares == nil || *disk.Properties.MaxShares <= 1) {
-			vmset, err := c.cloud.GetNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
-			if err != nil {
-				return -1, err
-			}
-			attachedNode, err := vmset.GetNodeNameByProviderID(*disk.ManagedBy)
-			if err != nil {
-				return -1, err
-			}
-			if strings.EqualFold(string(nodeName), string(attachedNode)) {
-				klog.Warningf("volume %s is actually attached to current node %s, invalidate vm cache and return error", diskURI, nodeName)
-				// update VM(invalidate vm cache)
-				if errUpdate := c.UpdateVM(ctx, nodeName); errUpdate != nil {
-					return -1, errUpdate
-				}
-				lun, _, err := c.GetDiskLun(diskName, diskURI, nodeName)
-				return lun, err
-			}
-
-			attachErr := fmt.Sprintf(
-				"disk(%s) already attached to node(%s), could not be attached to node(%s)",
-				diskURI, *disk.ManagedBy, nodeName)
-			klog.V(2).Infof("found dangling volume %s attached to node %s, could not be attached to node(%s)", diskURI, attachedNode, nodeName)
-			return -1, volerr.NewDanglingError(attachErr, attachedNode, "")
-		}
-
-		if disk.Properties != nil {
-			if disk.Properties.DiskSizeGB != nil && *disk.Properties.DiskSizeGB >= diskCachingLimit && cachingMode != armcompute.CachingTypesNone {
-				// Disk Caching is not supported for disks 4 TiB and larger
-				// https://docs.microsoft.com/en-us/azure/virtual-machines/premium-storage-performance#disk-caching
-				cachingMode = armcompute.CachingTypesNone
-				klog.Warningf("size of disk(%s) is %dGB which is bigger than limit(%dGB), set cacheMode as None",
-					diskURI, *disk.Properties.DiskSizeGB, diskCachingLimit)
-			}
-
-			if disk.Properties.Encryption != nil &&
-				disk.Properties.Encryption.DiskEncryptionSetID != nil {
-				diskEncryptionSetID = *disk.Properties.Encryption.DiskEncryptionSetID
-			}
-
-			if disk.Properties.DiskState != nil && *disk.Properties.DiskState != armcompute.DiskStateUnattached && (disk.Properties.MaxShares == nil || *disk.Properties.MaxShares <= 1) {
-				return -1, fmt.Errorf("state of disk(%s) is %s, not in expected %s state", diskURI, *disk.Properties.DiskState, armcompute.DiskStateUnattached)
+	attachedNode, err := c.getAttachedNode(nodeName, disk)
+	if err != nil {
+		return -1, err
+	}
+	if attachedNode != "" {
+		if strings.EqualFold(string(nodeName), string(attachedNode)) {
+			klog.Warningf("volume %s is actually attached to current node %s, invalidate vm cache and return error", diskURI, nodeName)
+			// update VM(invalidate vm cache)
+			if errUpdate := c.UpdateVM(ctx, nodeName); errUpdate != nil {
+				return -1, errUpdate
 			}
+			lun, _, err := c.GetDiskLun(diskName, diskURI, nodeName)
+			return lun, err
 		}
 
-		if v, ok := disk.Tags[WriteAcceleratorEnabled]; ok {
-			if v != nil && strings.EqualFold(*v, "true") {
-				writeAcceleratorEnabled = true
-			}
-		}
+		attachErr := fmt.Sprintf(
+			"disk(%s) already attached to node(%s), could not be attached to node(%s)",
+			diskURI, *disk.ManagedBy, nodeName)
+		klog.V(2).Infof("found dangling volume %s attached to node %s, could not be attached to node(%s)", diskURI, attachedNode, nodeName)
+		return -1, volerr.NewDanglingError(attachErr, attachedNode, "")
 	}
 
-	options := provider.AttachDiskOptions{
-		Lun:                     -1,
-		DiskName:                diskName,
-		CachingMode:             compute.CachingTypes(cachingMode),
-		DiskEncryptionSetID:     diskEncryptionSetID,
-		WriteAcceleratorEnabled: writeAcceleratorEnabled,
+	options, err := attachDiskOptions(diskName, diskURI, cachingMode, disk)
+	if err != nil {
+		return -1, err
 	}
 	node := strings.ToLower(string(nodeName))
 	diskuri := strings.ToLower(diskURI)
+	attributes := []attribute.KeyValue{diskURIAttributeKey.String(diskURI), nodeAttributeKey.String(string(nodeName))}
+	// the queue wait lasts until the request is taken in a batch by the holder of the node lock
+	queueCtx, queueSpan := startSpan(ctx, "insertAttachDiskRequest", attributes...)
 	requestNum, err := c.insertAttachDiskRequest(diskuri, node, &options)
 	if err != nil {
+		endSpan(queueSpan, err)
 		return -1, err
 	}
 
+	_, lockSpan := startSpan(queueCtx, "lockNode", attributes...)
 	c.lockMap.LockEntry(node)
+	lockSpan.End()
 	unlock := false
 	defer func() {
 		if !unlock {
@@ -203,11 +208,17 @@ func (c *controllerCommon) AttachDisk(ctx context.Context, diskName, diskURI str
 	}
 
 	diskMap, err := c.cleanAttachDiskRequests(node)
+	queueSpan.SetAttributes(batchSizeAttributeKey.Int(len(diskMap)))
+	endSpan(queueSpan, err)
 	if err != nil {
 		return -1, err
 	}
+	attributes = append(attributes, batchSizeAttributeKey.Int(len(diskMap)))
 
+	_, lunSpan := startSpan(ctx, "SetDiskLun", attributes...)
 	lun, err := c.SetDiskLun(nodeName, diskuri, diskMap, occupiedLuns)
+	lunSpan.SetAttributes(lunAttributeKey.Int(int(lun)))
+	endSpan(lunSpan, err)
 	if err != nil {
 		return -1, err
 	}
@@ -216,16 +227,12 @@ func (c *controllerCommon) AttachDisk(ctx context.Context, diskName, diskURI str
 	if len(diskMap) == 0 {
 		if !c.DisableDiskLunCheck {
 			// always check disk lun after disk attach complete
-			diskLun, vmState, errGetLun := c.GetDiskLun(diskName, diskURI, nodeName)
-			if errGetLun != nil {
-				return -1, fmt.Errorf("disk(%s) could not be found on node(%s), vmState: %s, error: %w", diskURI, nodeName, pointer.StringDeref(vmState, ""), errGetLun)
-			}
-			lun = diskLun
+			return c.verifyDiskLun(ctx, diskName, diskURI, nodeName)
 		}
 		return lun, nil
 	}
 
-	vmset, err := c.cloud.GetNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
+	vmset, err := c.getNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
 	if err != nil {
 		return -1, err
 	}
@@ -239,30 +246,221 @@ func (c *controllerCommon) AttachDisk(ctx context.Context, diskName, diskURI str
 		}
 	}()
 
-	err = vmset.AttachDisk(ctx, nodeName, diskMap)
+	vmCtx, vmSpan := startSpan(ctx, "vmset.AttachDisk", append(attributes, lunAttributeKey.Int(int(lun)))...)
+	err = vmset.AttachDisk(vmCtx, nodeName, diskMap)
 	if err != nil {
 		if IsOperationPreempted(err) {
 			klog.Errorf("Retry VM Update on node (%s) due to error (%v)", nodeName, err)
-			err = vmset.UpdateVM(ctx, nodeName)
+			err = vmset.UpdateVM(vmCtx, nodeName)
 		}
+	}
+	endSpan(vmSpan, err)
+	if err != nil {
+		return -1, err
+	}
+
+	if !c.DisableDiskLunCheck {
+		// always check disk lun after disk attach complete
+		return c.verifyDiskLun(ctx, diskName, diskURI, nodeName)
+	}
+	return lun, nil
+}
+
+// getAttachedNode returns the node which the non-shared disk is attached to, or empty if it's not attached
+func (c *controllerCommon) getAttachedNode(nodeName types.NodeName, disk *armcompute.Disk) (types.NodeName, error) {
+	// there is possibility that disk is nil when GetDisk is throttled
+	// don't check disk state when GetDisk is throttled
+	if disk == nil || disk.ManagedBy == nil || (disk.Properties != nil && disk.Properties.MaxShares != nil && *disk.Properties.MaxShares > 1) {
+		return "", nil
+	}
+	vmset, err := c.getNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
+	if err != nil {
+		return "", err
+	}
+	return vmset.GetNodeNameByProviderID(*disk.ManagedBy)
+}
+
+// attachDiskOptions returns the options to attach the disk, the disk must not be attached to any node unless it's shared
+func attachDiskOptions(diskName, diskURI string, cachingMode armcompute.CachingTypes, disk *armcompute.Disk) (provider.AttachDiskOptions, error) {
+	diskEncryptionSetID := ""
+	writeAcceleratorEnabled := false
+
+	if disk != nil {
+		if disk.Properties != nil {
+			if disk.Properties.DiskSizeGB != nil && *disk.Properties.DiskSizeGB >= diskCachingLimit && cachingMode != armcompute.CachingTypesNone {
+				// Disk Caching is not supported for disks 4 TiB and larger
+				// https://docs.microsoft.com/en-us/azure/virtual-machines/premium-storage-performance#disk-caching
+				cachingMode = armcompute.CachingTypesNone
+				klog.Warningf("size of disk(%s) is %dGB which is bigger than limit(%dGB), set cacheMode as None",
+					diskURI, *disk.Properties.DiskSizeGB, diskCachingLimit)
+			}
+
+			if disk.Properties.Encryption != nil &&
+				disk.Properties.Encryption.DiskEncryptionSetID != nil {
+				diskEncryptionSetID = *disk.Properties.Encryption.DiskEncryptionSetID
+			}
+
+			if disk.Properties.DiskState != nil && *disk.Properties.DiskState != armcompute.DiskStateUnattached && (disk.Properties.MaxShares == nil || *disk.Properties.MaxShares <= 1) {
+				return provider.AttachDiskOptions{}, fmt.Errorf("state of disk(%s) is %s, not in expected %s state", diskURI, *disk.Properties.DiskState, armcompute.DiskStateUnattached)
+			}
+		}
+
+		if v, ok := disk.Tags[WriteAcceleratorEnabled]; ok {
+			if v != nil && strings.EqualFold(*v, "true") {
+				writeAcceleratorEnabled = true
+			}
+		}
+	}
+
+	return provider.AttachDiskOptions{
+		Lun:                     -1,
+		DiskName:                diskName,
+		CachingMode:             compute.CachingTypes(cachingMode),
+		DiskEncryptionSetID:     diskEncryptionSetID,
+		WriteAcceleratorEnabled: writeAcceleratorEnabled,
+	}, nil
+}
+
+// attachDiskRequest is a disk attached by AttachDisks
+type attachDiskRequest struct {
+	diskName    string
+	diskURI     string
+	cachingMode armcompute.CachingTypes
+	disk        *armcompute.Disk
+}
+
+// AttachDisks attaches the disks to the node in one VM update, so that either all of them or none of them are attached
+// by this call. Nothing is attached if any disk is attached to another node, which is returned as a dangling error.
+// It returns the luns of the disks in order.
+func (c *controllerCommon) AttachDisks(ctx context.Context, nodeName types.NodeName, requests []attachDiskRequest, occupiedLuns []int) ([]int32, error) {
+	requestMap := make(map[string]*provider.AttachDiskOptions, len(requests))
+	for _, request := range requests {
+		attachedNode, err := c.getAttachedNode(nodeName, request.disk)
 		if err != nil {
-			return -1, err
+			return nil, err
 		}
+		if attachedNode != "" {
+			if strings.EqualFold(string(nodeName), string(attachedNode)) {
+				klog.Warningf("volume %s is actually attached to current node %s, invalidate vm cache", request.diskURI, nodeName)
+				if err := c.UpdateVM(ctx, nodeName); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			attachErr := fmt.Sprintf("disk(%s) already attached to node(%s), could not be attached to node(%s)", request.diskURI, *request.disk.ManagedBy, nodeName)
+			return nil, volerr.NewDanglingError(attachErr, attachedNode, "")
+		}
+		options, err := attachDiskOptions(request.diskName, request.diskURI, request.cachingMode, request.disk)
+		if err != nil {
+			return nil, err
+		}
+		requestMap[strings.ToLower(request.diskURI)] = &options
 	}
 
-	if !c.DisableDiskLunCheck {
+	if len(requestMap) > 0 {
+		if err := c.attachDiskBatch(ctx, nodeName, requestMap, occupiedLuns); err != nil {
+			return nil, err
+		}
+	}
+
+	luns := make([]int32, len(requests))
+	for i, request := range requests {
+		if options, ok := requestMap[strings.ToLower(request.diskURI)]; ok && c.DisableDiskLunCheck && options.Lun >= 0 {
+			luns[i] = options.Lun
+			continue
+		}
 		// always check disk lun after disk attach complete
-		diskLun, vmState, errGetLun := c.GetDiskLun(diskName, diskURI, nodeName)
-		if errGetLun != nil {
-			return -1, fmt.Errorf("disk(%s) could not be found on node(%s), vmState: %s, error: %w", diskURI, nodeName, pointer.StringDeref(vmState, ""), errGetLun)
+		lun, err := c.verifyDiskLun(ctx, request.diskName, request.diskURI, nodeName)
+		if err != nil {
+			return nil, err
 		}
-		lun = diskLun
+		luns[i] = lun
 	}
+	return luns, nil
+}
+
+// attachDiskBatch queues all the requests at once and attaches the queued requests to the node in one VM update
+func (c *controllerCommon) attachDiskBatch(ctx context.Context, nodeName types.NodeName, requestMap map[string]*provider.AttachDiskOptions, occupiedLuns []int) error {
+	node := strings.ToLower(string(nodeName))
+	attributes := []attribute.KeyValue{nodeAttributeKey.String(string(nodeName))}
+	queueCtx, queueSpan := startSpan(ctx, "insertAttachDiskRequests", attributes...)
+	requestNum, err := c.insertAttachDiskRequests(node, requestMap)
+	if err != nil {
+		endSpan(queueSpan, err)
+		return err
+	}
+
+	_, lockSpan := startSpan(queueCtx, "lockNode", attributes...)
+	c.lockMap.LockEntry(node)
+	lockSpan.End()
+	defer c.lockMap.UnlockEntry(node)
+
+	if c.AttachDetachInitialDelayInMs > 0 && requestNum == len(requestMap) {
+		klog.V(2).Infof("wait %dms for more requests on node %s, current disks attach: %d", c.AttachDetachInitialDelayInMs, node, len(requestMap))
+		time.Sleep(time.Duration(c.AttachDetachInitialDelayInMs) * time.Millisecond)
+	}
+
+	diskMap, err := c.cleanAttachDiskRequests(node)
+	queueSpan.SetAttributes(batchSizeAttributeKey.Int(len(diskMap)))
+	endSpan(queueSpan, err)
+	if err != nil || len(diskMap) == 0 {
+		// the requests were taken in a batch by another holder of the node lock
+		return err
+	}
+	attributes = append(attributes, batchSizeAttributeKey.Int(len(diskMap)))
+
+	var diskURI string
+	for diskURI = range diskMap {
+		break
+	}
+	_, lunSpan := startSpan(ctx, "SetDiskLun", attributes...)
+	_, err = c.SetDiskLun(nodeName, diskURI, diskMap, occupiedLuns)
+	endSpan(lunSpan, err)
+	if err != nil {
+		return err
+	}
+
+	vmset, err := c.getNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
+	if err != nil {
+		return err
+	}
+	klog.V(2).Infof("Trying to attach %d volumes to node %s, diskMap len:%d, %+v", len(requestMap), nodeName, len(diskMap), diskMap)
+	vmCtx, vmSpan := startSpan(ctx, "vmset.AttachDisk", attributes...)
+	err = vmset.AttachDisk(vmCtx, nodeName, diskMap)
+	if err != nil && IsOperationPreempted(err) {
+		klog.Errorf("Retry VM Update on node (%s) due to error (%v)", nodeName, err)
+		err = vmset.UpdateVM(vmCtx, nodeName)
+	}
+	endSpan(vmSpan, err)
+	if err != nil {
+		// invalidate the cache if there is error in disk attach
+		_ = vmset.DeleteCacheForNode(string(nodeName))
+	}
+	return err
+}
+
+// verifyDiskLun returns the lun of the disk attached to the node
+func (c *controllerCommon) verifyDiskLun(ctx context.Context, diskName, diskURI string, nodeName types.NodeName) (int32, error) {
+	_, span := startSpan(ctx, "GetDiskLun", diskURIAttributeKey.String(diskURI), nodeAttributeKey.String(string(nodeName)))
+	lun, vmState, err := c.GetDiskLun(diskName, diskURI, nodeName)
+	if err != nil {
+		err = fmt.Errorf("disk(%s) could not be found on node(%s), vmState: %s, error: %w", diskURI, nodeName, pointer.StringDeref(vmState, ""), err)
+		endSpan(span, err)
+		return -1, err
+	}
+	span.SetAttributes(lunAttributeKey.Int(int(lun)))
+	endSpan(span, nil)
 	return lun, nil
 }
 
 // insertAttachDiskRequest return (attachDiskRequestQueueLength, error)
 func (c *controllerCommon) insertAttachDiskRequest(diskURI, nodeName string, options *provider.AttachDiskOptions) (int, error) {
+	return c.insertAttachDiskRequests(nodeName, map[string]*provider.AttachDiskOptions{diskURI: options})
+}
+
+// insertAttachDiskRequests inserts all the requests into the queue at once, so that they are taken in the same batch
+// return (attachDiskRequestQueueLength, error)
+func (c *controllerCommon) insertAttachDiskRequests(nodeName string, requests map[string]*provider.AttachDiskOptions) (int, error) {
 	var diskMap map[string]*provider.AttachDiskOptions
 	attachDiskMapKey := nodeName + attachDiskMapKeySuffix
 	c.lockMap.LockEntry(attachDiskMapKey)
@@ -276,12 +474,13 @@ func (c *controllerCommon) insertAttachDiskRequest(diskURI, nodeName string, opt
 		diskMap = make(map[string]*provider.AttachDiskOptions)
 		c.attachDiskMap.Store(nodeName, diskMap)
 	}
-	// insert attach disk request to queue
-	_, ok = diskMap[diskURI]
-	if ok {
-		klog.V(2).Infof("azureDisk - duplicated attach disk(%s) request on node(%s)", diskURI, nodeName)
-	} else {
-		diskMap[diskURI] = options
+	// insert attach disk requests to queue
+	for diskURI, options := range requests {
+		if _, ok = diskMap[diskURI]; ok {
+			klog.V(2).Infof("azureDisk - duplicated attach disk(%s) request on node(%s)", diskURI, nodeName)
+		} else {
+			diskMap[diskURI] = options
+		}
 	}
 	return len(diskMap), nil
 }
@@ -307,7 +506,7 @@ func (c *controllerCommon) cleanAttachDiskRequests(nodeName string) (map[string]
 
 // DetachDisk detaches a disk from VM
 func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI string, nodeName types.NodeName) error {
-	if _, err := c.cloud.InstanceID(ctx, nodeName); err != nil {
+	if _, err := c.getCloud().InstanceID(ctx, nodeName); err != nil {
 		if errors.Is(err, cloudprovider.InstanceNotFound) {
 			// if host doesn't exist, no need to detach
 			klog.Warningf("azureDisk - failed to get azure instance id(%s), DetachDisk(%s) will assume disk is already detached",
@@ -318,19 +517,25 @@ func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI str
 		return fmt.Errorf("failed to get azure instance id for node %q: %w", nodeName, err)
 	}
 
-	vmset, err := c.cloud.GetNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
+	vmset, err := c.getNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
 	if err != nil {
 		return err
 	}
 
 	node := strings.ToLower(string(nodeName))
 	disk := strings.ToLower(diskURI)
+	attributes := []attribute.KeyValue{diskURIAttributeKey.String(diskURI), nodeAttributeKey.String(string(nodeName))}
+	// the queue wait lasts until the request is taken in a batch by the holder of the node lock
+	queueCtx, queueSpan := startSpan(ctx, "insertDetachDiskRequest", attributes...)
 	requestNum, err := c.insertDetachDiskRequest(diskName, disk, node)
 	if err != nil {
+		endSpan(queueSpan, err)
 		return err
 	}
 
+	_, lockSpan := startSpan(queueCtx, "lockNode", attributes...)
 	c.lockMap.LockEntry(node)
+	lockSpan.End()
 	defer c.lockMap.UnlockEntry(node)
 
 	if c.AttachDetachInitialDelayInMs > 0 && requestNum == 1 {
@@ -338,26 +543,33 @@ func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI str
 		time.Sleep(time.Duration(c.AttachDetachInitialDelayInMs) * time.Millisecond)
 	}
 	diskMap, err := c.cleanDetachDiskRequests(node)
+	queueSpan.SetAttributes(batchSizeAttributeKey.Int(len(diskMap)))
+	endSpan(queueSpan, err)
 	if err != nil {
 		return err
 	}
+	attributes = append(attributes, batchSizeAttributeKey.Int(len(diskMap)))
 
 	klog.V(2).Infof("Trying to detach volume %s from node %s, diskMap len:%d, %s", diskURI, nodeName, len(diskMap), diskMap)
 	if len(diskMap) > 0 {
 		c.diskStateMap.Store(disk, "detaching")
 		defer c.diskStateMap.Delete(disk)
-		if err = vmset.DetachDisk(ctx, nodeName, diskMap, false); err != nil {
+		vmCtx, vmSpan := startSpan(ctx, "vmset.DetachDisk", attributes...)
+		if err = vmset.DetachDisk(vmCtx, nodeName, diskMap, false); err != nil {
 			if isInstanceNotFoundError(err) {
 				// if host doesn't exist, no need to detach
 				klog.Warningf("azureDisk - got InstanceNotFoundError(%v), DetachDisk(%s) will assume disk is already detached",
 					err, diskURI)
+				endSpan(vmSpan, nil)
 				return nil
 			}
 			if c.ForceDetachBackoff && !azureutils.IsThrottlingError(err) {
 				klog.Errorf("azureDisk - DetachDisk(%s) from node %s failed with error: %v, retry with force detach", diskURI, nodeName, err)
-				err = vmset.DetachDisk(ctx, nodeName, diskMap, true)
+				vmSpan.AddEvent("force detach")
+				err = vmset.DetachDisk(vmCtx, nodeName, diskMap, true)
 			}
 		}
+		endSpan(vmSpan, err)
 	}
 
 	if err != nil {
@@ -367,10 +579,14 @@ func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI str
 
 	if !c.DisableDiskLunCheck {
 		// always check disk lun after disk detach complete
+		_, lunSpan := startSpan(ctx, "GetDiskLun", attributes...)
 		lun, vmState, errGetLun := c.GetDiskLun(diskName, diskURI, nodeName)
 		if errGetLun == nil || !strings.Contains(errGetLun.Error(), consts.CannotFindDiskLUN) {
-			return fmt.Errorf("disk(%s) is still attached to node(%s) on lun(%d), vmState: %s, error: %w", diskURI, nodeName, lun, pointer.StringDeref(vmState, ""), errGetLun)
+			err = fmt.Errorf("disk(%s) is still attached to node(%s) on lun(%d), vmState: %s, error: %w", diskURI, nodeName, lun, pointer.StringDeref(vmState, ""), errGetLun)
+			endSpan(lunSpan, err)
+			return err
 		}
+		endSpan(lunSpan, nil)
 	}
 
 	klog.V(2).Infof("azureDisk - detach disk(%s, %s) succeeded", diskName, diskURI)
@@ -379,7 +595,7 @@ func (c *controllerCommon) DetachDisk(ctx context.Context, diskName, diskURI str
 
 // UpdateVM updates a vm
 func (c *controllerCommon) UpdateVM(ctx context.Context, nodeName types.NodeName) error {
-	vmset, err := c.cloud.GetNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
+	vmset, err := c.getNodeVMSet(nodeName, azcache.CacheReadTypeUnsafe)
 	if err != nil {
 		return err
 	}
@@ -442,7 +658,7 @@ func (c *controllerCommon) cleanDetachDiskRequests(nodeName string) (map[string]
 
 // GetNodeDataDisks invokes vmSet interfaces to get data disks for the node.
 func (c *controllerCommon) GetNodeDataDisks(nodeName types.NodeName, crt azcache.AzureCacheReadType) ([]*armcompute.DataDisk, *string, error) {
-	vmset, err := c.cloud.GetNodeVMSet(nodeName, crt)
+	vmset, err := c.getNodeVMSet(nodeName, crt)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -615,7 +831,7 @@ func (c *controllerCommon) checkDiskExists(ctx context.Context, diskURI string)
 		return false, err
 	}
 
-	diskClient, err := c.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := c.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return false, err
 	}
@@ -41,6 +41,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	cloudprovider "k8s.io/cloud-provider"
+	volerr "k8s.io/cloud-provider/volume/errors"
 	"k8s.io/utils/pointer"
 
 	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
@@ -267,6 +268,74 @@ func TestCommonAttachDisk(t *testing.T) {
 	}
 }
 
+func TestCommonAttachDisks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	otherInstanceID := "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2"
+	testCases := []struct {
+		desc         string
+		disks        []*armcompute.Disk
+		updates      int
+		waitResult   *retry.Error
+		expectedLuns []int32
+		expectErr    bool
+		dangling     bool
+	}{
+		{
+			desc:         "all disks shall be attached in one VM update",
+			disks:        []*armcompute.Disk{nil, {Name: pointer.String("disk-1")}},
+			updates:      1,
+			expectedLuns: []int32{3, 4},
+		},
+		{
+			desc:       "an error shall be returned if the VM update fails",
+			disks:      []*armcompute.Disk{nil, nil},
+			updates:    1,
+			waitResult: conflictingUserInputError,
+			expectErr:  true,
+		},
+		{
+			desc:      "a dangling error shall be returned before any VM update if a disk is attached to another node",
+			disks:     []*armcompute.Disk{nil, {Name: pointer.String("disk-1"), ManagedBy: pointer.String(otherInstanceID)}},
+			expectErr: true,
+			dangling:  true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			testCloud := provider.GetTestCloud(ctrl)
+			expectedVMs := setTestVirtualMachines(testCloud, map[string]string{"vm1": "PowerState/Running"}, false)
+			mockVMsClient := testCloud.VirtualMachinesClient.(*mockvmclient.MockInterface)
+			mockVMsClient.EXPECT().Get(gomock.Any(), testCloud.ResourceGroup, "vm1", gomock.Any()).Return(expectedVMs[0], nil).AnyTimes()
+			mockVMsClient.EXPECT().UpdateAsync(gomock.Any(), testCloud.ResourceGroup, gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(fakeUpdateAsync(200)).Times(test.updates)
+			mockVMsClient.EXPECT().WaitForUpdateResult(gomock.Any(), gomock.Any(), testCloud.ResourceGroup, gomock.Any()).Return(nil, test.waitResult).Times(test.updates)
+
+			common := &controllerCommon{
+				cloud:               testCloud,
+				lockMap:             newLockMap(),
+				DisableDiskLunCheck: true,
+			}
+			var requests []attachDiskRequest
+			for i, disk := range test.disks {
+				diskName := fmt.Sprintf("disk-%d", i)
+				requests = append(requests, attachDiskRequest{
+					diskName:    diskName,
+					diskURI:     fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/disks/%s", testCloud.SubscriptionID, testCloud.ResourceGroup, diskName),
+					cachingMode: armcompute.CachingTypesReadOnly,
+					disk:        disk,
+				})
+			}
+			luns, err := common.AttachDisks(context.Background(), "vm1", requests, nil)
+			assert.Equal(t, test.expectErr, err != nil, "return error: %v", err)
+			assert.ElementsMatch(t, test.expectedLuns, luns)
+			var danglingErr *volerr.DanglingAttachError
+			assert.Equal(t, test.dangling, errors.As(err, &danglingErr))
+		})
+	}
+}
+
 func TestCommonDetachDisk(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -0,0 +1,656 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"go.uber.org/mock/gomock"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	volerr "k8s.io/cloud-provider/volume/errors"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	"sigs.k8s.io/cloud-provider-azure/pkg/consts"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const (
+	// the seed of a failing simulation is logged, set SIMULATION_SEED to replay only that seed
+	simulationSeedEnv = "SIMULATION_SEED"
+	// SIMULATION_STEPS overrides the number of steps of every seed
+	simulationStepsEnv = "SIMULATION_STEPS"
+
+	simulationSeeds      = 8
+	simulationSteps      = 250
+	simulationNodes      = 8
+	simulationDisks      = 48
+	simulationMaxOps     = 12
+	simulationMissingVM  = "sim-node-deleted"
+	simulationOpTimeout  = 30 * time.Second
+	simulationInstanceID = "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/%s"
+	simulationDiskURI    = "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.Compute/disks/%s"
+)
+
+// simulationVMSet is a VMSet keeping the data disks of the VMs in memory,
+// the VM updates which would be rejected by ARM are recorded as violations
+type simulationVMSet struct {
+	provider.VMSet
+
+	mu sync.Mutex
+	// <node, <diskURI, lun>>
+	vms       map[string]map[string]int32
+	maxShares map[string]int
+	// the number of the next AttachDisk or non-force DetachDisk calls of the node which fail
+	attachFaults map[string]int
+	detachFaults map[string]int
+	violations   []string
+}
+
+func newSimulationVMSet(nodes []string) *simulationVMSet {
+	vmset := &simulationVMSet{
+		vms:          map[string]map[string]int32{},
+		maxShares:    map[string]int{},
+		attachFaults: map[string]int{},
+		detachFaults: map[string]int{},
+	}
+	for _, node := range nodes {
+		vmset.vms[node] = map[string]int32{}
+	}
+	return vmset
+}
+
+func (s *simulationVMSet) GetInstanceIDByNodeName(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.vms[strings.ToLower(name)]; !ok {
+		return "", cloudprovider.InstanceNotFound
+	}
+	return fmt.Sprintf(simulationInstanceID, name), nil
+}
+
+func (s *simulationVMSet) GetNodeNameByProviderID(providerID string) (types.NodeName, error) {
+	return types.NodeName(path.Base(providerID)), nil
+}
+
+func (s *simulationVMSet) GetDataDisks(nodeName types.NodeName, _ azcache.AzureCacheReadType) ([]*armcompute.DataDisk, *string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[strings.ToLower(string(nodeName))]
+	if !ok {
+		return nil, nil, cloudprovider.InstanceNotFound
+	}
+	var dataDisks []*armcompute.DataDisk
+	for diskURI, lun := range vm {
+		dataDisks = append(dataDisks, &armcompute.DataDisk{
+			Name:        to.Ptr(path.Base(diskURI)),
+			Lun:         to.Ptr(lun),
+			ManagedDisk: &armcompute.ManagedDiskParameters{ID: to.Ptr(diskURI)},
+		})
+	}
+	sort.Slice(dataDisks, func(i, j int) bool { return *dataDisks[i].Lun < *dataDisks[j].Lun })
+	return dataDisks, to.Ptr("Succeeded"), nil
+}
+
+func (s *simulationVMSet) AttachDisk(_ context.Context, nodeName types.NodeName, diskMap map[string]*provider.AttachDiskOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := strings.ToLower(string(nodeName))
+	vm, ok := s.vms[node]
+	if !ok {
+		return cloudprovider.InstanceNotFound
+	}
+	if s.attachFaults[node] > 0 {
+		s.attachFaults[node]--
+		return fmt.Errorf("Code=%q Message=\"operation on VM %s was preempted\"", consts.OperationPreemptedErrorCode, node)
+	}
+
+	// the update is rejected as a whole, like ARM does
+	used := map[int32]string{}
+	for diskURI, lun := range vm {
+		used[lun] = diskURI
+	}
+	for diskURI, opt := range diskMap {
+		if opt.Lun < 0 || opt.Lun >= maxLUN {
+			s.violations = append(s.violations, fmt.Sprintf("disk %s is attached to node %s on invalid lun %d", diskURI, node, opt.Lun))
+			return fmt.Errorf("invalid lun %d", opt.Lun)
+		}
+		if other, ok := used[opt.Lun]; ok {
+			s.violations = append(s.violations, fmt.Sprintf("lun %d of node %s is used by disk %s and disk %s", opt.Lun, node, other, diskURI))
+			return fmt.Errorf("Code=\"Conflict\" Message=\"lun %d of VM %s is already used\"", opt.Lun, node)
+		}
+		used[opt.Lun] = diskURI
+		if _, ok := vm[diskURI]; ok {
+			s.violations = append(s.violations, fmt.Sprintf("disk %s is attached to node %s twice", diskURI, node))
+			return fmt.Errorf("disk %s is already attached to VM %s", diskURI, node)
+		}
+		if attached := s.attachedNodes(diskURI); len(attached) >= s.maxShares[diskURI] {
+			return fmt.Errorf("Code=\"OperationNotAllowed\" Message=\"disk %s is attached to VMs %v\"", diskURI, attached)
+		}
+	}
+	for diskURI, opt := range diskMap {
+		vm[diskURI] = opt.Lun
+	}
+	return nil
+}
+
+func (s *simulationVMSet) DetachDisk(_ context.Context, nodeName types.NodeName, diskMap map[string]string, forceDetach bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := strings.ToLower(string(nodeName))
+	vm, ok := s.vms[node]
+	if !ok {
+		return cloudprovider.InstanceNotFound
+	}
+	if !forceDetach && s.detachFaults[node] > 0 {
+		s.detachFaults[node]--
+		return fmt.Errorf("Code=\"InternalServerError\" Message=\"detach from VM %s failed\"", node)
+	}
+	for diskURI := range diskMap {
+		delete(vm, diskURI)
+	}
+	return nil
+}
+
+func (s *simulationVMSet) UpdateVM(_ context.Context, _ types.NodeName) error {
+	return nil
+}
+
+func (s *simulationVMSet) DeleteCacheForNode(_ string) error {
+	return nil
+}
+
+// attachedNodes returns the sorted nodes the disk is attached to, s.mu must be held
+func (s *simulationVMSet) attachedNodes(diskURI string) []string {
+	var nodes []string
+	for node, vm := range s.vms {
+		if _, ok := vm[diskURI]; ok {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// disk returns the disk as returned by GET, like ControllerPublishVolume passes it to AttachDisk
+func (s *simulationVMSet) disk(diskURI string) *armcompute.Disk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	disk := &armcompute.Disk{
+		ID:         to.Ptr(diskURI),
+		Name:       to.Ptr(path.Base(diskURI)),
+		Properties: &armcompute.DiskProperties{MaxShares: to.Ptr(int32(s.maxShares[diskURI])), DiskState: to.Ptr(armcompute.DiskStateUnattached)},
+	}
+	for i, node := range s.attachedNodes(diskURI) {
+		if i == 0 {
+			disk.ManagedBy = to.Ptr(fmt.Sprintf(simulationInstanceID, node))
+			disk.Properties.DiskState = to.Ptr(armcompute.DiskStateAttached)
+		}
+		disk.ManagedByExtended = append(disk.ManagedByExtended, to.Ptr(fmt.Sprintf(simulationInstanceID, node)))
+	}
+	return disk
+}
+
+type simulationOp struct {
+	publish      bool
+	diskURI      string
+	node         string
+	occupiedLuns []int
+
+	// the expected result
+	expectErr      bool
+	expectDangling string
+	expectLun      int32
+
+	// the actual result
+	done chan struct{}
+	lun  int32
+	err  error
+}
+
+func (op *simulationOp) String() string {
+	if op.publish {
+		return fmt.Sprintf("publish(%s, %s, occupied luns %v)", path.Base(op.diskURI), op.node, op.occupiedLuns)
+	}
+	return fmt.Sprintf("unpublish(%s, %s)", path.Base(op.diskURI), op.node)
+}
+
+// simulation drives seeded, interleaved publish and unpublish calls through controllerCommon.
+// In every step the node locks are held until all the requests of the step are queued,
+// so the requests of a node are batched in a single VM update and the result of a step
+// only depends on the seed, not on the scheduling of the goroutines.
+type simulation struct {
+	t     *testing.T
+	seed  int64
+	step  int
+	rng   *rand.Rand
+	c     *controllerCommon
+	vmset *simulationVMSet
+	nodes []string
+	disks []string
+	// the VolumeAttachments of the successful publish calls, <diskURI, <node, lun>>
+	attachments map[string]map[string]int32
+}
+
+func newSimulation(t *testing.T, ctrl *gomock.Controller, seed int64) *simulation {
+	s := &simulation{
+		t:           t,
+		seed:        seed,
+		rng:         rand.New(rand.NewSource(seed)),
+		attachments: map[string]map[string]int32{},
+	}
+	for i := 0; i < simulationNodes; i++ {
+		s.nodes = append(s.nodes, fmt.Sprintf("sim-node-%d", i))
+	}
+	s.vmset = newSimulationVMSet(s.nodes)
+	for i := 0; i < simulationDisks; i++ {
+		diskURI := strings.ToLower(fmt.Sprintf(simulationDiskURI, fmt.Sprintf("sim-disk-%02d", i)))
+		s.disks = append(s.disks, diskURI)
+		s.attachments[diskURI] = map[string]int32{}
+		s.vmset.maxShares[diskURI] = 1
+		if i%8 == 0 {
+			s.vmset.maxShares[diskURI] = 2
+		}
+	}
+
+	cloud := provider.GetTestCloud(ctrl)
+	cloud.VMSet = s.vmset
+	s.c = &controllerCommon{
+		cloud:              cloud,
+		lockMap:            newLockMap(),
+		ForceDetachBackoff: true,
+	}
+	return s
+}
+
+func (s *simulation) fatalf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Fatalf("seed %d, step %d: %s, reproduce with %s=%d", s.seed, s.step, fmt.Sprintf(format, args...), simulationSeedEnv, s.seed)
+}
+
+// plan picks the operations of the next step on distinct disks and their expected results
+func (s *simulation) plan() []*simulationOp {
+	var ops []*simulationOp
+	for _, i := range s.rng.Perm(len(s.disks))[:1+s.rng.Intn(simulationMaxOps)] {
+		diskURI := s.disks[i]
+		op := &simulationOp{diskURI: diskURI, node: s.nodes[s.rng.Intn(len(s.nodes))], done: make(chan struct{})}
+		attached := s.attachedNodes(diskURI)
+		switch r := s.rng.Intn(10); {
+		case r < 5 && len(attached) > 0:
+			// unpublish from a node the disk is attached to
+			op.node = attached[s.rng.Intn(len(attached))]
+		case r < 6:
+			// unpublish from any node, the VM may have been deleted
+			if s.rng.Intn(4) == 0 {
+				op.node = simulationMissingVM
+			}
+		case r < 7 && len(attached) > 0:
+			// publish to a node the disk is already attached to
+			op.publish = true
+			op.node = attached[s.rng.Intn(len(attached))]
+		default:
+			op.publish = true
+		}
+		ops = append(ops, op)
+	}
+
+	// the failed VM updates, a preempted attach fails the whole batch of the node,
+	// a failed detach is retried with force detach.
+	// The VolumeAttachments of a node may record luns which are not on the VM yet,
+	// they are passed as occupied luns by all the publish calls to the node.
+	occupiedLuns := map[string][]int{}
+	failedBatches := map[string]bool{}
+	for _, node := range s.nodes {
+		s.vmset.attachFaults[node] = 0
+		s.vmset.detachFaults[node] = 0
+		if s.rng.Intn(10) == 0 {
+			s.vmset.attachFaults[node] = 1
+			failedBatches[node] = true
+		}
+		if s.rng.Intn(10) == 0 {
+			s.vmset.detachFaults[node] = 1
+		}
+		if s.rng.Intn(5) == 0 {
+			for j := 0; j <= s.rng.Intn(3); j++ {
+				if lun := s.rng.Intn(maxLUN); !s.isLunUsed(node, int32(lun)) {
+					occupiedLuns[node] = append(occupiedLuns[node], lun)
+				}
+			}
+		}
+	}
+
+	var queued []*simulationOp
+	for _, op := range ops {
+		if !op.publish {
+			continue
+		}
+		op.occupiedLuns = occupiedLuns[op.node]
+		attached := s.attachedNodes(op.diskURI)
+		switch {
+		case containsString(attached, op.node):
+			op.expectLun = s.attachments[op.diskURI][op.node]
+		case len(attached) > 0 && s.vmset.maxShares[op.diskURI] <= 1:
+			op.expectErr = true
+			op.expectDangling = attached[0]
+		default:
+			// ARM rejects the batch attaching a shared disk to more than maxShares VMs
+			if len(attached) >= s.vmset.maxShares[op.diskURI] {
+				failedBatches[op.node] = true
+			}
+			op.expectLun = -1
+			queued = append(queued, op)
+		}
+	}
+	for _, op := range queued {
+		op.expectErr = failedBatches[op.node]
+	}
+	return ops
+}
+
+// publish does what ControllerPublishVolume does with the disk controller
+func (s *simulation) publish(ctx context.Context, op *simulationOp, disk *armcompute.Disk) (int32, error) {
+	diskName := path.Base(op.diskURI)
+	nodeName := types.NodeName(op.node)
+	lun, _, err := s.c.GetDiskLun(diskName, op.diskURI, nodeName)
+	if err == nil {
+		return lun, nil
+	}
+	return s.c.AttachDisk(ctx, diskName, op.diskURI, nodeName, armcompute.CachingTypesReadOnly, disk, op.occupiedLuns)
+}
+
+// run runs the operations of a step concurrently and waits for all of them
+func (s *simulation) run(ops []*simulationOp) {
+	ctx := context.Background()
+	for _, node := range s.nodes {
+		s.c.lockMap.LockEntry(node)
+	}
+	for _, op := range ops {
+		var disk *armcompute.Disk
+		if op.publish {
+			disk = s.vmset.disk(op.diskURI)
+		}
+		go func(op *simulationOp) {
+			defer close(op.done)
+			if op.publish {
+				op.lun, op.err = s.publish(ctx, op, disk)
+			} else {
+				op.err = s.c.DetachDisk(ctx, path.Base(op.diskURI), op.diskURI, types.NodeName(op.node))
+			}
+		}(op)
+	}
+
+	deadline := time.Now().Add(simulationOpTimeout)
+	for _, op := range ops {
+		for !s.isQueued(op) {
+			if time.Now().After(deadline) {
+				s.fatalf("%s was neither queued nor completed", op)
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+	for _, node := range s.nodes {
+		s.c.lockMap.UnlockEntry(node)
+	}
+
+	timeout := time.After(simulationOpTimeout)
+	for _, op := range ops {
+		select {
+		case <-op.done:
+		case <-timeout:
+			s.fatalf("%s did not complete, the request is lost", op)
+		}
+	}
+}
+
+// isQueued returns true if the operation completed or its request is in the attach or detach queue
+func (s *simulation) isQueued(op *simulationOp) bool {
+	select {
+	case <-op.done:
+		return true
+	default:
+	}
+	m, suffix := &s.c.detachDiskMap, detachDiskMapKeySuffix
+	if op.publish {
+		m, suffix = &s.c.attachDiskMap, attachDiskMapKeySuffix
+	}
+	s.c.lockMap.LockEntry(op.node + suffix)
+	defer s.c.lockMap.UnlockEntry(op.node + suffix)
+	v, ok := m.Load(op.node)
+	if !ok {
+		return false
+	}
+	switch diskMap := v.(type) {
+	case map[string]*provider.AttachDiskOptions:
+		_, ok = diskMap[op.diskURI]
+	case map[string]string:
+		_, ok = diskMap[op.diskURI]
+	}
+	return ok
+}
+
+// verify checks the results of the operations and updates the VolumeAttachments
+func (s *simulation) verify(ops []*simulationOp) {
+	for _, op := range ops {
+		if !op.publish {
+			if op.err != nil {
+				s.fatalf("%s failed: %v", op, op.err)
+			}
+			delete(s.attachments[op.diskURI], op.node)
+			continue
+		}
+		if op.expectErr {
+			if op.err == nil {
+				s.fatalf("%s returned lun %d, expected an error", op, op.lun)
+			}
+			var danglingErr *volerr.DanglingAttachError
+			isDangling := errors.As(op.err, &danglingErr)
+			if op.expectDangling != "" && (!isDangling || !strings.EqualFold(string(danglingErr.CurrentNode), op.expectDangling)) {
+				s.fatalf("%s returned %v, expected a dangling error of node %s", op, op.err, op.expectDangling)
+			}
+			if op.expectDangling == "" && isDangling {
+				s.fatalf("%s returned unexpected dangling error %v", op, op.err)
+			}
+			continue
+		}
+		if op.err != nil {
+			s.fatalf("%s failed: %v", op, op.err)
+		}
+		if op.expectLun >= 0 && op.lun != op.expectLun {
+			s.fatalf("%s returned lun %d, expected the lun %d of the existing attachment", op, op.lun, op.expectLun)
+		}
+		for _, lun := range op.occupiedLuns {
+			if int32(lun) == op.lun {
+				s.fatalf("%s returned occupied lun %d", op, op.lun)
+			}
+		}
+		s.attachments[op.diskURI][op.node] = op.lun
+	}
+}
+
+// checkInvariants checks the state of the VMs and of the disk controller after a step
+func (s *simulation) checkInvariants() {
+	s.vmset.mu.Lock()
+	violations := s.vmset.violations
+	vms := map[string]map[string]int32{}
+	for node, vm := range s.vmset.vms {
+		vms[node] = map[string]int32{}
+		luns := map[int32]string{}
+		for diskURI, lun := range vm {
+			if other, ok := luns[lun]; ok {
+				violations = append(violations, fmt.Sprintf("lun %d of node %s is used by disk %s and disk %s", lun, node, other, diskURI))
+			}
+			luns[lun] = diskURI
+			vms[node][diskURI] = lun
+		}
+	}
+	s.vmset.mu.Unlock()
+	if len(violations) > 0 {
+		s.fatalf("invalid VM updates: %v", violations)
+	}
+
+	// the VolumeAttachments match the data disks of the VMs
+	for diskURI, attachments := range s.attachments {
+		if len(attachments) > s.vmset.maxShares[diskURI] {
+			s.fatalf("disk %s is attached to %d nodes, maxShares is %d", diskURI, len(attachments), s.vmset.maxShares[diskURI])
+		}
+		for node, lun := range attachments {
+			if actual, ok := vms[node][diskURI]; !ok || actual != lun {
+				s.fatalf("disk %s is published to node %s on lun %d, the VM has lun %d (attached: %t)", diskURI, node, lun, actual, ok)
+			}
+		}
+	}
+	for node, vm := range vms {
+		for diskURI := range vm {
+			if _, ok := s.attachments[diskURI][node]; !ok {
+				s.fatalf("disk %s is attached to node %s without a successful publish", diskURI, node)
+			}
+		}
+	}
+
+	// no request is left in the queues and no node is locked
+	for _, node := range append(s.nodes, simulationMissingVM) {
+		for _, m := range []*sync.Map{&s.c.attachDiskMap, &s.c.detachDiskMap} {
+			if v, ok := m.Load(node); ok {
+				switch diskMap := v.(type) {
+				case map[string]*provider.AttachDiskOptions:
+					if len(diskMap) > 0 {
+						s.fatalf("attach requests %v of node %s are not processed", diskMap, node)
+					}
+				case map[string]string:
+					if len(diskMap) > 0 {
+						s.fatalf("detach requests %v of node %s are not processed", diskMap, node)
+					}
+				}
+			}
+		}
+		locked := make(chan struct{})
+		go func(node string) {
+			s.c.lockMap.LockEntry(node)
+			s.c.lockMap.UnlockEntry(node)
+			close(locked)
+		}(node)
+		select {
+		case <-locked:
+		case <-time.After(simulationOpTimeout):
+			s.fatalf("node %s is still locked", node)
+		}
+	}
+	s.c.diskStateMap.Range(func(key, value interface{}) bool {
+		s.fatalf("disk %v is still in %v state", key, value)
+		return false
+	})
+}
+
+func (s *simulation) attachedNodes(diskURI string) []string {
+	var nodes []string
+	for node := range s.attachments[diskURI] {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (s *simulation) isLunUsed(node string, lun int32) bool {
+	for _, attachments := range s.attachments {
+		if used, ok := attachments[node]; ok && used == lun {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAttachDetachSimulation(t *testing.T) {
+	seeds := make([]int64, simulationSeeds)
+	for i := range seeds {
+		seeds[i] = int64(i + 1)
+	}
+	steps := simulationSteps
+	if testing.Short() {
+		seeds = seeds[:2]
+		steps /= 5
+	}
+	if v := os.Getenv(simulationSeedEnv); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid %s %q: %v", simulationSeedEnv, v, err)
+		}
+		seeds = []int64{seed}
+	}
+	if v := os.Getenv(simulationStepsEnv); v != "" {
+		var err error
+		if steps, err = strconv.Atoi(v); err != nil {
+			t.Fatalf("invalid %s %q: %v", simulationStepsEnv, v, err)
+		}
+	}
+
+	for _, seed := range seeds {
+		t.Run(fmt.Sprintf("seed-%d", seed), func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			s := newSimulation(t, ctrl, seed)
+			calls := 0
+			for s.step = 0; s.step < steps; s.step++ {
+				ops := s.plan()
+				s.run(ops)
+				s.verify(ops)
+				s.checkInvariants()
+				calls += len(ops)
+			}
+			t.Logf("seed %d: %d publish and unpublish calls in %d steps", seed, calls, steps)
+		})
+	}
+}
+
+func TestSimulationVMSetRejectsLunCollision(t *testing.T) {
+	vmset := newSimulationVMSet([]string{"node-0"})
+	vmset.maxShares["disk-0"] = 1
+	vmset.maxShares["disk-1"] = 1
+	ctx := context.Background()
+	if err := vmset.AttachDisk(ctx, "node-0", map[string]*provider.AttachDiskOptions{"disk-0": {Lun: 3}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := vmset.AttachDisk(ctx, "node-0", map[string]*provider.AttachDiskOptions{"disk-1": {Lun: 3}}); err == nil {
+		t.Fatalf("expected the lun collision to be rejected")
+	}
+	if len(vmset.violations) != 1 {
+		t.Fatalf("expected 1 violation, got %v", vmset.violations)
+	}
+	if _, ok := vmset.vms["node-0"]["disk-1"]; ok {
+		t.Fatalf("the rejected disk is attached")
+	}
+}
@@ -67,6 +67,8 @@ type ManagedDiskOptions struct {
 	ResourceGroup string
 	// The AvailabilityZone to create the disk.
 	AvailabilityZone string
+	// The ExtendedLocation, e.g. an edge zone, to create the disk, the extended location in the cloud config is used if not set.
+	ExtendedLocation *ExtendedLocation
 	// The tags of the disk.
 	Tags map[string]string
 	// IOPS Caps for UltraSSD disk
@@ -112,7 +114,7 @@ func (c *ManagedDiskController) CreateManagedDisk(ctx context.Context, options *
 
 	var createZones []string
 	if len(options.AvailabilityZone) > 0 {
-		requestedZone := c.cloud.GetZoneID(options.AvailabilityZone)
+		requestedZone := c.getCloud().GetZoneID(options.AvailabilityZone)
 		if requestedZone != "" {
 			createZones = append(createZones, requestedZone)
 		}
@@ -132,14 +134,14 @@ func (c *ManagedDiskController) CreateManagedDisk(ctx context.Context, options *
 	diskSizeGB := int32(options.SizeGB)
 	diskSku := options.StorageAccountType
 
-	rg := c.cloud.ResourceGroup
+	rg := c.getCloud().ResourceGroup
 	if options.ResourceGroup != "" {
 		rg = options.ResourceGroup
 	}
-	if options.SubscriptionID != "" && !strings.EqualFold(options.SubscriptionID, c.cloud.SubscriptionID) && options.ResourceGroup == "" {
+	if options.SubscriptionID != "" && !strings.EqualFold(options.SubscriptionID, c.getCloud().SubscriptionID) && options.ResourceGroup == "" {
 		return "", fmt.Errorf("resourceGroup must be specified when subscriptionID(%s) is not empty", options.SubscriptionID)
 	}
-	subsID := c.cloud.SubscriptionID
+	subsID := c.getCloud().SubscriptionID
 	if options.SubscriptionID != "" {
 		subsID = options.SubscriptionID
 	}
@@ -240,7 +242,7 @@ func (c *ManagedDiskController) CreateManagedDisk(ctx context.Context, options *
 		diskProperties.MaxShares = &options.MaxShares
 	}
 
-	location := c.cloud.Location
+	location := c.getCloud().Location
 	if options.Location != "" {
 		location = options.Location
 	}
@@ -253,17 +255,22 @@ func (c *ManagedDiskController) CreateManagedDisk(ctx context.Context, options *
 		Properties: &diskProperties,
 	}
 
-	if c.cloud.HasExtendedLocation() {
+	if options.ExtendedLocation != nil {
 		model.ExtendedLocation = &armcompute.ExtendedLocation{
-			Name: pointer.String(c.cloud.ExtendedLocationName),
-			Type: to.Ptr(armcompute.ExtendedLocationTypes(c.cloud.ExtendedLocationType)),
+			Name: pointer.String(options.ExtendedLocation.Name),
+			Type: to.Ptr(armcompute.ExtendedLocationTypes(options.ExtendedLocation.Type)),
+		}
+	} else if c.getCloud().HasExtendedLocation() {
+		model.ExtendedLocation = &armcompute.ExtendedLocation{
+			Name: pointer.String(c.getCloud().ExtendedLocationName),
+			Type: to.Ptr(armcompute.ExtendedLocationTypes(c.getCloud().ExtendedLocationType)),
 		}
 	}
 
 	if len(createZones) > 0 {
 		model.Zones = to.SliceOfPtrs(createZones...)
 	}
-	diskClient, err := c.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := c.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return "", err
 	}
@@ -315,7 +322,7 @@ func (c *ManagedDiskController) DeleteManagedDisk(ctx context.Context, diskURI s
 	}
 
 	diskName := path.Base(diskURI)
-	diskClient, err := c.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := c.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return err
 	}
@@ -346,7 +353,7 @@ func (c *ManagedDiskController) DeleteManagedDisk(ctx context.Context, diskURI s
 
 // GetDisk return: disk provisionState, diskID, error
 func (c *ManagedDiskController) GetDisk(ctx context.Context, subsID, resourceGroup, diskName string) (string, string, error) {
-	diskclient, err := c.clientFactory.GetDiskClientForSub(subsID)
+	diskclient, err := c.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return "", "", err
 	}
@@ -369,7 +376,7 @@ func (c *ManagedDiskController) ResizeDisk(ctx context.Context, diskURI string,
 	if err != nil {
 		return oldSize, err
 	}
-	diskClient, err := c.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := c.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return oldSize, err
 	}
@@ -21,11 +21,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
@@ -39,8 +43,14 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume/util/hostutil"
 	"k8s.io/mount-utils"
@@ -122,9 +132,50 @@ type DriverCore struct {
 	endpoint                     string
 	disableAVSetNodes            bool
 	removeNotReadyTaint          bool
+	localCacheDevice             string
+	luksKeyDir                   string
+	fsckTimeoutInSeconds         int64
 	kubeClient                   kubernetes.Interface
+	eventRecorder                record.EventRecorder
+	scsiPR                       scsiPersistentReservation
+	enforceNodeIOLimit           bool
+	enableVolumeIOMetrics        bool
+	enableThrottlingDetection    bool
+	throttling                   *throttlingDetector
+	enableAutoExpand             bool
+	shutdownTimeoutInSeconds     int64
+	shards                       *controllerShards
+	enableCloudConfigReload      bool
+	// elects the controller replica which runs the cluster-wide controller loops, nil on the node or without kubeClient
+	leader *controllerLeader
+	// informers of the controller, nil on the node or without kubeClient
+	controllerInformers    informers.SharedInformerFactory
+	volumeAttachmentLister storagelisters.VolumeAttachmentLister
+	// informer of the nodes reporting volume usage, nil if the auto expansion is disabled
+	volumeUsageInformers  informers.SharedInformerFactory
+	volumeUsageNodeLister corelisters.NodeLister
+	// options of the SKU catalog, nil if no source of the catalog is configured
+	skuCatalogOptions *DriverOptions
+	// in-flight CSI operations drained on shutdown
+	operations operationTracker
+	// staged volumes with tuned block device settings <volumeID, state file>
+	deviceSettingsStateFiles sync.Map
+	// staged volumes exported in the block IO metrics <volumeID, *volumeIOInfo>
+	volumeIOs sync.Map
+	// staged file system volumes whose usage is reported for auto expansion <volumeID, *autoExpandVolume>
+	autoExpandVolumes sync.Map
+	// the volume usage in the annotation of the node <volumeID, volumeUsage>, only accessed by the reporting loop
+	reportedVolumeUsage map[string]volumeUsage
+	// PVCs warned that they could not be auto expanded further <PVC UID, size in GiB>
+	autoExpandLimitWarnings sync.Map
+	// PVs of the volume attachments of the driver checked by the controller loops <PV name, *attachedVolume>
+	attachedVolumes sync.Map
+	// fence requests executed by the node <annotation, request time>
+	executedFenceRequests sync.Map
 	// a timed cache storing volume stats <volumeID, volumeStats>
 	volStatsCache azcache.Resource
+	// guards cloud and clientFactory, which are swapped when the cloud config is reloaded
+	cloudMutex sync.RWMutex
 }
 
 // Driver is the v1 implementation of the Azure Disk CSI Driver.
@@ -135,6 +186,16 @@ type Driver struct {
 	throttlingCache azcache.Resource
 	// a timed cache for disk lun collision check throttling
 	checkDiskLunThrottlingCache azcache.Resource
+	// readiness checks the dependencies of the driver, it's created on first use
+	readinessOnce sync.Once
+	readiness     *readinessChecker
+	// the credential of the ARM token readiness check
+	armCredentialMutex sync.Mutex
+	armCredential      azcore.TokenCredential
+	// records the mutating ARM requests instead of executing them in the dry run, nil if the dry run is disabled
+	dryRun *dryRunRecorder
+	// paces the disk, snapshot and VM requests to ARM, nil if the ARM request scheduler is disabled
+	armScheduler *armScheduler
 }
 
 // newDriverV1 Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
@@ -154,7 +215,7 @@ func newDriverV1(options *DriverOptions) *Driver {
 	driver.enableDiskOnlineResize = options.EnableDiskOnlineResize
 	driver.allowEmptyCloudConfig = options.AllowEmptyCloudConfig
 	driver.enableListVolumes = options.EnableListVolumes
-	driver.enableListSnapshots = options.EnableListVolumes
+	driver.enableListSnapshots = options.EnableListSnapshots
 	driver.supportZone = options.SupportZone
 	driver.getNodeInfoFromLabels = options.GetNodeInfoFromLabels
 	driver.enableDiskCapacityCheck = options.EnableDiskCapacityCheck
@@ -174,6 +235,16 @@ func newDriverV1(options *DriverOptions) *Driver {
 	driver.endpoint = options.Endpoint
 	driver.disableAVSetNodes = options.DisableAVSetNodes
 	driver.removeNotReadyTaint = options.RemoveNotReadyTaint
+	driver.localCacheDevice = options.LocalCacheDevice
+	driver.luksKeyDir = options.LuksKeyDir
+	driver.fsckTimeoutInSeconds = options.FsckTimeoutInSeconds
+	driver.scsiPR = newSCSIPersistentReservation()
+	driver.enforceNodeIOLimit = options.EnforceNodeIOLimit
+	driver.enableVolumeIOMetrics = options.EnableVolumeIOMetrics
+	driver.enableThrottlingDetection = options.EnableThrottlingDetection
+	driver.enableAutoExpand = options.EnableAutoExpand
+	driver.shutdownTimeoutInSeconds = options.ShutdownTimeoutInSeconds
+	driver.enableCloudConfigReload = options.EnableCloudConfigReload
 	driver.volumeLocks = volumehelper.NewVolumeLocks()
 	driver.ioHandler = azureutils.NewOSIOHandler()
 	driver.hostUtil = hostutil.NewHostUtil()
@@ -199,6 +270,18 @@ func newDriverV1(options *DriverOptions) *Driver {
 		klog.Fatalf("%v", err)
 	}
 
+	if options.DryRun {
+		if driver.dryRun, err = newDryRunRecorder(options.DryRunJournal); err != nil {
+			klog.Fatalf("failed to open dry run journal(%s): %v", options.DryRunJournal, err)
+		}
+		klog.Warning("dry run is enabled, the mutating ARM requests are recorded in the journal instead of being executed")
+	}
+
+	if options.EnableARMRequestScheduler {
+		driver.armScheduler = newARMScheduler(float64(options.ARMRequestQPS), int(options.ARMRequestBurst), time.Duration(options.ARMRequestMaxQueueWaitInMs)*time.Millisecond)
+		klog.V(2).Infof("ARM request scheduler is enabled with qps(%d), burst(%d), max queue wait(%dms)", options.ARMRequestQPS, options.ARMRequestBurst, options.ARMRequestMaxQueueWaitInMs)
+	}
+
 	userAgent := GetUserAgent(driver.Name, driver.customUserAgent, driver.userAgentSuffix)
 	klog.V(2).Infof("driver userAgent: %s", userAgent)
 
@@ -207,6 +290,11 @@ func newDriverV1(options *DriverOptions) *Driver {
 		klog.Warningf("get kubeconfig(%s) failed with error: %v", options.Kubeconfig, err)
 	}
 	driver.kubeClient = kubeClient
+	if kubeClient != nil {
+		eventBroadcaster := record.NewBroadcaster()
+		eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+		driver.eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: driver.Name, Host: driver.NodeID})
+	}
 
 	cloud, err := azureutils.GetCloudProviderFromClient(context.Background(), kubeClient, driver.cloudConfigSecretName, driver.cloudConfigSecretNamespace,
 		userAgent, driver.allowEmptyCloudConfig, driver.enableTrafficManager, driver.trafficManagerPort)
@@ -216,44 +304,29 @@ func newDriverV1(options *DriverOptions) *Driver {
 	driver.cloud = cloud
 
 	if driver.cloud != nil {
+		driver.clientFactory = driver.configureCloud(driver.cloud)
 		driver.diskController = NewManagedDiskController(driver.cloud)
 		driver.diskController.DisableUpdateCache = driver.disableUpdateCache
 		driver.diskController.AttachDetachInitialDelayInMs = int(driver.attachDetachInitialDelayInMs)
 		driver.diskController.ForceDetachBackoff = driver.forceDetachBackoff
-		driver.clientFactory = driver.cloud.ComputeClientFactory
-		if driver.vmType != "" {
-			klog.V(2).Infof("override VMType(%s) in cloud config as %s", driver.cloud.VMType, driver.vmType)
-			driver.cloud.VMType = driver.vmType
-		}
-
-		if driver.NodeID == "" {
-			// Disable UseInstanceMetadata for controller to mitigate a timeout issue using IMDS
-			// https://github.com/kubernetes-sigs/azuredisk-csi-driver/issues/168
-			klog.V(2).Infof("disable UseInstanceMetadata for controller")
-			driver.cloud.Config.UseInstanceMetadata = false
-
-			if driver.cloud.VMType == azurecloudconsts.VMTypeStandard && driver.cloud.DisableAvailabilitySetNodes {
-				klog.V(2).Infof("set DisableAvailabilitySetNodes as false since VMType is %s", driver.cloud.VMType)
-				driver.cloud.DisableAvailabilitySetNodes = false
-			}
-
-			if driver.cloud.VMType == azurecloudconsts.VMTypeVMSS && !driver.cloud.DisableAvailabilitySetNodes && driver.disableAVSetNodes {
-				klog.V(2).Infof("DisableAvailabilitySetNodes for controller since current VMType is vmss")
-				driver.cloud.DisableAvailabilitySetNodes = true
-			}
-			klog.V(2).Infof("cloud: %s, location: %s, rg: %s, VMType: %s, PrimaryScaleSetName: %s, PrimaryAvailabilitySetName: %s, DisableAvailabilitySetNodes: %v", driver.cloud.Cloud, driver.cloud.Location, driver.cloud.ResourceGroup, driver.cloud.VMType, driver.cloud.PrimaryScaleSetName, driver.cloud.PrimaryAvailabilitySetName, driver.cloud.DisableAvailabilitySetNodes)
-		}
-
-		if driver.vmssCacheTTLInSeconds > 0 {
-			klog.V(2).Infof("reset vmssCacheTTLInSeconds as %d", driver.vmssCacheTTLInSeconds)
-			driver.cloud.VMCacheTTLInSeconds = int(driver.vmssCacheTTLInSeconds)
-			driver.cloud.VmssCacheTTLInSeconds = int(driver.vmssCacheTTLInSeconds)
+		driver.diskController.clientFactory = driver.clientFactory
+		driver.diskController.dryRun = driver.dryRun
+		driver.diskController.armScheduler = driver.armScheduler
+		if driver.dryRun != nil {
+			// the VMs are not updated in the dry run, so that the disks are not found on them
+			driver.diskController.DisableDiskLunCheck = true
 		}
 	}
 
 	driver.deviceHelper = optimization.NewSafeDeviceHelper()
 
-	if driver.getPerfOptimizationEnabled() {
+	if skuCatalogEnabled(options) {
+		// the Resource SKUs API is called in the background once the driver runs, not to delay serving and registration
+		driver.skuCatalogOptions = options
+		loadSkuCatalog(context.TODO(), driver.cloud, options, false)
+	}
+
+	if driver.getPerfOptimizationEnabled() || driver.enforceNodeIOLimit || driver.enableThrottlingDetection {
 		driver.nodeInfo, err = optimization.NewNodeInfo(context.TODO(), driver.getCloud(), driver.NodeID)
 		if err != nil {
 			klog.Warningf("Failed to get node info. Error: %v", err)
@@ -264,6 +337,41 @@ func newDriverV1(options *DriverOptions) *Driver {
 	if err != nil {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
+	if driver.localCacheDevice != "" {
+		registerLocalCacheCollector(driver.mounter)
+	}
+	if driver.NodeID != "" && driver.enableVolumeIOMetrics {
+		registerVolumeIOCollector(&driver.volumeIOs)
+	}
+	if driver.NodeID != "" && driver.enableThrottlingDetection {
+		driver.throttling = newThrottlingDetector()
+	}
+	if driver.NodeID == "" && (options.EnableControllerSharding || kubeClient != nil) {
+		replicaID := options.ControllerShardID
+		if replicaID == "" {
+			if replicaID, err = os.Hostname(); err != nil {
+				klog.Fatalf("failed to get hostname as controller replica ID: %v", err)
+			}
+		}
+		group := strings.ReplaceAll(driver.Name, ".", "-")
+		if options.EnableControllerSharding {
+			if kubeClient == nil {
+				klog.Fatalf("kubeClient is required by the controller sharding")
+			}
+			driver.shards = newControllerShards(kubeClient, replicaID, options.ControllerShardNamespace, group, options.ControllerShardEndpoint)
+		}
+		if kubeClient != nil {
+			driver.leader = newControllerLeader(kubeClient, replicaID, options.LeaderElectionNamespace, group)
+			driver.controllerInformers = informers.NewSharedInformerFactory(kubeClient, 0)
+			driver.volumeAttachmentLister = driver.controllerInformers.Storage().V1().VolumeAttachments().Lister()
+			if driver.enableAutoExpand {
+				driver.volumeUsageInformers = informers.NewSharedInformerFactoryWithOptions(kubeClient, 0, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+					options.LabelSelector = volumeUsageLabel + "=true"
+				}))
+				driver.volumeUsageNodeLister = driver.volumeUsageInformers.Core().V1().Nodes().Lister()
+			}
+		}
+	}
 
 	controllerCap := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
@@ -293,6 +401,7 @@ func newDriverV1(options *DriverOptions) *Driver {
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	})
 
 	if kubeClient != nil && driver.removeNotReadyTaint {
@@ -305,6 +414,55 @@ func newDriverV1(options *DriverOptions) *Driver {
 	return &driver
 }
 
+// configureCloud applies the driver options overriding the cloud config, and returns the client factory of the disks and snapshots
+func (d *Driver) configureCloud(cloud *azure.Cloud) azclient.ClientFactory {
+	clientFactory := cloud.ComputeClientFactory
+	var perCallPolicies, perRetryPolicies []policy.Policy
+	if d.enableOtelTracing {
+		perCallPolicies = append(perCallPolicies, tracingPolicy{})
+	}
+	if d.armScheduler != nil {
+		perRetryPolicies = append(perRetryPolicies, armRateLimitPolicy{scheduler: d.armScheduler})
+	}
+	if len(perCallPolicies) > 0 || len(perRetryPolicies) > 0 {
+		if factory, err := newClientFactoryWithPolicies(cloud, perCallPolicies, perRetryPolicies); err != nil {
+			klog.Warningf("disk and snapshot requests are not traced nor rate limited by the response headers, failed to create client factory: %v", err)
+		} else {
+			clientFactory = factory
+		}
+	}
+	clientFactory = d.dryRun.wrapClientFactory(d.armScheduler.wrapClientFactory(clientFactory), cloud.SubscriptionID)
+	if d.vmType != "" {
+		klog.V(2).Infof("override VMType(%s) in cloud config as %s", cloud.VMType, d.vmType)
+		cloud.VMType = d.vmType
+	}
+
+	if d.NodeID == "" {
+		// Disable UseInstanceMetadata for controller to mitigate a timeout issue using IMDS
+		// https://github.com/kubernetes-sigs/azuredisk-csi-driver/issues/168
+		klog.V(2).Infof("disable UseInstanceMetadata for controller")
+		cloud.Config.UseInstanceMetadata = false
+
+		if cloud.VMType == azurecloudconsts.VMTypeStandard && cloud.DisableAvailabilitySetNodes {
+			klog.V(2).Infof("set DisableAvailabilitySetNodes as false since VMType is %s", cloud.VMType)
+			cloud.DisableAvailabilitySetNodes = false
+		}
+
+		if cloud.VMType == azurecloudconsts.VMTypeVMSS && !cloud.DisableAvailabilitySetNodes && d.disableAVSetNodes {
+			klog.V(2).Infof("DisableAvailabilitySetNodes for controller since current VMType is vmss")
+			cloud.DisableAvailabilitySetNodes = true
+		}
+		klog.V(2).Infof("cloud: %s, location: %s, rg: %s, VMType: %s, PrimaryScaleSetName: %s, PrimaryAvailabilitySetName: %s, DisableAvailabilitySetNodes: %v", cloud.Cloud, cloud.Location, cloud.ResourceGroup, cloud.VMType, cloud.PrimaryScaleSetName, cloud.PrimaryAvailabilitySetName, cloud.DisableAvailabilitySetNodes)
+	}
+
+	if d.vmssCacheTTLInSeconds > 0 {
+		klog.V(2).Infof("reset vmssCacheTTLInSeconds as %d", d.vmssCacheTTLInSeconds)
+		cloud.VMCacheTTLInSeconds = int(d.vmssCacheTTLInSeconds)
+		cloud.VmssCacheTTLInSeconds = int(d.vmssCacheTTLInSeconds)
+	}
+	return clientFactory
+}
+
 // Run driver initialization
 func (d *Driver) Run(ctx context.Context) error {
 	versionMeta, err := GetVersionYAML(d.Name)
@@ -313,7 +471,11 @@ func (d *Driver) Run(ctx context.Context) error {
 	}
 	klog.Infof("\nDRIVER INFORMATION:\n-------------------\n%s\n\nStreaming logs below:", versionMeta)
 
-	grpcInterceptor := grpc.UnaryInterceptor(csicommon.LogGRPC)
+	interceptors := []grpc.UnaryServerInterceptor{csicommon.LogGRPC, d.operations.unaryInterceptor}
+	if d.armScheduler != nil {
+		interceptors = append(interceptors, d.armScheduler.unaryInterceptor)
+	}
+	grpcInterceptor := grpc.ChainUnaryInterceptor(interceptors...)
 	opts := []grpc.ServerOption{
 		grpcInterceptor,
 	}
@@ -324,7 +486,9 @@ func (d *Driver) Run(ctx context.Context) error {
 		}
 		// Exporter will flush traces on shutdown
 		defer func() {
-			if err := exporter.Shutdown(context.Background()); err != nil {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+			defer cancel()
+			if err := exporter.Shutdown(shutdownCtx); err != nil {
 				klog.Errorf("Could not shutdown otel exporter: %v", err)
 			}
 		}()
@@ -336,25 +500,91 @@ func (d *Driver) Run(ctx context.Context) error {
 	csi.RegisterControllerServer(s, d)
 	csi.RegisterNodeServer(s, d)
 
+	drained := make(chan error, 1)
 	go func() {
 		//graceful shutdown
 		<-ctx.Done()
-		s.GracefulStop()
+		drained <- d.operations.drain(s, time.Duration(d.shutdownTimeoutInSeconds)*time.Second)
 	}()
+	if d.NodeID != "" && d.getPerfOptimizationEnabled() {
+		go wait.UntilWithContext(ctx, d.reapplyDeviceSettings, deviceSettingsReapplyInterval)
+	}
+	if d.throttling != nil {
+		go wait.UntilWithContext(ctx, d.detectThrottling, throttlingCheckInterval)
+	}
+	if d.shards != nil {
+		if err := d.shards.start(ctx); err != nil {
+			klog.Fatalf("failed to start controller sharding: %v", err)
+		}
+		go wait.UntilWithContext(ctx, d.shards.renew, shardLeaseRenewInterval)
+		if d.shards.endpoint != "" {
+			go func() {
+				if err := d.serveShardEndpoint(ctx); err != nil {
+					klog.Fatalf("failed to serve controller shard endpoint(%s): %v", d.shards.endpoint, err)
+				}
+			}()
+		}
+	}
+	if d.leader != nil {
+		for _, factory := range []informers.SharedInformerFactory{d.controllerInformers, d.volumeUsageInformers} {
+			if factory == nil {
+				continue
+			}
+			factory.Start(ctx.Done())
+			for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+				if !synced {
+					klog.Fatalf("failed to sync the informer of %v", informer)
+				}
+			}
+		}
+		go wait.UntilWithContext(ctx, d.leader.renew, shardLeaseRenewInterval)
+		go wait.UntilWithContext(ctx, d.fencePersistentReservations, fencingInterval)
+	}
+	if d.NodeID != "" && d.kubeClient != nil {
+		go d.watchFenceRequests(ctx)
+	}
+	if d.enableCloudConfigReload {
+		go d.watchCloudConfig(ctx)
+	}
+	if d.skuCatalogOptions != nil && (d.skuCatalogOptions.EnableSkuCatalogAPI || d.skuCatalogOptions.SkuCatalogCacheTTLInSeconds > 0) {
+		go d.refreshSkuCatalog(ctx, time.Duration(d.skuCatalogOptions.SkuCatalogCacheTTLInSeconds)*time.Second)
+	}
+	if d.enableAutoExpand {
+		if d.NodeID != "" {
+			go wait.UntilWithContext(ctx, d.reportVolumeUsage, autoExpandInterval)
+		} else {
+			go wait.UntilWithContext(ctx, d.autoExpand, autoExpandInterval)
+		}
+	}
 	// Driver d act as IdentityServer, ControllerServer and NodeServer
 	listener, err := csicommon.Listen(ctx, d.endpoint)
 	if err != nil {
 		klog.Fatalf("failed to listen to endpoint, error: %v", err)
 	}
 	err = s.Serve(listener)
-	if errors.Is(err, grpc.ErrServerStopped) {
+	if err == nil || errors.Is(err, grpc.ErrServerStopped) {
 		klog.Infof("gRPC server stopped serving")
+		if ctx.Err() != nil {
+			return <-drained
+		}
 		return nil
 	}
 	return err
 }
 
+// sleepIfThrottled sleeps for the RetryAfter of a throttled request, unless the ARM request scheduler is enabled,
+// which rejects the requests until then instead
+func (d *Driver) sleepIfThrottled(err error, defaultSleepSec int) {
+	if d.armScheduler != nil {
+		return
+	}
+	azureutils.SleepIfThrottled(err, defaultSleepSec)
+}
+
 func (d *Driver) isGetDiskThrottled() bool {
+	if d.armScheduler.isThrottled(armOperationRead) {
+		return true
+	}
 	cache, err := d.throttlingCache.Get(consts.GetDiskThrottlingKey, azcache.CacheReadTypeDefault)
 	if err != nil {
 		klog.Warningf("throttlingCache(%s) return with error: %s", consts.GetDiskThrottlingKey, err)
@@ -388,7 +618,7 @@ func (d *Driver) checkDiskExists(ctx context.Context, diskURI string) (*armcompu
 		return nil, nil
 	}
 	subsID := azureutils.GetSubscriptionIDFromURI(diskURI)
-	diskClient, err := d.diskController.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := d.diskController.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return nil, err
 	}
@@ -404,7 +634,7 @@ func (d *Driver) checkDiskCapacity(ctx context.Context, subsID, resourceGroup, d
 		klog.Warningf("skip checkDiskCapacity(%s, %s) since it's still in throttling", resourceGroup, diskName)
 		return true, nil
 	}
-	diskClient, err := d.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := d.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return false, err
 	}
@@ -448,16 +678,27 @@ func (d *DriverCore) setVersion(version string) {
 	d.Version = version
 }
 
-// getCloud returns the value of the cloud field. It is intended for use with unit tests.
+// getCloud returns the value of the cloud field.
 func (d *DriverCore) getCloud() *azure.Cloud {
+	d.cloudMutex.RLock()
+	defer d.cloudMutex.RUnlock()
 	return d.cloud
 }
 
 // setCloud sets the cloud field. It is intended for use with unit tests.
 func (d *DriverCore) setCloud(cloud *azure.Cloud) {
+	d.cloudMutex.Lock()
+	defer d.cloudMutex.Unlock()
 	d.cloud = cloud
 }
 
+// getClientFactory returns the value of the clientFactory field.
+func (d *DriverCore) getClientFactory() azclient.ClientFactory {
+	d.cloudMutex.RLock()
+	defer d.cloudMutex.RUnlock()
+	return d.clientFactory
+}
+
 // getMounter returns the value of the mounter field. It is intended for use with unit tests.
 func (d *DriverCore) getMounter() *mount.SafeFormatAndMount {
 	return d.mounter
@@ -494,7 +735,7 @@ func (d *DriverCore) getHostUtil() hostUtil {
 
 // getSnapshotCompletionPercent returns the completion percent of snapshot
 func (d *DriverCore) getSnapshotCompletionPercent(ctx context.Context, subsID, resourceGroup, snapshotName string) (float32, error) {
-	snapshotClient, err := d.clientFactory.GetSnapshotClientForSub(subsID)
+	snapshotClient, err := d.getClientFactory().GetSnapshotClientForSub(subsID)
 	if err != nil {
 		return 0.0, err
 	}
@@ -526,8 +767,11 @@ func (d *DriverCore) waitForSnapshotReady(ctx context.Context, subsID, resourceG
 
 	timeTick := time.Tick(intervel)
 	timeAfter := time.After(timeout)
+	shuttingDown := d.operations.shuttingDown()
 	for {
 		select {
+		case <-shuttingDown:
+			return fmt.Errorf("stop waiting for snapshot(%s) under rg(%s) with completionPercent %f: %w", snapshotName, resourceGroup, completionPercent, errShuttingDown)
 		case <-timeTick:
 			completionPercent, err = d.getSnapshotCompletionPercent(ctx, subsID, resourceGroup, snapshotName)
 			if err != nil {
@@ -547,7 +791,7 @@ func (d *DriverCore) waitForSnapshotReady(ctx context.Context, subsID, resourceG
 
 // getUsedLunsFromVolumeAttachments returns a list of used luns from VolumeAttachments
 func (d *DriverCore) getUsedLunsFromVolumeAttachments(ctx context.Context, nodeName string) ([]int, error) {
-	kubeClient := d.cloud.KubeClient
+	kubeClient := d.getCloud().KubeClient
 	if kubeClient == nil || kubeClient.StorageV1() == nil || kubeClient.StorageV1().VolumeAttachments() == nil {
 		return nil, fmt.Errorf("kubeClient or kubeClient.StorageV1() or kubeClient.StorageV1().VolumeAttachments() is nil")
 	}
@@ -0,0 +1,190 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	azurecloudconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DriverConfigurationAPIVersion is the version of the driver configuration file
+	DriverConfigurationAPIVersion = "disk.csi.azure.com/v1alpha1"
+	// DriverConfigurationKind is the kind of the driver configuration file
+	DriverConfigurationKind = "DriverConfiguration"
+)
+
+// DriverConfiguration is the versioned driver configuration file, which holds the driver options.
+// The options are named after the fields of DriverOptions, e.g. enableListVolumes for --enable-list-volumes.
+type DriverConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+	DriverOptions   `json:",inline"`
+}
+
+// LoadConfigFile sets the options from the driver configuration file, the options not in the file get the default values of the flags,
+// and setFlags, the flags set on the command line by name, take precedence over the file.
+func (o *DriverOptions) LoadConfigFile(path string, setFlags map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read driver configuration file(%s): %w", path, err)
+	}
+	fs := o.AddFlags()
+	config := DriverConfiguration{DriverOptions: *o}
+	// unknown options and values of wrong types are rejected
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return fmt.Errorf("failed to parse driver configuration file(%s): %w", path, err)
+	}
+	if config.APIVersion != DriverConfigurationAPIVersion || config.Kind != DriverConfigurationKind {
+		return fmt.Errorf("unsupported driver configuration file(%s) of apiVersion(%s) kind(%s), expected apiVersion(%s) kind(%s)",
+			path, config.APIVersion, config.Kind, DriverConfigurationAPIVersion, DriverConfigurationKind)
+	}
+	*o = config.DriverOptions
+	for name, value := range setFlags {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("failed to set flag --%s=%s: %w", name, value, err)
+		}
+	}
+	return nil
+}
+
+// Validate rejects the invalid options and combinations of options
+func (o *DriverOptions) Validate() error {
+	var errs []error
+	if o.DriverName == "" {
+		errs = append(errs, fmt.Errorf("driverName must not be empty"))
+	}
+	if o.Endpoint == "" {
+		errs = append(errs, fmt.Errorf("endpoint must not be empty"))
+	}
+	if o.VolumeAttachLimit < -1 {
+		errs = append(errs, fmt.Errorf("volumeAttachLimit(%d) must be -1 or greater", o.VolumeAttachLimit))
+	}
+	if o.ReservedDataDiskSlotNum < 0 {
+		errs = append(errs, fmt.Errorf("reservedDataDiskSlotNum(%d) must not be negative", o.ReservedDataDiskSlotNum))
+	}
+	if o.VolumeAttachLimit > 0 && o.ReservedDataDiskSlotNum >= o.VolumeAttachLimit {
+		errs = append(errs, fmt.Errorf("reservedDataDiskSlotNum(%d) must be less than volumeAttachLimit(%d)", o.ReservedDataDiskSlotNum, o.VolumeAttachLimit))
+	}
+	if o.EnableTrafficManager && (o.TrafficManagerPort <= 0 || o.TrafficManagerPort > 65535) {
+		errs = append(errs, fmt.Errorf("trafficManagerPort(%d) must be between 1 and 65535 when enableTrafficManager is true", o.TrafficManagerPort))
+	}
+	if o.AttachDetachInitialDelayInMs < 0 {
+		errs = append(errs, fmt.Errorf("attachDetachInitialDelayInMs(%d) must not be negative", o.AttachDetachInitialDelayInMs))
+	}
+	switch o.VMType {
+	case "", azurecloudconsts.VMTypeVMSS, azurecloudconsts.VMTypeStandard, azurecloudconsts.VMTypeVmssFlex:
+	default:
+		errs = append(errs, fmt.Errorf("vmType(%s) must be one of %s, %s and %s", o.VMType, azurecloudconsts.VMTypeVMSS, azurecloudconsts.VMTypeStandard, azurecloudconsts.VMTypeVmssFlex))
+	}
+	if o.LocalCacheDevice != "" && !filepath.IsAbs(o.LocalCacheDevice) {
+		errs = append(errs, fmt.Errorf("localCacheDevice(%s) must be an absolute path, e.g. /dev/nvme0n1", o.LocalCacheDevice))
+	}
+	if o.LuksKeyDir != "" && !filepath.IsAbs(o.LuksKeyDir) {
+		errs = append(errs, fmt.Errorf("luksKeyDir(%s) must be an absolute path, e.g. /etc/azuredisk/luks-keys", o.LuksKeyDir))
+	}
+	if o.FsckTimeoutInSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("fsckTimeoutInSeconds(%d) must be positive", o.FsckTimeoutInSeconds))
+	}
+	if o.SkuCatalogCacheFile != "" && !o.EnableSkuCatalogAPI {
+		errs = append(errs, fmt.Errorf("skuCatalogCacheFile caches the SKUs of the Resource SKUs API, it requires enableSkuCatalogAPI"))
+	}
+	if o.SkuCatalogCacheTTLInSeconds < 0 {
+		errs = append(errs, fmt.Errorf("skuCatalogCacheTTLInSeconds(%d) must not be negative", o.SkuCatalogCacheTTLInSeconds))
+	}
+	if o.ShutdownTimeoutInSeconds < 0 {
+		errs = append(errs, fmt.Errorf("shutdownTimeoutInSeconds(%d) must not be negative", o.ShutdownTimeoutInSeconds))
+	}
+	if o.EnableControllerSharding {
+		if o.NodeID != "" {
+			errs = append(errs, fmt.Errorf("enableControllerSharding only applies to the controller, nodeID(%s) must be empty", o.NodeID))
+		}
+		if o.ControllerShardNamespace == "" {
+			errs = append(errs, fmt.Errorf("controllerShardNamespace must not be empty when enableControllerSharding is true"))
+		}
+		if o.ControllerShardEndpoint != "" {
+			if _, _, err := net.SplitHostPort(o.ControllerShardEndpoint); err != nil {
+				errs = append(errs, fmt.Errorf("controllerShardEndpoint(%s) must be host:port: %v", o.ControllerShardEndpoint, err))
+			}
+		}
+	} else if o.ControllerShardID != "" {
+		errs = append(errs, fmt.Errorf("controllerShardID(%s) requires enableControllerSharding", o.ControllerShardID))
+	}
+	if o.NodeID == "" && o.LeaderElectionNamespace == "" {
+		errs = append(errs, fmt.Errorf("leaderElectionNamespace must not be empty on the controller"))
+	}
+	if o.DryRun && o.NodeID != "" {
+		errs = append(errs, fmt.Errorf("dryRun only applies to the controller, nodeID(%s) must be empty", o.NodeID))
+	}
+	if o.DryRunJournal != "" && !o.DryRun {
+		errs = append(errs, fmt.Errorf("dryRunJournal(%s) requires dryRun", o.DryRunJournal))
+	}
+	if o.EnableARMRequestScheduler {
+		if o.ARMRequestQPS <= 0 {
+			errs = append(errs, fmt.Errorf("armRequestQPS(%d) must be positive when enableARMRequestScheduler is true", o.ARMRequestQPS))
+		}
+		if o.ARMRequestBurst < 1 {
+			errs = append(errs, fmt.Errorf("armRequestBurst(%d) must be at least 1 when enableARMRequestScheduler is true", o.ARMRequestBurst))
+		}
+		if o.ARMRequestMaxQueueWaitInMs < 0 {
+			errs = append(errs, fmt.Errorf("armRequestMaxQueueWaitInMs(%d) must not be negative", o.ARMRequestMaxQueueWaitInMs))
+		}
+	}
+	if err := o.validateDriverVersion(); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// changedOptions returns the options whose values are different from the default values of the flags, except the excluded ones
+func (o *DriverOptions) changedOptions(excluded ...string) []string {
+	defaults := &DriverOptions{}
+	defaults.AddFlags()
+	value, defaultValue := reflect.ValueOf(*o), reflect.ValueOf(*defaults)
+	var changed []string
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if !reflect.DeepEqual(value.Field(i).Interface(), defaultValue.Field(i).Interface()) && !slices.Contains(excluded, name) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// String returns the options in the format of the driver configuration file
+func (o *DriverOptions) String() string {
+	data, err := yaml.Marshal(DriverConfiguration{
+		TypeMeta:      metav1.TypeMeta{APIVersion: DriverConfigurationAPIVersion, Kind: DriverConfigurationKind},
+		DriverOptions: *o,
+	})
+	if err != nil {
+		return fmt.Sprintf("%+v", *o)
+	}
+	return string(data)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `apiVersion: disk.csi.azure.com/v1alpha1
+kind: DriverConfiguration
+enableListVolumes: true
+vmType: vmss
+fsckTimeoutInSeconds: 30
+`)
+	o := &DriverOptions{}
+	o.AddFlags()
+	assert.NoError(t, o.LoadConfigFile(path, map[string]string{"fsck-timeout-seconds": "60", "metrics-address": ":29604"}))
+	assert.True(t, o.EnableListVolumes)
+	assert.False(t, o.EnableListSnapshots)
+	assert.Equal(t, "vmss", o.VMType)
+	// the flags set on the command line take precedence over the file
+	assert.Equal(t, int64(60), o.FsckTimeoutInSeconds)
+	// the options not in the file get the default values
+	assert.Equal(t, "disk.csi.azure.com", o.DriverName)
+	assert.Equal(t, int64(-1), o.VolumeAttachLimit)
+	assert.NoError(t, o.Validate())
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		content string
+		err     string
+	}{
+		{
+			desc:    "unknown option",
+			content: "apiVersion: disk.csi.azure.com/v1alpha1\nkind: DriverConfiguration\nenableListVolume: true\n",
+			err:     `unknown field "enableListVolume"`,
+		},
+		{
+			desc:    "wrong type",
+			content: "apiVersion: disk.csi.azure.com/v1alpha1\nkind: DriverConfiguration\nvolumeAttachLimit: eight\n",
+			err:     "cannot unmarshal string",
+		},
+		{
+			desc:    "unsupported apiVersion",
+			content: "apiVersion: disk.csi.azure.com/v2\nkind: DriverConfiguration\n",
+			err:     "unsupported driver configuration file",
+		},
+		{
+			desc:    "missing kind",
+			content: "apiVersion: disk.csi.azure.com/v1alpha1\n",
+			err:     "unsupported driver configuration file",
+		},
+	}
+	for _, test := range tests {
+		o := &DriverOptions{}
+		err := o.LoadConfigFile(writeConfigFile(t, test.content), nil)
+		assert.ErrorContains(t, err, test.err, test.desc)
+	}
+
+	o := &DriverOptions{}
+	assert.ErrorContains(t, o.LoadConfigFile(filepath.Join(t.TempDir(), "missing.yaml"), nil), "failed to read driver configuration file")
+}
+
+func TestValidateDriverOptions(t *testing.T) {
+	tests := []struct {
+		desc   string
+		modify func(o *DriverOptions)
+		err    string
+	}{
+		{
+			desc:   "default options",
+			modify: func(*DriverOptions) {},
+		},
+		{
+			desc:   "empty driver name",
+			modify: func(o *DriverOptions) { o.DriverName = "" },
+			err:    "driverName must not be empty",
+		},
+		{
+			desc: "reserved slots exceed attach limit",
+			modify: func(o *DriverOptions) {
+				o.VolumeAttachLimit = 4
+				o.ReservedDataDiskSlotNum = 4
+			},
+			err: "reservedDataDiskSlotNum(4) must be less than volumeAttachLimit(4)",
+		},
+		{
+			desc: "invalid traffic manager port",
+			modify: func(o *DriverOptions) {
+				o.EnableTrafficManager = true
+				o.TrafficManagerPort = 0
+			},
+			err: "trafficManagerPort(0) must be between 1 and 65535",
+		},
+		{
+			desc:   "invalid vm type",
+			modify: func(o *DriverOptions) { o.VMType = "vmas" },
+			err:    "vmType(vmas) must be one of",
+		},
+		{
+			desc:   "relative local cache device",
+			modify: func(o *DriverOptions) { o.LocalCacheDevice = "nvme0n1" },
+			err:    "localCacheDevice(nvme0n1) must be an absolute path",
+		},
+		{
+			desc:   "relative luks key dir",
+			modify: func(o *DriverOptions) { o.LuksKeyDir = "luks-keys" },
+			err:    "luksKeyDir(luks-keys) must be an absolute path",
+		},
+		{
+			desc:   "sku catalog cache without sku catalog API",
+			modify: func(o *DriverOptions) { o.SkuCatalogCacheFile = "/var/lib/azuredisk/skus.json" },
+			err:    "it requires enableSkuCatalogAPI",
+		},
+		{
+			desc: "controller sharding on node",
+			modify: func(o *DriverOptions) {
+				o.EnableControllerSharding = true
+				o.NodeID = "node-0"
+			},
+			err: "nodeID(node-0) must be empty",
+		},
+		{
+			desc: "dry run on node",
+			modify: func(o *DriverOptions) {
+				o.DryRun = true
+				o.NodeID = "node-0"
+			},
+			err: "dryRun only applies to the controller",
+		},
+		{
+			desc:   "dry run journal without dry run",
+			modify: func(o *DriverOptions) { o.DryRunJournal = "/tmp/journal.jsonl" },
+			err:    "dryRunJournal(/tmp/journal.jsonl) requires dryRun",
+		},
+		{
+			desc: "controller shard endpoint without port",
+			modify: func(o *DriverOptions) {
+				o.EnableControllerSharding = true
+				o.ControllerShardEndpoint = "10.0.0.4"
+			},
+			err: "controllerShardEndpoint(10.0.0.4) must be host:port",
+		},
+		{
+			desc:   "controller without leader election namespace",
+			modify: func(o *DriverOptions) { o.LeaderElectionNamespace = "" },
+			err:    "leaderElectionNamespace must not be empty on the controller",
+		},
+		{
+			desc:   "shard ID without controller sharding",
+			modify: func(o *DriverOptions) { o.ControllerShardID = "csi-azuredisk-controller-0" },
+			err:    "requires enableControllerSharding",
+		},
+		{
+			desc: "ARM request scheduler without budget",
+			modify: func(o *DriverOptions) {
+				o.EnableARMRequestScheduler = true
+				o.ARMRequestQPS = 0
+			},
+			err: "armRequestQPS(0) must be positive",
+		},
+		{
+			desc: "ARM request scheduler without burst",
+			modify: func(o *DriverOptions) {
+				o.EnableARMRequestScheduler = true
+				o.ARMRequestBurst = 0
+			},
+			err: "armRequestBurst(0) must be at least 1",
+		},
+	}
+	for _, test := range tests {
+		o := &DriverOptions{}
+		o.AddFlags()
+		test.modify(o)
+		err := o.Validate()
+		if test.err == "" {
+			assert.NoError(t, err, test.desc)
+		} else {
+			assert.ErrorContains(t, err, test.err, test.desc)
+		}
+	}
+
+	// all the errors are reported at once
+	o := &DriverOptions{}
+	o.AddFlags()
+	o.Endpoint = ""
+	o.FsckTimeoutInSeconds = 0
+	err := o.Validate()
+	assert.ErrorContains(t, err, "endpoint must not be empty")
+	assert.ErrorContains(t, err, "fsckTimeoutInSeconds(0) must be positive")
+}
+
+func TestChangedOptions(t *testing.T) {
+	o := &DriverOptions{}
+	o.AddFlags()
+	assert.Empty(t, o.changedOptions())
+
+	o.NodeID = "node-0"
+	o.EnableListSnapshots = true
+	o.VolumeAttachLimit = 8
+	assert.Equal(t, []string{"nodeID", "volumeAttachLimit", "enableListSnapshots"}, o.changedOptions())
+	assert.Equal(t, []string{"enableListSnapshots"}, o.changedOptions("nodeID", "volumeAttachLimit"))
+}
+
+func TestDriverOptionsString(t *testing.T) {
+	o := &DriverOptions{}
+	o.AddFlags()
+	o.EnableListVolumes = true
+	o.VMType = "vmssflex"
+
+	// the effective configuration could be loaded as a driver configuration file
+	loaded := &DriverOptions{}
+	assert.NoError(t, loaded.LoadConfigFile(writeConfigFile(t, o.String()), nil))
+	assert.Equal(t, *o, *loaded)
+}
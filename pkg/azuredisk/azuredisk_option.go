@@ -25,42 +25,66 @@ import (
 // DriverOptions defines driver parameters specified in driver deployment
 type DriverOptions struct {
 	// Common options
-	NodeID                     string
-	DriverName                 string
-	VolumeAttachLimit          int64
-	ReservedDataDiskSlotNum    int64
-	EnablePerfOptimization     bool
-	CloudConfigSecretName      string
-	CloudConfigSecretNamespace string
-	CustomUserAgent            string
-	UserAgentSuffix            string
-	UseCSIProxyGAInterface     bool
-	EnableOtelTracing          bool
+	NodeID                     string `json:"nodeID"`
+	DriverName                 string `json:"driverName"`
+	VolumeAttachLimit          int64  `json:"volumeAttachLimit"`
+	ReservedDataDiskSlotNum    int64  `json:"reservedDataDiskSlotNum"`
+	EnablePerfOptimization     bool   `json:"enablePerfOptimization"`
+	CloudConfigSecretName      string `json:"cloudConfigSecretName"`
+	CloudConfigSecretNamespace string `json:"cloudConfigSecretNamespace"`
+	CustomUserAgent            string `json:"customUserAgent"`
+	UserAgentSuffix            string `json:"userAgentSuffix"`
+	UseCSIProxyGAInterface     bool   `json:"useCSIProxyGAInterface"`
+	EnableOtelTracing          bool   `json:"enableOtelTracing"`
 
 	//only used in v1
-	EnableDiskOnlineResize       bool
-	AllowEmptyCloudConfig        bool
-	EnableListVolumes            bool
-	EnableListSnapshots          bool
-	SupportZone                  bool
-	GetNodeInfoFromLabels        bool
-	EnableDiskCapacityCheck      bool
-	DisableUpdateCache           bool
-	EnableTrafficManager         bool
-	TrafficManagerPort           int64
-	AttachDetachInitialDelayInMs int64
-	VMSSCacheTTLInSeconds        int64
-	VolStatsCacheExpireInMinutes int64
-	VMType                       string
-	EnableWindowsHostProcess     bool
-	GetNodeIDFromIMDS            bool
-	WaitForSnapshotReady         bool
-	CheckDiskLUNCollision        bool
-	ForceDetachBackoff           bool
-	Kubeconfig                   string
-	Endpoint                     string
-	DisableAVSetNodes            bool
-	RemoveNotReadyTaint          bool
+	EnableDiskOnlineResize       bool   `json:"enableDiskOnlineResize"`
+	AllowEmptyCloudConfig        bool   `json:"allowEmptyCloudConfig"`
+	EnableListVolumes            bool   `json:"enableListVolumes"`
+	EnableListSnapshots          bool   `json:"enableListSnapshots"`
+	SupportZone                  bool   `json:"supportZone"`
+	GetNodeInfoFromLabels        bool   `json:"getNodeInfoFromLabels"`
+	EnableDiskCapacityCheck      bool   `json:"enableDiskCapacityCheck"`
+	DisableUpdateCache           bool   `json:"disableUpdateCache"`
+	EnableTrafficManager         bool   `json:"enableTrafficManager"`
+	TrafficManagerPort           int64  `json:"trafficManagerPort"`
+	AttachDetachInitialDelayInMs int64  `json:"attachDetachInitialDelayInMs"`
+	VMSSCacheTTLInSeconds        int64  `json:"vmssCacheTTLInSeconds"`
+	VolStatsCacheExpireInMinutes int64  `json:"volStatsCacheExpireInMinutes"`
+	VMType                       string `json:"vmType"`
+	EnableWindowsHostProcess     bool   `json:"enableWindowsHostProcess"`
+	GetNodeIDFromIMDS            bool   `json:"getNodeIDFromIMDS"`
+	WaitForSnapshotReady         bool   `json:"waitForSnapshotReady"`
+	CheckDiskLUNCollision        bool   `json:"checkDiskLUNCollision"`
+	ForceDetachBackoff           bool   `json:"forceDetachBackoff"`
+	Kubeconfig                   string `json:"kubeconfig"`
+	Endpoint                     string `json:"endpoint"`
+	DisableAVSetNodes            bool   `json:"disableAVSetNodes"`
+	RemoveNotReadyTaint          bool   `json:"removeNotReadyTaint"`
+	LocalCacheDevice             string `json:"localCacheDevice"`
+	LuksKeyDir                   string `json:"luksKeyDir"`
+	FsckTimeoutInSeconds         int64  `json:"fsckTimeoutInSeconds"`
+	EnforceNodeIOLimit           bool   `json:"enforceNodeIOLimit"`
+	EnableSkuCatalogAPI          bool   `json:"enableSkuCatalogAPI"`
+	SkuCatalogCacheFile          string `json:"skuCatalogCacheFile"`
+	SkuCatalogCacheTTLInSeconds  int64  `json:"skuCatalogCacheTTLInSeconds"`
+	SkuCatalogOverrideFile       string `json:"skuCatalogOverrideFile"`
+	EnableVolumeIOMetrics        bool   `json:"enableVolumeIOMetrics"`
+	EnableThrottlingDetection    bool   `json:"enableThrottlingDetection"`
+	EnableAutoExpand             bool   `json:"enableAutoExpand"`
+	ShutdownTimeoutInSeconds     int64  `json:"shutdownTimeoutInSeconds"`
+	EnableControllerSharding     bool   `json:"enableControllerSharding"`
+	ControllerShardID            string `json:"controllerShardID"`
+	ControllerShardNamespace     string `json:"controllerShardNamespace"`
+	ControllerShardEndpoint      string `json:"controllerShardEndpoint"`
+	LeaderElectionNamespace      string `json:"leaderElectionNamespace"`
+	EnableCloudConfigReload      bool   `json:"enableCloudConfigReload"`
+	DryRun                       bool   `json:"dryRun"`
+	DryRunJournal                string `json:"dryRunJournal"`
+	EnableARMRequestScheduler    bool   `json:"enableARMRequestScheduler"`
+	ARMRequestQPS                int64  `json:"armRequestQPS"`
+	ARMRequestBurst              int64  `json:"armRequestBurst"`
+	ARMRequestMaxQueueWaitInMs   int64  `json:"armRequestMaxQueueWaitInMs"`
 }
 
 func (o *DriverOptions) AddFlags() *flag.FlagSet {
@@ -102,6 +126,30 @@ func (o *DriverOptions) AddFlags() *flag.FlagSet {
 	fs.StringVar(&o.Kubeconfig, "kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
 	fs.BoolVar(&o.DisableAVSetNodes, "disable-avset-nodes", false, "disable DisableAvailabilitySetNodes in cloud config for controller")
 	fs.BoolVar(&o.RemoveNotReadyTaint, "remove-not-ready-taint", true, "remove NotReady taint from node when node is ready")
+	fs.StringVar(&o.LocalCacheDevice, "local-cache-device", "", "local NVMe or temp disk device on the node to carve read cache slices from for volumes with localCache parameter, e.g. /dev/nvme0n1")
+	fs.StringVar(&o.LuksKeyDir, "luks-key-dir", "/etc/azuredisk/luks-keys", "directory on the node of the LUKS key files referenced by luksKeyFile in node stage secrets, key files outside the directory are rejected, empty string disables key files")
+	fs.Int64Var(&o.FsckTimeoutInSeconds, "fsck-timeout-seconds", 600, "timeout in seconds of the file system check and repair for volumes with fsckPolicy parameter")
+	fs.BoolVar(&o.EnforceNodeIOLimit, "enforce-node-io-limit", false, "boolean flag to cap the sum of pod I/O limits of volumes on the node to the IOPS and bandwidth limits of the VM size")
+	fs.BoolVar(&o.EnableSkuCatalogAPI, "enable-sku-catalog-api", false, "boolean flag to load VM and disk SKUs from the Resource SKUs API instead of only the SKU maps compiled into the driver")
+	fs.StringVar(&o.SkuCatalogCacheFile, "sku-catalog-cache-file", "", "file to cache the SKUs loaded from the Resource SKUs API, the cache is used if the API call fails")
+	fs.Int64Var(&o.SkuCatalogCacheTTLInSeconds, "sku-catalog-cache-ttl-seconds", 86400, "TTL in seconds of the SKU catalog cache file, the Resource SKUs API is not called if the cache file is newer, the SKU catalog is also reloaded at this interval, 0 disables the cache and the periodic reload")
+	fs.StringVar(&o.SkuCatalogOverrideFile, "sku-catalog-override-file", "", "JSON or YAML file of VM and disk SKUs in the format of `az vm list-skus -o json`, which take precedence over the SKUs from the Resource SKUs API")
+	fs.BoolVar(&o.EnableVolumeIOMetrics, "enable-volume-io-metrics", true, "boolean flag to export the block IO statistics of the disks of staged volumes on the node metrics endpoint")
+	fs.BoolVar(&o.EnableThrottlingDetection, "enable-throttling-detection", false, "boolean flag to check whether the disks of staged volumes are pinned at the IOPS and bandwidth limits of the disks or the VM size, which are exported as metrics and recorded as events")
+	fs.BoolVar(&o.EnableAutoExpand, "enable-auto-expand", false, "boolean flag to expand volumes whose file system usage crosses the autoExpandThresholdPercent parameter, the node reports the usage in the node annotation and the elected controller replica expands the PVCs")
+	fs.Int64Var(&o.ShutdownTimeoutInSeconds, "shutdown-timeout-seconds", 25, "timeout in seconds to drain the in-flight operations on SIGTERM, the remaining operations are cancelled after the timeout")
+	fs.BoolVar(&o.EnableControllerSharding, "enable-controller-sharding", false, "boolean flag to split the attach/detach of the nodes among the active controller replicas")
+	fs.StringVar(&o.ControllerShardID, "controller-shard-id", "", "unique ID of the controller replica in the controller sharding, hostname is used if empty")
+	fs.StringVar(&o.ControllerShardNamespace, "controller-shard-namespace", "kube-system", "namespace of the leases of the controller replicas in the controller sharding")
+	fs.StringVar(&o.ControllerShardEndpoint, "controller-shard-endpoint", "", "host:port advertised to the other controller replicas, which forward the attach/detach of the nodes owned by the replica to it, the replica handles all the requests it receives if empty")
+	fs.StringVar(&o.LeaderElectionNamespace, "leader-election-namespace", "kube-system", "namespace of the lease electing the controller replica which runs the cluster-wide controller loops, e.g. auto expansion and persistent reservation fencing")
+	fs.BoolVar(&o.EnableCloudConfigReload, "enable-cloud-config-reload", true, "boolean flag to watch the cloud config secret and file, and reload the cloud config and credentials without restarting the driver when either changes")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "boolean flag to record the mutating ARM requests of the controller, e.g. disk create and attach, in the dry run journal and return synthetic successes instead of executing them, the read requests are executed")
+	fs.StringVar(&o.DryRunJournal, "dry-run-journal", "", "path of the JSON lines journal of the dry run, the journal is written to stdout if empty")
+	fs.BoolVar(&o.EnableARMRequestScheduler, "enable-arm-request-scheduler", false, "boolean flag to pace the disk, snapshot and VM requests of the controller to ARM with a shared request budget, and reject the requests with Unavailable and a retry delay when ARM throttles them instead of sleeping")
+	fs.Int64Var(&o.ARMRequestQPS, "arm-request-qps", 10, "ARM requests per second of the ARM request scheduler")
+	fs.Int64Var(&o.ARMRequestBurst, "arm-request-burst", 20, "ARM request burst of the ARM request scheduler")
+	fs.Int64Var(&o.ARMRequestMaxQueueWaitInMs, "arm-request-max-queue-wait-ms", 5000, "maximum time in milliseconds a request waits for the ARM request scheduler, the request is rejected with Unavailable if it would wait longer")
 	fs.StringVar(&o.Endpoint, "endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 
 	return fs
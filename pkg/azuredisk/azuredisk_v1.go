@@ -24,3 +24,8 @@ package azuredisk
 func NewDriver(options *DriverOptions) CSIDriver {
 	return newDriverV1(options)
 }
+
+// validateDriverVersion validates the options for the driver version, all options are supported by the v1 driver
+func (o *DriverOptions) validateDriverVersion() error {
+	return nil
+}
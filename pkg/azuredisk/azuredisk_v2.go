@@ -62,6 +62,21 @@ func NewDriver(options *DriverOptions) CSIDriver {
 	}
 }
 
+// driverV2Options are the options supported by the v2 driver
+var driverV2Options = []string{"nodeID", "driverName", "volumeAttachLimit", "enablePerfOptimization", "cloudConfigSecretName", "cloudConfigSecretNamespace",
+	"customUserAgent", "userAgentSuffix", "useCSIProxyGAInterface", "enableOtelTracing", "disableAVSetNodes", "enableVolumeIOMetrics", "kubeconfig", "endpoint"}
+
+// validateDriverVersion rejects the options which would be ignored by the v2 driver
+func (o *DriverOptions) validateDriverVersion() error {
+	if !*useDriverV2 {
+		return nil
+	}
+	if ignored := o.changedOptions(driverV2Options...); len(ignored) > 0 {
+		return fmt.Errorf("options %v are not supported by the v2 driver", ignored)
+	}
+	return nil
+}
+
 // newDriverV2 Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
 // does not support optional driver plugin info manifest field. Refer to CSI spec for more details.
 func newDriverV2(options *DriverOptions) *DriverV2 {
@@ -73,6 +88,7 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 	driver.VolumeAttachLimit = options.VolumeAttachLimit
 	driver.volumeLocks = volumehelper.NewVolumeLocks()
 	driver.perfOptimizationEnabled = options.EnablePerfOptimization
+	driver.enableVolumeIOMetrics = options.EnableVolumeIOMetrics
 	driver.cloudConfigSecretName = options.CloudConfigSecretName
 	driver.cloudConfigSecretNamespace = options.CloudConfigSecretNamespace
 	driver.customUserAgent = options.CustomUserAgent
@@ -102,6 +118,8 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 	if err != nil {
 		klog.Fatalf("failed to get Azure Cloud Provider, error: %v", err)
 	}
+	// the v2 driver does not reload the cloud config, the operations still read the cloud provider
+	// by getCloud and getClientFactory, which are safe against a swap of the cloud provider
 	driver.cloud = cloud
 
 	if driver.cloud != nil {
@@ -146,6 +164,9 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 	if err != nil {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
+	if driver.NodeID != "" && driver.enableVolumeIOMetrics {
+		registerVolumeIOCollector(&driver.volumeIOs)
+	}
 
 	driver.AddControllerServiceCapabilities(
 		[]csi.ControllerServiceCapability_RPC_Type{
@@ -171,6 +192,7 @@ func newDriverV2(options *DriverOptions) *DriverV2 {
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	})
 	return &driver
 }
@@ -225,7 +247,7 @@ func (d *DriverV2) checkDiskExists(ctx context.Context, diskURI string) (*armcom
 	}
 
 	subsID := azureutils.GetSubscriptionIDFromURI(diskURI)
-	diskClient, err := d.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := d.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +261,7 @@ func (d *DriverV2) checkDiskExists(ctx context.Context, diskURI string) (*armcom
 }
 
 func (d *DriverV2) checkDiskCapacity(ctx context.Context, subsID, resourceGroup, diskName string, requestGiB int) (bool, error) {
-	diskClient, err := d.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := d.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return false, err
 	}
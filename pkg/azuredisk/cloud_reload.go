@@ -0,0 +1,246 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	// cloudConfigReloadDelay coalesces a burst of changes into one reload,
+	// e.g. kubelet updates a mounted secret by swapping the ..data symlink
+	cloudConfigReloadDelay = 2 * time.Second
+
+	cloudConfigSourceSecret = "secret"
+	cloudConfigSourceFile   = "file"
+
+	cloudConfigReloadedReason     = "CloudConfigReloaded"
+	cloudConfigReloadFailedReason = "CloudConfigReloadFailed"
+)
+
+var (
+	registerCloudConfigReloadMetricsOnce sync.Once
+
+	cloudConfigReloads = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_cloud_config_reloads_total",
+			Help:           "Number of the reloads of the cloud config triggered by a change of the cloud config secret or file",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"source", "result"},
+	)
+	cloudConfigLastReloadSuccess = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_cloud_config_last_reload_success_timestamp_seconds",
+			Help:           "Timestamp of the last successful reload of the cloud config",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+)
+
+func registerCloudConfigReloadMetrics() {
+	registerCloudConfigReloadMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(cloudConfigReloads, cloudConfigLastReloadSuccess)
+	})
+}
+
+// watchCloudConfig watches the cloud config secret and file, the cloud config is reloaded when either changes
+func (d *Driver) watchCloudConfig(ctx context.Context) {
+	if d.getCloud() == nil {
+		klog.Warningf("cloud config is not reloaded since driver is running without cloud config")
+		return
+	}
+	registerCloudConfigReloadMetrics()
+
+	changes := make(chan string, 1)
+	notify := func(source string) {
+		select {
+		case changes <- source:
+		default:
+			// a reload is already pending
+		}
+	}
+	if d.kubeClient != nil && d.cloudConfigSecretName != "" {
+		go d.watchCloudConfigSecret(ctx, notify)
+	}
+	go watchCloudConfigFile(ctx, azureutils.GetCloudConfigFilePath(), notify)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case source := <-changes:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cloudConfigReloadDelay):
+			}
+			_ = d.reloadCloudConfig(ctx, source)
+		}
+	}
+}
+
+// watchCloudConfigSecret notifies the changes of the data of the cloud config secret
+func (d *Driver) watchCloudConfigSecret(ctx context.Context, notify func(source string)) {
+	factory := informers.NewSharedInformerFactoryWithOptions(d.kubeClient, 0,
+		informers.WithNamespace(d.cloudConfigSecretNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", d.cloudConfigSecretName).String()
+		}))
+	isCloudConfigSecret := func(obj interface{}) bool {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		secret, ok := obj.(*corev1.Secret)
+		return ok && secret.Name == d.cloudConfigSecretName
+	}
+	_, err := factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			// the existing secret was read on startup
+			if !isInInitialList && isCloudConfigSecret(obj) {
+				notify(cloudConfigSourceSecret)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSecret, oldOK := oldObj.(*corev1.Secret)
+			newSecret, newOK := newObj.(*corev1.Secret)
+			if oldOK && newOK && isCloudConfigSecret(newSecret) && !reflect.DeepEqual(oldSecret.Data, newSecret.Data) {
+				notify(cloudConfigSourceSecret)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			// the cloud config falls back to the file
+			if isCloudConfigSecret(obj) {
+				notify(cloudConfigSourceSecret)
+			}
+		},
+	})
+	if err != nil {
+		klog.Errorf("failed to watch cloud config secret(%s/%s): %v", d.cloudConfigSecretNamespace, d.cloudConfigSecretName, err)
+		return
+	}
+	klog.V(2).Infof("watching cloud config secret(%s/%s)", d.cloudConfigSecretNamespace, d.cloudConfigSecretName)
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+}
+
+// watchCloudConfigFile notifies the changes of the cloud config file,
+// the directory is watched since the file is replaced rather than written when a mounted secret or config map is updated
+func watchCloudConfigFile(ctx context.Context, path string, notify func(source string)) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Errorf("failed to watch cloud config file(%s): %v", path, err)
+		return
+	}
+	defer watcher.Close()
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		klog.V(2).Infof("cloud config file(%s) is not watched: %v", path, err)
+		return
+	}
+	klog.V(2).Infof("watching cloud config file(%s)", path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// ..data is the symlink swapped by kubelet when a mounted secret or config map is updated
+			if name := filepath.Base(event.Name); name == filepath.Base(path) || name == "..data" {
+				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Remove) {
+					notify(cloudConfigSourceFile)
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Warningf("error watching cloud config file(%s): %v", path, err)
+		}
+	}
+}
+
+// reloadCloudConfig rebuilds the cloud provider and the client factory from the cloud config, and swaps them into the driver
+// and the disk controller, the in-flight operations keep using the cloud provider they got.
+// The current cloud provider is kept if the cloud config could not be loaded.
+func (d *Driver) reloadCloudConfig(ctx context.Context, source string) error {
+	registerCloudConfigReloadMetrics()
+	cloud, err := azureutils.ReloadCloudProviderFromClient(ctx, d.kubeClient, d.cloudConfigSecretName, d.cloudConfigSecretNamespace,
+		GetUserAgent(d.Name, d.customUserAgent, d.userAgentSuffix), d.enableTrafficManager, d.trafficManagerPort)
+	if err != nil {
+		cloudConfigReloads.WithLabelValues(source, "failure").Inc()
+		d.recordCloudConfigEvent(source, corev1.EventTypeWarning, cloudConfigReloadFailedReason,
+			fmt.Sprintf("failed to reload cloud config after the change of the cloud config %s, keep using the current cloud config: %v", source, err))
+		return err
+	}
+	clientFactory := d.configureCloud(cloud)
+
+	d.cloudMutex.Lock()
+	d.cloud = cloud
+	d.clientFactory = clientFactory
+	d.cloudMutex.Unlock()
+	if d.diskController != nil {
+		d.diskController.setCloud(cloud, clientFactory)
+	}
+	d.resetARMCredential()
+
+	cloudConfigReloads.WithLabelValues(source, "success").Inc()
+	cloudConfigLastReloadSuccess.SetToCurrentTime()
+	d.recordCloudConfigEvent(source, corev1.EventTypeNormal, cloudConfigReloadedReason,
+		fmt.Sprintf("reloaded cloud config after the change of the cloud config %s, rg: %s, location: %s", source, cloud.ResourceGroup, cloud.Location))
+	return nil
+}
+
+// recordCloudConfigEvent records the event on the cloud config secret, or on the node if the change is in the file
+func (d *Driver) recordCloudConfigEvent(source, eventType, reason, message string) {
+	if eventType == corev1.EventTypeWarning {
+		klog.Warning(message)
+	} else {
+		klog.V(2).Info(message)
+	}
+	if d.eventRecorder == nil {
+		return
+	}
+	switch {
+	case source == cloudConfigSourceSecret:
+		d.eventRecorder.Event(&corev1.ObjectReference{Kind: "Secret", Namespace: d.cloudConfigSecretNamespace, Name: d.cloudConfigSecretName}, eventType, reason, message)
+	case d.NodeID != "":
+		d.eventRecorder.Event(&corev1.ObjectReference{Kind: "Node", Name: d.NodeID, UID: types.UID(d.NodeID)}, eventType, reason, message)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+func TestReloadCloudConfig(t *testing.T) {
+	credFile := filepath.Join(t.TempDir(), "azure.json")
+	t.Setenv(consts.DefaultAzureCredentialFileEnv, credFile)
+	assert.NoError(t, os.WriteFile(credFile, []byte("location: \"East US\"\nresourceGroup: reloaded-rg\n"), 0600))
+
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+	recorder := record.NewFakeRecorder(10)
+	d.eventRecorder = recorder
+	oldCloud := d.getCloud()
+
+	assert.NoError(t, d.reloadCloudConfig(context.Background(), cloudConfigSourceFile))
+	cloud := d.getCloud()
+	assert.NotSame(t, oldCloud, cloud)
+	assert.Equal(t, "reloaded-rg", cloud.ResourceGroup)
+	assert.Equal(t, "eastus", cloud.Location)
+	assert.Same(t, cloud, d.diskController.getCloud())
+	assert.Equal(t, d.getClientFactory(), d.diskController.getClientFactory())
+	assert.Contains(t, <-recorder.Events, cloudConfigReloadedReason)
+
+	// the current cloud config is kept if the new one could not be loaded
+	assert.NoError(t, os.Remove(credFile))
+	assert.Error(t, d.reloadCloudConfig(context.Background(), cloudConfigSourceFile))
+	assert.Same(t, cloud, d.getCloud())
+	assert.Contains(t, <-recorder.Events, cloudConfigReloadFailedReason)
+}
+
+func TestWatchCloudConfigFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	credFile := filepath.Join(t.TempDir(), "azure.json")
+	changes := make(chan string, 1)
+	go watchCloudConfigFile(ctx, credFile, func(source string) {
+		select {
+		case changes <- source:
+		default:
+		}
+	})
+
+	// the file is written until the watcher is ready
+	for i := 0; ; i++ {
+		assert.NoError(t, os.WriteFile(credFile, []byte(fmt.Sprintf("resourceGroup: rg-%d\n", i)), 0600))
+		select {
+		case source := <-changes:
+			assert.Equal(t, cloudConfigSourceFile, source)
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if i > 50 {
+			t.Fatalf("change of cloud config file is not notified")
+		}
+	}
+}
+
+func TestWatchCloudConfigSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "azure-cloud-provider", Namespace: "kube-system"},
+		Data:       map[string][]byte{"cloud-config": []byte("resourceGroup: rg")},
+	}
+	d := &Driver{}
+	d.kubeClient = fake.NewSimpleClientset(secret)
+	d.cloudConfigSecretName = secret.Name
+	d.cloudConfigSecretNamespace = secret.Namespace
+	changes := make(chan string, 1)
+	go d.watchCloudConfigSecret(ctx, func(source string) {
+		select {
+		case changes <- source:
+		default:
+		}
+	})
+
+	// the secret is updated until the informer is synced, the existing secret is not notified
+	for i := 0; ; i++ {
+		secret.Data["cloud-config"] = []byte(fmt.Sprintf("resourceGroup: rg-%d", i))
+		_, err := d.kubeClient.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+		select {
+		case source := <-changes:
+			assert.Equal(t, cloudConfigSourceSecret, source)
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if i > 50 {
+			t.Fatalf("change of cloud config secret is not notified")
+		}
+	}
+}
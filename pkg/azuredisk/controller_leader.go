@@ -0,0 +1,125 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
+)
+
+// controllerLeader elects one of the controller replicas to run the cluster-wide controller loops,
+// e.g. auto expansion and persistent reservation fencing. The leader holds a lease, which is renewed every
+// shardLeaseRenewInterval and taken over by another replica once it's not renewed in shardLeaseDuration.
+type controllerLeader struct {
+	kubeClient kubernetes.Interface
+	id         string
+	namespace  string
+	name       string
+
+	mu sync.RWMutex
+	// the lease last written by the replica, nil if the replica is not the leader
+	lease *coordinationv1.Lease
+}
+
+func newControllerLeader(kubeClient kubernetes.Interface, id, namespace, group string) *controllerLeader {
+	return &controllerLeader{
+		kubeClient: kubeClient,
+		id:         id,
+		namespace:  namespace,
+		name:       group + "-controller-leader",
+	}
+}
+
+// isLeader returns whether the replica holds the leader lease
+func (l *controllerLeader) isLeader() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.lease == nil {
+		return false
+	}
+	holder, ok := liveLeaseHolder(l.lease, time.Now())
+	return ok && holder == l.id
+}
+
+// renew takes or renews the leader lease
+func (l *controllerLeader) renew(ctx context.Context) {
+	l.mu.RLock()
+	base := l.lease
+	l.mu.RUnlock()
+
+	lease, err := l.takeLease(ctx, base)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		if l.lease != nil {
+			klog.Errorf("controller replica(%s) lost the leader lease %s/%s: %v", l.id, l.namespace, l.name, err)
+		} else {
+			klog.V(4).Infof("controller replica(%s) is not the leader: %v", l.id, err)
+		}
+		l.lease = nil
+		return
+	}
+	if l.lease == nil {
+		klog.V(2).Infof("controller replica(%s) became the leader", l.id)
+	}
+	l.lease = lease
+}
+
+// takeLease takes the leader lease unless it's held by another replica, the updates of the lease are fenced by its resource version.
+// base is the lease last written by the replica, the lease is read from the API server if it's nil.
+func (l *controllerLeader) takeLease(ctx context.Context, base *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	leases := l.kubeClient.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	lease := base.DeepCopy()
+	if lease == nil {
+		var err error
+		if lease, err = leases.Get(ctx, l.name, metav1.GetOptions{}); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+			return leases.Create(ctx, &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{Name: l.name, Namespace: l.namespace},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       pointer.String(l.id),
+					LeaseDurationSeconds: pointer.Int32(int32(shardLeaseDuration.Seconds())),
+					AcquireTime:          &now,
+					RenewTime:            &now,
+				},
+			}, metav1.CreateOptions{})
+		}
+	}
+	if holder, ok := liveLeaseHolder(lease, now.Time); ok && holder != l.id {
+		return nil, fmt.Errorf("lease is held by controller replica(%s)", holder)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.id {
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = pointer.Int32(pointer.Int32Deref(lease.Spec.LeaseTransitions, 0) + 1)
+	}
+	lease.Spec.HolderIdentity = pointer.String(l.id)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(shardLeaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+	return leases.Update(ctx, lease, metav1.UpdateOptions{})
+}
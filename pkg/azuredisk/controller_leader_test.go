@@ -0,0 +1,67 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/pointer"
+)
+
+func TestControllerLeader(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	enforceLeaseResourceVersions(kubeClient)
+	leader0 := newControllerLeader(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com")
+	leader1 := newControllerLeader(kubeClient, "controller-1", "kube-system", "disk-csi-azure-com")
+
+	leader0.renew(ctx)
+	leader1.renew(ctx)
+	assert.True(t, leader0.isLeader())
+	assert.False(t, leader1.isLeader())
+
+	// the leader renews the lease it wrote
+	leader0.renew(ctx)
+	assert.True(t, leader0.isLeader())
+	assert.False(t, leader1.isLeader())
+
+	// the lease is taken over once it's not renewed in shardLeaseDuration
+	lease, err := kubeClient.CoordinationV1().Leases("kube-system").Get(ctx, "disk-csi-azure-com-controller-leader", metav1.GetOptions{})
+	assert.NoError(t, err)
+	expired := metav1.NewMicroTime(time.Now().Add(-2 * shardLeaseDuration))
+	lease.Spec.RenewTime = &expired
+	_, err = kubeClient.CoordinationV1().Leases("kube-system").Update(ctx, lease, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	leader1.renew(ctx)
+	assert.True(t, leader1.isLeader())
+	lease, err = kubeClient.CoordinationV1().Leases("kube-system").Get(ctx, "disk-csi-azure-com-controller-leader", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "controller-1", pointer.StringDeref(lease.Spec.HolderIdentity, ""))
+	assert.Equal(t, int32(1), pointer.Int32Deref(lease.Spec.LeaseTransitions, 0))
+
+	// the former leader fails to renew the lease written by the new leader
+	leader0.renew(ctx)
+	assert.False(t, leader0.isLeader())
+	leader0.renew(ctx)
+	assert.False(t, leader0.isLeader())
+}
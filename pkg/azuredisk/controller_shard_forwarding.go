@@ -0,0 +1,275 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	csicommon "sigs.k8s.io/azuredisk-csi-driver/pkg/csi-common"
+)
+
+const (
+	// controllerShardTokenFile is the projected service account token sent to the shard endpoints of the other replicas
+	controllerShardTokenFile = "/var/run/secrets/azuredisk/controller-shard/token"
+	// controllerShardAudience is the audience of the projected service account token, which is not accepted by the API server
+	controllerShardAudience = "disk.csi.azure.com/controller-shard"
+	// shardForwardedMetadataKey marks the requests forwarded by another replica, which are handled locally instead of being forwarded again
+	shardForwardedMetadataKey = "x-azuredisk-shard-forwarded-by"
+	// the tokens authenticated by TokenReview are not reviewed again for shardTokenCacheTTL
+	shardTokenCacheTTL = time.Minute
+	// the certificate of the shard endpoint is generated on every start, its validity only needs to cover the lifetime of the replica
+	shardCertificateValidity = 10 * 365 * 24 * time.Hour
+)
+
+// shardControllerServer serves the attach/detach forwarded by the other controller replicas on the shard endpoint
+type shardControllerServer struct {
+	csi.UnimplementedControllerServer
+	d *Driver
+}
+
+func (s *shardControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	return s.d.ControllerPublishVolume(ctx, req)
+}
+
+func (s *shardControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	return s.d.ControllerUnpublishVolume(ctx, req)
+}
+
+// serveShardEndpoint serves the attach/detach forwarded by the other controller replicas until ctx is done
+func (d *Driver) serveShardEndpoint(ctx context.Context) error {
+	_, port, err := net.SplitHostPort(d.shards.endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid controller shard endpoint(%s): %w", d.shards.endpoint, err)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return err
+	}
+	interceptors := []grpc.UnaryServerInterceptor{d.shards.authInterceptor, csicommon.LogGRPC, d.operations.unaryInterceptor}
+	if d.armScheduler != nil {
+		interceptors = append(interceptors, d.armScheduler.unaryInterceptor)
+	}
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{*d.shards.certificate}, MinVersion: tls.VersionTLS12})),
+		grpc.ChainUnaryInterceptor(interceptors...))
+	csi.RegisterControllerServer(server, &shardControllerServer{d: d})
+	go func() {
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Duration(d.shutdownTimeoutInSeconds) * time.Second):
+			server.Stop()
+		}
+	}()
+	klog.V(2).Infof("serving controller shard endpoint on %s", listener.Addr())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		return err
+	}
+	return nil
+}
+
+// isShardForwarded returns true if the request is forwarded by another controller replica
+func isShardForwarded(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(shardForwardedMetadataKey)) > 0
+}
+
+// forwardToShard sends the request to the shard endpoint of another controller replica
+func forwardToShard[Resp any](ctx context.Context, s *controllerShards, member, endpoint string, call func(context.Context, csi.ControllerClient) (Resp, error)) (Resp, error) {
+	var empty Resp
+	conn, err := s.conn(member, endpoint)
+	if err != nil {
+		return empty, status.Errorf(codes.Unavailable, "failed to connect to controller shard endpoint(%s): %v", endpoint, err)
+	}
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return empty, status.Errorf(codes.Internal, "failed to read controller shard token: %v", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+strings.TrimSpace(string(token)), shardForwardedMetadataKey, s.id)
+	return call(ctx, csi.NewControllerClient(conn))
+}
+
+// conn returns the TLS connection to the shard endpoint of the member, which is reused by the later requests.
+// Only the certificate advertised in the lease of the member is trusted, the connection is recreated if it changes.
+func (s *controllerShards) conn(member, endpoint string) (*grpc.ClientConn, error) {
+	s.mu.RLock()
+	certificatePEM := s.certificates[member]
+	s.mu.RUnlock()
+	if certificatePEM == "" {
+		return nil, fmt.Errorf("controller replica(%s) does not advertise a certificate", member)
+	}
+	key := endpoint + "/" + certificatePEM
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	if conn, ok := s.conns[endpoint]; ok {
+		if conn.key == key {
+			return conn.ClientConn, nil
+		}
+		_ = conn.Close()
+		delete(s.conns, endpoint)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(certificatePEM)) {
+		return nil, fmt.Errorf("invalid certificate of controller replica(%s)", member)
+	}
+	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:    roots,
+		ServerName: member,
+		MinVersion: tls.VersionTLS12,
+	})))
+	if err != nil {
+		return nil, err
+	}
+	s.conns[endpoint] = &shardConn{ClientConn: conn, key: key}
+	return conn, nil
+}
+
+// shardConn is a connection to the shard endpoint of a member, key identifies the endpoint and the certificate of the member
+type shardConn struct {
+	*grpc.ClientConn
+	key string
+}
+
+// newShardCertificate generates a self-signed certificate of the shard endpoint of the replica, with the replica ID as its DNS name.
+// It's trusted by the other replicas as it's advertised in the lease of the replica, which only the controller service account could update.
+func newShardCertificate(id string) (*tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: id},
+		DNSNames:              []string{id},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(shardCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// authInterceptor only accepts the requests of the controller replicas, which send the projected token of their service account
+func (s *controllerShards) authInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		token = strings.TrimPrefix(values[0], "Bearer ")
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "controller shard token is missing")
+	}
+	if err := s.authenticate(ctx, token); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authenticate checks that the token is issued to the service account of the replica for the controller shard audience
+func (s *controllerShards) authenticate(ctx context.Context, token string) error {
+	now := time.Now()
+	s.authMutex.Lock()
+	expiry, ok := s.authenticated[token]
+	username := s.username
+	s.authMutex.Unlock()
+	if ok && now.Before(expiry) {
+		return nil
+	}
+	if username == "" {
+		own, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read controller shard token: %v", err)
+		}
+		if username, err = s.reviewToken(ctx, strings.TrimSpace(string(own))); err != nil {
+			return status.Errorf(codes.Internal, "failed to review controller shard token: %v", err)
+		}
+	}
+	reviewed, err := s.reviewToken(ctx, token)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "controller shard token is not authenticated: %v", err)
+	}
+	if reviewed != username {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed to call the controller shard endpoint", reviewed)
+	}
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+	s.username = username
+	for cached, expiry := range s.authenticated {
+		if !now.Before(expiry) {
+			delete(s.authenticated, cached)
+		}
+	}
+	s.authenticated[token] = now.Add(shardTokenCacheTTL)
+	return nil
+}
+
+// reviewToken returns the username of the token if it's authenticated for the controller shard audience
+func (s *controllerShards) reviewToken(ctx context.Context, token string) (string, error) {
+	review, err := s.kubeClient.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: []string{controllerShardAudience},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	if !review.Status.Authenticated {
+		return "", fmt.Errorf("token is rejected: %s", review.Status.Error)
+	}
+	return review.Status.User.Username, nil
+}
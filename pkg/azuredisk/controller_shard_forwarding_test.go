@@ -0,0 +1,204 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const shardTestUsername = "system:serviceaccount:kube-system:csi-azuredisk-controller-sa"
+
+// newShardTestClient returns a kube client whose TokenReviews authenticate "controller-token" as the controller service account,
+// and "other-token" as another service account
+func newShardTestClient() *fake.Clientset {
+	kubeClient := fake.NewSimpleClientset()
+	kubeClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		if len(review.Spec.Audiences) != 1 || review.Spec.Audiences[0] != controllerShardAudience {
+			return true, review, nil
+		}
+		switch review.Spec.Token {
+		case "controller-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: shardTestUsername}}
+		case "other-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "system:serviceaccount:default:default"}}
+		default:
+			review.Status = authenticationv1.TokenReviewStatus{Error: "invalid token"}
+		}
+		return true, review, nil
+	})
+	return kubeClient
+}
+
+func newShardTestShards(t *testing.T, kubeClient *fake.Clientset, id, token string) *controllerShards {
+	shards := startTestShards(t, newControllerShards(kubeClient, id, "kube-system", "disk-csi-azure-com", ""))
+	shards.tokenFile = filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(shards.tokenFile, []byte(token+"\n"), 0600))
+	return shards
+}
+
+// recordingControllerServer records the forwarded publish requests
+type recordingControllerServer struct {
+	csi.UnimplementedControllerServer
+	forwardedBy []string
+}
+
+func (s *recordingControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.forwardedBy = append(s.forwardedBy, md.Get(shardForwardedMetadataKey)...)
+	return &csi.ControllerPublishVolumeResponse{PublishContext: map[string]string{"LUN": "1", "node": req.GetNodeId()}}, nil
+}
+
+// serveShardTestEndpoint serves the controller server over TLS behind the auth interceptor of the shards, and returns its address
+func serveShardTestEndpoint(t *testing.T, shards *controllerShards, controller csi.ControllerServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{*shards.certificate}, MinVersion: tls.VersionTLS12})),
+		grpc.UnaryInterceptor(shards.authInterceptor))
+	csi.RegisterControllerServer(server, controller)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// nodeOwnedBy returns a node owned by the member
+func nodeOwnedBy(shards *controllerShards, member string) string {
+	for i := 0; ; i++ {
+		if node := fmt.Sprintf("node-%d", i); shards.owner(node) == member {
+			return node
+		}
+	}
+}
+
+func TestForwardToNodeShard(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := newShardTestClient()
+	shards0 := newShardTestShards(t, kubeClient, "controller-0", "controller-token")
+	shards1 := newShardTestShards(t, kubeClient, "controller-1", "controller-token")
+	controller1 := &recordingControllerServer{}
+	endpoint := serveShardTestEndpoint(t, shards1, controller1)
+	shards0.setMembers(map[string]string{"controller-0": "", "controller-1": endpoint},
+		map[string]string{"controller-0": shards0.certificatePEM, "controller-1": shards1.certificatePEM})
+	node := nodeOwnedBy(shards0, "controller-1")
+
+	// the publish of a node owned by another replica is forwarded to it
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+	d.shards = shards0
+	resp, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: testVolumeID,
+		NodeId:   node,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"LUN": "1", "node": node}, resp.PublishContext)
+	assert.Equal(t, []string{"controller-0"}, controller1.forwardedBy)
+	assert.Empty(t, shards0.nodeLeases)
+
+	// a forwarded request is handled locally under the lease of the node
+	forwardedCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(shardForwardedMetadataKey, "controller-1"))
+	_, forwarded, release, err := shardControllerCall(forwardedCtx, shards0, node, &csi.ControllerPublishVolumeRequest{NodeId: node}, csi.ControllerClient.ControllerPublishVolume)
+	assert.NoError(t, err)
+	assert.False(t, forwarded)
+	assert.Equal(t, 1, shards0.nodeLeases[node].refs)
+	release()
+	assert.Len(t, controller1.forwardedBy, 1)
+}
+
+func TestShardEndpointAuthentication(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := newShardTestClient()
+	shards1 := newShardTestShards(t, kubeClient, "controller-1", "controller-token")
+	endpoint := serveShardTestEndpoint(t, shards1, &recordingControllerServer{})
+	req := &csi.ControllerPublishVolumeRequest{NodeId: "node"}
+
+	tests := []struct {
+		token    string
+		expected codes.Code
+	}{
+		{token: "controller-token", expected: codes.OK},
+		{token: "other-token", expected: codes.PermissionDenied},
+		{token: "invalid-token", expected: codes.Unauthenticated},
+		{token: "", expected: codes.Unauthenticated},
+	}
+	for _, test := range tests {
+		t.Run(test.token, func(t *testing.T) {
+			shards0 := newShardTestShards(t, kubeClient, "controller-0", test.token)
+			shards0.setMembers(map[string]string{"controller-1": endpoint}, map[string]string{"controller-1": shards1.certificatePEM})
+			_, err := forwardToShard(ctx, shards0, "controller-1", endpoint, func(ctx context.Context, client csi.ControllerClient) (*csi.ControllerPublishVolumeResponse, error) {
+				return client.ControllerPublishVolume(ctx, req)
+			})
+			assert.Equal(t, test.expected, status.Code(err), err)
+		})
+	}
+	assert.Len(t, shards1.authenticated, 1)
+	assert.Equal(t, shardTestUsername, shards1.username)
+}
+
+func TestShardEndpointTLS(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := newShardTestClient()
+	shards1 := newShardTestShards(t, kubeClient, "controller-1", "controller-token")
+	endpoint := serveShardTestEndpoint(t, shards1, &recordingControllerServer{})
+	other := newShardTestShards(t, kubeClient, "controller-2", "controller-token")
+	shards0 := newShardTestShards(t, kubeClient, "controller-0", "controller-token")
+	publish := func(ctx context.Context, client csi.ControllerClient) (*csi.ControllerPublishVolumeResponse, error) {
+		return client.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{NodeId: "node"})
+	}
+
+	// the request is not sent without the certificate of the member
+	shards0.setMembers(map[string]string{"controller-1": endpoint}, nil)
+	_, err := forwardToShard(ctx, shards0, "controller-1", endpoint, publish)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the endpoint presenting a certificate other than the one in the lease of the member is rejected
+	shards0.setMembers(map[string]string{"controller-1": endpoint}, map[string]string{"controller-1": other.certificatePEM})
+	_, err = forwardToShard(ctx, shards0, "controller-1", endpoint, publish)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the connection is recreated with the new certificate of the member
+	shards0.setMembers(map[string]string{"controller-1": endpoint}, map[string]string{"controller-1": shards1.certificatePEM})
+	_, err = forwardToShard(ctx, shards0, "controller-1", endpoint, publish)
+	assert.NoError(t, err)
+	assert.Len(t, shards0.conns, 1)
+}
@@ -0,0 +1,546 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coordinationlisters "k8s.io/client-go/listers/coordination/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	// the lease of a controller replica expires if it's not renewed in shardLeaseDuration
+	shardLeaseDuration      = 30 * time.Second
+	shardLeaseRenewInterval = 10 * time.Second
+	// number of points of each controller replica on the hash ring
+	shardVirtualNodes = 100
+	// shardGroupLabel labels the leases of the controller replicas sharing the attach/detach of the nodes
+	shardGroupLabel = "disk.csi.azure.com/controller-shard-group"
+	// shardNodeGroupLabel labels the leases of the nodes held by the controller replicas of the group
+	shardNodeGroupLabel = "disk.csi.azure.com/controller-shard-node-group"
+	// shardNodeAnnotation holds the node name of a node lease
+	shardNodeAnnotation = "disk.csi.azure.com/controller-shard-node"
+	// shardEndpointAnnotation holds the shard endpoint of a controller replica in its lease
+	shardEndpointAnnotation = "disk.csi.azure.com/controller-shard-endpoint"
+	// shardCertificateAnnotation holds the PEM encoded TLS certificate of the shard endpoint of a controller replica in its lease
+	shardCertificateAnnotation = "disk.csi.azure.com/controller-shard-certificate"
+)
+
+// shardRing is a consistent hash ring of the controller replicas
+type shardRing struct {
+	members []string
+	hashes  []uint32
+	owners  map[uint32]string
+}
+
+func hashShardKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newShardRing(members []string) *shardRing {
+	ring := &shardRing{owners: map[uint32]string{}}
+	ring.members = append(ring.members, members...)
+	sort.Strings(ring.members)
+	for _, member := range ring.members {
+		for i := 0; i < shardVirtualNodes; i++ {
+			hash := hashShardKey(member + "#" + strconv.Itoa(i))
+			if _, ok := ring.owners[hash]; ok {
+				continue
+			}
+			ring.owners[hash] = member
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// owner returns the controller replica owning the node, empty string is returned if there is no member
+func (r *shardRing) owner(nodeName string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	hash := hashShardKey(nodeName)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// controllerShards splits the attach/detach of the nodes among the controller replicas,
+// the membership is maintained with a lease per replica, and the replica attaching or detaching disks of a node holds the lease of the node
+type controllerShards struct {
+	id         string
+	namespace  string
+	group      string
+	kubeClient kubernetes.Interface
+	// address of the shard endpoint of the replica advertised in its lease, the requests are not forwarded to the replica if empty
+	endpoint string
+	// the token sent to the shard endpoints of the other replicas
+	tokenFile string
+	// the self-signed TLS certificate of the shard endpoint generated on start, which is advertised in the lease of the replica
+	certificate    *tls.Certificate
+	certificatePEM string
+
+	mu   sync.RWMutex
+	ring *shardRing
+	// shard endpoints and PEM encoded certificates of the members
+	endpoints    map[string]string
+	certificates map[string]string
+
+	// the node leases of the group are served from nodeLeaseInformers, so that routing a request needs no API call
+	nodeLeaseInformers informers.SharedInformerFactory
+	nodeLeaseLister    coordinationlisters.LeaseNamespaceLister
+	nodeLeasesMutex    sync.Mutex
+	nodeLeases         map[string]*heldNodeLease
+
+	connsMutex sync.Mutex
+	conns      map[string]*shardConn
+
+	authMutex sync.Mutex
+	// the username of the service account of the controller replicas, which is the only one allowed to call the shard endpoint
+	username string
+	// tokens authenticated by TokenReview recently <token, expiry>
+	authenticated map[string]time.Time
+}
+
+// heldNodeLease is the lease of a node taken by the replica. The lease is renewed while refs is not zero,
+// and it's deleted once it expires after the last attach/detach of the node is done.
+type heldNodeLease struct {
+	refs int
+	// lease is the lease last written by the replica, nil if it needs to be read from the informer
+	lease *coordinationv1.Lease
+	// taking is closed once the lease being written is taken or renewed, nil if the lease is not being written
+	taking chan struct{}
+}
+
+// validFor returns how long the held lease is still valid
+func (h *heldNodeLease) validFor(id string, now time.Time) time.Duration {
+	if h.lease == nil {
+		return 0
+	}
+	if holder, ok := liveLeaseHolder(h.lease, now); !ok || holder != id {
+		return 0
+	}
+	return h.lease.Spec.RenewTime.Add(time.Duration(*h.lease.Spec.LeaseDurationSeconds) * time.Second).Sub(now)
+}
+
+func newControllerShards(kubeClient kubernetes.Interface, id, namespace, group, endpoint string) *controllerShards {
+	nodeLeaseInformers := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.SelectorFromSet(labels.Set{shardNodeGroupLabel: group}).String()
+		}))
+	return &controllerShards{
+		id:                 id,
+		namespace:          namespace,
+		group:              group,
+		kubeClient:         kubeClient,
+		endpoint:           endpoint,
+		tokenFile:          controllerShardTokenFile,
+		ring:               newShardRing(nil),
+		endpoints:          map[string]string{},
+		certificates:       map[string]string{},
+		nodeLeaseInformers: nodeLeaseInformers,
+		nodeLeaseLister:    nodeLeaseInformers.Coordination().V1().Leases().Lister().Leases(namespace),
+		nodeLeases:         map[string]*heldNodeLease{},
+		conns:              map[string]*shardConn{},
+		authenticated:      map[string]time.Time{},
+	}
+}
+
+// start generates the certificate of the shard endpoint, starts the informer of the node leases and waits for it to sync
+func (s *controllerShards) start(ctx context.Context) error {
+	certificate, certificatePEM, err := newShardCertificate(s.id)
+	if err != nil {
+		return fmt.Errorf("failed to generate controller shard certificate: %w", err)
+	}
+	s.certificate, s.certificatePEM = certificate, certificatePEM
+	s.nodeLeaseInformers.Start(ctx.Done())
+	for informer, synced := range s.nodeLeaseInformers.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("failed to sync the informer(%v) of controller shard node leases", informer)
+		}
+	}
+	return nil
+}
+
+// leaseName returns the lease name of the controller replica
+func (s *controllerShards) leaseName() string {
+	return fmt.Sprintf("%s-%s", s.group, s.id)
+}
+
+// nodeLeaseName returns the lease name of the node, the node name is hashed to fit in the lease name
+func (s *controllerShards) nodeLeaseName(nodeName string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nodeName))
+	return fmt.Sprintf("%s-node-%016x", s.group, h.Sum64())
+}
+
+// renew renews the lease of the replica and refreshes the members from the leases which are not expired,
+// the leases of the nodes held by the replica are renewed and the expired node leases are deleted as well
+func (s *controllerShards) renew(ctx context.Context) {
+	now := time.Now()
+	s.renewNodeLeases(ctx, now)
+	if err := s.renewLease(ctx, now); err != nil {
+		// the replica stops owning nodes if its lease could not be renewed, the other replicas take over once it expires
+		klog.Errorf("failed to renew controller shard lease(%s/%s): %v", s.namespace, s.leaseName(), err)
+		s.setMembers(nil, nil)
+		return
+	}
+	leases, err := s.kubeClient.CoordinationV1().Leases(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{shardGroupLabel: s.group}).String(),
+	})
+	if err != nil {
+		klog.Errorf("failed to list controller shard leases in namespace(%s): %v", s.namespace, err)
+		s.setMembers(nil, nil)
+		return
+	}
+	endpoints, certificates := map[string]string{}, map[string]string{}
+	for i := range leases.Items {
+		if member, ok := liveLeaseHolder(&leases.Items[i], now); ok {
+			endpoints[member] = leases.Items[i].Annotations[shardEndpointAnnotation]
+			certificates[member] = leases.Items[i].Annotations[shardCertificateAnnotation]
+		}
+	}
+	s.setMembers(endpoints, certificates)
+}
+
+func (s *controllerShards) renewLease(ctx context.Context, now time.Time) error {
+	leases := s.kubeClient.CoordinationV1().Leases(s.namespace)
+	renewTime := metav1.NewMicroTime(now)
+	lease, err := leases.Get(ctx, s.leaseName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        s.leaseName(),
+				Namespace:   s.namespace,
+				Labels:      map[string]string{shardGroupLabel: s.group},
+				Annotations: map[string]string{shardEndpointAnnotation: s.endpoint, shardCertificateAnnotation: s.certificatePEM},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(s.id),
+				LeaseDurationSeconds: pointer.Int32(int32(shardLeaseDuration.Seconds())),
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[shardEndpointAnnotation] = s.endpoint
+	lease.Annotations[shardCertificateAnnotation] = s.certificatePEM
+	lease.Spec.HolderIdentity = pointer.String(s.id)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(shardLeaseDuration.Seconds()))
+	lease.Spec.RenewTime = &renewTime
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// liveLeaseHolder returns the holder of the lease if the lease is not expired
+func liveLeaseHolder(lease *coordinationv1.Lease, now time.Time) (string, bool) {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return "", false
+	}
+	expireTime := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return *spec.HolderIdentity, now.Before(expireTime)
+}
+
+// setMembers replaces the members with the replicas of the shard endpoints
+func (s *controllerShards) setMembers(endpoints, certificates map[string]string) {
+	members := make([]string, 0, len(endpoints))
+	for member := range endpoints {
+		members = append(members, member)
+	}
+	ring := newShardRing(members)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if fmt.Sprint(ring.members) != fmt.Sprint(s.ring.members) {
+		klog.V(2).Infof("controller shard members of group(%s) changed from %v to %v", s.group, s.ring.members, ring.members)
+	}
+	s.ring = ring
+	s.endpoints = endpoints
+	s.certificates = certificates
+}
+
+// owner returns the controller replica owning the node
+func (s *controllerShards) owner(nodeName string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring.owner(nodeName)
+}
+
+// route returns the replica which attaches and detaches the disks of the node and its shard endpoint.
+// The replica holding the lease of the node keeps handling the node until the lease expires,
+// so that the node is handled by one replica while the members change, the owner of the node on the ring handles it otherwise.
+func (s *controllerShards) route(nodeName string) (string, string) {
+	member := ""
+	s.nodeLeasesMutex.Lock()
+	if held, ok := s.nodeLeases[nodeName]; ok && held.validFor(s.id, time.Now()) > 0 {
+		member = s.id
+	}
+	s.nodeLeasesMutex.Unlock()
+	if member == "" {
+		lease, err := s.nodeLeaseLister.Get(s.nodeLeaseName(nodeName))
+		switch {
+		case err == nil:
+			if holder, ok := liveLeaseHolder(lease, time.Now()); ok {
+				member = holder
+			}
+		case !apierrors.IsNotFound(err):
+			klog.Warningf("failed to get the lease(%s/%s) of node(%s): %v", s.namespace, s.nodeLeaseName(nodeName), nodeName, err)
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if member == "" {
+		member = s.ring.owner(nodeName)
+	}
+	return member, s.endpoints[member]
+}
+
+// acquireNode acquires the lease of the node before the replica attaches or detaches disks of the node,
+// so that two replicas never update the VM of the node concurrently. The concurrent attach/detach of the node share the lease,
+// which is only written if the replica does not hold it yet, and is renewed by renew until release is called.
+func (s *controllerShards) acquireNode(ctx context.Context, nodeName string) (func(), error) {
+	s.nodeLeasesMutex.Lock()
+	held, ok := s.nodeLeases[nodeName]
+	if !ok {
+		held = &heldNodeLease{}
+		s.nodeLeases[nodeName] = held
+	}
+	held.refs++
+	release := func() { s.releaseNode(nodeName, held) }
+	for held.taking != nil {
+		taking := held.taking
+		s.nodeLeasesMutex.Unlock()
+		select {
+		case <-taking:
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+		s.nodeLeasesMutex.Lock()
+	}
+	// the lease is renewed by renew before it expires
+	if held.validFor(s.id, time.Now()) > shardLeaseRenewInterval {
+		s.nodeLeasesMutex.Unlock()
+		return release, nil
+	}
+	err := s.writeHeldNodeLease(ctx, nodeName, held)
+	s.nodeLeasesMutex.Unlock()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+func (s *controllerShards) releaseNode(nodeName string, held *heldNodeLease) {
+	s.nodeLeasesMutex.Lock()
+	defer s.nodeLeasesMutex.Unlock()
+	held.refs--
+	if held.refs == 0 && held.lease == nil && held.taking == nil {
+		delete(s.nodeLeases, nodeName)
+	}
+	// the lease is kept until it expires, so that the replica keeps handling the node, renew deletes it then
+}
+
+// writeHeldNodeLease takes or renews the held lease of the node, nodeLeasesMutex must be held,
+// it's released while the lease is written and the other acquisitions of the node wait for the write
+func (s *controllerShards) writeHeldNodeLease(ctx context.Context, nodeName string, held *heldNodeLease) error {
+	taking := make(chan struct{})
+	held.taking = taking
+	base := held.lease
+	s.nodeLeasesMutex.Unlock()
+	lease, err := s.takeNodeLease(ctx, nodeName, base)
+	s.nodeLeasesMutex.Lock()
+	held.lease = lease
+	held.taking = nil
+	close(taking)
+	return err
+}
+
+// takeNodeLease takes the lease of the node unless it's held by another replica, the updates of the lease are fenced by its resource version.
+// base is the lease last written by the replica, the lease in the informer is used if it's nil.
+func (s *controllerShards) takeNodeLease(ctx context.Context, nodeName string, base *coordinationv1.Lease) (*coordinationv1.Lease, error) {
+	leases := s.kubeClient.CoordinationV1().Leases(s.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	lease := base.DeepCopy()
+	if lease == nil {
+		cached, err := s.nodeLeaseLister.Get(s.nodeLeaseName(nodeName))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, nodeLeaseError(nodeName, err)
+		}
+		lease = cached.DeepCopy()
+	}
+	if lease == nil {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        s.nodeLeaseName(nodeName),
+				Namespace:   s.namespace,
+				Labels:      map[string]string{shardNodeGroupLabel: s.group},
+				Annotations: map[string]string{shardNodeAnnotation: nodeName},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(s.id),
+				LeaseDurationSeconds: pointer.Int32(int32(shardLeaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		created, err := leases.Create(ctx, lease, metav1.CreateOptions{})
+		if err != nil {
+			return nil, nodeLeaseError(nodeName, err)
+		}
+		return created, nil
+	}
+	if holder, ok := liveLeaseHolder(lease, now.Time); ok && holder != s.id {
+		return nil, status.Errorf(codes.Unavailable, "node(%s) is handled by controller replica(%s) until its lease expires", nodeName, holder)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != s.id {
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = pointer.Int32(pointer.Int32Deref(lease.Spec.LeaseTransitions, 0) + 1)
+	}
+	lease.Spec.HolderIdentity = pointer.String(s.id)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(shardLeaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+	updated, err := leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, nodeLeaseError(nodeName, err)
+	}
+	return updated, nil
+}
+
+// renewNodeLeases renews the leases of the nodes being attached or detached by the replica, and deletes the expired node leases,
+// i.e. the leases of the nodes idle for shardLeaseDuration, and the leases left by the replicas which are gone
+func (s *controllerShards) renewNodeLeases(ctx context.Context, now time.Time) {
+	var expired []*coordinationv1.Lease
+	s.nodeLeasesMutex.Lock()
+	var renewing []string
+	for nodeName, held := range s.nodeLeases {
+		if held.refs > 0 {
+			renewing = append(renewing, nodeName)
+		}
+	}
+	for _, nodeName := range renewing {
+		// the lease being taken by acquireNode is not renewed again
+		if held, ok := s.nodeLeases[nodeName]; ok && held.refs > 0 && held.taking == nil {
+			if err := s.writeHeldNodeLease(ctx, nodeName, held); err != nil {
+				klog.Errorf("failed to renew the lease(%s/%s) of node(%s): %v", s.namespace, s.nodeLeaseName(nodeName), nodeName, err)
+			}
+		}
+	}
+	for nodeName, held := range s.nodeLeases {
+		if held.refs == 0 && held.taking == nil && held.validFor(s.id, now) == 0 {
+			delete(s.nodeLeases, nodeName)
+			if held.lease != nil {
+				expired = append(expired, held.lease)
+			}
+		}
+	}
+	held := map[string]bool{}
+	for nodeName := range s.nodeLeases {
+		held[s.nodeLeaseName(nodeName)] = true
+	}
+	s.nodeLeasesMutex.Unlock()
+
+	cached, err := s.nodeLeaseLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("failed to list controller shard node leases in namespace(%s): %v", s.namespace, err)
+	}
+	for _, lease := range cached {
+		if _, live := liveLeaseHolder(lease, now); live || held[lease.Name] {
+			continue
+		}
+		// the leases left by the other replicas are deleted by the owner of the node to avoid conflicts
+		if nodeName := lease.Annotations[shardNodeAnnotation]; nodeName != "" && s.owner(nodeName) == s.id {
+			expired = append(expired, lease)
+		}
+	}
+
+	deleted := map[string]bool{}
+	for _, lease := range expired {
+		if deleted[lease.Name] {
+			continue
+		}
+		deleted[lease.Name] = true
+		// the lease is only deleted if it's not taken by another replica since it expired
+		err := s.kubeClient.CoordinationV1().Leases(s.namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion},
+		})
+		if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			klog.Warningf("failed to delete the expired lease(%s/%s): %v", s.namespace, lease.Name, err)
+			continue
+		}
+		klog.V(4).Infof("deleted the expired lease(%s/%s) of node(%s)", s.namespace, lease.Name, lease.Annotations[shardNodeAnnotation])
+	}
+}
+
+// nodeLeaseError returns a retryable error if the lease of the node could not be taken, e.g. another replica took it concurrently
+func nodeLeaseError(nodeName string, err error) error {
+	if _, ok := status.FromError(err); ok && status.Code(err) != codes.Unknown {
+		return err
+	}
+	return status.Errorf(codes.Unavailable, "failed to take the lease of node(%s): %v", nodeName, err)
+}
+
+// shardControllerCall routes the attach/detach of the node. It's forwarded to the shard endpoint of the replica handling the node,
+// or the lease of the node is acquired to handle it locally, in which case release must be called once it's handled.
+func shardControllerCall[Req, Resp any](ctx context.Context, s *controllerShards, nodeName string, req Req,
+	call func(csi.ControllerClient, context.Context, Req, ...grpc.CallOption) (Resp, error)) (resp Resp, forwarded bool, release func(), err error) {
+	if !isShardForwarded(ctx) {
+		if member, endpoint := s.route(nodeName); member != "" && member != s.id && endpoint != "" {
+			klog.V(4).Infof("forward the request of node(%s) to controller replica(%s) at %s", nodeName, member, endpoint)
+			resp, err = forwardToShard(ctx, s, member, endpoint, func(ctx context.Context, client csi.ControllerClient) (Resp, error) {
+				return call(client, ctx, req)
+			})
+			return resp, true, nil, err
+		}
+	}
+	release, err = s.acquireNode(ctx, nodeName)
+	return resp, false, release, err
+}
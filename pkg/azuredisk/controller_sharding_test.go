@@ -0,0 +1,343 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/pointer"
+)
+
+func TestShardRing(t *testing.T) {
+	assert.Equal(t, "", newShardRing(nil).owner("node"))
+
+	members := []string{"controller-0", "controller-1", "controller-2"}
+	ring := newShardRing(members)
+	owned := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		owned[ring.owner(fmt.Sprintf("aks-nodepool-%d", i))]++
+	}
+	for _, member := range members {
+		assert.Greater(t, owned[member], 500, "member %s owns too few nodes: %v", member, owned)
+	}
+
+	// only the nodes of the removed member move to the other members
+	shrunk := newShardRing([]string{"controller-2", "controller-0"})
+	for i := 0; i < 3000; i++ {
+		node := fmt.Sprintf("aks-nodepool-%d", i)
+		if owner := ring.owner(node); owner != "controller-1" {
+			assert.Equal(t, owner, shrunk.owner(node))
+		}
+	}
+}
+
+// enforceLeaseResourceVersions makes the fake client version the leases, and reject the updates and deletes of stale leases like the API server
+func enforceLeaseResourceVersions(kubeClient *fake.Clientset) {
+	var version int
+	gvr := coordinationv1.SchemeGroupVersion.WithResource("leases")
+	current := func(namespace, name string) (*coordinationv1.Lease, error) {
+		obj, err := kubeClient.Tracker().Get(gvr, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		return obj.(*coordinationv1.Lease), nil
+	}
+	kubeClient.PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// CreateAction and UpdateAction have the same methods, so switch on the verb
+		switch action.GetVerb() {
+		case "create":
+			version++
+			action.(k8stesting.CreateAction).GetObject().(*coordinationv1.Lease).ResourceVersion = strconv.Itoa(version)
+		case "update":
+			lease := action.(k8stesting.UpdateAction).GetObject().(*coordinationv1.Lease)
+			if stored, err := current(action.GetNamespace(), lease.Name); err == nil && stored.ResourceVersion != lease.ResourceVersion {
+				return true, nil, apierrors.NewConflict(gvr.GroupResource(), lease.Name, fmt.Errorf("stale resource version"))
+			}
+			version++
+			lease.ResourceVersion = strconv.Itoa(version)
+		case "delete":
+			action := action.(k8stesting.DeleteAction)
+			preconditions := action.GetDeleteOptions().Preconditions
+			if stored, err := current(action.GetNamespace(), action.GetName()); err == nil && preconditions != nil &&
+				preconditions.ResourceVersion != nil && *preconditions.ResourceVersion != stored.ResourceVersion {
+				return true, nil, apierrors.NewConflict(gvr.GroupResource(), action.GetName(), fmt.Errorf("stale resource version"))
+			}
+		}
+		return false, nil, nil
+	})
+}
+
+// startTestShards starts the informer of the node leases of the shards until the test is done
+func startTestShards(t *testing.T, shards *controllerShards) *controllerShards {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	assert.NoError(t, shards.start(ctx))
+	return shards
+}
+
+// waitForNodeLease waits until the informer of the shards sees the lease of the node held by holder, or deleted if holder is empty
+func waitForNodeLease(t *testing.T, shards *controllerShards, nodeName, holder string) {
+	assert.Eventually(t, func() bool {
+		lease, err := shards.nodeLeaseLister.Get(shards.nodeLeaseName(nodeName))
+		if holder == "" {
+			return apierrors.IsNotFound(err)
+		}
+		return err == nil && pointer.StringDeref(lease.Spec.HolderIdentity, "") == holder
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestControllerShardsRenew(t *testing.T) {
+	now := metav1.NewMicroTime(time.Now())
+	expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	lease := func(id string, renewTime *metav1.MicroTime) *coordinationv1.Lease {
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "disk-csi-azure-com-" + id,
+				Namespace:   "kube-system",
+				Labels:      map[string]string{shardGroupLabel: "disk-csi-azure-com"},
+				Annotations: map[string]string{shardEndpointAnnotation: id + ":29612"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(id),
+				LeaseDurationSeconds: pointer.Int32(30),
+				RenewTime:            renewTime,
+			},
+		}
+	}
+	kubeClient := fake.NewSimpleClientset(lease("controller-1", &now), lease("controller-2", &expired), lease("controller-0", &expired))
+	shards := startTestShards(t, newControllerShards(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com", "10.0.0.4:29612"))
+	// the node leases are not members
+	release, err := shards.acquireNode(context.Background(), "node")
+	assert.NoError(t, err)
+	defer release()
+	shards.renew(context.Background())
+
+	assert.Equal(t, []string{"controller-0", "controller-1"}, shards.ring.members)
+	assert.Equal(t, map[string]string{"controller-0": "10.0.0.4:29612", "controller-1": "controller-1:29612"}, shards.endpoints)
+	assert.Equal(t, shards.certificatePEM, shards.certificates["controller-0"])
+	renewed, err := kubeClient.CoordinationV1().Leases("kube-system").Get(context.Background(), "disk-csi-azure-com-controller-0", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, renewed.Spec.RenewTime.After(expired.Time))
+
+	// the lease is created if it does not exist
+	shards = startTestShards(t, newControllerShards(kubeClient, "controller-3", "kube-system", "disk-csi-azure-com", ""))
+	shards.renew(context.Background())
+	assert.Equal(t, []string{"controller-0", "controller-1", "controller-3"}, shards.ring.members)
+}
+
+func TestAcquireNode(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	enforceLeaseResourceVersions(kubeClient)
+	shards0 := startTestShards(t, newControllerShards(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com", ""))
+	shards1 := startTestShards(t, newControllerShards(kubeClient, "controller-1", "kube-system", "disk-csi-azure-com", ""))
+	leases := kubeClient.CoordinationV1().Leases("kube-system")
+
+	// the concurrent attach/detach of the node share the lease, which is only written once
+	release, err := shards0.acquireNode(ctx, "node")
+	assert.NoError(t, err)
+	writes := len(kubeClient.Actions())
+	release2, err := shards0.acquireNode(ctx, "node")
+	assert.NoError(t, err)
+	assert.Len(t, kubeClient.Actions(), writes)
+	assert.Equal(t, 2, shards0.nodeLeases["node"].refs)
+	lease, err := leases.Get(ctx, shards0.nodeLeaseName("node"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "controller-0", *lease.Spec.HolderIdentity)
+	assert.Equal(t, "node", lease.Annotations[shardNodeAnnotation])
+	assert.Equal(t, "disk-csi-azure-com", lease.Labels[shardNodeGroupLabel])
+
+	// another replica can't take the lease until it expires
+	waitForNodeLease(t, shards1, "node", "controller-0")
+	_, err = shards1.acquireNode(ctx, "node")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), "controller-0")
+	assert.Empty(t, shards1.nodeLeases)
+	member, _ := shards1.route("node")
+	assert.Equal(t, "controller-0", member)
+
+	// the lease is renewed by renew while the node is held
+	renewTime := shards0.nodeLeases["node"].lease.Spec.RenewTime
+	time.Sleep(time.Millisecond)
+	shards0.renewNodeLeases(ctx, time.Now())
+	assert.True(t, shards0.nodeLeases["node"].lease.Spec.RenewTime.After(renewTime.Time))
+
+	release()
+	release2()
+	// the lease is kept after the release, so that the replica keeps handling the node
+	assert.Equal(t, 0, shards0.nodeLeases["node"].refs)
+	_, err = shards1.acquireNode(ctx, "node")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	shards0.renewNodeLeases(ctx, time.Now())
+	_, err = leases.Get(ctx, shards0.nodeLeaseName("node"), metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	// the lease is deleted once it expires after the release
+	shards0.renewNodeLeases(ctx, time.Now().Add(shardLeaseDuration+time.Second))
+	assert.Empty(t, shards0.nodeLeases)
+	_, err = leases.Get(ctx, shards0.nodeLeaseName("node"), metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	waitForNodeLease(t, shards1, "node", "")
+	release, err = shards1.acquireNode(ctx, "node")
+	assert.NoError(t, err)
+	defer release()
+	lease, err = leases.Get(ctx, shards0.nodeLeaseName("node"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "controller-1", *lease.Spec.HolderIdentity)
+}
+
+func TestAcquireNodeTakeOver(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	enforceLeaseResourceVersions(kubeClient)
+	shards0 := startTestShards(t, newControllerShards(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com", ""))
+	shards1 := startTestShards(t, newControllerShards(kubeClient, "controller-1", "kube-system", "disk-csi-azure-com", ""))
+	leases := kubeClient.CoordinationV1().Leases("kube-system")
+
+	release, err := shards0.acquireNode(ctx, "node")
+	assert.NoError(t, err)
+	release()
+	expired := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	lease, err := leases.Get(ctx, shards0.nodeLeaseName("node"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	lease.Spec.RenewTime = &expired
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	// the expired lease is taken over by another replica
+	assert.Eventually(t, func() bool {
+		cached, err := shards1.nodeLeaseLister.Get(shards1.nodeLeaseName("node"))
+		return err == nil && cached.Spec.RenewTime.Equal(&expired)
+	}, 5*time.Second, 10*time.Millisecond)
+	release, err = shards1.acquireNode(ctx, "node")
+	assert.NoError(t, err)
+	defer release()
+	lease, err = leases.Get(ctx, shards0.nodeLeaseName("node"), metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "controller-1", *lease.Spec.HolderIdentity)
+	assert.Equal(t, int32(1), *lease.Spec.LeaseTransitions)
+
+	// the lease written by the replica before the take over is not deleted
+	shards0.renewNodeLeases(ctx, time.Now().Add(shardLeaseDuration+time.Second))
+	assert.Empty(t, shards0.nodeLeases)
+	_, err = leases.Get(ctx, shards0.nodeLeaseName("node"), metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestDeleteOrphanedNodeLeases(t *testing.T) {
+	ctx := context.Background()
+	expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	now := metav1.NewMicroTime(time.Now())
+	nodeLease := func(shards *controllerShards, nodeName, holder string, renewTime *metav1.MicroTime) *coordinationv1.Lease {
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        shards.nodeLeaseName(nodeName),
+				Namespace:   "kube-system",
+				Labels:      map[string]string{shardNodeGroupLabel: "disk-csi-azure-com"},
+				Annotations: map[string]string{shardNodeAnnotation: nodeName},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(holder),
+				LeaseDurationSeconds: pointer.Int32(30),
+				RenewTime:            renewTime,
+			},
+		}
+	}
+	shards := newControllerShards(nil, "controller-0", "kube-system", "disk-csi-azure-com", "")
+	kubeClient := fake.NewSimpleClientset(
+		nodeLease(shards, "gone-node", "controller-9", &expired),
+		nodeLease(shards, "busy-node", "controller-9", &now),
+	)
+	shards = startTestShards(t, newControllerShards(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com", ""))
+	shards.setMembers(map[string]string{"controller-0": ""}, nil)
+	assert.Eventually(t, func() bool {
+		cached, err := shards.nodeLeaseLister.List(labels.Everything())
+		return err == nil && len(cached) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the expired lease left by a replica which is gone is deleted, the live one is kept
+	shards.renewNodeLeases(ctx, time.Now())
+	leases, err := kubeClient.CoordinationV1().Leases("kube-system").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, leases.Items, 1)
+	assert.Equal(t, "busy-node", leases.Items[0].Annotations[shardNodeAnnotation])
+}
+
+func TestAcquireNodeConflict(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeClient.PrependReactor("create", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewAlreadyExists(coordinationv1.Resource("leases"), "lease")
+	})
+	shards := startTestShards(t, newControllerShards(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com", ""))
+	_, err := shards.acquireNode(context.Background(), "node")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Empty(t, shards.nodeLeases)
+}
+
+func TestRouteNode(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset()
+	shards := startTestShards(t, newControllerShards(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com", ""))
+	member, endpoint := shards.route("node")
+	assert.Equal(t, "", member)
+	assert.Equal(t, "", endpoint)
+
+	shards.setMembers(map[string]string{"controller-0": "", "controller-1": "10.0.0.5:29612"}, nil)
+	var owned, notOwned string
+	for i := 0; owned == "" || notOwned == ""; i++ {
+		node := fmt.Sprintf("node-%d", i)
+		if shards.owner(node) == "controller-0" {
+			owned = node
+		} else {
+			notOwned = node
+		}
+	}
+	member, _ = shards.route(owned)
+	assert.Equal(t, "controller-0", member)
+	member, endpoint = shards.route(notOwned)
+	assert.Equal(t, "controller-1", member)
+	assert.Equal(t, "10.0.0.5:29612", endpoint)
+
+	// the replica holding the lease of the node keeps handling it
+	release, err := shards.acquireNode(ctx, notOwned)
+	assert.NoError(t, err)
+	release()
+	member, _ = shards.route(notOwned)
+	assert.Equal(t, "controller-0", member)
+
+	// the requests are routed from the informer without API calls
+	kubeClient.ClearActions()
+	for i := 0; i < 10; i++ {
+		shards.route(owned)
+		shards.route(notOwned)
+	}
+	assert.Empty(t, kubeClient.Actions())
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// attachedVolume caches the fields of the PV of a volume attachment, which don't change while the PV is attached
+type attachedVolume struct {
+	// volumeHandle is empty if the PV is removed or is not a volume of the driver
+	volumeHandle   string
+	attributes     map[string]string
+	claimNamespace string
+	claimName      string
+}
+
+// groupVolumeAttachments groups the volume attachments of the driver by PV name,
+// the cached PVs which are no longer attached are removed
+func (d *DriverCore) groupVolumeAttachments(vas []*storagev1.VolumeAttachment) map[string][]*storagev1.VolumeAttachment {
+	attachments := map[string][]*storagev1.VolumeAttachment{}
+	for _, va := range vas {
+		if va.Spec.Attacher != d.Name || va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+		pvName := *va.Spec.Source.PersistentVolumeName
+		attachments[pvName] = append(attachments[pvName], va)
+	}
+	d.attachedVolumes.Range(func(pvName, _ interface{}) bool {
+		if _, ok := attachments[pvName.(string)]; !ok {
+			d.attachedVolumes.Delete(pvName)
+		}
+		return true
+	})
+	return attachments
+}
+
+// getAttachedVolume returns the PV of a volume attachment, the PV is read once while it's attached
+func (d *DriverCore) getAttachedVolume(ctx context.Context, pvName string) (*attachedVolume, error) {
+	if volume, ok := d.attachedVolumes.Load(pvName); ok {
+		return volume.(*attachedVolume), nil
+	}
+	pv, err := d.kubeClient.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return &attachedVolume{}, nil
+		}
+		return nil, err
+	}
+	volume := &attachedVolume{}
+	if csiSource := pv.Spec.CSI; csiSource != nil && csiSource.Driver == d.Name {
+		volume.volumeHandle = csiSource.VolumeHandle
+		volume.attributes = csiSource.VolumeAttributes
+	}
+	if claimRef := pv.Spec.ClaimRef; claimRef != nil {
+		volume.claimNamespace, volume.claimName = claimRef.Namespace, claimRef.Name
+	}
+	d.attachedVolumes.Store(pvName, volume)
+	return volume, nil
+}
@@ -18,6 +18,7 @@ package azuredisk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path"
 	"sort"
@@ -99,6 +100,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 	defer d.volumeLocks.Release(name)
 
+	if diskParams.StripeCount > 1 {
+		return d.createStripedVolume(ctx, req, diskParams)
+	}
+
 	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
 	volSizeBytes := int64(capacityBytes)
 	requestGiB := int(volumehelper.RoundUpGiB(volSizeBytes))
@@ -118,10 +123,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 
 	if diskParams.Location == "" {
-		diskParams.Location = d.cloud.Location
+		diskParams.Location = d.getCloud().Location
 	}
 
-	localCloud := d.cloud
+	localCloud := d.getCloud()
 	localDiskController := d.diskController
 
 	if diskParams.UserAgent != "" {
@@ -135,8 +140,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 				cloud:               localCloud,
 				lockMap:             newLockMap(),
 				DisableDiskLunCheck: true,
-				clientFactory:       localCloud.ComputeClientFactory,
+				clientFactory:       d.dryRun.wrapClientFactory(d.armScheduler.wrapClientFactory(localCloud.ComputeClientFactory), localCloud.SubscriptionID),
 				ForceDetachBackoff:  d.forceDetachBackoff,
+				dryRun:              d.dryRun,
+				armScheduler:        d.armScheduler,
 			},
 		}
 		localDiskController.DisableUpdateCache = d.disableUpdateCache
@@ -155,7 +162,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	diskParams.DiskName = azureutils.CreateValidDiskName(diskParams.DiskName)
 
 	if diskParams.ResourceGroup == "" {
-		diskParams.ResourceGroup = d.cloud.ResourceGroup
+		diskParams.ResourceGroup = d.getCloud().ResourceGroup
 	}
 
 	// normalize values
@@ -187,6 +194,11 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 
 	diskZone := azureutils.PickAvailabilityZone(req.GetAccessibilityRequirements(), diskParams.Location, topologyKey)
+	// the edge zone is taken from the extendedLocation parameter or the topology of the selected node
+	edgeZone := diskParams.ExtendedLocation
+	if edgeZone == "" {
+		edgeZone = azureutils.PickEdgeZone(req.GetAccessibilityRequirements())
+	}
 	accessibleTopology := []*csi.Topology{}
 
 	if d.enableDiskCapacityCheck {
@@ -232,6 +244,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 					diskParams.VolumeContext[consts.ResizeRequired] = strconv.FormatBool(true)
 					klog.V(2).Infof("source disk(%s) size(%d) is less than requested size(%d), set resizeRequired as true", sourceID, *sourceGiB, requestGiB)
 				}
+				if disk != nil && disk.ExtendedLocation != nil && disk.ExtendedLocation.Name != nil && edgeZone == "" {
+					edgeZone = *disk.ExtendedLocation.Name
+					klog.V(2).Infof("source disk(%s) is in edge zone(%s)", sourceID, edgeZone)
+				}
 				if disk != nil && len(disk.Zones) == 1 {
 					if disk.Zones[0] != nil {
 						diskZone = fmt.Sprintf("%s-%s", diskParams.Location, *disk.Zones[0])
@@ -245,7 +261,18 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
-	if strings.HasSuffix(strings.ToLower(string(skuName)), "zrs") {
+	if edgeZone != "" {
+		if strings.HasSuffix(strings.ToLower(string(skuName)), "zrs") {
+			return nil, status.Errorf(codes.InvalidArgument, "ZRS disk(%s) is not supported in edge zone(%s)", skuName, edgeZone)
+		}
+		// there are no availability zones in edge zones
+		diskZone = ""
+		accessibleTopology = []*csi.Topology{
+			{
+				Segments: map[string]string{topologyKey: "", consts.EdgeZoneTopologyKey: edgeZone},
+			},
+		}
+	} else if strings.HasSuffix(strings.ToLower(string(skuName)), "zrs") {
 		klog.V(2).Infof("diskZone(%s) is reset as empty since disk(%s) is ZRS(%s)", diskZone, diskParams.DiskName, skuName)
 		diskZone = ""
 		// make volume scheduled on all 3 availability zones
@@ -268,8 +295,8 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
-	klog.V(2).Infof("begin to create azure disk(%s) account type(%s) rg(%s) location(%s) size(%d) diskZone(%v) maxShares(%d)",
-		diskParams.DiskName, skuName, diskParams.ResourceGroup, diskParams.Location, requestGiB, diskZone, diskParams.MaxShares)
+	klog.V(2).Infof("begin to create azure disk(%s) account type(%s) rg(%s) location(%s) size(%d) diskZone(%v) edgeZone(%v) maxShares(%d)",
+		diskParams.DiskName, skuName, diskParams.ResourceGroup, diskParams.Location, requestGiB, diskZone, edgeZone, diskParams.MaxShares)
 
 	if skuName == armcompute.DiskStorageAccountTypesUltraSSDLRS {
 		if diskParams.DiskIOPSReadWrite == "" && diskParams.DiskMBPSReadWrite == "" {
@@ -302,6 +329,10 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		PerformancePlus:     diskParams.PerformancePlus,
 	}
 
+	if edgeZone != "" {
+		volumeOptions.ExtendedLocation = &ExtendedLocation{Name: edgeZone, Type: string(armcompute.ExtendedLocationTypesEdgeZone)}
+	}
+
 	volumeOptions.SkipGetDiskOperation = d.isGetDiskThrottled()
 	// Azure Stack Cloud does not support NetworkAccessPolicy, PublicNetworkAccess
 	if !azureutils.IsAzureStackCloud(localCloud.Config.Cloud, localCloud.Config.DisableAzureStackCloud) {
@@ -313,7 +344,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 
 	var diskURI string
-	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, metricsRequest, d.cloud.ResourceGroup, d.cloud.SubscriptionID, d.Name)
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, metricsRequest, d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, diskURI)
@@ -351,6 +382,9 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	if err := d.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		return nil, status.Errorf(codes.Internal, "invalid delete volume req: %v", req)
 	}
+	if azureutils.IsStripedVolumeID(volumeID) {
+		return d.deleteStripedVolume(ctx, req)
+	}
 	diskURI := volumeID
 
 	if err := azureutils.IsValidDiskURI(diskURI); err != nil {
@@ -363,7 +397,7 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	}
 	defer d.volumeLocks.Release(volumeID)
 
-	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_delete_volume", d.cloud.ResourceGroup, d.cloud.SubscriptionID, d.Name)
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_delete_volume", d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, diskURI)
@@ -408,6 +442,18 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	if d.shards != nil && req.GetNodeId() != "" {
+		resp, forwarded, release, err := shardControllerCall(ctx, d.shards, req.GetNodeId(), req, csi.ControllerClient.ControllerPublishVolume)
+		if forwarded || err != nil {
+			return resp, err
+		}
+		defer release()
+	}
+
+	if azureutils.IsStripedVolumeID(diskURI) {
+		return d.publishStripedVolume(ctx, req)
+	}
+
 	disk, err := d.checkDiskExists(ctx, diskURI)
 	if err != nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume not found, failed with error: %v", err))
@@ -424,7 +470,7 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
-	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_publish_volume", d.cloud.ResourceGroup, d.cloud.SubscriptionID, d.Name)
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_publish_volume", d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, diskURI, consts.Node, string(nodeName))
@@ -526,12 +572,24 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	}
 	nodeName := types.NodeName(nodeID)
 
+	if d.shards != nil {
+		resp, forwarded, release, err := shardControllerCall(ctx, d.shards, nodeID, req, csi.ControllerClient.ControllerUnpublishVolume)
+		if forwarded || err != nil {
+			return resp, err
+		}
+		defer release()
+	}
+
+	if azureutils.IsStripedVolumeID(diskURI) {
+		return d.unpublishStripedVolume(ctx, req)
+	}
+
 	diskName, err := azureutils.GetDiskName(diskURI)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
-	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_unpublish_volume", d.cloud.ResourceGroup, d.cloud.SubscriptionID, d.Name)
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_unpublish_volume", d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, diskURI, consts.Node, string(nodeName))
@@ -539,6 +597,7 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 
 	klog.V(2).Infof("Trying to detach volume %s from node %s", diskURI, nodeID)
 
+	d.fenceUnpublishedNode(ctx, diskURI, nodeID)
 	if err := d.diskController.DetachDisk(ctx, diskName, diskURI, nodeName); err != nil {
 		if strings.Contains(err.Error(), consts.ErrDiskNotFound) {
 			klog.Warningf("volume %s already detached from node %s", diskURI, nodeID)
@@ -579,9 +638,15 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
 	}
 
-	if _, err := d.checkDiskExists(ctx, diskURI); err != nil {
+	members, err := getVolumeMembers(diskURI)
+	if err != nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume not found, failed with error: %v", err))
 	}
+	for _, member := range members {
+		if _, err := d.checkDiskExists(ctx, member); err != nil {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume not found, failed with error: %v", err))
+		}
+	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
@@ -650,17 +715,17 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 			return nil, status.Errorf(codes.Aborted, "ListVolumes starting token(%d) can not be negative", start)
 		}
 	}
-	if d.cloud.KubeClient != nil && d.cloud.KubeClient.CoreV1() != nil && d.cloud.KubeClient.CoreV1().PersistentVolumes() != nil {
+	if d.getCloud().KubeClient != nil && d.getCloud().KubeClient.CoreV1() != nil && d.getCloud().KubeClient.CoreV1().PersistentVolumes() != nil {
 		klog.V(6).Infof("List Volumes in Cluster:")
 		return d.listVolumesInCluster(ctx, start, int(req.MaxEntries))
 	}
-	klog.V(6).Infof("List Volumes in Node Resource Group: %s", d.cloud.ResourceGroup)
+	klog.V(6).Infof("List Volumes in Node Resource Group: %s", d.getCloud().ResourceGroup)
 	return d.listVolumesInNodeResourceGroup(ctx, start, int(req.MaxEntries))
 }
 
 // listVolumesInCluster is a helper function for ListVolumes used for when there is an available kubeclient
 func (d *Driver) listVolumesInCluster(ctx context.Context, start, maxEntries int) (*csi.ListVolumesResponse, error) {
-	pvList, err := d.cloud.KubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	pvList, err := d.getCloud().KubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "ListVolumes failed while fetching PersistentVolumes List with error: %v", err.Error())
 	}
@@ -681,8 +746,8 @@ func (d *Driver) listVolumesInCluster(ctx context.Context, start, maxEntries int
 				continue
 			}
 			subsID := azureutils.GetSubscriptionIDFromURI(diskURI)
-			if !strings.EqualFold(subsID, d.cloud.SubscriptionID) {
-				klog.V(6).Infof("disk(%s) not in current subscription(%s), skip", diskURI, d.cloud.SubscriptionID)
+			if !strings.EqualFold(subsID, d.getCloud().SubscriptionID) {
+				klog.V(6).Infof("disk(%s) not in current subscription(%s), skip", diskURI, d.getCloud().SubscriptionID)
 				continue
 			}
 			rg, diskURI = strings.ToLower(rg), strings.ToLower(diskURI)
@@ -748,7 +813,7 @@ func (d *Driver) listVolumesInCluster(ctx context.Context, start, maxEntries int
 // listVolumesInNodeResourceGroup is a helper function for ListVolumes used for when there is no available kubeclient
 func (d *Driver) listVolumesInNodeResourceGroup(ctx context.Context, start, maxEntries int) (*csi.ListVolumesResponse, error) {
 	entries := []*csi.ListVolumesResponse_Entry{}
-	listStatus := d.listVolumesByResourceGroup(ctx, d.cloud.ResourceGroup, entries, start, maxEntries, nil)
+	listStatus := d.listVolumesByResourceGroup(ctx, d.getCloud().ResourceGroup, entries, start, maxEntries, nil)
 	if listStatus.err != nil {
 		return nil, listStatus.err
 	}
@@ -768,7 +833,7 @@ func (d *Driver) listVolumesInNodeResourceGroup(ctx context.Context, start, maxE
 
 // listVolumesByResourceGroup is a helper function that updates the ListVolumeResponse_Entry slice and returns number of total visited volumes, number of volumes that needs to be visited and an error if found
 func (d *Driver) listVolumesByResourceGroup(ctx context.Context, resourceGroup string, entries []*csi.ListVolumesResponse_Entry, start, maxEntries int, volSet map[string]bool) listVolumeStatus {
-	diskClient := d.clientFactory.GetDiskClient()
+	diskClient := d.getClientFactory().GetDiskClient()
 	disks, derr := diskClient.List(ctx, resourceGroup)
 	if derr != nil {
 		return listVolumeStatus{err: status.Errorf(codes.Internal, "ListVolumes on rg(%s) failed with error: %v", resourceGroup, derr.Error())}
@@ -784,7 +849,7 @@ func (d *Driver) listVolumesByResourceGroup(ctx context.Context, resourceGroup s
 	if start > 0 && start >= len(disks) {
 		return listVolumeStatus{
 			numVisited: len(disks),
-			err:        status.Errorf(codes.FailedPrecondition, "ListVolumes starting token(%d) on rg(%s) is greater than total number of volumes", start, d.cloud.ResourceGroup),
+			err:        status.Errorf(codes.FailedPrecondition, "ListVolumes starting token(%d) on rg(%s) is greater than total number of volumes", start, d.getCloud().ResourceGroup),
 		}
 	}
 	if start < 0 {
@@ -809,7 +874,7 @@ func (d *Driver) listVolumesByResourceGroup(ctx context.Context, resourceGroup s
 			nodeList := []string{}
 
 			if disk.ManagedBy != nil {
-				attachedNode, err := d.cloud.VMSet.GetNodeNameByProviderID(*disk.ManagedBy)
+				attachedNode, err := d.getCloud().VMSet.GetNodeNameByProviderID(*disk.ManagedBy)
 				if err != nil {
 					return listVolumeStatus{err: err}
 				}
@@ -846,6 +911,9 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	if capacityBytes == 0 {
 		return nil, status.Error(codes.InvalidArgument, "volume capacity range missing in request")
 	}
+	if azureutils.IsStripedVolumeID(req.GetVolumeId()) {
+		return d.expandStripedVolume(ctx, req)
+	}
 	requestSize := *resource.NewQuantity(capacityBytes, resource.BinarySI)
 
 	diskURI := req.GetVolumeId()
@@ -863,7 +931,7 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	}
 
 	subsID := azureutils.GetSubscriptionIDFromURI(diskURI)
-	diskClient, err := d.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := d.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not get disk client for subscription(%s) with error(%v)", subsID, err)
 	}
@@ -876,7 +944,7 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	}
 	oldSize := *resource.NewQuantity(int64(*result.Properties.DiskSizeGB), resource.BinarySI)
 
-	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_expand_volume", d.cloud.ResourceGroup, d.cloud.SubscriptionID, d.Name)
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_expand_volume", d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, diskURI)
@@ -913,6 +981,10 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 		return nil, status.Error(codes.InvalidArgument, "snapshot name must be provided")
 	}
 
+	if azureutils.IsStripedVolumeID(sourceVolumeID) {
+		return d.createStripedSnapshot(ctx, req)
+	}
+
 	snapshotName = azureutils.CreateValidDiskName(snapshotName)
 
 	var customTags string
@@ -920,8 +992,8 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	incremental := true
 	var subsID, resourceGroup, dataAccessAuthMode string
 	var err error
-	localCloud := d.cloud
-	location := d.cloud.Location
+	localCloud := d.getCloud()
+	location := d.getCloud().Location
 
 	parameters := req.GetParameters()
 	for k, v := range parameters {
@@ -982,7 +1054,7 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 			},
 			Incremental: &incremental,
 		},
-		Location: &d.cloud.Location,
+		Location: &d.getCloud().Location,
 		Tags:     tags,
 	}
 
@@ -999,7 +1071,7 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	defer d.volumeLocks.Release(snapshotName)
 
 	var crossRegionSnapshotName string
-	if location != "" && location != d.cloud.Location {
+	if location != "" && location != d.getCloud().Location {
 		if incremental {
 			crossRegionSnapshotName = snapshotName
 			snapshotName = azureutils.CreateValidDiskName("local_" + snapshotName)
@@ -1012,14 +1084,14 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	if crossRegionSnapshotName != "" {
 		metricsRequest = "controller_create_snapshot_cross_region"
 	}
-	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, metricsRequest, d.cloud.ResourceGroup, d.cloud.SubscriptionID, d.Name)
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, metricsRequest, d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.SourceResourceID, sourceVolumeID, consts.SnapshotName, snapshotName)
 	}()
 
-	klog.V(2).Infof("begin to create snapshot(%s, incremental: %v) under rg(%s) region(%s)", snapshotName, incremental, resourceGroup, d.cloud.Location)
-	snapshotClient, err := d.clientFactory.GetSnapshotClientForSub(subsID)
+	klog.V(2).Infof("begin to create snapshot(%s, incremental: %v) under rg(%s) region(%s)", snapshotName, incremental, resourceGroup, d.getCloud().Location)
+	snapshotClient, err := d.getClientFactory().GetSnapshotClientForSub(subsID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not get snapshot client for subscription(%s) with error(%v)", subsID, err)
 	}
@@ -1028,21 +1100,34 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("request snapshot(%s) under rg(%s) already exists, but the SourceVolumeId is different, error details: %v", snapshotName, resourceGroup, err))
 		}
 
-		azureutils.SleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
+		d.sleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
 		return nil, status.Error(codes.Internal, fmt.Sprintf("create snapshot error: %v", err.Error()))
 	}
 
+	var checkpointed bool
 	if d.shouldWaitForSnapshotReady {
 		if err := d.waitForSnapshotReady(ctx, subsID, resourceGroup, snapshotName, waitForSnapshotReadyInterval, waitForSnapshotReadyTimeout); err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("waitForSnapshotReady(%s, %s, %s) failed with %v", subsID, resourceGroup, snapshotName, err))
+			switch {
+			case !errors.Is(err, errShuttingDown):
+				return nil, status.Error(codes.Internal, fmt.Sprintf("waitForSnapshotReady(%s, %s, %s) failed with %v", subsID, resourceGroup, snapshotName, err))
+			case crossRegionSnapshotName != "":
+				// the cross region copy is started when the request is retried
+				return nil, status.Error(codes.Unavailable, fmt.Sprintf("waitForSnapshotReady(%s, %s, %s) failed with %v", subsID, resourceGroup, snapshotName, err))
+			}
+			// the snapshot is returned as not ready to use, the request is retried until it's ready after restart
+			klog.Warningf("checkpoint snapshot(%s) under rg(%s) on shutdown: %v", snapshotName, resourceGroup, err)
+			checkpointed = true
 		}
 	}
-	klog.V(2).Infof("create snapshot(%s) under rg(%s) region(%s) successfully", snapshotName, resourceGroup, d.cloud.Location)
+	klog.V(2).Infof("create snapshot(%s) under rg(%s) region(%s) successfully", snapshotName, resourceGroup, d.getCloud().Location)
 
 	csiSnapshot, err := d.getSnapshotByID(ctx, subsID, resourceGroup, snapshotName, sourceVolumeID)
 	if err != nil {
 		return nil, err
 	}
+	if checkpointed {
+		csiSnapshot.ReadyToUse = false
+	}
 
 	if crossRegionSnapshotName != "" {
 		copySnapshot := snapshot
@@ -1062,21 +1147,25 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 				return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("request snapshot(%s) under rg(%s) already exists, but the SourceVolumeId is different, error details: %v", crossRegionSnapshotName, resourceGroup, err))
 			}
 
-			azureutils.SleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
+			d.sleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
 			return nil, status.Error(codes.Internal, fmt.Sprintf("create snapshot error: %v", err))
 		}
 		klog.V(2).Infof("create snapshot(%s) under rg(%s) region(%s) successfully", crossRegionSnapshotName, resourceGroup, location)
 
 		if err := d.waitForSnapshotReady(ctx, subsID, resourceGroup, crossRegionSnapshotName, waitForSnapshotReadyInterval, waitForSnapshotReadyTimeout); err != nil {
+			if errors.Is(err, errShuttingDown) {
+				// the copy continues in the background and is waited again when the request is retried
+				return nil, status.Error(codes.Unavailable, fmt.Sprintf("waitForSnapshotReady(%s, %s, %s) failed with %v", subsID, resourceGroup, crossRegionSnapshotName, err))
+			}
 			return nil, status.Error(codes.Internal, fmt.Sprintf("waitForSnapshotReady(%s, %s, %s) failed with %v", subsID, resourceGroup, crossRegionSnapshotName, err))
 		}
 
-		klog.V(2).Infof("begin to delete snapshot(%s) under rg(%s) region(%s)", snapshotName, resourceGroup, d.cloud.Location)
+		klog.V(2).Infof("begin to delete snapshot(%s) under rg(%s) region(%s)", snapshotName, resourceGroup, d.getCloud().Location)
 		if err = snapshotClient.Delete(ctx, resourceGroup, snapshotName); err != nil {
 			klog.Errorf("delete snapshot error: %v", err)
-			azureutils.SleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
+			d.sleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
 		} else {
-			klog.V(2).Infof("delete snapshot(%s) under rg(%s) region(%s) successfully", snapshotName, resourceGroup, d.cloud.Location)
+			klog.V(2).Infof("delete snapshot(%s) under rg(%s) region(%s) successfully", snapshotName, resourceGroup, d.getCloud().Location)
 		}
 
 		csiSnapshot, err = d.getSnapshotByID(ctx, subsID, resourceGroup, crossRegionSnapshotName, sourceVolumeID)
@@ -1099,10 +1188,14 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 		return nil, status.Error(codes.InvalidArgument, "Snapshot ID must be provided")
 	}
 
+	if azureutils.IsStripedVolumeID(snapshotID) {
+		return d.deleteStripedSnapshot(ctx, req)
+	}
+
 	var err error
 	var subsID string
 	snapshotName := snapshotID
-	resourceGroup := d.cloud.ResourceGroup
+	resourceGroup := d.getCloud().ResourceGroup
 
 	if azureutils.IsARMResourceID(snapshotID) {
 		snapshotName, resourceGroup, subsID, err = d.getSnapshotInfo(snapshotID)
@@ -1111,19 +1204,19 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 		}
 	}
 
-	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_delete_snapshot", d.cloud.ResourceGroup, d.cloud.SubscriptionID, d.Name)
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_delete_snapshot", d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
 	isOperationSucceeded := false
 	defer func() {
 		mc.ObserveOperationWithResult(isOperationSucceeded, consts.SnapshotID, snapshotID)
 	}()
 
 	klog.V(2).Infof("begin to delete snapshot(%s) under rg(%s)", snapshotName, resourceGroup)
-	snapshotClient, err := d.clientFactory.GetSnapshotClientForSub(subsID)
+	snapshotClient, err := d.getClientFactory().GetSnapshotClientForSub(subsID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not get snapshot client for subscription(%s) with error(%v)", subsID, err)
 	}
 	if err := snapshotClient.Delete(ctx, resourceGroup, snapshotName); err != nil {
-		azureutils.SleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
+		d.sleepIfThrottled(err, consts.SnapshotOpThrottlingSleepSec)
 		return nil, status.Error(codes.Internal, fmt.Sprintf("delete snapshot error: %v", err))
 	}
 	klog.V(2).Infof("delete snapshot(%s) under rg(%s) successfully", snapshotName, resourceGroup)
@@ -1135,7 +1228,7 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
 	// SnapshotId is not empty, return snapshot that match the snapshot id.
 	if len(req.GetSnapshotId()) != 0 {
-		snapshot, err := d.getSnapshotByID(ctx, "", d.cloud.ResourceGroup, req.GetSnapshotId(), req.SourceVolumeId)
+		snapshot, err := d.getSnapshotByID(ctx, "", d.getCloud().ResourceGroup, req.GetSnapshotId(), req.SourceVolumeId)
 		if err != nil {
 			if strings.Contains(err.Error(), consts.ResourceNotFound) {
 				return &csi.ListSnapshotsResponse{}, nil
@@ -1152,9 +1245,9 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 		}
 		return listSnapshotResp, nil
 	}
-	snapshotClient := d.clientFactory.GetSnapshotClient()
+	snapshotClient := d.getClientFactory().GetSnapshotClient()
 	// no SnapshotId is set, return all snapshots that satisfy the request.
-	snapshots, err := snapshotClient.List(ctx, d.cloud.ResourceGroup)
+	snapshots, err := snapshotClient.List(ctx, d.getCloud().ResourceGroup)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err.Error()))
 	}
@@ -1171,7 +1264,7 @@ func (d *Driver) getSnapshotByID(ctx context.Context, subsID, resourceGroup, sna
 			return nil, status.Errorf(codes.Internal, err.Error())
 		}
 	}
-	snapshotClient, err := d.clientFactory.GetSnapshotClientForSub(subsID)
+	snapshotClient, err := d.getClientFactory().GetSnapshotClientForSub(subsID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not get snapshot client for subscription(%s) with error(%v)", subsID, err)
 	}
@@ -1188,7 +1281,7 @@ func (d *Driver) GetSourceDiskSize(ctx context.Context, subsID, resourceGroup, d
 	if curDepth > maxDepth {
 		return nil, nil, status.Error(codes.Internal, fmt.Sprintf("current depth (%d) surpassed the max depth (%d) while searching for the source disk size", curDepth, maxDepth))
 	}
-	diskClient, err := d.clientFactory.GetDiskClientForSub(subsID)
+	diskClient, err := d.getClientFactory().GetDiskClientForSub(subsID)
 	if err != nil {
 		return nil, nil, status.Error(codes.Internal, err.Error())
 	}
@@ -455,6 +455,54 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "valid request in edge zone",
+			testFunc: func(t *testing.T) {
+				cntl := gomock.NewController(t)
+				defer cntl.Finish()
+				d, _ := NewFakeDriver(cntl)
+				req := &csi.CreateVolumeRequest{
+					Name:               testVolumeName,
+					VolumeCapabilities: stdVolumeCapabilities,
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(10)},
+					AccessibilityRequirements: &csi.TopologyRequirement{
+						Preferred: []*csi.Topology{
+							{Segments: map[string]string{topologyKey: "", consts.EdgeZoneTopologyKey: "microsoftlosangeles1"}},
+						},
+					},
+				}
+				size := int32(volumehelper.BytesToGiB(req.CapacityRange.RequiredBytes))
+				id := fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", testVolumeName)
+				state := "Succeeded"
+				disk := &armcompute.Disk{
+					ID:   &id,
+					Name: &testVolumeName,
+					Properties: &armcompute.DiskProperties{
+						DiskSizeGB:        &size,
+						ProvisioningState: &state,
+					},
+				}
+				diskClient := mock_diskclient.NewMockInterface(cntl)
+				d.getClientFactory().(*mock_azclient.MockClientFactory).EXPECT().GetDiskClientForSub(gomock.Any()).Return(diskClient, nil).AnyTimes()
+				diskClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).Return(disk, nil).AnyTimes()
+				diskClient.EXPECT().CreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _, _ string, model armcompute.Disk) (*armcompute.Disk, error) {
+						assert.Equal(t, &armcompute.ExtendedLocation{Name: pointer.String("microsoftlosangeles1"), Type: to.Ptr(armcompute.ExtendedLocationTypesEdgeZone)}, model.ExtendedLocation)
+						assert.Empty(t, model.Zones)
+						return disk, nil
+					}).Times(1)
+				resp, err := d.CreateVolume(context.Background(), req)
+				assert.NoError(t, err)
+				assert.Equal(t, []*csi.Topology{
+					{Segments: map[string]string{topologyKey: "", consts.EdgeZoneTopologyKey: "microsoftlosangeles1"}},
+				}, resp.GetVolume().GetAccessibleTopology())
+
+				// ZRS disks are not supported in edge zones
+				req.Parameters = map[string]string{consts.SkuNameField: "StandardSSD_ZRS", consts.ExtendedLocationField: "microsoftlosangeles1"}
+				_, err = d.CreateVolume(context.Background(), req)
+				assert.Equal(t, status.Error(codes.InvalidArgument, "ZRS disk(StandardSSD_ZRS) is not supported in edge zone(microsoftlosangeles1)"), err)
+			},
+		},
 		{
 			name: "invalid parameter",
 			testFunc: func(t *testing.T) {
@@ -1390,6 +1438,38 @@ func TestCreateSnapshot(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "snapshot not ready to use is checkpointed on shutdown",
+			testFunc: func(t *testing.T) {
+				req := &csi.CreateSnapshotRequest{
+					SourceVolumeId: testVolumeID,
+					Name:           "snapname",
+				}
+				cntl := gomock.NewController(t)
+				defer cntl.Finish()
+				d, _ := newFakeDriverV1(cntl)
+				d.setCloud(&azure.Cloud{})
+				mockSnapshotClient := mock_snapshotclient.NewMockInterface(cntl)
+				d.getClientFactory().(*mock_azclient.MockClientFactory).EXPECT().GetSnapshotClientForSub(gomock.Any()).Return(mockSnapshotClient, nil).AnyTimes()
+				snapshot := &armcompute.Snapshot{
+					Properties: &armcompute.SnapshotProperties{
+						TimeCreated:       &time.Time{},
+						ProvisioningState: pointer.String("succeeded"),
+						DiskSizeGB:        pointer.Int32(10),
+						CompletionPercent: pointer.Float32(50),
+					},
+					ID: pointer.String("test"),
+				}
+				mockSnapshotClient.EXPECT().CreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+				mockSnapshotClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).Return(snapshot, nil).AnyTimes()
+				d.operations.startShutdown()
+
+				resp, err := d.CreateSnapshot(context.Background(), req)
+				assert.NoError(t, err)
+				assert.Equal(t, "test", resp.GetSnapshot().GetSnapshotId())
+				assert.False(t, resp.GetSnapshot().GetReadyToUse())
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, tc.testFunc)
@@ -0,0 +1,80 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// deviceSettingsReapplyInterval is the interval to check the tuned block device settings of staged volumes,
+// udev rules may reset them after a device rescan, e.g. when another disk is attached
+const deviceSettingsReapplyInterval = time.Minute
+
+// getDeviceSettingsStateFile returns the file recording the block device settings tuned on NodeStageVolume,
+// it's in the staging directory of the volume next to the staging path, which is hidden by the mount of a file system volume
+func getDeviceSettingsStateFile(stagingPath string) string {
+	return filepath.Join(filepath.Dir(stagingPath), "."+filepath.Base(stagingPath)+".device-settings")
+}
+
+// trackDeviceSettings adds the tuned block device settings of a volume to the periodic check, it's a no-op if no setting is recorded
+func (d *DriverCore) trackDeviceSettings(volumeID, stagingPath string) {
+	stateFile := getDeviceSettingsStateFile(stagingPath)
+	if _, err := os.Stat(stateFile); err != nil {
+		return
+	}
+	d.deviceSettingsStateFiles.Store(volumeID, stateFile)
+}
+
+// restoreDeviceSettings restores the block device settings of a volume to the values before NodeStageVolume,
+// a failure is only logged since the volume could still be unstaged
+func (d *DriverCore) restoreDeviceSettings(volumeID, stagingPath string) {
+	d.deviceSettingsStateFiles.Delete(volumeID)
+	stateFile := getDeviceSettingsStateFile(stagingPath)
+	if _, err := os.Stat(stateFile); err != nil {
+		return
+	}
+	if err := d.getDeviceHelper().RestoreDeviceSettings(stateFile); err != nil {
+		klog.Warningf("failed to restore device settings of volume %s: %v", volumeID, err)
+		return
+	}
+	klog.V(2).Infof("restored device settings of volume %s", volumeID)
+}
+
+// reapplyDeviceSettings applies the tuned block device settings of staged volumes again if they are reset,
+// and adjusts the settings of volumes with auto perfProfile to the observed workload.
+// A volume under stage or unstage is skipped
+func (d *Driver) reapplyDeviceSettings(_ context.Context) {
+	d.deviceSettingsStateFiles.Range(func(key, value interface{}) bool {
+		volumeID := key.(string)
+		if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+			return true
+		}
+		defer d.volumeLocks.Release(volumeID)
+		if err := d.getDeviceHelper().ReapplyDeviceSettings(value.(string)); err != nil {
+			klog.Warningf("failed to reapply device settings of volume %s: %v", volumeID, err)
+		}
+		if err := d.getDeviceHelper().TuneDeviceSettings(value.(string)); err != nil {
+			klog.Warningf("failed to tune device settings of volume %s: %v", volumeID, err)
+		}
+		return true
+	})
+}
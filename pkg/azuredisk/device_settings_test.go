@@ -0,0 +1,72 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization/mockoptimization"
+)
+
+func TestGetDeviceSettingsStateFile(t *testing.T) {
+	assert.Equal(t, filepath.Join("/var/lib/kubelet/plugins/kubernetes.io/csi/disk.csi.azure.com/abc", ".globalmount.device-settings"),
+		getDeviceSettingsStateFile("/var/lib/kubelet/plugins/kubernetes.io/csi/disk.csi.azure.com/abc/globalmount"))
+}
+
+func TestTrackAndRestoreDeviceSettings(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, err := newFakeDriverV1(cntl)
+	require.NoError(t, err)
+	helper := d.getDeviceHelper().(*mockoptimization.MockInterface)
+
+	stagingPath := filepath.Join(t.TempDir(), "globalmount")
+	stateFile := getDeviceSettingsStateFile(stagingPath)
+
+	// nothing is tracked or restored without the state file
+	d.trackDeviceSettings("vol_1", stagingPath)
+	d.reapplyDeviceSettings(context.Background())
+	d.restoreDeviceSettings("vol_1", stagingPath)
+
+	require.NoError(t, os.WriteFile(stateFile, []byte("{}"), 0600))
+	d.trackDeviceSettings("vol_1", stagingPath)
+	helper.EXPECT().ReapplyDeviceSettings(stateFile).Return(nil)
+	helper.EXPECT().TuneDeviceSettings(stateFile).Return(nil)
+	d.reapplyDeviceSettings(context.Background())
+
+	// a volume under stage or unstage is skipped
+	d.volumeLocks.TryAcquire("vol_1")
+	d.reapplyDeviceSettings(context.Background())
+	d.volumeLocks.Release("vol_1")
+
+	helper.EXPECT().ReapplyDeviceSettings(stateFile).Return(fmt.Errorf("test error"))
+	helper.EXPECT().TuneDeviceSettings(stateFile).Return(fmt.Errorf("test error"))
+	d.reapplyDeviceSettings(context.Background())
+
+	helper.EXPECT().RestoreDeviceSettings(stateFile).Return(fmt.Errorf("test error"))
+	d.restoreDeviceSettings("vol_1", stagingPath)
+	// the volume is not tracked any more
+	d.reapplyDeviceSettings(context.Background())
+}
@@ -0,0 +1,364 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// operations recorded in the dry run journal
+const (
+	dryRunCreateOrUpdateDisk     = "CreateOrUpdateDisk"
+	dryRunPatchDisk              = "PatchDisk"
+	dryRunDeleteDisk             = "DeleteDisk"
+	dryRunCreateOrUpdateSnapshot = "CreateOrUpdateSnapshot"
+	dryRunDeleteSnapshot         = "DeleteSnapshot"
+	dryRunAttachDisk             = "AttachDisk"
+	dryRunDetachDisk             = "DetachDisk"
+	dryRunUpdateVM               = "UpdateVM"
+)
+
+// dryRunJournalEntry is a line of the dry run journal, it holds a mutating ARM request which was not executed
+type dryRunJournalEntry struct {
+	Time      time.Time   `json:"time"`
+	Operation string      `json:"operation"`
+	Resource  string      `json:"resource"`
+	Node      string      `json:"node,omitempty"`
+	Request   interface{} `json:"request,omitempty"`
+}
+
+// dryRunRecorder records the mutating ARM requests in the journal and returns synthetic successes, the read requests pass through.
+// The disks and snapshots created or updated in the dry run are kept in memory and returned by the reads instead of the real ones,
+// so that the operations waiting for them complete as they would.
+type dryRunRecorder struct {
+	mu      sync.Mutex
+	journal io.Writer
+	// <lowercase ARM ID, *armcompute.Disk>
+	disks map[string]*armcompute.Disk
+	// <lowercase ARM ID, *armcompute.Snapshot>
+	snapshots map[string]*armcompute.Snapshot
+}
+
+// newDryRunRecorder returns a recorder appending to the journal at path, the journal is written to stdout if path is empty
+func newDryRunRecorder(path string) (*dryRunRecorder, error) {
+	var journal io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		journal = f
+	}
+	return newDryRunRecorderWithWriter(journal), nil
+}
+
+func newDryRunRecorderWithWriter(journal io.Writer) *dryRunRecorder {
+	return &dryRunRecorder{
+		journal:   journal,
+		disks:     map[string]*armcompute.Disk{},
+		snapshots: map[string]*armcompute.Snapshot{},
+	}
+}
+
+// record writes the request in the journal
+func (r *dryRunRecorder) record(operation, resource, node string, request interface{}) {
+	klog.V(2).Infof("dry run: skip %s of %s", operation, resource)
+	data, err := json.Marshal(dryRunJournalEntry{Time: time.Now().UTC(), Operation: operation, Resource: resource, Node: node, Request: request})
+	if err != nil {
+		klog.Errorf("dry run: failed to marshal %s of %s: %v", operation, resource, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.journal.Write(append(data, '\n')); err != nil {
+		klog.Errorf("dry run: failed to write %s of %s in the journal: %v", operation, resource, err)
+	}
+}
+
+func (r *dryRunRecorder) getDisk(id string) (*armcompute.Disk, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	disk, ok := r.disks[strings.ToLower(id)]
+	return disk, ok
+}
+
+func (r *dryRunRecorder) setDisk(id string, disk *armcompute.Disk) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if disk == nil {
+		delete(r.disks, strings.ToLower(id))
+	} else {
+		r.disks[strings.ToLower(id)] = disk
+	}
+}
+
+func (r *dryRunRecorder) getSnapshot(id string) (*armcompute.Snapshot, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot, ok := r.snapshots[strings.ToLower(id)]
+	return snapshot, ok
+}
+
+func (r *dryRunRecorder) setSnapshot(id string, snapshot *armcompute.Snapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if snapshot == nil {
+		delete(r.snapshots, strings.ToLower(id))
+	} else {
+		r.snapshots[strings.ToLower(id)] = snapshot
+	}
+}
+
+// wrapClientFactory returns a client factory whose disk and snapshot clients record the mutating requests,
+// the factory is returned as is if the dry run is disabled
+func (r *dryRunRecorder) wrapClientFactory(factory azclient.ClientFactory, subscriptionID string) azclient.ClientFactory {
+	if r == nil || factory == nil {
+		return factory
+	}
+	return &dryRunClientFactory{ClientFactory: factory, recorder: r, subscriptionID: subscriptionID}
+}
+
+// wrapVMSet returns a VMSet which records the VM updates, the VMSet is returned as is if the dry run is disabled
+func (r *dryRunRecorder) wrapVMSet(vmset provider.VMSet) provider.VMSet {
+	if r == nil || vmset == nil {
+		return vmset
+	}
+	return &dryRunVMSet{VMSet: vmset, recorder: r}
+}
+
+type dryRunClientFactory struct {
+	azclient.ClientFactory
+	recorder       *dryRunRecorder
+	subscriptionID string
+}
+
+func (f *dryRunClientFactory) GetDiskClient() diskclient.Interface {
+	return &dryRunDiskClient{Interface: f.ClientFactory.GetDiskClient(), recorder: f.recorder, subscriptionID: f.subscriptionID}
+}
+
+func (f *dryRunClientFactory) GetDiskClientForSub(subscriptionID string) (diskclient.Interface, error) {
+	client, err := f.ClientFactory.GetDiskClientForSub(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return &dryRunDiskClient{Interface: client, recorder: f.recorder, subscriptionID: subscriptionID}, nil
+}
+
+func (f *dryRunClientFactory) GetSnapshotClient() snapshotclient.Interface {
+	return &dryRunSnapshotClient{Interface: f.ClientFactory.GetSnapshotClient(), factory: f, subscriptionID: f.subscriptionID}
+}
+
+func (f *dryRunClientFactory) GetSnapshotClientForSub(subscriptionID string) (snapshotclient.Interface, error) {
+	client, err := f.ClientFactory.GetSnapshotClientForSub(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	return &dryRunSnapshotClient{Interface: client, factory: f, subscriptionID: subscriptionID}, nil
+}
+
+// getSourceSize returns the size of the source disk or snapshot of a snapshot, which is filled by ARM when the snapshot is created
+func (f *dryRunClientFactory) getSourceSize(ctx context.Context, sourceResourceID string) *int32 {
+	id, err := arm.ParseResourceID(sourceResourceID)
+	if err != nil {
+		return nil
+	}
+	if strings.EqualFold(id.ResourceType.Type, "snapshots") {
+		client, err := f.GetSnapshotClientForSub(id.SubscriptionID)
+		if err != nil {
+			return nil
+		}
+		snapshot, err := client.Get(ctx, id.ResourceGroupName, id.Name)
+		if err != nil || snapshot.Properties == nil {
+			return nil
+		}
+		return snapshot.Properties.DiskSizeGB
+	}
+	client, err := f.GetDiskClientForSub(id.SubscriptionID)
+	if err != nil {
+		return nil
+	}
+	disk, err := client.Get(ctx, id.ResourceGroupName, id.Name)
+	if err != nil || disk.Properties == nil {
+		return nil
+	}
+	return disk.Properties.DiskSizeGB
+}
+
+type dryRunDiskClient struct {
+	diskclient.Interface
+	recorder       *dryRunRecorder
+	subscriptionID string
+}
+
+func (c *dryRunDiskClient) Get(ctx context.Context, resourceGroupName string, diskName string) (*armcompute.Disk, error) {
+	if disk, ok := c.recorder.getDisk(fmt.Sprintf(managedDiskPath, c.subscriptionID, resourceGroupName, diskName)); ok {
+		return disk, nil
+	}
+	return c.Interface.Get(ctx, resourceGroupName, diskName)
+}
+
+func (c *dryRunDiskClient) CreateOrUpdate(_ context.Context, resourceGroupName string, diskName string, disk armcompute.Disk) (*armcompute.Disk, error) {
+	id := fmt.Sprintf(managedDiskPath, c.subscriptionID, resourceGroupName, diskName)
+	c.recorder.record(dryRunCreateOrUpdateDisk, id, "", disk)
+
+	result := disk
+	result.ID = to.Ptr(id)
+	result.Name = to.Ptr(diskName)
+	result.Type = to.Ptr("Microsoft.Compute/disks")
+	properties := armcompute.DiskProperties{}
+	if disk.Properties != nil {
+		properties = *disk.Properties
+	}
+	properties.ProvisioningState = to.Ptr("Succeeded")
+	if properties.DiskState == nil {
+		properties.DiskState = to.Ptr(armcompute.DiskStateUnattached)
+	}
+	if properties.TimeCreated == nil {
+		properties.TimeCreated = to.Ptr(time.Now().UTC())
+	}
+	result.Properties = &properties
+	c.recorder.setDisk(id, &result)
+	return &result, nil
+}
+
+func (c *dryRunDiskClient) Patch(ctx context.Context, resourceGroupName string, diskName string, update armcompute.DiskUpdate) (*armcompute.Disk, error) {
+	id := fmt.Sprintf(managedDiskPath, c.subscriptionID, resourceGroupName, diskName)
+	c.recorder.record(dryRunPatchDisk, id, "", update)
+
+	disk, err := c.Get(ctx, resourceGroupName, diskName)
+	if err != nil {
+		return nil, err
+	}
+	result := *disk
+	properties := armcompute.DiskProperties{}
+	if disk.Properties != nil {
+		properties = *disk.Properties
+	}
+	if update.Properties != nil && update.Properties.DiskSizeGB != nil {
+		properties.DiskSizeGB = update.Properties.DiskSizeGB
+	}
+	result.Properties = &properties
+	if update.Tags != nil {
+		result.Tags = update.Tags
+	}
+	c.recorder.setDisk(id, &result)
+	return &result, nil
+}
+
+func (c *dryRunDiskClient) Delete(_ context.Context, resourceGroupName string, diskName string) error {
+	id := fmt.Sprintf(managedDiskPath, c.subscriptionID, resourceGroupName, diskName)
+	c.recorder.record(dryRunDeleteDisk, id, "", nil)
+	c.recorder.setDisk(id, nil)
+	return nil
+}
+
+type dryRunSnapshotClient struct {
+	snapshotclient.Interface
+	factory        *dryRunClientFactory
+	subscriptionID string
+}
+
+func (c *dryRunSnapshotClient) Get(ctx context.Context, resourceGroupName string, snapshotName string) (*armcompute.Snapshot, error) {
+	if snapshot, ok := c.factory.recorder.getSnapshot(fmt.Sprintf(diskSnapshotPath, c.subscriptionID, resourceGroupName, snapshotName)); ok {
+		return snapshot, nil
+	}
+	return c.Interface.Get(ctx, resourceGroupName, snapshotName)
+}
+
+func (c *dryRunSnapshotClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, snapshotName string, snapshot armcompute.Snapshot) (*armcompute.Snapshot, error) {
+	id := fmt.Sprintf(diskSnapshotPath, c.subscriptionID, resourceGroupName, snapshotName)
+	c.factory.recorder.record(dryRunCreateOrUpdateSnapshot, id, "", snapshot)
+
+	result := snapshot
+	result.ID = to.Ptr(id)
+	result.Name = to.Ptr(snapshotName)
+	result.Type = to.Ptr("Microsoft.Compute/snapshots")
+	properties := armcompute.SnapshotProperties{}
+	if snapshot.Properties != nil {
+		properties = *snapshot.Properties
+	}
+	properties.ProvisioningState = to.Ptr("Succeeded")
+	properties.CompletionPercent = to.Ptr[float32](100)
+	if properties.TimeCreated == nil {
+		properties.TimeCreated = to.Ptr(time.Now().UTC())
+	}
+	if properties.DiskSizeGB == nil && properties.CreationData != nil && properties.CreationData.SourceResourceID != nil {
+		properties.DiskSizeGB = c.factory.getSourceSize(ctx, *properties.CreationData.SourceResourceID)
+	}
+	if properties.DiskSizeGB == nil {
+		properties.DiskSizeGB = to.Ptr[int32](0)
+	}
+	result.Properties = &properties
+	c.factory.recorder.setSnapshot(id, &result)
+	return &result, nil
+}
+
+func (c *dryRunSnapshotClient) Delete(_ context.Context, resourceGroupName string, snapshotName string) error {
+	id := fmt.Sprintf(diskSnapshotPath, c.subscriptionID, resourceGroupName, snapshotName)
+	c.factory.recorder.record(dryRunDeleteSnapshot, id, "", nil)
+	c.factory.recorder.setSnapshot(id, nil)
+	return nil
+}
+
+// dryRunVMSet records the disk attach/detach and the VM updates, the VMs are not updated
+type dryRunVMSet struct {
+	provider.VMSet
+	recorder *dryRunRecorder
+}
+
+// vmID returns the ARM ID of the VM of the node, or the node name if the VM is not found
+func (vmset *dryRunVMSet) vmID(nodeName types.NodeName) string {
+	if id, err := vmset.GetInstanceIDByNodeName(string(nodeName)); err == nil && id != "" {
+		return id
+	}
+	return string(nodeName)
+}
+
+func (vmset *dryRunVMSet) AttachDisk(_ context.Context, nodeName types.NodeName, diskMap map[string]*provider.AttachDiskOptions) error {
+	vmset.recorder.record(dryRunAttachDisk, vmset.vmID(nodeName), string(nodeName), diskMap)
+	return nil
+}
+
+func (vmset *dryRunVMSet) DetachDisk(_ context.Context, nodeName types.NodeName, diskMap map[string]string, forceDetach bool) error {
+	vmset.recorder.record(dryRunDetachDisk, vmset.vmID(nodeName), string(nodeName), map[string]interface{}{
+		"disks":       diskMap,
+		"forceDetach": forceDetach,
+	})
+	return nil
+}
+
+func (vmset *dryRunVMSet) UpdateVM(_ context.Context, nodeName types.NodeName) error {
+	vmset.recorder.record(dryRunUpdateVM, vmset.vmID(nodeName), string(nodeName), nil)
+	return nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient/mock_snapshotclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const dryRunTestSubscriptionID = "subs"
+
+// readDryRunJournal returns the entries of the journal, the requests are decoded as maps
+func readDryRunJournal(t *testing.T, journal *bytes.Buffer) []dryRunJournalEntry {
+	var entries []dryRunJournalEntry
+	for _, line := range strings.Split(strings.TrimSpace(journal.String()), "\n") {
+		var entry dryRunJournalEntry
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func newDryRunTestFactory(cntl *gomock.Controller, journal *bytes.Buffer) (*dryRunClientFactory, *mock_diskclient.MockInterface, *mock_snapshotclient.MockInterface) {
+	diskClient := mock_diskclient.NewMockInterface(cntl)
+	snapshotClient := mock_snapshotclient.NewMockInterface(cntl)
+	factory := mock_azclient.NewMockClientFactory(cntl)
+	factory.EXPECT().GetDiskClientForSub(dryRunTestSubscriptionID).Return(diskClient, nil).AnyTimes()
+	factory.EXPECT().GetSnapshotClientForSub(dryRunTestSubscriptionID).Return(snapshotClient, nil).AnyTimes()
+	recorder := newDryRunRecorderWithWriter(journal)
+	return recorder.wrapClientFactory(factory, dryRunTestSubscriptionID).(*dryRunClientFactory), diskClient, snapshotClient
+}
+
+func TestDryRunDiskClient(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	journal := &bytes.Buffer{}
+	factory, diskClient, _ := newDryRunTestFactory(cntl, journal)
+	client, err := factory.GetDiskClientForSub(dryRunTestSubscriptionID)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	diskID := fmt.Sprintf(managedDiskPath, dryRunTestSubscriptionID, "rg", "disk")
+
+	// the created disk is returned by the reads without calling ARM
+	created, err := client.CreateOrUpdate(ctx, "rg", "disk", armcompute.Disk{
+		Location:   to.Ptr("eastus"),
+		Properties: &armcompute.DiskProperties{DiskSizeGB: to.Ptr[int32](10)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, diskID, *created.ID)
+	disk, err := client.Get(ctx, "rg", "disk")
+	assert.NoError(t, err)
+	assert.Equal(t, "Succeeded", *disk.Properties.ProvisioningState)
+	assert.Equal(t, armcompute.DiskStateUnattached, *disk.Properties.DiskState)
+
+	resized, err := client.Patch(ctx, "rg", "disk", armcompute.DiskUpdate{Properties: &armcompute.DiskUpdateProperties{DiskSizeGB: to.Ptr[int32](20)}})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(20), *resized.Properties.DiskSizeGB)
+
+	// the disks which are not created in the dry run are read from ARM
+	assert.NoError(t, client.Delete(ctx, "rg", "disk"))
+	diskClient.EXPECT().Get(gomock.Any(), "rg", "disk").Return(&armcompute.Disk{Properties: &armcompute.DiskProperties{DiskSizeGB: to.Ptr[int32](5)}}, nil)
+	disk, err = client.Get(ctx, "rg", "disk")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(5), *disk.Properties.DiskSizeGB)
+
+	entries := readDryRunJournal(t, journal)
+	assert.Len(t, entries, 3)
+	operations := []string{dryRunCreateOrUpdateDisk, dryRunPatchDisk, dryRunDeleteDisk}
+	for i, entry := range entries {
+		assert.Equal(t, operations[i], entry.Operation)
+		assert.Equal(t, diskID, entry.Resource)
+	}
+	assert.Equal(t, "eastus", entries[0].Request.(map[string]interface{})["location"])
+	assert.Nil(t, entries[2].Request)
+}
+
+func TestDryRunSnapshotClient(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	journal := &bytes.Buffer{}
+	factory, diskClient, _ := newDryRunTestFactory(cntl, journal)
+	client, err := factory.GetSnapshotClientForSub(dryRunTestSubscriptionID)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	diskID := fmt.Sprintf(managedDiskPath, dryRunTestSubscriptionID, "rg", "disk")
+	snapshotID := fmt.Sprintf(diskSnapshotPath, dryRunTestSubscriptionID, "rg", "snapshot")
+
+	// the size of the snapshot is the size of the source disk
+	diskClient.EXPECT().Get(gomock.Any(), "rg", "disk").Return(&armcompute.Disk{Properties: &armcompute.DiskProperties{DiskSizeGB: to.Ptr[int32](8)}}, nil)
+	_, err = client.CreateOrUpdate(ctx, "rg", "snapshot", armcompute.Snapshot{
+		Properties: &armcompute.SnapshotProperties{CreationData: &armcompute.CreationData{
+			CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+			SourceResourceID: to.Ptr(diskID),
+		}},
+	})
+	assert.NoError(t, err)
+	snapshot, err := client.Get(ctx, "rg", "snapshot")
+	assert.NoError(t, err)
+	assert.Equal(t, snapshotID, *snapshot.ID)
+	assert.Equal(t, int32(8), *snapshot.Properties.DiskSizeGB)
+	assert.Equal(t, float32(100), *snapshot.Properties.CompletionPercent)
+	assert.NotNil(t, snapshot.Properties.TimeCreated)
+
+	assert.NoError(t, client.Delete(ctx, "rg", "snapshot"))
+	entries := readDryRunJournal(t, journal)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, dryRunCreateOrUpdateSnapshot, entries[0].Operation)
+	assert.Equal(t, dryRunDeleteSnapshot, entries[1].Operation)
+	assert.Equal(t, snapshotID, entries[1].Resource)
+}
+
+func TestDryRunVMSet(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	journal := &bytes.Buffer{}
+	vmset := provider.NewMockVMSet(cntl)
+	vmID := "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/node-0"
+	vmset.EXPECT().GetInstanceIDByNodeName("node-0").Return(vmID, nil).AnyTimes()
+	recorded := newDryRunRecorderWithWriter(journal).wrapVMSet(vmset)
+	ctx := context.Background()
+
+	assert.NoError(t, recorded.AttachDisk(ctx, types.NodeName("node-0"), map[string]*provider.AttachDiskOptions{
+		"diskuri": {DiskName: "disk", Lun: 1},
+	}))
+	assert.NoError(t, recorded.DetachDisk(ctx, types.NodeName("node-0"), map[string]string{"diskuri": "disk"}, true))
+	assert.NoError(t, recorded.UpdateVM(ctx, types.NodeName("node-0")))
+
+	entries := readDryRunJournal(t, journal)
+	assert.Len(t, entries, 3)
+	operations := []string{dryRunAttachDisk, dryRunDetachDisk, dryRunUpdateVM}
+	for i, entry := range entries {
+		assert.Equal(t, operations[i], entry.Operation)
+		assert.Equal(t, vmID, entry.Resource)
+		assert.Equal(t, "node-0", entry.Node)
+	}
+	assert.Equal(t, float64(1), entries[0].Request.(map[string]interface{})["diskuri"].(map[string]interface{})["Lun"])
+	assert.Equal(t, true, entries[1].Request.(map[string]interface{})["forceDetach"])
+}
+
+func TestDryRunRecorderDisabled(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	var recorder *dryRunRecorder
+	factory := mock_azclient.NewMockClientFactory(cntl)
+	vmset := provider.NewMockVMSet(cntl)
+	assert.Equal(t, factory, recorder.wrapClientFactory(factory, dryRunTestSubscriptionID))
+	assert.Equal(t, vmset, recorder.wrapVMSet(vmset))
+}
+
+func TestNewDryRunRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	recorder, err := newDryRunRecorder(path)
+	assert.NoError(t, err)
+	recorder.record(dryRunUpdateVM, "vm", "node-0", nil)
+	recorder.record(dryRunUpdateVM, "vm", "node-1", nil)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 2)
+
+	_, err = newDryRunRecorder(filepath.Join(t.TempDir(), "missing", "journal.jsonl"))
+	assert.Error(t, err)
+}
+
+func TestConfigureCloudDryRun(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+	assert.NotNil(t, d.configureCloud(d.cloud))
+	_, ok := d.configureCloud(d.cloud).(*dryRunClientFactory)
+	assert.False(t, ok)
+
+	d.dryRun = newDryRunRecorderWithWriter(&bytes.Buffer{})
+	_, ok = d.configureCloud(d.cloud).(*dryRunClientFactory)
+	assert.True(t, ok)
+}
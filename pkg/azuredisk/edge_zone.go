@@ -0,0 +1,102 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"k8s.io/klog/v2"
+)
+
+const imdsTimeout = 5 * time.Second
+
+var (
+	// imdsExtendedLocationURL is the extended location of the VM in IMDS, which is not in the instance metadata of the cloud provider
+	imdsExtendedLocationURL = "http://169.254.169.254/metadata/instance/compute/extendedLocation?api-version=2021-12-13&format=json"
+	// imdsComputeURL is the compute metadata of the VM in IMDS
+	imdsComputeURL = "http://169.254.169.254/metadata/instance/compute?api-version=2021-12-13&format=json"
+)
+
+// getNodeEdgeZone returns the edge zone of the node from the extended location in the cloud config,
+// or from IMDS if the instance metadata is used, empty string is returned if the node is not in an edge zone
+func (d *DriverCore) getNodeEdgeZone(ctx context.Context) string {
+	cloud := d.getCloud()
+	if cloud == nil {
+		return ""
+	}
+	extendedLocation := &ExtendedLocation{Name: cloud.ExtendedLocationName, Type: cloud.ExtendedLocationType}
+	if !cloud.HasExtendedLocation() {
+		if !cloud.UseInstanceMetadata {
+			return ""
+		}
+		var err error
+		if extendedLocation, err = getExtendedLocationFromIMDS(ctx, imdsExtendedLocationURL); err != nil {
+			klog.Warningf("failed to get extended location of node(%s) from IMDS: %v", d.NodeID, err)
+			return ""
+		}
+	}
+	if !strings.EqualFold(extendedLocation.Type, string(armcompute.ExtendedLocationTypesEdgeZone)) {
+		return ""
+	}
+	return extendedLocation.Name
+}
+
+// getExtendedLocationFromIMDS returns the extended location of the VM from IMDS
+func getExtendedLocationFromIMDS(ctx context.Context, url string) (*ExtendedLocation, error) {
+	body, err := queryIMDS(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("failure of getting extended location: %w", err)
+	}
+	extendedLocation := &ExtendedLocation{}
+	if err := json.Unmarshal(body, extendedLocation); err != nil {
+		return nil, err
+	}
+	return extendedLocation, nil
+}
+
+// queryIMDS returns the response body of the IMDS request
+func queryIMDS(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, imdsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata", "True")
+	// IMDS must be reached directly instead of through a proxy
+	client := &http.Client{Transport: &http.Transport{Proxy: nil}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response %q: %s", resp.Status, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestGetExtendedLocationFromIMDS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "True" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"name":"microsoftlosangeles1","type":"edgeZone"}`))
+	}))
+	defer server.Close()
+
+	extendedLocation, err := getExtendedLocationFromIMDS(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, &ExtendedLocation{Name: "microsoftlosangeles1", Type: "edgeZone"}, extendedLocation)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	_, err = getExtendedLocationFromIMDS(context.Background(), server.URL)
+	assert.Error(t, err)
+}
+
+func TestGetNodeEdgeZone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"name":"microsoftlosangeles1","type":"edgeZone"}`))
+	}))
+	defer server.Close()
+	defer func(url string) { imdsExtendedLocationURL = url }(imdsExtendedLocationURL)
+	imdsExtendedLocationURL = server.URL
+
+	d := &DriverCore{}
+	assert.Equal(t, "", d.getNodeEdgeZone(context.Background()))
+
+	d.cloud = &azure.Cloud{}
+	assert.Equal(t, "", d.getNodeEdgeZone(context.Background()), "IMDS should not be called if the instance metadata is not used")
+
+	d.cloud.UseInstanceMetadata = true
+	assert.Equal(t, "microsoftlosangeles1", d.getNodeEdgeZone(context.Background()))
+
+	// the extended location in the cloud config takes precedence
+	d.cloud.ExtendedLocationName = "microsoftdallas1"
+	d.cloud.ExtendedLocationType = "EdgeZone"
+	assert.Equal(t, "microsoftdallas1", d.getNodeEdgeZone(context.Background()))
+
+	d.cloud.ExtendedLocationType = "CustomLocation"
+	assert.Equal(t, "", d.getNodeEdgeZone(context.Background()))
+}
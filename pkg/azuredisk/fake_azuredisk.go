@@ -119,6 +119,8 @@ func newFakeDriverV1(ctrl *gomock.Controller) (*fakeDriverV1, error) {
 	driver.shouldWaitForSnapshotReady = true
 	driver.endpoint = "tcp://127.0.0.1:0"
 	driver.disableAVSetNodes = true
+	driver.fsckTimeoutInSeconds = 600
+	driver.scsiPR = newFakeSCSIPersistentReservation()
 	driver.kubeClient = fake.NewSimpleClientset()
 
 	driver.cloud = azure.GetTestCloud(ctrl)
@@ -169,9 +171,6 @@ func (d *fakeDriverV1) setNextCommandOutputScripts(scripts ...testingexec.FakeAc
 func (d *fakeDriverV1) setThrottlingCache(key string, value string) {
 	d.throttlingCache.Set(key, value)
 }
-func (d *fakeDriverV1) getClientFactory() azclient.ClientFactory {
-	return d.clientFactory
-}
 
 func createVolumeCapabilities(accessMode csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability {
 	return []*csi.VolumeCapability{
@@ -30,7 +30,6 @@ import (
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization/mockoptimization"
 	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
-	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
@@ -106,9 +105,6 @@ func newFakeDriverV2(ctrl *gomock.Controller) (*fakeDriverV2, error) {
 func (d *fakeDriverV2) setNextCommandOutputScripts(scripts ...testingexec.FakeAction) {
 	d.mounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(scripts...)
 }
-func (d *fakeDriverV2) getClientFactory() azclient.ClientFactory {
-	return d.clientFactory
-}
 
 func (d *DriverV2) setThrottlingCache(key string, value string) {
 }
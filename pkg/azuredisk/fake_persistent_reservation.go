@@ -0,0 +1,133 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// fakeSCSIDevice is the persistent reservation state of a fake device
+type fakeSCSIDevice struct {
+	keys        map[uint64]bool
+	reservation *scsiReservation
+}
+
+// fakeSCSIPersistentReservation simulates the persistent reservation semantics of SPC-3 on in-memory devices
+type fakeSCSIPersistentReservation struct {
+	mutex   sync.Mutex
+	devices map[string]*fakeSCSIDevice
+}
+
+func newFakeSCSIPersistentReservation() *fakeSCSIPersistentReservation {
+	return &fakeSCSIPersistentReservation{devices: map[string]*fakeSCSIDevice{}}
+}
+
+func (f *fakeSCSIPersistentReservation) getDevice(device string) *fakeSCSIDevice {
+	dev, ok := f.devices[device]
+	if !ok {
+		dev = &fakeSCSIDevice{keys: map[uint64]bool{}}
+		f.devices[device] = dev
+	}
+	return dev
+}
+
+func (f *fakeSCSIPersistentReservation) Register(device string, key uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.getDevice(device).keys[key] = true
+	return nil
+}
+
+func (f *fakeSCSIPersistentReservation) Unregister(device string, key uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dev := f.getDevice(device)
+	if !dev.keys[key] {
+		return errReservationConflict
+	}
+	delete(dev.keys, key)
+	if dev.reservation != nil {
+		if dev.reservation.prType == prTypeWriteExclusiveAllRegistrants {
+			if len(dev.keys) == 0 {
+				dev.reservation = nil
+			}
+		} else if dev.reservation.key == key {
+			dev.reservation = nil
+		}
+	}
+	return nil
+}
+
+func (f *fakeSCSIPersistentReservation) Reserve(device string, key uint64, prType uint8) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dev := f.getDevice(device)
+	if !dev.keys[key] {
+		return errReservationConflict
+	}
+	if dev.reservation != nil {
+		if dev.reservation.prType != prType || (prType != prTypeWriteExclusiveAllRegistrants && dev.reservation.key != key) {
+			return errReservationConflict
+		}
+		return nil
+	}
+	dev.reservation = &scsiReservation{key: key, prType: prType}
+	if prType == prTypeWriteExclusiveAllRegistrants {
+		dev.reservation.key = 0
+	}
+	return nil
+}
+
+func (f *fakeSCSIPersistentReservation) PreemptAndAbort(device string, key, victimKey uint64, prType uint8) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	dev := f.getDevice(device)
+	if !dev.keys[key] {
+		return errReservationConflict
+	}
+	if !dev.keys[victimKey] {
+		return fmt.Errorf("key %#x is not registered on %s", victimKey, device)
+	}
+	delete(dev.keys, victimKey)
+	if dev.reservation != nil && dev.reservation.prType != prTypeWriteExclusiveAllRegistrants && dev.reservation.key == victimKey {
+		dev.reservation = &scsiReservation{key: key, prType: prType}
+	}
+	return nil
+}
+
+func (f *fakeSCSIPersistentReservation) ReadKeys(device string) ([]uint64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	keys := []uint64{}
+	for key := range f.getDevice(device).keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
+
+func (f *fakeSCSIPersistentReservation) ReadReservation(device string) (*scsiReservation, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if reservation := f.getDevice(device).reservation; reservation != nil {
+		r := *reservation
+		return &r, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+const (
+	fsckResultClean     = "clean"
+	fsckResultRepaired  = "repaired"
+	fsckResultCorrupted = "corrupted"
+	fsckResultFailed    = "failed"
+	fsckResultSkipped   = "skipped"
+
+	// only the tail of the checker output is kept in node events
+	maxFsckEventOutputLength = 1024
+)
+
+var (
+	registerFsckMetricsOnce sync.Once
+
+	fsckResultCount = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_fsck_total",
+			Help:           "Number of file system checks before mounting volumes by file system type, fsck policy and result",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"fstype", "policy", "result"},
+	)
+)
+
+// checkFilesystem runs the file system checker on the existing file system of source according to policy before it's mounted,
+// the outcome is recorded as a node event and a metric. With repair policy, a file system that could not be checked or repaired
+// is never mounted.
+func (d *DriverCore) checkFilesystem(ctx context.Context, volumeID, source, policy string) error {
+	fstype, err := getFsckDiskFormat(source, d.mounter)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get disk format of %s: %v", source, err)
+	}
+	if fstype == "" {
+		// blank device would be formatted later
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(d.fsckTimeoutInSeconds)*time.Second)
+	defer cancel()
+	klog.V(2).Infof("checkFilesystem: checking %s file system on %s of volume %s with policy %s", fstype, source, volumeID, policy)
+	result, output, err := runFsck(ctx, source, fstype, policy, d.mounter)
+	if err != nil {
+		output = fmt.Sprintf("%v, output: %s", err, output)
+	}
+	d.recordFsckResult(volumeID, source, fstype, policy, result, output)
+
+	if policy == consts.FsckPolicyRepair {
+		switch result {
+		case fsckResultCorrupted:
+			return status.Errorf(codes.FailedPrecondition, "%s file system on %s of volume %s is corrupted and could not be repaired: %s", fstype, source, volumeID, output)
+		case fsckResultFailed:
+			return status.Errorf(codes.Internal, "failed to repair %s file system on %s of volume %s: %s", fstype, source, volumeID, output)
+		}
+	}
+	return nil
+}
+
+// recordFsckResult records the outcome of a file system check as a metric and a node event
+func (d *DriverCore) recordFsckResult(volumeID, source, fstype, policy, result, output string) {
+	registerFsckMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(fsckResultCount)
+	})
+	fsckResultCount.WithLabelValues(fstype, policy, result).Inc()
+
+	if result == fsckResultSkipped {
+		klog.V(2).Infof("recordFsckResult: file system check of %s file system on %s is not supported", fstype, source)
+		return
+	}
+	eventType, reason := corev1.EventTypeNormal, "FsckClean"
+	switch result {
+	case fsckResultRepaired:
+		reason = "FsckRepaired"
+	case fsckResultCorrupted:
+		eventType, reason = corev1.EventTypeWarning, "FsckCorrupted"
+	case fsckResultFailed:
+		eventType, reason = corev1.EventTypeWarning, "FsckFailed"
+	}
+	if len(output) > maxFsckEventOutputLength {
+		output = "..." + output[len(output)-maxFsckEventOutputLength:]
+	}
+	message := fmt.Sprintf("fsck(%s) of %s file system on %s of volume %s: %s", policy, fstype, source, volumeID, result)
+	if result != fsckResultClean && output != "" {
+		message = fmt.Sprintf("%s, output: %s", message, output)
+	}
+	if eventType == corev1.EventTypeWarning {
+		klog.Warning(message)
+	} else {
+		klog.V(2).Info(message)
+	}
+
+	if d.eventRecorder != nil {
+		nodeRef := &corev1.ObjectReference{Kind: "Node", Name: d.NodeID, UID: types.UID(d.NodeID)}
+		d.eventRecorder.Event(nodeRef, eventType, reason, message)
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+const (
+	// e2fsck exit codes are bit flags
+	e2fsckErrorsCorrected       = 1
+	e2fsckErrorsCorrectedReboot = 2
+	e2fsckErrorsUncorrected     = 4
+	// xfs_repair exits with 1 in no-modify mode if corruption is detected
+	xfsRepairCorrupted = 1
+	// xfs_repair exits with 2 if the log is dirty and needs to be replayed by mounting the file system
+	xfsRepairDirtyLog = 2
+)
+
+// getFsckDiskFormat returns the file system type on source, return empty if the device is blank
+func getFsckDiskFormat(source string, m *mount.SafeFormatAndMount) (string, error) {
+	return m.GetDiskFormat(source)
+}
+
+// runFsck runs the file system checker of fstype on source, returns the result and the output of the checker
+func runFsck(ctx context.Context, source, fstype, policy string, m *mount.SafeFormatAndMount) (string, string, error) {
+	switch fstype {
+	case "ext2", "ext3", "ext4":
+		return runE2fsck(ctx, source, policy, m)
+	case "xfs":
+		return runXfsRepair(ctx, source, policy, m)
+	}
+	return fsckResultSkipped, "", nil
+}
+
+// runE2fsck checks an ext file system without any change with check policy, or repairs it automatically with repair policy
+func runE2fsck(ctx context.Context, source, policy string, m *mount.SafeFormatAndMount) (string, string, error) {
+	args := []string{"-n", source}
+	if policy == consts.FsckPolicyRepair {
+		args = []string{"-p", source}
+	}
+	code, output, err := runChecker(ctx, m, "e2fsck", args...)
+	if err != nil {
+		return fsckResultFailed, output, err
+	}
+	switch {
+	case code == 0:
+		return fsckResultClean, output, nil
+	case code&e2fsckErrorsUncorrected != 0:
+		return fsckResultCorrupted, output, nil
+	case code&^(e2fsckErrorsCorrected|e2fsckErrorsCorrectedReboot) != 0:
+		return fsckResultFailed, output, fmt.Errorf("e2fsck exited with code %d", code)
+	}
+	return fsckResultRepaired, output, nil
+}
+
+// runXfsRepair checks an xfs file system in no-modify mode, with repair policy a corrupted file system is repaired,
+// and the log is zeroed only if xfs_repair refuses to repair the file system because of the dirty log
+func runXfsRepair(ctx context.Context, source, policy string, m *mount.SafeFormatAndMount) (string, string, error) {
+	code, output, err := runChecker(ctx, m, "xfs_repair", "-n", source)
+	if err != nil {
+		return fsckResultFailed, output, err
+	}
+	switch code {
+	case 0:
+		return fsckResultClean, output, nil
+	case xfsRepairDirtyLog:
+		// the log would be replayed by mounting the file system
+		klog.V(2).Infof("runXfsRepair: log of xfs file system on %s is dirty, leave it to mount", source)
+		return fsckResultClean, output, nil
+	case xfsRepairCorrupted:
+		if policy != consts.FsckPolicyRepair {
+			return fsckResultCorrupted, output, nil
+		}
+	default:
+		return fsckResultFailed, output, fmt.Errorf("xfs_repair exited with code %d", code)
+	}
+
+	code, output, err = runChecker(ctx, m, "xfs_repair", source)
+	if err != nil {
+		return fsckResultFailed, output, err
+	}
+	if code == xfsRepairDirtyLog {
+		klog.Warningf("runXfsRepair: zeroing the dirty log of corrupted xfs file system on %s", source)
+		if code, output, err = runChecker(ctx, m, "xfs_repair", "-L", source); err != nil {
+			return fsckResultFailed, output, err
+		}
+	}
+	if code != 0 {
+		return fsckResultCorrupted, output, nil
+	}
+	return fsckResultRepaired, output, nil
+}
+
+// runChecker runs a file system checker and returns its exit code, an error is returned only if the checker could not run to completion
+func runChecker(ctx context.Context, m *mount.SafeFormatAndMount, cmd string, args ...string) (int, string, error) {
+	output, err := m.Exec.CommandContext(ctx, cmd, args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return 0, string(output), fmt.Errorf("%s %v did not complete: %v", cmd, args, ctx.Err())
+	}
+	if err != nil {
+		if ee, ok := err.(utilexec.ExitError); ok {
+			return ee.ExitStatus(), string(output), nil
+		}
+		return 0, string(output), fmt.Errorf("failed to run %s %v: %v", cmd, args, err)
+	}
+	return 0, string(output), nil
+}
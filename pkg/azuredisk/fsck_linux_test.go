@@ -0,0 +1,220 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+	testingexec "k8s.io/utils/exec/testing"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func fsckExitAction(code int) testingexec.FakeAction {
+	return func() ([]byte, []byte, error) {
+		if code == 0 {
+			return []byte{}, []byte{}, nil
+		}
+		return []byte("fsck output"), []byte{}, &testingexec.FakeExitError{Status: code}
+	}
+}
+
+func TestRunFsck(t *testing.T) {
+	tests := []struct {
+		desc           string
+		fstype         string
+		policy         string
+		outputScripts  []testingexec.FakeAction
+		expectedResult string
+		expectedErr    bool
+	}{
+		{
+			desc:           "clean ext4 file system",
+			fstype:         "ext4",
+			policy:         consts.FsckPolicyCheck,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(0)},
+			expectedResult: fsckResultClean,
+		},
+		{
+			desc:           "ext4 file system repaired",
+			fstype:         "ext4",
+			policy:         consts.FsckPolicyRepair,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(1)},
+			expectedResult: fsckResultRepaired,
+		},
+		{
+			desc:           "corrupted ext4 file system",
+			fstype:         "ext4",
+			policy:         consts.FsckPolicyCheck,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(4)},
+			expectedResult: fsckResultCorrupted,
+		},
+		{
+			desc:           "e2fsck operational error",
+			fstype:         "ext3",
+			policy:         consts.FsckPolicyRepair,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(8)},
+			expectedResult: fsckResultFailed,
+			expectedErr:    true,
+		},
+		{
+			desc:           "clean xfs file system",
+			fstype:         "xfs",
+			policy:         consts.FsckPolicyRepair,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(0)},
+			expectedResult: fsckResultClean,
+		},
+		{
+			desc:           "xfs file system with dirty log",
+			fstype:         "xfs",
+			policy:         consts.FsckPolicyRepair,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(2)},
+			expectedResult: fsckResultClean,
+		},
+		{
+			desc:           "corrupted xfs file system with check policy",
+			fstype:         "xfs",
+			policy:         consts.FsckPolicyCheck,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(1)},
+			expectedResult: fsckResultCorrupted,
+		},
+		{
+			desc:           "corrupted xfs file system repaired",
+			fstype:         "xfs",
+			policy:         consts.FsckPolicyRepair,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(1), fsckExitAction(0)},
+			expectedResult: fsckResultRepaired,
+		},
+		{
+			desc:           "corrupted xfs file system with dirty log repaired after zeroing the log",
+			fstype:         "xfs",
+			policy:         consts.FsckPolicyRepair,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(1), fsckExitAction(2), fsckExitAction(0)},
+			expectedResult: fsckResultRepaired,
+		},
+		{
+			desc:           "corrupted xfs file system could not be repaired",
+			fstype:         "xfs",
+			policy:         consts.FsckPolicyRepair,
+			outputScripts:  []testingexec.FakeAction{fsckExitAction(1), fsckExitAction(1)},
+			expectedResult: fsckResultCorrupted,
+		},
+		{
+			desc:           "unsupported file system",
+			fstype:         "btrfs",
+			policy:         consts.FsckPolicyCheck,
+			expectedResult: fsckResultSkipped,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+
+		result, _, err := runFsck(context.Background(), "/dev/sdd", test.fstype, test.policy, fakeMounter)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		assert.Equal(t, test.expectedResult, result, test.desc)
+	}
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	blkidNoFormatAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 2}
+	}
+	blkidExt4Action := func() ([]byte, []byte, error) {
+		return []byte("DEVICE=/dev/sdd\nTYPE=ext4"), []byte{}, nil
+	}
+
+	tests := []struct {
+		desc          string
+		policy        string
+		outputScripts []testingexec.FakeAction
+		expectedEvent string
+		expectedCode  codes.Code
+	}{
+		{
+			desc:          "blank device is not checked",
+			policy:        consts.FsckPolicyRepair,
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction},
+			expectedCode:  codes.OK,
+		},
+		{
+			desc:          "clean file system",
+			policy:        consts.FsckPolicyCheck,
+			outputScripts: []testingexec.FakeAction{blkidExt4Action, fsckExitAction(0)},
+			expectedEvent: "Normal FsckClean",
+			expectedCode:  codes.OK,
+		},
+		{
+			desc:          "corrupted file system is mounted with check policy",
+			policy:        consts.FsckPolicyCheck,
+			outputScripts: []testingexec.FakeAction{blkidExt4Action, fsckExitAction(4)},
+			expectedEvent: "Warning FsckCorrupted",
+			expectedCode:  codes.OK,
+		},
+		{
+			desc:          "repaired file system",
+			policy:        consts.FsckPolicyRepair,
+			outputScripts: []testingexec.FakeAction{blkidExt4Action, fsckExitAction(1)},
+			expectedEvent: "Normal FsckRepaired",
+			expectedCode:  codes.OK,
+		},
+		{
+			desc:          "corrupted file system is not mounted with repair policy",
+			policy:        consts.FsckPolicyRepair,
+			outputScripts: []testingexec.FakeAction{blkidExt4Action, fsckExitAction(4)},
+			expectedEvent: "Warning FsckCorrupted",
+			expectedCode:  codes.FailedPrecondition,
+		},
+		{
+			desc:          "failed check is not mounted with repair policy",
+			policy:        consts.FsckPolicyRepair,
+			outputScripts: []testingexec.FakeAction{blkidExt4Action, fsckExitAction(8)},
+			expectedEvent: "Warning FsckFailed",
+			expectedCode:  codes.Internal,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+		recorder := record.NewFakeRecorder(1)
+		d := &DriverCore{mounter: fakeMounter, fsckTimeoutInSeconds: 600, eventRecorder: recorder}
+		d.NodeID = "node"
+
+		err = d.checkFilesystem(context.Background(), "vol_1", "/dev/sdd", test.policy)
+		assert.Equal(t, test.expectedCode, status.Code(err), "desc: %s, err: %v", test.desc, err)
+		select {
+		case event := <-recorder.Events:
+			assert.True(t, strings.HasPrefix(event, test.expectedEvent+" "), "desc: %s, event: %s", test.desc, event)
+		default:
+			assert.Empty(t, test.expectedEvent, test.desc)
+		}
+	}
+}
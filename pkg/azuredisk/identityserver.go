@@ -43,12 +43,10 @@ func (f *Driver) GetPluginInfo(_ context.Context, _ *csi.GetPluginInfoRequest) (
 	}, nil
 }
 
-// Probe check whether the plugin is running or not.
-// This method does not need to return anything.
-// Currently the spec does not dictate what you should return either.
-// Hence, return an empty response
-func (f *Driver) Probe(_ context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+// Probe check whether the plugin is alive, it's called by the liveness probe.
+// Only the local liveness checks are run, see readiness.go, so that an outage of ARM does not restart the plugin.
+func (f *Driver) Probe(ctx context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: f.getReadinessChecker().ready(ctx, true)}}, nil
 }
 
 // GetPluginCapabilities returns the capabilities of the plugin
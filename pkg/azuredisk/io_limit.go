@@ -0,0 +1,148 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+)
+
+// podUIDInTargetPathRE matches the pod UID in a publish target path, e.g.
+// /var/lib/kubelet/pods/<pod uid>/volumes/kubernetes.io~csi/<pv>/mount or
+// /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/<pv>/<pod uid>
+var podUIDInTargetPathRE = regexp.MustCompile(`/(?:pods|publish/[^/]+)/([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})(?:/|$)`)
+
+// podIOLimits is the I/O limits of a volume in a pod, 0 means unlimited
+type podIOLimits struct {
+	iops   int
+	bwMbps int
+}
+
+// getPodUIDFromTargetPath returns the UID of the pod consuming a publish target path, return empty if it's not found
+func getPodUIDFromTargetPath(target string) string {
+	if matches := podUIDInTargetPathRE.FindStringSubmatch(target); len(matches) == 2 {
+		return matches[1]
+	}
+	return ""
+}
+
+// getPodIOLimits returns the pod I/O limits in volume attributes, nil is returned if no limit is set.
+// A limit that is not set or set to auto defaults to the provisioned performance of the disk SKU.
+func getPodIOLimits(attributes map[string]string) (*podIOLimits, error) {
+	var iopsLimit, mbpsLimit, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string
+	for k, v := range attributes {
+		switch strings.ToLower(k) {
+		case consts.PodIOPSLimitField:
+			iopsLimit = v
+		case consts.PodMBpsLimitField:
+			mbpsLimit = v
+		case consts.SkuNameField, consts.StorageAccountTypeField:
+			accountType = v
+		case consts.RequestedSizeGib:
+			diskSizeGibStr = v
+		case consts.DiskIOPSReadWriteField:
+			diskIopsStr = v
+		case consts.DiskMBPSReadWriteField:
+			diskBwMbpsStr = v
+		}
+	}
+	if iopsLimit == "" && mbpsLimit == "" {
+		return nil, nil
+	}
+
+	limits := &podIOLimits{}
+	if iopsLimit != "" {
+		if err := azureutils.ValidatePodIOLimit(consts.PodIOPSLimitField, iopsLimit); err != nil {
+			return nil, err
+		}
+		limits.iops, _ = strconv.Atoi(iopsLimit)
+	}
+	if mbpsLimit != "" {
+		if err := azureutils.ValidatePodIOLimit(consts.PodMBpsLimitField, mbpsLimit); err != nil {
+			return nil, err
+		}
+		limits.bwMbps, _ = strconv.Atoi(mbpsLimit)
+	}
+	if limits.iops > 0 && limits.bwMbps > 0 {
+		return limits, nil
+	}
+
+	iops, bwMbps, err := optimization.GetProvisionedDiskPerf(accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+	if err != nil {
+		if strings.EqualFold(iopsLimit, consts.PodIOLimitAuto) || strings.EqualFold(mbpsLimit, consts.PodIOLimitAuto) {
+			return nil, fmt.Errorf("failed to get provisioned performance of %s disk with size %sGiB: %v", accountType, diskSizeGibStr, err)
+		}
+		klog.Warningf("getPodIOLimits: failed to get provisioned performance of %s disk with size %sGiB, the unset limit is left unlimited: %v", accountType, diskSizeGibStr, err)
+		return limits, nil
+	}
+	if limits.iops == 0 {
+		limits.iops = iops
+	}
+	if limits.bwMbps == 0 {
+		limits.bwMbps = bwMbps
+	}
+	return limits, nil
+}
+
+// applyPodIOLimits limits the I/O of the pod consuming target on the device behind source,
+// source is the block device of a block volume or the staging path of a mounted volume
+func (d *DriverCore) applyPodIOLimits(volumeID, source, target string, attributes map[string]string) error {
+	limits, err := getPodIOLimits(attributes)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if limits == nil {
+		return nil
+	}
+	podUID := getPodUIDFromTargetPath(target)
+	if podUID == "" {
+		klog.Warningf("applyPodIOLimits: could not find pod UID in target path %s, skip limiting I/O of volume %s", target, volumeID)
+		return nil
+	}
+
+	var nodeLimits *podIOLimits
+	if d.enforceNodeIOLimit && d.getNodeInfo() != nil {
+		nodeLimits = &podIOLimits{iops: d.getNodeInfo().MaxIops, bwMbps: d.getNodeInfo().MaxBwMbps}
+	}
+	if err := setPodIOMax(podUID, source, limits, nodeLimits); err != nil {
+		return err
+	}
+	klog.V(2).Infof("applyPodIOLimits: limited I/O of volume %s in pod %s to %d IOPS and %d MBps", volumeID, podUID, limits.iops, limits.bwMbps)
+	return nil
+}
+
+// removePodIOLimits removes the I/O limits of the pod consuming target, it's a no-op if no limit was applied
+func (d *DriverCore) removePodIOLimits(volumeID, target string) error {
+	podUID := getPodUIDFromTargetPath(target)
+	if podUID == "" {
+		return nil
+	}
+	if err := clearPodIOMax(podUID, target); err != nil {
+		return fmt.Errorf("failed to remove I/O limits of volume %s in pod %s: %v", volumeID, podUID, err)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ioMaxFile = "io.max"
+)
+
+var (
+	cgroupRootPath = "/sys/fs/cgroup"
+
+	// ioLimitMutex serializes the changes on io.max, so that the sum of limits on the node is consistent
+	ioLimitMutex = &sync.Mutex{}
+
+	// podCgroupNameRE matches the pod level cgroup created by kubelet with systemd or cgroupfs cgroup driver
+	podCgroupNameRE = regexp.MustCompile(`^(kubepods-(burstable-|besteffort-)?)?pod[0-9a-fA-F_-]+(\.slice)?$`)
+)
+
+// findPodCgroupPath returns the cgroup v2 path of a pod, return empty if it's not found
+func findPodCgroupPath(podUID string) string {
+	escapedUID := strings.ReplaceAll(podUID, "-", "_")
+	candidates := []string{
+		// systemd cgroup driver
+		filepath.Join("kubepods.slice", "kubepods-pod"+escapedUID+".slice"),
+		filepath.Join("kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-pod"+escapedUID+".slice"),
+		filepath.Join("kubepods.slice", "kubepods-besteffort.slice", "kubepods-besteffort-pod"+escapedUID+".slice"),
+		// cgroupfs cgroup driver
+		filepath.Join("kubepods", "pod"+podUID),
+		filepath.Join("kubepods", "burstable", "pod"+podUID),
+		filepath.Join("kubepods", "besteffort", "pod"+podUID),
+	}
+	for _, candidate := range candidates {
+		path := filepath.Join(cgroupRootPath, candidate)
+		if _, err := os.Stat(filepath.Join(path, ioMaxFile)); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// getDeviceNumber returns the major:minor of a block device, or of the device mounted on path
+func getDeviceNumber(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+	}
+	mountInfo, err := findMountInfo(path)
+	if err != nil {
+		return "", err
+	}
+	if mountInfo == nil {
+		return "", fmt.Errorf("%s is not mounted", path)
+	}
+	return fmt.Sprintf("%d:%d", mountInfo.Major, mountInfo.Minor), nil
+}
+
+// formatIOMax returns the io.max entry of limits on device, 0 means unlimited
+func formatIOMax(device string, limits *podIOLimits) string {
+	iops, bps := "max", "max"
+	if limits.iops > 0 {
+		iops = strconv.Itoa(limits.iops)
+	}
+	if limits.bwMbps > 0 {
+		bps = strconv.FormatInt(int64(limits.bwMbps)*bytesPerMB, 10)
+	}
+	return fmt.Sprintf("%s rbps=%s wbps=%s riops=%s wiops=%s", device, bps, bps, iops, iops)
+}
+
+// parseIOMax parses the content of io.max, e.g. "8:16 rbps=2097152 wbps=max riops=max wiops=120",
+// the read limits are returned for each device since the driver always sets the same read and write limits
+func parseIOMax(content string) map[string]podIOLimits {
+	entries := map[string]podIOLimits{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		limits := podIOLimits{}
+		for _, field := range fields[1:] {
+			key, value, found := strings.Cut(field, "=")
+			if !found || value == "max" {
+				continue
+			}
+			number, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "riops":
+				limits.iops = int(number)
+			case "rbps":
+				limits.bwMbps = int(number / bytesPerMB)
+			}
+		}
+		entries[fields[0]] = limits
+	}
+	return entries
+}
+
+// getNodeIOMaxSum returns the sum of the I/O limits of all pods on the node, the entry of device in excludedCgroup is excluded
+func getNodeIOMaxSum(excludedCgroup, device string) (podIOLimits, error) {
+	sum := podIOLimits{}
+	for _, root := range []string{"kubepods.slice", "kubepods"} {
+		err := filepath.WalkDir(filepath.Join(cgroupRootPath, root), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !entry.IsDir() || !podCgroupNameRE.MatchString(entry.Name()) {
+				return nil
+			}
+			content, err := os.ReadFile(filepath.Join(path, ioMaxFile))
+			if err != nil {
+				klog.V(4).Infof("getNodeIOMaxSum: failed to read %s of %s: %v", ioMaxFile, path, err)
+				return filepath.SkipDir
+			}
+			for entryDevice, limits := range parseIOMax(string(content)) {
+				if path == excludedCgroup && entryDevice == device {
+					continue
+				}
+				sum.iops += limits.iops
+				sum.bwMbps += limits.bwMbps
+			}
+			// container cgroups below the pod cgroup are not counted
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return sum, err
+		}
+	}
+	return sum, nil
+}
+
+// setPodIOMax writes the io.max entry of the device behind source in the cgroup of a pod,
+// the limits are rejected if the sum of limits on the node would exceed nodeLimits
+func setPodIOMax(podUID, source string, limits, nodeLimits *podIOLimits) error {
+	podCgroup := findPodCgroupPath(podUID)
+	if podCgroup == "" {
+		return status.Errorf(codes.Internal, "cgroup v2 of pod %s is not found under %s", podUID, cgroupRootPath)
+	}
+	device, err := getDeviceNumber(source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get device number of %s: %v", source, err)
+	}
+
+	ioLimitMutex.Lock()
+	defer ioLimitMutex.Unlock()
+	if nodeLimits != nil {
+		sum, err := getNodeIOMaxSum(podCgroup, device)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to get the sum of pod I/O limits on the node: %v", err)
+		}
+		if nodeLimits.iops > 0 && sum.iops+limits.iops > nodeLimits.iops {
+			return status.Errorf(codes.ResourceExhausted, "IOPS limit %d exceeds the remaining IOPS %d of the node", limits.iops, nodeLimits.iops-sum.iops)
+		}
+		if nodeLimits.bwMbps > 0 && sum.bwMbps+limits.bwMbps > nodeLimits.bwMbps {
+			return status.Errorf(codes.ResourceExhausted, "bandwidth limit %d MBps exceeds the remaining bandwidth %d MBps of the node", limits.bwMbps, nodeLimits.bwMbps-sum.bwMbps)
+		}
+	}
+
+	ioMax := formatIOMax(device, limits)
+	klog.V(4).Infof("setPodIOMax: writing %q to %s", ioMax, filepath.Join(podCgroup, ioMaxFile))
+	if err := os.WriteFile(filepath.Join(podCgroup, ioMaxFile), []byte(ioMax), 0644); err != nil {
+		return status.Errorf(codes.Internal, "failed to set %s of pod %s: %v", ioMaxFile, podUID, err)
+	}
+	return nil
+}
+
+// clearPodIOMax removes the io.max entry of the device behind target in the cgroup of a pod
+func clearPodIOMax(podUID, target string) error {
+	podCgroup := findPodCgroupPath(podUID)
+	if podCgroup == "" {
+		return nil
+	}
+	device, err := getDeviceNumber(target)
+	if err != nil {
+		klog.V(4).Infof("clearPodIOMax: failed to get device number of %s: %v", target, err)
+		return nil
+	}
+
+	ioLimitMutex.Lock()
+	defer ioLimitMutex.Unlock()
+	content, err := os.ReadFile(filepath.Join(podCgroup, ioMaxFile))
+	if err != nil {
+		return err
+	}
+	if _, ok := parseIOMax(string(content))[device]; !ok {
+		return nil
+	}
+	// the entry is removed by the kernel once all limits are max
+	return os.WriteFile(filepath.Join(podCgroup, ioMaxFile), []byte(formatIOMax(device, &podIOLimits{})), 0644)
+}
@@ -0,0 +1,121 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testPodUID      = "8e2a1b7c-3f4d-4e5a-9b6c-7d8e9f0a1b2c"
+	testOtherPodUID = "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d"
+)
+
+// setupFakeCgroupFiles creates a fake cgroup v2 hierarchy with the systemd cgroup driver and a volume mounted on 8:16,
+// the staging path of the volume is returned
+func setupFakeCgroupFiles(t *testing.T) string {
+	root := t.TempDir()
+	origin := map[*string]string{
+		&cgroupRootPath:    cgroupRootPath,
+		&procMountInfoPath: procMountInfoPath,
+	}
+	t.Cleanup(func() {
+		for p, v := range origin {
+			*p = v
+		}
+	})
+	cgroupRootPath = filepath.Join(root, "cgroup")
+	procMountInfoPath = filepath.Join(root, "mountinfo")
+
+	for _, podCgroup := range []string{
+		filepath.Join("kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-pod8e2a1b7c_3f4d_4e5a_9b6c_7d8e9f0a1b2c.slice"),
+		filepath.Join("kubepods.slice", "kubepods-pod1a2b3c4d_5e6f_4a7b_8c9d_0e1f2a3b4c5d.slice"),
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(cgroupRootPath, podCgroup), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(cgroupRootPath, podCgroup, ioMaxFile), []byte{}, 0644))
+	}
+
+	stagingPath := filepath.Join(root, "staging")
+	assert.NoError(t, os.MkdirAll(stagingPath, 0755))
+	assert.NoError(t, os.WriteFile(procMountInfoPath,
+		[]byte("100 1 8:16 / "+stagingPath+" rw,relatime shared:1 - ext4 /dev/sdb rw\n"), 0644))
+	return stagingPath
+}
+
+func TestFindPodCgroupPath(t *testing.T) {
+	setupFakeCgroupFiles(t)
+	assert.Equal(t, filepath.Join(cgroupRootPath, "kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-pod8e2a1b7c_3f4d_4e5a_9b6c_7d8e9f0a1b2c.slice"), findPodCgroupPath(testPodUID))
+	assert.Equal(t, filepath.Join(cgroupRootPath, "kubepods.slice", "kubepods-pod1a2b3c4d_5e6f_4a7b_8c9d_0e1f2a3b4c5d.slice"), findPodCgroupPath(testOtherPodUID))
+	assert.Equal(t, "", findPodCgroupPath("00000000-0000-0000-0000-000000000000"))
+}
+
+func TestFormatAndParseIOMax(t *testing.T) {
+	assert.Equal(t, "8:16 rbps=100000000 wbps=100000000 riops=500 wiops=500", formatIOMax("8:16", &podIOLimits{iops: 500, bwMbps: 100}))
+	assert.Equal(t, "8:16 rbps=max wbps=max riops=max wiops=max", formatIOMax("8:16", &podIOLimits{}))
+
+	entries := parseIOMax("8:16 rbps=100000000 wbps=100000000 riops=500 wiops=500\n8:32 rbps=max wbps=max riops=120 wiops=120\n")
+	assert.Equal(t, map[string]podIOLimits{"8:16": {iops: 500, bwMbps: 100}, "8:32": {iops: 120}}, entries)
+	assert.Empty(t, parseIOMax(""))
+}
+
+func TestSetAndClearPodIOMax(t *testing.T) {
+	stagingPath := setupFakeCgroupFiles(t)
+	ioMaxPath := filepath.Join(findPodCgroupPath(testPodUID), ioMaxFile)
+
+	assert.NoError(t, setPodIOMax(testPodUID, stagingPath, &podIOLimits{iops: 500, bwMbps: 100}, nil))
+	content, err := os.ReadFile(ioMaxPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "8:16 rbps=100000000 wbps=100000000 riops=500 wiops=500", string(content))
+
+	assert.NoError(t, clearPodIOMax(testPodUID, stagingPath))
+	content, err = os.ReadFile(ioMaxPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "8:16 rbps=max wbps=max riops=max wiops=max", string(content))
+
+	// pod cgroup is gone
+	assert.NoError(t, clearPodIOMax("00000000-0000-0000-0000-000000000000", stagingPath))
+	err = setPodIOMax("00000000-0000-0000-0000-000000000000", stagingPath, &podIOLimits{iops: 500}, nil)
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestSetPodIOMaxWithNodeLimits(t *testing.T) {
+	stagingPath := setupFakeCgroupFiles(t)
+	otherPodIOMax := filepath.Join(findPodCgroupPath(testOtherPodUID), ioMaxFile)
+	assert.NoError(t, os.WriteFile(otherPodIOMax, []byte("8:32 rbps=200000000 wbps=200000000 riops=3000 wiops=3000\n"), 0644))
+
+	sum, err := getNodeIOMaxSum("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, podIOLimits{iops: 3000, bwMbps: 200}, sum)
+
+	err = setPodIOMax(testPodUID, stagingPath, &podIOLimits{iops: 2000, bwMbps: 100}, &podIOLimits{iops: 4000, bwMbps: 1000})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	err = setPodIOMax(testPodUID, stagingPath, &podIOLimits{iops: 500, bwMbps: 900}, &podIOLimits{iops: 4000, bwMbps: 1000})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.NoError(t, setPodIOMax(testPodUID, stagingPath, &podIOLimits{iops: 1000, bwMbps: 800}, &podIOLimits{iops: 4000, bwMbps: 1000}))
+
+	// re-applying the same limits of the volume does not count the existing entry
+	assert.NoError(t, setPodIOMax(testPodUID, stagingPath, &podIOLimits{iops: 1000, bwMbps: 800}, &podIOLimits{iops: 4000, bwMbps: 1000}))
+}
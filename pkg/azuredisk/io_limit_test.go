@@ -0,0 +1,117 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+func TestGetPodUIDFromTargetPath(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected string
+	}{
+		{
+			target:   "/var/lib/kubelet/pods/8e2a1b7c-3f4d-4e5a-9b6c-7d8e9f0a1b2c/volumes/kubernetes.io~csi/pvc-xxx/mount",
+			expected: "8e2a1b7c-3f4d-4e5a-9b6c-7d8e9f0a1b2c",
+		},
+		{
+			target:   "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-xxx/8e2a1b7c-3f4d-4e5a-9b6c-7d8e9f0a1b2c",
+			expected: "8e2a1b7c-3f4d-4e5a-9b6c-7d8e9f0a1b2c",
+		},
+		{
+			target:   "/tmp/target",
+			expected: "",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getPodUIDFromTargetPath(test.target), test.target)
+	}
+}
+
+func TestGetPodIOLimits(t *testing.T) {
+	tests := []struct {
+		desc        string
+		attributes  map[string]string
+		expected    *podIOLimits
+		expectedErr bool
+	}{
+		{
+			desc:       "no limit",
+			attributes: map[string]string{consts.SkuNameField: "Premium_LRS"},
+		},
+		{
+			desc:       "explicit limits",
+			attributes: map[string]string{"podIOPSLimit": "300", "podMBpsLimit": "50"},
+			expected:   &podIOLimits{iops: 300, bwMbps: 50},
+		},
+		{
+			desc:       "auto limits of P10 disk",
+			attributes: map[string]string{"podIOPSLimit": "auto", "podMBpsLimit": "auto", "skuName": "Premium_LRS", consts.RequestedSizeGib: "100"},
+			expected:   &podIOLimits{iops: 500, bwMbps: 100},
+		},
+		{
+			desc:       "bandwidth defaults to provisioned bandwidth",
+			attributes: map[string]string{"podIOPSLimit": "300", "skuName": "Premium_LRS", consts.RequestedSizeGib: "100"},
+			expected:   &podIOLimits{iops: 300, bwMbps: 100},
+		},
+		{
+			desc:       "auto limits of PremiumV2 disk",
+			attributes: map[string]string{"podIOPSLimit": "auto", "skuName": "PremiumV2_LRS", consts.RequestedSizeGib: "100", "diskIOPSReadWrite": "5000", "diskMBpsReadWrite": "300"},
+			expected:   &podIOLimits{iops: 5000, bwMbps: 300},
+		},
+		{
+			desc:       "unset limit is unlimited if provisioned performance is unknown",
+			attributes: map[string]string{"podIOPSLimit": "300", "skuName": "Unknown_LRS", consts.RequestedSizeGib: "100"},
+			expected:   &podIOLimits{iops: 300},
+		},
+		{
+			desc:        "auto limit fails if provisioned performance is unknown",
+			attributes:  map[string]string{"podIOPSLimit": "auto", "skuName": "Unknown_LRS", consts.RequestedSizeGib: "100"},
+			expectedErr: true,
+		},
+		{
+			desc:        "invalid limit",
+			attributes:  map[string]string{"podMBpsLimit": "-1"},
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		limits, err := getPodIOLimits(test.attributes)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		assert.Equal(t, test.expected, limits, test.desc)
+	}
+}
+
+func TestApplyPodIOLimits(t *testing.T) {
+	d := &DriverCore{}
+	// no limit
+	assert.NoError(t, d.applyPodIOLimits("vol_1", "/dev/sdb", "/var/lib/kubelet/pods/8e2a1b7c-3f4d-4e5a-9b6c-7d8e9f0a1b2c/volumes/kubernetes.io~csi/pvc-xxx/mount", nil))
+	// pod UID is not found in target path
+	assert.NoError(t, d.applyPodIOLimits("vol_1", "/dev/sdb", "/tmp/target", map[string]string{consts.PodIOPSLimitField: "300", consts.PodMBpsLimitField: "50"}))
+	// invalid limit
+	err := d.applyPodIOLimits("vol_1", "/dev/sdb", "/tmp/target", map[string]string{consts.PodIOPSLimitField: "0"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	// no-op if no limit was applied
+	assert.NoError(t, d.removePodIOLimits("vol_1", "/tmp/target"))
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+const (
+	// localCacheVolumeGroup is the LVM volume group created on the local cache device,
+	// every cached volume carves its cache slices from it
+	localCacheVolumeGroup = "azdisk-localcache"
+	localCacheNamePrefix  = "azcache-"
+	dmCacheDataLVSuffix   = "-cache"
+	dmCacheMetaLVSuffix   = "-meta"
+	bcacheLVSuffix        = "-bcache"
+)
+
+var (
+	// localCacheMutex serializes the changes on the local cache volume group
+	localCacheMutex = &sync.Mutex{}
+
+	registerLocalCacheCollectorOnce sync.Once
+
+	localCacheHitsDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_local_cache_hits_total",
+		"Number of reads served by the local cache of a volume", []string{"volume", "mode"}, nil, metrics.ALPHA, "")
+	localCacheMissesDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_local_cache_misses_total",
+		"Number of reads missed by the local cache of a volume", []string{"volume", "mode"}, nil, metrics.ALPHA, "")
+	localCacheUsageRatioDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_local_cache_usage_ratio",
+		"Ratio of the local cache slice of a volume in use", []string{"volume", "mode"}, nil, metrics.ALPHA, "")
+)
+
+// localCacheStats is the hit statistics of the local cache of a volume
+type localCacheStats struct {
+	// name is the local cache name of the volume, e.g. azcache-pvc-xxx
+	name       string
+	mode       string
+	hits       uint64
+	misses     uint64
+	usageRatio float64
+}
+
+// getLocalCacheName returns the local cache name of a volume, e.g. azcache-pvc-xxx,
+// it's the dm-cache mapping name and the prefix of the logical volumes carved from the local cache device
+func getLocalCacheName(volumeID string) string {
+	return getMapperName(localCacheNamePrefix, volumeID)
+}
+
+// getLocalCacheLVPath returns the device path of a logical volume in the local cache volume group
+func getLocalCacheLVPath(lvName string) string {
+	return filepath.Join("/dev", localCacheVolumeGroup, lvName)
+}
+
+// localCacheCollector exports the hit statistics of all local caches on the node
+type localCacheCollector struct {
+	metrics.BaseStableCollector
+
+	mounter *mount.SafeFormatAndMount
+}
+
+// registerLocalCacheCollector registers the local cache metrics collector in the legacy registry
+func registerLocalCacheCollector(m *mount.SafeFormatAndMount) {
+	registerLocalCacheCollectorOnce.Do(func() {
+		legacyregistry.CustomMustRegister(&localCacheCollector{mounter: m})
+	})
+}
+
+// DescribeWithStability implements the metrics.StableCollector interface
+func (c *localCacheCollector) DescribeWithStability(ch chan<- *metrics.Desc) {
+	ch <- localCacheHitsDesc
+	ch <- localCacheMissesDesc
+	ch <- localCacheUsageRatioDesc
+}
+
+// CollectWithStability implements the metrics.StableCollector interface
+func (c *localCacheCollector) CollectWithStability(ch chan<- metrics.Metric) {
+	stats, err := listLocalCacheStats(c.mounter)
+	if err != nil {
+		klog.Warningf("failed to list local cache stats: %v", err)
+	}
+	for _, s := range stats {
+		volume := strings.TrimPrefix(s.name, localCacheNamePrefix)
+		ch <- metrics.NewLazyConstMetric(localCacheHitsDesc, metrics.CounterValue, float64(s.hits), volume, s.mode)
+		ch <- metrics.NewLazyConstMetric(localCacheMissesDesc, metrics.CounterValue, float64(s.misses), volume, s.mode)
+		ch <- metrics.NewLazyConstMetric(localCacheUsageRatioDesc, metrics.GaugeValue, s.usageRatio, volume, s.mode)
+	}
+}
@@ -0,0 +1,545 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+const (
+	bcacheDiskFormat = "bcache"
+	// dm-cache block size in 512-byte sectors, i.e. 256KiB
+	dmCacheBlockSectors = 512
+)
+
+var (
+	sysBlockPath    = "/sys/block"
+	sysFsBcachePath = "/sys/fs/bcache"
+
+	bcacheDetachTimeout      = 2 * time.Minute
+	bcacheDetachPollInterval = time.Second
+)
+
+// setupLocalCache builds a read cache of mode on the local cache device in front of the origin device
+// and returns the device path to stage. A failure to carve or attach the cache slice only degrades the
+// volume to uncached, since both caches run in writethrough mode and the origin device is always consistent.
+func setupLocalCache(mode, name, originPath, cacheDevice string, sizeGiB int, m *mount.SafeFormatAndMount) (string, error) {
+	switch mode {
+	case consts.LocalCacheDmCache:
+		if cacheDevice == "" {
+			klog.Warningf("setupLocalCache: local cache device is not configured on the node, %s is staged without cache", originPath)
+			return originPath, nil
+		}
+		devicePath, err := setupDmCache(name, originPath, cacheDevice, sizeGiB, m)
+		if err != nil {
+			klog.Warningf("setupLocalCache: failed to set up dm-cache %s, %s is staged without cache: %v", name, originPath, err)
+			return originPath, nil
+		}
+		return devicePath, nil
+	case consts.LocalCacheBcache:
+		return setupBcache(name, originPath, cacheDevice, sizeGiB, m)
+	}
+	return originPath, nil
+}
+
+// teardownLocalCache flushes and removes the local cache of a volume, it's a no-op if there is no local cache
+func teardownLocalCache(name string, m *mount.SafeFormatAndMount) error {
+	if err := teardownDmCache(name, m); err != nil {
+		return err
+	}
+	return teardownBcache(name, m)
+}
+
+// resizeLocalCache extends the local cache of a volume to the new size of its origin device
+func resizeLocalCache(name string, m *mount.SafeFormatAndMount) error {
+	if isMapperOpen(name) {
+		return resizeDmCache(name, m)
+	}
+	if bcacheDevice, _ := findBcacheDevice(name); bcacheDevice != "" {
+		return fmt.Errorf("online expansion of bcache device %s is not supported, restage the volume to pick up the new size", bcacheDevice)
+	}
+	return nil
+}
+
+// getLocalCacheDevicePath returns the device path of the local cache of a volume, return empty string if there is no local cache
+func getLocalCacheDevicePath(name string) string {
+	if isMapperOpen(name) {
+		return getMapperPath(name)
+	}
+	if bcacheDevice, _ := findBcacheDevice(name); bcacheDevice != "" {
+		return filepath.Join("/dev", bcacheDevice)
+	}
+	return ""
+}
+
+// ensureLocalCacheVolumeGroup creates the local cache volume group on a blank local cache device
+func ensureLocalCacheVolumeGroup(cacheDevice string, m *mount.SafeFormatAndMount) error {
+	format, err := m.GetDiskFormat(cacheDevice)
+	if err != nil {
+		return fmt.Errorf("failed to get disk format of %s: %v", cacheDevice, err)
+	}
+	switch format {
+	case lvmDiskFormat:
+		return nil
+	case "":
+		klog.V(2).Infof("ensureLocalCacheVolumeGroup: creating volume group %s on %s", localCacheVolumeGroup, cacheDevice)
+		if output, err := m.Exec.Command("vgcreate", localCacheVolumeGroup, cacheDevice).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to create volume group %s on %s: %v, output: %s", localCacheVolumeGroup, cacheDevice, err, string(output))
+		}
+		return nil
+	}
+	return fmt.Errorf("refuse to use %s as local cache device since it already contains %s data", cacheDevice, format)
+}
+
+// createLocalCacheLV carves a fresh logical volume from the local cache volume group, a leftover one is
+// always recreated since a stale cache must never be served after the origin device was used elsewhere
+func createLocalCacheLV(lvName, size string, m *mount.SafeFormatAndMount) (string, error) {
+	if err := removeLocalCacheLV(lvName, m); err != nil {
+		return "", err
+	}
+	args := []string{"--yes", "--zero", "y", "--wipesignatures", "y", "--size", size, "--name", lvName, localCacheVolumeGroup}
+	if output, err := m.Exec.Command("lvcreate", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to create logical volume %s with size %s: %v, output: %s", lvName, size, err, string(output))
+	}
+	return getLocalCacheLVPath(lvName), nil
+}
+
+// removeLocalCacheLV removes a logical volume from the local cache volume group if it exists
+func removeLocalCacheLV(lvName string, m *mount.SafeFormatAndMount) error {
+	if _, err := os.Stat(getLocalCacheLVPath(lvName)); err != nil {
+		return nil
+	}
+	klog.V(2).Infof("removeLocalCacheLV: removing logical volume %s", lvName)
+	if output, err := m.Exec.Command("lvremove", "--yes", localCacheVolumeGroup+"/"+lvName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to remove logical volume %s: %v, output: %s", lvName, err, string(output))
+	}
+	return nil
+}
+
+// setupDmCache creates a writethrough dm-cache mapping over the origin device with data and metadata slices on the local cache device
+func setupDmCache(name, originPath, cacheDevice string, sizeGiB int, m *mount.SafeFormatAndMount) (string, error) {
+	if isMapperOpen(name) {
+		klog.V(2).Infof("setupDmCache: %s is already active", name)
+		return getMapperPath(name), nil
+	}
+
+	localCacheMutex.Lock()
+	defer localCacheMutex.Unlock()
+	if err := ensureLocalCacheVolumeGroup(cacheDevice, m); err != nil {
+		return "", err
+	}
+	dataPath, err := createLocalCacheLV(name+dmCacheDataLVSuffix, fmt.Sprintf("%dg", sizeGiB), m)
+	if err != nil {
+		return "", err
+	}
+	// dm-cache needs about 16 bytes of metadata per cache block on top of 4MiB
+	metaPath, err := createLocalCacheLV(name+dmCacheMetaLVSuffix, fmt.Sprintf("%dm", 8+sizeGiB/16), m)
+	if err != nil {
+		_ = removeLocalCacheLV(name+dmCacheDataLVSuffix, m)
+		return "", err
+	}
+
+	sectors, err := getDeviceSectors(originPath, m)
+	if err == nil {
+		table := fmt.Sprintf("0 %d cache %s %s %s %d 1 writethrough default 0", sectors, metaPath, dataPath, originPath, dmCacheBlockSectors)
+		klog.V(2).Infof("setupDmCache: creating dm-cache %s with table %q", name, table)
+		var output []byte
+		if output, err = m.Exec.Command("dmsetup", "create", name, "--table", table).CombinedOutput(); err != nil {
+			err = fmt.Errorf("failed to create dm-cache %s: %v, output: %s", name, err, string(output))
+		}
+	}
+	if err != nil {
+		_ = removeLocalCacheLV(name+dmCacheMetaLVSuffix, m)
+		_ = removeLocalCacheLV(name+dmCacheDataLVSuffix, m)
+		return "", err
+	}
+	return getMapperPath(name), nil
+}
+
+// teardownDmCache removes the dm-cache mapping of a volume once there is no dirty block, and releases its cache slices
+func teardownDmCache(name string, m *mount.SafeFormatAndMount) error {
+	if isMapperOpen(name) {
+		output, err := m.Exec.Command("dmsetup", "status", name).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to get status of dm-cache %s: %v, output: %s", name, err, string(output))
+		}
+		_, dirty, err := parseDmCacheStatus(string(output))
+		if err != nil {
+			return err
+		}
+		if dirty > 0 {
+			return fmt.Errorf("dm-cache %s still has %d dirty blocks", name, dirty)
+		}
+		klog.V(2).Infof("teardownDmCache: removing dm-cache %s", name)
+		if output, err := m.Exec.Command("dmsetup", "remove", name).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to remove dm-cache %s: %v, output: %s", name, err, string(output))
+		}
+	}
+
+	localCacheMutex.Lock()
+	defer localCacheMutex.Unlock()
+	if err := removeLocalCacheLV(name+dmCacheMetaLVSuffix, m); err != nil {
+		return err
+	}
+	return removeLocalCacheLV(name+dmCacheDataLVSuffix, m)
+}
+
+// resizeDmCache reloads the dm-cache mapping of a volume with the current size of its origin device
+func resizeDmCache(name string, m *mount.SafeFormatAndMount) error {
+	output, err := m.Exec.Command("dmsetup", "table", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to get table of dm-cache %s: %v, output: %s", name, err, string(output))
+	}
+	// table: <start> <length> cache <metadata dev> <cache dev> <origin dev> <block size> ...
+	fields := strings.Fields(string(output))
+	if len(fields) < 6 || fields[2] != "cache" {
+		return fmt.Errorf("unexpected table of dm-cache %s: %q", name, string(output))
+	}
+	sectors, err := getDeviceSectors(filepath.Join("/dev/block", fields[5]), m)
+	if err != nil {
+		return err
+	}
+	if strconv.FormatInt(sectors, 10) == fields[1] {
+		return nil
+	}
+	fields[1] = strconv.FormatInt(sectors, 10)
+	klog.V(2).Infof("resizeDmCache: resizing dm-cache %s to %d sectors", name, sectors)
+	if output, err := m.Exec.Command("dmsetup", "reload", name, "--table", strings.Join(fields, " ")).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to reload dm-cache %s: %v, output: %s", name, err, string(output))
+	}
+	if output, err := m.Exec.Command("dmsetup", "resume", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to resume dm-cache %s: %v, output: %s", name, err, string(output))
+	}
+	return nil
+}
+
+// parseDmCacheStatus parses the output of dmsetup status of a dm-cache mapping, returns the stats and the number of dirty blocks
+func parseDmCacheStatus(status string) (localCacheStats, uint64, error) {
+	stats := localCacheStats{mode: consts.LocalCacheDmCache}
+	// status: <start> <length> cache <metadata block size> <#used metadata blocks>/<#total metadata blocks> <cache block size>
+	// <#used cache blocks>/<#total cache blocks> <#read hits> <#read misses> <#write hits> <#write misses>
+	// <#demotions> <#promotions> <#dirty> ...
+	fields := strings.Fields(status)
+	if len(fields) < 14 || fields[2] != "cache" {
+		return stats, 0, fmt.Errorf("unexpected dm-cache status: %q", status)
+	}
+	var used, total, dirty uint64
+	if _, err := fmt.Sscanf(fields[6], "%d/%d", &used, &total); err != nil {
+		return stats, 0, fmt.Errorf("unexpected cache blocks %q in dm-cache status: %v", fields[6], err)
+	}
+	if total > 0 {
+		stats.usageRatio = float64(used) / float64(total)
+	}
+	for _, f := range []struct {
+		value *uint64
+		index int
+	}{{&stats.hits, 7}, {&stats.misses, 8}, {&dirty, 13}} {
+		v, err := strconv.ParseUint(fields[f.index], 10, 64)
+		if err != nil {
+			return stats, 0, fmt.Errorf("unexpected field %q in dm-cache status: %v", fields[f.index], err)
+		}
+		*f.value = v
+	}
+	return stats, dirty, nil
+}
+
+// setupBcache registers the origin device as a bcache backing device and attaches a cache set carved from the local cache device,
+// a blank origin device is formatted as bcache backing device first and a device which contains any other data is never touched.
+// The backing device keeps running without cache if the local cache device is not configured or the cache set could not be attached.
+func setupBcache(name, originPath, cacheDevice string, sizeGiB int, m *mount.SafeFormatAndMount) (string, error) {
+	format, err := m.GetDiskFormat(originPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get disk format of %s: %v", originPath, err)
+	}
+	switch format {
+	case "":
+		klog.V(2).Infof("setupBcache: formatting %s as bcache backing device", originPath)
+		if output, err := m.Exec.Command("make-bcache", "-B", originPath).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to format %s as bcache backing device: %v, output: %s", originPath, err, string(output))
+		}
+	case bcacheDiskFormat:
+	default:
+		return "", fmt.Errorf("refuse to use %s as bcache backing device since it already contains %s data", originPath, format)
+	}
+
+	bcacheDevice, err := registerBcacheDevice(originPath)
+	if err != nil {
+		return "", err
+	}
+	bcacheSysPath := filepath.Join(sysBlockPath, bcacheDevice, "bcache")
+	if err := os.WriteFile(filepath.Join(bcacheSysPath, "label"), []byte(name), 0200); err != nil {
+		return "", fmt.Errorf("failed to label bcache device %s: %v", bcacheDevice, err)
+	}
+	devicePath := filepath.Join("/dev", bcacheDevice)
+
+	if _, err := os.Stat(filepath.Join(bcacheSysPath, "cache")); err == nil {
+		klog.V(2).Infof("setupBcache: %s is already attached to a cache set", bcacheDevice)
+		return devicePath, nil
+	}
+	if cacheDevice == "" {
+		klog.Warningf("setupBcache: local cache device is not configured on the node, %s is staged without cache", devicePath)
+		return devicePath, nil
+	}
+	if err := attachBcacheCacheSet(name, bcacheSysPath, cacheDevice, sizeGiB, m); err != nil {
+		klog.Warningf("setupBcache: failed to attach cache set to %s, it's staged without cache: %v", devicePath, err)
+	}
+	return devicePath, nil
+}
+
+// attachBcacheCacheSet creates a cache set on a slice of the local cache device and attaches it to the bcache device
+func attachBcacheCacheSet(name, bcacheSysPath, cacheDevice string, sizeGiB int, m *mount.SafeFormatAndMount) error {
+	localCacheMutex.Lock()
+	defer localCacheMutex.Unlock()
+	if err := ensureLocalCacheVolumeGroup(cacheDevice, m); err != nil {
+		return err
+	}
+	cachePath, err := createLocalCacheLV(name+bcacheLVSuffix, fmt.Sprintf("%dg", sizeGiB), m)
+	if err != nil {
+		return err
+	}
+	if output, err := m.Exec.Command("make-bcache", "-C", cachePath).CombinedOutput(); err != nil {
+		_ = removeLocalCacheLV(name+bcacheLVSuffix, m)
+		return fmt.Errorf("failed to format %s as bcache cache device: %v, output: %s", cachePath, err, string(output))
+	}
+	cacheSetPath, err := getBcacheCacheSetPath(cachePath)
+	if err != nil {
+		if _, err = registerBcacheDevice(cachePath); err == nil {
+			cacheSetPath, err = getBcacheCacheSetPath(cachePath)
+		}
+	}
+	if err == nil {
+		klog.V(2).Infof("setupBcache: attaching cache set %s to %s", filepath.Base(cacheSetPath), bcacheSysPath)
+		if err = os.WriteFile(filepath.Join(bcacheSysPath, "attach"), []byte(filepath.Base(cacheSetPath)), 0200); err != nil {
+			err = fmt.Errorf("failed to attach cache set %s: %v", filepath.Base(cacheSetPath), err)
+		}
+	}
+	if err != nil {
+		stopBcacheCacheSet(cachePath)
+		_ = removeLocalCacheLV(name+bcacheLVSuffix, m)
+	}
+	return err
+}
+
+// teardownBcache detaches the cache set of a volume, which writes back any dirty data, then stops the bcache device and releases the cache slice
+func teardownBcache(name string, m *mount.SafeFormatAndMount) error {
+	bcacheDevice, err := findBcacheDevice(name)
+	if err != nil {
+		return err
+	}
+	if bcacheDevice != "" {
+		bcacheSysPath := filepath.Join(sysBlockPath, bcacheDevice, "bcache")
+		if _, err := os.Stat(filepath.Join(bcacheSysPath, "cache")); err == nil {
+			klog.V(2).Infof("teardownBcache: detaching cache set from %s", bcacheDevice)
+			if err := os.WriteFile(filepath.Join(bcacheSysPath, "detach"), []byte("1"), 0200); err != nil {
+				return fmt.Errorf("failed to detach cache set from %s: %v", bcacheDevice, err)
+			}
+			if err := waitForBcacheDetached(bcacheSysPath); err != nil {
+				return err
+			}
+		}
+		klog.V(2).Infof("teardownBcache: stopping %s", bcacheDevice)
+		if err := os.WriteFile(filepath.Join(bcacheSysPath, "stop"), []byte("1"), 0200); err != nil {
+			return fmt.Errorf("failed to stop %s: %v", bcacheDevice, err)
+		}
+	}
+
+	cachePath := getLocalCacheLVPath(name + bcacheLVSuffix)
+	if _, err := os.Stat(cachePath); err != nil {
+		return nil
+	}
+	stopBcacheCacheSet(cachePath)
+	localCacheMutex.Lock()
+	defer localCacheMutex.Unlock()
+	return removeLocalCacheLV(name+bcacheLVSuffix, m)
+}
+
+// waitForBcacheDetached waits until all dirty data of a bcache device is written back and the cache set is detached
+func waitForBcacheDetached(bcacheSysPath string) error {
+	deadline := time.Now().Add(bcacheDetachTimeout)
+	for {
+		state, err := os.ReadFile(filepath.Join(bcacheSysPath, "state"))
+		if err != nil {
+			return fmt.Errorf("failed to read state of %s: %v", bcacheSysPath, err)
+		}
+		if strings.TrimSpace(string(state)) == "no cache" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for cache set to be detached from %s, state: %s", bcacheSysPath, strings.TrimSpace(string(state)))
+		}
+		time.Sleep(bcacheDetachPollInterval)
+	}
+}
+
+// registerBcacheDevice registers a bcache formatted device with the kernel and returns the name of its bcache device if it's a backing device
+func registerBcacheDevice(devicePath string) (string, error) {
+	if err := os.WriteFile(filepath.Join(sysFsBcachePath, "register"), []byte(devicePath), 0200); err != nil {
+		// the device may have been registered by udev already
+		klog.V(4).Infof("registerBcacheDevice: register %s returned %v", devicePath, err)
+	}
+	kernelName, err := getKernelDeviceName(devicePath)
+	if err != nil {
+		return "", err
+	}
+	link, err := os.Readlink(filepath.Join(sysBlockPath, kernelName, "bcache", "dev"))
+	if err != nil {
+		if _, statErr := os.Stat(filepath.Join(sysBlockPath, kernelName, "bcache", "set")); statErr == nil {
+			// a cache device has no bcache device
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to find bcache device of %s: %v", devicePath, err)
+	}
+	return filepath.Base(link), nil
+}
+
+// findBcacheDevice returns the name of the bcache device with label, e.g. bcache0, return empty string if not found
+func findBcacheDevice(label string) (string, error) {
+	entries, err := os.ReadDir(sysBlockPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s: %v", sysBlockPath, err)
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "bcache") {
+			continue
+		}
+		value, err := os.ReadFile(filepath.Join(sysBlockPath, entry.Name(), "bcache", "label"))
+		if err == nil && strings.TrimSpace(string(value)) == label {
+			return entry.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// getBcacheCacheSetPath returns the sysfs path of the cache set registered on a cache device, e.g. /sys/fs/bcache/<uuid>
+func getBcacheCacheSetPath(cachePath string) (string, error) {
+	kernelName, err := getKernelDeviceName(cachePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(filepath.Join(sysBlockPath, kernelName, "bcache", "set"))
+}
+
+// stopBcacheCacheSet unregisters the cache set on a cache device
+func stopBcacheCacheSet(cachePath string) {
+	cacheSetPath, err := getBcacheCacheSetPath(cachePath)
+	if err != nil {
+		return
+	}
+	klog.V(2).Infof("stopBcacheCacheSet: stopping cache set %s", filepath.Base(cacheSetPath))
+	if err := os.WriteFile(filepath.Join(cacheSetPath, "stop"), []byte("1"), 0200); err != nil {
+		klog.Warningf("failed to stop cache set %s: %v", filepath.Base(cacheSetPath), err)
+	}
+}
+
+// getKernelDeviceName returns the kernel name of a device path, e.g. sdc for /dev/disk/azure/scsi1/lun0
+func getKernelDeviceName(devicePath string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", devicePath, err)
+	}
+	return filepath.Base(realPath), nil
+}
+
+// getDeviceSectors returns the size of a block device in 512-byte sectors
+func getDeviceSectors(devicePath string, m *mount.SafeFormatAndMount) (int64, error) {
+	output, err := m.Exec.Command("blockdev", "--getsz", devicePath).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of %s: %v, output: %s", devicePath, err, string(output))
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size of %s: %v", devicePath, err)
+	}
+	return sectors, nil
+}
+
+// listLocalCacheStats returns the stats of all local caches carved from the local cache volume group
+func listLocalCacheStats(m *mount.SafeFormatAndMount) ([]localCacheStats, error) {
+	entries, err := os.ReadDir(filepath.Join("/dev", localCacheVolumeGroup))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []localCacheStats
+	for _, entry := range entries {
+		lvName := entry.Name()
+		switch {
+		case strings.HasSuffix(lvName, dmCacheDataLVSuffix):
+			name := strings.TrimSuffix(lvName, dmCacheDataLVSuffix)
+			output, err := m.Exec.Command("dmsetup", "status", name).CombinedOutput()
+			if err != nil {
+				klog.V(4).Infof("listLocalCacheStats: failed to get status of dm-cache %s: %v", name, err)
+				continue
+			}
+			stats, _, err := parseDmCacheStatus(string(output))
+			if err != nil {
+				klog.V(4).Infof("listLocalCacheStats: %v", err)
+				continue
+			}
+			stats.name = name
+			result = append(result, stats)
+		case strings.HasSuffix(lvName, bcacheLVSuffix):
+			stats, err := getBcacheStats(getLocalCacheLVPath(lvName))
+			if err != nil {
+				klog.V(4).Infof("listLocalCacheStats: %v", err)
+				continue
+			}
+			stats.name = strings.TrimSuffix(lvName, bcacheLVSuffix)
+			result = append(result, stats)
+		}
+	}
+	return result, nil
+}
+
+// getBcacheStats reads the stats of the cache set registered on a cache device
+func getBcacheStats(cachePath string) (localCacheStats, error) {
+	stats := localCacheStats{mode: consts.LocalCacheBcache}
+	cacheSetPath, err := getBcacheCacheSetPath(cachePath)
+	if err != nil {
+		return stats, fmt.Errorf("failed to find cache set of %s: %v", cachePath, err)
+	}
+	var available uint64
+	for _, f := range []struct {
+		value *uint64
+		file  string
+	}{{&stats.hits, "stats_total/cache_hits"}, {&stats.misses, "stats_total/cache_misses"}, {&available, "cache_available_percent"}} {
+		content, err := os.ReadFile(filepath.Join(cacheSetPath, f.file))
+		if err != nil {
+			return stats, err
+		}
+		if *f.value, err = strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return stats, fmt.Errorf("failed to parse %s of cache set %s: %v", f.file, filepath.Base(cacheSetPath), err)
+		}
+	}
+	stats.usageRatio = float64(100-available) / 100
+	return stats, nil
+}
@@ -0,0 +1,283 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	testingexec "k8s.io/utils/exec/testing"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+const testDmCacheStatus = "0 2097152 cache 8 27/2048 512 100/400 30 10 5 5 0 100 0 1 writethrough 2 migration_threshold 2048 smq 0 rw -"
+
+// setupFakeBcacheSysfs creates a fake sysfs with an origin device sdc registered as bcache0 and returns the origin device path
+func setupFakeBcacheSysfs(t *testing.T) string {
+	root := t.TempDir()
+	sysBlockPath = filepath.Join(root, "sys", "block")
+	sysFsBcachePath = filepath.Join(root, "sys", "fs", "bcache")
+	t.Cleanup(func() {
+		sysBlockPath = "/sys/block"
+		sysFsBcachePath = "/sys/fs/bcache"
+	})
+
+	originPath := filepath.Join(root, "dev", "sdc")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(originPath), 0755))
+	assert.NoError(t, os.WriteFile(originPath, []byte{}, 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBlockPath, "sdc", "bcache"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBlockPath, "bcache0", "bcache"), 0755))
+	assert.NoError(t, os.MkdirAll(sysFsBcachePath, 0755))
+	assert.NoError(t, os.Symlink("../../bcache0", filepath.Join(sysBlockPath, "sdc", "bcache", "dev")))
+	return originPath
+}
+
+func TestSetupLocalCache(t *testing.T) {
+	blkidNoFormatAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 2}
+	}
+	blkidExt4Action := func() ([]byte, []byte, error) {
+		return []byte("DEVICE=/dev/sdc\nTYPE=ext4"), []byte{}, nil
+	}
+	successAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	failedAction := func() ([]byte, []byte, error) {
+		return []byte("failed"), []byte{}, &testingexec.FakeExitError{Status: 5}
+	}
+	blockdevAction := func() ([]byte, []byte, error) {
+		return []byte("2097152\n"), []byte{}, nil
+	}
+
+	tests := []struct {
+		desc          string
+		mode          string
+		cacheDevice   string
+		outputScripts []testingexec.FakeAction
+		expectedPath  string
+		expectedErr   bool
+	}{
+		{
+			desc:         "no local cache",
+			mode:         "",
+			cacheDevice:  "/dev/nvme0n1",
+			expectedPath: "/dev/sdc",
+		},
+		{
+			desc:         "dm-cache without local cache device",
+			mode:         consts.LocalCacheDmCache,
+			expectedPath: "/dev/sdc",
+		},
+		{
+			desc:          "dm-cache on blank local cache device",
+			mode:          consts.LocalCacheDmCache,
+			cacheDevice:   "/dev/nvme0n1",
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, successAction, successAction, successAction, blockdevAction, successAction},
+			expectedPath:  "/dev/mapper/azcache-pvc-xxx",
+		},
+		{
+			desc:          "dm-cache degraded when local cache device is in use",
+			mode:          consts.LocalCacheDmCache,
+			cacheDevice:   "/dev/nvme0n1",
+			outputScripts: []testingexec.FakeAction{blkidExt4Action},
+			expectedPath:  "/dev/sdc",
+		},
+		{
+			desc:          "dm-cache degraded when dmsetup failed",
+			mode:          consts.LocalCacheDmCache,
+			cacheDevice:   "/dev/nvme0n1",
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, successAction, successAction, successAction, blockdevAction, failedAction},
+			expectedPath:  "/dev/sdc",
+		},
+		{
+			desc:          "bcache refuses origin device with file system",
+			mode:          consts.LocalCacheBcache,
+			cacheDevice:   "/dev/nvme0n1",
+			outputScripts: []testingexec.FakeAction{blkidExt4Action},
+			expectedErr:   true,
+		},
+		{
+			desc:          "make-bcache failed",
+			mode:          consts.LocalCacheBcache,
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, failedAction},
+			expectedErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+
+		path, err := setupLocalCache(test.mode, "azcache-pvc-xxx", "/dev/sdc", test.cacheDevice, 10, fakeMounter)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		assert.Equal(t, test.expectedPath, path, test.desc)
+	}
+}
+
+func TestSetupBcacheWithoutLocalCacheDevice(t *testing.T) {
+	originPath := setupFakeBcacheSysfs(t)
+	fakeMounter, err := mounter.NewFakeSafeMounter()
+	assert.NoError(t, err)
+	fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(
+		func() ([]byte, []byte, error) {
+			return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 2}
+		},
+		func() ([]byte, []byte, error) {
+			return []byte{}, []byte{}, nil
+		},
+	)
+
+	path, err := setupLocalCache(consts.LocalCacheBcache, "azcache-pvc-xxx", originPath, "", 10, fakeMounter)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/bcache0", path)
+
+	registered, err := os.ReadFile(filepath.Join(sysFsBcachePath, "register"))
+	assert.NoError(t, err)
+	assert.Equal(t, originPath, string(registered))
+	device, err := findBcacheDevice("azcache-pvc-xxx")
+	assert.NoError(t, err)
+	assert.Equal(t, "bcache0", device)
+}
+
+func TestTeardownBcache(t *testing.T) {
+	setupFakeBcacheSysfs(t)
+	bcacheSysPath := filepath.Join(sysBlockPath, "bcache0", "bcache")
+	assert.NoError(t, os.WriteFile(filepath.Join(bcacheSysPath, "label"), []byte("azcache-pvc-xxx\n"), 0644))
+	assert.NoError(t, os.Symlink(sysFsBcachePath, filepath.Join(bcacheSysPath, "cache")))
+	assert.NoError(t, os.WriteFile(filepath.Join(bcacheSysPath, "state"), []byte("no cache\n"), 0644))
+	fakeMounter, err := mounter.NewFakeSafeMounter()
+	assert.NoError(t, err)
+
+	assert.NoError(t, teardownLocalCache("azcache-pvc-yyy", fakeMounter))
+	_, err = os.Stat(filepath.Join(bcacheSysPath, "stop"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, teardownLocalCache("azcache-pvc-xxx", fakeMounter))
+	for _, file := range []string{"detach", "stop"} {
+		content, err := os.ReadFile(filepath.Join(bcacheSysPath, file))
+		assert.NoError(t, err)
+		assert.Equal(t, "1", string(content))
+	}
+}
+
+func TestWaitForBcacheDetached(t *testing.T) {
+	bcacheDetachTimeout = 0
+	defer func() { bcacheDetachTimeout = 2 * time.Minute }()
+
+	bcacheSysPath := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(bcacheSysPath, "state"), []byte("dirty\n"), 0644))
+	assert.Error(t, waitForBcacheDetached(bcacheSysPath))
+	assert.NoError(t, os.WriteFile(filepath.Join(bcacheSysPath, "state"), []byte("no cache\n"), 0644))
+	assert.NoError(t, waitForBcacheDetached(bcacheSysPath))
+}
+
+func TestGetBcacheStats(t *testing.T) {
+	setupFakeBcacheSysfs(t)
+	cachePath := filepath.Join(filepath.Dir(sysBlockPath), "..", "dev", "dm-5")
+	assert.NoError(t, os.WriteFile(cachePath, []byte{}, 0644))
+	cacheSetPath := filepath.Join(sysFsBcachePath, "6f8e9a3c")
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheSetPath, "stats_total"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBlockPath, "dm-5", "bcache"), 0755))
+	assert.NoError(t, os.Symlink(cacheSetPath, filepath.Join(sysBlockPath, "dm-5", "bcache", "set")))
+
+	_, err := getBcacheStats(cachePath)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(cacheSetPath, "stats_total", "cache_hits"), []byte("30\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(cacheSetPath, "stats_total", "cache_misses"), []byte("10\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(cacheSetPath, "cache_available_percent"), []byte("75\n"), 0644))
+	stats, err := getBcacheStats(cachePath)
+	assert.NoError(t, err)
+	assert.Equal(t, localCacheStats{mode: consts.LocalCacheBcache, hits: 30, misses: 10, usageRatio: 0.25}, stats)
+}
+
+func TestParseDmCacheStatus(t *testing.T) {
+	stats, dirty, err := parseDmCacheStatus(testDmCacheStatus)
+	assert.NoError(t, err)
+	assert.Equal(t, localCacheStats{mode: consts.LocalCacheDmCache, hits: 30, misses: 10, usageRatio: 0.25}, stats)
+	assert.Equal(t, uint64(0), dirty)
+
+	_, dirty, err = parseDmCacheStatus("0 2097152 cache 8 27/2048 512 100/400 30 10 5 5 0 100 7 1 writethrough")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), dirty)
+
+	_, _, err = parseDmCacheStatus("0 2097152 linear 8:32 0")
+	assert.Error(t, err)
+	_, _, err = parseDmCacheStatus("0 2097152 cache 8 27/2048 512 100 30 10 5 5 0 100 0")
+	assert.Error(t, err)
+}
+
+func TestResizeDmCache(t *testing.T) {
+	tableAction := func() ([]byte, []byte, error) {
+		return []byte("0 2097152 cache 253:4 253:5 8:32 512 1 writethrough default 0\n"), []byte{}, nil
+	}
+	sameSizeAction := func() ([]byte, []byte, error) {
+		return []byte("2097152\n"), []byte{}, nil
+	}
+	newSizeAction := func() ([]byte, []byte, error) {
+		return []byte("4194304\n"), []byte{}, nil
+	}
+	successAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	failedAction := func() ([]byte, []byte, error) {
+		return []byte("failed"), []byte{}, &testingexec.FakeExitError{Status: 1}
+	}
+
+	tests := []struct {
+		desc          string
+		outputScripts []testingexec.FakeAction
+		expectedErr   bool
+	}{
+		{
+			desc:          "origin device is not resized",
+			outputScripts: []testingexec.FakeAction{tableAction, sameSizeAction},
+		},
+		{
+			desc:          "reload with new size",
+			outputScripts: []testingexec.FakeAction{tableAction, newSizeAction, successAction, successAction},
+		},
+		{
+			desc:          "dmsetup table failed",
+			outputScripts: []testingexec.FakeAction{failedAction},
+			expectedErr:   true,
+		},
+		{
+			desc:          "dmsetup reload failed",
+			outputScripts: []testingexec.FakeAction{tableAction, newSizeAction, failedAction},
+			expectedErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+
+		err = resizeDmCache("azcache-pvc-xxx", fakeMounter)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+	}
+}
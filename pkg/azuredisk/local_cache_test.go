@@ -0,0 +1,60 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/component-base/metrics"
+)
+
+func TestGetLocalCacheName(t *testing.T) {
+	tests := []struct {
+		volumeID string
+		expected string
+	}{
+		{
+			volumeID: "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/disks/pvc-xxx",
+			expected: "azcache-pvc-xxx",
+		},
+		{
+			volumeID: "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/disks/Disk_A",
+			expected: "azcache-disk_a",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getLocalCacheName(test.volumeID))
+	}
+}
+
+func TestGetLocalCacheLVPath(t *testing.T) {
+	assert.Equal(t, "/dev/azdisk-localcache/azcache-pvc-xxx-cache", getLocalCacheLVPath("azcache-pvc-xxx"+dmCacheDataLVSuffix))
+}
+
+func TestLocalCacheCollectorDescribe(t *testing.T) {
+	ch := make(chan *metrics.Desc, 3)
+	(&localCacheCollector{}).DescribeWithStability(ch)
+	close(ch)
+
+	var descs []*metrics.Desc
+	for desc := range ch {
+		descs = append(descs, desc)
+	}
+	assert.Equal(t, []*metrics.Desc{localCacheHitsDesc, localCacheMissesDesc, localCacheUsageRatioDesc}, descs)
+}
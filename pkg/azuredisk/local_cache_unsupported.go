@@ -0,0 +1,47 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"runtime"
+
+	mount "k8s.io/mount-utils"
+)
+
+func setupLocalCache(_, _, _, _ string, _ int, _ *mount.SafeFormatAndMount) (string, error) {
+	return "", fmt.Errorf("local cache is not supported on %s", runtime.GOOS)
+}
+
+func teardownLocalCache(_ string, _ *mount.SafeFormatAndMount) error {
+	return nil
+}
+
+func resizeLocalCache(_ string, _ *mount.SafeFormatAndMount) error {
+	return nil
+}
+
+func getLocalCacheDevicePath(_ string) string {
+	return ""
+}
+
+func listLocalCacheStats(_ *mount.SafeFormatAndMount) ([]localCacheStats, error) {
+	return nil, nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	devMapperPath    = "/dev/mapper"
+	luksMapperPrefix = "luks-"
+	// device mapper names are limited to 127 characters
+	maxMapperNameLength = 127
+)
+
+var invalidMapperNameCharRE = regexp.MustCompile(`[^a-z0-9._-]`)
+
+// getMapperName returns a device mapper name of a volume with prefix, e.g. luks-pvc-xxx
+func getMapperName(prefix, volumeID string) string {
+	name, err := azureutils.GetDiskName(volumeID)
+	if err != nil {
+		name = volumeID
+	}
+	name = prefix + invalidMapperNameCharRE.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > maxMapperNameLength {
+		name = name[:maxMapperNameLength]
+	}
+	return name
+}
+
+// getLuksMapperName returns the dm-crypt mapping name of a volume, e.g. luks-pvc-xxx
+func getLuksMapperName(volumeID string) string {
+	return getMapperName(luksMapperPrefix, volumeID)
+}
+
+// getMapperPath returns the device path of a device mapper mapping, e.g. /dev/mapper/luks-pvc-xxx
+func getMapperPath(mapperName string) string {
+	return filepath.Join(devMapperPath, mapperName)
+}
+
+// isMapperOpen checks whether the device mapper mapping exists on the node
+func isMapperOpen(mapperName string) bool {
+	_, err := os.Stat(getMapperPath(mapperName))
+	return err == nil
+}
+
+// getLuksMapperPath returns the device path of a dm-crypt mapping, e.g. /dev/mapper/luks-pvc-xxx
+func getLuksMapperPath(mapperName string) string {
+	return getMapperPath(mapperName)
+}
+
+// isLuksMapperOpen checks whether the dm-crypt mapping exists on the node
+func isLuksMapperOpen(mapperName string) bool {
+	return isMapperOpen(mapperName)
+}
+
+// getLuksKey gets the LUKS key from node stage secrets, an inline passphrase takes precedence over a key file in keyDir on the node
+func getLuksKey(secrets map[string]string, keyDir string) ([]byte, error) {
+	if passphrase, ok := secrets[consts.LuksPassphraseSecretKey]; ok && passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if keyFile, ok := secrets[consts.LuksKeyFileSecretKey]; ok && keyFile != "" {
+		path, err := getLuksKeyFilePath(keyFile, keyDir)
+		if err != nil {
+			return nil, err
+		}
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LUKS key file %s: %v", keyFile, err)
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("LUKS key file %s is empty", keyFile)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("neither %s nor %s is provided in node stage secrets", consts.LuksPassphraseSecretKey, consts.LuksKeyFileSecretKey)
+}
+
+// getLuksKeyFilePath resolves a key file, relative to keyDir or an absolute path in keyDir, to its path on the node.
+// The key file is rejected if it's out of keyDir, including through .. or symbolic links.
+func getLuksKeyFilePath(keyFile, keyDir string) (string, error) {
+	if keyDir == "" {
+		return "", fmt.Errorf("%s is not allowed since the LUKS key directory is not configured on the node", consts.LuksKeyFileSecretKey)
+	}
+	for _, element := range strings.Split(filepath.ToSlash(keyFile), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("LUKS key file %s must not contain ..", keyFile)
+		}
+	}
+	keyDir = filepath.Clean(keyDir)
+	path := filepath.Clean(keyFile)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(keyDir, path)
+	}
+	if !isPathInDir(path, keyDir) {
+		return "", fmt.Errorf("LUKS key file %s is not in the LUKS key directory %s", keyFile, keyDir)
+	}
+
+	// the key file must not be a symbolic link to a file out of keyDir
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read LUKS key file %s: %v", keyFile, err)
+	}
+	realKeyDir, err := filepath.EvalSymlinks(keyDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read LUKS key directory %s: %v", keyDir, err)
+	}
+	if !isPathInDir(realPath, realKeyDir) {
+		return "", fmt.Errorf("LUKS key file %s is not in the LUKS key directory %s", keyFile, keyDir)
+	}
+	return realPath, nil
+}
+
+// isPathInDir checks whether the cleaned path is a file under the cleaned dir
+func isPathInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const luksDiskFormat = "crypto_LUKS"
+
+// openLuksDevice formats devicePath as LUKS2 if it is blank and opens it as /dev/mapper/<mapperName>,
+// a device which already contains a file system or any other data is never formatted.
+func openLuksDevice(devicePath, mapperName string, key []byte, m *mount.SafeFormatAndMount) (string, error) {
+	mapperPath := getLuksMapperPath(mapperName)
+	if isLuksMapperOpen(mapperName) {
+		klog.V(2).Infof("openLuksDevice: %s is already opened at %s", devicePath, mapperPath)
+		return mapperPath, nil
+	}
+
+	format, err := m.GetDiskFormat(devicePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get disk format of %s: %v", devicePath, err)
+	}
+	switch format {
+	case "":
+		klog.V(2).Infof("openLuksDevice: formatting %s with LUKS2", devicePath)
+		cmd := m.Exec.Command("cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-", devicePath)
+		cmd.SetStdin(bytes.NewReader(key))
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to format %s with LUKS2: %v, output: %s", devicePath, err, string(output))
+		}
+	case luksDiskFormat:
+	default:
+		return "", fmt.Errorf("refuse to format %s with LUKS2 since it already contains %s data", devicePath, format)
+	}
+
+	cmd := m.Exec.Command("cryptsetup", "luksOpen", "--key-file", "-", devicePath, mapperName)
+	cmd.SetStdin(bytes.NewReader(key))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to open LUKS device %s as %s: %v, output: %s", devicePath, mapperName, err, string(output))
+	}
+	klog.V(2).Infof("openLuksDevice: opened %s at %s", devicePath, mapperPath)
+	return mapperPath, nil
+}
+
+// closeLuksDevice closes the dm-crypt mapping, it's a no-op if the mapping does not exist
+func closeLuksDevice(mapperName string, m *mount.SafeFormatAndMount) error {
+	if !isLuksMapperOpen(mapperName) {
+		return nil
+	}
+	if output, err := m.Exec.Command("cryptsetup", "luksClose", mapperName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to close LUKS device %s: %v, output: %s", mapperName, err, string(output))
+	}
+	klog.V(2).Infof("closeLuksDevice: closed %s", mapperName)
+	return nil
+}
+
+// resizeLuksDevice grows the dm-crypt mapping to the size of its backing device
+func resizeLuksDevice(mapperName string, key []byte, m *mount.SafeFormatAndMount) error {
+	args := []string{"resize", mapperName}
+	if len(key) > 0 {
+		args = []string{"resize", "--key-file", "-", mapperName}
+	}
+	cmd := m.Exec.Command("cryptsetup", args...)
+	if len(key) > 0 {
+		cmd.SetStdin(bytes.NewReader(key))
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to resize LUKS device %s: %v, output: %s", mapperName, err, string(output))
+	}
+	return nil
+}
+
+// getLuksBackingDevice returns the underlying device of a dm-crypt mapping, e.g. /dev/sdc
+func getLuksBackingDevice(mapperName string, m *mount.SafeFormatAndMount) (string, error) {
+	output, err := m.Exec.Command("cryptsetup", "status", mapperName).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get status of LUKS device %s: %v", mapperName, err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "device" {
+			return strings.TrimSpace(fields[1]), nil
+		}
+	}
+	return "", fmt.Errorf("could not find backing device of LUKS device %s in output: %s", mapperName, string(output))
+}
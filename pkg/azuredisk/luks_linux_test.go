@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	testingexec "k8s.io/utils/exec/testing"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func TestOpenLuksDevice(t *testing.T) {
+	blkidNoFormatAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 2}
+	}
+	blkidLuksAction := func() ([]byte, []byte, error) {
+		return []byte("DEVICE=/dev/sdd\nTYPE=crypto_LUKS"), []byte{}, nil
+	}
+	blkidExt4Action := func() ([]byte, []byte, error) {
+		return []byte("DEVICE=/dev/sdd\nTYPE=ext4"), []byte{}, nil
+	}
+	cryptsetupAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	cryptsetupFailedAction := func() ([]byte, []byte, error) {
+		return []byte("Device /dev/sdd is in use."), []byte{}, &testingexec.FakeExitError{Status: 5}
+	}
+
+	tests := []struct {
+		desc          string
+		outputScripts []testingexec.FakeAction
+		expectedPath  string
+		expectedErr   bool
+	}{
+		{
+			desc:          "format and open blank device",
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, cryptsetupAction, cryptsetupAction},
+			expectedPath:  "/dev/mapper/luks-vol_1",
+		},
+		{
+			desc:          "open existing LUKS device",
+			outputScripts: []testingexec.FakeAction{blkidLuksAction, cryptsetupAction},
+			expectedPath:  "/dev/mapper/luks-vol_1",
+		},
+		{
+			desc:          "refuse to format device with file system",
+			outputScripts: []testingexec.FakeAction{blkidExt4Action},
+			expectedErr:   true,
+		},
+		{
+			desc:          "luksFormat failed",
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, cryptsetupFailedAction},
+			expectedErr:   true,
+		},
+		{
+			desc:          "luksOpen failed",
+			outputScripts: []testingexec.FakeAction{blkidLuksAction, cryptsetupFailedAction},
+			expectedErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+
+		path, err := openLuksDevice("/dev/sdd", "luks-vol_1", []byte("passphrase"), fakeMounter)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		assert.Equal(t, test.expectedPath, path, test.desc)
+	}
+}
+
+func TestGetLuksBackingDevice(t *testing.T) {
+	statusAction := func() ([]byte, []byte, error) {
+		return []byte(`/dev/mapper/luks-vol_1 is active and is in use.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: keyring
+  device:  /dev/sdc
+  sector size:  512
+  offset:  32768 sectors
+  size:    2064384 sectors
+  mode:    read/write
+`), []byte{}, nil
+	}
+	noDeviceAction := func() ([]byte, []byte, error) {
+		return []byte("/dev/mapper/luks-vol_1 is inactive."), []byte{}, nil
+	}
+	failedAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 4}
+	}
+
+	tests := []struct {
+		desc           string
+		outputScripts  []testingexec.FakeAction
+		expectedDevice string
+		expectedErr    bool
+	}{
+		{
+			desc:           "active device",
+			outputScripts:  []testingexec.FakeAction{statusAction},
+			expectedDevice: "/dev/sdc",
+		},
+		{
+			desc:          "no device line",
+			outputScripts: []testingexec.FakeAction{noDeviceAction},
+			expectedErr:   true,
+		},
+		{
+			desc:          "cryptsetup status failed",
+			outputScripts: []testingexec.FakeAction{failedAction},
+			expectedErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+
+		device, err := getLuksBackingDevice("luks-vol_1", fakeMounter)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		assert.Equal(t, test.expectedDevice, device, test.desc)
+	}
+}
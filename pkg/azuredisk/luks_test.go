@@ -0,0 +1,167 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+func TestGetLuksMapperName(t *testing.T) {
+	tests := []struct {
+		volumeID string
+		expected string
+	}{
+		{
+			volumeID: "/subscriptions/xxx/resourceGroups/rg/providers/Microsoft.Compute/disks/pvc-7c8e3d4b-Disk",
+			expected: "luks-pvc-7c8e3d4b-disk",
+		},
+		{
+			volumeID: "vol_1",
+			expected: "luks-vol_1",
+		},
+		{
+			volumeID: "vol 1:2",
+			expected: "luks-vol-1-2",
+		},
+		{
+			volumeID: strings.Repeat("a", 200),
+			expected: "luks-" + strings.Repeat("a", maxMapperNameLength-len(luksMapperPrefix)),
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getLuksMapperName(test.volumeID), "volumeID: %s", test.volumeID)
+	}
+}
+
+func TestGetLuksMapperPath(t *testing.T) {
+	assert.Equal(t, "/dev/mapper/luks-vol_1", filepath.ToSlash(getLuksMapperPath("luks-vol_1")))
+}
+
+func TestGetLuksKey(t *testing.T) {
+	keyDir := t.TempDir()
+	keyFile := filepath.Join(keyDir, "key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("keyfromfile"), 0600))
+	emptyKeyFile := filepath.Join(keyDir, "empty")
+	assert.NoError(t, os.WriteFile(emptyKeyFile, []byte{}, 0600))
+	notExistKeyFile := filepath.Join(keyDir, "notexist")
+	outsideKeyFile := filepath.Join(t.TempDir(), "outside")
+	assert.NoError(t, os.WriteFile(outsideKeyFile, []byte("keyoutside"), 0600))
+	symlinkKeyFile := filepath.Join(keyDir, "symlink")
+	symlinkErr := os.Symlink(outsideKeyFile, symlinkKeyFile)
+
+	tests := []struct {
+		desc        string
+		secrets     map[string]string
+		keyDir      string
+		skip        bool
+		expectedKey []byte
+		expectedErr bool
+	}{
+		{
+			desc:        "no secrets",
+			expectedErr: true,
+		},
+		{
+			desc:        "passphrase",
+			secrets:     map[string]string{consts.LuksPassphraseSecretKey: "passphrase"},
+			expectedKey: []byte("passphrase"),
+		},
+		{
+			desc: "passphrase takes precedence over key file",
+			secrets: map[string]string{
+				consts.LuksPassphraseSecretKey: "passphrase",
+				consts.LuksKeyFileSecretKey:    keyFile,
+			},
+			expectedKey: []byte("passphrase"),
+		},
+		{
+			desc:        "key file",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: keyFile},
+			keyDir:      keyDir,
+			expectedKey: []byte("keyfromfile"),
+		},
+		{
+			desc:        "key file relative to key dir",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: "key"},
+			keyDir:      keyDir,
+			expectedKey: []byte("keyfromfile"),
+		},
+		{
+			desc:        "empty key file",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: emptyKeyFile},
+			keyDir:      keyDir,
+			expectedErr: true,
+		},
+		{
+			desc:        "key file not found",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: notExistKeyFile},
+			keyDir:      keyDir,
+			expectedErr: true,
+		},
+		{
+			desc:        "key dir not configured",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: keyFile},
+			expectedErr: true,
+		},
+		{
+			desc:        "key file out of key dir",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: outsideKeyFile},
+			keyDir:      keyDir,
+			expectedErr: true,
+		},
+		{
+			desc:        "key file with ..",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: keyDir + "/../" + filepath.Base(keyDir) + "/key"},
+			keyDir:      keyDir,
+			expectedErr: true,
+		},
+		{
+			desc:        "relative key file with ..",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: "../outside"},
+			keyDir:      keyDir,
+			expectedErr: true,
+		},
+		{
+			desc:        "key dir itself",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: keyDir},
+			keyDir:      keyDir,
+			expectedErr: true,
+		},
+		{
+			desc:        "symbolic link to a key file out of key dir",
+			secrets:     map[string]string{consts.LuksKeyFileSecretKey: symlinkKeyFile},
+			keyDir:      keyDir,
+			skip:        symlinkErr != nil,
+			expectedErr: true,
+		},
+	}
+	for _, test := range tests {
+		if test.skip {
+			continue
+		}
+		key, err := getLuksKey(test.secrets, test.keyDir)
+		assert.Equal(t, test.expectedErr, err != nil, fmt.Sprintf("desc: %s, err: %v", test.desc, err))
+		assert.Equal(t, test.expectedKey, key, test.desc)
+	}
+}
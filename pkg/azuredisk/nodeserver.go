@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +32,7 @@ import (
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
@@ -58,7 +60,7 @@ func getDefaultFsType() string {
 }
 
 // NodeStageVolume mount disk device to a staging path
-func (d *Driver) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	diskURI := req.GetVolumeId()
 	if len(diskURI) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -84,6 +86,11 @@ func (d *Driver) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequ
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	// an unsupported encryption mode must not be staged as an unencrypted volume
+	if err := azureutils.ValidateEncryption(azureutils.GetEncryption(params)); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
 	if acquired := d.volumeLocks.TryAcquire(diskURI); !acquired {
 		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, diskURI)
 	}
@@ -94,11 +101,42 @@ func (d *Driver) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequ
 		return nil, status.Error(codes.InvalidArgument, "lun not provided")
 	}
 
-	source, err := d.getDevicePathWithLUN(lun)
+	source, err := d.discoverDevice(ctx, diskURI, lun)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to find disk on lun %s. %v", lun, err)
 	}
 
+	// register the key of the node on the shared disk, the reservation is taken on publish
+	if azureutils.IsPersistentReservationEnabled(params) {
+		if volumeCapability.GetBlock() == nil {
+			return nil, status.Error(codes.InvalidArgument, "persistent reservation is only supported on block volume")
+		}
+		if err := d.registerPersistentReservation(diskURI, source, target); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to register persistent reservation key of volume %s: %v", diskURI, err)
+		}
+	}
+
+	// member disks of a striped volume are tuned and assembled together
+	luns, devicePaths := []string{lun}, []string{source}
+	striped := azureutils.IsStripedVolumeID(diskURI)
+	if striped {
+		stripeLUNs := azureutils.GetStripeLUNs(req.PublishContext)
+		if len(stripeLUNs) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "stripe luns not provided")
+		}
+		luns = stripeLUNs
+		devicePaths = make([]string, 0, len(stripeLUNs))
+		for _, stripeLUN := range stripeLUNs {
+			devicePath, err := d.discoverDevice(ctx, diskURI, stripeLUN)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to find disk on lun %s. %v", stripeLUN, err)
+			}
+			devicePaths = append(devicePaths, devicePath)
+		}
+	}
+	d.trackVolumeIO(diskURI, req.GetVolumeContext(), luns, devicePaths)
+	d.trackAutoExpand(diskURI, params, volumeCapability)
+
 	// If perf optimizations are enabled
 	// tweak device settings to enhance performance
 	if d.getPerfOptimizationEnabled() {
@@ -108,15 +146,55 @@ func (d *Driver) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequ
 		}
 
 		if d.getDeviceHelper().DiskSupportsPerfOptimization(profile, accountType) {
-			if err := d.getDeviceHelper().OptimizeDiskPerformance(d.getNodeInfo(), source, profile, accountType,
-				diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettings); err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to optimize device performance for target(%s) error(%s)", source, err)
+			_, span := startSpan(ctx, "OptimizeDiskPerformance", diskURIAttributeKey.String(diskURI), attribute.String("azuredisk.perf_profile", profile))
+			for _, devicePath := range devicePaths {
+				if err := d.getDeviceHelper().OptimizeDiskPerformance(d.getNodeInfo(), devicePath, profile, accountType,
+					diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettings, getDeviceSettingsStateFile(target)); err != nil {
+					endSpan(span, err)
+					return nil, status.Errorf(codes.Internal, "failed to optimize device performance for target(%s) error(%s)", devicePath, err)
+				}
 			}
+			endSpan(span, nil)
+			d.trackDeviceSettings(diskURI, target)
 		} else {
 			klog.V(6).Infof("NodeStageVolume: perf optimization is disabled for %s. perfProfile %s accountType %s", source, profile, accountType)
 		}
 	}
 
+	if striped {
+		if _, ok := params[consts.VolumeAttributePartition]; ok {
+			return nil, status.Error(codes.InvalidArgument, "striped volume is not supported on a partition")
+		}
+		if source, err = assembleStripedVolume(devicePaths, getStripedVolumeGroupName(diskURI), azureutils.GetStripeSizeKiB(params), d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to assemble striped volume %s: %v", diskURI, err)
+		}
+	}
+
+	// If local cache is requested, stage the cached device in front of the managed disk
+	if localCache := azureutils.GetLocalCache(params); localCache != "" {
+		if _, ok := params[consts.VolumeAttributePartition]; ok {
+			return nil, status.Error(codes.InvalidArgument, "local cache is not supported on a partition")
+		}
+		if source, err = setupLocalCache(localCache, getLocalCacheName(diskURI), source, d.localCacheDevice, azureutils.GetLocalCacheSizeGiB(params), d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set up local cache of volume %s: %v", diskURI, err)
+		}
+	}
+
+	// If LUKS encryption is requested, stage the dm-crypt mapping instead of the raw device
+	encrypted := azureutils.GetEncryption(params) == consts.EncryptionLuks2
+	if encrypted {
+		if _, ok := params[consts.VolumeAttributePartition]; ok {
+			return nil, status.Error(codes.InvalidArgument, "LUKS encryption is not supported on a partition")
+		}
+		key, err := getLuksKey(req.GetSecrets(), d.luksKeyDir)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to get LUKS key of volume %s: %v", diskURI, err)
+		}
+		if source, err = openLuksDevice(source, getLuksMapperName(diskURI), key, d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to open LUKS device of volume %s: %v", diskURI, err)
+		}
+	}
+
 	// If the access type is block, do nothing for stage
 	switch req.GetVolumeCapability().GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
@@ -153,9 +231,19 @@ func (d *Driver) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequ
 		source = source + "-part" + partition
 	}
 
+	// check or repair the existing file system before it's mounted
+	if fsckPolicy := azureutils.GetFsckPolicy(params); fsckPolicy != "" {
+		if err := d.checkFilesystem(ctx, diskURI, source, fsckPolicy); err != nil {
+			return nil, err
+		}
+	}
+
 	// FormatAndMount will format only if needed
 	klog.V(2).Infof("NodeStageVolume: formatting %s and mounting at %s with mount options(%s)", source, target, options)
-	if err := d.formatAndMount(source, target, fstype, options); err != nil {
+	_, span := startSpan(ctx, "FormatAndMount", diskURIAttributeKey.String(diskURI), attribute.String("azuredisk.fs_type", fstype))
+	err = d.formatAndMount(source, target, fstype, options)
+	endSpan(span, err)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not format %s(lun: %s), and mount it at %s, failed with %v", source, lun, target, err)
 	}
 	klog.V(2).Infof("NodeStageVolume: format %s and mounting at %s successfully.", source, target)
@@ -173,7 +261,10 @@ func (d *Driver) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequ
 	// if resize is required, resize filesystem
 	if needResize {
 		klog.V(2).Infof("NodeStageVolume: fs resize initiating on target(%s) volumeid(%s)", target, diskURI)
-		if err := resizeVolume(source, target, d.mounter); err != nil {
+		_, span := startSpan(ctx, "resizeVolume", diskURIAttributeKey.String(diskURI))
+		err := resizeVolume(source, target, d.mounter)
+		endSpan(span, err)
+		if err != nil {
 			return nil, status.Errorf(codes.Internal, "NodeStageVolume: could not resize volume %s (%s):  %v", source, target, err)
 		}
 		klog.V(2).Infof("NodeStageVolume: fs resize successful on target(%s) volumeid(%s).", target, diskURI)
@@ -198,6 +289,10 @@ func (d *Driver) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageVolume
 	}
 	defer d.volumeLocks.Release(volumeID)
 
+	if err := d.unregisterPersistentReservation(volumeID, stagingTargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unregister persistent reservation key of volume %s: %v", volumeID, err)
+	}
+
 	klog.V(2).Infof("NodeUnstageVolume: unmounting %s", stagingTargetPath)
 	err := CleanupMountPoint(stagingTargetPath, d.mounter, true /*extensiveMountPointCheck*/)
 	if err != nil {
@@ -205,11 +300,26 @@ func (d *Driver) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageVolume
 	}
 	klog.V(2).Infof("NodeUnstageVolume: unmount %s successfully", stagingTargetPath)
 
+	if err := closeLuksDevice(getLuksMapperName(volumeID), d.mounter); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to close LUKS device of volume %s: %v", volumeID, err)
+	}
+	if err := teardownLocalCache(getLocalCacheName(volumeID), d.mounter); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to tear down local cache of volume %s: %v", volumeID, err)
+	}
+	if azureutils.IsStripedVolumeID(volumeID) {
+		if err := deactivateStripedVolume(getStripedVolumeGroupName(volumeID), d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to deactivate striped volume %s: %v", volumeID, err)
+		}
+	}
+	d.restoreDeviceSettings(volumeID, stagingTargetPath)
+	d.untrackVolumeIO(volumeID)
+	d.untrackAutoExpand(volumeID)
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 // NodePublishVolume mount the volume from staging to target path
-func (d *Driver) NodePublishVolume(_ context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in the request")
@@ -245,6 +355,13 @@ func (d *Driver) NodePublishVolume(_ context.Context, req *csi.NodePublishVolume
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Target path could not be prepared: %v", err))
 	}
 
+	// keep checking the tuned device settings of a volume staged before the driver restarts
+	if d.getPerfOptimizationEnabled() {
+		d.trackDeviceSettings(volumeID, source)
+	}
+	d.recoverVolumeIO(volumeID, params, req.GetPublishContext())
+	d.trackAutoExpand(volumeID, params, volumeCapability)
+
 	mountOptions := []string{"bind"}
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
@@ -261,11 +378,33 @@ func (d *Driver) NodePublishVolume(_ context.Context, req *csi.NodePublishVolume
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to find device path with lun %s. %v", lun, err)
 		}
+		if azureutils.IsPersistentReservationEnabled(params) {
+			if err := d.reservePersistentReservation(volumeID, source, getReservationType(volumeCapability, req.GetReadonly())); err != nil {
+				return nil, err
+			}
+		}
+		if azureutils.IsStripedVolumeID(volumeID) {
+			source = getStripedLogicalVolumePath(getStripedVolumeGroupName(volumeID))
+		}
+		if azureutils.GetLocalCache(params) != "" {
+			if localCachePath := getLocalCacheDevicePath(getLocalCacheName(volumeID)); localCachePath != "" {
+				source = localCachePath
+			}
+		}
+		if azureutils.GetEncryption(params) == consts.EncryptionLuks2 {
+			source = getLuksMapperPath(getLuksMapperName(volumeID))
+		}
 		klog.V(2).Infof("NodePublishVolume [block]: found device path %s with lun %s", source, lun)
+		if err := d.applyPodIOLimits(volumeID, source, target, params); err != nil {
+			return nil, err
+		}
 		if err = d.ensureBlockTargetFile(target); err != nil {
 			return nil, status.Errorf(codes.Internal, err.Error())
 		}
 	case *csi.VolumeCapability_Mount:
+		if err := d.applyPodIOLimits(volumeID, source, target, params); err != nil {
+			return nil, err
+		}
 		mnt, err := d.ensureMountPoint(target)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "could not mount target %q: %v", target, err)
@@ -298,6 +437,10 @@ func (d *Driver) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpublishVo
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if err := d.removePodIOLimits(volumeID, targetPath); err != nil {
+		klog.Warningf("NodeUnpublishVolume: %v", err)
+	}
+
 	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
 	err := CleanupMountPoint(targetPath, d.mounter, true /*extensiveMountPointCheck*/)
 	if err != nil {
@@ -328,16 +471,16 @@ func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*c
 	if d.supportZone {
 		var zone cloudprovider.Zone
 		if d.getNodeInfoFromLabels {
-			failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+			failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 		} else {
-			if runtime.GOOS == "windows" && (!d.cloud.UseInstanceMetadata || d.cloud.Metadata == nil) {
-				zone, err = d.cloud.VMSet.GetZoneByNodeName(d.NodeID)
+			if runtime.GOOS == "windows" && (!d.getCloud().UseInstanceMetadata || d.getCloud().Metadata == nil) {
+				zone, err = d.getCloud().VMSet.GetZoneByNodeName(d.NodeID)
 			} else {
-				zone, err = d.cloud.GetZone(ctx)
+				zone, err = d.getCloud().GetZone(ctx)
 			}
 			if err != nil {
 				klog.Warningf("get zone(%s) failed with: %v, fall back to get zone from node labels", d.NodeID, err)
-				failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+				failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 			}
 		}
 		if err != nil {
@@ -348,10 +491,14 @@ func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*c
 		}
 
 		klog.V(2).Infof("NodeGetInfo, nodeName: %s, failureDomain: %s", d.NodeID, zone.FailureDomain)
-		if azureutils.IsValidAvailabilityZone(zone.FailureDomain, d.cloud.Location) {
+		if azureutils.IsValidAvailabilityZone(zone.FailureDomain, d.getCloud().Location) {
 			topology.Segments[topologyKey] = zone.FailureDomain
 			topology.Segments[consts.WellKnownTopologyKey] = zone.FailureDomain
 		}
+		if edgeZone := d.getNodeEdgeZone(ctx); edgeZone != "" {
+			klog.V(2).Infof("NodeGetInfo, nodeName: %s, edgeZone: %s", d.NodeID, edgeZone)
+			topology.Segments[consts.EdgeZoneTopologyKey] = edgeZone
+		}
 	}
 
 	maxDataDiskCount := d.VolumeAttachLimit
@@ -360,18 +507,18 @@ func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*c
 		var err error
 		if d.getNodeInfoFromLabels {
 			if instanceTypeFromLabels == "" {
-				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 			}
 		} else {
-			if runtime.GOOS == "windows" && d.cloud.UseInstanceMetadata && d.cloud.Metadata != nil {
+			if runtime.GOOS == "windows" && d.getCloud().UseInstanceMetadata && d.getCloud().Metadata != nil {
 				var metadata *azure.InstanceMetadata
-				metadata, err = d.cloud.Metadata.GetMetadata(azcache.CacheReadTypeDefault)
+				metadata, err = d.getCloud().Metadata.GetMetadata(azcache.CacheReadTypeDefault)
 				if err == nil && metadata != nil && metadata.Compute != nil {
 					instanceType = metadata.Compute.VMSize
 					klog.V(2).Infof("NodeGetInfo: nodeName(%s), VM Size(%s)", d.NodeID, instanceType)
 				}
 			} else {
-				instances, ok := d.cloud.Instances()
+				instances, ok := d.getCloud().Instances()
 				if !ok {
 					klog.Warningf("failed to get instances from cloud provider")
 				} else {
@@ -383,7 +530,7 @@ func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*c
 			}
 			if instanceType == "" && instanceTypeFromLabels == "" {
 				klog.Warningf("fall back to get instance type from node labels")
-				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 			}
 		}
 		if err != nil {
@@ -396,8 +543,8 @@ func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*c
 	}
 
 	nodeID := d.NodeID
-	if d.getNodeIDFromIMDS && d.cloud.UseInstanceMetadata && d.cloud.Metadata != nil {
-		metadata, err := d.cloud.Metadata.GetMetadata(azcache.CacheReadTypeDefault)
+	if d.getNodeIDFromIMDS && d.getCloud().UseInstanceMetadata && d.getCloud().Metadata != nil {
+		metadata, err := d.getCloud().Metadata.GetMetadata(azcache.CacheReadTypeDefault)
 		if err == nil && metadata != nil && metadata.Compute != nil {
 			klog.V(2).Infof("NodeGetInfo: NodeID(%s), metadata.Compute.Name(%s)", d.NodeID, metadata.Compute.Name)
 			if metadata.Compute.Name != "" {
@@ -424,7 +571,15 @@ func (d *Driver) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*c
 	}, nil
 }
 
+// getMaxDataDiskCount returns the max data disk count of a VM size from the SKU catalog loaded from the Resource SKUs API,
+// the cache file or the override file, and then from the embedded maps
 func getMaxDataDiskCount(instanceType string) int64 {
+	skuCatalog := optimization.GetSkuCatalog()
+	if vmSku, ok := skuCatalog.GetLoadedVMSku(instanceType); ok && vmSku.MaxDataDiskCount > 0 {
+		klog.V(5).Infof("got a matching size in SKU catalog, VM Size: %s, MaxDataDiskCount: %d", instanceType, vmSku.MaxDataDiskCount)
+		return int64(vmSku.MaxDataDiskCount)
+	}
+
 	vmsize := strings.ToUpper(instanceType)
 	maxDataDiskCount, exists := maxDataDiskCountMap[vmsize]
 	if exists {
@@ -432,6 +587,11 @@ func getMaxDataDiskCount(instanceType string) int64 {
 		return maxDataDiskCount
 	}
 
+	if vmSku, ok := skuCatalog.GetVMSku(instanceType); ok && vmSku.MaxDataDiskCount > 0 {
+		klog.V(5).Infof("got a matching size in embedded SKU map, VM Size: %s, MaxDataDiskCount: %d", vmsize, vmSku.MaxDataDiskCount)
+		return int64(vmSku.MaxDataDiskCount)
+	}
+
 	klog.V(5).Infof("not found a matching size in getMaxDataDiskCount, VM Size: %s, use default volume limit: %d", vmsize, defaultAzureVolumeLimit)
 	return defaultAzureVolumeLimit
 }
@@ -447,9 +607,24 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 	volUsage, err := d.GetVolumeStats(ctx, d.mounter, req.VolumeId, req.VolumePath, d.hostUtil)
 	if err != nil {
 		klog.Errorf("NodeGetVolumeStats: failed to get volume stats for volume %s path %s: %v", req.VolumeId, req.VolumePath, err)
+		if status.Code(err) == codes.NotFound {
+			return &csi.NodeGetVolumeStatsResponse{
+				Usage: volUsage,
+			}, err
+		}
+	} else {
+		d.recordVolumeUsage(req.VolumeId, volUsage)
+	}
+
+	volumeCondition := getVolumeCondition(req.VolumePath, d.hostUtil)
+	if volumeCondition.GetAbnormal() {
+		klog.Warningf("NodeGetVolumeStats: volume %s path %s is abnormal: %s", req.VolumeId, req.VolumePath, volumeCondition.GetMessage())
+		// usage could not be collected on an unhealthy volume, report the condition instead of the error
+		err = nil
 	}
 	return &csi.NodeGetVolumeStatsResponse{
-		Usage: volUsage,
+		Usage:           volUsage,
+		VolumeCondition: volumeCondition,
 	}, err
 }
 
@@ -479,6 +654,8 @@ func (d *Driver) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVolumeRe
 		}
 	}
 
+	isStriped := azureutils.IsStripedVolumeID(volumeID)
+	localCacheName := getLocalCacheName(volumeID)
 	if isBlock {
 		if d.enableDiskOnlineResize {
 			klog.V(2).Infof("NodeExpandVolume begin to rescan all devices on block volume(%s)", volumeID)
@@ -486,6 +663,14 @@ func (d *Driver) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVolumeRe
 				klog.Errorf("NodeExpandVolume rescanAllVolumes failed with error: %v", err)
 			}
 		}
+		if isStriped {
+			if err := growStripedVolume(getStripedVolumeGroupName(volumeID), d.mounter); err != nil {
+				return nil, status.Errorf(codes.Internal, "could not grow striped volume %q: %v", volumeID, err)
+			}
+		}
+		if err := resizeLocalCache(localCacheName, d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not resize local cache of volume %q: %v", volumeID, err)
+		}
 		klog.V(2).Infof("NodeExpandVolume skip resize operation on block volume(%s)", volumeID)
 		return &csi.NodeExpandVolumeResponse{}, nil
 	}
@@ -500,10 +685,51 @@ func (d *Driver) NodeExpandVolume(_ context.Context, req *csi.NodeExpandVolumeRe
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
 
+	// the origin device of a local cache is not on the mount path, rescan all devices instead
+	hasLocalCache := getLocalCacheDevicePath(localCacheName) != ""
+	luksMapperName := getLuksMapperName(volumeID)
+	isLuksDevice := devicePath == getLuksMapperPath(luksMapperName)
+	rescanDevicePath := devicePath
+	if isLuksDevice && !isStriped && !hasLocalCache {
+		if rescanDevicePath, err = getLuksBackingDevice(luksMapperName, d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+	}
+
 	if d.enableDiskOnlineResize {
-		klog.V(2).Infof("NodeExpandVolume begin to rescan device %s on volume(%s)", devicePath, volumeID)
-		if err := rescanVolume(d.ioHandler, devicePath); err != nil {
-			klog.Errorf("NodeExpandVolume rescanVolume failed with error: %v", err)
+		if isStriped || hasLocalCache {
+			klog.V(2).Infof("NodeExpandVolume begin to rescan all devices on volume(%s)", volumeID)
+			if err := rescanAllVolumes(d.ioHandler); err != nil {
+				klog.Errorf("NodeExpandVolume rescanAllVolumes failed with error: %v", err)
+			}
+		} else {
+			klog.V(2).Infof("NodeExpandVolume begin to rescan device %s on volume(%s)", rescanDevicePath, volumeID)
+			if err := rescanVolume(d.ioHandler, rescanDevicePath); err != nil {
+				klog.Errorf("NodeExpandVolume rescanVolume failed with error: %v", err)
+			}
+		}
+	}
+
+	if isStriped {
+		klog.V(2).Infof("NodeExpandVolume begin to grow striped volume(%s)", volumeID)
+		if err := growStripedVolume(getStripedVolumeGroupName(volumeID), d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not grow striped volume %q: %v", volumeID, err)
+		}
+	}
+
+	if hasLocalCache {
+		klog.V(2).Infof("NodeExpandVolume begin to resize local cache of volume(%s)", volumeID)
+		if err := resizeLocalCache(localCacheName, d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not resize local cache of volume %q: %v", volumeID, err)
+		}
+	}
+
+	if isLuksDevice {
+		// the key is optional here since cryptsetup could reuse the volume key in kernel keyring
+		key, _ := getLuksKey(req.GetSecrets(), d.luksKeyDir)
+		klog.V(2).Infof("NodeExpandVolume begin to resize LUKS device %s on volume(%s)", devicePath, volumeID)
+		if err := resizeLuksDevice(luksMapperName, key, d.mounter); err != nil {
+			return nil, status.Errorf(codes.Internal, "could not resize LUKS device of volume %q: %v", volumeID, err)
 		}
 	}
 
@@ -603,6 +829,18 @@ func (d *Driver) formatAndMount(source, target, fstype string, options []string)
 	return formatAndMount(source, target, fstype, options, d.mounter)
 }
 
+// discoverDevice returns the device path of the disk attached on lun in a span
+func (d *Driver) discoverDevice(ctx context.Context, diskURI, lun string) (string, error) {
+	attributes := []attribute.KeyValue{diskURIAttributeKey.String(diskURI)}
+	if lunNum, err := strconv.Atoi(lun); err == nil {
+		attributes = append(attributes, lunAttributeKey.Int(lunNum))
+	}
+	_, span := startSpan(ctx, "getDevicePathWithLUN", attributes...)
+	devicePath, err := d.getDevicePathWithLUN(lun)
+	endSpan(span, err)
+	return devicePath, err
+}
+
 func (d *Driver) getDevicePathWithLUN(lunStr string) (string, error) {
 	lun, err := azureutils.GetDiskLUN(lunStr)
 	if err != nil {
@@ -417,6 +417,17 @@ func TestNodeStageVolume(t *testing.T) {
 	volumeContextWithPerfProfileField := map[string]string{
 		consts.PerfProfileField: "wrong",
 	}
+	volumeContextWithEncryption := map[string]string{
+		consts.EncryptionField: consts.EncryptionLuks2,
+	}
+	volumeContextWithEncryptionOnPartition := map[string]string{
+		consts.EncryptionField:          consts.EncryptionLuks2,
+		consts.VolumeAttributePartition: "1",
+	}
+	stripedVolumeID := azureutils.GetStripedVolumeID(fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "pvc-xxx"), 2)
+	luksSecrets := map[string]string{
+		consts.LuksPassphraseSecretKey: "passphrase",
+	}
 
 	stdVolCapBlock := &csi.VolumeCapability_Block{
 		Block: &csi.VolumeCapability_BlockVolume{},
@@ -430,6 +441,10 @@ func TestNodeStageVolume(t *testing.T) {
 	publishContext := map[string]string{
 		consts.LUN: "/dev/disk/azure/scsi1/lun1",
 	}
+	stripedPublishContext := map[string]string{
+		consts.LUN:        "/dev/disk/azure/scsi1/lun1",
+		consts.StripeLUNs: "/dev/disk/azure/scsi1/lun1,/dev/disk/azure/scsi1/lun1",
+	}
 
 	blkidAction := func() ([]byte, []byte, error) {
 		return []byte("DEVICE=/dev/sdd\nTYPE=ext4"), []byte{}, nil
@@ -443,6 +458,15 @@ func TestNodeStageVolume(t *testing.T) {
 	resize2fsAction := func() ([]byte, []byte, error) {
 		return []byte{}, []byte{}, nil
 	}
+	blkidNoFormatAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 2}
+	}
+	cryptsetupAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	cryptsetupFailedAction := func() ([]byte, []byte, error) {
+		return []byte("No key available with this passphrase."), []byte{}, &testingexec.FakeExitError{Status: 2}
+	}
 
 	tests := []struct {
 		desc          string
@@ -568,7 +592,7 @@ func TestNodeStageVolume(t *testing.T) {
 					DiskSupportsPerfOptimization(gomock.Any(), gomock.Any()).
 					Return(true)
 				mockoptimization.EXPECT().
-					OptimizeDiskPerformance(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					OptimizeDiskPerformance(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
 					Return(nil).
 					After(diskSupportsPerfOptimizationCall)
 
@@ -596,7 +620,7 @@ func TestNodeStageVolume(t *testing.T) {
 					DiskSupportsPerfOptimization(gomock.Any(), gomock.Any()).
 					Return(true)
 				mockoptimization.EXPECT().
-					OptimizeDiskPerformance(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					OptimizeDiskPerformance(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
 					Return(fmt.Errorf("failed to optimize device performance")).
 					After(diskSupportsPerfOptimizationCall)
 
@@ -637,6 +661,139 @@ func TestNodeStageVolume(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			desc:          "Stripe luns not provided",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			req: csi.NodeStageVolumeRequest{VolumeId: stripedVolumeID, StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  volumeContext,
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "stripe luns not provided"),
+		},
+		{
+			desc:          "Striped volume on partition",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			req: csi.NodeStageVolumeRequest{VolumeId: stripedVolumeID, StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: stripedPublishContext,
+				VolumeContext:  map[string]string{consts.VolumeAttributePartition: "1"},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "striped volume is not supported on a partition"),
+		},
+		{
+			desc:          "Local cache on partition",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  map[string]string{consts.LocalCacheField: consts.LocalCacheDmCache, consts.VolumeAttributePartition: "1"},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "local cache is not supported on a partition"),
+		},
+		{
+			desc:          "Successfully staged with dm-cache local cache when local cache device is not configured",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			setupFunc: func(t *testing.T, d FakeDriver) {
+				d.setNextCommandOutputScripts(blkidAction, fsckAction, blockSizeAction, blkidAction, blockSizeAction, blkidAction)
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  map[string]string{consts.LocalCacheField: consts.LocalCacheDmCache},
+			},
+			expectedErr: nil,
+		},
+		{
+			desc:          "Persistent reservation on mount volume",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  map[string]string{consts.PersistentReservationField: consts.TrueValue},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "persistent reservation is only supported on block volume"),
+		},
+		{
+			desc: "unsupported encryption",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  map[string]string{consts.EncryptionField: "luks1"},
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "encryption(luks1) is not supported, supported values are none and luks2"),
+		},
+		{
+			desc:          "LUKS key not provided",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  volumeContextWithEncryption,
+			},
+			expectedErr: status.Errorf(codes.InvalidArgument, "failed to get LUKS key of volume vol_1: %v",
+				fmt.Errorf("neither %s nor %s is provided in node stage secrets", consts.LuksPassphraseSecretKey, consts.LuksKeyFileSecretKey)),
+		},
+		{
+			desc:          "LUKS encryption on partition",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  volumeContextWithEncryptionOnPartition,
+				Secrets:        luksSecrets,
+			},
+			expectedErr: status.Error(codes.InvalidArgument, "LUKS encryption is not supported on a partition"),
+		},
+		{
+			desc:          "failed to open LUKS device",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			setupFunc: func(t *testing.T, d FakeDriver) {
+				d.setNextCommandOutputScripts(blkidNoFormatAction, cryptsetupAction, cryptsetupFailedAction)
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  volumeContextWithEncryption,
+				Secrets:        luksSecrets,
+			},
+			expectedErr: status.Errorf(codes.Internal, "failed to open LUKS device of volume vol_1: %v",
+				fmt.Errorf("failed to open LUKS device /dev/sdd as luks-vol_1: exit 2, output: No key available with this passphrase.")),
+		},
+		{
+			desc:          "Successfully staged with LUKS encryption",
+			skipOnDarwin:  true,
+			skipOnWindows: true,
+			setupFunc: func(t *testing.T, d FakeDriver) {
+				d.setNextCommandOutputScripts(blkidNoFormatAction, cryptsetupAction, cryptsetupAction,
+					blkidAction, fsckAction, blockSizeAction, blkidAction, blockSizeAction, blkidAction)
+			},
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: sourceTest,
+				VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap,
+					AccessType: stdVolCap},
+				PublishContext: publishContext,
+				VolumeContext:  volumeContextWithEncryption,
+				Secrets:        luksSecrets,
+			},
+			expectedErr: nil,
+		},
 	}
 
 	for _, test := range tests {
@@ -85,6 +85,7 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to find disk on lun %s. %v", lun, err)
 	}
+	d.trackVolumeIO(diskURI, req.GetVolumeContext(), []string{lun}, []string{source})
 
 	// If perf optimizations are enabled
 	// tweak device settings to enhance performance
@@ -96,7 +97,7 @@ func (d *DriverV2) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolume
 
 		if d.getDeviceHelper().DiskSupportsPerfOptimization(profile, accountType) {
 			if err := d.getDeviceHelper().OptimizeDiskPerformance(d.getNodeInfo(), source, profile, accountType,
-				diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettings); err != nil {
+				diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettings, getDeviceSettingsStateFile(target)); err != nil {
 				return nil, status.Errorf(codes.Internal, "failed to optimize device performance for target(%s) error(%s)", source, err)
 			}
 		} else {
@@ -191,6 +192,8 @@ func (d *DriverV2) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVo
 		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", stagingTargetPath, err)
 	}
 	klog.V(2).Infof("NodeUnstageVolume: unmount %s successfully", stagingTargetPath)
+	d.restoreDeviceSettings(volumeID, stagingTargetPath)
+	d.untrackVolumeIO(volumeID)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -237,6 +240,8 @@ func (d *DriverV2) NodePublishVolume(ctx context.Context, req *csi.NodePublishVo
 	}
 	defer d.volumeLocks.Release(volumeID)
 
+	d.recoverVolumeIO(volumeID, req.GetVolumeContext(), req.GetPublishContext())
+
 	mountOptions := []string{"bind"}
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
@@ -324,16 +329,16 @@ func (d *DriverV2) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest)
 	if d.supportZone {
 		var zone cloudprovider.Zone
 		if d.getNodeInfoFromLabels {
-			failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+			failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 		} else {
-			if runtime.GOOS == "windows" && (!d.cloud.UseInstanceMetadata || d.cloud.Metadata == nil) {
-				zone, err = d.cloud.VMSet.GetZoneByNodeName(d.NodeID)
+			if runtime.GOOS == "windows" && (!d.getCloud().UseInstanceMetadata || d.getCloud().Metadata == nil) {
+				zone, err = d.getCloud().VMSet.GetZoneByNodeName(d.NodeID)
 			} else {
-				zone, err = d.cloud.GetZone(ctx)
+				zone, err = d.getCloud().GetZone(ctx)
 			}
 			if err != nil {
 				klog.Warningf("get zone(%s) failed with: %v, fall back to get zone from node labels", d.NodeID, err)
-				failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+				failureDomainFromLabels, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 			}
 		}
 		if err != nil {
@@ -344,7 +349,7 @@ func (d *DriverV2) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest)
 		}
 
 		klog.V(2).Infof("NodeGetInfo, nodeName: %s, failureDomain: %s", d.NodeID, zone.FailureDomain)
-		if azureutils.IsValidAvailabilityZone(zone.FailureDomain, d.cloud.Location) {
+		if azureutils.IsValidAvailabilityZone(zone.FailureDomain, d.getCloud().Location) {
 			topology.Segments[topologyKey] = zone.FailureDomain
 			topology.Segments[consts.WellKnownTopologyKey] = zone.FailureDomain
 		}
@@ -356,17 +361,17 @@ func (d *DriverV2) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest)
 		var err error
 		if d.getNodeInfoFromLabels {
 			if instanceTypeFromLabels == "" {
-				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 			}
 		} else {
-			if runtime.GOOS == "windows" && d.cloud.UseInstanceMetadata && d.cloud.Metadata != nil {
-				metadata, err := d.cloud.Metadata.GetMetadata(azcache.CacheReadTypeDefault)
+			if runtime.GOOS == "windows" && d.getCloud().UseInstanceMetadata && d.getCloud().Metadata != nil {
+				metadata, err := d.getCloud().Metadata.GetMetadata(azcache.CacheReadTypeDefault)
 				if err == nil && metadata.Compute != nil {
 					instanceType = metadata.Compute.VMSize
 					klog.V(5).Infof("NodeGetInfo: nodeName(%s), VM Size(%s)", d.NodeID, instanceType)
 				}
 			} else {
-				instances, ok := d.cloud.Instances()
+				instances, ok := d.getCloud().Instances()
 				if !ok {
 					klog.Warningf("failed to get instances from cloud provider")
 				} else {
@@ -378,7 +383,7 @@ func (d *DriverV2) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest)
 			}
 			if instanceType == "" && instanceTypeFromLabels == "" {
 				klog.Warningf("fall back to get instance type from node labels")
-				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.cloud.KubeClient)
+				_, instanceTypeFromLabels, err = getNodeInfoFromLabels(ctx, d.NodeID, d.getCloud().KubeClient)
 			}
 		}
 		if err != nil {
@@ -406,8 +411,21 @@ func (d *DriverV2) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolum
 	}
 
 	volUsage, err := d.GetVolumeStats(ctx, d.mounter, req.VolumeId, req.VolumePath, d.hostUtil)
+	if err != nil && status.Code(err) == codes.NotFound {
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: volUsage,
+		}, err
+	}
+
+	volumeCondition := getVolumeCondition(req.VolumePath, d.hostUtil)
+	if volumeCondition.GetAbnormal() {
+		klog.Warningf("NodeGetVolumeStats: volume %s path %s is abnormal: %s", req.VolumeId, req.VolumePath, volumeCondition.GetMessage())
+		// usage could not be collected on an unhealthy volume, report the condition instead of the error
+		err = nil
+	}
 	return &csi.NodeGetVolumeStatsResponse{
-		Usage: volUsage,
+		Usage:           volUsage,
+		VolumeCondition: volumeCondition,
 	}, err
 }
 
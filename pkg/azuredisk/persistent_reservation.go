@@ -0,0 +1,221 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// SCSI-3 persistent reservation types
+const (
+	// prTypeNone means the node only registers its key without taking a reservation
+	prTypeNone                         uint8 = 0x0
+	prTypeWriteExclusive               uint8 = 0x1
+	prTypeWriteExclusiveAllRegistrants uint8 = 0x7
+
+	// persistentReservationStateFile is written in the staging path of a volume,
+	// it records the device and the key registered on NodeStageVolume for NodeUnstageVolume
+	persistentReservationStateFile = ".azuredisk-persistent-reservation"
+
+	// reservationKeyPrefix is in the top 16 bits of the keys registered by the driver,
+	// so that the keys of other initiators sharing the disk are never preempted
+	reservationKeyPrefix     uint64 = 0x415a << 48
+	reservationKeyPrefixMask uint64 = 0xffff << 48
+)
+
+// errReservationConflict is returned if a persistent reservation command is rejected with RESERVATION CONFLICT status
+var errReservationConflict = errors.New("reservation conflict")
+
+// scsiReservation is the persistent reservation held on a device
+type scsiReservation struct {
+	// key is the reservation key of the holder, it's 0 for all registrants reservation
+	key    uint64
+	prType uint8
+}
+
+// scsiPersistentReservation issues SCSI-3 persistent reservation commands to a block device
+type scsiPersistentReservation interface {
+	// Register registers key on device, an existing key of the node is replaced
+	Register(device string, key uint64) error
+	// Unregister removes the registration of key, the reservation held by key is released
+	Unregister(device string, key uint64) error
+	// Reserve takes a reservation of prType with a registered key
+	Reserve(device string, key uint64, prType uint8) error
+	// PreemptAndAbort removes the registration and the reservation of victimKey and aborts its outstanding commands
+	PreemptAndAbort(device string, key, victimKey uint64, prType uint8) error
+	// ReadKeys returns all keys registered on device
+	ReadKeys(device string) ([]uint64, error)
+	// ReadReservation returns the reservation held on device, nil is returned if there is no reservation
+	ReadReservation(device string) (*scsiReservation, error)
+}
+
+// persistentReservationState is persisted in persistentReservationStateFile
+type persistentReservationState struct {
+	Device string `json:"device"`
+	Key    uint64 `json:"key"`
+}
+
+// getReservationKey returns the reservation key of a node, it's derived from the node name
+// so that the key of a removed node could still be identified. The key is never 0, which means unregistration.
+func getReservationKey(nodeName string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nodeName))
+	return reservationKeyPrefix | h.Sum64()&^reservationKeyPrefixMask
+}
+
+// isDriverReservationKey returns whether the key is registered by the driver
+func isDriverReservationKey(key uint64) bool {
+	return key&reservationKeyPrefixMask == reservationKeyPrefix
+}
+
+// getReservationType returns the reservation type taken on publish according to the access mode:
+// multiple writers share a write exclusive all registrants reservation, a single writer takes a write exclusive reservation,
+// and readers only register their keys
+func getReservationType(volumeCapability *csi.VolumeCapability, readonly bool) uint8 {
+	if readonly {
+		return prTypeNone
+	}
+	switch volumeCapability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return prTypeWriteExclusiveAllRegistrants
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		return prTypeNone
+	}
+	return prTypeWriteExclusive
+}
+
+// registerPersistentReservation registers the key of the node on device and records it in the staging path
+func (d *DriverCore) registerPersistentReservation(volumeID, device, stagingPath string) error {
+	key := getReservationKey(d.NodeID)
+	if err := d.scsiPR.Register(device, key); err != nil {
+		return err
+	}
+	klog.V(2).Infof("registerPersistentReservation: registered key %#x of node %s on %s of volume %s", key, d.NodeID, device, volumeID)
+
+	state, err := json.Marshal(persistentReservationState{Device: device, Key: key})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stagingPath, 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stagingPath, persistentReservationStateFile), state, 0600)
+}
+
+// unregisterPersistentReservation removes the key registered on NodeStageVolume, it's a no-op if no key was registered
+func (d *DriverCore) unregisterPersistentReservation(volumeID, stagingPath string) error {
+	stateFile := filepath.Join(stagingPath, persistentReservationStateFile)
+	content, err := os.ReadFile(stateFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var state persistentReservationState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", stateFile, err)
+	}
+
+	if err := d.scsiPR.Unregister(state.Device, state.Key); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		klog.Warningf("unregisterPersistentReservation: device %s of volume %s is gone, skip unregistering key %#x", state.Device, volumeID, state.Key)
+	} else {
+		klog.V(2).Infof("unregisterPersistentReservation: unregistered key %#x on %s of volume %s", state.Key, state.Device, volumeID)
+	}
+	return os.Remove(stateFile)
+}
+
+// reservePersistentReservation takes the reservation of prType on device. A reservation held by a NotReady or removed node
+// conflicts until the controller fences the node, see fencePersistentReservations.
+func (d *DriverCore) reservePersistentReservation(volumeID, device string, prType uint8) error {
+	if prType == prTypeNone {
+		return nil
+	}
+	key := getReservationKey(d.NodeID)
+
+	reservation, err := d.scsiPR.ReadReservation(device)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read persistent reservation on %s of volume %s: %v", device, volumeID, err)
+	}
+	if reservation != nil {
+		if reservation.prType == prType && (reservation.key == key || prType == prTypeWriteExclusiveAllRegistrants) {
+			klog.V(4).Infof("reservePersistentReservation: reservation(type %#x) on %s of volume %s is already held", prType, device, volumeID)
+			return nil
+		}
+		return status.Errorf(codes.FailedPrecondition, "volume %s is reserved by key %#x with type %#x, the access mode conflicts with the existing reservation", volumeID, reservation.key, reservation.prType)
+	}
+
+	if err := d.scsiPR.Reserve(device, key, prType); err != nil {
+		if errors.Is(err, errReservationConflict) {
+			return status.Errorf(codes.FailedPrecondition, "failed to reserve volume %s: %v", volumeID, err)
+		}
+		return status.Errorf(codes.Internal, "failed to reserve %s of volume %s: %v", device, volumeID, err)
+	}
+	klog.V(2).Infof("reservePersistentReservation: reserved %s of volume %s with key %#x and type %#x", device, volumeID, key, prType)
+	return nil
+}
+
+// preemptReservationKeys preempts and aborts the registered keys of fencedKeys with the key of the node,
+// so that the NotReady or removed nodes could never write to the volume again. Only the keys of the driver are preempted.
+func (d *DriverCore) preemptReservationKeys(volumeName, device string, fencedKeys []uint64) error {
+	key := getReservationKey(d.NodeID)
+	keys, err := d.scsiPR.ReadKeys(device)
+	if err != nil {
+		return fmt.Errorf("failed to read registered keys on %s of volume %s: %v", device, volumeName, err)
+	}
+	registered := make(map[uint64]bool, len(keys))
+	for _, registeredKey := range keys {
+		registered[registeredKey] = true
+	}
+	if !registered[key] {
+		return fmt.Errorf("key %#x of node %s is not registered on %s of volume %s", key, d.NodeID, device, volumeName)
+	}
+	// the reservation taken over from a preempted holder keeps its type
+	prType := prTypeWriteExclusive
+	reservation, err := d.scsiPR.ReadReservation(device)
+	if err != nil {
+		return fmt.Errorf("failed to read persistent reservation on %s of volume %s: %v", device, volumeName, err)
+	}
+	if reservation != nil {
+		prType = reservation.prType
+	}
+
+	for _, fencedKey := range fencedKeys {
+		if fencedKey == key || !registered[fencedKey] || !isDriverReservationKey(fencedKey) {
+			continue
+		}
+		klog.Warningf("preemptReservationKeys: preempting key %#x on %s of volume %s", fencedKey, device, volumeName)
+		if err := d.scsiPR.PreemptAndAbort(device, key, fencedKey, prType); err != nil {
+			return fmt.Errorf("failed to preempt key %#x on %s of volume %s: %v", fencedKey, device, volumeName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+)
+
+const (
+	// fenceRequestAnnotationPrefix prefixes the annotations of the fence requests on the node executing them,
+	// the annotation of a volume is named after the hash of its PV name
+	fenceRequestAnnotationPrefix = "fence.disk.csi.azure.com/"
+	// the controller checks the volumes with persistent reservation attached to NotReady or removed nodes every fencingInterval
+	fencingInterval = 30 * time.Second
+	// a fence request is executed by the node only in fenceRequestTTL after it's requested, the expired requests are removed by the node,
+	// and the controller requests again if the volume is still attached to the NotReady or removed nodes
+	fenceRequestTTL = 5 * time.Minute
+)
+
+// fenceRequest asks a Ready node attached to a volume to preempt the reservation keys of the NotReady or removed nodes attached to it
+type fenceRequest struct {
+	Volume string `json:"volume"`
+	// LUN of the volume on the node executing the request
+	LUN         string      `json:"lun"`
+	FencedKeys  []uint64    `json:"fencedKeys"`
+	RequestTime metav1.Time `json:"requestTime"`
+}
+
+func getFenceRequestAnnotation(pvName string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(pvName))
+	return fmt.Sprintf("%s%016x", fenceRequestAnnotationPrefix, h.Sum64())
+}
+
+func isNodeReady(node *v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// fencePersistentReservations requests the fencing of the NotReady or removed nodes attached to the volumes with persistent reservation,
+// it only runs on the controller leader
+func (d *DriverCore) fencePersistentReservations(ctx context.Context) {
+	if d.volumeAttachmentLister == nil || !d.leader.isLeader() {
+		return
+	}
+	vas, err := d.volumeAttachmentLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("fencePersistentReservations: failed to list volume attachments: %v", err)
+		return
+	}
+	attachments := d.groupVolumeAttachments(vas)
+	nodes := map[string]*v1.Node{}
+	for pvName, pvAttachments := range attachments {
+		if len(pvAttachments) < 2 {
+			continue
+		}
+		if err := d.fenceVolumeAttachments(ctx, pvName, pvAttachments, nodes); err != nil {
+			klog.Errorf("fencePersistentReservations: failed to fence PV %s: %v", pvName, err)
+		}
+	}
+}
+
+// fenceUnpublishedNode requests the fencing of a NotReady or removed node before the volume is detached from it,
+// so that the keys of the node are preempted even if the volume attachment is gone before the next fencingInterval
+func (d *DriverCore) fenceUnpublishedNode(ctx context.Context, volumeID, nodeName string) {
+	if d.volumeAttachmentLister == nil {
+		return
+	}
+	vas, err := d.volumeAttachmentLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("fenceUnpublishedNode: failed to list volume attachments: %v", err)
+		return
+	}
+	for pvName, pvAttachments := range d.groupVolumeAttachments(vas) {
+		if len(pvAttachments) < 2 || !hasVolumeAttachment(pvAttachments, nodeName) {
+			continue
+		}
+		volume, err := d.getAttachedVolume(ctx, pvName)
+		if err != nil {
+			klog.Errorf("fenceUnpublishedNode: failed to get PV %s: %v", pvName, err)
+			continue
+		}
+		if strings.EqualFold(volume.volumeHandle, volumeID) {
+			if err := d.fenceVolumeAttachments(ctx, pvName, pvAttachments, map[string]*v1.Node{}); err != nil {
+				klog.Errorf("fenceUnpublishedNode: failed to fence PV %s: %v", pvName, err)
+			}
+			return
+		}
+	}
+}
+
+func hasVolumeAttachment(vas []*storagev1.VolumeAttachment, nodeName string) bool {
+	for _, va := range vas {
+		if va.Spec.NodeName == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// fenceVolumeAttachments requests the first Ready node the volume is attached to, in the order of node names,
+// to preempt the reservation keys of the NotReady or removed nodes the volume is attached to
+func (d *DriverCore) fenceVolumeAttachments(ctx context.Context, pvName string, vas []*storagev1.VolumeAttachment, nodes map[string]*v1.Node) error {
+	volume, err := d.getAttachedVolume(ctx, pvName)
+	if err != nil || !azureutils.IsPersistentReservationEnabled(volume.attributes) {
+		return err
+	}
+
+	var executor *storagev1.VolumeAttachment
+	var fencedNodes []string
+	for _, va := range vas {
+		node, err := d.getFencingNode(ctx, va.Spec.NodeName, nodes)
+		if err != nil {
+			return err
+		}
+		if node == nil || !isNodeReady(node) {
+			fencedNodes = append(fencedNodes, va.Spec.NodeName)
+			continue
+		}
+		if va.Status.Attached && va.Status.AttachmentMetadata[consts.LUN] != "" && (executor == nil || va.Spec.NodeName < executor.Spec.NodeName) {
+			executor = va
+		}
+	}
+	if len(fencedNodes) == 0 || executor == nil {
+		return nil
+	}
+	sort.Strings(fencedNodes)
+	request := fenceRequest{
+		Volume:      pvName,
+		LUN:         executor.Status.AttachmentMetadata[consts.LUN],
+		RequestTime: metav1.Now(),
+	}
+	for _, nodeName := range fencedNodes {
+		request.FencedKeys = append(request.FencedKeys, getReservationKey(nodeName))
+	}
+
+	annotation := getFenceRequestAnnotation(pvName)
+	if value, ok := nodes[executor.Spec.NodeName].Annotations[annotation]; ok {
+		var existing fenceRequest
+		if err := json.Unmarshal([]byte(value), &existing); err == nil && existing.LUN == request.LUN &&
+			slices.Equal(existing.FencedKeys, request.FencedKeys) && time.Since(existing.RequestTime.Time) < fenceRequestTTL {
+			return nil
+		}
+	}
+	value, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{annotation: string(value)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	node, err := d.kubeClient.CoreV1().Nodes().Patch(ctx, executor.Spec.NodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return err
+	}
+	nodes[node.Name] = node
+	klog.Warningf("fenceVolumeAttachments: requested node %s to fence nodes %v attached to PV %s", node.Name, fencedNodes, pvName)
+	return nil
+}
+
+// getFencingNode gets the node once per fencing round, nil is returned if the node is removed
+func (d *DriverCore) getFencingNode(ctx context.Context, nodeName string, nodes map[string]*v1.Node) (*v1.Node, error) {
+	if node, ok := nodes[nodeName]; ok {
+		return node, nil
+	}
+	node, err := d.kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		node = nil
+	}
+	nodes[nodeName] = node
+	return node, nil
+}
+
+// watchFenceRequests executes the fence requests in the annotations of the node
+func (d *Driver) watchFenceRequests(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(d.kubeClient, fencingInterval, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", d.NodeID).String()
+	}))
+	informer := factory.Core().V1().Nodes().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { d.executeFenceRequests(ctx, obj.(*v1.Node)) },
+		UpdateFunc: func(_, obj interface{}) { d.executeFenceRequests(ctx, obj.(*v1.Node)) },
+	}); err != nil {
+		klog.Errorf("watchFenceRequests: failed to watch node %s: %v", d.NodeID, err)
+		return
+	}
+	factory.Start(ctx.Done())
+}
+
+// executeFenceRequests executes each fence request once, and removes the expired requests
+func (d *Driver) executeFenceRequests(ctx context.Context, node *v1.Node) {
+	expired := map[string]interface{}{}
+	for annotation, value := range node.Annotations {
+		if !strings.HasPrefix(annotation, fenceRequestAnnotationPrefix) {
+			continue
+		}
+		var request fenceRequest
+		if err := json.Unmarshal([]byte(value), &request); err != nil {
+			klog.Warningf("executeFenceRequests: failed to parse %s(%s): %v", annotation, value, err)
+			expired[annotation] = nil
+			continue
+		}
+		if time.Since(request.RequestTime.Time) > fenceRequestTTL {
+			expired[annotation] = nil
+			continue
+		}
+		if executed, ok := d.executedFenceRequests.Load(annotation); ok && executed.(time.Time).Equal(request.RequestTime.Time) {
+			continue
+		}
+		device, err := d.getDevicePathWithLUN(request.LUN)
+		if err == nil {
+			err = d.preemptReservationKeys(request.Volume, device, request.FencedKeys)
+		}
+		if err != nil {
+			klog.Errorf("executeFenceRequests: failed to fence keys %#x on lun %s of PV %s: %v", request.FencedKeys, request.LUN, request.Volume, err)
+			continue
+		}
+		d.executedFenceRequests.Store(annotation, request.RequestTime.Time)
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": expired,
+		},
+	})
+	if err != nil {
+		klog.Errorf("executeFenceRequests: %v", err)
+		return
+	}
+	if _, err := d.kubeClient.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		klog.Errorf("executeFenceRequests: failed to remove expired fence requests of node %s: %v", node.Name, err)
+		return
+	}
+	for annotation := range expired {
+		d.executedFenceRequests.Delete(annotation)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+func newTestNode(name string, ready v1.ConditionStatus) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+		},
+	}
+}
+
+func newTestPV(name string, persistentReservation bool) *v1.PersistentVolume {
+	attributes := map[string]string{}
+	if persistentReservation {
+		attributes[consts.PersistentReservationField] = consts.TrueValue
+	}
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: consts.DefaultDriverName, VolumeHandle: "/disks/" + name, VolumeAttributes: attributes},
+			},
+		},
+	}
+}
+
+func newTestVolumeAttachment(pvName, nodeName, lun string) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName + "-" + nodeName},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: consts.DefaultDriverName,
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+		Status: storagev1.VolumeAttachmentStatus{
+			Attached:           lun != "",
+			AttachmentMetadata: map[string]string{consts.LUN: lun},
+		},
+	}
+}
+
+// newTestLeaderDriver returns a controller leader with the informer of the volume attachments started
+func newTestLeaderDriver(t *testing.T, objects ...runtime.Object) (*DriverCore, *fake.Clientset) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	kubeClient := fake.NewSimpleClientset(objects...)
+	d := &DriverCore{}
+	d.Name = consts.DefaultDriverName
+	d.kubeClient = kubeClient
+	d.leader = newControllerLeader(kubeClient, "controller-0", "kube-system", "disk-csi-azure-com")
+	d.leader.renew(ctx)
+	d.controllerInformers = informers.NewSharedInformerFactory(kubeClient, 0)
+	d.volumeAttachmentLister = d.controllerInformers.Storage().V1().VolumeAttachments().Lister()
+	d.controllerInformers.Start(ctx.Done())
+	d.controllerInformers.WaitForCacheSync(ctx.Done())
+	return d, kubeClient
+}
+
+func getTestFenceRequest(t *testing.T, kubeClient *fake.Clientset, nodeName, pvName string) *fenceRequest {
+	node, err := kubeClient.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	assert.NoError(t, err)
+	value, ok := node.Annotations[getFenceRequestAnnotation(pvName)]
+	if !ok {
+		return nil
+	}
+	var request fenceRequest
+	assert.NoError(t, json.Unmarshal([]byte(value), &request))
+	return &request
+}
+
+func countNodePatches(kubeClient *fake.Clientset) int {
+	patches := 0
+	for _, action := range kubeClient.Actions() {
+		if action.GetVerb() == "patch" && action.GetResource().Resource == "nodes" {
+			patches++
+		}
+	}
+	return patches
+}
+
+func TestFencePersistentReservations(t *testing.T) {
+	d, kubeClient := newTestLeaderDriver(t,
+		newTestNode("node-0", v1.ConditionTrue),
+		newTestNode("node-1", v1.ConditionTrue),
+		newTestNode("node-2", v1.ConditionUnknown),
+		newTestPV("pv-1", true),
+		newTestPV("pv-2", false),
+		newTestPV("pv-3", true),
+		newTestVolumeAttachment("pv-1", "node-1", "1"),
+		newTestVolumeAttachment("pv-1", "node-0", "2"),
+		newTestVolumeAttachment("pv-1", "node-2", "3"),
+		newTestVolumeAttachment("pv-1", "removed-node", "4"),
+		newTestVolumeAttachment("pv-2", "node-1", "5"),
+		newTestVolumeAttachment("pv-2", "node-2", "6"),
+		newTestVolumeAttachment("pv-3", "node-0", "7"),
+		newTestVolumeAttachment("pv-3", "node-1", "8"),
+	)
+	ctx := context.Background()
+
+	d.fencePersistentReservations(ctx)
+	// the first Ready node in the order of node names fences the NotReady and removed nodes
+	request := getTestFenceRequest(t, kubeClient, "node-0", "pv-1")
+	if assert.NotNil(t, request) {
+		assert.Equal(t, "pv-1", request.Volume)
+		assert.Equal(t, "2", request.LUN)
+		assert.Equal(t, []uint64{getReservationKey("node-2"), getReservationKey("removed-node")}, request.FencedKeys)
+	}
+	assert.Nil(t, getTestFenceRequest(t, kubeClient, "node-1", "pv-1"))
+	// no persistent reservation
+	assert.Nil(t, getTestFenceRequest(t, kubeClient, "node-1", "pv-2"))
+	// all the nodes are Ready
+	assert.Nil(t, getTestFenceRequest(t, kubeClient, "node-0", "pv-3"))
+	assert.Equal(t, 1, countNodePatches(kubeClient))
+
+	// the fresh request is not written again
+	d.fencePersistentReservations(ctx)
+	assert.Equal(t, 1, countNodePatches(kubeClient))
+
+	// only the leader fences
+	d.leader.lease = nil
+	node, _ := kubeClient.CoreV1().Nodes().Get(ctx, "node-0", metav1.GetOptions{})
+	node.Annotations = nil
+	_, _ = kubeClient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{})
+	d.fencePersistentReservations(ctx)
+	assert.Nil(t, getTestFenceRequest(t, kubeClient, "node-0", "pv-1"))
+}
+
+func TestFenceUnpublishedNode(t *testing.T) {
+	d, kubeClient := newTestLeaderDriver(t,
+		newTestNode("node-0", v1.ConditionTrue),
+		newTestNode("node-1", v1.ConditionTrue),
+		newTestNode("node-2", v1.ConditionFalse),
+		newTestPV("pv-1", true),
+		newTestVolumeAttachment("pv-1", "node-0", "1"),
+		newTestVolumeAttachment("pv-1", "node-1", "2"),
+		newTestVolumeAttachment("pv-1", "node-2", "3"),
+	)
+	ctx := context.Background()
+	// a replica which is not the leader fences the node it detaches the volume from
+	d.leader.lease = nil
+
+	// another volume
+	d.fenceUnpublishedNode(ctx, "/disks/pv-2", "node-2")
+	assert.Equal(t, 0, countNodePatches(kubeClient))
+
+	d.fenceUnpublishedNode(ctx, "/disks/pv-1", "node-2")
+	request := getTestFenceRequest(t, kubeClient, "node-0", "pv-1")
+	if assert.NotNil(t, request) {
+		assert.Equal(t, "1", request.LUN)
+		assert.Equal(t, []uint64{getReservationKey("node-2")}, request.FencedKeys)
+	}
+}
+
+func TestExecuteFenceRequests(t *testing.T) {
+	value := func(requestTime time.Time) string {
+		request, _ := json.Marshal(fenceRequest{Volume: "pv-1", LUN: "1", FencedKeys: []uint64{getReservationKey("node-1")}, RequestTime: metav1.NewTime(requestTime)})
+		return string(request)
+	}
+	node := newTestNode("node-0", v1.ConditionTrue)
+	node.Annotations = map[string]string{
+		getFenceRequestAnnotation("pv-1"): value(time.Now().Add(-2 * fenceRequestTTL)),
+		getFenceRequestAnnotation("pv-2"): "invalid",
+		"other":                           "value",
+	}
+	kubeClient := fake.NewSimpleClientset(node)
+	d := &Driver{}
+	d.NodeID = "node-0"
+	d.kubeClient = kubeClient
+	d.executedFenceRequests.Store(getFenceRequestAnnotation("pv-1"), time.Now())
+
+	d.executeFenceRequests(context.Background(), node)
+	node, err := kubeClient.CoreV1().Nodes().Get(context.Background(), "node-0", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"other": "value"}, node.Annotations)
+	_, ok := d.executedFenceRequests.Load(getFenceRequestAnnotation("pv-1"))
+	assert.False(t, ok)
+}
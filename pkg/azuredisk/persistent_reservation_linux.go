@@ -0,0 +1,236 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sgIO                  = 0x2285
+	sgInterfaceID         = 'S'
+	sgDxferNone           = -1
+	sgDxferToDev          = -2
+	sgDxferFromDev        = -3
+	sgTimeoutMilliseconds = 30000
+	sgSenseBufferLength   = 32
+
+	scsiStatusGood                = 0x00
+	scsiStatusReservationConflict = 0x18
+
+	persistentReserveIn  = 0x5e
+	persistentReserveOut = 0x5f
+
+	// PERSISTENT RESERVE IN service actions
+	prInReadKeys        = 0x00
+	prInReadReservation = 0x01
+
+	// PERSISTENT RESERVE OUT service actions
+	prOutReserve                   = 0x01
+	prOutPreemptAndAbort           = 0x05
+	prOutRegisterAndIgnoreExisting = 0x06
+
+	prOutParameterListLength = 24
+	// prInAllocationLength is large enough for the keys of all nodes sharing a disk
+	prInAllocationLength = 8192
+)
+
+// sgIOHdr is struct sg_io_hdr in <scsi/sg.h>
+type sgIOHdr struct {
+	interfaceID    int32
+	dxferDirection int32
+	cmdLen         uint8
+	mxSbLen        uint8
+	iovecCount     uint16
+	dxferLen       uint32
+	dxferp         unsafe.Pointer
+	cmdp           unsafe.Pointer
+	sbp            unsafe.Pointer
+	timeout        uint32
+	flags          uint32
+	packID         int32
+	usrPtr         unsafe.Pointer
+	status         uint8
+	maskedStatus   uint8
+	msgStatus      uint8
+	sbLenWr        uint8
+	hostStatus     uint16
+	driverStatus   uint16
+	resid          int32
+	duration       uint32
+	info           uint32
+}
+
+// sgPersistentReservation issues persistent reservation commands with SG_IO ioctl
+type sgPersistentReservation struct{}
+
+func newSCSIPersistentReservation() scsiPersistentReservation {
+	return &sgPersistentReservation{}
+}
+
+func (s *sgPersistentReservation) Register(device string, key uint64) error {
+	return s.reserveOut(device, prOutRegisterAndIgnoreExisting, prTypeNone, 0, key)
+}
+
+func (s *sgPersistentReservation) Unregister(device string, key uint64) error {
+	return s.reserveOut(device, prOutRegisterAndIgnoreExisting, prTypeNone, key, 0)
+}
+
+func (s *sgPersistentReservation) Reserve(device string, key uint64, prType uint8) error {
+	return s.reserveOut(device, prOutReserve, prType, key, 0)
+}
+
+func (s *sgPersistentReservation) PreemptAndAbort(device string, key, victimKey uint64, prType uint8) error {
+	return s.reserveOut(device, prOutPreemptAndAbort, prType, key, victimKey)
+}
+
+func (s *sgPersistentReservation) ReadKeys(device string) ([]uint64, error) {
+	data, err := s.reserveIn(device, prInReadKeys)
+	if err != nil {
+		return nil, err
+	}
+	return parseReadKeys(data)
+}
+
+func (s *sgPersistentReservation) ReadReservation(device string) (*scsiReservation, error) {
+	data, err := s.reserveIn(device, prInReadReservation)
+	if err != nil {
+		return nil, err
+	}
+	return parseReadReservation(data)
+}
+
+func (s *sgPersistentReservation) reserveOut(device string, serviceAction, prType uint8, key, serviceActionKey uint64) error {
+	cdb := newReserveOutCDB(serviceAction, prType)
+	parameters := newReserveOutParameters(key, serviceActionKey)
+	return sendSCSICommand(device, cdb, parameters, sgDxferToDev)
+}
+
+func (s *sgPersistentReservation) reserveIn(device string, serviceAction uint8) ([]byte, error) {
+	cdb := make([]byte, 10)
+	cdb[0] = persistentReserveIn
+	cdb[1] = serviceAction
+	binary.BigEndian.PutUint16(cdb[7:9], prInAllocationLength)
+	data := make([]byte, prInAllocationLength)
+	if err := sendSCSICommand(device, cdb, data, sgDxferFromDev); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// newReserveOutCDB returns the PERSISTENT RESERVE OUT command with logical unit scope
+func newReserveOutCDB(serviceAction, prType uint8) []byte {
+	cdb := make([]byte, 10)
+	cdb[0] = persistentReserveOut
+	cdb[1] = serviceAction
+	cdb[2] = prType & 0x0f
+	binary.BigEndian.PutUint32(cdb[5:9], prOutParameterListLength)
+	return cdb
+}
+
+// newReserveOutParameters returns the PERSISTENT RESERVE OUT parameter list without APTPL,
+// registrations are not preserved across power loss so a restarted VM has to register again
+func newReserveOutParameters(key, serviceActionKey uint64) []byte {
+	parameters := make([]byte, prOutParameterListLength)
+	binary.BigEndian.PutUint64(parameters[0:8], key)
+	binary.BigEndian.PutUint64(parameters[8:16], serviceActionKey)
+	return parameters
+}
+
+// parseReadKeys parses the READ KEYS parameter data
+func parseReadKeys(data []byte) ([]uint64, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("READ KEYS parameter data is too short: %d", len(data))
+	}
+	length := int(binary.BigEndian.Uint32(data[4:8]))
+	if length > len(data)-8 {
+		return nil, fmt.Errorf("READ KEYS parameter data is truncated: %d keys returned", length/8)
+	}
+	keys := make([]uint64, 0, length/8)
+	for offset := 8; offset+8 <= 8+length; offset += 8 {
+		keys = append(keys, binary.BigEndian.Uint64(data[offset:offset+8]))
+	}
+	return keys, nil
+}
+
+// parseReadReservation parses the READ RESERVATION parameter data
+func parseReadReservation(data []byte) (*scsiReservation, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("READ RESERVATION parameter data is too short: %d", len(data))
+	}
+	if binary.BigEndian.Uint32(data[4:8]) == 0 {
+		return nil, nil
+	}
+	if len(data) < 24 {
+		return nil, fmt.Errorf("READ RESERVATION parameter data is too short: %d", len(data))
+	}
+	return &scsiReservation{
+		key:    binary.BigEndian.Uint64(data[8:16]),
+		prType: data[21] & 0x0f,
+	}, nil
+}
+
+// sendSCSICommand sends cdb to device with SG_IO, data is written to or read from the device according to direction
+func sendSCSICommand(device string, cdb, data []byte, direction int32) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sense := make([]byte, sgSenseBufferLength)
+	hdr := sgIOHdr{
+		interfaceID:    sgInterfaceID,
+		dxferDirection: direction,
+		cmdLen:         uint8(len(cdb)),
+		mxSbLen:        uint8(len(sense)),
+		cmdp:           unsafe.Pointer(&cdb[0]),
+		sbp:            unsafe.Pointer(&sense[0]),
+		timeout:        sgTimeoutMilliseconds,
+	}
+	if len(data) > 0 {
+		hdr.dxferLen = uint32(len(data))
+		hdr.dxferp = unsafe.Pointer(&data[0])
+	} else {
+		hdr.dxferDirection = sgDxferNone
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), sgIO, uintptr(unsafe.Pointer(&hdr)))
+	runtime.KeepAlive(cdb)
+	runtime.KeepAlive(data)
+	runtime.KeepAlive(sense)
+	if errno != 0 {
+		return fmt.Errorf("SG_IO ioctl on %s failed: %v", device, errno)
+	}
+	switch {
+	case hdr.status == scsiStatusReservationConflict:
+		return errReservationConflict
+	case hdr.status != scsiStatusGood || hdr.hostStatus != 0 || hdr.driverStatus != 0:
+		return fmt.Errorf("SCSI command %#x on %s failed with status %#x, host status %#x, driver status %#x, sense data %x",
+			cdb[0], device, hdr.status, hdr.hostStatus, hdr.driverStatus, sense[:hdr.sbLenWr])
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSgIOHdrSize(t *testing.T) {
+	// sizeof(struct sg_io_hdr) on 64-bit architectures
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		assert.Equal(t, uintptr(88), unsafe.Sizeof(sgIOHdr{}))
+	}
+}
+
+func TestNewReserveOutCDB(t *testing.T) {
+	assert.Equal(t, []byte{0x5f, 0x05, 0x07, 0, 0, 0, 0, 0, 24, 0}, newReserveOutCDB(prOutPreemptAndAbort, prTypeWriteExclusiveAllRegistrants))
+	assert.Equal(t, []byte{0x5f, 0x06, 0x00, 0, 0, 0, 0, 0, 24, 0}, newReserveOutCDB(prOutRegisterAndIgnoreExisting, prTypeNone))
+}
+
+func TestNewReserveOutParameters(t *testing.T) {
+	parameters := newReserveOutParameters(0x0102030405060708, 0x1112131415161718)
+	assert.Equal(t, 24, len(parameters))
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, parameters[0:8])
+	assert.Equal(t, []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}, parameters[8:16])
+	assert.Equal(t, make([]byte, 8), parameters[16:24])
+}
+
+func TestParseReadKeys(t *testing.T) {
+	data := make([]byte, 64)
+	data[7] = 16
+	data[15] = 0x1
+	data[23] = 0x2
+	keys, err := parseReadKeys(data)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, keys)
+
+	keys, err = parseReadKeys(make([]byte, 64))
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	data = make([]byte, 16)
+	data[7] = 16
+	_, err = parseReadKeys(data)
+	assert.Error(t, err)
+
+	_, err = parseReadKeys([]byte{0})
+	assert.Error(t, err)
+}
+
+func TestParseReadReservation(t *testing.T) {
+	reservation, err := parseReadReservation(make([]byte, 64))
+	assert.NoError(t, err)
+	assert.Nil(t, reservation)
+
+	data := make([]byte, 64)
+	data[7] = 16
+	data[15] = 0x3
+	data[21] = 0x01
+	reservation, err = parseReadReservation(data)
+	assert.NoError(t, err)
+	assert.Equal(t, &scsiReservation{key: 3, prType: prTypeWriteExclusive}, reservation)
+
+	_, err = parseReadReservation([]byte{0})
+	assert.Error(t, err)
+}
+
+func TestSendSCSICommandOnMissingDevice(t *testing.T) {
+	err := newSCSIPersistentReservation().Register(filepath.Join(t.TempDir(), "sdz"), 1)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testPRDevice = "/dev/sdd"
+
+func newTestPRDriver(nodeName string, scsiPR scsiPersistentReservation) *DriverCore {
+	d := &DriverCore{scsiPR: scsiPR}
+	d.NodeID = nodeName
+	return d
+}
+
+func TestGetReservationKey(t *testing.T) {
+	assert.Equal(t, getReservationKey("node-0"), getReservationKey("node-0"))
+	assert.NotEqual(t, getReservationKey("node-0"), getReservationKey("node-1"))
+	assert.NotEqual(t, uint64(0), getReservationKey(""))
+	assert.True(t, isDriverReservationKey(getReservationKey("node-0")))
+	assert.False(t, isDriverReservationKey(0x1234))
+}
+
+func TestGetReservationType(t *testing.T) {
+	newCapability := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}}
+	}
+	assert.Equal(t, prTypeWriteExclusiveAllRegistrants, getReservationType(newCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), false))
+	assert.Equal(t, prTypeWriteExclusive, getReservationType(newCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER), false))
+	assert.Equal(t, prTypeWriteExclusive, getReservationType(newCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), false))
+	assert.Equal(t, prTypeNone, getReservationType(newCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER), true))
+	assert.Equal(t, prTypeNone, getReservationType(newCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY), false))
+}
+
+func TestRegisterAndUnregisterPersistentReservation(t *testing.T) {
+	scsiPR := newFakeSCSIPersistentReservation()
+	d := newTestPRDriver("node-0", scsiPR)
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+
+	assert.NoError(t, d.registerPersistentReservation("vol_1", testPRDevice, stagingPath))
+	keys, _ := scsiPR.ReadKeys(testPRDevice)
+	assert.Equal(t, []uint64{getReservationKey("node-0")}, keys)
+	_, err := os.Stat(filepath.Join(stagingPath, persistentReservationStateFile))
+	assert.NoError(t, err)
+
+	assert.NoError(t, d.unregisterPersistentReservation("vol_1", stagingPath))
+	keys, _ = scsiPR.ReadKeys(testPRDevice)
+	assert.Empty(t, keys)
+	_, err = os.Stat(filepath.Join(stagingPath, persistentReservationStateFile))
+	assert.True(t, os.IsNotExist(err))
+
+	// no-op if no key was registered
+	assert.NoError(t, d.unregisterPersistentReservation("vol_1", stagingPath))
+}
+
+func TestReservePersistentReservation(t *testing.T) {
+	key0, key1, key2 := getReservationKey("node-0"), getReservationKey("node-1"), getReservationKey("node-2")
+
+	tests := []struct {
+		desc                string
+		registeredKeys      []uint64
+		reservation         *scsiReservation
+		prType              uint8
+		expectedCode        codes.Code
+		expectedKeys        []uint64
+		expectedReservation *scsiReservation
+	}{
+		{
+			desc:                "take write exclusive reservation",
+			registeredKeys:      []uint64{key0, key1},
+			prType:              prTypeWriteExclusive,
+			expectedKeys:        []uint64{key0, key1},
+			expectedReservation: &scsiReservation{key: key0, prType: prTypeWriteExclusive},
+		},
+		{
+			desc:                "share all registrants reservation",
+			registeredKeys:      []uint64{key0, key1},
+			reservation:         &scsiReservation{key: key1, prType: prTypeWriteExclusiveAllRegistrants},
+			prType:              prTypeWriteExclusiveAllRegistrants,
+			expectedKeys:        []uint64{key0, key1},
+			expectedReservation: &scsiReservation{key: 0, prType: prTypeWriteExclusiveAllRegistrants},
+		},
+		{
+			desc:                "reservation held by another node conflicts",
+			registeredKeys:      []uint64{key0, key1},
+			reservation:         &scsiReservation{key: key1, prType: prTypeWriteExclusive},
+			prType:              prTypeWriteExclusive,
+			expectedCode:        codes.FailedPrecondition,
+			expectedKeys:        []uint64{key0, key1},
+			expectedReservation: &scsiReservation{key: key1, prType: prTypeWriteExclusive},
+		},
+		{
+			desc:                "reservation of NotReady node is not preempted on publish",
+			registeredKeys:      []uint64{key0, key2},
+			reservation:         &scsiReservation{key: key2, prType: prTypeWriteExclusive},
+			prType:              prTypeWriteExclusive,
+			expectedCode:        codes.FailedPrecondition,
+			expectedKeys:        []uint64{key0, key2},
+			expectedReservation: &scsiReservation{key: key2, prType: prTypeWriteExclusive},
+		},
+		{
+			desc:           "reader does not take reservation",
+			registeredKeys: []uint64{key0, key1},
+			prType:         prTypeNone,
+			expectedKeys:   []uint64{key0, key1},
+		},
+	}
+
+	for _, test := range tests {
+		scsiPR := newFakeSCSIPersistentReservation()
+		for _, key := range test.registeredKeys {
+			assert.NoError(t, scsiPR.Register(testPRDevice, key))
+		}
+		if test.reservation != nil {
+			assert.NoError(t, scsiPR.Reserve(testPRDevice, test.reservation.key, test.reservation.prType))
+		}
+		d := newTestPRDriver("node-0", scsiPR)
+
+		err := d.reservePersistentReservation("vol_1", testPRDevice, test.prType)
+		assert.Equal(t, test.expectedCode, status.Code(err), "desc: %s, err: %v", test.desc, err)
+		keys, _ := scsiPR.ReadKeys(testPRDevice)
+		assert.ElementsMatch(t, test.expectedKeys, keys, test.desc)
+		reservation, _ := scsiPR.ReadReservation(testPRDevice)
+		assert.Equal(t, test.expectedReservation, reservation, test.desc)
+	}
+}
+
+func TestPreemptReservationKeys(t *testing.T) {
+	key0, key1, key2 := getReservationKey("node-0"), getReservationKey("node-1"), getReservationKey("node-2")
+	foreignKey := uint64(0x1234)
+
+	tests := []struct {
+		desc                string
+		registeredKeys      []uint64
+		reservation         *scsiReservation
+		fencedKeys          []uint64
+		expectErr           bool
+		expectedKeys        []uint64
+		expectedReservation *scsiReservation
+	}{
+		{
+			desc:                "fenced key holding the reservation is preempted",
+			registeredKeys:      []uint64{key0, key1, key2},
+			reservation:         &scsiReservation{key: key2, prType: prTypeWriteExclusive},
+			fencedKeys:          []uint64{key2},
+			expectedKeys:        []uint64{key0, key1},
+			expectedReservation: &scsiReservation{key: key0, prType: prTypeWriteExclusive},
+		},
+		{
+			desc:                "fenced registrant is preempted",
+			registeredKeys:      []uint64{key0, key2},
+			reservation:         &scsiReservation{key: key0, prType: prTypeWriteExclusiveAllRegistrants},
+			fencedKeys:          []uint64{key2},
+			expectedKeys:        []uint64{key0},
+			expectedReservation: &scsiReservation{key: 0, prType: prTypeWriteExclusiveAllRegistrants},
+		},
+		{
+			desc:           "keys which are not driver keys, not registered or of the node are skipped",
+			registeredKeys: []uint64{key0, foreignKey},
+			fencedKeys:     []uint64{key0, key1, foreignKey},
+			expectedKeys:   []uint64{key0, foreignKey},
+		},
+		{
+			desc:           "key of the node is not registered",
+			registeredKeys: []uint64{key1, key2},
+			fencedKeys:     []uint64{key2},
+			expectErr:      true,
+			expectedKeys:   []uint64{key1, key2},
+		},
+	}
+
+	for _, test := range tests {
+		scsiPR := newFakeSCSIPersistentReservation()
+		for _, key := range test.registeredKeys {
+			assert.NoError(t, scsiPR.Register(testPRDevice, key))
+		}
+		if test.reservation != nil {
+			assert.NoError(t, scsiPR.Reserve(testPRDevice, test.reservation.key, test.reservation.prType))
+		}
+		d := newTestPRDriver("node-0", scsiPR)
+
+		err := d.preemptReservationKeys("pv-1", testPRDevice, test.fencedKeys)
+		assert.Equal(t, test.expectErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		keys, _ := scsiPR.ReadKeys(testPRDevice)
+		assert.ElementsMatch(t, test.expectedKeys, keys, test.desc)
+		reservation, _ := scsiPR.ReadReservation(testPRDevice)
+		assert.Equal(t, test.expectedReservation, reservation, test.desc)
+	}
+}
+
+func TestUnregisterReleasesReservation(t *testing.T) {
+	scsiPR := newFakeSCSIPersistentReservation()
+	d := newTestPRDriver("node-0", scsiPR)
+	stagingPath := t.TempDir()
+
+	assert.NoError(t, d.registerPersistentReservation("vol_1", testPRDevice, stagingPath))
+	assert.NoError(t, d.reservePersistentReservation("vol_1", testPRDevice, prTypeWriteExclusive))
+	reservation, _ := scsiPR.ReadReservation(testPRDevice)
+	assert.NotNil(t, reservation)
+
+	assert.NoError(t, d.unregisterPersistentReservation("vol_1", stagingPath))
+	reservation, _ = scsiPR.ReadReservation(testPRDevice)
+	assert.Nil(t, reservation)
+}
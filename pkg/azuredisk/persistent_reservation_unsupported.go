@@ -0,0 +1,57 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var errPersistentReservationNotSupported = fmt.Errorf("SCSI persistent reservation is not supported on %s", runtime.GOOS)
+
+type unsupportedPersistentReservation struct{}
+
+func newSCSIPersistentReservation() scsiPersistentReservation {
+	return &unsupportedPersistentReservation{}
+}
+
+func (u *unsupportedPersistentReservation) Register(_ string, _ uint64) error {
+	return errPersistentReservationNotSupported
+}
+
+func (u *unsupportedPersistentReservation) Unregister(_ string, _ uint64) error {
+	return errPersistentReservationNotSupported
+}
+
+func (u *unsupportedPersistentReservation) Reserve(_ string, _ uint64, _ uint8) error {
+	return errPersistentReservationNotSupported
+}
+
+func (u *unsupportedPersistentReservation) PreemptAndAbort(_ string, _, _ uint64, _ uint8) error {
+	return errPersistentReservationNotSupported
+}
+
+func (u *unsupportedPersistentReservation) ReadKeys(_ string) ([]uint64, error) {
+	return nil, errPersistentReservationNotSupported
+}
+
+func (u *unsupportedPersistentReservation) ReadReservation(_ string) (*scsiReservation, error) {
+	return nil, errPersistentReservationNotSupported
+}
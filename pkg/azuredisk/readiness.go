@@ -0,0 +1,352 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+const (
+	// the results of the readiness checks are reused within readinessCacheTTL
+	readinessCacheTTL = 10 * time.Second
+
+	kubeClientCheckTimeout = 5 * time.Second
+	armCheckTimeout        = 10 * time.Second
+	sysfsCheckTimeout      = 2 * time.Second
+
+	// readinessCheckDiskName is a disk which is not expected to exist, getting it checks the access to ARM without side effect
+	readinessCheckDiskName = "azuredisk-csi-driver-readiness-check"
+	// sysfsSCSIDevicesPath is read to find the attached disks
+	sysfsSCSIDevicesPath = "/sys/bus/scsi/devices"
+)
+
+var (
+	registerReadinessMetricsOnce sync.Once
+
+	readinessCheckStatus = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_readiness_check_status",
+			Help:           "Whether the last readiness check of a dependency of the driver passed",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"check"},
+	)
+	readinessCheckDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_readiness_check_duration_seconds",
+			Help:           "Duration of the readiness checks of the dependencies of the driver",
+			Buckets:        metrics.ExponentialBuckets(0.001, 4, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"check"},
+	)
+)
+
+// readinessCheck checks a dependency of the driver
+type readinessCheck struct {
+	name    string
+	timeout time.Duration
+	// liveness checks are local checks reported by Probe and /healthz, they depend on the state loaded on startup,
+	// so that their failure could be recovered by a restart. The checks of remote dependencies, e.g. ARM, are only
+	// reported by /readyz, so that an outage of a dependency does not restart the driver.
+	liveness bool
+	check    func(ctx context.Context) error
+}
+
+// readinessResult is the result of a readiness check
+type readinessResult struct {
+	name string
+	err  error
+}
+
+// readinessCheckGroup runs a group of checks and caches their results
+type readinessCheckGroup struct {
+	checks []readinessCheck
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	results   []readinessResult
+}
+
+// readinessChecker runs the liveness checks and the readiness checks of the remote dependencies in separate groups,
+// so that the liveness checks never wait for a slow remote dependency
+type readinessChecker struct {
+	liveness  readinessCheckGroup
+	readiness readinessCheckGroup
+}
+
+func newReadinessChecker(checks []readinessCheck) *readinessChecker {
+	registerReadinessMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(readinessCheckStatus, readinessCheckDuration)
+	})
+	c := &readinessChecker{}
+	for _, check := range checks {
+		if check.liveness {
+			c.liveness.checks = append(c.liveness.checks, check)
+		} else {
+			c.readiness.checks = append(c.readiness.checks, check)
+		}
+	}
+	return c
+}
+
+// check returns the results of the liveness checks, and of the readiness checks unless liveness is true
+func (c *readinessChecker) check(ctx context.Context, liveness bool) []readinessResult {
+	results := c.liveness.check(ctx)
+	if liveness {
+		return results
+	}
+	return append(append([]readinessResult{}, results...), c.readiness.check(ctx)...)
+}
+
+// check returns the results of the checks, which are run again if the cached results are older than readinessCacheTTL
+func (g *readinessCheckGroup) check(ctx context.Context) []readinessResult {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.results != nil && time.Since(g.checkedAt) < readinessCacheTTL {
+		return g.results
+	}
+	results := make([]readinessResult, 0, len(g.checks))
+	for _, check := range g.checks {
+		start := time.Now()
+		err := runReadinessCheck(ctx, check)
+		readinessCheckDuration.WithLabelValues(check.name).Observe(time.Since(start).Seconds())
+		status := 1.0
+		if err != nil {
+			klog.Warningf("readiness check %s failed: %v", check.name, err)
+			status = 0
+		}
+		readinessCheckStatus.WithLabelValues(check.name).Set(status)
+		results = append(results, readinessResult{name: check.name, err: err})
+	}
+	g.results, g.checkedAt = results, time.Now()
+	return results
+}
+
+// runReadinessCheck runs the check within its timeout
+func runReadinessCheck(ctx context.Context, check readinessCheck) error {
+	if check.timeout <= 0 {
+		return check.check(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	// the check is abandoned on timeout if it does not watch ctx, e.g. a hung read of sysfs
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- check.check(ctx)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %v", check.timeout)
+	}
+}
+
+// ready returns whether all the checks passed, only the liveness checks are run if liveness is true
+func (c *readinessChecker) ready(ctx context.Context, liveness bool) bool {
+	for _, result := range c.check(ctx, liveness) {
+		if result.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// handler serves the results of the checks in the format of the Kubernetes health endpoints,
+// e.g. "[+]disk-client ok", the status code is 500 if a check failed
+func (c *readinessChecker) handler(liveness bool) http.Handler {
+	endpoint := "readyz"
+	if liveness {
+		endpoint = "healthz"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var output strings.Builder
+		failed := false
+		for _, result := range c.check(r.Context(), liveness) {
+			if result.err != nil {
+				failed = true
+				fmt.Fprintf(&output, "[-]%s failed: %v\n", result.name, result.err)
+			} else {
+				fmt.Fprintf(&output, "[+]%s ok\n", result.name)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(&output, "%s check failed\n", endpoint)
+		} else {
+			fmt.Fprintf(&output, "%s check passed\n", endpoint)
+		}
+		_, _ = w.Write([]byte(output.String()))
+	})
+}
+
+// getReadinessChecker returns the readiness checker of the driver, the checks depend on whether it runs as the controller or the node
+func (d *Driver) getReadinessChecker() *readinessChecker {
+	d.readinessOnce.Do(func() {
+		if d.NodeID == "" {
+			d.readiness = newReadinessChecker(d.controllerReadinessChecks())
+		} else {
+			d.readiness = newReadinessChecker(d.nodeReadinessChecks())
+		}
+	})
+	return d.readiness
+}
+
+// HealthzHandler serves the liveness checks of the driver
+func (d *Driver) HealthzHandler() http.Handler {
+	return d.getReadinessChecker().handler(true)
+}
+
+// ReadyzHandler serves the readiness checks of the driver
+func (d *Driver) ReadyzHandler() http.Handler {
+	return d.getReadinessChecker().handler(false)
+}
+
+// controllerReadinessChecks returns the checks of the controller, which all depend on remote services,
+// the cloud checks are skipped if the driver is allowed to run without cloud config
+func (d *Driver) controllerReadinessChecks() []readinessCheck {
+	var checks []readinessCheck
+	if d.kubeClient != nil {
+		checks = append(checks, readinessCheck{name: "kube-client", timeout: kubeClientCheckTimeout, check: d.checkKubeClient})
+	}
+	if d.allowEmptyCloudConfig {
+		return checks
+	}
+	return append(checks,
+		readinessCheck{name: "cloud-config", check: d.checkCloudConfig},
+		readinessCheck{name: "arm-token", timeout: armCheckTimeout, check: d.checkARMToken},
+		readinessCheck{name: "disk-client", timeout: armCheckTimeout, check: d.checkDiskClient},
+	)
+}
+
+func (d *Driver) nodeReadinessChecks() []readinessCheck {
+	checks := []readinessCheck{}
+	if cloud := d.getCloud(); cloud != nil && cloud.UseInstanceMetadata {
+		checks = append(checks, readinessCheck{name: "imds", timeout: imdsTimeout, check: func(ctx context.Context) error {
+			_, err := queryIMDS(ctx, imdsComputeURL)
+			return err
+		}})
+	}
+	if runtime.GOOS == "linux" {
+		checks = append(checks, readinessCheck{name: "sysfs", liveness: true, timeout: sysfsCheckTimeout, check: func(context.Context) error {
+			_, err := d.ioHandler.ReadDir(sysfsSCSIDevicesPath)
+			return err
+		}})
+	}
+	// node info is only loaded on startup for the features using the VM size
+	if d.getPerfOptimizationEnabled() || d.enforceNodeIOLimit || d.enableThrottlingDetection {
+		checks = append(checks, readinessCheck{name: "node-info", liveness: true, check: func(context.Context) error {
+			if d.getNodeInfo() == nil {
+				return fmt.Errorf("node info of node(%s) is not loaded", d.NodeID)
+			}
+			return nil
+		}})
+	}
+	return checks
+}
+
+func (d *Driver) checkCloudConfig(context.Context) error {
+	if d.getCloud() == nil {
+		return fmt.Errorf("driver is running without cloud config")
+	}
+	return nil
+}
+
+func (d *Driver) checkKubeClient(context.Context) error {
+	if d.kubeClient == nil {
+		return fmt.Errorf("kube client is not configured")
+	}
+	// ServerVersion does not take a context, the timeout is enforced by the caller
+	_, err := d.kubeClient.Discovery().ServerVersion()
+	return err
+}
+
+// checkARMToken gets an ARM token, the credential caches the token so that a new token is only requested when it expires
+func (d *Driver) checkARMToken(ctx context.Context) error {
+	cloud := d.getCloud()
+	if cloud == nil {
+		return d.checkCloudConfig(ctx)
+	}
+	d.armCredentialMutex.Lock()
+	if d.armCredential == nil {
+		credential, err := armCredential(cloud)
+		if err != nil {
+			d.armCredentialMutex.Unlock()
+			return err
+		}
+		d.armCredential = credential
+	}
+	credential := d.armCredential
+	d.armCredentialMutex.Unlock()
+	_, err := credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{armTokenScope(cloud.Environment.TokenAudience, cloud.Environment.ResourceManagerEndpoint)}})
+	return err
+}
+
+// resetARMCredential drops the cached credential, e.g. after the cloud config is reloaded
+func (d *Driver) resetARMCredential() {
+	d.armCredentialMutex.Lock()
+	defer d.armCredentialMutex.Unlock()
+	d.armCredential = nil
+}
+
+// checkDiskClient gets a disk which does not exist, so that a NotFound error means ARM is reachable and the request is authorized
+func (d *Driver) checkDiskClient(ctx context.Context) error {
+	cloud := d.getCloud()
+	if cloud == nil {
+		return d.checkCloudConfig(ctx)
+	}
+	diskClient, err := d.getClientFactory().GetDiskClientForSub(cloud.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	_, err = diskClient.Get(ctx, cloud.ResourceGroup, readinessCheckDiskName)
+	var respErr *azcore.ResponseError
+	if err == nil || (errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// armTokenScope returns the scope of the ARM token
+func armTokenScope(tokenAudience, resourceManagerEndpoint string) string {
+	audience := tokenAudience
+	if audience == "" {
+		audience = resourceManagerEndpoint
+	}
+	if audience == "" {
+		audience = "https://management.azure.com/"
+	}
+	return strings.TrimSuffix(audience, "/") + "/.default"
+}
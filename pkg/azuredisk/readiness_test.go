@@ -0,0 +1,182 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+)
+
+func TestReadinessChecker(t *testing.T) {
+	calls, remoteCalls := 0, 0
+	checker := newReadinessChecker([]readinessCheck{
+		{name: "ok", liveness: true, check: func(context.Context) error {
+			calls++
+			return nil
+		}},
+		{name: "failed", check: func(context.Context) error {
+			remoteCalls++
+			return errors.New("unreachable")
+		}},
+		{name: "hung", timeout: 10 * time.Millisecond, check: func(context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}},
+	})
+
+	// the liveness checks are run without the checks of remote dependencies
+	assert.True(t, checker.ready(context.Background(), true))
+	assert.Equal(t, 0, remoteCalls)
+
+	results := checker.check(context.Background(), false)
+	assert.Len(t, results, 3)
+	assert.NoError(t, results[0].err)
+	assert.EqualError(t, results[1].err, "unreachable")
+	assert.EqualError(t, results[2].err, "timed out after 10ms")
+	assert.True(t, checker.ready(context.Background(), true))
+	assert.False(t, checker.ready(context.Background(), false))
+	// the results are cached
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, remoteCalls)
+
+	checker.liveness.checkedAt = time.Now().Add(-readinessCacheTTL)
+	checker.check(context.Background(), true)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, remoteCalls)
+}
+
+func TestReadinessCheckerHandler(t *testing.T) {
+	checker := newReadinessChecker([]readinessCheck{
+		{name: "sysfs", liveness: true, check: func(context.Context) error { return nil }},
+		{name: "imds", check: func(context.Context) error { return errors.New("connection refused") }},
+	})
+
+	recorder := httptest.NewRecorder()
+	checker.handler(true).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "[+]sysfs ok\nhealthz check passed\n", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	checker.handler(false).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "[+]sysfs ok\n[-]imds failed: connection refused\nreadyz check failed\n", recorder.Body.String())
+}
+
+func TestControllerReadiness(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+	d.NodeID = ""
+	d.cloud = nil
+	d.allowEmptyCloudConfig = false
+
+	// Probe and /healthz are not affected by the remote dependencies
+	resp, err := d.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.True(t, resp.Ready.Value)
+	recorder := httptest.NewRecorder()
+	d.HealthzHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	d.ReadyzHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "[+]kube-client ok")
+	assert.Contains(t, recorder.Body.String(), "[-]cloud-config failed: driver is running without cloud config")
+	assert.Contains(t, recorder.Body.String(), "[-]disk-client failed: driver is running without cloud config")
+
+	d.kubeClient = nil
+	assert.EqualError(t, d.checkKubeClient(context.Background()), "kube client is not configured")
+	assert.Equal(t, []string{"cloud-config", "arm-token", "disk-client"}, readinessCheckNames(d.controllerReadinessChecks()))
+
+	// the cloud checks are skipped if the driver is allowed to run without cloud config
+	d.allowEmptyCloudConfig = true
+	assert.Empty(t, d.controllerReadinessChecks())
+}
+
+// readinessCheckNames returns the names of the checks in order
+func readinessCheckNames(checks []readinessCheck) []string {
+	var names []string
+	for _, check := range checks {
+		names = append(names, check.name)
+	}
+	return names
+}
+
+func TestCheckDiskClient(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+	diskClient := mock_diskclient.NewMockInterface(cntl)
+	d.getClientFactory().(*mock_azclient.MockClientFactory).EXPECT().GetDiskClientForSub(gomock.Any()).Return(diskClient, nil).AnyTimes()
+
+	diskClient.EXPECT().Get(gomock.Any(), d.cloud.ResourceGroup, readinessCheckDiskName).Return(nil, &azcore.ResponseError{StatusCode: http.StatusNotFound})
+	assert.NoError(t, d.checkDiskClient(context.Background()))
+
+	diskClient.EXPECT().Get(gomock.Any(), d.cloud.ResourceGroup, readinessCheckDiskName).Return(nil, &azcore.ResponseError{StatusCode: http.StatusForbidden})
+	assert.Error(t, d.checkDiskClient(context.Background()))
+}
+
+func TestNodeReadiness(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	defer func(url string) { imdsComputeURL = url }(imdsComputeURL)
+	imdsComputeURL = server.URL
+
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := newFakeDriverV1(cntl)
+	d.cloud.UseInstanceMetadata = true
+	d.enableThrottlingDetection = true
+
+	var names []string
+	for _, result := range d.getReadinessChecker().check(context.Background(), false) {
+		names = append(names, result.name)
+		switch result.name {
+		case "imds", "node-info":
+			assert.Error(t, result.err, result.name)
+		default:
+			assert.NoError(t, result.err, result.name)
+		}
+	}
+	// the liveness checks are run first
+	expected := []string{"node-info", "imds"}
+	if runtime.GOOS == "linux" {
+		expected = []string{"sysfs", "node-info", "imds"}
+	}
+	assert.Equal(t, expected, names)
+}
+
+func TestArmTokenScope(t *testing.T) {
+	assert.Equal(t, "https://management.azure.com/.default", armTokenScope("", ""))
+	assert.Equal(t, "https://management.usgovcloudapi.net/.default", armTokenScope("", "https://management.usgovcloudapi.net/"))
+	assert.Equal(t, "https://management.core.windows.net/.default", armTokenScope("https://management.core.windows.net/", "https://management.azure.com/"))
+}
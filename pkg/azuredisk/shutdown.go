@@ -0,0 +1,162 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+)
+
+// otelShutdownTimeout bounds the time spent flushing the traces on shutdown
+const otelShutdownTimeout = 10 * time.Second
+
+// ErrUnfinishedOperations is returned by Run if the in-flight operations are not finished within the shutdown timeout
+var ErrUnfinishedOperations = errors.New("in-flight operations are not finished before the shutdown timeout")
+
+// errShuttingDown is returned by the long running waits which are checkpointed on shutdown
+var errShuttingDown = errors.New("driver is shutting down")
+
+// gracefulStopper is the part of grpc.Server used to drain the in-flight RPCs
+type gracefulStopper interface {
+	GracefulStop()
+	Stop()
+}
+
+// operationTracker tracks the in-flight CSI operations so that they can be drained on shutdown
+type operationTracker struct {
+	mu         sync.Mutex
+	nextID     uint64
+	operations map[uint64]string
+	// closed once the driver starts shutting down
+	shutdown chan struct{}
+}
+
+// unaryInterceptor tracks the RPC as an in-flight operation until the handler returns
+func (t *operationTracker) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := t.start(describeOperation(info.FullMethod, req))
+	defer t.finish(id)
+	return handler(ctx, req)
+}
+
+func (t *operationTracker) start(operation string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.operations == nil {
+		t.operations = map[uint64]string{}
+	}
+	t.nextID++
+	t.operations[t.nextID] = operation
+	return t.nextID
+}
+
+func (t *operationTracker) finish(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.operations, id)
+}
+
+// inFlight returns the sorted in-flight operations
+func (t *operationTracker) inFlight() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	operations := make([]string, 0, len(t.operations))
+	for _, operation := range t.operations {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+// shuttingDown returns a channel which is closed once the driver starts shutting down
+func (t *operationTracker) shuttingDown() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shutdown == nil {
+		t.shutdown = make(chan struct{})
+	}
+	return t.shutdown
+}
+
+// startShutdown checkpoints the long running waits watching shuttingDown
+func (t *operationTracker) startShutdown() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shutdown == nil {
+		t.shutdown = make(chan struct{})
+	}
+	select {
+	case <-t.shutdown:
+	default:
+		close(t.shutdown)
+	}
+}
+
+// drain stops accepting new RPCs and waits for the in-flight operations to finish within timeout,
+// the remaining operations are cancelled and reported in the returned error after timeout
+func (t *operationTracker) drain(server gracefulStopper, timeout time.Duration) error {
+	t.startShutdown()
+	klog.Infof("shutting down, draining in-flight operations %v within %v", t.inFlight(), timeout)
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		klog.Infof("all in-flight operations are finished")
+		return nil
+	case <-timer.C:
+	}
+	unfinished := t.inFlight()
+	server.Stop()
+	if len(unfinished) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnfinishedOperations, strings.Join(unfinished, ", "))
+}
+
+// describeOperation returns the RPC method with the volume, snapshot and node it operates on
+func describeOperation(method string, req interface{}) string {
+	var args []string
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		args = append(args, r.GetVolumeId())
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		args = append(args, r.GetSnapshotId())
+	}
+	if r, ok := req.(interface{ GetName() string }); ok && r.GetName() != "" {
+		args = append(args, r.GetName())
+	}
+	if r, ok := req.(interface{ GetNodeId() string }); ok && r.GetNodeId() != "" {
+		args = append(args, r.GetNodeId())
+	}
+	method = method[strings.LastIndex(method, "/")+1:]
+	if len(args) == 0 {
+		return method
+	}
+	return fmt.Sprintf("%s(%s)", method, strings.Join(args, ", "))
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// fakeServer finishes the graceful stop once release is closed
+type fakeServer struct {
+	release chan struct{}
+	stopped bool
+}
+
+func (s *fakeServer) GracefulStop() {
+	<-s.release
+}
+
+func (s *fakeServer) Stop() {
+	s.stopped = true
+	close(s.release)
+}
+
+func TestOperationTrackerInterceptor(t *testing.T) {
+	tracker := &operationTracker{}
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerPublishVolume"}
+	req := &csi.ControllerPublishVolumeRequest{VolumeId: "vol", NodeId: "node"}
+	_, err := tracker.unaryInterceptor(context.Background(), req, info, func(_ context.Context, _ interface{}) (interface{}, error) {
+		assert.Equal(t, []string{"ControllerPublishVolume(vol, node)"}, tracker.inFlight())
+		return nil, errors.New("failed")
+	})
+	assert.Error(t, err)
+	assert.Empty(t, tracker.inFlight())
+}
+
+func TestOperationTrackerDrain(t *testing.T) {
+	tracker := &operationTracker{}
+	server := &fakeServer{release: make(chan struct{})}
+	close(server.release)
+	assert.NoError(t, tracker.drain(server, time.Minute))
+	assert.False(t, server.stopped)
+	select {
+	case <-tracker.shuttingDown():
+	default:
+		t.Error("shutdown channel should be closed after drain")
+	}
+
+	tracker = &operationTracker{}
+	tracker.start("CreateSnapshot(snapshot)")
+	tracker.start("ControllerUnpublishVolume(vol, node)")
+	server = &fakeServer{release: make(chan struct{})}
+	err := tracker.drain(server, time.Millisecond)
+	assert.True(t, errors.Is(err, ErrUnfinishedOperations))
+	assert.Contains(t, err.Error(), "ControllerUnpublishVolume(vol, node), CreateSnapshot(snapshot)")
+	assert.True(t, server.stopped)
+}
+
+func TestDescribeOperation(t *testing.T) {
+	tests := []struct {
+		method   string
+		req      interface{}
+		expected string
+	}{
+		{
+			method:   "/csi.v1.Identity/Probe",
+			req:      &csi.ProbeRequest{},
+			expected: "Probe",
+		},
+		{
+			method:   "/csi.v1.Controller/CreateSnapshot",
+			req:      &csi.CreateSnapshotRequest{Name: "snapshot", SourceVolumeId: "vol"},
+			expected: "CreateSnapshot(snapshot)",
+		},
+		{
+			method:   "/csi.v1.Controller/DeleteSnapshot",
+			req:      &csi.DeleteSnapshotRequest{SnapshotId: "snapshot"},
+			expected: "DeleteSnapshot(snapshot)",
+		},
+		{
+			method:   "/csi.v1.Node/NodeStageVolume",
+			req:      &csi.NodeStageVolumeRequest{VolumeId: "vol"},
+			expected: "NodeStageVolume(vol)",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, describeOperation(test.method, test.req))
+	}
+}
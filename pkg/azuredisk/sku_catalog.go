@@ -0,0 +1,110 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+)
+
+// skuCatalogLoadTimeout is the timeout of listing SKUs from the Resource SKUs API
+const skuCatalogLoadTimeout = 2 * time.Minute
+
+// skuCatalogEnabled returns whether any source of the SKU catalog is configured
+func skuCatalogEnabled(options *DriverOptions) bool {
+	return options.EnableSkuCatalogAPI || options.SkuCatalogCacheFile != "" || options.SkuCatalogOverrideFile != ""
+}
+
+// loadSkuCatalog loads the VM and disk SKU catalog used by perf optimization and NodeGetInfo from the Resource SKUs API,
+// the cache file and the override file, the embedded SKU maps are used if none of them is configured.
+// The Resource SKUs API is only called if listFromAPI is true, otherwise the cache file is used even if it's stale,
+// so that the driver start is not blocked by the API call.
+func loadSkuCatalog(ctx context.Context, cloud *azure.Cloud, options *DriverOptions, listFromAPI bool) {
+	if !skuCatalogEnabled(options) {
+		return
+	}
+
+	config := optimization.SkuCatalogConfig{
+		CacheFile:    options.SkuCatalogCacheFile,
+		CacheTTL:     time.Duration(options.SkuCatalogCacheTTLInSeconds) * time.Second,
+		OverrideFile: options.SkuCatalogOverrideFile,
+	}
+	var lister optimization.ResourceSKULister
+	if cloud != nil {
+		config.Location = cloud.Location
+		if options.EnableSkuCatalogAPI && listFromAPI {
+			var err error
+			if lister, err = newResourceSKULister(cloud); err != nil {
+				klog.Warningf("failed to create Resource SKUs client: %v", err)
+			}
+		}
+	} else if options.EnableSkuCatalogAPI && listFromAPI {
+		klog.Warningf("Resource SKUs API is not available without cloud config")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, skuCatalogLoadTimeout)
+	defer cancel()
+	optimization.LoadSkuCatalog(ctx, lister, config)
+}
+
+// refreshSkuCatalog loads the SKU catalog from the Resource SKUs API in the background once the driver runs, and then
+// reloads the SKU catalog with the cloud config in use every interval until ctx is done, 0 interval disables the reload.
+// The cache and override files are loaded when the driver is created, so the first reload happens after one interval
+// if the Resource SKUs API is not enabled.
+func (d *Driver) refreshSkuCatalog(ctx context.Context, interval time.Duration) {
+	if d.skuCatalogOptions.EnableSkuCatalogAPI {
+		loadSkuCatalog(ctx, d.getCloud(), d.skuCatalogOptions, true)
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			loadSkuCatalog(ctx, d.getCloud(), d.skuCatalogOptions, true)
+		}
+	}
+}
+
+// newResourceSKULister returns a ResourceSKULister with the credential in cloud config
+func newResourceSKULister(cloud *azure.Cloud) (optimization.ResourceSKULister, error) {
+	cred, err := armCredential(cloud)
+	if err != nil {
+		return nil, err
+	}
+	clientOption, err := azclient.GetAzCoreClientOption(&cloud.ARMClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := armcompute.NewResourceSKUsClient(cloud.SubscriptionID, cred, &arm.ClientOptions{ClientOptions: *clientOption})
+	if err != nil {
+		return nil, err
+	}
+	return optimization.NewResourceSKULister(client), nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+)
+
+func TestLoadSkuCatalog(t *testing.T) {
+	t.Cleanup(func() {
+		optimization.LoadSkuCatalog(context.Background(), nil, optimization.SkuCatalogConfig{})
+	})
+	overrideFile := filepath.Join(t.TempDir(), "skus.json")
+	assert.NoError(t, os.WriteFile(overrideFile, []byte(`[
+  {"resourceType": "virtualMachines", "name": "Standard_X4s_v9", "capabilities": [{"name": "MaxDataDiskCount", "value": "24"}]},
+  {"resourceType": "virtualMachines", "name": "Standard_D2_v2", "capabilities": [{"name": "MaxDataDiskCount", "value": "4"}]}
+]`), 0644))
+
+	// the catalog is not loaded without any source
+	loadSkuCatalog(context.Background(), nil, &DriverOptions{SkuCatalogOverrideFile: ""}, true)
+	assert.Equal(t, int64(defaultAzureVolumeLimit), getMaxDataDiskCount("Standard_X4s_v9"))
+
+	loadSkuCatalog(context.Background(), nil, &DriverOptions{EnableSkuCatalogAPI: true, SkuCatalogOverrideFile: overrideFile}, true)
+	assert.Equal(t, int64(24), getMaxDataDiskCount("Standard_X4s_v9"))
+	// the loaded SKU takes precedence over the embedded map
+	assert.Equal(t, int64(4), getMaxDataDiskCount("standard_d2_v2"))
+	assert.Equal(t, int64(64), getMaxDataDiskCount("Standard_DS14_V2"))
+	assert.Equal(t, int64(defaultAzureVolumeLimit), getMaxDataDiskCount("NOT_EXISTING"))
+
+	// the stale cache file is used without calling the Resource SKUs API when the driver is created
+	cacheFile := filepath.Join(t.TempDir(), "sku-catalog.json")
+	assert.NoError(t, os.WriteFile(cacheFile, []byte(`[
+  {"resourceType": "virtualMachines", "name": "Standard_X4s_v9", "capabilities": [{"name": "MaxDataDiskCount", "value": "32"}]}
+]`), 0644))
+	staleTime := time.Now().Add(-48 * time.Hour)
+	assert.NoError(t, os.Chtimes(cacheFile, staleTime, staleTime))
+	loadSkuCatalog(context.Background(), nil, &DriverOptions{EnableSkuCatalogAPI: true, SkuCatalogCacheFile: cacheFile, SkuCatalogCacheTTLInSeconds: 86400}, false)
+	assert.Equal(t, int64(32), getMaxDataDiskCount("Standard_X4s_v9"))
+}
+
+func TestRefreshSkuCatalog(t *testing.T) {
+	t.Cleanup(func() {
+		optimization.LoadSkuCatalog(context.Background(), nil, optimization.SkuCatalogConfig{})
+	})
+	overrideFile := filepath.Join(t.TempDir(), "skus.json")
+	writeOverride := func(maxDataDiskCount string) {
+		assert.NoError(t, os.WriteFile(overrideFile, []byte(`[
+  {"resourceType": "virtualMachines", "name": "Standard_X4s_v9", "capabilities": [{"name": "MaxDataDiskCount", "value": "`+maxDataDiskCount+`"}]}
+]`), 0644))
+	}
+	writeOverride("24")
+
+	d := &Driver{}
+	d.skuCatalogOptions = &DriverOptions{SkuCatalogOverrideFile: overrideFile}
+	loadSkuCatalog(context.Background(), nil, d.skuCatalogOptions, false)
+	assert.Equal(t, int64(24), getMaxDataDiskCount("Standard_X4s_v9"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.refreshSkuCatalog(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	// the change of the override file is picked up by the periodic reload
+	writeOverride("32")
+	assert.Eventually(t, func() bool {
+		return getMaxDataDiskCount("Standard_X4s_v9") == 32
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestRefreshSkuCatalogOnce(t *testing.T) {
+	t.Cleanup(func() {
+		optimization.LoadSkuCatalog(context.Background(), nil, optimization.SkuCatalogConfig{})
+	})
+	overrideFile := filepath.Join(t.TempDir(), "skus.json")
+	assert.NoError(t, os.WriteFile(overrideFile, []byte(`[
+  {"resourceType": "virtualMachines", "name": "Standard_X4s_v9", "capabilities": [{"name": "MaxDataDiskCount", "value": "24"}]}
+]`), 0644))
+
+	// the Resource SKUs API is called once in the background without the periodic reload
+	d := &Driver{}
+	d.skuCatalogOptions = &DriverOptions{EnableSkuCatalogAPI: true, SkuCatalogOverrideFile: overrideFile}
+	done := make(chan struct{})
+	go func() {
+		d.refreshSkuCatalog(context.Background(), 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refreshSkuCatalog did not return without the periodic reload")
+	}
+	assert.Equal(t, int64(24), getMaxDataDiskCount("Standard_X4s_v9"))
+}
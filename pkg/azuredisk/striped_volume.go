@@ -0,0 +1,484 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
+	azureconsts "sigs.k8s.io/cloud-provider-azure/pkg/consts"
+	"sigs.k8s.io/cloud-provider-azure/pkg/metrics"
+)
+
+const (
+	stripedVolumeGroupPrefix = "azdisk-"
+	stripedLogicalVolumeName = "striped"
+)
+
+var invalidVolumeGroupNameCharRE = regexp.MustCompile(`[^a-zA-Z0-9+_.-]`)
+
+// A striped volume is made of stripeCount member disks with the same size, its volume ID is a composite of
+// the member count and the base disk URI which member disk URIs are derived from, see azureutils.GetStripedVolumeID. Controller operations on a striped volume fan out
+// to all member disks by calling the same operation with member disk URIs, and the node assembles member
+// disks into one striped LVM logical volume.
+
+// getVolumeMembers returns member disk URIs of a striped volume, or the volume ID itself for a regular volume
+func getVolumeMembers(volumeID string) ([]string, error) {
+	if azureutils.IsStripedVolumeID(volumeID) {
+		return azureutils.GetStripedVolumeMembers(volumeID)
+	}
+	return []string{volumeID}, nil
+}
+
+// createStripedVolume creates member disks of a striped volume one by one, a retry would reuse the member disks already created
+func (d *Driver) createStripedVolume(ctx context.Context, req *csi.CreateVolumeRequest, diskParams azureutils.ManagedDiskParameters) (*csi.CreateVolumeResponse, error) {
+	stripeCount := diskParams.StripeCount
+	if diskParams.MaxShares > 1 {
+		return nil, status.Error(codes.InvalidArgument, "shared disk is not supported on striped volume")
+	}
+
+	requestGiB := int(volumehelper.RoundUpGiB(req.GetCapacityRange().GetRequiredBytes()))
+	if requestGiB < consts.MinimumDiskSizeGiB {
+		requestGiB = consts.MinimumDiskSizeGiB
+	}
+	memberGiB := (requestGiB + stripeCount - 1) / stripeCount
+	maxVolSize := int(volumehelper.RoundUpGiB(req.GetCapacityRange().GetLimitBytes()))
+	if (maxVolSize > 0) && (maxVolSize < memberGiB*stripeCount) {
+		return nil, status.Error(codes.InvalidArgument, "After round-up, volume size exceeds the limit specified")
+	}
+
+	var sourceMembers []string
+	if content := req.GetVolumeContentSource(); content != nil {
+		sourceID := content.GetVolume().GetVolumeId()
+		if content.GetSnapshot() != nil {
+			sourceID = content.GetSnapshot().GetSnapshotId()
+		}
+		if !azureutils.IsStripedVolumeID(sourceID) {
+			return nil, status.Errorf(codes.InvalidArgument, "striped volume could only be created from a striped volume or its snapshot, source(%s)", sourceID)
+		}
+		var err error
+		if sourceMembers, err = azureutils.GetStripedVolumeMembers(sourceID); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if len(sourceMembers) != stripeCount {
+			return nil, status.Errorf(codes.InvalidArgument, "%s(%d) is not equal to the member count(%d) of source(%s)", consts.StripeCountField, stripeCount, len(sourceMembers), sourceID)
+		}
+	}
+
+	name := diskParams.DiskName
+	if name == "" {
+		name = req.GetName()
+	}
+	name = azureutils.CreateValidDiskName(name)
+
+	memberParams := map[string]string{}
+	for k, v := range req.GetParameters() {
+		switch strings.ToLower(k) {
+		case consts.StripeCountField, consts.StripeSizeKiBField, consts.DiskNameField:
+		default:
+			memberParams[k] = v
+		}
+	}
+
+	klog.V(2).Infof("begin to create striped volume(%s) with %d member disks, member size(%dGiB) stripe size(%dKiB)", name, stripeCount, memberGiB, diskParams.StripeSizeKiB)
+	memberIDs := make([]string, 0, stripeCount)
+	accessibilityRequirements := req.GetAccessibilityRequirements()
+	var volumeContext map[string]string
+	var accessibleTopology []*csi.Topology
+	for i := 0; i < stripeCount; i++ {
+		memberName := azureutils.GetStripeMemberName(name, i)
+		params := make(map[string]string, len(memberParams)+1)
+		for k, v := range memberParams {
+			params[k] = v
+		}
+		params[consts.DiskNameField] = memberName
+
+		memberReq := &csi.CreateVolumeRequest{
+			Name:                      memberName,
+			CapacityRange:             &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(int64(memberGiB))},
+			VolumeCapabilities:        req.GetVolumeCapabilities(),
+			Parameters:                params,
+			Secrets:                   req.GetSecrets(),
+			AccessibilityRequirements: accessibilityRequirements,
+		}
+		if sourceMembers != nil {
+			if req.GetVolumeContentSource().GetSnapshot() != nil {
+				memberReq.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: sourceMembers[i]}},
+				}
+			} else {
+				memberReq.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceMembers[i]}},
+				}
+			}
+		}
+
+		resp, err := d.CreateVolume(ctx, memberReq)
+		if err != nil {
+			klog.Errorf("create member disk(%s) of striped volume(%s) failed with %v", memberName, name, err)
+			return nil, err
+		}
+		memberIDs = append(memberIDs, resp.GetVolume().GetVolumeId())
+
+		if i == 0 {
+			volumeContext = resp.GetVolume().GetVolumeContext()
+			accessibleTopology = resp.GetVolume().GetAccessibleTopology()
+			// all member disks must be placed in the same zone as the first one
+			if len(accessibleTopology) == 1 {
+				accessibilityRequirements = &csi.TopologyRequirement{
+					Requisite: accessibleTopology,
+					Preferred: accessibleTopology,
+				}
+			}
+		} else if required, ok := resp.GetVolume().GetVolumeContext()[consts.ResizeRequired]; ok {
+			volumeContext[consts.ResizeRequired] = required
+		}
+	}
+
+	delete(volumeContext, consts.DiskNameField)
+	if diskParams.DiskName != "" {
+		volumeContext[consts.DiskNameField] = diskParams.DiskName
+	}
+	volumeContext[consts.StripeCountField] = strconv.Itoa(stripeCount)
+	volumeContext[consts.StripeSizeKiBField] = strconv.Itoa(diskParams.StripeSizeKiB)
+	volumeContext[consts.RequestedSizeGib] = strconv.Itoa(memberGiB * stripeCount)
+
+	volumeID, err := getStripedVolumeID(name, memberIDs)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	klog.V(2).Infof("create striped volume(%s) successfully", volumeID)
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           volumeID,
+			CapacityBytes:      volumehelper.GiBToBytes(int64(memberGiB * stripeCount)),
+			VolumeContext:      volumeContext,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: accessibleTopology,
+		},
+	}, nil
+}
+
+// deleteStripedVolume deletes all member disks of a striped volume
+func (d *Driver) deleteStripedVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	members, err := azureutils.GetStripedVolumeMembers(volumeID)
+	if err != nil {
+		klog.Errorf("GetStripedVolumeMembers(%s) in DeleteVolume failed with error: %v", volumeID, err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if acquired := d.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer d.volumeLocks.Release(volumeID)
+
+	for _, member := range members {
+		if _, err := d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: member, Secrets: req.GetSecrets()}); err != nil {
+			return nil, err
+		}
+	}
+	klog.V(2).Infof("delete striped volume(%s) successfully", volumeID)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// publishStripedVolume attaches all member disks of a striped volume to the node in one batch, which is one VM update,
+// the members attached by the batch are detached again if the batch fails, so the volume is never left partially attached
+func (d *Driver) publishStripedVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	members, err := azureutils.GetStripedVolumeMembers(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume not found, failed with error: %v", err))
+	}
+
+	nodeID := req.GetNodeId()
+	if len(nodeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID not provided")
+	}
+	nodeName := types.NodeName(nodeID)
+
+	volumeContext := req.GetVolumeContext()
+	cachingMode, err := azureutils.GetCachingMode(volumeContext)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	mc := metrics.NewMetricContext(consts.AzureDiskCSIDriverName, "controller_publish_volume", d.getCloud().ResourceGroup, d.getCloud().SubscriptionID, d.Name)
+	isOperationSucceeded := false
+	defer func() {
+		mc.ObserveOperationWithResult(isOperationSucceeded, consts.VolumeID, volumeID, consts.Node, nodeID)
+	}()
+
+	luns := make([]string, len(members))
+	var pending []attachDiskRequest
+	var pendingIndexes []int
+	for i, member := range members {
+		diskName, err := azureutils.GetDiskName(member)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+		lun, _, err := d.diskController.GetDiskLun(diskName, member, nodeName)
+		if err == cloudprovider.InstanceNotFound {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("failed to get azure instance id for node %q (%v)", nodeName, err))
+		}
+		if err == nil {
+			// the member is already attached to the node
+			luns[i] = strconv.Itoa(int(lun))
+			continue
+		}
+		if !strings.Contains(err.Error(), azureconsts.CannotFindDiskLUN) {
+			return nil, status.Errorf(codes.Internal, "could not get disk lun for volume %s: %v", member, err)
+		}
+
+		disk, err := d.checkDiskExists(ctx, member)
+		if err != nil {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume not found, failed with error: %v", err))
+		}
+		if disk, err = d.detachDanglingStripeMember(ctx, member, diskName, nodeName, disk); err != nil {
+			return nil, err
+		}
+		pending = append(pending, attachDiskRequest{diskName: diskName, diskURI: member, cachingMode: cachingMode, disk: disk})
+		pendingIndexes = append(pendingIndexes, i)
+	}
+
+	if len(pending) > 0 {
+		if attachDiskInitialDelay := azureutils.GetAttachDiskInitialDelay(volumeContext); attachDiskInitialDelay > 0 {
+			klog.V(2).Infof("attachDiskInitialDelayInMs is set to %d", attachDiskInitialDelay)
+			d.diskController.AttachDetachInitialDelayInMs = attachDiskInitialDelay
+		}
+		occupiedLuns := d.getOccupiedLunsFromNode(ctx, nodeName, volumeID)
+		klog.V(2).Infof("Trying to attach %d member disks of striped volume %s to node %s", len(pending), volumeID, nodeName)
+		attachedLuns, err := d.diskController.AttachDisks(ctx, nodeName, pending, occupiedLuns)
+		if err != nil {
+			klog.Errorf("Attach striped volume %s to instance %s failed with %v, detaching its member disks attached by the batch", volumeID, nodeName, err)
+			d.detachStripeMembers(ctx, nodeName, pending)
+			errMsg := fmt.Sprintf("Attach striped volume %s to instance %s failed with %v", volumeID, nodeName, err)
+			if len(errMsg) > maxErrMsgLength {
+				errMsg = errMsg[:maxErrMsgLength]
+			}
+			return nil, status.Errorf(codes.Internal, errMsg)
+		}
+		for i, lun := range attachedLuns {
+			luns[pendingIndexes[i]] = strconv.Itoa(int(lun))
+		}
+	}
+
+	klog.V(2).Infof("attach striped volume %s to node %s successfully, luns: %v", volumeID, nodeName, luns)
+	isOperationSucceeded = true
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{
+			consts.LUN:        luns[0],
+			consts.StripeLUNs: strings.Join(luns, ","),
+		},
+	}, nil
+}
+
+// detachDanglingStripeMember detaches the member disk from the node it's attached to if that's not the node to attach,
+// and returns the disk refreshed after the detach
+func (d *Driver) detachDanglingStripeMember(ctx context.Context, diskURI, diskName string, nodeName types.NodeName, disk *armcompute.Disk) (*armcompute.Disk, error) {
+	attachedNode, err := d.diskController.getAttachedNode(nodeName, disk)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not get the node which volume %s is attached to: %v", diskURI, err)
+	}
+	if attachedNode == "" || strings.EqualFold(string(nodeName), string(attachedNode)) {
+		return disk, nil
+	}
+	klog.Warningf("volume %s is already attached to node %s, try detach first", diskURI, attachedNode)
+	if err := d.diskController.DetachDisk(ctx, diskName, diskURI, attachedNode); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not detach volume %s from node %s: %v", diskURI, attachedNode, err)
+	}
+	if disk, err = d.checkDiskExists(ctx, diskURI); err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume not found, failed with error: %v", err))
+	}
+	return disk, nil
+}
+
+// detachStripeMembers detaches the member disks which are attached to the node, the errors are only logged
+// since the attach error is returned and the attach would be retried
+func (d *Driver) detachStripeMembers(ctx context.Context, nodeName types.NodeName, members []attachDiskRequest) {
+	for _, member := range members {
+		if _, _, err := d.diskController.GetDiskLun(member.diskName, member.diskURI, nodeName); err != nil {
+			continue
+		}
+		if err := d.diskController.DetachDisk(ctx, member.diskName, member.diskURI, nodeName); err != nil {
+			klog.Errorf("detach member disk %s of the striped volume from node %s failed with %v", member.diskURI, nodeName, err)
+		}
+	}
+}
+
+// unpublishStripedVolume detaches all member disks of a striped volume from the node concurrently
+func (d *Driver) unpublishStripedVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	members, err := azureutils.GetStripedVolumeMembers(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i := range members {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+				VolumeId: members[i],
+				NodeId:   req.GetNodeId(),
+				Secrets:  req.GetSecrets(),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	klog.V(2).Infof("detach striped volume %s from node %s successfully", req.GetVolumeId(), req.GetNodeId())
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// expandStripedVolume expands all member disks of a striped volume evenly
+func (d *Driver) expandStripedVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	members, err := azureutils.GetStripedVolumeMembers(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "striped volume ID(%s) is not valid: %v", req.GetVolumeId(), err)
+	}
+
+	requestGiB := volumehelper.RoundUpGiB(req.GetCapacityRange().GetRequiredBytes())
+	memberGiB := (requestGiB + int64(len(members)) - 1) / int64(len(members))
+	var capacityBytes int64
+	for _, member := range members {
+		resp, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+			VolumeId:         member,
+			CapacityRange:    &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(memberGiB)},
+			Secrets:          req.GetSecrets(),
+			VolumeCapability: req.GetVolumeCapability(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		capacityBytes += resp.GetCapacityBytes()
+	}
+
+	klog.V(2).Infof("expand striped volume(%s) successfully, currentSize(%d)", req.GetVolumeId(), capacityBytes)
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacityBytes,
+		NodeExpansionRequired: true,
+	}, nil
+}
+
+// createStripedSnapshot takes snapshots of all member disks of a striped volume as a group,
+// member snapshots are not taken atomically, so the application should be quiesced for a consistent group snapshot
+func (d *Driver) createStripedSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	sourceVolumeID := req.GetSourceVolumeId()
+	members, err := azureutils.GetStripedVolumeMembers(sourceVolumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "striped volume ID(%s) is not valid: %v", sourceVolumeID, err)
+	}
+
+	snapshotName := azureutils.CreateValidDiskName(req.GetName())
+	snapshotIDs := make([]string, 0, len(members))
+	groupSnapshot := &csi.Snapshot{
+		SourceVolumeId: sourceVolumeID,
+		ReadyToUse:     true,
+	}
+	for i, member := range members {
+		resp, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			SourceVolumeId: member,
+			Name:           azureutils.GetStripeMemberName(snapshotName, i),
+			Secrets:        req.GetSecrets(),
+			Parameters:     req.GetParameters(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		snapshot := resp.GetSnapshot()
+		snapshotIDs = append(snapshotIDs, snapshot.GetSnapshotId())
+		groupSnapshot.SizeBytes += snapshot.GetSizeBytes()
+		groupSnapshot.ReadyToUse = groupSnapshot.ReadyToUse && snapshot.GetReadyToUse()
+		if groupSnapshot.CreationTime == nil || (snapshot.GetCreationTime() != nil && snapshot.GetCreationTime().AsTime().After(groupSnapshot.CreationTime.AsTime())) {
+			groupSnapshot.CreationTime = snapshot.GetCreationTime()
+		}
+	}
+	if groupSnapshot.SnapshotId, err = getStripedVolumeID(snapshotName, snapshotIDs); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	klog.V(2).Infof("create snapshot(%s) of striped volume(%s) successfully", groupSnapshot.SnapshotId, sourceVolumeID)
+	return &csi.CreateSnapshotResponse{Snapshot: groupSnapshot}, nil
+}
+
+// deleteStripedSnapshot deletes all member snapshots of a striped volume snapshot
+func (d *Driver) deleteStripedSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	members, err := azureutils.GetStripedVolumeMembers(req.GetSnapshotId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	for _, member := range members {
+		if _, err := d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: member, Secrets: req.GetSecrets()}); err != nil {
+			return nil, err
+		}
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// getStripedVolumeID returns the composite ID of the members created with the base name,
+// the members must be derivable from the ID, e.g. they are in the same resource group
+func getStripedVolumeID(baseName string, memberIDs []string) (string, error) {
+	baseID := memberIDs[0][:strings.LastIndex(memberIDs[0], "/")+1] + baseName
+	id := azureutils.GetStripedVolumeID(baseID, len(memberIDs))
+	members, err := azureutils.GetStripedVolumeMembers(id)
+	if err != nil {
+		return "", err
+	}
+	for i := range members {
+		if !strings.EqualFold(members[i], memberIDs[i]) {
+			return "", fmt.Errorf("member(%s) could not be derived from striped volume ID(%s), expected %s", memberIDs[i], id, members[i])
+		}
+	}
+	return id, nil
+}
+
+// getStripedVolumeGroupName returns the LVM volume group name of a striped volume on the node, e.g. azdisk-pvc-xxx
+func getStripedVolumeGroupName(volumeID string) string {
+	name := volumeID
+	if baseID, _, err := azureutils.ParseStripedVolumeID(volumeID); err == nil {
+		name = baseID[strings.LastIndex(baseID, "/")+1:]
+	}
+	return stripedVolumeGroupPrefix + invalidVolumeGroupNameCharRE.ReplaceAllString(name, "-")
+}
+
+// getStripedLogicalVolumePath returns the device path of the striped logical volume, e.g. /dev/azdisk-pvc-xxx/striped
+func getStripedLogicalVolumePath(vgName string) string {
+	return filepath.Join("/dev", vgName, stripedLogicalVolumeName)
+}
@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const lvmDiskFormat = "LVM2_member"
+
+// assembleStripedVolume creates or activates the striped logical volume on member devices and returns its device path,
+// blank member devices are initialized as a new volume group, a device which contains any other data is never touched.
+func assembleStripedVolume(devicePaths []string, vgName string, stripeSizeKiB int, m *mount.SafeFormatAndMount) (string, error) {
+	lvPath := getStripedLogicalVolumePath(vgName)
+	if _, err := os.Stat(lvPath); err == nil {
+		klog.V(2).Infof("assembleStripedVolume: %s is already active", lvPath)
+		return lvPath, nil
+	}
+
+	blankDevices := 0
+	for _, devicePath := range devicePaths {
+		format, err := m.GetDiskFormat(devicePath)
+		if err != nil {
+			return "", fmt.Errorf("failed to get disk format of %s: %v", devicePath, err)
+		}
+		switch format {
+		case "":
+			blankDevices++
+		case lvmDiskFormat:
+		default:
+			return "", fmt.Errorf("refuse to use %s as a member of striped volume %s since it already contains %s data", devicePath, vgName, format)
+		}
+	}
+
+	switch blankDevices {
+	case len(devicePaths):
+		klog.V(2).Infof("assembleStripedVolume: creating volume group %s on %v", vgName, devicePaths)
+		// vgcreate initializes the devices as physical volumes as well
+		args := append([]string{vgName}, devicePaths...)
+		if output, err := m.Exec.Command("vgcreate", args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to create volume group %s on %v: %v, output: %s", vgName, devicePaths, err, string(output))
+		}
+	case 0:
+		klog.V(2).Infof("assembleStripedVolume: activating volume group %s", vgName)
+		if output, err := m.Exec.Command("vgchange", "--activate", "y", vgName).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to activate volume group %s: %v, output: %s", vgName, err, string(output))
+		}
+	default:
+		return "", fmt.Errorf("%d of %d member devices of striped volume %s are not initialized", blankDevices, len(devicePaths), vgName)
+	}
+
+	if _, err := os.Stat(lvPath); err != nil {
+		klog.V(2).Infof("assembleStripedVolume: creating logical volume %s with %d stripes, stripe size %dKiB", lvPath, len(devicePaths), stripeSizeKiB)
+		args := []string{"--yes", "--type", "striped", "--stripes", strconv.Itoa(len(devicePaths)), "--stripesize", fmt.Sprintf("%dk", stripeSizeKiB),
+			"--extents", "100%FREE", "--name", stripedLogicalVolumeName, vgName}
+		if output, err := m.Exec.Command("lvcreate", args...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("failed to create logical volume %s: %v, output: %s", lvPath, err, string(output))
+		}
+	}
+	return lvPath, nil
+}
+
+// deactivateStripedVolume deactivates the volume group of a striped volume so that member disks could be detached safely
+func deactivateStripedVolume(vgName string, m *mount.SafeFormatAndMount) error {
+	if _, err := os.Stat(filepath.Dir(getStripedLogicalVolumePath(vgName))); err != nil {
+		return nil
+	}
+	if output, err := m.Exec.Command("vgchange", "--activate", "n", vgName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to deactivate volume group %s: %v, output: %s", vgName, err, string(output))
+	}
+	klog.V(2).Infof("deactivateStripedVolume: deactivated volume group %s", vgName)
+	return nil
+}
+
+// growStripedVolume grows all physical volumes to the size of member disks and extends the striped logical volume over the free space
+func growStripedVolume(vgName string, m *mount.SafeFormatAndMount) error {
+	output, err := m.Exec.Command("pvs", "--noheadings", "--options", "pv_name", "--select", "vg_name="+vgName).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list physical volumes of volume group %s: %v", vgName, err)
+	}
+	pvs := strings.Fields(string(output))
+	if len(pvs) == 0 {
+		return fmt.Errorf("could not find any physical volume of volume group %s", vgName)
+	}
+	for _, pv := range pvs {
+		if output, err := m.Exec.Command("pvresize", pv).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to resize physical volume %s: %v, output: %s", pv, err, string(output))
+		}
+	}
+
+	lv := vgName + "/" + stripedLogicalVolumeName
+	if output, err := m.Exec.Command("lvextend", "--extents", "+100%FREE", lv).CombinedOutput(); err != nil {
+		if strings.Contains(string(output), "matches existing size") || strings.Contains(string(output), "not larger than existing size") {
+			klog.V(2).Infof("growStripedVolume: logical volume %s is already at the maximum size", lv)
+			return nil
+		}
+		return fmt.Errorf("failed to extend logical volume %s: %v, output: %s", lv, err, string(output))
+	}
+	klog.V(2).Infof("growStripedVolume: extended logical volume %s", lv)
+	return nil
+}
@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	testingexec "k8s.io/utils/exec/testing"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/mounter"
+)
+
+func TestAssembleStripedVolume(t *testing.T) {
+	blkidNoFormatAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, &testingexec.FakeExitError{Status: 2}
+	}
+	blkidLVMAction := func() ([]byte, []byte, error) {
+		return []byte("DEVICE=/dev/sdc\nTYPE=LVM2_member"), []byte{}, nil
+	}
+	blkidExt4Action := func() ([]byte, []byte, error) {
+		return []byte("DEVICE=/dev/sdd\nTYPE=ext4"), []byte{}, nil
+	}
+	lvmAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	lvmFailedAction := func() ([]byte, []byte, error) {
+		return []byte("Volume group not found"), []byte{}, &testingexec.FakeExitError{Status: 5}
+	}
+
+	tests := []struct {
+		desc          string
+		outputScripts []testingexec.FakeAction
+		expectedPath  string
+		expectedErr   bool
+	}{
+		{
+			desc:          "create striped volume on blank devices",
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, blkidNoFormatAction, lvmAction, lvmAction},
+			expectedPath:  "/dev/azdisk-pvc-xxx/striped",
+		},
+		{
+			desc:          "activate existing striped volume",
+			outputScripts: []testingexec.FakeAction{blkidLVMAction, blkidLVMAction, lvmAction, lvmAction},
+			expectedPath:  "/dev/azdisk-pvc-xxx/striped",
+		},
+		{
+			desc:          "refuse device with file system",
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, blkidExt4Action},
+			expectedErr:   true,
+		},
+		{
+			desc:          "partially initialized devices",
+			outputScripts: []testingexec.FakeAction{blkidLVMAction, blkidNoFormatAction},
+			expectedErr:   true,
+		},
+		{
+			desc:          "vgchange failed",
+			outputScripts: []testingexec.FakeAction{blkidLVMAction, blkidLVMAction, lvmFailedAction},
+			expectedErr:   true,
+		},
+		{
+			desc:          "lvcreate failed",
+			outputScripts: []testingexec.FakeAction{blkidNoFormatAction, blkidNoFormatAction, lvmAction, lvmFailedAction},
+			expectedErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+
+		path, err := assembleStripedVolume([]string{"/dev/sdc", "/dev/sdd"}, "azdisk-pvc-xxx", 64, fakeMounter)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		assert.Equal(t, test.expectedPath, path, test.desc)
+	}
+}
+
+func TestGrowStripedVolume(t *testing.T) {
+	pvsAction := func() ([]byte, []byte, error) {
+		return []byte("  /dev/sdc\n  /dev/sdd\n"), []byte{}, nil
+	}
+	emptyPvsAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	lvmAction := func() ([]byte, []byte, error) {
+		return []byte{}, []byte{}, nil
+	}
+	lvextendNoChangeAction := func() ([]byte, []byte, error) {
+		return []byte("New size (2558 extents) matches existing size (2558 extents)."), []byte{}, &testingexec.FakeExitError{Status: 5}
+	}
+	lvmFailedAction := func() ([]byte, []byte, error) {
+		return []byte("failed"), []byte{}, &testingexec.FakeExitError{Status: 5}
+	}
+
+	tests := []struct {
+		desc          string
+		outputScripts []testingexec.FakeAction
+		expectedErr   bool
+	}{
+		{
+			desc:          "grow striped volume",
+			outputScripts: []testingexec.FakeAction{pvsAction, lvmAction, lvmAction, lvmAction},
+		},
+		{
+			desc:          "striped volume is already at the maximum size",
+			outputScripts: []testingexec.FakeAction{pvsAction, lvmAction, lvmAction, lvextendNoChangeAction},
+		},
+		{
+			desc:          "no physical volume found",
+			outputScripts: []testingexec.FakeAction{emptyPvsAction},
+			expectedErr:   true,
+		},
+		{
+			desc:          "pvresize failed",
+			outputScripts: []testingexec.FakeAction{pvsAction, lvmFailedAction},
+			expectedErr:   true,
+		},
+		{
+			desc:          "lvextend failed",
+			outputScripts: []testingexec.FakeAction{pvsAction, lvmAction, lvmAction, lvmFailedAction},
+			expectedErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		fakeMounter, err := mounter.NewFakeSafeMounter()
+		assert.NoError(t, err)
+		fakeMounter.Exec.(*mounter.FakeSafeMounter).SetNextCommandOutputScripts(test.outputScripts...)
+
+		err = growStripedVolume("azdisk-pvc-xxx", fakeMounter)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/pointer"
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	volumehelper "sigs.k8s.io/azuredisk-csi-driver/pkg/util"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient/mock_diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/mock_azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient/mock_snapshotclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmclient/mockvmclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+func TestGetStripedVolumeGroupName(t *testing.T) {
+	volumeID := azureutils.GetStripedVolumeID(fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "pvc-xxx"), 2)
+	assert.Equal(t, "azdisk-pvc-xxx", getStripedVolumeGroupName(volumeID))
+	assert.Equal(t, "/dev/azdisk-pvc-xxx/striped", filepath.ToSlash(getStripedLogicalVolumePath("azdisk-pvc-xxx")))
+}
+
+func TestGetVolumeMembers(t *testing.T) {
+	members := []string{
+		fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "pvc-xxx-0"),
+		fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "pvc-xxx-1"),
+	}
+	result, err := getVolumeMembers(azureutils.GetStripedVolumeID(fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "pvc-xxx"), 2))
+	assert.NoError(t, err)
+	assert.Equal(t, members, result)
+
+	result, err = getVolumeMembers(testVolumeID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{testVolumeID}, result)
+
+	_, err = getVolumeMembers(consts.StripedVolumeIDPrefix + "invalid")
+	assert.Error(t, err)
+}
+
+func TestCreateStripedVolume(t *testing.T) {
+	stdCapacityRangetest := &csi.CapacityRange{
+		RequiredBytes: volumehelper.GiBToBytes(10),
+	}
+	sourceID := azureutils.GetStripedVolumeID(fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "source"), 2)
+
+	tests := []struct {
+		desc          string
+		parameters    map[string]string
+		contentSource *csi.VolumeContentSource
+		expectedErr   error
+	}{
+		{
+			desc:        "invalid stripe count",
+			parameters:  map[string]string{consts.StripeCountField: "17"},
+			expectedErr: status.Error(codes.InvalidArgument, "Failed parsing disk parameters: stripecount(17) must be in range [1, 16]"),
+		},
+		{
+			desc:        "shared disk is not supported",
+			parameters:  map[string]string{consts.StripeCountField: "3", consts.MaxSharesField: "2"},
+			expectedErr: status.Error(codes.InvalidArgument, "shared disk is not supported on striped volume"),
+		},
+		{
+			desc:       "source is not a striped volume",
+			parameters: map[string]string{consts.StripeCountField: "3"},
+			contentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: testVolumeID}},
+			},
+			expectedErr: status.Errorf(codes.InvalidArgument, "striped volume could only be created from a striped volume or its snapshot, source(%s)", testVolumeID),
+		},
+		{
+			desc:       "stripe count does not match source",
+			parameters: map[string]string{consts.StripeCountField: "3"},
+			contentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: sourceID}},
+			},
+			expectedErr: status.Errorf(codes.InvalidArgument, "stripecount(3) is not equal to the member count(2) of source(%s)", sourceID),
+		},
+	}
+	for _, test := range tests {
+		cntl := gomock.NewController(t)
+		d, _ := NewFakeDriver(cntl)
+		req := &csi.CreateVolumeRequest{
+			Name:                testVolumeName,
+			VolumeCapabilities:  createVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			CapacityRange:       stdCapacityRangetest,
+			Parameters:          test.parameters,
+			VolumeContentSource: test.contentSource,
+		}
+		_, err := d.CreateVolume(context.Background(), req)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		cntl.Finish()
+	}
+}
+
+func TestCreateStripedVolumeSuccess(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := NewFakeDriver(cntl)
+
+	var mutex sync.Mutex
+	createdDisks := map[string]int32{}
+	state := "Succeeded"
+	diskClient := mock_diskclient.NewMockInterface(cntl)
+	d.getClientFactory().(*mock_azclient.MockClientFactory).EXPECT().GetDiskClientForSub(gomock.Any()).Return(diskClient, nil).AnyTimes()
+	diskClient.EXPECT().CreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, name string, disk armcompute.Disk) (*armcompute.Disk, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			createdDisks[name] = *disk.Properties.DiskSizeGB
+			return &disk, nil
+		}).Times(3)
+	diskClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, rg, name string) (*armcompute.Disk, error) {
+			id := fmt.Sprintf(consts.ManagedDiskPath, "subs", rg, name)
+			return &armcompute.Disk{ID: &id, Name: &name, Properties: &armcompute.DiskProperties{ProvisioningState: &state}}, nil
+		}).AnyTimes()
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-striped",
+		VolumeCapabilities: createVolumeCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(10)},
+		Parameters:         map[string]string{consts.StripeCountField: "3", consts.SkuNameField: "Premium_LRS"},
+	}
+	resp, err := d.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int32{"pvc-striped-0": 4, "pvc-striped-1": 4, "pvc-striped-2": 4}, createdDisks)
+
+	members, err := azureutils.GetStripedVolumeMembers(resp.GetVolume().GetVolumeId())
+	assert.NoError(t, err)
+	assert.Len(t, members, 3)
+	for i, member := range members {
+		diskName, err := azureutils.GetDiskName(member)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("pvc-striped-%d", i), diskName)
+	}
+	assert.Equal(t, volumehelper.GiBToBytes(12), resp.GetVolume().GetCapacityBytes())
+	volumeContext := resp.GetVolume().GetVolumeContext()
+	assert.Equal(t, "3", volumeContext[consts.StripeCountField])
+	assert.Equal(t, "64", volumeContext[consts.StripeSizeKiBField])
+	assert.Equal(t, "12", volumeContext[consts.RequestedSizeGib])
+	_, ok := volumeContext[consts.DiskNameField]
+	assert.False(t, ok)
+}
+
+func TestDeleteStripedVolume(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := NewFakeDriver(cntl)
+
+	diskClient := mock_diskclient.NewMockInterface(cntl)
+	d.getClientFactory().(*mock_azclient.MockClientFactory).EXPECT().GetDiskClientForSub(gomock.Any()).Return(diskClient, nil).AnyTimes()
+	diskClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).Return(&armcompute.Disk{}, nil).AnyTimes()
+	diskClient.EXPECT().Delete(gomock.Any(), "rg", "pvc-xxx-0").Return(nil).Times(1)
+	diskClient.EXPECT().Delete(gomock.Any(), "rg", "pvc-xxx-1").Return(nil).Times(1)
+
+	resp, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: azureutils.GetStripedVolumeID(fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "pvc-xxx"), 2)})
+	assert.NoError(t, err)
+	assert.Equal(t, &csi.DeleteVolumeResponse{}, resp)
+
+	// invalid striped volume ID is treated as deleted
+	resp, err = d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: consts.StripedVolumeIDPrefix + "invalid"})
+	assert.NoError(t, err)
+	assert.Equal(t, &csi.DeleteVolumeResponse{}, resp)
+}
+
+func TestDeleteStripedSnapshot(t *testing.T) {
+	cntl := gomock.NewController(t)
+	defer cntl.Finish()
+	d, _ := NewFakeDriver(cntl)
+
+	snapshotID := azureutils.GetStripedVolumeID("/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snapshot", 2)
+	snapshotClient := mock_snapshotclient.NewMockInterface(cntl)
+	d.getClientFactory().(*mock_azclient.MockClientFactory).EXPECT().GetSnapshotClientForSub(gomock.Any()).Return(snapshotClient, nil).AnyTimes()
+	snapshotClient.EXPECT().Delete(gomock.Any(), "rg", "snapshot-0").Return(nil).Times(1)
+	snapshotClient.EXPECT().Delete(gomock.Any(), "rg", "snapshot-1").Return(fmt.Errorf("test error")).Times(1)
+
+	_, err := d.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	assert.Equal(t, status.Error(codes.Internal, "delete snapshot error: test error"), err)
+}
+
+func TestPublishStripedVolume(t *testing.T) {
+	nodeName := "vm1"
+	volumeID := azureutils.GetStripedVolumeID(fmt.Sprintf(consts.ManagedDiskPath, "subs", "rg", "pvc-xxx"), 2)
+	tests := []struct {
+		desc             string
+		waitResult       *retry.Error
+		expectedErr      bool
+		expectedDetached []string
+		expectedDisks    int
+	}{
+		{
+			desc:          "all member disks are attached in one VM update",
+			expectedDisks: 3,
+		},
+		{
+			desc:             "member disks attached by the failed batch are detached",
+			waitResult:       retry.NewError(false, fmt.Errorf("test error")),
+			expectedErr:      true,
+			expectedDetached: []string{"pvc-xxx-0", "pvc-xxx-1"},
+			expectedDisks:    1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			cntl := gomock.NewController(t)
+			defer cntl.Finish()
+			d, _ := newFakeDriverV1(cntl)
+			d.diskController.AttachDetachInitialDelayInMs = 0
+
+			diskClient := mock_diskclient.NewMockInterface(cntl)
+			d.getClientFactory().(*mock_azclient.MockClientFactory).EXPECT().GetDiskClientForSub(gomock.Any()).Return(diskClient, nil).AnyTimes()
+			diskClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, rg, name string) (*armcompute.Disk, error) {
+					id := fmt.Sprintf(consts.ManagedDiskPath, "subs", rg, name)
+					return &armcompute.Disk{ID: &id, Name: &name}, nil
+				}).AnyTimes()
+
+			// the VM keeps the data disks of the last update
+			var mutex sync.Mutex
+			dataDisks := []compute.DataDisk{{Lun: pointer.Int32(0), Name: pointer.String("other")}}
+			vm := setTestVirtualMachines(d.getCloud(), map[string]string{nodeName: "PowerState/Running"}, false)[0]
+			var detached []string
+			mockVMsClient := d.getCloud().VirtualMachinesClient.(*mockvmclient.MockInterface)
+			mockVMsClient.EXPECT().Get(gomock.Any(), gomock.Any(), nodeName, gomock.Any()).DoAndReturn(
+				func(_ context.Context, _, _ string, _ compute.InstanceViewTypes) (compute.VirtualMachine, *retry.Error) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					disks := append([]compute.DataDisk{}, dataDisks...)
+					vm.StorageProfile = &compute.StorageProfile{DataDisks: &disks}
+					return vm, nil
+				}).AnyTimes()
+			mockVMsClient.EXPECT().UpdateAsync(gomock.Any(), gomock.Any(), nodeName, gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, resourceGroup, vmName string, parameters compute.VirtualMachineUpdate, source string) (*azure.Future, *retry.Error) {
+					mutex.Lock()
+					dataDisks = *parameters.StorageProfile.DataDisks
+					mutex.Unlock()
+					return fakeUpdateAsync(200)(ctx, resourceGroup, vmName, parameters, source)
+				}).Times(1)
+			mockVMsClient.EXPECT().WaitForUpdateResult(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, test.waitResult).Times(1)
+			mockVMsClient.EXPECT().Update(gomock.Any(), gomock.Any(), nodeName, gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, _, _ string, parameters compute.VirtualMachineUpdate, _ string) (*compute.VirtualMachine, *retry.Error) {
+					mutex.Lock()
+					defer mutex.Unlock()
+					var disks []compute.DataDisk
+					for _, disk := range *parameters.StorageProfile.DataDisks {
+						if pointer.BoolDeref(disk.ToBeDetached, false) {
+							detached = append(detached, *disk.Name)
+						} else {
+							disks = append(disks, disk)
+						}
+					}
+					dataDisks = disks
+					return nil, nil
+				}).AnyTimes()
+
+			resp, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         volumeID,
+				NodeId:           nodeName,
+				VolumeCapability: createVolumeCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+			assert.Equal(t, test.expectedErr, err != nil, "return error: %v", err)
+			assert.ElementsMatch(t, test.expectedDetached, detached)
+			assert.Len(t, dataDisks, test.expectedDisks)
+			if err == nil {
+				assert.ElementsMatch(t, []string{"1", "2"}, azureutils.GetStripeLUNs(resp.GetPublishContext()))
+			}
+		})
+	}
+}
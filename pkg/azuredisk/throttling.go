@@ -0,0 +1,338 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+)
+
+const (
+	// throttlingCheckInterval is the interval to sample the block IO statistics of the disks of staged volumes
+	throttlingCheckInterval = 30 * time.Second
+	// a disk or the VM is at a limit if its usage is within this ratio of the limit
+	throttlingLimitRatio = 0.95
+	// a disk is reported as throttled if it's at a limit in consecutive checks
+	throttlingReportSamples = 3
+
+	throttlingBottleneckDisk = "disk"
+	throttlingBottleneckVM   = "vm"
+
+	throttlingLimitProvisioned = "provisioned"
+	throttlingLimitBurst       = "burst"
+
+	// disk bandwidth in MBps is 1000*1000 bytes per second
+	bytesPerMB = 1000 * 1000
+)
+
+var (
+	registerThrottlingMetricsOnce sync.Once
+
+	volumeSaturationLabels = append(append([]string{}, volumeIOLabels...), "limit")
+	volumeThrottledLabels  = append(append([]string{}, volumeIOLabels...), "bottleneck")
+
+	volumeIOPSSaturationRatio = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_volume_iops_saturation_ratio",
+			Help:           "Ratio of the IOPS of a disk of a volume to the provisioned or burst IOPS limit of the disk",
+			StabilityLevel: metrics.ALPHA,
+		},
+		volumeSaturationLabels,
+	)
+	volumeBandwidthSaturationRatio = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_volume_bandwidth_saturation_ratio",
+			Help:           "Ratio of the bandwidth of a disk of a volume to the provisioned or burst bandwidth limit of the disk",
+			StabilityLevel: metrics.ALPHA,
+		},
+		volumeSaturationLabels,
+	)
+	nodeIOPSSaturationRatio = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_node_iops_saturation_ratio",
+			Help:           "Ratio of the IOPS of the disks of staged volumes on the node to the uncached or burst IOPS limit of the VM size",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"limit"},
+	)
+	nodeBandwidthSaturationRatio = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_node_bandwidth_saturation_ratio",
+			Help:           "Ratio of the bandwidth of the disks of staged volumes on the node to the uncached or burst bandwidth limit of the VM size",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"limit"},
+	)
+	volumeThrottled = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_volume_throttled",
+			Help:           "Whether a disk of a volume is pinned at a limit, the bottleneck is the limit of the disk or the uncached limit of the VM size",
+			StabilityLevel: metrics.ALPHA,
+		},
+		volumeThrottledLabels,
+	)
+)
+
+// diskIOSample is the last sample of the block IO statistics of a disk of a volume
+type diskIOSample struct {
+	stat      optimization.BlockDeviceStat
+	sampledAt time.Time
+	labels    []string
+	// the bottleneck found in the last consecutive checks and how many times it's found
+	bottleneck        string
+	bottleneckSamples int
+}
+
+// diskIOUsage is the IOPS and bandwidth of a disk of a volume between two samples
+type diskIOUsage struct {
+	key      string
+	volumeID string
+	info     *volumeIOInfo
+	lun      string
+	iops     float64
+	bwMbps   float64
+}
+
+// throttledDisk is a disk of a volume pinned at a limit in enough consecutive checks to be reported
+type throttledDisk struct {
+	volumeID   string
+	info       *volumeIOInfo
+	lun        string
+	bottleneck string
+	message    string
+}
+
+// throttlingDetector compares the IO usage of the disks of staged volumes with the limits of the disks and the VM size
+type throttlingDetector struct {
+	sysBlockPath string
+	// samples of the disks by <volumeID>/<lun>, only accessed by the periodic check
+	samples map[string]*diskIOSample
+}
+
+// newThrottlingDetector returns a throttlingDetector and registers the throttling metrics in the legacy registry
+func newThrottlingDetector() *throttlingDetector {
+	registerThrottlingMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(volumeIOPSSaturationRatio, volumeBandwidthSaturationRatio,
+			nodeIOPSSaturationRatio, nodeBandwidthSaturationRatio, volumeThrottled)
+	})
+	return &throttlingDetector{sysBlockPath: defaultSysBlockPath, samples: map[string]*diskIOSample{}}
+}
+
+// getDiskLimits returns the provisioned and burst limits of each disk of a volume from its volume context,
+// the requested size of a striped volume is split evenly among its disks. nil is returned if the disk SKU is unknown
+func getDiskLimits(volumeID string, volumeContext map[string]string, diskCount int) *optimization.DiskSkuInfo {
+	// an invalid perfProfile does not matter here, the other attributes are still returned
+	_, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, _, _ := optimization.GetDiskPerfAttributes(volumeContext)
+	if accountType == "" || diskSizeGibStr == "" {
+		klog.V(4).Infof("getDiskLimits: sku or size of volume %s is unknown, only the limits of the VM size are checked", volumeID)
+		return nil
+	}
+	if diskCount > 1 {
+		if diskSizeGib, err := strconv.Atoi(diskSizeGibStr); err == nil {
+			diskSizeGibStr = strconv.Itoa(diskSizeGib / diskCount)
+		}
+	}
+	limits, err := optimization.GetDiskSkuInfo(accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+	if err != nil {
+		klog.V(4).Infof("getDiskLimits: could not get limits of volume %s, only the limits of the VM size are checked: %v", volumeID, err)
+		return nil
+	}
+	return limits
+}
+
+// getDiskIOUsage returns the IOPS and bandwidth in MBps between two samples taken interval seconds apart,
+// false is returned if the counters are reset
+func getDiskIOUsage(prev, cur optimization.BlockDeviceStat, interval float64) (iops, bwMbps float64, ok bool) {
+	if interval <= 0 || cur.ReadIOs < prev.ReadIOs || cur.WriteIOs < prev.WriteIOs ||
+		cur.ReadSectors < prev.ReadSectors || cur.WriteSectors < prev.WriteSectors {
+		return 0, 0, false
+	}
+	ios := cur.ReadIOs - prev.ReadIOs + cur.WriteIOs - prev.WriteIOs
+	sectors := cur.ReadSectors - prev.ReadSectors + cur.WriteSectors - prev.WriteSectors
+	return float64(ios) / interval, float64(sectors*blockDeviceStatSectorSize) / bytesPerMB / interval, true
+}
+
+// isAtLimit checks whether usage is pinned at limit or burstLimit, a usage between them is bursting on credits
+func isAtLimit(usage float64, limit, burstLimit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	if usage >= float64(burstLimit)*throttlingLimitRatio && burstLimit > limit {
+		return true
+	}
+	return usage >= float64(limit)*throttlingLimitRatio && (burstLimit <= limit || usage <= float64(limit)*(2-throttlingLimitRatio))
+}
+
+// setSaturationRatio sets the ratio of usage to the provisioned and burst limits
+func setSaturationRatio(gauge *metrics.GaugeVec, labels []string, usage float64, limit, burstLimit int) {
+	if limit > 0 {
+		gauge.WithLabelValues(append(labels, throttlingLimitProvisioned)...).Set(usage / float64(limit))
+	}
+	if burstLimit > 0 {
+		gauge.WithLabelValues(append(labels, throttlingLimitBurst)...).Set(usage / float64(burstLimit))
+	}
+}
+
+// deleteThrottlingMetrics deletes the metrics of a disk which is not staged any more
+func deleteThrottlingMetrics(labels []string) {
+	for _, limit := range []string{throttlingLimitProvisioned, throttlingLimitBurst} {
+		volumeIOPSSaturationRatio.DeleteLabelValues(append(labels, limit)...)
+		volumeBandwidthSaturationRatio.DeleteLabelValues(append(labels, limit)...)
+	}
+	for _, bottleneck := range []string{throttlingBottleneckDisk, throttlingBottleneckVM} {
+		volumeThrottled.DeleteLabelValues(append(labels, bottleneck)...)
+	}
+}
+
+// check samples the disks of volumes and exports their saturation against the limits of the disks and the VM size,
+// the disks pinned at a limit in throttlingReportSamples consecutive checks are returned once
+func (t *throttlingDetector) check(volumes *sync.Map, nodeInfo *optimization.NodeInfo, now time.Time) []throttledDisk {
+	var usages []diskIOUsage
+	sampled := map[string]bool{}
+	volumes.Range(func(key, value interface{}) bool {
+		volumeID, info := key.(string), value.(*volumeIOInfo)
+		for lun, devicePath := range info.devices {
+			stat, err := readBlockDeviceStat(t.sysBlockPath, devicePath)
+			if err != nil {
+				klog.V(4).Infof("failed to read block IO stat of %s of volume %s: %v", devicePath, volumeID, err)
+				continue
+			}
+			sampleKey := volumeID + "/" + lun
+			sampled[sampleKey] = true
+			last, ok := t.samples[sampleKey]
+			if !ok {
+				labels := []string{info.pvName, info.pvcNamespace, info.pvcName, lun, info.sku}
+				t.samples[sampleKey] = &diskIOSample{stat: stat, sampledAt: now, labels: labels}
+				continue
+			}
+			iops, bwMbps, ok := getDiskIOUsage(last.stat, stat, now.Sub(last.sampledAt).Seconds())
+			last.stat, last.sampledAt = stat, now
+			if ok {
+				usages = append(usages, diskIOUsage{key: sampleKey, volumeID: volumeID, info: info, lun: lun, iops: iops, bwMbps: bwMbps})
+			}
+		}
+		return true
+	})
+	for key, sample := range t.samples {
+		if !sampled[key] {
+			deleteThrottlingMetrics(sample.labels)
+			delete(t.samples, key)
+		}
+	}
+
+	// the uncached limits of the VM size are shared by all data disks, only the disks of staged volumes are counted
+	var nodeIops, nodeBwMbps float64
+	for _, usage := range usages {
+		nodeIops += usage.iops
+		nodeBwMbps += usage.bwMbps
+	}
+	vmAtLimit := false
+	if nodeInfo != nil {
+		setSaturationRatio(nodeIOPSSaturationRatio, nil, nodeIops, nodeInfo.MaxIops, nodeInfo.MaxBurstIops)
+		setSaturationRatio(nodeBandwidthSaturationRatio, nil, nodeBwMbps, nodeInfo.MaxBwMbps, nodeInfo.MaxBurstBwMbps)
+		vmAtLimit = isAtLimit(nodeIops, nodeInfo.MaxIops, nodeInfo.MaxBurstIops) || isAtLimit(nodeBwMbps, nodeInfo.MaxBwMbps, nodeInfo.MaxBurstBwMbps)
+	}
+
+	var throttled []throttledDisk
+	for _, usage := range usages {
+		sample := t.samples[usage.key]
+		limits := usage.info.diskLimits
+		diskAtLimit := false
+		if limits != nil {
+			setSaturationRatio(volumeIOPSSaturationRatio, sample.labels, usage.iops, limits.MaxIops, limits.MaxBurstIops)
+			setSaturationRatio(volumeBandwidthSaturationRatio, sample.labels, usage.bwMbps, limits.MaxBwMbps, limits.MaxBurstBwMbps)
+			diskAtLimit = isAtLimit(usage.iops, limits.MaxIops, limits.MaxBurstIops) || isAtLimit(usage.bwMbps, limits.MaxBwMbps, limits.MaxBurstBwMbps)
+		}
+
+		// a disk at its own limit is throttled by the disk even if the VM is also at its limit
+		bottleneck := ""
+		switch {
+		case diskAtLimit:
+			bottleneck = throttlingBottleneckDisk
+		case vmAtLimit && usage.iops > 0:
+			bottleneck = throttlingBottleneckVM
+		}
+		for _, b := range []string{throttlingBottleneckDisk, throttlingBottleneckVM} {
+			value := 0.0
+			if b == bottleneck {
+				value = 1
+			}
+			volumeThrottled.WithLabelValues(append(sample.labels, b)...).Set(value)
+		}
+
+		if bottleneck != sample.bottleneck {
+			sample.bottleneck, sample.bottleneckSamples = bottleneck, 0
+		}
+		if bottleneck == "" {
+			continue
+		}
+		sample.bottleneckSamples++
+		if sample.bottleneckSamples != throttlingReportSamples {
+			continue
+		}
+
+		volumeID := usage.volumeID
+		disk := throttledDisk{volumeID: volumeID, info: usage.info, lun: usage.lun, bottleneck: bottleneck}
+		if bottleneck == throttlingBottleneckDisk {
+			disk.message = fmt.Sprintf("disk on lun %s of volume %s is throttled at the limits of %s %s: %.0f IOPS of %d (burst %d), %.1f MBps of %d (burst %d)",
+				usage.lun, volumeID, usage.info.sku, limits.DiskSize, usage.iops, limits.MaxIops, limits.MaxBurstIops, usage.bwMbps, limits.MaxBwMbps, limits.MaxBurstBwMbps)
+		} else {
+			disk.message = fmt.Sprintf("disk on lun %s of volume %s is throttled by the uncached limits of VM size %s rather than the disk: %.0f IOPS of %d (burst %d), %.1f MBps of %d (burst %d) on the node",
+				usage.lun, volumeID, nodeInfo.SkuName, nodeIops, nodeInfo.MaxIops, nodeInfo.MaxBurstIops, nodeBwMbps, nodeInfo.MaxBwMbps, nodeInfo.MaxBurstBwMbps)
+		}
+		throttled = append(throttled, disk)
+	}
+	return throttled
+}
+
+// detectThrottling checks whether the disks of staged volumes are pinned at the limits of the disks or the VM size,
+// a throttled disk is logged and recorded as events of the node and the PVC
+func (d *DriverCore) detectThrottling(_ context.Context) {
+	for _, disk := range d.throttling.check(&d.volumeIOs, d.getNodeInfo(), time.Now()) {
+		d.recordThrottling(disk)
+	}
+}
+
+// recordThrottling records a throttled disk as events of the node and the PVC of the volume
+func (d *DriverCore) recordThrottling(disk throttledDisk) {
+	klog.Warning(disk.message)
+	if d.eventRecorder == nil {
+		return
+	}
+	reason := "DiskThrottled"
+	if disk.bottleneck == throttlingBottleneckVM {
+		reason = "VMDiskThrottled"
+	}
+	nodeRef := &corev1.ObjectReference{Kind: "Node", Name: d.NodeID, UID: types.UID(d.NodeID)}
+	d.eventRecorder.Event(nodeRef, corev1.EventTypeWarning, reason, disk.message)
+	if disk.info.pvcName != "" && disk.info.pvcNamespace != "" {
+		pvcRef := &corev1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: disk.info.pvcNamespace, Name: disk.info.pvcName}
+		d.eventRecorder.Event(pvcRef, corev1.EventTypeWarning, reason, disk.message)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+)
+
+func TestIsAtLimit(t *testing.T) {
+	tests := []struct {
+		desc       string
+		usage      float64
+		limit      int
+		burstLimit int
+		expected   bool
+	}{
+		{desc: "below limit", usage: 400, limit: 500, burstLimit: 500, expected: false},
+		{desc: "at limit", usage: 490, limit: 500, burstLimit: 500, expected: true},
+		{desc: "at limit without burst", usage: 500, limit: 500, burstLimit: 0, expected: true},
+		{desc: "at provisioned limit after burst credits run out", usage: 500, limit: 500, burstLimit: 3500, expected: true},
+		{desc: "bursting", usage: 2000, limit: 500, burstLimit: 3500, expected: false},
+		{desc: "at burst limit", usage: 3400, limit: 500, burstLimit: 3500, expected: true},
+		{desc: "unknown limit", usage: 3400, limit: 0, burstLimit: 0, expected: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isAtLimit(test.usage, test.limit, test.burstLimit), test.desc)
+	}
+}
+
+func TestGetDiskIOUsage(t *testing.T) {
+	prev := optimization.BlockDeviceStat{ReadIOs: 100, ReadSectors: 1000, WriteIOs: 100, WriteSectors: 1000}
+	cur := optimization.BlockDeviceStat{ReadIOs: 1100, ReadSectors: 101000, WriteIOs: 1100, WriteSectors: 101000}
+	iops, bwMbps, ok := getDiskIOUsage(prev, cur, 10)
+	assert.True(t, ok)
+	assert.Equal(t, 200.0, iops)
+	assert.InDelta(t, 10.24, bwMbps, 0.001)
+
+	// counters are reset
+	_, _, ok = getDiskIOUsage(cur, prev, 10)
+	assert.False(t, ok)
+	_, _, ok = getDiskIOUsage(prev, cur, 0)
+	assert.False(t, ok)
+}
+
+func TestGetDiskLimits(t *testing.T) {
+	limits := getDiskLimits("vol-1", map[string]string{"skuName": "Premium_LRS", consts.RequestedSizeGib: "100"}, 1)
+	assert.Equal(t, "P10", limits.DiskSize)
+
+	// the size of a striped volume is split among its disks
+	limits = getDiskLimits("vol-1", map[string]string{"skuName": "Premium_LRS", consts.RequestedSizeGib: "512"}, 4)
+	assert.Equal(t, "P10", limits.DiskSize)
+
+	limits = getDiskLimits("vol-1", map[string]string{"skuName": "PremiumV2_LRS", consts.RequestedSizeGib: "100", "DiskIOPSReadWrite": "8000", "DiskMBpsReadWrite": "300"}, 1)
+	assert.Equal(t, 8000, limits.MaxIops)
+	assert.Equal(t, 300, limits.MaxBwMbps)
+
+	assert.Nil(t, getDiskLimits("vol-1", map[string]string{consts.RequestedSizeGib: "100"}, 1))
+	assert.Nil(t, getDiskLimits("vol-1", map[string]string{"skuName": "Unknown_LRS", consts.RequestedSizeGib: "100"}, 1))
+}
+
+func TestThrottlingCheck(t *testing.T) {
+	root := t.TempDir()
+	sysBlockPath := filepath.Join(root, "sys/block")
+	// the IOs are split evenly between reads and writes
+	writeStat := func(device string, ios, sectors uint64) {
+		assert.NoError(t, os.MkdirAll(filepath.Join(sysBlockPath, device), 0755))
+		stat := fmt.Sprintf("%d 0 %d 0 %d 0 %d 0 0 0 0\n", ios/2, sectors/2, ios/2, sectors/2)
+		assert.NoError(t, os.WriteFile(filepath.Join(sysBlockPath, device, "stat"), []byte(stat), 0644))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "dev"), 0755))
+	for _, device := range []string{"sdc", "sdd"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, "dev", device), nil, 0644))
+		writeStat(device, 0, 0)
+	}
+
+	p10 := optimization.DiskSkuMap["premium_lrs"]["p10"]
+	volumes := &sync.Map{}
+	volumes.Store("vol-1", &volumeIOInfo{pvName: "pv-1", pvcNamespace: "default", pvcName: "pvc-1", sku: "Premium_LRS",
+		devices: map[string]string{"0": filepath.Join(root, "dev/sdc")}, diskLimits: &p10})
+	volumes.Store("vol-2", &volumeIOInfo{pvName: "pv-2", pvcNamespace: "default", pvcName: "pvc-2", sku: "Premium_LRS",
+		devices: map[string]string{"1": filepath.Join(root, "dev/sdd")}, diskLimits: &p10})
+	nodeInfo := &optimization.NodeInfo{SkuName: "Standard_D2s_v3", MaxIops: 3200, MaxBurstIops: 3200, MaxBwMbps: 48, MaxBurstBwMbps: 48}
+
+	detector := newThrottlingDetector()
+	detector.sysBlockPath = sysBlockPath
+	now := time.Now()
+	assert.Empty(t, detector.check(volumes, nodeInfo, now))
+
+	// vol-1 is pinned at the provisioned IOPS of P10, while vol-2 is idle
+	var throttled []throttledDisk
+	for i := 1; i <= throttlingReportSamples+1; i++ {
+		writeStat("sdc", uint64(i)*500*30, 0)
+		throttled = append(throttled, detector.check(volumes, nodeInfo, now.Add(time.Duration(i)*30*time.Second))...)
+	}
+	assert.Len(t, throttled, 1, "a throttled disk should be reported once")
+	assert.Equal(t, "vol-1", throttled[0].volumeID)
+	assert.Equal(t, throttlingBottleneckDisk, throttled[0].bottleneck)
+	assert.True(t, strings.Contains(throttled[0].message, "500 IOPS of 500 (burst 3500)"), throttled[0].message)
+	assert.Equal(t, 1.0, getGaugeValue(t, volumeThrottled, "pv-1", "default", "pvc-1", "0", "Premium_LRS", throttlingBottleneckDisk))
+	assert.Equal(t, 0.0, getGaugeValue(t, volumeThrottled, "pv-2", "default", "pvc-2", "1", "Premium_LRS", throttlingBottleneckDisk))
+	assert.Equal(t, 1.0, getGaugeValue(t, volumeIOPSSaturationRatio, "pv-1", "default", "pvc-1", "0", "Premium_LRS", throttlingLimitProvisioned))
+
+	// both volumes are bursting below the limits of the disks, but the VM is pinned at its uncached IOPS
+	throttled = nil
+	base := uint64(throttlingReportSamples+1) * 500 * 30
+	for i := 1; i <= throttlingReportSamples; i++ {
+		writeStat("sdc", base+uint64(i)*1600*30, 0)
+		writeStat("sdd", uint64(i)*1600*30, 0)
+		throttled = append(throttled, detector.check(volumes, nodeInfo, now.Add(time.Duration(throttlingReportSamples+1+i)*30*time.Second))...)
+	}
+	assert.Len(t, throttled, 2)
+	for _, disk := range throttled {
+		assert.Equal(t, throttlingBottleneckVM, disk.bottleneck)
+		assert.True(t, strings.Contains(disk.message, "VM size Standard_D2s_v3"), disk.message)
+	}
+	assert.Equal(t, 1.0, getGaugeValue(t, nodeIOPSSaturationRatio, throttlingLimitProvisioned))
+
+	// the samples and metrics of an unstaged volume are removed
+	volumes.Delete("vol-2")
+	detector.check(volumes, nodeInfo, now.Add(time.Hour))
+	_, ok := detector.samples["vol-2/1"]
+	assert.False(t, ok)
+}
+
+func TestRecordThrottling(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	d := &DriverCore{}
+	d.NodeID = "node-1"
+	d.eventRecorder = recorder
+	d.recordThrottling(throttledDisk{volumeID: "vol-1", lun: "0", bottleneck: throttlingBottleneckVM, message: "throttled",
+		info: &volumeIOInfo{pvcNamespace: "default", pvcName: "pvc-1"}})
+	d.recordThrottling(throttledDisk{volumeID: "vol-2", lun: "1", bottleneck: throttlingBottleneckDisk, message: "throttled",
+		info: &volumeIOInfo{}})
+	close(recorder.Events)
+
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.Equal(t, []string{"Warning VMDiskThrottled throttled", "Warning VMDiskThrottled throttled", "Warning DiskThrottled throttled"}, events)
+}
+
+func getGaugeValue(t *testing.T, gauge *metrics.GaugeVec, labels ...string) float64 {
+	value, err := testutil.GetGaugeMetricValue(gauge.WithLabelValues(labels...))
+	assert.NoError(t, err)
+	return value
+}
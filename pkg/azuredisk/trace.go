@@ -19,13 +19,34 @@ package azuredisk
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+const tracerName = "sigs.k8s.io/azuredisk-csi-driver"
+
+// attributes of the driver spans
+const (
+	diskURIAttributeKey   = attribute.Key("azuredisk.disk_uri")
+	nodeAttributeKey      = attribute.Key("azuredisk.node")
+	lunAttributeKey       = attribute.Key("azuredisk.lun")
+	batchSizeAttributeKey = attribute.Key("azuredisk.batch_size")
 )
 
 func InitOtelTracing() (*otlptrace.Exporter, error) {
@@ -54,6 +75,85 @@ func InitOtelTracing() (*otlptrace.Exporter, error) {
 
 	// Register the trace provider as global.
 	otel.SetTracerProvider(traceProvider)
+	// Propagate the W3C trace context from the sidecars and into the ARM requests.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
 	return exporter, nil
 }
+
+// startSpan starts a child span of the span in ctx, the span is not recorded if the tracing is disabled
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, oteltrace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, oteltrace.WithAttributes(attributes...))
+}
+
+// endSpan records the error of the operation in the span and ends it
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingPolicy traces the ARM requests and propagates the trace context in their headers
+type tracingPolicy struct{}
+
+func (tracingPolicy) Do(req *policy.Request) (*http.Response, error) {
+	raw := req.Raw()
+	ctx, span := otel.Tracer(tracerName).Start(raw.Context(), fmt.Sprintf("%s %s", raw.Method, armResourceType(raw.URL.Path)),
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(attribute.String("http.method", raw.Method), attribute.String("http.url", raw.URL.Path)))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(raw.Header))
+	resp, err := req.Next()
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if err == nil && resp.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(otelcodes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// armResourceType returns the resource type of the ARM request path, e.g. Microsoft.Compute/disks
+func armResourceType(path string) string {
+	const providers = "/providers/"
+	i := strings.LastIndex(strings.ToLower(path), providers)
+	if i < 0 {
+		return path
+	}
+	segments := strings.Split(path[i+len(providers):], "/")
+	if len(segments) < 2 {
+		return strings.Join(segments, "/")
+	}
+	return segments[0] + "/" + segments[1]
+}
+
+// armCredential returns the credential of the ARM clients configured in cloud config
+func armCredential(cloud *azure.Cloud) (azcore.TokenCredential, error) {
+	authProvider, err := azclient.NewAuthProvider(&cloud.ARMClientConfig, &cloud.AzureAuthConfig.AzureAuthConfig)
+	if err != nil {
+		return nil, err
+	}
+	cred := authProvider.GetAzIdentity()
+	if authProvider.IsMultiTenantModeEnabled() {
+		cred = authProvider.GetMultiTenantIdentity()
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("no credential is configured in cloud config")
+	}
+	return cred, nil
+}
+
+// newClientFactoryWithPolicies returns a client factory whose clients send the ARM requests through the policies
+func newClientFactoryWithPolicies(cloud *azure.Cloud, perCallPolicies, perRetryPolicies []policy.Policy) (azclient.ClientFactory, error) {
+	cred, err := armCredential(cloud)
+	if err != nil {
+		return nil, err
+	}
+	return azclient.NewClientFactory(&azclient.ClientFactoryConfig{SubscriptionID: cloud.SubscriptionID}, &cloud.ARMClientConfig, cred,
+		func(option *arm.ClientOptions) {
+			option.PerCallPolicies = append(option.PerCallPolicies, perCallPolicies...)
+			option.PerRetryPolicies = append(option.PerRetryPolicies, perRetryPolicies...)
+		})
+}
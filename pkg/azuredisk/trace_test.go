@@ -0,0 +1,127 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// spanRecorder keeps the ended spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []trace.ReadOnlySpan
+}
+
+func (r *spanRecorder) ExportSpans(_ context.Context, spans []trace.ReadOnlySpan) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *spanRecorder) Shutdown(context.Context) error {
+	return nil
+}
+
+// recordSpans records the spans of the global tracer provider until the test ends
+func recordSpans(t *testing.T) *spanRecorder {
+	recorder := &spanRecorder{}
+	tracerProvider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	otel.SetTracerProvider(trace.NewTracerProvider(trace.WithSyncer(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return recorder
+}
+
+func TestStartSpan(t *testing.T) {
+	recorder := recordSpans(t)
+
+	ctx, parent := startSpan(context.Background(), "ControllerPublishVolume")
+	_, span := startSpan(ctx, "SetDiskLun", diskURIAttributeKey.String("disk"), lunAttributeKey.Int(1))
+	endSpan(span, errors.New("no lun available"))
+	endSpan(parent, nil)
+
+	assert.Len(t, recorder.spans, 2)
+	child := recorder.spans[0]
+	assert.Equal(t, "SetDiskLun", child.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), child.Parent().SpanID())
+	assert.Equal(t, []attribute.KeyValue{diskURIAttributeKey.String("disk"), lunAttributeKey.Int(1)}, child.Attributes())
+	assert.Equal(t, otelcodes.Error, child.Status().Code)
+	assert.Equal(t, otelcodes.Unset, recorder.spans[1].Status().Code)
+}
+
+func TestTracingPolicy(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	pipeline := runtime.NewPipeline("test", "v1", runtime.PipelineOptions{}, &policy.ClientOptions{
+		PerCallPolicies: []policy.Policy{tracingPolicy{}},
+		Retry:           policy.RetryOptions{MaxRetries: -1},
+	})
+	ctx, parent := startSpan(context.Background(), "CreateSnapshot")
+	req, err := runtime.NewRequest(ctx, http.MethodPut, server.URL+"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snapshot")
+	assert.NoError(t, err)
+	resp, err := pipeline.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	parent.End()
+
+	assert.Len(t, recorder.spans, 2)
+	span := recorder.spans[0]
+	assert.Equal(t, "PUT Microsoft.Compute/snapshots", span.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	assert.Equal(t, otelcodes.Error, span.Status().Code)
+	assert.Contains(t, span.Attributes(), attribute.Int("http.status_code", http.StatusNotFound))
+	// the trace context of the ARM request span is propagated in the request headers
+	assert.Contains(t, traceparent, span.SpanContext().SpanID().String())
+}
+
+func TestArmResourceType(t *testing.T) {
+	tests := map[string]string{
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk":                                     "Microsoft.Compute/disks",
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots":                                      "Microsoft.Compute/snapshots",
+		"/subscriptions/sub/providers/Microsoft.Compute/locations/eastus/operations/id":                                   "Microsoft.Compute/locations",
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/0": "Microsoft.Compute/virtualMachineScaleSets",
+		"/subscriptions/sub/resourcegroups":                                                                               "/subscriptions/sub/resourcegroups",
+	}
+	for path, expected := range tests {
+		assert.Equal(t, expected, armResourceType(path), path)
+	}
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const healthyVolumeConditionMessage = "volume is healthy"
+
+// newVolumeCondition returns an abnormal volume condition describing all problems found on a volume,
+// or a normal one if there is no problem
+func newVolumeCondition(problems []string) *csi.VolumeCondition {
+	if len(problems) == 0 {
+		return &csi.VolumeCondition{Abnormal: false, Message: healthyVolumeConditionMessage}
+	}
+	return &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+}
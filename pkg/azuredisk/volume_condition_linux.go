@@ -0,0 +1,245 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+var (
+	procMountInfoPath = "/proc/self/mountinfo"
+	procUptimePath    = "/proc/uptime"
+	sysDevBlockPath   = "/sys/dev/block"
+	sysFsExt4Path     = "/sys/fs/ext4"
+	kmsgPath          = "/dev/kmsg"
+
+	// kernel log messages older than kernelLogWindow are not reported
+	kernelLogWindow = 10 * time.Minute
+	// ioErrorCounts stores the last seen I/O error count of each device, only the increase is reported
+	ioErrorCounts sync.Map
+
+	kernelErrorRE = regexp.MustCompile(`(?i)error|remounting filesystem read-only|shutting down filesystem|offlin`)
+)
+
+// getVolumeCondition checks the mount, the device and the kernel error counters and logs behind a volume path
+func getVolumeCondition(target string, hostutil hostUtil) *csi.VolumeCondition {
+	isBlock, err := hostutil.PathIsDevice(target)
+	if err != nil {
+		klog.Warningf("getVolumeCondition: failed to determine whether %s is block device: %v", target, err)
+		return nil
+	}
+	return newVolumeCondition(checkVolumeHealth(target, isBlock))
+}
+
+// checkVolumeHealth returns human-readable problems found on a volume path, return empty if the volume is healthy
+func checkVolumeHealth(target string, isBlock bool) []string {
+	var problems []string
+	var major, minor uint32
+	if isBlock {
+		var st unix.Stat_t
+		if err := unix.Stat(target, &st); err != nil {
+			return []string{fmt.Sprintf("failed to stat block volume %s: %v", target, err)}
+		}
+		major, minor = unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+	} else {
+		mountInfo, err := findMountInfo(target)
+		if err != nil {
+			klog.Warningf("checkVolumeHealth: %v", err)
+			return nil
+		}
+		if mountInfo == nil {
+			return []string{fmt.Sprintf("volume path %s is not mounted", target)}
+		}
+		if hasMountOption(mountInfo.SuperOptions, "ro") && !hasMountOption(mountInfo.MountOptions, "ro") {
+			problems = append(problems, fmt.Sprintf("file system on %s is read-only, it may have been remounted read-only by the kernel after I/O errors", mountInfo.Source))
+		}
+		major, minor = uint32(mountInfo.Major), uint32(mountInfo.Minor)
+	}
+
+	sysPath := filepath.Join(sysDevBlockPath, fmt.Sprintf("%d:%d", major, minor))
+	realPath, err := filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		return append(problems, fmt.Sprintf("device %d:%d behind volume path %s is missing", major, minor, target))
+	}
+
+	devices := getBlockDeviceStack(filepath.Base(realPath))
+	for _, device := range devices {
+		problems = append(problems, checkBlockDeviceHealth(device)...)
+	}
+	return append(problems, checkKernelLog(devices)...)
+}
+
+// findMountInfo returns the mount info of a mount point, return nil if it's not mounted
+func findMountInfo(target string) (*mount.MountInfo, error) {
+	mountInfos, err := mount.ParseMountInfo(procMountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", procMountInfoPath, err)
+	}
+	target = filepath.Clean(target)
+	for i := range mountInfos {
+		if mountInfos[i].MountPoint == target {
+			return &mountInfos[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func hasMountOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// getBlockDeviceStack returns the kernel names of a block device and of all devices below it,
+// e.g. dm-1 on top of dm-0 on top of sdc returns [dm-1 dm-0 sdc]
+func getBlockDeviceStack(device string) []string {
+	devices := []string{device}
+	entries, err := os.ReadDir(filepath.Join(sysBlockPath, device, "slaves"))
+	if err != nil {
+		return devices
+	}
+	for _, entry := range entries {
+		devices = append(devices, getBlockDeviceStack(entry.Name())...)
+	}
+	return devices
+}
+
+// checkBlockDeviceHealth checks the SCSI device state, the I/O error counter and the ext4 error counter of a block device
+func checkBlockDeviceHealth(device string) []string {
+	var problems []string
+	if state, err := os.ReadFile(filepath.Join(sysBlockPath, device, "device", "state")); err == nil {
+		if s := strings.TrimSpace(string(state)); s != "running" {
+			problems = append(problems, fmt.Sprintf("device %s is %s", device, s))
+		}
+	}
+
+	if content, err := os.ReadFile(filepath.Join(sysBlockPath, device, "device", "ioerr_cnt")); err == nil {
+		// ioerr_cnt is a hex number, e.g. 0x1a
+		if count, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(content)), "0x"), 16, 64); err == nil {
+			if last, ok := ioErrorCounts.Swap(device, count); ok && count > last.(uint64) {
+				problems = append(problems, fmt.Sprintf("%d I/O errors on device %s since last check", count-last.(uint64), device))
+			}
+		}
+	}
+
+	if content, err := os.ReadFile(filepath.Join(sysFsExt4Path, device, "errors_count")); err == nil {
+		if count, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64); err == nil && count > 0 {
+			problems = append(problems, fmt.Sprintf("ext4 file system on device %s has recorded %d errors, fsck is required", device, count))
+		}
+	}
+	return problems
+}
+
+// checkKernelLog scans the kernel log for recent error messages on devices
+func checkKernelLog(devices []string) []string {
+	messages, err := readKernelLog(kernelLogWindow)
+	if err != nil {
+		klog.V(4).Infof("checkKernelLog: failed to read kernel log: %v", err)
+		return nil
+	}
+
+	var problems []string
+	for _, device := range devices {
+		deviceRE := regexp.MustCompile(`\b` + regexp.QuoteMeta(device) + `\b`)
+		count, latest := 0, ""
+		for _, message := range messages {
+			if deviceRE.MatchString(message) && kernelErrorRE.MatchString(message) {
+				count++
+				latest = message
+			}
+		}
+		if count > 0 {
+			problems = append(problems, fmt.Sprintf("kernel reported %d errors on device %s in the last %v, latest: %s", count, device, kernelLogWindow, latest))
+		}
+	}
+	return problems
+}
+
+// readKernelLog returns the kernel log messages within window from /dev/kmsg
+func readKernelLog(window time.Duration) ([]string, error) {
+	uptime, err := os.ReadFile(procUptimePath)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(uptime))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("unexpected content of %s: %q", procUptimePath, string(uptime))
+	}
+	uptimeSeconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	sinceUsec := int64(uptimeSeconds*1e6) - window.Microseconds()
+
+	f, err := os.OpenFile(kmsgPath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var messages []string
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.EPIPE) {
+				// the record was overwritten in the ring buffer, continue with the next one
+				continue
+			}
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, io.EOF) {
+				return messages, nil
+			}
+			return messages, err
+		}
+		// each read of /dev/kmsg returns one record: <priority>,<sequence>,<timestamp in usec>,<flags>;<message>
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			header, message, found := strings.Cut(string(line), ";")
+			if !found || strings.HasPrefix(header, " ") {
+				continue
+			}
+			headerFields := strings.Split(header, ",")
+			if len(headerFields) < 3 {
+				continue
+			}
+			if usec, err := strconv.ParseInt(headerFields[2], 10, 64); err == nil && usec >= sinceUsec {
+				messages = append(messages, message)
+			}
+		}
+	}
+}
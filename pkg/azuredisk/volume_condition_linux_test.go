@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupFakeVolumeConditionFiles creates fake procfs, sysfs and kmsg with dm-0 on top of sdc mounted at the returned target
+func setupFakeVolumeConditionFiles(t *testing.T, superOptions string, kmsg string) string {
+	root := t.TempDir()
+	origin := map[*string]string{
+		&procMountInfoPath: procMountInfoPath,
+		&procUptimePath:    procUptimePath,
+		&sysDevBlockPath:   sysDevBlockPath,
+		&sysBlockPath:      sysBlockPath,
+		&sysFsExt4Path:     sysFsExt4Path,
+		&kmsgPath:          kmsgPath,
+	}
+	t.Cleanup(func() {
+		for p, v := range origin {
+			*p = v
+		}
+		ioErrorCounts.Delete("sdc")
+	})
+	procMountInfoPath = filepath.Join(root, "mountinfo")
+	procUptimePath = filepath.Join(root, "uptime")
+	sysDevBlockPath = filepath.Join(root, "sys", "dev", "block")
+	sysBlockPath = filepath.Join(root, "sys", "block")
+	sysFsExt4Path = filepath.Join(root, "sys", "fs", "ext4")
+	kmsgPath = filepath.Join(root, "kmsg")
+
+	target := filepath.Join(root, "target")
+	assert.NoError(t, os.WriteFile(procMountInfoPath,
+		[]byte("100 1 253:0 / "+target+" rw,relatime shared:1 - ext4 /dev/mapper/luks-pvc-xxx "+superOptions+"\n"), 0644))
+	assert.NoError(t, os.WriteFile(procUptimePath, []byte("1000.00 2000.00\n"), 0644))
+	assert.NoError(t, os.WriteFile(kmsgPath, []byte(kmsg), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBlockPath, "dm-0", "slaves", "sdc"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBlockPath, "sdc", "device"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(sysBlockPath, "sdc", "device", "state"), []byte("running\n"), 0644))
+	assert.NoError(t, os.MkdirAll(sysDevBlockPath, 0755))
+	assert.NoError(t, os.Symlink(filepath.Join(sysBlockPath, "dm-0"), filepath.Join(sysDevBlockPath, "253:0")))
+	return target
+}
+
+func TestCheckVolumeHealth(t *testing.T) {
+	tests := []struct {
+		desc         string
+		superOptions string
+		kmsg         string
+		setup        func()
+		target       string
+		expected     []string
+	}{
+		{
+			desc:         "healthy volume",
+			superOptions: "rw",
+			kmsg:         "6,100,999000000,-;EXT4-fs (dm-0): mounted filesystem with ordered data mode\n",
+		},
+		{
+			desc:         "volume path is not mounted",
+			superOptions: "rw",
+			target:       "/not/mounted",
+			expected:     []string{"volume path /not/mounted is not mounted"},
+		},
+		{
+			desc:         "file system is remounted read-only",
+			superOptions: "ro,errors=remount-ro",
+			expected:     []string{"file system on /dev/mapper/luks-pvc-xxx is read-only, it may have been remounted read-only by the kernel after I/O errors"},
+		},
+		{
+			desc:         "device is offline",
+			superOptions: "rw",
+			setup: func() {
+				_ = os.WriteFile(filepath.Join(sysBlockPath, "sdc", "device", "state"), []byte("offline\n"), 0644)
+			},
+			expected: []string{"device sdc is offline"},
+		},
+		{
+			desc:         "device is missing",
+			superOptions: "rw",
+			setup: func() {
+				_ = os.Remove(filepath.Join(sysDevBlockPath, "253:0"))
+			},
+			expected: []string{"device 253:0 behind volume path TARGET is missing"},
+		},
+		{
+			desc:         "ext4 errors are recorded",
+			superOptions: "rw",
+			setup: func() {
+				_ = os.MkdirAll(filepath.Join(sysFsExt4Path, "dm-0"), 0755)
+				_ = os.WriteFile(filepath.Join(sysFsExt4Path, "dm-0", "errors_count"), []byte("3\n"), 0644)
+			},
+			expected: []string{"ext4 file system on device dm-0 has recorded 3 errors, fsck is required"},
+		},
+		{
+			desc:         "recent kernel errors",
+			superOptions: "rw",
+			kmsg: "3,100,100000000,-;blk_update_request: I/O error, dev sdc, sector 2048\n" +
+				"3,101,999000000,-;blk_update_request: I/O error, dev sdc, sector 4096\n" +
+				" DEVICE=b8:32\n" +
+				"3,102,999500000,-;blk_update_request: I/O error, dev sdc1, sector 4096\n" +
+				"6,103,999600000,-;sd 1:0:0:0: [sdc] Attached SCSI disk\n",
+			expected: []string{"kernel reported 1 errors on device sdc in the last 10m0s, latest: blk_update_request: I/O error, dev sdc, sector 4096"},
+		},
+	}
+
+	for _, test := range tests {
+		target := setupFakeVolumeConditionFiles(t, test.superOptions, test.kmsg)
+		if test.setup != nil {
+			test.setup()
+		}
+		if test.target != "" {
+			target = test.target
+		}
+		var expected []string
+		for _, e := range test.expected {
+			expected = append(expected, strings.ReplaceAll(e, "TARGET", target))
+		}
+		assert.Equal(t, expected, checkVolumeHealth(target, false), test.desc)
+	}
+}
+
+func TestCheckBlockDeviceHealthIOErrors(t *testing.T) {
+	setupFakeVolumeConditionFiles(t, "rw", "")
+	ioerrPath := filepath.Join(sysBlockPath, "sdc", "device", "ioerr_cnt")
+
+	assert.NoError(t, os.WriteFile(ioerrPath, []byte("0x1a\n"), 0644))
+	assert.Empty(t, checkBlockDeviceHealth("sdc"))
+	assert.Empty(t, checkBlockDeviceHealth("sdc"))
+	assert.NoError(t, os.WriteFile(ioerrPath, []byte("0x1c\n"), 0644))
+	assert.Equal(t, []string{"2 I/O errors on device sdc since last check"}, checkBlockDeviceHealth("sdc"))
+	assert.Empty(t, checkBlockDeviceHealth("sdc"))
+}
+
+func TestGetBlockDeviceStack(t *testing.T) {
+	setupFakeVolumeConditionFiles(t, "rw", "")
+	assert.Equal(t, []string{"dm-0", "sdc"}, getBlockDeviceStack("dm-0"))
+	assert.Equal(t, []string{"sdc"}, getBlockDeviceStack("sdc"))
+}
@@ -0,0 +1,30 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVolumeCondition(t *testing.T) {
+	assert.Equal(t, &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}, newVolumeCondition(nil))
+	assert.Equal(t, &csi.VolumeCondition{Abnormal: true, Message: "device sdc is offline; 2 I/O errors on device sdc since last check"},
+		newVolumeCondition([]string{"device sdc is offline", "2 I/O errors on device sdc since last check"}))
+}
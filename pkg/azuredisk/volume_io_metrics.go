@@ -0,0 +1,223 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
+)
+
+const (
+	defaultSysBlockPath = "/sys/block"
+	// sectors in /sys/block/<dev>/stat are always 512 bytes regardless of the sector size of the device
+	blockDeviceStatSectorSize = 512
+)
+
+var (
+	registerVolumeIOCollectorOnce sync.Once
+
+	volumeIOLabels = []string{"pv", "pvc_namespace", "pvc_name", "lun", "sku"}
+
+	volumeReadIOsDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_read_ios_total",
+		"Number of read IOs completed on a disk of a volume", volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeWriteIOsDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_write_ios_total",
+		"Number of write IOs completed on a disk of a volume", volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeReadBytesDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_read_bytes_total",
+		"Number of bytes read from a disk of a volume", volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeWriteBytesDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_write_bytes_total",
+		"Number of bytes written to a disk of a volume", volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeReadTimeDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_read_time_seconds_total",
+		"Total time in seconds spent by read IOs on a disk of a volume", volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeWriteTimeDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_write_time_seconds_total",
+		"Total time in seconds spent by write IOs on a disk of a volume", volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeIOTimeDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_io_time_seconds_total",
+		"Total time in seconds a disk of a volume has IOs in progress", volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeIOWeightedTimeDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_io_weighted_time_seconds_total",
+		"Total time in seconds spent by all IOs in progress on a disk of a volume, divide its rate by the rate of io_time for the average queue depth",
+		volumeIOLabels, nil, metrics.ALPHA, "")
+	volumeIOsInProgressDesc = metrics.NewDesc(consts.AzureDiskCSIDriverName+"_volume_ios_in_progress",
+		"Number of IOs in progress on a disk of a volume", volumeIOLabels, nil, metrics.ALPHA, "")
+)
+
+// volumeIOInfo is a staged volume exported in the block IO metrics and checked for throttling
+type volumeIOInfo struct {
+	pvName       string
+	pvcNamespace string
+	pvcName      string
+	sku          string
+	// devices is the device path of each disk of the volume by lun, a striped volume has multiple disks
+	devices map[string]string
+	// diskLimits is the provisioned and burst limits of each disk of the volume, nil if unknown
+	diskLimits *optimization.DiskSkuInfo
+}
+
+// newVolumeIOInfo returns the labels of a volume from its volume context, which has the PV and PVC names
+// if the external provisioner runs with --extra-create-metadata
+func newVolumeIOInfo(volumeContext map[string]string, luns, devicePaths []string) *volumeIOInfo {
+	info := &volumeIOInfo{devices: make(map[string]string, len(luns))}
+	for k, v := range volumeContext {
+		switch strings.ToLower(k) {
+		case consts.PvNameKey:
+			info.pvName = v
+		case consts.PvcNamespaceKey:
+			info.pvcNamespace = v
+		case consts.PvcNameKey:
+			info.pvcName = v
+		case consts.SkuNameField, consts.StorageAccountTypeField:
+			info.sku = v
+		}
+	}
+	for i := range luns {
+		if i < len(devicePaths) {
+			info.devices[luns[i]] = devicePaths[i]
+		}
+	}
+	return info
+}
+
+// isVolumeIOTracked checks whether the disks of staged volumes are tracked for the block IO metrics or throttling detection
+func (d *DriverCore) isVolumeIOTracked() bool {
+	return d.enableVolumeIOMetrics || d.enableThrottlingDetection
+}
+
+// trackVolumeIO adds the disks of a staged volume to the block IO metrics and throttling detection
+func (d *DriverCore) trackVolumeIO(volumeID string, volumeContext map[string]string, luns, devicePaths []string) {
+	if !d.isVolumeIOTracked() {
+		return
+	}
+	info := newVolumeIOInfo(volumeContext, luns, devicePaths)
+	if d.enableThrottlingDetection {
+		info.diskLimits = getDiskLimits(volumeID, volumeContext, len(devicePaths))
+	}
+	d.volumeIOs.Store(volumeID, info)
+}
+
+// untrackVolumeIO removes the disks of an unstaged volume from the block IO metrics and throttling detection
+func (d *DriverCore) untrackVolumeIO(volumeID string) {
+	d.volumeIOs.Delete(volumeID)
+}
+
+// recoverVolumeIO adds the disks of a volume staged before the driver restarts to the block IO metrics and throttling detection,
+// the disks are looked up without rescanning since they are already attached and staged
+func (d *DriverCore) recoverVolumeIO(volumeID string, volumeContext, publishContext map[string]string) {
+	if !d.isVolumeIOTracked() {
+		return
+	}
+	if _, ok := d.volumeIOs.Load(volumeID); ok {
+		return
+	}
+	lun, ok := publishContext[consts.LUN]
+	if !ok {
+		return
+	}
+	luns := []string{lun}
+	if azureutils.IsStripedVolumeID(volumeID) {
+		luns = azureutils.GetStripeLUNs(publishContext)
+	}
+	devicePaths := make([]string, 0, len(luns))
+	for _, lun := range luns {
+		lunInt, err := azureutils.GetDiskLUN(lun)
+		if err != nil {
+			klog.V(4).Infof("recoverVolumeIO: invalid lun %s of volume %s: %v", lun, volumeID, err)
+			return
+		}
+		devicePath, err := findDiskByLun(int(lunInt), d.ioHandler, d.mounter)
+		if err != nil || devicePath == "" {
+			klog.V(4).Infof("recoverVolumeIO: could not find disk on lun %s of volume %s: %v", lun, volumeID, err)
+			return
+		}
+		devicePaths = append(devicePaths, devicePath)
+	}
+	d.trackVolumeIO(volumeID, volumeContext, luns, devicePaths)
+}
+
+// volumeIOCollector exports the block IO statistics in /sys/block/<dev>/stat of the disks of staged volumes
+type volumeIOCollector struct {
+	metrics.BaseStableCollector
+
+	volumes      *sync.Map
+	sysBlockPath string
+}
+
+// registerVolumeIOCollector registers the volume block IO metrics collector in the legacy registry
+func registerVolumeIOCollector(volumes *sync.Map) {
+	registerVolumeIOCollectorOnce.Do(func() {
+		legacyregistry.CustomMustRegister(&volumeIOCollector{volumes: volumes, sysBlockPath: defaultSysBlockPath})
+	})
+}
+
+// DescribeWithStability implements the metrics.StableCollector interface
+func (c *volumeIOCollector) DescribeWithStability(ch chan<- *metrics.Desc) {
+	ch <- volumeReadIOsDesc
+	ch <- volumeWriteIOsDesc
+	ch <- volumeReadBytesDesc
+	ch <- volumeWriteBytesDesc
+	ch <- volumeReadTimeDesc
+	ch <- volumeWriteTimeDesc
+	ch <- volumeIOTimeDesc
+	ch <- volumeIOWeightedTimeDesc
+	ch <- volumeIOsInProgressDesc
+}
+
+// CollectWithStability implements the metrics.StableCollector interface
+func (c *volumeIOCollector) CollectWithStability(ch chan<- metrics.Metric) {
+	c.volumes.Range(func(key, value interface{}) bool {
+		info := value.(*volumeIOInfo)
+		for lun, devicePath := range info.devices {
+			stat, err := readBlockDeviceStat(c.sysBlockPath, devicePath)
+			if err != nil {
+				klog.V(4).Infof("failed to read block IO stat of %s of volume %s: %v", devicePath, key, err)
+				continue
+			}
+			labels := []string{info.pvName, info.pvcNamespace, info.pvcName, lun, info.sku}
+			ch <- metrics.NewLazyConstMetric(volumeReadIOsDesc, metrics.CounterValue, float64(stat.ReadIOs), labels...)
+			ch <- metrics.NewLazyConstMetric(volumeWriteIOsDesc, metrics.CounterValue, float64(stat.WriteIOs), labels...)
+			ch <- metrics.NewLazyConstMetric(volumeReadBytesDesc, metrics.CounterValue, float64(stat.ReadSectors*blockDeviceStatSectorSize), labels...)
+			ch <- metrics.NewLazyConstMetric(volumeWriteBytesDesc, metrics.CounterValue, float64(stat.WriteSectors*blockDeviceStatSectorSize), labels...)
+			ch <- metrics.NewLazyConstMetric(volumeReadTimeDesc, metrics.CounterValue, float64(stat.ReadTicksMs)/1000, labels...)
+			ch <- metrics.NewLazyConstMetric(volumeWriteTimeDesc, metrics.CounterValue, float64(stat.WriteTicksMs)/1000, labels...)
+			ch <- metrics.NewLazyConstMetric(volumeIOTimeDesc, metrics.CounterValue, float64(stat.IOTicksMs)/1000, labels...)
+			ch <- metrics.NewLazyConstMetric(volumeIOWeightedTimeDesc, metrics.CounterValue, float64(stat.TimeInQueueMs)/1000, labels...)
+			ch <- metrics.NewLazyConstMetric(volumeIOsInProgressDesc, metrics.GaugeValue, float64(stat.InFlight), labels...)
+		}
+		return true
+	})
+}
+
+// readBlockDeviceStat reads the block IO statistics of a device path, e.g. /dev/disk/azure/scsi1/lun0 or /dev/sdc,
+// the device is resolved on every read since its name may change after a rescan
+func readBlockDeviceStat(sysBlockPath, devicePath string) (optimization.BlockDeviceStat, error) {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return optimization.BlockDeviceStat{}, err
+	}
+	content, err := os.ReadFile(filepath.Join(sysBlockPath, filepath.Base(resolved), "stat"))
+	if err != nil {
+		return optimization.BlockDeviceStat{}, err
+	}
+	return optimization.ParseBlockDeviceStat(string(content))
+}
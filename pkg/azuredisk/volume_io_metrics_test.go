@@ -0,0 +1,137 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuredisk
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+func TestNewVolumeIOInfo(t *testing.T) {
+	info := newVolumeIOInfo(map[string]string{
+		consts.PvNameKey:       "pv-1",
+		consts.PvcNamespaceKey: "default",
+		consts.PvcNameKey:      "pvc-1",
+		"skuName":              "PremiumV2_LRS",
+		"cachingMode":          "None",
+	}, []string{"1", "2"}, []string{"/dev/sdc", "/dev/sdd"})
+	assert.Equal(t, &volumeIOInfo{
+		pvName:       "pv-1",
+		pvcNamespace: "default",
+		pvcName:      "pvc-1",
+		sku:          "PremiumV2_LRS",
+		devices:      map[string]string{"1": "/dev/sdc", "2": "/dev/sdd"},
+	}, info)
+
+	// the labels are empty without --extra-create-metadata
+	info = newVolumeIOInfo(nil, []string{"0"}, []string{"/dev/sdc"})
+	assert.Equal(t, &volumeIOInfo{devices: map[string]string{"0": "/dev/sdc"}}, info)
+}
+
+func TestTrackVolumeIO(t *testing.T) {
+	d := &DriverCore{}
+	d.trackVolumeIO("vol-1", nil, []string{"0"}, []string{"/dev/sdc"})
+	_, ok := d.volumeIOs.Load("vol-1")
+	assert.False(t, ok, "volume should not be tracked if the metrics are disabled")
+
+	d.enableVolumeIOMetrics = true
+	d.trackVolumeIO("vol-1", nil, []string{"0"}, []string{"/dev/sdc"})
+	_, ok = d.volumeIOs.Load("vol-1")
+	assert.True(t, ok)
+
+	// a tracked volume is not looked up again
+	d.recoverVolumeIO("vol-1", nil, map[string]string{consts.LUN: "1"})
+	value, _ := d.volumeIOs.Load("vol-1")
+	assert.Equal(t, map[string]string{"0": "/dev/sdc"}, value.(*volumeIOInfo).devices)
+
+	// a volume without lun is not tracked
+	d.recoverVolumeIO("vol-2", nil, nil)
+	_, ok = d.volumeIOs.Load("vol-2")
+	assert.False(t, ok)
+
+	d.untrackVolumeIO("vol-1")
+	_, ok = d.volumeIOs.Load("vol-1")
+	assert.False(t, ok)
+}
+
+func TestVolumeIOCollector(t *testing.T) {
+	root := t.TempDir()
+	sysBlockPath := filepath.Join(root, "sys/block")
+	assert.NoError(t, os.MkdirAll(filepath.Join(sysBlockPath, "sdc"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(sysBlockPath, "sdc/stat"),
+		[]byte("    100    5   1600   2000    50    2    800   3000    4   4500   5000    0    0    0    0\n"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "dev"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "dev/sdc"), nil, 0644))
+
+	volumes := &sync.Map{}
+	volumes.Store("vol-1", &volumeIOInfo{
+		pvName:       "pv-1",
+		pvcNamespace: "default",
+		pvcName:      "pvc-1",
+		sku:          "Premium_LRS",
+		devices:      map[string]string{"0": filepath.Join(root, "dev/sdc")},
+	})
+	// a disk which could not be found is skipped
+	volumes.Store("vol-2", &volumeIOInfo{devices: map[string]string{"1": filepath.Join(root, "dev/sdd")}})
+
+	collector := &volumeIOCollector{volumes: volumes, sysBlockPath: sysBlockPath}
+	expected := `
+# HELP azuredisk_csi_driver_volume_ios_in_progress [ALPHA] Number of IOs in progress on a disk of a volume
+# TYPE azuredisk_csi_driver_volume_ios_in_progress gauge
+azuredisk_csi_driver_volume_ios_in_progress{lun="0",pv="pv-1",pvc_name="pvc-1",pvc_namespace="default",sku="Premium_LRS"} 4
+# HELP azuredisk_csi_driver_volume_read_bytes_total [ALPHA] Number of bytes read from a disk of a volume
+# TYPE azuredisk_csi_driver_volume_read_bytes_total counter
+azuredisk_csi_driver_volume_read_bytes_total{lun="0",pv="pv-1",pvc_name="pvc-1",pvc_namespace="default",sku="Premium_LRS"} 819200
+# HELP azuredisk_csi_driver_volume_read_time_seconds_total [ALPHA] Total time in seconds spent by read IOs on a disk of a volume
+# TYPE azuredisk_csi_driver_volume_read_time_seconds_total counter
+azuredisk_csi_driver_volume_read_time_seconds_total{lun="0",pv="pv-1",pvc_name="pvc-1",pvc_namespace="default",sku="Premium_LRS"} 2
+# HELP azuredisk_csi_driver_volume_write_ios_total [ALPHA] Number of write IOs completed on a disk of a volume
+# TYPE azuredisk_csi_driver_volume_write_ios_total counter
+azuredisk_csi_driver_volume_write_ios_total{lun="0",pv="pv-1",pvc_name="pvc-1",pvc_namespace="default",sku="Premium_LRS"} 50
+# HELP azuredisk_csi_driver_volume_io_weighted_time_seconds_total [ALPHA] Total time in seconds spent by all IOs in progress on a disk of a volume, divide its rate by the rate of io_time for the average queue depth
+# TYPE azuredisk_csi_driver_volume_io_weighted_time_seconds_total counter
+azuredisk_csi_driver_volume_io_weighted_time_seconds_total{lun="0",pv="pv-1",pvc_name="pvc-1",pvc_namespace="default",sku="Premium_LRS"} 5
+`
+	assert.NoError(t, testutil.CustomCollectAndCompare(collector, strings.NewReader(expected),
+		"azuredisk_csi_driver_volume_ios_in_progress",
+		"azuredisk_csi_driver_volume_read_bytes_total",
+		"azuredisk_csi_driver_volume_read_time_seconds_total",
+		"azuredisk_csi_driver_volume_write_ios_total",
+		"azuredisk_csi_driver_volume_io_weighted_time_seconds_total"))
+}
+
+func TestVolumeIOCollectorDescribe(t *testing.T) {
+	ch := make(chan *metrics.Desc, 9)
+	(&volumeIOCollector{}).DescribeWithStability(ch)
+	close(ch)
+
+	var descs []*metrics.Desc
+	for desc := range ch {
+		descs = append(descs, desc)
+	}
+	assert.Equal(t, []*metrics.Desc{volumeReadIOsDesc, volumeWriteIOsDesc, volumeReadBytesDesc, volumeWriteBytesDesc,
+		volumeReadTimeDesc, volumeWriteTimeDesc, volumeIOTimeDesc, volumeIOWeightedTimeDesc, volumeIOsInProgressDesc}, descs)
+}
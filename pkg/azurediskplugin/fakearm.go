@@ -0,0 +1,36 @@
+//go:build fakearm
+// +build fakearm
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/fakearm"
+)
+
+// the plugin built with the fakearm tag serves the Azure requests by the in-memory backend, e.g. for csi-sanity without an Azure subscription
+func init() {
+	backend, err := fakearm.NewBackendFromEnv()
+	if err != nil {
+		klog.Fatalf("failed to create fake ARM backend: %v", err)
+	}
+	klog.Warningf("the Azure compute requests are served by the in-memory fake ARM backend")
+	azureutils.SetCloudProviderHook(backend.Install)
+}
@@ -18,12 +18,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"k8s.io/component-base/metrics/legacyregistry"
 	"k8s.io/klog/v2"
@@ -37,9 +40,14 @@ func init() {
 	})
 }
 
+// unfinishedOperationsExitCode is the exit code when the in-flight operations are not drained on shutdown
+const unfinishedOperationsExitCode = 2
+
 var (
 	version        = flag.Bool("version", false, "Print the version and exit.")
 	metricsAddress = flag.String("metrics-address", "", "export the metrics")
+	configFile     = flag.String("config", "", "path of the driver configuration file of kind DriverConfiguration, the flags set on the command line take precedence over the file")
+	validateConfig = flag.Bool("validate-config", false, "validate the driver configuration file and flags, print the effective configuration and exit")
 	driverOptions  azuredisk.DriverOptions
 )
 
@@ -54,22 +62,57 @@ func main() {
 		os.Exit(0)
 	}
 
-	exportMetrics()
-	handle()
-	os.Exit(0)
-}
+	if *configFile != "" {
+		setFlags := map[string]string{}
+		flag.Visit(func(f *flag.Flag) {
+			setFlags[f.Name] = f.Value.String()
+		})
+		if err := driverOptions.LoadConfigFile(*configFile, setFlags); err != nil {
+			klog.Fatalln(err)
+		}
+	}
+	if err := driverOptions.Validate(); err != nil {
+		if *validateConfig {
+			fmt.Fprintf(os.Stderr, "invalid driver configuration: %v\n", err) // nolint
+			os.Exit(1)
+		}
+		klog.Fatalf("invalid driver configuration: %v", err)
+	}
+	if *validateConfig {
+		fmt.Print(driverOptions.String()) // nolint
+		os.Exit(0)
+	}
+	klog.V(2).Infof("effective driver configuration:\n%s", driverOptions.String())
 
-func handle() {
 	driver := azuredisk.NewDriver(&driverOptions)
 	if driver == nil {
 		klog.Fatalln("Failed to initialize azuredisk CSI Driver")
 	}
-	if err := driver.Run(context.Background()); err != nil {
+	exportMetrics(driver)
+	handle(driver)
+	os.Exit(0)
+}
+
+func handle(driver azuredisk.CSIDriver) {
+	// the in-flight operations are drained when the driver is stopped by SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := driver.Run(ctx); err != nil {
+		if errors.Is(err, azuredisk.ErrUnfinishedOperations) {
+			klog.Errorf("azuredisk CSI Driver stopped with %v", err)
+			klog.FlushAndExit(klog.ExitFlushTimeout, unfinishedOperationsExitCode)
+		}
 		klog.Fatalf("Failed to run azuredisk CSI Driver: %v", err)
 	}
 }
 
-func exportMetrics() {
+// healthChecker is implemented by the driver which checks its dependencies
+type healthChecker interface {
+	HealthzHandler() http.Handler
+	ReadyzHandler() http.Handler
+}
+
+func exportMetrics(driver azuredisk.CSIDriver) {
 	if *metricsAddress == "" {
 		return
 	}
@@ -78,7 +121,9 @@ func exportMetrics() {
 		klog.Warningf("failed to get listener for metrics endpoint: %v", err)
 		return
 	}
-	serve(context.Background(), l, serveMetrics)
+	serve(context.Background(), l, func(l net.Listener) error {
+		return serveMetrics(l, driver)
+	})
 }
 
 func serve(_ context.Context, l net.Listener, serveFunc func(net.Listener) error) {
@@ -92,9 +137,13 @@ func serve(_ context.Context, l net.Listener, serveFunc func(net.Listener) error
 	}()
 }
 
-func serveMetrics(l net.Listener) error {
+func serveMetrics(l net.Listener, driver azuredisk.CSIDriver) error {
 	m := http.NewServeMux()
 	m.Handle("/metrics", legacyregistry.Handler()) //nolint, because azure cloud provider uses legacyregistry currently
+	if checker, ok := driver.(healthChecker); ok {
+		m.Handle("/healthz", checker.HealthzHandler())
+		m.Handle("/readyz", checker.ReadyzHandler())
+	}
 	return trapClosedConnErr(http.Serve(l, m))
 }
 
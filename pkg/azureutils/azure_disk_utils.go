@@ -18,7 +18,9 @@ package azureutils
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -29,6 +31,7 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -106,31 +109,44 @@ var (
 )
 
 type ManagedDiskParameters struct {
-	AccountType             string
-	CachingMode             v1.AzureDataDiskCachingMode
-	DeviceSettings          map[string]string
-	DiskAccessID            string
-	DiskEncryptionSetID     string
-	DiskEncryptionType      string
-	DiskIOPSReadWrite       string
-	DiskMBPSReadWrite       string
-	DiskName                string
-	EnableBursting          *bool
-	PerformancePlus         *bool
-	FsType                  string
-	Location                string
-	LogicalSectorSize       int
-	MaxShares               int
-	NetworkAccessPolicy     string
-	PublicNetworkAccess     string
-	PerfProfile             string
-	SubscriptionID          string
-	ResourceGroup           string
-	Tags                    map[string]string
-	UserAgent               string
-	VolumeContext           map[string]string
-	WriteAcceleratorEnabled string
-	Zoned                   string
+	AccountType                string
+	AutoExpandMaxGiB           int
+	AutoExpandStepGiB          int
+	AutoExpandThresholdPercent int
+	CachingMode                v1.AzureDataDiskCachingMode
+	DeviceSettings             map[string]string
+	DiskAccessID               string
+	DiskEncryptionSetID        string
+	DiskEncryptionType         string
+	DiskIOPSReadWrite          string
+	DiskMBPSReadWrite          string
+	DiskName                   string
+	EnableBursting             *bool
+	Encryption                 string
+	ExtendedLocation           string
+	PerformancePlus            *bool
+	FsckPolicy                 string
+	FsType                     string
+	LocalCache                 string
+	LocalCacheSizeGiB          int
+	Location                   string
+	LogicalSectorSize          int
+	MaxShares                  int
+	NetworkAccessPolicy        string
+	PublicNetworkAccess        string
+	PerfProfile                string
+	PersistentReservation      bool
+	PodIOPSLimit               string
+	PodMBpsLimit               string
+	StripeCount                int
+	StripeSizeKiB              int
+	SubscriptionID             string
+	ResourceGroup              string
+	Tags                       map[string]string
+	UserAgent                  string
+	VolumeContext              map[string]string
+	WriteAcceleratorEnabled    string
+	Zoned                      string
 }
 
 func GetCachingMode(attributes map[string]string) (armcompute.CachingTypes, error) {
@@ -164,9 +180,46 @@ func GetAttachDiskInitialDelay(attributes map[string]string) int {
 	return -1
 }
 
+// GetCloudConfigFilePath returns the path of the cloud config file, which is read if the cloud config secret is not found
+func GetCloudConfigFilePath() string {
+	credFile, ok := os.LookupEnv(consts.DefaultAzureCredentialFileEnv)
+	if ok && strings.TrimSpace(credFile) != "" {
+		klog.V(2).Infof("%s env var set as %v", consts.DefaultAzureCredentialFileEnv, credFile)
+		return credFile
+	}
+	if util.IsWindowsOS() {
+		credFile = consts.DefaultCredFilePathWindows
+	} else {
+		credFile = consts.DefaultCredFilePathLinux
+	}
+	klog.V(2).Infof("use default %s env var: %v", consts.DefaultAzureCredentialFileEnv, credFile)
+	return credFile
+}
+
+// cloudProviderHook is called with every cloud provider created from the cloud config
+var cloudProviderHook func(az *azure.Cloud)
+
+// SetCloudProviderHook sets the function called with every cloud provider created by GetCloudProviderFromClient and
+// ReloadCloudProviderFromClient, e.g. to replace the Azure clients by an in-memory backend in tests
+func SetCloudProviderHook(hook func(az *azure.Cloud)) {
+	cloudProviderHook = hook
+}
+
 // GetCloudProviderFromClient get Azure Cloud Provider
 func GetCloudProviderFromClient(ctx context.Context, kubeClient clientset.Interface, secretName, secretNamespace, userAgent string,
 	allowEmptyCloudConfig bool, enableTrafficMgr bool, trafficMgrPort int64) (*azure.Cloud, error) {
+	return getCloudProviderFromClient(ctx, kubeClient, secretName, secretNamespace, userAgent, allowEmptyCloudConfig, enableTrafficMgr, trafficMgrPort, false)
+}
+
+// ReloadCloudProviderFromClient reads the cloud config again and returns a new Azure Cloud Provider,
+// unlike GetCloudProviderFromClient, an error is returned if there is no cloud config or the cloud provider could not be initialized
+func ReloadCloudProviderFromClient(ctx context.Context, kubeClient clientset.Interface, secretName, secretNamespace, userAgent string,
+	enableTrafficMgr bool, trafficMgrPort int64) (*azure.Cloud, error) {
+	return getCloudProviderFromClient(ctx, kubeClient, secretName, secretNamespace, userAgent, false, enableTrafficMgr, trafficMgrPort, true)
+}
+
+func getCloudProviderFromClient(ctx context.Context, kubeClient clientset.Interface, secretName, secretNamespace, userAgent string,
+	allowEmptyCloudConfig bool, enableTrafficMgr bool, trafficMgrPort int64, failOnInitError bool) (*azure.Cloud, error) {
 	var config *azure.Config
 	var fromSecret bool
 	var err error
@@ -192,17 +245,7 @@ func GetCloudProviderFromClient(ctx context.Context, kubeClient clientset.Interf
 
 	if config == nil {
 		klog.V(2).Infof("could not read cloud config from secret %s/%s", secretNamespace, secretName)
-		credFile, ok := os.LookupEnv(consts.DefaultAzureCredentialFileEnv)
-		if ok && strings.TrimSpace(credFile) != "" {
-			klog.V(2).Infof("%s env var set as %v", consts.DefaultAzureCredentialFileEnv, credFile)
-		} else {
-			if util.IsWindowsOS() {
-				credFile = consts.DefaultCredFilePathWindows
-			} else {
-				credFile = consts.DefaultCredFilePathLinux
-			}
-			klog.V(2).Infof("use default %s env var: %v", consts.DefaultAzureCredentialFileEnv, credFile)
-		}
+		credFile := GetCloudConfigFilePath()
 		config, err = configloader.Load[azure.Config](ctx, nil, &configloader.FileLoaderConfig{FilePath: credFile})
 		if err != nil {
 			klog.Warningf("load azure config from file(%s) failed with %v", credFile, err)
@@ -246,6 +289,9 @@ func GetCloudProviderFromClient(ctx context.Context, kubeClient clientset.Interf
 			config.UseFederatedWorkloadIdentityExtension = true
 		}
 		if err = az.InitializeCloudFromConfig(ctx, config, fromSecret, false); err != nil {
+			if failOnInitError {
+				return nil, fmt.Errorf("InitializeCloudFromConfig failed with error: %w", err)
+			}
 			klog.Warningf("InitializeCloudFromConfig failed with error: %v", err)
 		}
 	}
@@ -254,6 +300,9 @@ func GetCloudProviderFromClient(ctx context.Context, kubeClient clientset.Interf
 	if kubeClient != nil && az.KubeClient == nil {
 		az.KubeClient = kubeClient
 	}
+	if cloudProviderHook != nil && config != nil {
+		cloudProviderHook(az)
+	}
 	return az, nil
 }
 
@@ -330,6 +379,155 @@ func GetFStype(attributes map[string]string) string {
 	return ""
 }
 
+// GetEncryption returns the node-side encryption mode in attributes, e.g. luks2
+// return empty string if node-side encryption is not enabled
+func GetEncryption(attributes map[string]string) string {
+	for k, v := range attributes {
+		switch strings.ToLower(k) {
+		case consts.EncryptionField:
+			if strings.EqualFold(v, consts.EncryptionNone) {
+				return ""
+			}
+			return strings.ToLower(v)
+		}
+	}
+	return ""
+}
+
+// GetFsckPolicy returns the file system check policy in attributes, e.g. check, repair
+// return empty string if file system check is not enabled
+func GetFsckPolicy(attributes map[string]string) string {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.FsckPolicyField) {
+			if strings.EqualFold(v, consts.FsckPolicyNone) {
+				return ""
+			}
+			return strings.ToLower(v)
+		}
+	}
+	return ""
+}
+
+// IsPersistentReservationEnabled returns true if SCSI persistent reservation management is enabled in attributes
+func IsPersistentReservationEnabled(attributes map[string]string) bool {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.PersistentReservationField) {
+			return strings.EqualFold(v, consts.TrueValue)
+		}
+	}
+	return false
+}
+
+// GetLocalCache returns the local cache mode in attributes, e.g. dm-cache, bcache
+// return empty string if local cache is not enabled
+func GetLocalCache(attributes map[string]string) string {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.LocalCacheField) {
+			if strings.EqualFold(v, consts.LocalCacheNone) {
+				return ""
+			}
+			return strings.ToLower(v)
+		}
+	}
+	return ""
+}
+
+// GetLocalCacheSizeGiB returns the size of the local cache slice of a volume, default size is returned if not set
+func GetLocalCacheSizeGiB(attributes map[string]string) int {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.LocalCacheSizeGiBField) {
+			if sizeGiB, err := strconv.Atoi(v); err == nil && sizeGiB > 0 {
+				return sizeGiB
+			}
+		}
+	}
+	return consts.DefaultLocalCacheSizeGiB
+}
+
+// ValidateStripeSizeKiB checks the stripe size is a power of 2 between 4KiB and 4MiB(default LVM extent size)
+func ValidateStripeSizeKiB(stripeSizeKiB int) error {
+	if stripeSizeKiB < 4 || stripeSizeKiB > 4096 || stripeSizeKiB&(stripeSizeKiB-1) != 0 {
+		return fmt.Errorf("%s(%d) must be a power of 2 in range [4, 4096]", consts.StripeSizeKiBField, stripeSizeKiB)
+	}
+	return nil
+}
+
+// GetStripeSizeKiB returns the stripe size of a striped volume, default stripe size is returned if not set
+func GetStripeSizeKiB(attributes map[string]string) int {
+	for k, v := range attributes {
+		if strings.EqualFold(k, consts.StripeSizeKiBField) {
+			if stripeSizeKiB, err := strconv.Atoi(v); err == nil && ValidateStripeSizeKiB(stripeSizeKiB) == nil {
+				return stripeSizeKiB
+			}
+		}
+	}
+	return consts.DefaultStripeSizeKiB
+}
+
+// IsStripedVolumeID checks whether the ID is a composite ID of a striped volume or of its snapshot group,
+// e.g. stripe#4#/subscriptions/xxx/resourceGroups/xxx/providers/Microsoft.Compute/disks/pvc-xxx
+func IsStripedVolumeID(id string) bool {
+	return strings.HasPrefix(strings.ToLower(id), consts.StripedVolumeIDPrefix)
+}
+
+// GetStripedVolumeID encodes the member count and the base resource ID of a striped volume or of its snapshot group into a composite ID,
+// the base resource ID is the resource ID of the members with the base name, see GetStripedVolumeMembers
+func GetStripedVolumeID(baseID string, memberCount int) string {
+	return fmt.Sprintf("%s%d%s%s", consts.StripedVolumeIDPrefix, memberCount, consts.StripedVolumeIDSeparator, baseID)
+}
+
+// ParseStripedVolumeID returns the base resource ID and the member count of a composite ID
+func ParseStripedVolumeID(id string) (string, int, error) {
+	if !IsStripedVolumeID(id) {
+		return "", 0, fmt.Errorf("%s is not a striped volume ID", id)
+	}
+	count, baseID, found := strings.Cut(id[len(consts.StripedVolumeIDPrefix):], consts.StripedVolumeIDSeparator)
+	if !found {
+		return "", 0, fmt.Errorf("invalid striped volume ID(%s)", id)
+	}
+	memberCount, err := strconv.Atoi(count)
+	if err != nil || memberCount < 1 || memberCount > consts.MaxStripeCount {
+		return "", 0, fmt.Errorf("invalid member count(%s) in striped volume ID(%s)", count, id)
+	}
+	if !IsARMResourceID(baseID) {
+		return "", 0, fmt.Errorf("invalid base resource ID(%s) in striped volume ID(%s)", baseID, id)
+	}
+	return baseID, memberCount, nil
+}
+
+// GetStripedVolumeMembers derives the member resource IDs from a composite ID in order,
+// members are in the resource group of the base resource ID and named by GetStripeMemberName with the base name
+func GetStripedVolumeMembers(id string) ([]string, error) {
+	baseID, memberCount, err := ParseStripedVolumeID(id)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.LastIndex(baseID, "/")
+	members := make([]string, 0, memberCount)
+	for index := 0; index < memberCount; index++ {
+		members = append(members, baseID[:i+1]+GetStripeMemberName(baseID[i+1:], index))
+	}
+	return members, nil
+}
+
+// GetStripeMemberName returns the name of the member disk or snapshot with index in a striped volume
+func GetStripeMemberName(name string, index int) string {
+	suffix := fmt.Sprintf("-%d", index)
+	if len(name)+len(suffix) > diskNameMaxLength {
+		name = name[:diskNameMaxLength-len(suffix)]
+	}
+	return name + suffix
+}
+
+// GetStripeLUNs returns the LUNs of member disks of a striped volume in order
+func GetStripeLUNs(publishContext map[string]string) []string {
+	luns, ok := publishContext[consts.StripeLUNs]
+	if !ok || luns == "" {
+		return nil
+	}
+	return strings.Split(luns, ",")
+}
+
 func GetMaxShares(attributes map[string]string) (int, error) {
 	for k, v := range attributes {
 		switch strings.ToLower(k) {
@@ -557,6 +755,57 @@ func ValidateDiskEncryptionType(encryptionType string) error {
 	return fmt.Errorf("DiskEncryptionType(%s) is not supported", encryptionType)
 }
 
+// ValidateEncryption checks whether the node-side encryption mode is supported
+func ValidateEncryption(encryption string) error {
+	switch strings.ToLower(encryption) {
+	case "", consts.EncryptionNone, consts.EncryptionLuks2:
+		return nil
+	}
+	return fmt.Errorf("encryption(%s) is not supported, supported values are %s and %s", encryption, consts.EncryptionNone, consts.EncryptionLuks2)
+}
+
+// ValidateFsckPolicy checks whether the file system check policy is supported
+func ValidateFsckPolicy(policy string) error {
+	switch strings.ToLower(policy) {
+	case "", consts.FsckPolicyNone, consts.FsckPolicyCheck, consts.FsckPolicyRepair:
+		return nil
+	}
+	return fmt.Errorf("%s(%s) is not supported, supported values are %s, %s and %s", consts.FsckPolicyField, policy, consts.FsckPolicyNone, consts.FsckPolicyCheck, consts.FsckPolicyRepair)
+}
+
+// ValidatePodIOLimit checks whether a pod I/O limit is auto or a positive integer
+func ValidatePodIOLimit(field, limit string) error {
+	if strings.EqualFold(limit, consts.PodIOLimitAuto) {
+		return nil
+	}
+	if value, err := strconv.Atoi(limit); err != nil || value < 1 {
+		return fmt.Errorf("%s(%s) is not supported, supported values are %s and positive integer", field, limit, consts.PodIOLimitAuto)
+	}
+	return nil
+}
+
+// ValidateLocalCache checks whether the local cache mode is supported
+func ValidateLocalCache(localCache string) error {
+	switch strings.ToLower(localCache) {
+	case "", consts.LocalCacheNone, consts.LocalCacheDmCache, consts.LocalCacheBcache:
+		return nil
+	}
+	return fmt.Errorf("%s(%s) is not supported, supported values are %s, %s and %s", consts.LocalCacheField, localCache, consts.LocalCacheNone, consts.LocalCacheDmCache, consts.LocalCacheBcache)
+}
+
+// ParseAutoExpandValue parses a value of the auto expansion parameters, which is a positive integer,
+// and a percent less than 100 for autoExpandThresholdPercent
+func ParseAutoExpandValue(field, value string) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("%s(%s) must be a positive integer", field, value)
+	}
+	if strings.EqualFold(field, consts.AutoExpandThresholdPercentField) && v > 99 {
+		return 0, fmt.Errorf("%s(%s) must be in range [1, 99]", field, value)
+	}
+	return v, nil
+}
+
 func ValidateDataAccessAuthMode(dataAccessAuthMode string) error {
 	if dataAccessAuthMode == "" {
 		return nil
@@ -656,6 +905,31 @@ func ParseDiskParameters(parameters map[string]string) (ManagedDiskParameters, e
 			}
 		case consts.UserAgentField:
 			diskParams.UserAgent = v
+		case consts.ExtendedLocationField:
+			diskParams.ExtendedLocation = v
+		case consts.EncryptionField:
+			if err = ValidateEncryption(v); err != nil {
+				return diskParams, err
+			}
+			diskParams.Encryption = strings.ToLower(v)
+		case consts.FsckPolicyField:
+			if err = ValidateFsckPolicy(v); err != nil {
+				return diskParams, err
+			}
+			diskParams.FsckPolicy = strings.ToLower(v)
+		case consts.LocalCacheField:
+			if err = ValidateLocalCache(v); err != nil {
+				return diskParams, err
+			}
+			diskParams.LocalCache = strings.ToLower(v)
+		case consts.LocalCacheSizeGiBField:
+			diskParams.LocalCacheSizeGiB, err = strconv.Atoi(v)
+			if err != nil {
+				return diskParams, fmt.Errorf("parse %s failed with error: %v", v, err)
+			}
+			if diskParams.LocalCacheSizeGiB < 1 {
+				return diskParams, fmt.Errorf("%s(%d) must be a positive integer", consts.LocalCacheSizeGiBField, diskParams.LocalCacheSizeGiB)
+			}
 		case consts.EnableAsyncAttachField:
 			// no op, only for backward compatibility
 		case consts.ZonedField:
@@ -666,10 +940,52 @@ func ParseDiskParameters(parameters map[string]string) (ManagedDiskParameters, e
 				return diskParams, fmt.Errorf("invalid %s: %s in storage class", consts.PerformancePlusField, v)
 			}
 			diskParams.PerformancePlus = &value
+		case consts.PersistentReservationField:
+			if diskParams.PersistentReservation, err = strconv.ParseBool(v); err != nil {
+				return diskParams, fmt.Errorf("invalid %s: %s in storage class", consts.PersistentReservationField, v)
+			}
+		case consts.PodIOPSLimitField:
+			if err = ValidatePodIOLimit(consts.PodIOPSLimitField, v); err != nil {
+				return diskParams, err
+			}
+			diskParams.PodIOPSLimit = strings.ToLower(v)
+		case consts.PodMBpsLimitField:
+			if err = ValidatePodIOLimit(consts.PodMBpsLimitField, v); err != nil {
+				return diskParams, err
+			}
+			diskParams.PodMBpsLimit = strings.ToLower(v)
 		case consts.AttachDiskInitialDelayField:
 			if _, err = strconv.Atoi(v); err != nil {
 				return diskParams, fmt.Errorf("parse %s failed with error: %v", v, err)
 			}
+		case consts.StripeCountField:
+			diskParams.StripeCount, err = strconv.Atoi(v)
+			if err != nil {
+				return diskParams, fmt.Errorf("parse %s failed with error: %v", v, err)
+			}
+			if diskParams.StripeCount < 1 || diskParams.StripeCount > consts.MaxStripeCount {
+				return diskParams, fmt.Errorf("%s(%d) must be in range [1, %d]", consts.StripeCountField, diskParams.StripeCount, consts.MaxStripeCount)
+			}
+		case consts.AutoExpandThresholdPercentField:
+			if diskParams.AutoExpandThresholdPercent, err = ParseAutoExpandValue(consts.AutoExpandThresholdPercentField, v); err != nil {
+				return diskParams, err
+			}
+		case consts.AutoExpandStepGiBField:
+			if diskParams.AutoExpandStepGiB, err = ParseAutoExpandValue(consts.AutoExpandStepGiBField, v); err != nil {
+				return diskParams, err
+			}
+		case consts.AutoExpandMaxGiBField:
+			if diskParams.AutoExpandMaxGiB, err = ParseAutoExpandValue(consts.AutoExpandMaxGiBField, v); err != nil {
+				return diskParams, err
+			}
+		case consts.StripeSizeKiBField:
+			diskParams.StripeSizeKiB, err = strconv.Atoi(v)
+			if err != nil {
+				return diskParams, fmt.Errorf("parse %s failed with error: %v", v, err)
+			}
+			if err = ValidateStripeSizeKiB(diskParams.StripeSizeKiB); err != nil {
+				return diskParams, err
+			}
 		default:
 			// accept all device settings params
 			// device settings need to start with azureconstants.DeviceSettingsKeyPrefix
@@ -681,6 +997,19 @@ func ParseDiskParameters(parameters map[string]string) (ManagedDiskParameters, e
 		}
 	}
 
+	if diskParams.PersistentReservation {
+		if diskParams.MaxShares < 2 {
+			return diskParams, fmt.Errorf("%s is only supported on shared disk with %s larger than 1", consts.PersistentReservationField, consts.MaxSharesField)
+		}
+		if diskParams.StripeCount > 1 {
+			return diskParams, fmt.Errorf("%s is not supported on striped volume", consts.PersistentReservationField)
+		}
+	}
+
+	if diskParams.StripeCount > 1 && diskParams.StripeSizeKiB == 0 {
+		diskParams.StripeSizeKiB = consts.DefaultStripeSizeKiB
+	}
+
 	if strings.EqualFold(diskParams.AccountType, string(armcompute.DiskStorageAccountTypesPremiumV2LRS)) {
 		if diskParams.CachingMode != "" && !strings.EqualFold(string(diskParams.CachingMode), string(v1.AzureDataDiskCachingNone)) {
 			return diskParams, fmt.Errorf("cachingMode %s is not supported for %s", diskParams.CachingMode, armcompute.DiskStorageAccountTypesPremiumV2LRS)
@@ -692,11 +1021,15 @@ func ParseDiskParameters(parameters map[string]string) (ManagedDiskParameters, e
 
 // PickAvailabilityZone selects 1 zone given topology requirement.
 // if not found or topology requirement is not zone format, empty string is returned.
+// topologies in an edge zone are skipped since there are no availability zones in edge zones.
 func PickAvailabilityZone(requirement *csi.TopologyRequirement, region, topologyKey string) string {
 	if requirement == nil {
 		return ""
 	}
 	for _, topology := range requirement.GetPreferred() {
+		if topology.GetSegments()[consts.EdgeZoneTopologyKey] != "" {
+			continue
+		}
 		if zone, exists := topology.GetSegments()[consts.WellKnownTopologyKey]; exists {
 			if IsValidAvailabilityZone(zone, region) {
 				return zone
@@ -709,6 +1042,9 @@ func PickAvailabilityZone(requirement *csi.TopologyRequirement, region, topology
 		}
 	}
 	for _, topology := range requirement.GetRequisite() {
+		if topology.GetSegments()[consts.EdgeZoneTopologyKey] != "" {
+			continue
+		}
 		if zone, exists := topology.GetSegments()[consts.WellKnownTopologyKey]; exists {
 			if IsValidAvailabilityZone(zone, region) {
 				return zone
@@ -723,6 +1059,22 @@ func PickAvailabilityZone(requirement *csi.TopologyRequirement, region, topology
 	return ""
 }
 
+// PickEdgeZone selects the edge zone of the preferred topology first, then of the requisite topology,
+// empty string is returned if there is no edge zone in the topology requirement.
+func PickEdgeZone(requirement *csi.TopologyRequirement) string {
+	if requirement == nil {
+		return ""
+	}
+	for _, topologies := range [][]*csi.Topology{requirement.GetPreferred(), requirement.GetRequisite()} {
+		for _, topology := range topologies {
+			if edgeZone := topology.GetSegments()[consts.EdgeZoneTopologyKey]; edgeZone != "" {
+				return edgeZone
+			}
+		}
+	}
+	return ""
+}
+
 func checkDiskName(diskName string) bool {
 	length := len(diskName)
 
@@ -805,6 +1157,75 @@ func getRetryAfterSeconds(err error) int {
 	return 0
 }
 
+// GetRetryAfter returns how long to wait before retrying the throttled request of the error,
+// from the Retry-After header of the ARM response, or from the RetryAfter in the error message.
+// It's capped at MaxThrottlingSleepSec, 0 is returned if the error has no retry delay.
+func GetRetryAfter(err error) time.Duration {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && respErr.RawResponse != nil {
+		if retryAfter, ok := ParseRetryAfterHeader(respErr.RawResponse.Header, time.Now()); ok {
+			return retryAfter
+		}
+	}
+	return time.Duration(getRetryAfterSeconds(err)) * time.Second
+}
+
+// ParseRetryAfterHeader returns the delay of the retry-after-ms, x-ms-retry-after-ms or Retry-After header of an ARM response,
+// Retry-After is either in seconds or an HTTP date. The delay is capped at MaxThrottlingSleepSec.
+func ParseRetryAfterHeader(header http.Header, now time.Time) (time.Duration, bool) {
+	for _, key := range []string{"retry-after-ms", "x-ms-retry-after-ms"} {
+		if ms, err := strconv.ParseInt(header.Get(key), 10, 64); err == nil && ms >= 0 {
+			return capRetryAfter(time.Duration(ms) * time.Millisecond), true
+		}
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	var retryAfter time.Duration
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil && sec >= 0 {
+		retryAfter = time.Duration(sec) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		if retryAfter = date.Sub(now); retryAfter < 0 {
+			retryAfter = 0
+		}
+	} else {
+		return 0, false
+	}
+	return capRetryAfter(retryAfter), true
+}
+
+func capRetryAfter(retryAfter time.Duration) time.Duration {
+	if retryAfter > consts.MaxThrottlingSleepSec*time.Second {
+		return consts.MaxThrottlingSleepSec * time.Second
+	}
+	return retryAfter
+}
+
+// GetRateLimitRemaining returns the lowest number of remaining requests in the x-ms-ratelimit-remaining-* headers of an ARM response,
+// e.g. "x-ms-ratelimit-remaining-subscription-reads: 11999" or
+// "x-ms-ratelimit-remaining-resource: Microsoft.Compute/HighCostGet3Min;139,Microsoft.Compute/HighCostGet30Min;699"
+func GetRateLimitRemaining(header http.Header) (int, bool) {
+	remaining, found := 0, false
+	for key, values := range header {
+		if !strings.HasPrefix(strings.ToLower(key), consts.RateLimitRemainingHeaderPrefix) {
+			continue
+		}
+		for _, value := range values {
+			for _, policy := range strings.Split(value, ",") {
+				// the resource header holds <policy>;<remaining> pairs, the others only the remaining requests
+				if i := strings.LastIndex(policy, ";"); i >= 0 {
+					policy = policy[i+1:]
+				}
+				if n, err := strconv.Atoi(strings.TrimSpace(policy)); err == nil && (!found || n < remaining) {
+					remaining, found = n, true
+				}
+			}
+		}
+	}
+	return remaining, found
+}
+
 // SetKeyValueInMap set key/value pair in map
 // key in the map is case insensitive, if key already exists, overwrite existing value
 func SetKeyValueInMap(m map[string]string, key, value string) {
@@ -20,13 +20,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -36,6 +40,7 @@ import (
 	"k8s.io/utils/pointer"
 	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
 	"sigs.k8s.io/azuredisk-csi-driver/test/utils/testutil"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
 func TestCheckDiskName(t *testing.T) {
@@ -327,6 +332,51 @@ users:
 	}
 }
 
+func TestGetCloudConfigFilePath(t *testing.T) {
+	t.Setenv(consts.DefaultAzureCredentialFileEnv, "/etc/azure/cloud-config.json")
+	assert.Equal(t, "/etc/azure/cloud-config.json", GetCloudConfigFilePath())
+
+	t.Setenv(consts.DefaultAzureCredentialFileEnv, " ")
+	if runtime.GOOS == "windows" {
+		assert.Equal(t, consts.DefaultCredFilePathWindows, GetCloudConfigFilePath())
+	} else {
+		assert.Equal(t, consts.DefaultCredFilePathLinux, GetCloudConfigFilePath())
+	}
+}
+
+func TestReloadCloudProviderFromClient(t *testing.T) {
+	credFile := filepath.Join(t.TempDir(), "azure.json")
+	t.Setenv(consts.DefaultAzureCredentialFileEnv, credFile)
+
+	// unlike GetCloudProviderFromClient, an empty cloud config is not allowed
+	_, err := ReloadCloudProviderFromClient(context.Background(), nil, "", "", "useragent", false, -1)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(credFile, []byte("location: \"East US\"\nresourceGroup: rg\n"), 0600))
+	cloud, err := ReloadCloudProviderFromClient(context.Background(), nil, "", "", "useragent", false, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, "eastus", cloud.Location)
+	assert.Equal(t, "rg", cloud.ResourceGroup)
+}
+
+func TestSetCloudProviderHook(t *testing.T) {
+	credFile := filepath.Join(t.TempDir(), "azure.json")
+	t.Setenv(consts.DefaultAzureCredentialFileEnv, credFile)
+	var hooked []*azure.Cloud
+	SetCloudProviderHook(func(az *azure.Cloud) { hooked = append(hooked, az) })
+	defer SetCloudProviderHook(nil)
+
+	// the hook is not called without cloud config
+	_, err := GetCloudProviderFromClient(context.Background(), nil, "", "", "useragent", true, false, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, hooked)
+
+	assert.NoError(t, os.WriteFile(credFile, []byte("location: eastus\nresourceGroup: rg\n"), 0600))
+	cloud, err := ReloadCloudProviderFromClient(context.Background(), nil, "", "", "useragent", false, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []*azure.Cloud{cloud}, hooked)
+}
+
 func TestGetDiskLUN(t *testing.T) {
 	tests := []struct {
 		deviceInfo  string
@@ -474,6 +524,190 @@ func TestGetFStype(t *testing.T) {
 	}
 }
 
+func TestGetEncryption(t *testing.T) {
+	tests := []struct {
+		options  map[string]string
+		expected string
+	}{
+		{
+			nil,
+			"",
+		},
+		{
+			map[string]string{"encryption": "none"},
+			"",
+		},
+		{
+			map[string]string{"encryption": "luks2"},
+			"luks2",
+		},
+		{
+			map[string]string{"Encryption": "LUKS2"},
+			"luks2",
+		},
+	}
+
+	for _, test := range tests {
+		result := GetEncryption(test.options)
+		if result != test.expected {
+			t.Errorf("input: %q, GetEncryption result: %s, expected: %s", test.options, result, test.expected)
+		}
+	}
+}
+
+func TestGetFsckPolicy(t *testing.T) {
+	assert.Equal(t, "", GetFsckPolicy(nil))
+	assert.Equal(t, "", GetFsckPolicy(map[string]string{"fsckPolicy": "None"}))
+	assert.Equal(t, consts.FsckPolicyCheck, GetFsckPolicy(map[string]string{"fsckPolicy": "Check"}))
+	assert.Equal(t, consts.FsckPolicyRepair, GetFsckPolicy(map[string]string{consts.FsckPolicyField: "repair"}))
+}
+
+func TestValidateFsckPolicy(t *testing.T) {
+	for _, policy := range []string{"", "none", "check", "Repair"} {
+		assert.NoError(t, ValidateFsckPolicy(policy))
+	}
+	assert.Equal(t, fmt.Errorf("fsckpolicy(force) is not supported, supported values are none, check and repair"), ValidateFsckPolicy("force"))
+}
+
+func TestIsPersistentReservationEnabled(t *testing.T) {
+	assert.False(t, IsPersistentReservationEnabled(nil))
+	assert.False(t, IsPersistentReservationEnabled(map[string]string{"enablePersistentReservation": "false"}))
+	assert.True(t, IsPersistentReservationEnabled(map[string]string{"enablePersistentReservation": "True"}))
+	assert.True(t, IsPersistentReservationEnabled(map[string]string{consts.PersistentReservationField: "true"}))
+}
+
+func TestGetLocalCache(t *testing.T) {
+	assert.Equal(t, "", GetLocalCache(nil))
+	assert.Equal(t, "", GetLocalCache(map[string]string{"localCache": "None"}))
+	assert.Equal(t, consts.LocalCacheDmCache, GetLocalCache(map[string]string{"localCache": "DM-Cache"}))
+	assert.Equal(t, consts.LocalCacheBcache, GetLocalCache(map[string]string{consts.LocalCacheField: "bcache"}))
+}
+
+func TestGetLocalCacheSizeGiB(t *testing.T) {
+	assert.Equal(t, consts.DefaultLocalCacheSizeGiB, GetLocalCacheSizeGiB(nil))
+	assert.Equal(t, 32, GetLocalCacheSizeGiB(map[string]string{"localCacheSizeGiB": "32"}))
+	assert.Equal(t, consts.DefaultLocalCacheSizeGiB, GetLocalCacheSizeGiB(map[string]string{consts.LocalCacheSizeGiBField: "0"}))
+}
+
+func TestValidatePodIOLimit(t *testing.T) {
+	for _, limit := range []string{"auto", "Auto", "1", "5000"} {
+		assert.NoError(t, ValidatePodIOLimit(consts.PodIOPSLimitField, limit))
+	}
+	for _, limit := range []string{"", "0", "-1", "1.5", "max"} {
+		assert.Error(t, ValidatePodIOLimit(consts.PodMBpsLimitField, limit))
+	}
+}
+
+func TestParseAutoExpandValue(t *testing.T) {
+	value, err := ParseAutoExpandValue(consts.AutoExpandThresholdPercentField, "80")
+	assert.NoError(t, err)
+	assert.Equal(t, 80, value)
+	value, err = ParseAutoExpandValue(consts.AutoExpandMaxGiBField, "8192")
+	assert.NoError(t, err)
+	assert.Equal(t, 8192, value)
+	for _, v := range []string{"", "0", "-1", "1.5", "100"} {
+		_, err = ParseAutoExpandValue(consts.AutoExpandThresholdPercentField, v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestValidateLocalCache(t *testing.T) {
+	for _, mode := range []string{"", "none", "dm-cache", "BCache"} {
+		assert.NoError(t, ValidateLocalCache(mode))
+	}
+	assert.Equal(t, fmt.Errorf("localcache(flashcache) is not supported, supported values are none, dm-cache and bcache"), ValidateLocalCache("flashcache"))
+}
+
+func TestStripedVolumeID(t *testing.T) {
+	baseID := "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/disks/pvc-xxx"
+	members := []string{
+		"/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/disks/pvc-xxx-0",
+		"/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/disks/pvc-xxx-1",
+	}
+	volumeID := GetStripedVolumeID(baseID, len(members))
+	assert.Equal(t, "stripe#2#"+baseID, volumeID)
+	assert.True(t, IsStripedVolumeID(volumeID))
+	assert.False(t, IsStripedVolumeID(members[0]))
+
+	result, err := GetStripedVolumeMembers(volumeID)
+	assert.NoError(t, err)
+	assert.Equal(t, members, result)
+
+	longBaseID := "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/disks/" + strings.Repeat("a", 80)
+	result, err = GetStripedVolumeMembers(GetStripedVolumeID(longBaseID, 16))
+	assert.NoError(t, err)
+	assert.Len(t, result, 16)
+	assert.Equal(t, "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/disks/"+strings.Repeat("a", 77)+"-15", result[15])
+
+	for _, id := range []string{
+		members[0],
+		"stripe#" + baseID,
+		"stripe#0#" + baseID,
+		"stripe#17#" + baseID,
+		"stripe#x#" + baseID,
+		"stripe#2#invalid",
+	} {
+		_, err = GetStripedVolumeMembers(id)
+		assert.Error(t, err, id)
+	}
+}
+
+func TestGetStripeMemberName(t *testing.T) {
+	assert.Equal(t, "pvc-xxx-0", GetStripeMemberName("pvc-xxx", 0))
+	assert.Equal(t, "pvc-xxx-15", GetStripeMemberName("pvc-xxx", 15))
+	longName := strings.Repeat("a", 80)
+	assert.Equal(t, strings.Repeat("a", 77)+"-10", GetStripeMemberName(longName, 10))
+}
+
+func TestGetStripeLUNs(t *testing.T) {
+	assert.Nil(t, GetStripeLUNs(nil))
+	assert.Nil(t, GetStripeLUNs(map[string]string{consts.LUN: "1"}))
+	assert.Equal(t, []string{"1", "2", "3"}, GetStripeLUNs(map[string]string{consts.StripeLUNs: "1,2,3"}))
+}
+
+func TestGetStripeSizeKiB(t *testing.T) {
+	assert.Equal(t, consts.DefaultStripeSizeKiB, GetStripeSizeKiB(nil))
+	assert.Equal(t, 256, GetStripeSizeKiB(map[string]string{"stripeSizeKiB": "256"}))
+	assert.Equal(t, consts.DefaultStripeSizeKiB, GetStripeSizeKiB(map[string]string{consts.StripeSizeKiBField: "3"}))
+}
+
+func TestValidateStripeSizeKiB(t *testing.T) {
+	for _, size := range []int{4, 64, 512, 4096} {
+		assert.NoError(t, ValidateStripeSizeKiB(size))
+	}
+	for _, size := range []int{0, 2, 100, 8192} {
+		assert.Error(t, ValidateStripeSizeKiB(size))
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	tests := []struct {
+		encryption  string
+		expectedErr error
+	}{
+		{
+			encryption:  "",
+			expectedErr: nil,
+		},
+		{
+			encryption:  "None",
+			expectedErr: nil,
+		},
+		{
+			encryption:  "luks2",
+			expectedErr: nil,
+		},
+		{
+			encryption:  "luks1",
+			expectedErr: fmt.Errorf("encryption(luks1) is not supported, supported values are none and luks2"),
+		},
+	}
+	for _, test := range tests {
+		err := ValidateEncryption(test.encryption)
+		assert.Equal(t, test.expectedErr, err)
+	}
+}
+
 func TestGetMaxShares(t *testing.T) {
 	tests := []struct {
 		options       map[string]string
@@ -1451,6 +1685,191 @@ func TestParseDiskParameters(t *testing.T) {
 			},
 			expectedError: fmt.Errorf("cachingMode ReadOnly is not supported for PremiumV2_LRS"),
 		},
+		{
+			name:        "invalid encryption in parameters",
+			inputParams: map[string]string{consts.EncryptionField: "luks1"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.EncryptionField: "luks1"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("encryption(luks1) is not supported, supported values are none and luks2"),
+		},
+		{
+			name:        "disk parameters with luks2 encryption",
+			inputParams: map[string]string{consts.EncryptionField: "LUKS2"},
+			expectedOutput: ManagedDiskParameters{
+				Encryption:     consts.EncryptionLuks2,
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.EncryptionField: "LUKS2"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: nil,
+		},
+		{
+			name:        "invalid fsckpolicy",
+			inputParams: map[string]string{consts.FsckPolicyField: "force"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FsckPolicyField: "force"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("fsckpolicy(force) is not supported, supported values are none, check and repair"),
+		},
+		{
+			name:        "disk parameters with fsckpolicy",
+			inputParams: map[string]string{consts.FsckPolicyField: "Repair"},
+			expectedOutput: ManagedDiskParameters{
+				FsckPolicy:     consts.FsckPolicyRepair,
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.FsckPolicyField: "Repair"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: nil,
+		},
+		{
+			name:        "invalid enablepersistentreservation",
+			inputParams: map[string]string{consts.PersistentReservationField: "yes"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.PersistentReservationField: "yes"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("invalid enablepersistentreservation: yes in storage class"),
+		},
+		{
+			name:        "enablepersistentreservation on non-shared disk",
+			inputParams: map[string]string{consts.PersistentReservationField: "true"},
+			expectedOutput: ManagedDiskParameters{
+				PersistentReservation: true,
+				Tags:                  make(map[string]string),
+				VolumeContext:         map[string]string{consts.PersistentReservationField: "true"},
+				DeviceSettings:        make(map[string]string),
+			},
+			expectedError: fmt.Errorf("enablepersistentreservation is only supported on shared disk with maxshares larger than 1"),
+		},
+		{
+			name:        "disk parameters with enablepersistentreservation",
+			inputParams: map[string]string{consts.PersistentReservationField: "True", consts.MaxSharesField: "2"},
+			expectedOutput: ManagedDiskParameters{
+				MaxShares:             2,
+				PersistentReservation: true,
+				Tags:                  make(map[string]string),
+				VolumeContext:         map[string]string{consts.PersistentReservationField: "True", consts.MaxSharesField: "2"},
+				DeviceSettings:        make(map[string]string),
+			},
+			expectedError: nil,
+		},
+		{
+			name:        "invalid podiopslimit",
+			inputParams: map[string]string{consts.PodIOPSLimitField: "0"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.PodIOPSLimitField: "0"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("podiopslimit(0) is not supported, supported values are auto and positive integer"),
+		},
+		{
+			name:        "disk parameters with pod I/O limits",
+			inputParams: map[string]string{consts.PodIOPSLimitField: "500", consts.PodMBpsLimitField: "Auto"},
+			expectedOutput: ManagedDiskParameters{
+				PodIOPSLimit:   "500",
+				PodMBpsLimit:   consts.PodIOLimitAuto,
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.PodIOPSLimitField: "500", consts.PodMBpsLimitField: "Auto"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: nil,
+		},
+		{
+			name:        "disk parameters with auto expansion",
+			inputParams: map[string]string{"autoExpandThresholdPercent": "80", "autoExpandStepGiB": "50", "autoExpandMaxGiB": "1024"},
+			expectedOutput: ManagedDiskParameters{
+				AutoExpandThresholdPercent: 80,
+				AutoExpandStepGiB:          50,
+				AutoExpandMaxGiB:           1024,
+				Tags:                       make(map[string]string),
+				VolumeContext:              map[string]string{"autoExpandThresholdPercent": "80", "autoExpandStepGiB": "50", "autoExpandMaxGiB": "1024"},
+				DeviceSettings:             make(map[string]string),
+			},
+			expectedError: nil,
+		},
+		{
+			name:        "invalid autoexpandthresholdpercent",
+			inputParams: map[string]string{consts.AutoExpandThresholdPercentField: "100"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.AutoExpandThresholdPercentField: "100"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("autoexpandthresholdpercent(100) must be in range [1, 99]"),
+		},
+		{
+			name:        "invalid localcache",
+			inputParams: map[string]string{consts.LocalCacheField: "flashcache"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.LocalCacheField: "flashcache"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("localcache(flashcache) is not supported, supported values are none, dm-cache and bcache"),
+		},
+		{
+			name:        "invalid localcachesizegib",
+			inputParams: map[string]string{consts.LocalCacheSizeGiBField: "0"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.LocalCacheSizeGiBField: "0"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("localcachesizegib(0) must be a positive integer"),
+		},
+		{
+			name:        "disk parameters with dm-cache local cache",
+			inputParams: map[string]string{consts.LocalCacheField: "dm-cache", consts.LocalCacheSizeGiBField: "20"},
+			expectedOutput: ManagedDiskParameters{
+				LocalCache:        consts.LocalCacheDmCache,
+				LocalCacheSizeGiB: 20,
+				Tags:              make(map[string]string),
+				VolumeContext:     map[string]string{consts.LocalCacheField: "dm-cache", consts.LocalCacheSizeGiBField: "20"},
+				DeviceSettings:    make(map[string]string),
+			},
+			expectedError: nil,
+		},
+		{
+			name:        "invalid stripecount",
+			inputParams: map[string]string{consts.StripeCountField: "0"},
+			expectedOutput: ManagedDiskParameters{
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.StripeCountField: "0"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("stripecount(0) must be in range [1, 16]"),
+		},
+		{
+			name:        "invalid stripesizekib",
+			inputParams: map[string]string{consts.StripeSizeKiBField: "100"},
+			expectedOutput: ManagedDiskParameters{
+				StripeSizeKiB:  100,
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.StripeSizeKiBField: "100"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: fmt.Errorf("stripesizekib(100) must be a power of 2 in range [4, 4096]"),
+		},
+		{
+			name:        "striped disk parameters with default stripe size",
+			inputParams: map[string]string{consts.StripeCountField: "4"},
+			expectedOutput: ManagedDiskParameters{
+				StripeCount:    4,
+				StripeSizeKiB:  consts.DefaultStripeSizeKiB,
+				Tags:           make(map[string]string),
+				VolumeContext:  map[string]string{consts.StripeCountField: "4"},
+				DeviceSettings: make(map[string]string),
+			},
+			expectedError: nil,
+		},
 		{
 			name: "valid parameters input",
 			inputParams: map[string]string{
@@ -1647,6 +2066,21 @@ func TestPickAvailabilityZone(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "skip edge zone",
+			testFunc: func(t *testing.T) {
+				req := &csi.TopologyRequirement{
+					Preferred: []*csi.Topology{
+						{Segments: map[string]string{"N/A": "", consts.EdgeZoneTopologyKey: "microsoftlosangeles1"}},
+					},
+					Requisite: []*csi.Topology{
+						{Segments: map[string]string{"N/A": "", consts.EdgeZoneTopologyKey: "microsoftlosangeles1"}},
+						{Segments: map[string]string{"N/A": "test-01"}},
+					},
+				}
+				assert.Equal(t, "test-01", PickAvailabilityZone(req, "test", "N/A"))
+			},
+		},
 		{
 			name: "empty request ",
 			testFunc: func(t *testing.T) {
@@ -1665,6 +2099,20 @@ func TestPickAvailabilityZone(t *testing.T) {
 	}
 }
 
+func TestPickEdgeZone(t *testing.T) {
+	assert.Equal(t, "", PickEdgeZone(nil))
+	assert.Equal(t, "", PickEdgeZone(&csi.TopologyRequirement{
+		Preferred: []*csi.Topology{{Segments: map[string]string{consts.WellKnownTopologyKey: "eastus-1"}}},
+	}))
+	assert.Equal(t, "microsoftlosangeles1", PickEdgeZone(&csi.TopologyRequirement{
+		Preferred: []*csi.Topology{{Segments: map[string]string{consts.WellKnownTopologyKey: ""}}},
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{consts.WellKnownTopologyKey: "eastus-1"}},
+			{Segments: map[string]string{consts.EdgeZoneTopologyKey: "microsoftlosangeles1"}},
+		},
+	}))
+}
+
 func createTestFile(path string) error {
 	f, err := os.Create(path)
 	if err != nil {
@@ -1903,6 +2351,91 @@ func TestGetRetryAfterSeconds(t *testing.T) {
 	}
 }
 
+func TestGetRetryAfter(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "30")
+	respErr := &azcore.ResponseError{StatusCode: http.StatusTooManyRequests, RawResponse: &http.Response{Header: header}}
+	assert.Equal(t, 30*time.Second, GetRetryAfter(fmt.Errorf("get disk: %w", respErr)))
+	// the error message is parsed without the header
+	respErr.RawResponse.Header = http.Header{}
+	assert.Equal(t, 10*time.Second, GetRetryAfter(errors.New("Retriable: true, RetryAfter: 10s, HTTPStatusCode: 429")))
+	assert.Equal(t, time.Duration(0), GetRetryAfter(respErr))
+	assert.Equal(t, time.Duration(0), GetRetryAfter(nil))
+}
+
+func TestParseRetryAfterHeader(t *testing.T) {
+	now := time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		desc     string
+		header   map[string]string
+		expected time.Duration
+		ok       bool
+	}{
+		{
+			desc: "no header",
+		},
+		{
+			desc:     "seconds",
+			header:   map[string]string{"Retry-After": "17"},
+			expected: 17 * time.Second,
+			ok:       true,
+		},
+		{
+			desc:     "HTTP date",
+			header:   map[string]string{"Retry-After": now.Add(time.Minute).Format(http.TimeFormat)},
+			expected: time.Minute,
+			ok:       true,
+		},
+		{
+			desc:     "past HTTP date",
+			header:   map[string]string{"Retry-After": now.Add(-time.Minute).Format(http.TimeFormat)},
+			expected: 0,
+			ok:       true,
+		},
+		{
+			desc:     "milliseconds take precedence",
+			header:   map[string]string{"Retry-After": "17", "x-ms-retry-after-ms": "1500"},
+			expected: 1500 * time.Millisecond,
+			ok:       true,
+		},
+		{
+			desc:     "capped",
+			header:   map[string]string{"Retry-After": "86400"},
+			expected: consts.MaxThrottlingSleepSec * time.Second,
+			ok:       true,
+		},
+		{
+			desc:   "invalid",
+			header: map[string]string{"Retry-After": "soon"},
+		},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		for key, value := range test.header {
+			header.Set(key, value)
+		}
+		retryAfter, ok := ParseRetryAfterHeader(header, now)
+		assert.Equal(t, test.ok, ok, test.desc)
+		assert.Equal(t, test.expected, retryAfter, test.desc)
+	}
+}
+
+func TestGetRateLimitRemaining(t *testing.T) {
+	header := http.Header{}
+	_, ok := GetRateLimitRemaining(header)
+	assert.False(t, ok)
+
+	header.Set("x-ms-ratelimit-remaining-subscription-reads", "11999")
+	remaining, ok := GetRateLimitRemaining(header)
+	assert.True(t, ok)
+	assert.Equal(t, 11999, remaining)
+
+	header.Set("x-ms-ratelimit-remaining-resource", "Microsoft.Compute/HighCostGet3Min;139,Microsoft.Compute/HighCostGet30Min;699")
+	remaining, ok = GetRateLimitRemaining(header)
+	assert.True(t, ok)
+	assert.Equal(t, 139, remaining)
+}
+
 func TestIsThrottlingError(t *testing.T) {
 	tests := []struct {
 		desc     string
@@ -0,0 +1,311 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakearm is an in-memory Azure compute backend, which serves the disk, snapshot, VM and VMSS requests
+// of the driver without an Azure subscription, e.g. for csi-sanity and integration tests.
+package fakearm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"k8s.io/klog/v2"
+	provider "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+const (
+	// NodesEnv is the comma separated list of the availability set VMs, e.g. node-0:1,node-1:2 for node-0 in zone 1 and node-1 in zone 2
+	NodesEnv = "FAKE_ARM_NODES"
+	// ScaleSetsEnv is the comma separated list of the VMSS, e.g. aks-nodepool-vmss:3:1 for 3 instances in zone 1
+	ScaleSetsEnv = "FAKE_ARM_VMSS"
+	// LatencyEnv is the latency of every request, e.g. 100ms
+	LatencyEnv = "FAKE_ARM_LATENCY"
+	// FaultsEnv is the comma separated list of the injected faults, e.g. VirtualMachines.Update=preempted:2
+	FaultsEnv = "FAKE_ARM_FAULTS"
+
+	defaultSubscriptionID = "00000000-0000-0000-0000-000000000000"
+	defaultResourceGroup  = "fake-rg"
+	defaultLocation       = "eastus"
+	defaultRetryAfter     = time.Second
+)
+
+// FaultKind is the kind of an injected fault
+type FaultKind string
+
+const (
+	// FaultThrottled fails the request with 429 TooManyRequests and a Retry-After header
+	FaultThrottled FaultKind = "throttled"
+	// FaultPreempted fails the request with 409 OperationPreempted, as if another operation on the VM had preempted it
+	FaultPreempted FaultKind = "preempted"
+	// FaultInternalError fails the request with 500 InternalServerError
+	FaultInternalError FaultKind = "internal"
+)
+
+// Backend holds the disks, snapshots, VMs and VMSS instances, which are served through the Azure clients of the cloud provider.
+// The VMs and VMSS instances live in the resource group of the cloud config.
+// The operations, used by the latency and faults, are named after the clients, e.g. Disks.CreateOrUpdate, Snapshots.Get,
+// VirtualMachines.Update, VirtualMachineScaleSetVMs.Update and VirtualMachineScaleSets.List, Update covers UpdateAsync.
+type Backend struct {
+	mu             sync.Mutex
+	subscriptionID string
+	resourceGroup  string
+	location       string
+	latency        time.Duration
+	retryAfter     time.Duration
+	// faults are the remaining number of injected faults by operation
+	faults    map[string][]FaultKind
+	disks     map[string]*armcompute.Disk
+	snapshots map[string]*armcompute.Snapshot
+	// vms are the VMs and VMSS instances by lower case computer name
+	vms     map[string]*virtualMachine
+	futures map[*azure.Future]*virtualMachine
+}
+
+// NewBackend returns an empty backend, the subscription, resource group and location are set by Install
+func NewBackend() *Backend {
+	return &Backend{
+		retryAfter: defaultRetryAfter,
+		faults:     map[string][]FaultKind{},
+		disks:      map[string]*armcompute.Disk{},
+		snapshots:  map[string]*armcompute.Snapshot{},
+		vms:        map[string]*virtualMachine{},
+		futures:    map[*azure.Future]*virtualMachine{},
+	}
+}
+
+// NewBackendFromEnv returns a backend with the VMs, VMSS, latency and faults of the FAKE_ARM_* environment variables
+func NewBackendFromEnv() (*Backend, error) {
+	b := NewBackend()
+	for _, node := range splitList(os.Getenv(NodesEnv)) {
+		name, zone, _ := strings.Cut(node, ":")
+		b.AddVM(name, zone)
+	}
+	for _, scaleSet := range splitList(os.Getenv(ScaleSetsEnv)) {
+		parts := strings.Split(scaleSet, ":")
+		instances := 1
+		if len(parts) > 1 {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid number of instances in %s(%s)", ScaleSetsEnv, scaleSet)
+			}
+			instances = n
+		}
+		zone := ""
+		if len(parts) > 2 {
+			zone = parts[2]
+		}
+		b.AddScaleSet(parts[0], instances, zone)
+	}
+	if latency := os.Getenv(LatencyEnv); latency != "" {
+		d, err := time.ParseDuration(latency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s(%s): %w", LatencyEnv, latency, err)
+		}
+		b.SetLatency(d)
+	}
+	for _, fault := range splitList(os.Getenv(FaultsEnv)) {
+		operation, value, ok := strings.Cut(fault, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault in %s(%s), expected operation=kind[:count]", FaultsEnv, fault)
+		}
+		kind, countStr, _ := strings.Cut(value, ":")
+		count := 1
+		if countStr != "" {
+			n, err := strconv.Atoi(countStr)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid count of fault in %s(%s)", FaultsEnv, fault)
+			}
+			count = n
+		}
+		switch FaultKind(kind) {
+		case FaultThrottled, FaultPreempted, FaultInternalError:
+		default:
+			return nil, fmt.Errorf("invalid kind of fault in %s(%s), expected one of %s, %s and %s", FaultsEnv, fault, FaultThrottled, FaultPreempted, FaultInternalError)
+		}
+		b.InjectFault(operation, FaultKind(kind), count)
+	}
+	return b, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Install replaces the disk, snapshot, VM and VMSS clients of the cloud provider by the backend,
+// the subscription, resource group and location of the backend are taken from the first installed cloud provider
+func (b *Backend) Install(az *provider.Cloud) {
+	b.mu.Lock()
+	if b.subscriptionID == "" {
+		b.subscriptionID = az.SubscriptionID
+		if b.subscriptionID == "" {
+			b.subscriptionID = defaultSubscriptionID
+		}
+		b.resourceGroup = az.ResourceGroup
+		if b.resourceGroup == "" {
+			b.resourceGroup = defaultResourceGroup
+		}
+		b.location = az.Location
+		if b.location == "" {
+			b.location = defaultLocation
+		}
+	}
+	b.mu.Unlock()
+
+	az.ComputeClientFactory = &clientFactory{backend: b}
+	az.DisksClient = &legacyDiskClient{backend: b}
+	az.VirtualMachinesClient = &vmClient{backend: b}
+	az.VirtualMachineScaleSetsClient = &vmssClient{backend: b}
+	az.VirtualMachineScaleSetVMsClient = &vmssVMClient{backend: b}
+	klog.V(2).Infof("fake ARM backend installed, subscription: %s, resource group: %s, location: %s", b.subscriptionID, b.resourceGroup, b.location)
+}
+
+// SetLatency sets the latency of every request
+func (b *Backend) SetLatency(latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latency = latency
+}
+
+// SetRetryAfter sets the Retry-After of the throttled requests
+func (b *Backend) SetRetryAfter(retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retryAfter = retryAfter
+}
+
+// InjectFault fails the next count requests of the operation with the fault
+func (b *Backend) InjectFault(operation string, kind FaultKind, count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i < count; i++ {
+		b.faults[operation] = append(b.faults[operation], kind)
+	}
+}
+
+// serve waits for the latency and returns the next injected fault of the operation
+func (b *Backend) serve(ctx context.Context, operation string) *fault {
+	b.mu.Lock()
+	latency := b.latency
+	b.mu.Unlock()
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return &fault{statusCode: http.StatusRequestTimeout, code: "RequestTimeout", message: ctx.Err().Error()}
+		case <-time.After(latency):
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	faults := b.faults[operation]
+	if len(faults) == 0 {
+		return nil
+	}
+	b.faults[operation] = faults[1:]
+	switch faults[0] {
+	case FaultThrottled:
+		return &fault{statusCode: http.StatusTooManyRequests, code: "TooManyRequests",
+			message: fmt.Sprintf("the request of %s is throttled", operation), retryAfter: b.retryAfter}
+	case FaultPreempted:
+		return &fault{statusCode: http.StatusConflict, code: "OperationPreempted",
+			message: fmt.Sprintf("the request of %s is preempted by another operation", operation)}
+	default:
+		return &fault{statusCode: http.StatusInternalServerError, code: "InternalServerError",
+			message: fmt.Sprintf("the request of %s failed with an internal error", operation)}
+	}
+}
+
+// fault is a failed request, returned as *azcore.ResponseError by the track 2 clients and *retry.Error by the legacy clients
+type fault struct {
+	statusCode int
+	code       string
+	message    string
+	retryAfter time.Duration
+}
+
+func notFound(resourceType, id string) *fault {
+	return &fault{statusCode: http.StatusNotFound, code: "ResourceNotFound", message: fmt.Sprintf("the %s %s is not found", resourceType, id)}
+}
+
+func (f *fault) responseError(method, id string) error {
+	body, _ := json.Marshal(map[string]interface{}{"error": map[string]string{"code": f.code, "message": f.message}})
+	resp := &http.Response{
+		StatusCode: f.statusCode,
+		Status:     fmt.Sprintf("%d %s", f.statusCode, http.StatusText(f.statusCode)),
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    &http.Request{Method: method, URL: &url.URL{Scheme: "https", Host: "management.azure.com", Path: id}},
+	}
+	if f.retryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(int(f.retryAfter/time.Second)))
+	}
+	return &azcore.ResponseError{ErrorCode: f.code, StatusCode: f.statusCode, RawResponse: resp}
+}
+
+func (f *fault) retryError() *retry.Error {
+	if f == nil {
+		return nil
+	}
+	rerr := &retry.Error{
+		Retriable:      f.statusCode == http.StatusTooManyRequests || f.statusCode >= http.StatusInternalServerError,
+		HTTPStatusCode: f.statusCode,
+		RawError:       fmt.Errorf("Code=%q Message=%q", f.code, f.message),
+	}
+	if f.retryAfter > 0 {
+		rerr.RetryAfter = time.Now().Add(f.retryAfter)
+	}
+	return rerr
+}
+
+// diskID returns the ID of the disk, the disks are keyed by lower case ID
+func diskID(subscriptionID, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/disks/%s", subscriptionID, resourceGroup, name)
+}
+
+func snapshotID(subscriptionID, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/snapshots/%s", subscriptionID, resourceGroup, name)
+}
+
+// resourceGroupOf returns the resource group in the ID of a resource
+func resourceGroupOf(id string) string {
+	parts := strings.Split(id, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
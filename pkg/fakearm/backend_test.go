@@ -0,0 +1,144 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakearm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/stretchr/testify/assert"
+	provider "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func newTestBackend() *Backend {
+	az := &provider.Cloud{}
+	az.SubscriptionID = "subs"
+	az.ResourceGroup = "rg"
+	az.Location = "eastus"
+	b := NewBackend()
+	b.Install(az)
+	return b
+}
+
+func newTestClientFactory(b *Backend) *clientFactory {
+	return &clientFactory{backend: b}
+}
+
+func TestNewBackendFromEnv(t *testing.T) {
+	t.Setenv(NodesEnv, "node-0:1, node-1")
+	t.Setenv(ScaleSetsEnv, "aks-vmss:2:3")
+	t.Setenv(LatencyEnv, "10ms")
+	t.Setenv(FaultsEnv, "VirtualMachines.Update=preempted:2,Disks.Get=throttled")
+	b, err := NewBackendFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "1", b.vms["node-0"].zone)
+	assert.Equal(t, "", b.vms["node-1"].zone)
+	assert.Equal(t, "aks-vmss", b.vms["aks-vmss000001"].scaleSet)
+	assert.Equal(t, "1", b.vms["aks-vmss000001"].instanceID)
+	assert.Equal(t, "3", b.vms["aks-vmss000001"].zone)
+	assert.Len(t, b.vms, 4)
+	assert.Equal(t, 10*time.Millisecond, b.latency)
+	assert.Equal(t, []FaultKind{FaultPreempted, FaultPreempted}, b.faults["VirtualMachines.Update"])
+	assert.Equal(t, []FaultKind{FaultThrottled}, b.faults["Disks.Get"])
+
+	for env, value := range map[string]string{
+		ScaleSetsEnv: "aks-vmss:zero",
+		LatencyEnv:   "fast",
+		FaultsEnv:    "Disks.Get=unavailable",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			_, err := NewBackendFromEnv()
+			assert.ErrorContains(t, err, env)
+		})
+	}
+}
+
+func TestInstall(t *testing.T) {
+	b := newTestBackend()
+	assert.Equal(t, "subs", b.subscriptionID)
+	assert.Equal(t, "rg", b.resourceGroup)
+
+	// the first installed cloud provider sets the subscription, resource group and location
+	az := &provider.Cloud{}
+	b.Install(az)
+	assert.Equal(t, "rg", b.resourceGroup)
+	assert.IsType(t, &clientFactory{}, az.ComputeClientFactory)
+	assert.IsType(t, &vmClient{}, az.VirtualMachinesClient)
+	assert.IsType(t, &vmssVMClient{}, az.VirtualMachineScaleSetVMsClient)
+
+	b = NewBackend()
+	b.Install(&provider.Cloud{})
+	assert.Equal(t, defaultSubscriptionID, b.subscriptionID)
+	assert.Equal(t, defaultResourceGroup, b.resourceGroup)
+	assert.Equal(t, defaultLocation, b.location)
+}
+
+func TestInjectFault(t *testing.T) {
+	b := newTestBackend()
+	b.AddVM("node-0", "")
+	b.SetRetryAfter(3 * time.Second)
+	b.InjectFault("Disks.Get", FaultThrottled, 1)
+	b.InjectFault("VirtualMachines.Get", FaultPreempted, 1)
+	b.InjectFault("VirtualMachines.Get", FaultInternalError, 1)
+	ctx := context.Background()
+
+	// the track 2 clients return *azcore.ResponseError
+	_, err := newTestClientFactory(b).GetDiskClient().Get(ctx, "rg", "disk")
+	var respErr *azcore.ResponseError
+	assert.True(t, errors.As(err, &respErr))
+	assert.Equal(t, http.StatusTooManyRequests, respErr.StatusCode)
+	assert.Equal(t, "3", respErr.RawResponse.Header.Get("Retry-After"))
+	assert.Contains(t, strings.ToLower(err.Error()), "toomanyrequests")
+	// the fault is consumed
+	_, err = newTestClientFactory(b).GetDiskClient().Get(ctx, "rg", "disk")
+	assert.True(t, errors.As(err, &respErr))
+	assert.Equal(t, http.StatusNotFound, respErr.StatusCode)
+
+	// the legacy clients return *retry.Error
+	client := &vmClient{backend: b}
+	_, rerr := client.Get(ctx, "rg", "node-0", compute.InstanceViewTypesInstanceView)
+	assert.Equal(t, http.StatusConflict, rerr.HTTPStatusCode)
+	assert.Contains(t, rerr.Error().Error(), "OperationPreempted")
+	_, rerr = client.Get(ctx, "rg", "node-0", compute.InstanceViewTypesInstanceView)
+	assert.Equal(t, http.StatusInternalServerError, rerr.HTTPStatusCode)
+	assert.True(t, rerr.Retriable)
+	_, rerr = client.Get(ctx, "rg", "node-0", compute.InstanceViewTypesInstanceView)
+	assert.Nil(t, rerr)
+}
+
+func TestSetLatency(t *testing.T) {
+	b := newTestBackend()
+	b.SetLatency(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := newTestClientFactory(b).GetDiskClient().Get(ctx, "rg", "disk")
+	var respErr *azcore.ResponseError
+	assert.True(t, errors.As(err, &respErr))
+	assert.Equal(t, http.StatusRequestTimeout, respErr.StatusCode)
+}
+
+func TestResourceGroupOf(t *testing.T) {
+	assert.Equal(t, "rg", resourceGroupOf(diskID("subs", "rg", "disk")))
+	assert.Equal(t, "", resourceGroupOf("disk"))
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakearm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azclient/snapshotclient"
+	legacydiskclient "sigs.k8s.io/cloud-provider-azure/pkg/azureclients/diskclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+// clientFactory returns the disk and snapshot clients of the backend.
+// The other clients are not used by the driver and not implemented.
+type clientFactory struct {
+	azclient.ClientFactory
+	backend *Backend
+}
+
+func (f *clientFactory) GetDiskClient() diskclient.Interface {
+	return &diskClient{backend: f.backend, subscriptionID: f.subscriptionID("")}
+}
+
+func (f *clientFactory) GetDiskClientForSub(subscriptionID string) (diskclient.Interface, error) {
+	return &diskClient{backend: f.backend, subscriptionID: f.subscriptionID(subscriptionID)}, nil
+}
+
+func (f *clientFactory) GetSnapshotClient() snapshotclient.Interface {
+	return &snapshotClient{backend: f.backend, subscriptionID: f.subscriptionID("")}
+}
+
+func (f *clientFactory) GetSnapshotClientForSub(subscriptionID string) (snapshotclient.Interface, error) {
+	return &snapshotClient{backend: f.backend, subscriptionID: f.subscriptionID(subscriptionID)}, nil
+}
+
+// subscriptionID returns the subscription of the clients, the subscription of the backend if empty
+func (f *clientFactory) subscriptionID(subscriptionID string) string {
+	if subscriptionID != "" {
+		return subscriptionID
+	}
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	return f.backend.subscriptionID
+}
+
+// clone returns a deep copy of the resource, so that the callers could not change the state of the backend
+func clone[T any](resource *T) *T {
+	data, _ := json.Marshal(resource)
+	copied := new(T)
+	_ = json.Unmarshal(data, copied)
+	return copied
+}
+
+type diskClient struct {
+	backend        *Backend
+	subscriptionID string
+}
+
+func (c *diskClient) Get(ctx context.Context, resourceGroupName string, diskName string) (*armcompute.Disk, error) {
+	b, id := c.backend, diskID(c.subscriptionID, resourceGroupName, diskName)
+	if f := b.serve(ctx, "Disks.Get"); f != nil {
+		return nil, f.responseError(http.MethodGet, id)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	disk, ok := b.disks[strings.ToLower(id)]
+	if !ok {
+		return nil, notFound("disk", id).responseError(http.MethodGet, id)
+	}
+	return clone(disk), nil
+}
+
+// CreateOrUpdate creates the disk from the source disk or snapshot in CreationData if any,
+// the size of the disk is the size of the source if not set, an existing disk is updated with the size and tags
+func (c *diskClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, diskName string, parameters armcompute.Disk) (*armcompute.Disk, error) {
+	b, id := c.backend, diskID(c.subscriptionID, resourceGroupName, diskName)
+	if f := b.serve(ctx, "Disks.CreateOrUpdate"); f != nil {
+		return nil, f.responseError(http.MethodPut, id)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if disk, ok := b.disks[strings.ToLower(id)]; ok {
+		if parameters.Properties != nil && parameters.Properties.DiskSizeGB != nil {
+			if f := resize(disk, *parameters.Properties.DiskSizeGB); f != nil {
+				return nil, f.responseError(http.MethodPut, id)
+			}
+		}
+		if parameters.Tags != nil {
+			disk.Tags = parameters.Tags
+		}
+		return clone(disk), nil
+	}
+
+	disk := clone(&parameters)
+	if disk.Properties == nil {
+		disk.Properties = &armcompute.DiskProperties{}
+	}
+	if data := disk.Properties.CreationData; data != nil && data.SourceResourceID != nil {
+		sourceSize, f := b.sourceSize(*data.SourceResourceID)
+		if f != nil {
+			return nil, f.responseError(http.MethodPut, id)
+		}
+		if disk.Properties.DiskSizeGB == nil {
+			disk.Properties.DiskSizeGB = to.Ptr(sourceSize)
+		} else if *disk.Properties.DiskSizeGB < sourceSize {
+			return nil, (&fault{statusCode: http.StatusBadRequest, code: "BadRequest",
+				message: fmt.Sprintf("the size of disk %s must not be less than the size %dGB of the source %s", id, sourceSize, *data.SourceResourceID)}).responseError(http.MethodPut, id)
+		}
+	}
+	if disk.Properties.DiskSizeGB == nil || *disk.Properties.DiskSizeGB <= 0 {
+		return nil, (&fault{statusCode: http.StatusBadRequest, code: "InvalidParameter",
+			message: fmt.Sprintf("the size of disk %s must be positive", id)}).responseError(http.MethodPut, id)
+	}
+	// the defaults of ARM
+	if disk.Location == nil {
+		disk.Location = to.Ptr(b.location)
+	}
+	if disk.SKU == nil || disk.SKU.Name == nil {
+		disk.SKU = &armcompute.DiskSKU{Name: to.Ptr(armcompute.DiskStorageAccountTypesStandardLRS)}
+	}
+	if disk.Properties.NetworkAccessPolicy == nil {
+		disk.Properties.NetworkAccessPolicy = to.Ptr(armcompute.NetworkAccessPolicyAllowAll)
+	}
+	disk.ID = to.Ptr(id)
+	disk.Name = to.Ptr(diskName)
+	disk.Type = to.Ptr("Microsoft.Compute/disks")
+	disk.Properties.ProvisioningState = to.Ptr("Succeeded")
+	disk.Properties.DiskState = to.Ptr(armcompute.DiskStateUnattached)
+	disk.Properties.TimeCreated = to.Ptr(time.Now())
+	disk.Properties.UniqueID = to.Ptr(string(uuid.NewUUID()))
+	disk.Properties.DiskSizeBytes = to.Ptr(int64(*disk.Properties.DiskSizeGB) << 30)
+	b.disks[strings.ToLower(id)] = disk
+	return clone(disk), nil
+}
+
+// sourceSize returns the size of the source disk or snapshot, the caller must hold the lock
+func (b *Backend) sourceSize(sourceID string) (int32, *fault) {
+	if disk, ok := b.disks[strings.ToLower(sourceID)]; ok {
+		return *disk.Properties.DiskSizeGB, nil
+	}
+	if snapshot, ok := b.snapshots[strings.ToLower(sourceID)]; ok {
+		return *snapshot.Properties.DiskSizeGB, nil
+	}
+	return 0, notFound("source", sourceID)
+}
+
+// resize changes the size of the disk, disks could only be expanded
+func resize(disk *armcompute.Disk, sizeGB int32) *fault {
+	if sizeGB < *disk.Properties.DiskSizeGB {
+		return &fault{statusCode: http.StatusBadRequest, code: "BadRequest",
+			message: fmt.Sprintf("the size of disk %s could not be shrunk from %dGB to %dGB", *disk.ID, *disk.Properties.DiskSizeGB, sizeGB)}
+	}
+	disk.Properties.DiskSizeGB = to.Ptr(sizeGB)
+	disk.Properties.DiskSizeBytes = to.Ptr(int64(sizeGB) << 30)
+	return nil
+}
+
+// Delete deletes the disk, a disk attached to any VM could not be deleted, deleting a missing disk succeeds as ARM does
+func (c *diskClient) Delete(ctx context.Context, resourceGroupName string, diskName string) error {
+	b, id := c.backend, diskID(c.subscriptionID, resourceGroupName, diskName)
+	if f := b.serve(ctx, "Disks.Delete"); f != nil {
+		return f.responseError(http.MethodDelete, id)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	disk, ok := b.disks[strings.ToLower(id)]
+	if !ok {
+		return nil
+	}
+	if disk.ManagedBy != nil && *disk.ManagedBy != "" {
+		return (&fault{statusCode: http.StatusConflict, code: "OperationNotAllowed",
+			message: fmt.Sprintf("disk %s is attached to VM %s", id, *disk.ManagedBy)}).responseError(http.MethodDelete, id)
+	}
+	delete(b.disks, strings.ToLower(id))
+	return nil
+}
+
+func (c *diskClient) List(ctx context.Context, resourceGroupName string) ([]*armcompute.Disk, error) {
+	b := c.backend
+	if f := b.serve(ctx, "Disks.List"); f != nil {
+		return nil, f.responseError(http.MethodGet, resourceGroupName)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var disks []*armcompute.Disk
+	for _, disk := range b.disks {
+		if strings.EqualFold(resourceGroupOf(*disk.ID), resourceGroupName) {
+			disks = append(disks, clone(disk))
+		}
+	}
+	return disks, nil
+}
+
+func (c *diskClient) Patch(ctx context.Context, resourceGroupName string, diskName string, parameters armcompute.DiskUpdate) (*armcompute.Disk, error) {
+	b, id := c.backend, diskID(c.subscriptionID, resourceGroupName, diskName)
+	if f := b.serve(ctx, "Disks.Patch"); f != nil {
+		return nil, f.responseError(http.MethodPatch, id)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	disk, ok := b.disks[strings.ToLower(id)]
+	if !ok {
+		return nil, notFound("disk", id).responseError(http.MethodPatch, id)
+	}
+	if parameters.Properties != nil && parameters.Properties.DiskSizeGB != nil {
+		if f := resize(disk, *parameters.Properties.DiskSizeGB); f != nil {
+			return nil, f.responseError(http.MethodPatch, id)
+		}
+	}
+	if parameters.Tags != nil {
+		disk.Tags = parameters.Tags
+	}
+	return clone(disk), nil
+}
+
+type snapshotClient struct {
+	backend        *Backend
+	subscriptionID string
+}
+
+func (c *snapshotClient) Get(ctx context.Context, resourceGroupName string, snapshotName string) (*armcompute.Snapshot, error) {
+	b, id := c.backend, snapshotID(c.subscriptionID, resourceGroupName, snapshotName)
+	if f := b.serve(ctx, "Snapshots.Get"); f != nil {
+		return nil, f.responseError(http.MethodGet, id)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	snapshot, ok := b.snapshots[strings.ToLower(id)]
+	if !ok {
+		return nil, notFound("snapshot", id).responseError(http.MethodGet, id)
+	}
+	return clone(snapshot), nil
+}
+
+// CreateOrUpdate creates the snapshot of the source disk or snapshot in CreationData, the snapshot is completed at once
+func (c *snapshotClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, snapshotName string, parameters armcompute.Snapshot) (*armcompute.Snapshot, error) {
+	b, id := c.backend, snapshotID(c.subscriptionID, resourceGroupName, snapshotName)
+	if f := b.serve(ctx, "Snapshots.CreateOrUpdate"); f != nil {
+		return nil, f.responseError(http.MethodPut, id)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if snapshot, ok := b.snapshots[strings.ToLower(id)]; ok {
+		if parameters.Tags != nil {
+			snapshot.Tags = parameters.Tags
+		}
+		return clone(snapshot), nil
+	}
+
+	snapshot := clone(&parameters)
+	if snapshot.Properties == nil || snapshot.Properties.CreationData == nil || snapshot.Properties.CreationData.SourceResourceID == nil {
+		return nil, (&fault{statusCode: http.StatusBadRequest, code: "InvalidParameter",
+			message: fmt.Sprintf("snapshot %s must have a source resource", id)}).responseError(http.MethodPut, id)
+	}
+	sourceSize, f := b.sourceSize(*snapshot.Properties.CreationData.SourceResourceID)
+	if f != nil {
+		return nil, f.responseError(http.MethodPut, id)
+	}
+	if snapshot.Location == nil {
+		snapshot.Location = to.Ptr(b.location)
+	}
+	snapshot.ID = to.Ptr(id)
+	snapshot.Name = to.Ptr(snapshotName)
+	snapshot.Type = to.Ptr("Microsoft.Compute/snapshots")
+	snapshot.Properties.DiskSizeGB = to.Ptr(sourceSize)
+	snapshot.Properties.DiskSizeBytes = to.Ptr(int64(sourceSize) << 30)
+	snapshot.Properties.ProvisioningState = to.Ptr("Succeeded")
+	snapshot.Properties.CompletionPercent = to.Ptr[float32](100)
+	snapshot.Properties.TimeCreated = to.Ptr(time.Now())
+	snapshot.Properties.UniqueID = to.Ptr(string(uuid.NewUUID()))
+	b.snapshots[strings.ToLower(id)] = snapshot
+	return clone(snapshot), nil
+}
+
+func (c *snapshotClient) Delete(ctx context.Context, resourceGroupName string, snapshotName string) error {
+	b, id := c.backend, snapshotID(c.subscriptionID, resourceGroupName, snapshotName)
+	if f := b.serve(ctx, "Snapshots.Delete"); f != nil {
+		return f.responseError(http.MethodDelete, id)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.snapshots, strings.ToLower(id))
+	return nil
+}
+
+func (c *snapshotClient) List(ctx context.Context, resourceGroupName string) ([]*armcompute.Snapshot, error) {
+	b := c.backend
+	if f := b.serve(ctx, "Snapshots.List"); f != nil {
+		return nil, f.responseError(http.MethodGet, resourceGroupName)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var snapshots []*armcompute.Snapshot
+	for _, snapshot := range b.snapshots {
+		if strings.EqualFold(resourceGroupOf(*snapshot.ID), resourceGroupName) {
+			snapshots = append(snapshots, clone(snapshot))
+		}
+	}
+	return snapshots, nil
+}
+
+// legacyDiskClient is the legacy disk client, which is used by the cloud provider to filter out the deleted disks on attach.
+// The other methods are not used by the driver and not implemented.
+type legacyDiskClient struct {
+	legacydiskclient.Interface
+	backend *Backend
+}
+
+func (c *legacyDiskClient) Get(ctx context.Context, subsID, resourceGroupName, diskName string) (compute.Disk, *retry.Error) {
+	b, id := c.backend, diskID(subsID, resourceGroupName, diskName)
+	if f := b.serve(ctx, "Disks.Get"); f != nil {
+		return compute.Disk{}, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	disk, ok := b.disks[strings.ToLower(id)]
+	if !ok {
+		return compute.Disk{}, notFound("disk", id).retryError()
+	}
+	return compute.Disk{ID: disk.ID, Name: disk.Name, Location: disk.Location, ManagedBy: disk.ManagedBy}, nil
+}
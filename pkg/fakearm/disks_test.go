@@ -0,0 +1,160 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakearm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assertStatusCode(t *testing.T, statusCode int, err error) {
+	respErr, ok := err.(*azcore.ResponseError)
+	require.True(t, ok, "unexpected error %v", err)
+	assert.Equal(t, statusCode, respErr.StatusCode)
+}
+
+func TestDiskClient(t *testing.T) {
+	b := newTestBackend()
+	client, err := newTestClientFactory(b).GetDiskClientForSub("subs")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	disk, err := client.CreateOrUpdate(ctx, "rg", "disk", armcompute.Disk{
+		Zones:      []*string{to.Ptr("1")},
+		Properties: &armcompute.DiskProperties{DiskSizeGB: to.Ptr[int32](10)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, diskID("subs", "rg", "disk"), *disk.ID)
+	assert.Equal(t, "eastus", *disk.Location)
+	assert.Equal(t, armcompute.DiskStateUnattached, *disk.Properties.DiskState)
+	assert.Equal(t, "Succeeded", *disk.Properties.ProvisioningState)
+	assert.Equal(t, armcompute.DiskStorageAccountTypesStandardLRS, *disk.SKU.Name)
+	assert.Equal(t, armcompute.NetworkAccessPolicyAllowAll, *disk.Properties.NetworkAccessPolicy)
+
+	// the returned disks are copies of the state
+	disk.Properties.DiskSizeGB = to.Ptr[int32](1)
+	disk, err = client.Get(ctx, "rg", "DISK")
+	require.NoError(t, err)
+	assert.Equal(t, int32(10), *disk.Properties.DiskSizeGB)
+
+	disk, err = client.Patch(ctx, "rg", "disk", armcompute.DiskUpdate{
+		Tags:       map[string]*string{"k": to.Ptr("v")},
+		Properties: &armcompute.DiskUpdateProperties{DiskSizeGB: to.Ptr[int32](20)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(20), *disk.Properties.DiskSizeGB)
+	assert.Equal(t, int64(20)<<30, *disk.Properties.DiskSizeBytes)
+	assert.Equal(t, "v", *disk.Tags["k"])
+	_, err = client.Patch(ctx, "rg", "disk", armcompute.DiskUpdate{Properties: &armcompute.DiskUpdateProperties{DiskSizeGB: to.Ptr[int32](5)}})
+	assertStatusCode(t, http.StatusBadRequest, err)
+
+	// the size of a disk from a source is the size of the source
+	clone, err := client.CreateOrUpdate(ctx, "rg", "clone", armcompute.Disk{
+		Properties: &armcompute.DiskProperties{CreationData: &armcompute.CreationData{
+			CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+			SourceResourceID: disk.ID,
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(20), *clone.Properties.DiskSizeGB)
+	_, err = client.CreateOrUpdate(ctx, "rg", "missing-source", armcompute.Disk{
+		Properties: &armcompute.DiskProperties{CreationData: &armcompute.CreationData{SourceResourceID: to.Ptr(diskID("subs", "rg", "missing"))}},
+	})
+	assertStatusCode(t, http.StatusNotFound, err)
+	_, err = client.CreateOrUpdate(ctx, "rg", "no-size", armcompute.Disk{})
+	assertStatusCode(t, http.StatusBadRequest, err)
+
+	disks, err := client.List(ctx, "rg")
+	require.NoError(t, err)
+	assert.Len(t, disks, 2)
+	disks, err = client.List(ctx, "other-rg")
+	require.NoError(t, err)
+	assert.Empty(t, disks)
+
+	// an attached disk could not be deleted
+	b.disks[strings.ToLower(diskID("subs", "rg", "disk"))].ManagedBy = to.Ptr("vm")
+	assertStatusCode(t, http.StatusConflict, client.Delete(ctx, "rg", "disk"))
+	b.disks[strings.ToLower(diskID("subs", "rg", "disk"))].ManagedBy = nil
+	assert.NoError(t, client.Delete(ctx, "rg", "disk"))
+	assert.NoError(t, client.Delete(ctx, "rg", "disk"))
+	_, err = client.Get(ctx, "rg", "disk")
+	assertStatusCode(t, http.StatusNotFound, err)
+}
+
+func TestSnapshotClient(t *testing.T) {
+	b := newTestBackend()
+	factory := newTestClientFactory(b)
+	ctx := context.Background()
+	_, err := factory.GetDiskClient().CreateOrUpdate(ctx, "rg", "disk", armcompute.Disk{Properties: &armcompute.DiskProperties{DiskSizeGB: to.Ptr[int32](8)}})
+	require.NoError(t, err)
+	// the clients of the empty subscription are the clients of the subscription of the backend
+	client, err := factory.GetSnapshotClientForSub("")
+	require.NoError(t, err)
+
+	snapshot, err := client.CreateOrUpdate(ctx, "rg", "snapshot", armcompute.Snapshot{
+		Properties: &armcompute.SnapshotProperties{CreationData: &armcompute.CreationData{
+			CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+			SourceResourceID: to.Ptr(diskID("subs", "rg", "disk")),
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, snapshotID("subs", "rg", "snapshot"), *snapshot.ID)
+	assert.Equal(t, int32(8), *snapshot.Properties.DiskSizeGB)
+	assert.Equal(t, float32(100), *snapshot.Properties.CompletionPercent)
+
+	// a disk could be restored from the snapshot
+	disk, err := factory.GetDiskClient().CreateOrUpdate(ctx, "rg", "restored", armcompute.Disk{
+		Properties: &armcompute.DiskProperties{CreationData: &armcompute.CreationData{
+			CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+			SourceResourceID: snapshot.ID,
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(8), *disk.Properties.DiskSizeGB)
+
+	_, err = client.CreateOrUpdate(ctx, "rg", "no-source", armcompute.Snapshot{})
+	assertStatusCode(t, http.StatusBadRequest, err)
+	snapshots, err := client.List(ctx, "rg")
+	require.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+
+	assert.NoError(t, client.Delete(ctx, "rg", "snapshot"))
+	_, err = client.Get(ctx, "rg", "snapshot")
+	assertStatusCode(t, http.StatusNotFound, err)
+}
+
+func TestLegacyDiskClient(t *testing.T) {
+	b := newTestBackend()
+	ctx := context.Background()
+	_, err := newTestClientFactory(b).GetDiskClient().CreateOrUpdate(ctx, "rg", "disk", armcompute.Disk{Properties: &armcompute.DiskProperties{DiskSizeGB: to.Ptr[int32](8)}})
+	require.NoError(t, err)
+	client := &legacyDiskClient{backend: b}
+
+	disk, rerr := client.Get(ctx, "subs", "rg", "disk")
+	assert.Nil(t, rerr)
+	assert.Equal(t, diskID("subs", "rg", "disk"), *disk.ID)
+	_, rerr = client.Get(ctx, "subs", "rg", "missing")
+	assert.True(t, rerr.IsNotFound())
+}
@@ -0,0 +1,524 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakearm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmssclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
+)
+
+// defaultVMSize is the size of the VMs, which supports 8 data disks
+const defaultVMSize = "Standard_D4s_v3"
+
+// virtualMachine is an availability set VM or a VMSS instance, the data disks are kept in the format of the legacy clients
+type virtualMachine struct {
+	name       string
+	zone       string
+	scaleSet   string
+	instanceID string
+	dataDisks  []compute.DataDisk
+}
+
+// AddVM adds an availability set VM, whose name is the node name, zone is empty if the VM is not zonal
+func (b *Backend) AddVM(name, zone string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.vms[strings.ToLower(name)] = &virtualMachine{name: name, zone: zone}
+}
+
+// AddScaleSet adds a VMSS of the instances, the node names of the instances are the name of the VMSS
+// followed by the instance ID in 6 base 36 digits, e.g. aks-nodepool-vmss000000
+func (b *Backend) AddScaleSet(name string, instances int, zone string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i < instances; i++ {
+		computerName := fmt.Sprintf("%s%06s", name, strconv.FormatInt(int64(i), 36))
+		b.vms[strings.ToLower(computerName)] = &virtualMachine{name: computerName, zone: zone, scaleSet: name, instanceID: strconv.Itoa(i)}
+	}
+}
+
+func (b *Backend) vmID(vm *virtualMachine) string {
+	if vm.scaleSet != "" {
+		return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%s",
+			b.subscriptionID, b.resourceGroup, vm.scaleSet, vm.instanceID)
+	}
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s", b.subscriptionID, b.resourceGroup, vm.name)
+}
+
+// getVM returns the availability set VM, the caller must hold the lock
+func (b *Backend) getVM(resourceGroup, name string) *virtualMachine {
+	vm, ok := b.vms[strings.ToLower(name)]
+	if !ok || vm.scaleSet != "" || !strings.EqualFold(resourceGroup, b.resourceGroup) {
+		return nil
+	}
+	return vm
+}
+
+// getVMSSVM returns the VMSS instance, the caller must hold the lock
+func (b *Backend) getVMSSVM(resourceGroup, scaleSet, instanceID string) *virtualMachine {
+	if !strings.EqualFold(resourceGroup, b.resourceGroup) {
+		return nil
+	}
+	for _, vm := range b.vms {
+		if strings.EqualFold(vm.scaleSet, scaleSet) && vm.instanceID == instanceID {
+			return vm
+		}
+	}
+	return nil
+}
+
+// updateDataDisks replaces the data disks of the VM as ARM does: the disks marked ToBeDetached and the disks missing
+// from the list are detached, the new disks are attached. The update is rejected as a whole if any disk could not be attached.
+// The caller must hold the lock.
+func (b *Backend) updateDataDisks(vm *virtualMachine, dataDisks *[]compute.DataDisk) *fault {
+	if dataDisks == nil {
+		return nil
+	}
+	vmID := b.vmID(vm)
+	luns := map[int32]string{}
+	var kept []compute.DataDisk
+	for _, dataDisk := range *dataDisks {
+		if ptr.Deref(dataDisk.ToBeDetached, false) {
+			continue
+		}
+		if dataDisk.ManagedDisk == nil || dataDisk.ManagedDisk.ID == nil || dataDisk.Lun == nil {
+			return &fault{statusCode: http.StatusBadRequest, code: "InvalidParameter", message: "the data disk must have a managed disk ID and a LUN"}
+		}
+		id := *dataDisk.ManagedDisk.ID
+		disk, ok := b.disks[strings.ToLower(id)]
+		if !ok {
+			return notFound("disk", id)
+		}
+		lun := *dataDisk.Lun
+		if other, ok := luns[lun]; ok {
+			return &fault{statusCode: http.StatusConflict, code: "Conflict",
+				message: fmt.Sprintf("LUN %d of VM %s is already used by disk %s", lun, vm.name, other)}
+		}
+		luns[lun] = id
+		if !isAttachedTo(disk, vmID) {
+			if f := canAttach(disk, vm, vmID); f != nil {
+				return f
+			}
+		}
+		dataDisk.ToBeDetached = nil
+		dataDisk.DetachOption = ""
+		kept = append(kept, dataDisk)
+	}
+
+	keptIDs := map[string]bool{}
+	for _, id := range luns {
+		keptIDs[strings.ToLower(id)] = true
+	}
+	for _, dataDisk := range vm.dataDisks {
+		id := strings.ToLower(*dataDisk.ManagedDisk.ID)
+		if disk, ok := b.disks[id]; ok && !keptIDs[id] {
+			detach(disk, vmID)
+		}
+	}
+	for _, dataDisk := range kept {
+		attach(b.disks[strings.ToLower(*dataDisk.ManagedDisk.ID)], vmID)
+	}
+	vm.dataDisks = kept
+	return nil
+}
+
+// canAttach returns the fault if the disk could not be attached to the VM
+func canAttach(disk *armcompute.Disk, vm *virtualMachine, vmID string) *fault {
+	maxShares := int32(1)
+	if disk.Properties != nil && disk.Properties.MaxShares != nil {
+		maxShares = *disk.Properties.MaxShares
+	}
+	if maxShares <= 1 && disk.ManagedBy != nil && *disk.ManagedBy != "" {
+		return &fault{statusCode: http.StatusConflict, code: "OperationNotAllowed",
+			message: fmt.Sprintf("disk %s is attached to VM %s, it could not be attached to VM %s", *disk.ID, *disk.ManagedBy, vmID)}
+	}
+	if maxShares > 1 && len(disk.ManagedByExtended) >= int(maxShares) {
+		return &fault{statusCode: http.StatusConflict, code: "OperationNotAllowed",
+			message: fmt.Sprintf("disk %s is attached to %d VMs, which is the maxShares of the disk", *disk.ID, len(disk.ManagedByExtended))}
+	}
+	if len(disk.Zones) > 0 {
+		for _, zone := range disk.Zones {
+			if zone != nil && *zone == vm.zone {
+				return nil
+			}
+		}
+		return &fault{statusCode: http.StatusBadRequest, code: "BadRequest",
+			message: fmt.Sprintf("disk %s in zone %s could not be attached to VM %s in zone %q", *disk.ID, *disk.Zones[0], vmID, vm.zone)}
+	}
+	return nil
+}
+
+func isAttachedTo(disk *armcompute.Disk, vmID string) bool {
+	if disk.ManagedBy != nil && strings.EqualFold(*disk.ManagedBy, vmID) {
+		return true
+	}
+	for _, managedBy := range disk.ManagedByExtended {
+		if managedBy != nil && strings.EqualFold(*managedBy, vmID) {
+			return true
+		}
+	}
+	return false
+}
+
+// attach sets the VM in ManagedBy of the disk, the VMs of a shared disk are listed in ManagedByExtended
+func attach(disk *armcompute.Disk, vmID string) {
+	if isAttachedTo(disk, vmID) {
+		return
+	}
+	if disk.ManagedBy == nil || *disk.ManagedBy == "" {
+		disk.ManagedBy = to.Ptr(vmID)
+	}
+	if disk.Properties != nil && disk.Properties.MaxShares != nil && *disk.Properties.MaxShares > 1 {
+		disk.ManagedByExtended = append(disk.ManagedByExtended, to.Ptr(vmID))
+	}
+	disk.Properties.DiskState = to.Ptr(armcompute.DiskStateAttached)
+}
+
+func detach(disk *armcompute.Disk, vmID string) {
+	var managedByExtended []*string
+	for _, managedBy := range disk.ManagedByExtended {
+		if managedBy != nil && !strings.EqualFold(*managedBy, vmID) {
+			managedByExtended = append(managedByExtended, managedBy)
+		}
+	}
+	disk.ManagedByExtended = managedByExtended
+	if disk.ManagedBy != nil && strings.EqualFold(*disk.ManagedBy, vmID) {
+		disk.ManagedBy = nil
+		if len(managedByExtended) > 0 {
+			disk.ManagedBy = to.Ptr(*managedByExtended[0])
+		}
+	}
+	if disk.ManagedBy == nil {
+		disk.Properties.DiskState = to.Ptr(armcompute.DiskStateUnattached)
+	}
+}
+
+func (vm *virtualMachine) zones() *[]string {
+	if vm.zone == "" {
+		return nil
+	}
+	return &[]string{vm.zone}
+}
+
+func (vm *virtualMachine) copyDataDisks() *[]compute.DataDisk {
+	dataDisks := make([]compute.DataDisk, len(vm.dataDisks))
+	copy(dataDisks, vm.dataDisks)
+	return &dataDisks
+}
+
+var runningStatuses = []compute.InstanceViewStatus{
+	{Code: to.Ptr("ProvisioningState/succeeded")},
+	{Code: to.Ptr("PowerState/running")},
+}
+
+// legacyVM returns the availability set VM in the format of the legacy clients, the caller must hold the lock
+func (b *Backend) legacyVM(vm *virtualMachine) compute.VirtualMachine {
+	return compute.VirtualMachine{
+		ID:       to.Ptr(b.vmID(vm)),
+		Name:     to.Ptr(vm.name),
+		Location: to.Ptr(b.location),
+		Zones:    vm.zones(),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			ProvisioningState: to.Ptr("Succeeded"),
+			HardwareProfile:   &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypes(defaultVMSize)},
+			OsProfile:         &compute.OSProfile{ComputerName: to.Ptr(vm.name)},
+			StorageProfile:    &compute.StorageProfile{DataDisks: vm.copyDataDisks()},
+			InstanceView:      &compute.VirtualMachineInstanceView{Statuses: &runningStatuses},
+		},
+	}
+}
+
+// legacyVMSSVM returns the VMSS instance in the format of the legacy clients, the caller must hold the lock
+func (b *Backend) legacyVMSSVM(vm *virtualMachine) compute.VirtualMachineScaleSetVM {
+	return compute.VirtualMachineScaleSetVM{
+		ID:         to.Ptr(b.vmID(vm)),
+		Name:       to.Ptr(fmt.Sprintf("%s_%s", vm.scaleSet, vm.instanceID)),
+		InstanceID: to.Ptr(vm.instanceID),
+		Location:   to.Ptr(b.location),
+		Zones:      vm.zones(),
+		Sku:        &compute.Sku{Name: to.Ptr(defaultVMSize)},
+		VirtualMachineScaleSetVMProperties: &compute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: to.Ptr("Succeeded"),
+			HardwareProfile:   &compute.HardwareProfile{VMSize: compute.VirtualMachineSizeTypes(defaultVMSize)},
+			OsProfile:         &compute.OSProfile{ComputerName: to.Ptr(vm.name)},
+			NetworkProfile:    &compute.NetworkProfile{NetworkInterfaces: &[]compute.NetworkInterfaceReference{}},
+			StorageProfile:    &compute.StorageProfile{DataDisks: vm.copyDataDisks()},
+			InstanceView:      &compute.VirtualMachineScaleSetVMInstanceView{Statuses: &runningStatuses},
+		},
+	}
+}
+
+// vmClient is the legacy VM client of the availability set VMs, the VMs could not be created or deleted
+type vmClient struct {
+	backend *Backend
+}
+
+func (c *vmClient) Get(ctx context.Context, resourceGroupName string, vmName string, _ compute.InstanceViewTypes) (compute.VirtualMachine, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachines.Get"); f != nil {
+		return compute.VirtualMachine{}, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vm := b.getVM(resourceGroupName, vmName)
+	if vm == nil {
+		return compute.VirtualMachine{}, notFound("VM", vmName).retryError()
+	}
+	return b.legacyVM(vm), nil
+}
+
+func (c *vmClient) List(ctx context.Context, resourceGroupName string) ([]compute.VirtualMachine, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachines.List"); f != nil {
+		return nil, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var vms []compute.VirtualMachine
+	for _, vm := range b.vms {
+		if vm.scaleSet == "" && strings.EqualFold(resourceGroupName, b.resourceGroup) {
+			vms = append(vms, b.legacyVM(vm))
+		}
+	}
+	return vms, nil
+}
+
+func (c *vmClient) ListVmssFlexVMsWithoutInstanceView(ctx context.Context, _ string) ([]compute.VirtualMachine, *retry.Error) {
+	return nil, c.backend.serve(ctx, "VirtualMachines.List").retryError()
+}
+
+func (c *vmClient) ListVmssFlexVMsWithOnlyInstanceView(ctx context.Context, _ string) ([]compute.VirtualMachine, *retry.Error) {
+	return nil, c.backend.serve(ctx, "VirtualMachines.List").retryError()
+}
+
+func (c *vmClient) CreateOrUpdate(_ context.Context, _ string, vmName string, _ compute.VirtualMachine, _ string) *retry.Error {
+	return retry.NewError(false, fmt.Errorf("creating VM %s is not supported by the fake ARM backend", vmName))
+}
+
+func (c *vmClient) Update(ctx context.Context, resourceGroupName string, vmName string, parameters compute.VirtualMachineUpdate, _ string) (*compute.VirtualMachine, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachines.Update"); f != nil {
+		return nil, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vm := b.getVM(resourceGroupName, vmName)
+	if vm == nil {
+		return nil, notFound("VM", vmName).retryError()
+	}
+	if parameters.VirtualMachineProperties != nil && parameters.StorageProfile != nil {
+		if f := b.updateDataDisks(vm, parameters.StorageProfile.DataDisks); f != nil {
+			return nil, f.retryError()
+		}
+	}
+	result := b.legacyVM(vm)
+	return &result, nil
+}
+
+// UpdateAsync applies the update at once, the returned future is resolved by WaitForUpdateResult
+func (c *vmClient) UpdateAsync(ctx context.Context, resourceGroupName string, vmName string, parameters compute.VirtualMachineUpdate, source string) (*azure.Future, *retry.Error) {
+	if _, rerr := c.Update(ctx, resourceGroupName, vmName, parameters, source); rerr != nil {
+		return nil, rerr
+	}
+	return c.backend.newFuture(vmName), nil
+}
+
+func (c *vmClient) WaitForUpdateResult(_ context.Context, future *azure.Future, _ string, _ string) (*compute.VirtualMachine, *retry.Error) {
+	b := c.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vm, ok := b.futures[future]
+	if !ok {
+		return nil, retry.NewError(false, fmt.Errorf("unknown future"))
+	}
+	delete(b.futures, future)
+	result := b.legacyVM(vm)
+	return &result, nil
+}
+
+func (c *vmClient) Delete(_ context.Context, _ string, vmName string) *retry.Error {
+	return retry.NewError(false, fmt.Errorf("deleting VM %s is not supported by the fake ARM backend", vmName))
+}
+
+// newFuture returns a future of the update of the VM
+func (b *Backend) newFuture(name string) *azure.Future {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	future := &azure.Future{}
+	b.futures[future] = b.vms[strings.ToLower(name)]
+	return future
+}
+
+// vmssClient is the legacy VMSS client, which lists the VMSS of the instances.
+// The other methods are not used by the driver and not implemented.
+type vmssClient struct {
+	vmssclient.Interface
+	backend *Backend
+}
+
+// legacyScaleSets returns the uniform VMSS of the instances, the caller must hold the lock
+func (b *Backend) legacyScaleSets() map[string]compute.VirtualMachineScaleSet {
+	scaleSets := map[string]compute.VirtualMachineScaleSet{}
+	for _, vm := range b.vms {
+		if vm.scaleSet == "" {
+			continue
+		}
+		scaleSets[strings.ToLower(vm.scaleSet)] = compute.VirtualMachineScaleSet{
+			ID:       to.Ptr(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s", b.subscriptionID, b.resourceGroup, vm.scaleSet)),
+			Name:     to.Ptr(vm.scaleSet),
+			Location: to.Ptr(b.location),
+			Zones:    vm.zones(),
+			Sku:      &compute.Sku{Name: to.Ptr(defaultVMSize)},
+			VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+				ProvisioningState: to.Ptr("Succeeded"),
+				OrchestrationMode: compute.Uniform,
+				VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+					OsProfile: &compute.VirtualMachineScaleSetOSProfile{ComputerNamePrefix: to.Ptr(vm.scaleSet)},
+				},
+			},
+		}
+	}
+	return scaleSets
+}
+
+func (c *vmssClient) Get(ctx context.Context, resourceGroupName string, vmScaleSetName string) (compute.VirtualMachineScaleSet, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachineScaleSets.Get"); f != nil {
+		return compute.VirtualMachineScaleSet{}, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	scaleSet, ok := b.legacyScaleSets()[strings.ToLower(vmScaleSetName)]
+	if !ok || !strings.EqualFold(resourceGroupName, b.resourceGroup) {
+		return compute.VirtualMachineScaleSet{}, notFound("VMSS", vmScaleSetName).retryError()
+	}
+	return scaleSet, nil
+}
+
+func (c *vmssClient) List(ctx context.Context, resourceGroupName string) ([]compute.VirtualMachineScaleSet, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachineScaleSets.List"); f != nil {
+		return nil, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !strings.EqualFold(resourceGroupName, b.resourceGroup) {
+		return nil, nil
+	}
+	var scaleSets []compute.VirtualMachineScaleSet
+	for _, scaleSet := range b.legacyScaleSets() {
+		scaleSets = append(scaleSets, scaleSet)
+	}
+	return scaleSets, nil
+}
+
+// vmssVMClient is the legacy VMSS VM client of the VMSS instances
+type vmssVMClient struct {
+	backend *Backend
+}
+
+func (c *vmssVMClient) Get(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string, _ compute.InstanceViewTypes) (compute.VirtualMachineScaleSetVM, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachineScaleSetVMs.Get"); f != nil {
+		return compute.VirtualMachineScaleSetVM{}, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vm := b.getVMSSVM(resourceGroupName, vmScaleSetName, instanceID)
+	if vm == nil {
+		return compute.VirtualMachineScaleSetVM{}, notFound("VMSS VM", vmScaleSetName+"/"+instanceID).retryError()
+	}
+	return b.legacyVMSSVM(vm), nil
+}
+
+func (c *vmssVMClient) List(ctx context.Context, resourceGroupName string, virtualMachineScaleSetName string, _ string) ([]compute.VirtualMachineScaleSetVM, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachineScaleSetVMs.List"); f != nil {
+		return nil, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var vms []compute.VirtualMachineScaleSetVM
+	for _, vm := range b.vms {
+		if strings.EqualFold(vm.scaleSet, virtualMachineScaleSetName) && strings.EqualFold(resourceGroupName, b.resourceGroup) {
+			vms = append(vms, b.legacyVMSSVM(vm))
+		}
+	}
+	return vms, nil
+}
+
+func (c *vmssVMClient) Update(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, _ string) (*compute.VirtualMachineScaleSetVM, *retry.Error) {
+	b := c.backend
+	if f := b.serve(ctx, "VirtualMachineScaleSetVMs.Update"); f != nil {
+		return nil, f.retryError()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vm := b.getVMSSVM(resourceGroupName, vmScaleSetName, instanceID)
+	if vm == nil {
+		return nil, notFound("VMSS VM", vmScaleSetName+"/"+instanceID).retryError()
+	}
+	if parameters.VirtualMachineScaleSetVMProperties != nil && parameters.StorageProfile != nil {
+		if f := b.updateDataDisks(vm, parameters.StorageProfile.DataDisks); f != nil {
+			return nil, f.retryError()
+		}
+	}
+	result := b.legacyVMSSVM(vm)
+	return &result, nil
+}
+
+// UpdateAsync applies the update at once, the returned future is resolved by WaitForUpdateResult
+func (c *vmssVMClient) UpdateAsync(ctx context.Context, resourceGroupName string, vmScaleSetName string, instanceID string, parameters compute.VirtualMachineScaleSetVM, source string) (*azure.Future, *retry.Error) {
+	result, rerr := c.Update(ctx, resourceGroupName, vmScaleSetName, instanceID, parameters, source)
+	if rerr != nil {
+		return nil, rerr
+	}
+	return c.backend.newFuture(*result.OsProfile.ComputerName), nil
+}
+
+func (c *vmssVMClient) WaitForUpdateResult(_ context.Context, future *azure.Future, _ string, _ string) (*compute.VirtualMachineScaleSetVM, *retry.Error) {
+	b := c.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vm, ok := b.futures[future]
+	if !ok {
+		return nil, retry.NewError(false, fmt.Errorf("unknown future"))
+	}
+	delete(b.futures, future)
+	result := b.legacyVMSSVM(vm)
+	return &result, nil
+}
+
+func (c *vmssVMClient) UpdateVMs(ctx context.Context, resourceGroupName string, vmScaleSetName string, instances map[string]compute.VirtualMachineScaleSetVM, source string, _ int) *retry.Error {
+	for instanceID, parameters := range instances {
+		if _, rerr := c.Update(ctx, resourceGroupName, vmScaleSetName, instanceID, parameters, source); rerr != nil {
+			return rerr
+		}
+	}
+	return nil
+}
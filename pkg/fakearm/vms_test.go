@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fakearm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+	"sigs.k8s.io/azuredisk-csi-driver/pkg/azureutils"
+	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
+	provider "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+// newTestCloud returns a cloud provider of the cloud config, whose clients are replaced by the backend
+func newTestCloud(t *testing.T, b *Backend, vmType string) *provider.Cloud {
+	credFile := filepath.Join(t.TempDir(), "azure.json")
+	t.Setenv(consts.DefaultAzureCredentialFileEnv, credFile)
+	config := fmt.Sprintf(`{"cloud":"AzurePublicCloud","tenantId":"tenant","subscriptionId":"subs","aadClientId":"client","aadClientSecret":"secret",`+
+		`"resourceGroup":"rg","location":"eastus","vmType":%q,"useInstanceMetadata":false}`, vmType)
+	require.NoError(t, os.WriteFile(credFile, []byte(config), 0600))
+	azureutils.SetCloudProviderHook(b.Install)
+	defer azureutils.SetCloudProviderHook(nil)
+	az, err := azureutils.GetCloudProviderFromClient(context.Background(), nil, "", "", "fakearm", false, false, -1)
+	require.NoError(t, err)
+	return az
+}
+
+func createTestDisk(t *testing.T, b *Backend, name string, zone string, maxShares int32) string {
+	disk := armcompute.Disk{Properties: &armcompute.DiskProperties{DiskSizeGB: to.Ptr[int32](10), MaxShares: to.Ptr(maxShares)}}
+	if zone != "" {
+		disk.Zones = []*string{to.Ptr(zone)}
+	}
+	created, err := newTestClientFactory(b).GetDiskClient().CreateOrUpdate(context.Background(), "rg", name, disk)
+	require.NoError(t, err)
+	return *created.ID
+}
+
+func getTestDisk(t *testing.T, b *Backend, diskURI string) *armcompute.Disk {
+	disk, err := newTestClientFactory(b).GetDiskClient().Get(context.Background(), "rg", diskURI[strings.LastIndex(diskURI, "/")+1:])
+	require.NoError(t, err)
+	return disk
+}
+
+func attachTestDisk(vmset provider.VMSet, nodeName, diskURI string, lun int32) error {
+	return vmset.AttachDisk(context.Background(), types.NodeName(nodeName), map[string]*provider.AttachDiskOptions{
+		diskURI: {DiskName: diskURI[strings.LastIndex(diskURI, "/")+1:], Lun: lun},
+	})
+}
+
+func detachTestDisk(vmset provider.VMSet, nodeName, diskURI string) error {
+	return vmset.DetachDisk(context.Background(), types.NodeName(nodeName), map[string]string{
+		diskURI: diskURI[strings.LastIndex(diskURI, "/")+1:],
+	}, false)
+}
+
+func TestAvailabilitySetAttachDetach(t *testing.T) {
+	b := NewBackend()
+	b.AddVM("node-0", "1")
+	b.AddVM("node-1", "")
+	az := newTestCloud(t, b, "standard")
+	vmset, err := az.GetNodeVMSet(types.NodeName("node-0"), azcache.CacheReadTypeDefault)
+	require.NoError(t, err)
+
+	zonal := createTestDisk(t, b, "zonal", "1", 1)
+	regional := createTestDisk(t, b, "regional", "", 1)
+	shared := createTestDisk(t, b, "shared", "", 2)
+	otherZone := createTestDisk(t, b, "other-zone", "2", 1)
+
+	assert.NoError(t, attachTestDisk(vmset, "node-0", zonal, 0))
+	assert.NoError(t, attachTestDisk(vmset, "node-0", regional, 1))
+	disk := getTestDisk(t, b, zonal)
+	assert.Equal(t, "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/node-0", *disk.ManagedBy)
+	assert.Equal(t, armcompute.DiskStateAttached, *disk.Properties.DiskState)
+	dataDisks, _, err := vmset.GetDataDisks(types.NodeName("node-0"), azcache.CacheReadTypeForceRefresh)
+	assert.NoError(t, err)
+	assert.Len(t, dataDisks, 2)
+
+	// a disk attached to another VM, a disk in another zone and a used LUN are rejected
+	assert.ErrorContains(t, attachTestDisk(vmset, "node-1", regional, 0), "OperationNotAllowed")
+	assert.ErrorContains(t, attachTestDisk(vmset, "node-0", otherZone, 2), "BadRequest")
+	assert.ErrorContains(t, attachTestDisk(vmset, "node-0", otherZone, 0), "LUN 0 of VM node-0 is already used")
+	assert.Equal(t, armcompute.DiskStateUnattached, *getTestDisk(t, b, otherZone).Properties.DiskState)
+
+	// a shared disk could be attached to maxShares VMs
+	assert.NoError(t, attachTestDisk(vmset, "node-0", shared, 2))
+	assert.NoError(t, attachTestDisk(vmset, "node-1", shared, 0))
+	assert.Len(t, getTestDisk(t, b, shared).ManagedByExtended, 2)
+
+	assert.NoError(t, detachTestDisk(vmset, "node-0", zonal))
+	disk = getTestDisk(t, b, zonal)
+	assert.Nil(t, disk.ManagedBy)
+	assert.Equal(t, armcompute.DiskStateUnattached, *disk.Properties.DiskState)
+	assert.NoError(t, detachTestDisk(vmset, "node-0", shared))
+	disk = getTestDisk(t, b, shared)
+	assert.Equal(t, "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/node-1", *disk.ManagedBy)
+	assert.Equal(t, armcompute.DiskStateAttached, *disk.Properties.DiskState)
+
+	// the preempted update is not applied
+	b.InjectFault("VirtualMachines.Update", FaultPreempted, 1)
+	assert.ErrorContains(t, attachTestDisk(vmset, "node-0", zonal, 0), "OperationPreempted")
+	assert.Equal(t, armcompute.DiskStateUnattached, *getTestDisk(t, b, zonal).Properties.DiskState)
+	assert.NoError(t, attachTestDisk(vmset, "node-0", zonal, 0))
+}
+
+func TestScaleSetAttachDetach(t *testing.T) {
+	b := NewBackend()
+	b.AddScaleSet("aks-vmss", 2, "")
+	az := newTestCloud(t, b, "vmss")
+	vmset, err := az.GetNodeVMSet(types.NodeName("aks-vmss000001"), azcache.CacheReadTypeDefault)
+	require.NoError(t, err)
+	diskURI := createTestDisk(t, b, "disk", "", 1)
+
+	assert.NoError(t, attachTestDisk(vmset, "aks-vmss000001", diskURI, 3))
+	assert.Equal(t, "/subscriptions/subs/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-vmss/virtualMachines/1",
+		*getTestDisk(t, b, diskURI).ManagedBy)
+	dataDisks, _, err := vmset.GetDataDisks(types.NodeName("aks-vmss000001"), azcache.CacheReadTypeForceRefresh)
+	assert.NoError(t, err)
+	require.Len(t, dataDisks, 1)
+	assert.Equal(t, int32(3), *dataDisks[0].Lun)
+	assert.ErrorContains(t, attachTestDisk(vmset, "aks-vmss000000", diskURI, 0), "OperationNotAllowed")
+
+	assert.NoError(t, detachTestDisk(vmset, "aks-vmss000001", diskURI))
+	assert.Equal(t, armcompute.DiskStateUnattached, *getTestDisk(t, b, diskURI).Properties.DiskState)
+
+	// an attached disk could not be deleted
+	assert.NoError(t, attachTestDisk(vmset, "aks-vmss000000", diskURI, 0))
+	assert.ErrorContains(t, newTestClientFactory(b).GetDiskClient().Delete(context.Background(), "rg", "disk"), "OperationNotAllowed")
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+const (
+	// a sample with fewer IOs does not describe the workload well enough to change any setting
+	autoTuneMinIOs = 1000
+	// a numeric setting is only changed if the new value differs from the current one by more than this ratio
+	autoTuneMinChangeRatio = 0.25
+	// the scheduler is only switched if the same scheduler is chosen in consecutive samples
+	autoTuneSchedulerSamples = 2
+
+	autoTuneMinReadAheadKb  = 8
+	autoTuneMaxReadAheadKb  = 1024
+	autoTuneDefReadAheadKb  = 128
+	autoTuneMinNrRequests   = 32
+	autoTuneMaxNrRequests   = 1024
+	blockDeviceSectorSizeKb = 0.5
+)
+
+var (
+	registerAutoTuneMetricsOnce sync.Once
+
+	autoTuneChangeCount = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_perf_auto_tune_changes_total",
+			Help:           "Number of block device settings changed by the auto perfProfile by device and setting",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"device", "setting"},
+	)
+	autoTuneSettingValue = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           consts.AzureDiskCSIDriverName + "_perf_auto_tune_setting",
+			Help:           "Numeric block device settings applied by the auto perfProfile by device and setting",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"device", "setting"},
+	)
+)
+
+// recordAutoTuneChange exports a setting changed by the auto perfProfile as metrics
+func recordAutoTuneChange(deviceName, setting, value string) {
+	registerAutoTuneMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(autoTuneChangeCount, autoTuneSettingValue)
+	})
+	autoTuneChangeCount.WithLabelValues(deviceName, setting).Inc()
+	if valueFloat, err := strconv.ParseFloat(value, 64); err == nil {
+		autoTuneSettingValue.WithLabelValues(deviceName, setting).Set(valueFloat)
+	}
+}
+
+// BlockDeviceStat is the cumulative counters of a block device in /sys/block/<dev>/stat,
+// see https://www.kernel.org/doc/Documentation/block/stat.txt
+type BlockDeviceStat struct {
+	ReadIOs       uint64
+	ReadSectors   uint64
+	ReadTicksMs   uint64
+	WriteIOs      uint64
+	WriteSectors  uint64
+	WriteTicksMs  uint64
+	InFlight      uint64
+	IOTicksMs     uint64
+	TimeInQueueMs uint64
+}
+
+// ParseBlockDeviceStat parses the content of /sys/block/<dev>/stat
+func ParseBlockDeviceStat(content string) (BlockDeviceStat, error) {
+	fields := strings.Fields(content)
+	if len(fields) < 11 {
+		return BlockDeviceStat{}, fmt.Errorf("expected at least 11 fields in block device stat, got %d", len(fields))
+	}
+	values := make([]uint64, 11)
+	for i := range values {
+		value, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return BlockDeviceStat{}, fmt.Errorf("failed to parse field %d of block device stat: %v", i+1, err)
+		}
+		values[i] = value
+	}
+	return BlockDeviceStat{
+		ReadIOs:       values[0],
+		ReadSectors:   values[2],
+		ReadTicksMs:   values[3],
+		WriteIOs:      values[4],
+		WriteSectors:  values[6],
+		WriteTicksMs:  values[7],
+		InFlight:      values[8],
+		IOTicksMs:     values[9],
+		TimeInQueueMs: values[10],
+	}, nil
+}
+
+// workloadEstimate describes the IOs on a block device between two samples
+type workloadEstimate struct {
+	ios           uint64
+	readRatio     float64
+	avgIOSizeKb   float64
+	avgLatencyMs  float64
+	avgQueueDepth float64
+}
+
+// estimateWorkload estimates the workload from two samples of a block device taken interval apart,
+// false is returned if the counters are reset or there are too few IOs
+func estimateWorkload(prev, cur BlockDeviceStat, interval time.Duration) (workloadEstimate, bool) {
+	if cur.ReadIOs < prev.ReadIOs || cur.WriteIOs < prev.WriteIOs || cur.ReadSectors < prev.ReadSectors ||
+		cur.WriteSectors < prev.WriteSectors || cur.ReadTicksMs < prev.ReadTicksMs || cur.WriteTicksMs < prev.WriteTicksMs ||
+		cur.TimeInQueueMs < prev.TimeInQueueMs || interval <= 0 {
+		return workloadEstimate{}, false
+	}
+	readIOs := cur.ReadIOs - prev.ReadIOs
+	ios := readIOs + cur.WriteIOs - prev.WriteIOs
+	if ios < autoTuneMinIOs {
+		return workloadEstimate{}, false
+	}
+	sectors := cur.ReadSectors - prev.ReadSectors + cur.WriteSectors - prev.WriteSectors
+	ticksMs := cur.ReadTicksMs - prev.ReadTicksMs + cur.WriteTicksMs - prev.WriteTicksMs
+	return workloadEstimate{
+		ios:           ios,
+		readRatio:     float64(readIOs) / float64(ios),
+		avgIOSizeKb:   float64(sectors) * blockDeviceSectorSizeKb / float64(ios),
+		avgLatencyMs:  float64(ticksMs) / float64(ios),
+		avgQueueDepth: float64(cur.TimeInQueueMs-prev.TimeInQueueMs) / (interval.Seconds() * 1000),
+	}, true
+}
+
+// getAutoTuneScheduler chooses the scheduler for a workload, an empty scheduler means the current one is kept.
+// mq-deadline prevents reads from starving behind writes of a deep mixed workload, while a deep queue of
+// small IOs is bound by IOPS and gains more from skipping the scheduler
+func getAutoTuneScheduler(workload workloadEstimate) string {
+	if workload.readRatio > 0.3 && workload.readRatio < 0.7 && workload.avgQueueDepth >= 8 {
+		return "mq-deadline"
+	}
+	if workload.avgIOSizeKb <= 16 && workload.avgQueueDepth >= 32 {
+		return "none"
+	}
+	return ""
+}
+
+// getAutoTuneReadAheadKb chooses read_ahead_kb for a workload, large reads are likely sequential and benefit
+// from a larger read-ahead while small reads are likely random and would waste the bandwidth on read-ahead
+func getAutoTuneReadAheadKb(workload workloadEstimate) int {
+	switch {
+	case workload.readRatio >= 0.7 && workload.avgIOSizeKb >= 64:
+		return clampPowerOfTwo(workload.avgIOSizeKb*4, autoTuneMinReadAheadKb, autoTuneMaxReadAheadKb)
+	case workload.avgIOSizeKb <= 16:
+		return autoTuneMinReadAheadKb
+	default:
+		return autoTuneDefReadAheadKb
+	}
+}
+
+// getAutoTuneNrRequests chooses nr_requests for a workload with room for bursts above the average queue depth,
+// maxNrRequests is the limit of the device, e.g. the tags of a hardware queue without scheduler
+func getAutoTuneNrRequests(workload workloadEstimate, maxNrRequests int) int {
+	if maxNrRequests <= 0 || maxNrRequests > autoTuneMaxNrRequests {
+		maxNrRequests = autoTuneMaxNrRequests
+	}
+	return clampPowerOfTwo(workload.avgQueueDepth*2, int(math.Min(autoTuneMinNrRequests, float64(maxNrRequests))), maxNrRequests)
+}
+
+// clampPowerOfTwo rounds value up to a power of two within [minValue, maxValue]
+func clampPowerOfTwo(value float64, minValue, maxValue int) int {
+	result := minValue
+	if value > 1 {
+		result = int(math.Pow(2, math.Ceil(math.Log2(value))))
+	}
+	if result < minValue {
+		return minValue
+	}
+	if result > maxValue {
+		return maxValue
+	}
+	return result
+}
+
+// isSignificantChange checks whether a numeric setting should be changed from current to target
+func isSignificantChange(current, target int) bool {
+	if current <= 0 {
+		return target > 0
+	}
+	return math.Abs(float64(target-current))/float64(current) > autoTuneMinChangeRatio
+}
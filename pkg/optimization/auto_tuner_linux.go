@@ -0,0 +1,226 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
+)
+
+// autoTuneSample is the last sample of a block device tuned with auto perfProfile
+type autoTuneSample struct {
+	stat      BlockDeviceStat
+	sampledAt time.Time
+	// the scheduler chosen in the last consecutive samples and how many times it's chosen
+	pendingScheduler string
+	pendingSamples   int
+}
+
+// autoTuner keeps the samples of block devices tuned with auto perfProfile by device root
+type autoTuner struct {
+	lock    sync.Mutex
+	samples map[string]*autoTuneSample
+}
+
+var deviceAutoTuner = &autoTuner{samples: map[string]*autoTuneSample{}}
+
+// sample records the stat of a device and returns the workload since the last sample,
+// false is returned for the first sample or if the workload could not be estimated
+func (t *autoTuner) sample(deviceRoot string, stat BlockDeviceStat, now time.Time) (workloadEstimate, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	last, ok := t.samples[deviceRoot]
+	if !ok {
+		t.samples[deviceRoot] = &autoTuneSample{stat: stat, sampledAt: now}
+		return workloadEstimate{}, false
+	}
+	workload, ok := estimateWorkload(last.stat, stat, now.Sub(last.sampledAt))
+	last.stat, last.sampledAt = stat, now
+	return workload, ok
+}
+
+// confirmScheduler checks whether scheduler is chosen for a device in enough consecutive samples to switch to it
+func (t *autoTuner) confirmScheduler(deviceRoot, scheduler string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	last, ok := t.samples[deviceRoot]
+	if !ok {
+		return false
+	}
+	if scheduler == "" {
+		last.pendingScheduler, last.pendingSamples = "", 0
+		return false
+	}
+	if last.pendingScheduler != scheduler {
+		last.pendingScheduler, last.pendingSamples = scheduler, 0
+	}
+	last.pendingSamples++
+	return last.pendingSamples >= autoTuneSchedulerSamples
+}
+
+// forget drops the samples of a device which is not tuned any more
+func (t *autoTuner) forget(deviceRoot string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.samples, deviceRoot)
+}
+
+// isSchedulerAvailable checks whether scheduler is listed in the scheduler file of a device, e.g. "none [mq-deadline] kyber"
+func isSchedulerAvailable(schedulerPath, scheduler string) bool {
+	content, err := os.ReadFile(schedulerPath)
+	if err != nil {
+		return false
+	}
+	for _, available := range strings.Fields(string(content)) {
+		if strings.Trim(available, "[]") == scheduler {
+			return true
+		}
+	}
+	return false
+}
+
+// TuneDeviceSettings adjusts the scheduler, read_ahead_kb and nr_requests of the devices tuned with auto perfProfile
+// in stateFile according to the workload observed since the last call, it's a no-op for other perfProfiles.
+// The changed settings are recorded in stateFile so that they are reapplied and restored like the initial settings.
+func (deviceHelper *DeviceHelper) TuneDeviceSettings(stateFile string) error {
+	state, err := readDeviceSettingsState(stateFile)
+	if err != nil {
+		return fmt.Errorf("TuneDeviceSettings: failed to read %s. Error: %v", stateFile, err)
+	}
+	if state == nil || state.PerfProfile != consts.PerfProfileAuto {
+		return nil
+	}
+
+	var errs []error
+	changed := false
+	for i := range state.Devices {
+		device := &state.Devices[i]
+		if !isSameDevice(device) {
+			continue
+		}
+		deviceRoot := filepath.Join(deviceHelper.blockDeviceRootPath, device.DeviceName)
+		content, err := os.ReadFile(filepath.Join(deviceRoot, "stat"))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stat, err := ParseBlockDeviceStat(string(content))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse stat of %s: %v", device.DeviceName, err))
+			continue
+		}
+		workload, ok := deviceAutoTuner.sample(deviceRoot, stat, time.Now())
+		if !ok {
+			continue
+		}
+		klog.V(4).Infof("TuneDeviceSettings: workload of %s: %d IOs, read ratio %.2f, avg IO size %.1fKB, avg latency %.2fms, avg queue depth %.1f",
+			device.DeviceName, workload.ios, workload.readRatio, workload.avgIOSizeKb, workload.avgLatencyMs, workload.avgQueueDepth)
+		deviceChanged, err := tuneDeviceSettings(device, deviceRoot, workload)
+		changed = changed || deviceChanged
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if changed {
+		if err := writeDeviceSettingsState(stateFile, state); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tuneDeviceSettings applies the settings chosen for the workload on a device if they differ enough from the current ones
+func tuneDeviceSettings(device *deviceSettingsOfDevice, deviceRoot string, workload workloadEstimate) (changed bool, err error) {
+	schedulerPath := filepath.Join(deviceRoot, "queue/scheduler")
+	currentScheduler, err := readDeviceSetting(schedulerPath)
+	if err != nil {
+		return false, err
+	}
+	schedulerChanged := false
+	scheduler := getAutoTuneScheduler(workload)
+	if confirmed := deviceAutoTuner.confirmScheduler(deviceRoot, scheduler); confirmed && scheduler != currentScheduler &&
+		isSchedulerAvailable(schedulerPath, scheduler) {
+		if err := applyAutoTuneSetting(device, deviceRoot, "queue/scheduler", currentScheduler, scheduler, workload); err != nil {
+			return changed, err
+		}
+		changed, schedulerChanged, currentScheduler = true, true, scheduler
+	}
+
+	readAheadKb := getAutoTuneReadAheadKb(workload)
+	if current, err := readDeviceSetting(filepath.Join(deviceRoot, "queue/read_ahead_kb")); err == nil {
+		if currentInt, _ := strconv.Atoi(current); isSignificantChange(currentInt, readAheadKb) {
+			if err := applyAutoTuneSetting(device, deviceRoot, "queue/read_ahead_kb", current, strconv.Itoa(readAheadKb), workload); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	// nr_requests can not exceed the tags of a hardware queue without scheduler
+	maxNrRequests := autoTuneMaxNrRequests
+	if currentScheduler == "none" {
+		nrTags, err := readDeviceSetting(filepath.Join(deviceRoot, "mq/0/nr_tags"))
+		if err != nil {
+			return changed, nil
+		}
+		if maxNrRequests, err = strconv.Atoi(nrTags); err != nil {
+			return changed, nil
+		}
+	}
+	nrRequests := getAutoTuneNrRequests(workload, maxNrRequests)
+	if current, err := readDeviceSetting(filepath.Join(deviceRoot, "queue/nr_requests")); err == nil {
+		// switching the scheduler resets nr_requests, so it's always applied again
+		if currentInt, _ := strconv.Atoi(current); (schedulerChanged && currentInt != nrRequests) || isSignificantChange(currentInt, nrRequests) {
+			if err := applyAutoTuneSetting(device, deviceRoot, "queue/nr_requests", current, strconv.Itoa(nrRequests), workload); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// applyAutoTuneSetting writes value to a setting of a device and records it in the state, every change is logged and exported as metrics
+func applyAutoTuneSetting(device *deviceSettingsOfDevice, deviceRoot, setting, current, value string, workload workloadEstimate) error {
+	path := filepath.Join(deviceRoot, setting)
+	if err := echoToFile(value, path); err != nil {
+		return fmt.Errorf("could not set %s with value %s. Error: %v", path, value, err)
+	}
+	applied, err := readDeviceSetting(path)
+	if err != nil {
+		applied = value
+	}
+	device.setSetting(path, current, applied)
+	klog.V(2).Infof("TuneDeviceSettings: changed %s of %s from %s to %s for workload with read ratio %.2f, avg IO size %.1fKB, avg latency %.2fms, avg queue depth %.1f",
+		setting, device.DeviceName, current, applied, workload.readRatio, workload.avgIOSizeKb, workload.avgLatencyMs, workload.avgQueueDepth)
+	recordAutoTuneChange(device.DeviceName, setting, applied)
+	return nil
+}
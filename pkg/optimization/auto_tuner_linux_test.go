@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTuneDeviceSettings(t *testing.T) {
+	deviceHelper := NewDeviceHelper()
+	lunPath := setupFakeBlockDevice(t, deviceHelper)
+	deviceRoot := filepath.Join(deviceHelper.blockDeviceRootPath, "sdc")
+	require.NoError(t, os.MkdirAll(filepath.Join(deviceRoot, "mq/0"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(deviceRoot, "mq/0/nr_tags"), []byte("64\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(deviceRoot, "queue/read_ahead_kb"), []byte("128\n"), 0644))
+	t.Cleanup(func() { deviceAutoTuner.forget(deviceRoot) })
+	// writeStat simulates the IOs of a deep random read workload in the last minute
+	readIOs := 0
+	writeStat := func() {
+		readIOs += 60000
+		stat := fmt.Sprintf("%d 0 %d %d 0 0 0 0 0 0 %d\n", readIOs, readIOs*8, readIOs*2, readIOs*40)
+		require.NoError(t, os.WriteFile(filepath.Join(deviceRoot, "stat"), []byte(stat), 0644))
+		if sample, ok := deviceAutoTuner.samples[deviceRoot]; ok {
+			sample.sampledAt = time.Now().Add(-time.Minute)
+		}
+	}
+	nodeInfo := &NodeInfo{SkuName: "Standard_DS14", MaxBurstIops: 51200, MaxIops: 51200, MaxBwMbps: 512, MaxBurstBwMbps: 512}
+	stateFile := filepath.Join(t.TempDir(), ".globalmount.device-settings")
+
+	// no-op for other perfProfiles
+	assert.NoError(t, deviceHelper.OptimizeDiskPerformance(nodeInfo, lunPath, "basic", "Premium_LRS", "512", "", "", nil, stateFile))
+	writeStat()
+	assert.NoError(t, deviceHelper.TuneDeviceSettings(stateFile))
+	assert.NotContains(t, deviceAutoTuner.samples, deviceRoot)
+	assert.NoError(t, deviceHelper.RestoreDeviceSettings(stateFile))
+
+	assert.NoError(t, deviceHelper.OptimizeDiskPerformance(nodeInfo, lunPath, "auto", "Premium_LRS", "512", "", "", nil, stateFile))
+	basicNrRequests := readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests")
+	assert.Equal(t, "mq-deadline", readFakeSetting(t, deviceHelper, "sdc", "queue/scheduler"))
+	assert.Equal(t, "8", readFakeSetting(t, deviceHelper, "sdc", "queue/read_ahead_kb"))
+	// sysfs lists the available schedulers
+	require.NoError(t, os.WriteFile(filepath.Join(deviceRoot, "queue/scheduler"), []byte("none [mq-deadline] kyber bfq\n"), 0644))
+
+	// the first sample is the baseline
+	writeStat()
+	assert.NoError(t, deviceHelper.TuneDeviceSettings(stateFile))
+	assert.Equal(t, basicNrRequests, readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+
+	// nr_requests follows the queue depth, the scheduler is kept until it's chosen in consecutive samples
+	writeStat()
+	assert.NoError(t, deviceHelper.TuneDeviceSettings(stateFile))
+	assert.Equal(t, "mq-deadline", readFakeSetting(t, deviceHelper, "sdc", "queue/scheduler"))
+	assert.Equal(t, "128", readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+
+	// nr_requests is capped by the tags of hardware queue without scheduler
+	writeStat()
+	assert.NoError(t, deviceHelper.TuneDeviceSettings(stateFile))
+	assert.Equal(t, "none", readFakeSetting(t, deviceHelper, "sdc", "queue/scheduler"))
+	assert.Equal(t, "64", readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+	assert.Equal(t, "8", readFakeSetting(t, deviceHelper, "sdc", "queue/read_ahead_kb"))
+
+	// the tuned settings are recorded to be reapplied and restored
+	state, err := readDeviceSettingsState(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, "auto", state.PerfProfile)
+	assert.Contains(t, state.Devices[0].Settings, deviceSetting{Path: filepath.Join(deviceRoot, "queue/scheduler"), Original: "mq-deadline", Applied: "none"})
+	assert.Contains(t, state.Devices[0].Settings, deviceSetting{Path: filepath.Join(deviceRoot, "queue/nr_requests"), Original: "256", Applied: "64"})
+
+	assert.NoError(t, deviceHelper.RestoreDeviceSettings(stateFile))
+	assert.Equal(t, "mq-deadline", readFakeSetting(t, deviceHelper, "sdc", "queue/scheduler"))
+	assert.Equal(t, "256", readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+	assert.Equal(t, "128", readFakeSetting(t, deviceHelper, "sdc", "queue/read_ahead_kb"))
+	assert.NotContains(t, deviceAutoTuner.samples, deviceRoot)
+}
+
+func TestIsSchedulerAvailable(t *testing.T) {
+	schedulerPath := filepath.Join(t.TempDir(), "scheduler")
+	require.NoError(t, os.WriteFile(schedulerPath, []byte("none [mq-deadline] kyber\n"), 0644))
+	assert.True(t, isSchedulerAvailable(schedulerPath, "none"))
+	assert.True(t, isSchedulerAvailable(schedulerPath, "mq-deadline"))
+	assert.False(t, isSchedulerAvailable(schedulerPath, "bfq"))
+	assert.False(t, isSchedulerAvailable(filepath.Join(t.TempDir(), "not-exist"), "none"))
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBlockDeviceStat(t *testing.T) {
+	stat, err := ParseBlockDeviceStat("  100  5  1600  200  50  2  800  300  3  400  500  0  0  0  0  10  20\n")
+	assert.NoError(t, err)
+	assert.Equal(t, BlockDeviceStat{ReadIOs: 100, ReadSectors: 1600, ReadTicksMs: 200, WriteIOs: 50, WriteSectors: 800, WriteTicksMs: 300, InFlight: 3, IOTicksMs: 400, TimeInQueueMs: 500}, stat)
+
+	_, err = ParseBlockDeviceStat("100 5 1600")
+	assert.Error(t, err)
+	_, err = ParseBlockDeviceStat("100 5 1600 200 50 2 800 300 0 400 abc")
+	assert.Error(t, err)
+}
+
+func TestEstimateWorkload(t *testing.T) {
+	prev := BlockDeviceStat{ReadIOs: 1000, ReadSectors: 16000, ReadTicksMs: 1000, WriteIOs: 1000, WriteSectors: 16000, WriteTicksMs: 1000, TimeInQueueMs: 1000}
+	cur := BlockDeviceStat{ReadIOs: 4000, ReadSectors: 64000, ReadTicksMs: 7000, WriteIOs: 2000, WriteSectors: 32000, WriteTicksMs: 3000, TimeInQueueMs: 41000}
+	workload, ok := estimateWorkload(prev, cur, 10*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, workloadEstimate{ios: 4000, readRatio: 0.75, avgIOSizeKb: 8, avgLatencyMs: 2, avgQueueDepth: 4}, workload)
+
+	// too few IOs
+	_, ok = estimateWorkload(prev, BlockDeviceStat{ReadIOs: 1500, WriteIOs: 1000, ReadSectors: 16000, WriteSectors: 16000, ReadTicksMs: 1000, WriteTicksMs: 1000, TimeInQueueMs: 1000}, 10*time.Second)
+	assert.False(t, ok)
+	// counters are reset, e.g. the device is attached again
+	_, ok = estimateWorkload(cur, prev, 10*time.Second)
+	assert.False(t, ok)
+	_, ok = estimateWorkload(prev, cur, 0)
+	assert.False(t, ok)
+}
+
+func TestGetAutoTuneSettings(t *testing.T) {
+	tests := []struct {
+		desc              string
+		workload          workloadEstimate
+		maxNrRequests     int
+		expectedScheduler string
+		expectedReadAhead int
+		expectedNrRequest int
+	}{
+		{
+			desc:              "deep random small IOs",
+			workload:          workloadEstimate{readRatio: 0.9, avgIOSizeKb: 4, avgQueueDepth: 60},
+			maxNrRequests:     64,
+			expectedScheduler: "none",
+			expectedReadAhead: 8,
+			expectedNrRequest: 64,
+		},
+		{
+			desc:              "sequential reads",
+			workload:          workloadEstimate{readRatio: 0.95, avgIOSizeKb: 128, avgQueueDepth: 4},
+			expectedScheduler: "",
+			expectedReadAhead: 512,
+			expectedNrRequest: 32,
+		},
+		{
+			desc:              "very large sequential reads",
+			workload:          workloadEstimate{readRatio: 1, avgIOSizeKb: 1024, avgQueueDepth: 2000},
+			expectedScheduler: "",
+			expectedReadAhead: 1024,
+			expectedNrRequest: 1024,
+		},
+		{
+			desc:              "deep mixed IOs",
+			workload:          workloadEstimate{readRatio: 0.5, avgIOSizeKb: 32, avgQueueDepth: 20},
+			expectedScheduler: "mq-deadline",
+			expectedReadAhead: 128,
+			expectedNrRequest: 64,
+		},
+		{
+			desc:              "hardware queue smaller than minimum nr_requests",
+			workload:          workloadEstimate{readRatio: 0.5, avgIOSizeKb: 32, avgQueueDepth: 1},
+			maxNrRequests:     16,
+			expectedScheduler: "",
+			expectedReadAhead: 128,
+			expectedNrRequest: 16,
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expectedScheduler, getAutoTuneScheduler(test.workload), test.desc)
+		assert.Equal(t, test.expectedReadAhead, getAutoTuneReadAheadKb(test.workload), test.desc)
+		assert.Equal(t, test.expectedNrRequest, getAutoTuneNrRequests(test.workload, test.maxNrRequests), test.desc)
+	}
+}
+
+func TestIsSignificantChange(t *testing.T) {
+	assert.False(t, isSignificantChange(128, 128))
+	assert.False(t, isSignificantChange(128, 150))
+	assert.True(t, isSignificantChange(128, 256))
+	assert.True(t, isSignificantChange(128, 8))
+	assert.True(t, isSignificantChange(0, 8))
+}
@@ -22,7 +22,10 @@ import consts "sigs.k8s.io/azuredisk-csi-driver/pkg/azureconstants"
 type Interface interface {
 	DiskSupportsPerfOptimization(diskPerfProfile, diskAccountType string) bool
 	OptimizeDiskPerformance(nodeInfo *NodeInfo,
-		devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string) error
+		devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string, stateFile string) error
+	RestoreDeviceSettings(stateFile string) error
+	ReapplyDeviceSettings(stateFile string) error
+	TuneDeviceSettings(stateFile string) error
 }
 
 // Compile-time check to ensure all Mounter DeviceHelper satisfy
@@ -45,6 +48,18 @@ func (dh *SafeDeviceHelper) DeviceSupportsPerfOptimization(diskPerfProfile, disk
 }
 
 func (dh *SafeDeviceHelper) OptimizeDiskPerformance(nodeInfo *NodeInfo,
-	devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string) error {
-	return dh.Interface.OptimizeDiskPerformance(nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx)
+	devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string, stateFile string) error {
+	return dh.Interface.OptimizeDiskPerformance(nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx, stateFile)
+}
+
+func (dh *SafeDeviceHelper) RestoreDeviceSettings(stateFile string) error {
+	return dh.Interface.RestoreDeviceSettings(stateFile)
+}
+
+func (dh *SafeDeviceHelper) ReapplyDeviceSettings(stateFile string) error {
+	return dh.Interface.ReapplyDeviceSettings(stateFile)
+}
+
+func (dh *SafeDeviceHelper) TuneDeviceSettings(stateFile string) error {
+	return dh.Interface.TuneDeviceSettings(stateFile)
 }
@@ -78,15 +78,19 @@ func isPerfTuningEnabled(profile string) bool {
 		return true
 	case consts.PerfProfileAdvanced:
 		return true
+	case consts.PerfProfileAuto:
+		return true
 	default:
 		return false
 	}
 }
 
-// accountSupportsPerfOptimization checks to see if account type supports perf optimization
+// accountSupportsPerfOptimization checks to see if account type supports perf optimization,
+// premium covers both Premium SSD and Premium SSD v2
 func accountSupportsPerfOptimization(accountType string) bool {
 	accountTypeLower := strings.ToLower(accountType)
-	if strings.HasPrefix(accountTypeLower, "premium") || strings.HasPrefix(accountTypeLower, "standardssd") {
+	if strings.HasPrefix(accountTypeLower, "premium") || strings.HasPrefix(accountTypeLower, "standardssd") ||
+		strings.HasPrefix(accountTypeLower, "ultrassd") {
 		return true
 	}
 	return false
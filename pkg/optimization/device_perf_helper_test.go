@@ -49,6 +49,11 @@ func TestIsValidPerfProfile(t *testing.T) {
 			profile: "advanced",
 			want:    true,
 		},
+		{
+			name:    "auto profile should return true",
+			profile: "Auto",
+			want:    true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -161,6 +166,11 @@ func TestIsPerfTuningEnabled(t *testing.T) {
 			profile: "advanced",
 			want:    true,
 		},
+		{
+			name:    "auto profile should return true",
+			profile: "Auto",
+			want:    true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -188,9 +198,14 @@ func TestAccountSupportsPerfOptimization(t *testing.T) {
 			want:        true,
 		},
 		{
-			name:        "UltraSSD_LRS doesn't supports optimization",
+			name:        "PremiumV2_LRS supports optimization",
+			accountType: "PremiumV2_LRS",
+			want:        true,
+		},
+		{
+			name:        "UltraSSD_LRS supports optimization",
 			accountType: "UltraSSD_LRS",
-			want:        false,
+			want:        true,
 		},
 		{
 			name:        "Standard_LRS doesn't supports optimization",
@@ -45,9 +45,10 @@ func (deviceHelper *DeviceHelper) DiskSupportsPerfOptimization(diskPerfProfile,
 	return isPerfTuningEnabled(diskPerfProfile) && accountSupportsPerfOptimization(diskAccountType)
 }
 
-// OptimizeDiskPerformance optimizes device performance by setting tuning block device settings
+// OptimizeDiskPerformance optimizes device performance by setting tuning block device settings,
+// the settings before and after tuning are recorded in stateFile if it's not empty
 func (deviceHelper *DeviceHelper) OptimizeDiskPerformance(nodeInfo *NodeInfo, devicePath,
-	perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string) (err error) {
+	perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string, stateFile string) (err error) {
 
 	if nodeInfo == nil {
 		return fmt.Errorf("OptimizeDiskPerformance: Node info is not provided. Error: invalid parameter")
@@ -61,7 +62,8 @@ func (deviceHelper *DeviceHelper) OptimizeDiskPerformance(nodeInfo *NodeInfo, de
 	var deviceSettings map[string]string
 	deviceRoot := filepath.Join(deviceHelper.blockDeviceRootPath, deviceName)
 	switch strings.ToLower(perfProfile) {
-	case consts.PerfProfileBasic:
+	case consts.PerfProfileBasic, consts.PerfProfileAuto:
+		// auto profile starts with the settings of basic profile, which are adjusted by TuneDeviceSettings later
 		deviceSettings, err = getDeviceSettingsForBasicProfile(nodeInfo,
 			deviceRoot, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
 	case consts.PerfProfileAdvanced:
@@ -80,28 +82,80 @@ func (deviceHelper *DeviceHelper) OptimizeDiskPerformance(nodeInfo *NodeInfo, de
 		perfProfile,
 		accountType,
 		deviceSettings)
-	return applyDeviceSettings(deviceRoot, deviceSettings)
+	if stateFile == "" {
+		return applyDeviceSettings(deviceRoot, deviceSettings)
+	}
+
+	if err = AreDeviceSettingsValid(deviceRoot, deviceSettings); err != nil {
+		return err
+	}
+	if err = recordOriginalDeviceSettings(stateFile, perfProfile, devicePath, deviceName, deviceSettings); err != nil {
+		return fmt.Errorf("OptimizeDiskPerformance: Failed to record settings of deviceName %s in %s. Error: %v", deviceName, stateFile, err)
+	}
+	if err = applyDeviceSettings(deviceRoot, deviceSettings); err != nil {
+		return err
+	}
+	return recordAppliedDeviceSettings(stateFile, devicePath, deviceName, deviceSettings)
 }
 
 func getDeviceSettingsForBasicProfile(nodeInfo *NodeInfo,
 	deviceRoot, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string) (deviceSettings map[string]string, err error) {
 	klog.V(2).Infof("getDeviceSettingsForBasicProfile: Getting settings for deviceRoot %s",
 		deviceRoot)
-	queueDepth, nrRequests, scheduler, maxSectorsKb, _, err := getOptimalDeviceSettings(nodeInfo, DiskSkuMap, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+	queueDepth, nrRequests, scheduler, maxSectorsKb, _, err := getOptimalDeviceSettings(nodeInfo, skuCatalog.GetDiskSkus(), perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
 	if err != nil {
 		return nil, fmt.Errorf("getDeviceSettingsForBasicProfile: Failed to get optimal settings for profile %s accountType %s. Error: %v", perfProfile, accountType, err)
 	}
 
 	deviceSettings = make(map[string]string)
-	deviceSettings[filepath.Join(deviceRoot, "queue/max_sectors_kb")] = maxSectorsKb
+	deviceSettings[filepath.Join(deviceRoot, "queue/max_sectors_kb")] = capDeviceSetting(filepath.Join(deviceRoot, "queue/max_hw_sectors_kb"), maxSectorsKb)
+	deviceSettings[filepath.Join(deviceRoot, "queue/read_ahead_kb")] = "8"
+	if isNVMeDevice(filepath.Base(deviceRoot)) {
+		// NVMe devices have no SCSI device/queue_depth, the hardware queues are deep enough and
+		// none scheduler is recommended. nr_requests can not exceed the tags of a hardware queue with none scheduler
+		deviceSettings[filepath.Join(deviceRoot, "queue/scheduler")] = "none"
+		if nrTags, err := readDeviceSetting(filepath.Join(deviceRoot, "mq/0/nr_tags")); err == nil {
+			deviceSettings[filepath.Join(deviceRoot, "queue/nr_requests")] = minDeviceSetting(nrRequests, nrTags)
+		} else {
+			klog.Warningf("getDeviceSettingsForBasicProfile: nr_requests of %s is not tuned since the tags of hardware queue are unknown: %v", deviceRoot, err)
+		}
+		return deviceSettings, nil
+	}
+
 	deviceSettings[filepath.Join(deviceRoot, "queue/scheduler")] = scheduler
 	deviceSettings[filepath.Join(deviceRoot, "device/queue_depth")] = queueDepth
 	deviceSettings[filepath.Join(deviceRoot, "queue/nr_requests")] = nrRequests
-	deviceSettings[filepath.Join(deviceRoot, "queue/read_ahead_kb")] = "8"
 
 	return deviceSettings, nil
 }
 
+// isNVMeDevice checks whether a block device is a NVMe namespace, e.g. nvme0n1
+func isNVMeDevice(deviceName string) bool {
+	return strings.HasPrefix(deviceName, "nvme")
+}
+
+// capDeviceSetting caps value by the limit in the sysfs file limitPath, e.g. queue/max_hw_sectors_kb,
+// value is returned as is if the limit could not be read
+func capDeviceSetting(limitPath, value string) string {
+	limit, err := readDeviceSetting(limitPath)
+	if err != nil {
+		return value
+	}
+	return minDeviceSetting(value, limit)
+}
+
+// minDeviceSetting returns the smaller one of two numeric settings, value is returned if limit is not a number
+func minDeviceSetting(value, limit string) string {
+	valueInt, err := strconv.Atoi(value)
+	if err != nil {
+		return value
+	}
+	if limitInt, err := strconv.Atoi(limit); err == nil && limitInt > 0 && limitInt < valueInt {
+		return limit
+	}
+	return value
+}
+
 func getDeviceSettingsForAdvancedProfile(deviceRoot string, deviceSettingsFromCtx map[string]string) (deviceSettings map[string]string, err error) {
 	klog.V(2).Infof("getDeviceSettingsForAdvancedProfile: Getting settings for deviceRoot %s deviceSettingsFromCtx %v",
 		deviceRoot,
@@ -119,7 +173,8 @@ func applyDeviceSettings(deviceRoot string, deviceSettings map[string]string) (e
 		return err
 	}
 
-	for setting, value := range deviceSettings {
+	for _, setting := range sortDeviceSettingPaths(deviceSettings) {
+		value := deviceSettings[setting]
 		err = echoToFile(value, setting)
 		if err != nil {
 			return fmt.Errorf("applyDeviceSettings: Could not set %s with value %s. Error: %v",
@@ -164,9 +219,7 @@ func getOptimalDeviceSettings(nodeInfo *NodeInfo, diskSkus map[string]map[string
 	iopsHeadRoom := .25
 	maxHwSectorsKb := 512.0
 
-	// TODO: Get matching disk SKU
-	// In future get the disk SKU using disk size ex. P10, P30 etc
-	diskSku, err := getMatchingDiskSku(diskSkus, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+	diskSku, err := getDiskSku(diskSkus, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
 
 	if err != nil || diskSku == nil {
 		return queueDepth, nrRequests, scheduler, maxSectorsKb, readAheadKb, fmt.Errorf("could not find sku for account %s size %s. Error: sku not found", accountType, diskSizeGibStr)
@@ -226,55 +279,3 @@ func getOptimalDeviceSettings(nodeInfo *NodeInfo, diskSkus map[string]map[string
 		readAheadKb)
 	return queueDepth, nrRequests, scheduler, maxSectorsKb, readAheadKb, err
 }
-
-// getMatchingDiskSku gets the smallest SKU which matches the size, io and bw requirement
-// TODO: Query the disk size (e.g. P10, P30 etc) and use that to find the sku
-func getMatchingDiskSku(diskSkus map[string]map[string]DiskSkuInfo, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string) (matchingSku *DiskSkuInfo, err error) {
-	accountTypeLower := strings.ToLower(accountType)
-	skus, ok := diskSkus[accountTypeLower]
-
-	if !ok || skus == nil || len(diskSkus[accountTypeLower]) <= 0 {
-		return nil, fmt.Errorf("could not find sku for account %s. Error: sku not found", accountType)
-	}
-
-	diskSizeGb, err := strconv.Atoi(diskSizeGibStr)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse disk size %s. Error: incorrect sku size", diskSizeGibStr)
-	}
-
-	// Treating these as non required field, as they come as part of the provisioned size
-	// If these are explicitly set then that will be used to get the best possible match
-	diskIops, err := strconv.Atoi(diskIopsStr)
-	if err != nil {
-		diskIops = 0
-	}
-	diskBwMbps, err := strconv.Atoi(diskBwMbpsStr)
-	if err != nil {
-		diskBwMbps = 0
-	}
-
-	for _, sku := range diskSkus[accountTypeLower] {
-		// Use the smallest sku size which can fulfil Size, IOs and BW requirements
-		if meetsRequest(&sku, diskSizeGb, diskIops, diskBwMbps) {
-			if matchingSku == nil || sku.MaxSizeGiB < matchingSku.MaxSizeGiB {
-				tempSku := sku
-				matchingSku = &tempSku
-			}
-		}
-	}
-
-	return matchingSku, nil
-}
-
-// meetsRequest checks to see if given SKU meets\has enough size, iops and bw limits
-func meetsRequest(sku *DiskSkuInfo, diskSizeGb, diskIops, diskBwMbps int) bool {
-	if sku == nil {
-		return false
-	}
-
-	if sku.MaxSizeGiB >= diskSizeGb && sku.MaxBwMbps >= diskBwMbps && sku.MaxIops >= diskIops {
-		return true
-	}
-
-	return false
-}
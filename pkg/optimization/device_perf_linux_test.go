@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -118,7 +120,7 @@ func Test_OptimizeDiskPerformance(t *testing.T) {
 				}
 			}
 			if deviceHelper.DiskSupportsPerfOptimization(tt.perfProfile, tt.accountType) {
-				if err := deviceHelper.OptimizeDiskPerformance(tt.nodeInfo, tt.devicePath, tt.perfProfile, tt.accountType, tt.diskSizeGibStr, tt.diskIopsStr, tt.diskBwMbpsStr, tt.volumeContext); (err != nil) != tt.wantErr {
+				if err := deviceHelper.OptimizeDiskPerformance(tt.nodeInfo, tt.devicePath, tt.perfProfile, tt.accountType, tt.diskSizeGibStr, tt.diskIopsStr, tt.diskBwMbpsStr, tt.volumeContext, ""); (err != nil) != tt.wantErr {
 					t.Errorf("DeviceHelper.OptimizeDiskPerformance() error = %v, wantErr %v", err, tt.wantErr)
 				}
 			}
@@ -176,6 +178,26 @@ func Test_getOptimalDeviceSettings(t *testing.T) {
 			wantErr:        false,
 			node:           nodeInfoNoCapabilityVM,
 		},
+		{
+			name:           "Should return valid disk perf settings for PremiumV2 disk",
+			perfProfile:    "basic",
+			accountType:    "PremiumV2_LRS",
+			DiskSizeGibStr: "512",
+			diskIopsStr:    "20000",
+			diskBwMbpsStr:  "500",
+			wantScheduler:  "mq-deadline",
+			wantErr:        false,
+			node:           nodeInfo,
+		},
+		{
+			name:           "Should return valid disk perf settings for Ultra disk without provisioned performance",
+			perfProfile:    "basic",
+			accountType:    "UltraSSD_LRS",
+			DiskSizeGibStr: "512",
+			wantScheduler:  "mq-deadline",
+			wantErr:        false,
+			node:           nodeInfo,
+		},
 		{
 			name:           "Should return error if matching disk sku is not found",
 			perfProfile:    "basic",
@@ -537,3 +559,49 @@ func Test_echoToFile(t *testing.T) {
 		})
 	}
 }
+
+func Test_getOptimalDeviceSettingsForProvisionedPerf(t *testing.T) {
+	nodeInfo := &NodeInfo{SkuName: "Standard_E32ds_v5", MaxBurstIops: 80000, MaxIops: 80000, MaxBwMbps: 1200, MaxBurstBwMbps: 1200}
+	lowQueueDepth, _, _, _, _, err := getOptimalDeviceSettings(nodeInfo, DiskSkuMap, "basic", "PremiumV2_LRS", "512", "", "")
+	assert.NoError(t, err)
+	highQueueDepth, _, _, maxSectorsKb, _, err := getOptimalDeviceSettings(nodeInfo, DiskSkuMap, "basic", "PremiumV2_LRS", "512", "80000", "1200")
+	assert.NoError(t, err)
+	// the queue depth grows with the provisioned performance
+	low, _ := strconv.Atoi(lowQueueDepth)
+	high, _ := strconv.Atoi(highQueueDepth)
+	assert.Greater(t, high, low)
+	assert.NotEmpty(t, maxSectorsKb)
+
+	_, _, _, _, _, err = getOptimalDeviceSettings(nodeInfo, DiskSkuMap, "basic", "UltraSSD_LRS", "512", "invalid", "")
+	assert.Error(t, err)
+}
+
+func Test_getDeviceSettingsForBasicProfileOfNVMe(t *testing.T) {
+	nodeInfo := &NodeInfo{SkuName: "Standard_E32ds_v5", MaxBurstIops: 80000, MaxIops: 80000, MaxBwMbps: 1200, MaxBurstBwMbps: 1200}
+	for _, deviceName := range []string{"nvme0n2", "sdc"} {
+		deviceRoot := filepath.Join(t.TempDir(), deviceName)
+		for file, value := range map[string]string{"queue/max_hw_sectors_kb": "16\n", "mq/0/nr_tags": "8\n"} {
+			require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(deviceRoot, file)), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(deviceRoot, file), []byte(value), 0644))
+		}
+
+		deviceSettings, err := getDeviceSettingsForBasicProfile(nodeInfo, deviceRoot, "basic", "PremiumV2_LRS", "512", "80000", "1200")
+		assert.NoError(t, err)
+		assert.Equal(t, "16", deviceSettings[filepath.Join(deviceRoot, "queue/max_sectors_kb")])
+		if deviceName == "sdc" {
+			assert.Equal(t, "mq-deadline", deviceSettings[filepath.Join(deviceRoot, "queue/scheduler")])
+			assert.Contains(t, deviceSettings, filepath.Join(deviceRoot, "device/queue_depth"))
+			continue
+		}
+		assert.Equal(t, "none", deviceSettings[filepath.Join(deviceRoot, "queue/scheduler")])
+		assert.Equal(t, "8", deviceSettings[filepath.Join(deviceRoot, "queue/nr_requests")])
+		assert.NotContains(t, deviceSettings, filepath.Join(deviceRoot, "device/queue_depth"))
+	}
+
+	// nr_requests is not tuned if the tags of hardware queue are unknown
+	deviceRoot := filepath.Join(t.TempDir(), "nvme0n3")
+	deviceSettings, err := getDeviceSettingsForBasicProfile(nodeInfo, deviceRoot, "basic", "PremiumV2_LRS", "512", "", "")
+	assert.NoError(t, err)
+	assert.NotContains(t, deviceSettings, filepath.Join(deviceRoot, "queue/nr_requests"))
+	assert.Len(t, deviceSettings, 3)
+}
@@ -36,11 +36,17 @@ func TestSafeDeviceHelper_DeviceSupportsPerfOptimization(t *testing.T) {
 			want:            false,
 		},
 		{
-			name:            "ultrassd_lrs account should return false",
+			name:            "standard_lrs account should return false",
 			diskPerfProfile: "basic",
-			diskAccountType: "ultrassd_lrs",
+			diskAccountType: "standard_lrs",
 			want:            false,
 		},
+		{
+			name:            "ultrassd_lrs account should return true",
+			diskPerfProfile: "basic",
+			diskAccountType: "ultrassd_lrs",
+			want:            util.IsLinuxOS(),
+		},
 		{
 			name:            "invalid account type should return false",
 			diskPerfProfile: "blah",
@@ -137,7 +143,7 @@ func TestDeviceHelper_OptimizeDiskPerformance(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if deviceHelper.DiskSupportsPerfOptimization(tt.perfProfile, tt.accountType) {
-				if err := deviceHelper.OptimizeDiskPerformance(tt.nodeInfo, tt.devicePath, tt.perfProfile, tt.accountType, tt.diskSizeGibStr, tt.diskIopsStr, tt.diskBwMbpsStr, nil); (err != nil) != tt.wantErr {
+				if err := deviceHelper.OptimizeDiskPerformance(tt.nodeInfo, tt.devicePath, tt.perfProfile, tt.accountType, tt.diskSizeGibStr, tt.diskIopsStr, tt.diskBwMbpsStr, nil, ""); (err != nil) != tt.wantErr {
 					t.Errorf("DeviceHelper.OptimizeDiskPerformance() error = %v, wantErr %v", err, tt.wantErr)
 				}
 			}
@@ -31,6 +31,19 @@ func (deviceHelper *DeviceHelper) DiskSupportsPerfOptimization(diskPerfProfile,
 }
 
 func (deviceHelper *DeviceHelper) OptimizeDiskPerformance(nodeInfo *NodeInfo,
-	devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string) (err error) {
+	devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string, stateFile string) (err error) {
 	return fmt.Errorf("OptimizeDiskPerformance not implemented")
 }
+
+func (deviceHelper *DeviceHelper) RestoreDeviceSettings(stateFile string) error {
+	// no device is tuned on unsupported platforms
+	return nil
+}
+
+func (deviceHelper *DeviceHelper) ReapplyDeviceSettings(stateFile string) error {
+	return nil
+}
+
+func (deviceHelper *DeviceHelper) TuneDeviceSettings(stateFile string) error {
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// deviceSettingsState is persisted in the state file passed to OptimizeDiskPerformance,
+// it records the block device settings before and after tuning of each device of a volume
+type deviceSettingsState struct {
+	// PerfProfile is the lower case perfProfile the devices are tuned with
+	PerfProfile string                   `json:"perfProfile,omitempty"`
+	Devices     []deviceSettingsOfDevice `json:"devices"`
+}
+
+// deviceSettingsOfDevice records the tuned settings of a device, DevicePath is the lun path of the device
+// which is resolved again to make sure DeviceName still refers to the same disk before settings are changed
+type deviceSettingsOfDevice struct {
+	DevicePath string          `json:"devicePath"`
+	DeviceName string          `json:"deviceName"`
+	Settings   []deviceSetting `json:"settings"`
+}
+
+// deviceSetting is a sysfs setting file, an empty Original means the value could not be read and is not restored
+type deviceSetting struct {
+	Path     string `json:"path"`
+	Original string `json:"original"`
+	Applied  string `json:"applied"`
+}
+
+// readDeviceSettingsState reads the state file, nil is returned if it does not exist
+func readDeviceSettingsState(stateFile string) (*deviceSettingsState, error) {
+	content, err := os.ReadFile(stateFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	state := &deviceSettingsState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// writeDeviceSettingsState writes the state file, the file is replaced atomically
+func writeDeviceSettingsState(stateFile string, state *deviceSettingsState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0750); err != nil {
+		return err
+	}
+	tmpFile := stateFile + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, stateFile)
+}
+
+// getDevice returns the settings of a device in the state, a new entry is added if the device is not recorded yet
+// or the recorded entry refers to another device name, e.g. the lun is reused by another disk
+func (state *deviceSettingsState) getDevice(devicePath, deviceName string) *deviceSettingsOfDevice {
+	for i := range state.Devices {
+		if state.Devices[i].DevicePath == devicePath {
+			if state.Devices[i].DeviceName != deviceName {
+				state.Devices[i] = deviceSettingsOfDevice{DevicePath: devicePath, DeviceName: deviceName}
+			}
+			return &state.Devices[i]
+		}
+	}
+	state.Devices = append(state.Devices, deviceSettingsOfDevice{DevicePath: devicePath, DeviceName: deviceName})
+	return &state.Devices[len(state.Devices)-1]
+}
+
+// setSetting records the applied value of a setting, original is only recorded the first time a setting is tuned
+// so that the value before the first NodeStageVolume is restored
+func (device *deviceSettingsOfDevice) setSetting(path, original, applied string) {
+	for i := range device.Settings {
+		if device.Settings[i].Path == path {
+			device.Settings[i].Applied = applied
+			return
+		}
+	}
+	device.Settings = append(device.Settings, deviceSetting{Path: path, Original: original, Applied: applied})
+	sort.Slice(device.Settings, func(i, j int) bool { return deviceSettingPathLess(device.Settings[i].Path, device.Settings[j].Path) })
+}
+
+// deviceSettingPathLess orders the setting files of a device, queue/scheduler goes first
+// since switching the scheduler resets queue/nr_requests
+func deviceSettingPathLess(a, b string) bool {
+	aScheduler, bScheduler := filepath.Base(a) == "scheduler", filepath.Base(b) == "scheduler"
+	if aScheduler != bScheduler {
+		return aScheduler
+	}
+	return a < b
+}
+
+// sortDeviceSettingPaths returns the setting files in deviceSettings in the order they are applied
+func sortDeviceSettingPaths(deviceSettings map[string]string) []string {
+	paths := make([]string, 0, len(deviceSettings))
+	for path := range deviceSettings {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool { return deviceSettingPathLess(paths[i], paths[j]) })
+	return paths
+}
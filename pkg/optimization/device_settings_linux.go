@@ -0,0 +1,173 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// readDeviceSetting reads the value of a sysfs setting file, the selected entry is returned for
+// a file listing the available values, e.g. "none [mq-deadline] kyber" of queue/scheduler
+func readDeviceSetting(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(content))
+	if start := strings.Index(value, "["); start >= 0 {
+		if end := strings.Index(value[start:], "]"); end > 0 {
+			return value[start+1 : start+end], nil
+		}
+	}
+	return value, nil
+}
+
+// recordOriginalDeviceSettings records the current values of deviceSettings in stateFile before they are changed
+func recordOriginalDeviceSettings(stateFile, perfProfile, devicePath, deviceName string, deviceSettings map[string]string) error {
+	state, err := readDeviceSettingsState(stateFile)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &deviceSettingsState{}
+	}
+	state.PerfProfile = strings.ToLower(perfProfile)
+	device := state.getDevice(devicePath, deviceName)
+	for path, value := range deviceSettings {
+		original, err := readDeviceSetting(path)
+		if err != nil {
+			klog.Warningf("recordOriginalDeviceSettings: failed to read %s, it will not be restored: %v", path, err)
+		}
+		device.setSetting(path, original, value)
+	}
+	return writeDeviceSettingsState(stateFile, state)
+}
+
+// recordAppliedDeviceSettings records the values of deviceSettings read back after they are applied,
+// since the kernel may adjust a value written to sysfs, e.g. nr_requests is capped by the queue depth
+func recordAppliedDeviceSettings(stateFile, devicePath, deviceName string, deviceSettings map[string]string) error {
+	state, err := readDeviceSettingsState(stateFile)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("%s does not exist", stateFile)
+	}
+	device := state.getDevice(devicePath, deviceName)
+	for path := range deviceSettings {
+		if applied, err := readDeviceSetting(path); err == nil {
+			device.setSetting(path, "", applied)
+		}
+	}
+	return writeDeviceSettingsState(stateFile, state)
+}
+
+// isSameDevice checks the lun path of a recorded device still refers to the recorded device name
+func isSameDevice(device *deviceSettingsOfDevice) bool {
+	deviceName, err := getDeviceName(device.DevicePath)
+	if err != nil {
+		klog.Warningf("isSameDevice: could not get device name of %s: %v", device.DevicePath, err)
+		return false
+	}
+	if deviceName != device.DeviceName {
+		klog.Warningf("isSameDevice: %s refers to %s instead of %s now", device.DevicePath, deviceName, device.DeviceName)
+		return false
+	}
+	return true
+}
+
+// RestoreDeviceSettings restores the block device settings recorded in stateFile by OptimizeDiskPerformance
+// and removes stateFile, it's a no-op if stateFile does not exist
+func (deviceHelper *DeviceHelper) RestoreDeviceSettings(stateFile string) error {
+	state, err := readDeviceSettingsState(stateFile)
+	if err != nil {
+		return fmt.Errorf("RestoreDeviceSettings: failed to read %s. Error: %v", stateFile, err)
+	}
+	if state == nil {
+		return nil
+	}
+
+	var errs []error
+	for i := range state.Devices {
+		device := &state.Devices[i]
+		deviceAutoTuner.forget(filepath.Join(deviceHelper.blockDeviceRootPath, device.DeviceName))
+		if !isSameDevice(device) {
+			continue
+		}
+		// settings are restored in the order they are applied, the scheduler first
+		for _, setting := range device.Settings {
+			if setting.Original == "" || setting.Original == setting.Applied {
+				continue
+			}
+			if err := echoToFile(setting.Original, setting.Path); err != nil {
+				errs = append(errs, fmt.Errorf("could not restore %s with value %s. Error: %v", setting.Path, setting.Original, err))
+				continue
+			}
+			klog.V(2).Infof("RestoreDeviceSettings: restored %s of %s to %s", setting.Path, device.DevicePath, setting.Original)
+		}
+	}
+
+	// the state file is removed even if a setting could not be restored, otherwise it would be restored on a reused lun
+	if err := os.Remove(stateFile); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// ReapplyDeviceSettings checks the block device settings recorded in stateFile by OptimizeDiskPerformance
+// and applies them again if they are reset, e.g. by udev rules after a device rescan
+func (deviceHelper *DeviceHelper) ReapplyDeviceSettings(stateFile string) error {
+	state, err := readDeviceSettingsState(stateFile)
+	if err != nil {
+		return fmt.Errorf("ReapplyDeviceSettings: failed to read %s. Error: %v", stateFile, err)
+	}
+	if state == nil {
+		return nil
+	}
+
+	var errs []error
+	for i := range state.Devices {
+		device := &state.Devices[i]
+		if !isSameDevice(device) {
+			continue
+		}
+		for _, setting := range device.Settings {
+			current, err := readDeviceSetting(setting.Path)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if current == setting.Applied {
+				continue
+			}
+			klog.V(2).Infof("ReapplyDeviceSettings: %s of %s is reset from %s to %s, applying it again", setting.Path, device.DevicePath, setting.Applied, current)
+			if err := echoToFile(setting.Applied, setting.Path); err != nil {
+				errs = append(errs, fmt.Errorf("could not set %s with value %s. Error: %v", setting.Path, setting.Applied, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupFakeBlockDevice creates a fake sysfs block device sdc with a lun path refering to it,
+// the lun path is returned
+func setupFakeBlockDevice(t *testing.T, deviceHelper *DeviceHelper) string {
+	root := t.TempDir()
+	deviceHelper.blockDeviceRootPath = filepath.Join(root, "sys", "block")
+	for _, deviceName := range []string{"sdc", "sdd"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "dev"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, "dev", deviceName), []byte{}, 0644))
+		for file, value := range map[string]string{
+			"queue/scheduler":    "none [mq-deadline] kyber bfq\n",
+			"queue/nr_requests":  "256\n",
+			"device/queue_depth": "254\n",
+		} {
+			require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(deviceHelper.blockDeviceRootPath, deviceName, file)), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(deviceHelper.blockDeviceRootPath, deviceName, file), []byte(value), 0644))
+		}
+	}
+	lunPath := filepath.Join(root, "lun0")
+	require.NoError(t, os.Symlink(filepath.Join(root, "dev", "sdc"), lunPath))
+	return lunPath
+}
+
+func readFakeSetting(t *testing.T, deviceHelper *DeviceHelper, deviceName, setting string) string {
+	value, err := readDeviceSetting(filepath.Join(deviceHelper.blockDeviceRootPath, deviceName, setting))
+	require.NoError(t, err)
+	return value
+}
+
+func TestReadDeviceSetting(t *testing.T) {
+	dir := t.TempDir()
+	for content, expected := range map[string]string{
+		"none [mq-deadline] kyber bfq\n": "mq-deadline",
+		"[none] mq-deadline\n":           "none",
+		"128\n":                          "128",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "setting"), []byte(content), 0644))
+		value, err := readDeviceSetting(filepath.Join(dir, "setting"))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+	_, err := readDeviceSetting(filepath.Join(dir, "not-exist"))
+	assert.Error(t, err)
+}
+
+func TestRestoreAndReapplyDeviceSettings(t *testing.T) {
+	deviceHelper := NewDeviceHelper()
+	lunPath := setupFakeBlockDevice(t, deviceHelper)
+	stateFile := filepath.Join(t.TempDir(), ".globalmount.device-settings")
+	settings := map[string]string{"queue/scheduler": "none", "queue/nr_requests": "64", "device/queue_depth": "32"}
+
+	assert.NoError(t, deviceHelper.OptimizeDiskPerformance(&NodeInfo{}, lunPath, "advanced", "Premium_LRS", "", "", "", settings, stateFile))
+	assert.Equal(t, "none", readFakeSetting(t, deviceHelper, "sdc", "queue/scheduler"))
+	assert.Equal(t, "64", readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+	assert.FileExists(t, stateFile)
+
+	// settings reset by udev are applied again
+	require.NoError(t, os.WriteFile(filepath.Join(deviceHelper.blockDeviceRootPath, "sdc", "queue/scheduler"), []byte("none [mq-deadline] kyber bfq\n"), 0644))
+	assert.NoError(t, deviceHelper.ReapplyDeviceSettings(stateFile))
+	assert.Equal(t, "none", readFakeSetting(t, deviceHelper, "sdc", "queue/scheduler"))
+
+	// staging the volume again keeps the original values
+	assert.NoError(t, deviceHelper.OptimizeDiskPerformance(&NodeInfo{}, lunPath, "advanced", "Premium_LRS", "", "", "", map[string]string{"queue/nr_requests": "128"}, stateFile))
+	assert.Equal(t, "128", readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+
+	assert.NoError(t, deviceHelper.RestoreDeviceSettings(stateFile))
+	assert.Equal(t, "mq-deadline", readFakeSetting(t, deviceHelper, "sdc", "queue/scheduler"))
+	assert.Equal(t, "256", readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+	assert.Equal(t, "254", readFakeSetting(t, deviceHelper, "sdc", "device/queue_depth"))
+	assert.NoFileExists(t, stateFile)
+
+	// no-op without state file
+	assert.NoError(t, deviceHelper.RestoreDeviceSettings(stateFile))
+	assert.NoError(t, deviceHelper.ReapplyDeviceSettings(stateFile))
+}
+
+func TestRestoreDeviceSettingsOfChangedDevice(t *testing.T) {
+	deviceHelper := NewDeviceHelper()
+	lunPath := setupFakeBlockDevice(t, deviceHelper)
+	stateFile := filepath.Join(t.TempDir(), ".globalmount.device-settings")
+	assert.NoError(t, deviceHelper.OptimizeDiskPerformance(&NodeInfo{}, lunPath, "advanced", "Premium_LRS", "", "", "", map[string]string{"queue/nr_requests": "64"}, stateFile))
+
+	// the lun refers to another device after a rescan, settings of the recorded device are left untouched
+	require.NoError(t, os.Remove(lunPath))
+	require.NoError(t, os.Symlink(filepath.Join(filepath.Dir(lunPath), "dev", "sdd"), lunPath))
+	assert.NoError(t, deviceHelper.ReapplyDeviceSettings(stateFile))
+	assert.NoError(t, deviceHelper.RestoreDeviceSettings(stateFile))
+	assert.Equal(t, "64", readFakeSetting(t, deviceHelper, "sdc", "queue/nr_requests"))
+	assert.Equal(t, "256", readFakeSetting(t, deviceHelper, "sdd", "queue/nr_requests"))
+	assert.NoFileExists(t, stateFile)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceSettingsState(t *testing.T) {
+	state := &deviceSettingsState{}
+	device := state.getDevice("/dev/disk/azure/scsi1/lun0", "sdc")
+	device.setSetting("/sys/block/sdc/queue/scheduler", "none", "mq-deadline")
+	device.setSetting("/sys/block/sdc/queue/nr_requests", "256", "64")
+	// original value is only recorded the first time
+	device.setSetting("/sys/block/sdc/queue/nr_requests", "64", "32")
+	// the scheduler goes first
+	assert.Equal(t, []deviceSetting{
+		{Path: "/sys/block/sdc/queue/scheduler", Original: "none", Applied: "mq-deadline"},
+		{Path: "/sys/block/sdc/queue/nr_requests", Original: "256", Applied: "32"},
+	}, state.Devices[0].Settings)
+
+	// the same device is returned
+	assert.Len(t, state.getDevice("/dev/disk/azure/scsi1/lun0", "sdc").Settings, 2)
+	// the lun refers to another device
+	assert.Empty(t, state.getDevice("/dev/disk/azure/scsi1/lun0", "sdd").Settings)
+	state.getDevice("/dev/disk/azure/scsi1/lun1", "sde")
+	assert.Len(t, state.Devices, 2)
+}
+
+func TestReadWriteDeviceSettingsState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "staging", ".globalmount.device-settings")
+	state, err := readDeviceSettingsState(stateFile)
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	expected := &deviceSettingsState{Devices: []deviceSettingsOfDevice{{DevicePath: "/dev/disk/azure/scsi1/lun0", DeviceName: "sdc",
+		Settings: []deviceSetting{{Path: "/sys/block/sdc/queue/scheduler", Original: "none", Applied: "mq-deadline"}}}}}
+	assert.NoError(t, writeDeviceSettingsState(stateFile, expected))
+	state, err = readDeviceSettingsState(stateFile)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, state)
+
+	assert.NoError(t, os.WriteFile(stateFile, []byte("{invalid"), 0600))
+	_, err = readDeviceSettingsState(stateFile)
+	assert.Error(t, err)
+}
+
+func TestSortDeviceSettingPaths(t *testing.T) {
+	assert.Equal(t, []string{"/sys/block/sdc/queue/scheduler", "/sys/block/sdc/device/queue_depth", "/sys/block/sdc/queue/nr_requests", "/sys/block/sdc/queue/read_ahead_kb"},
+		sortDeviceSettingPaths(map[string]string{
+			"/sys/block/sdc/queue/read_ahead_kb": "8",
+			"/sys/block/sdc/queue/nr_requests":   "64",
+			"/sys/block/sdc/device/queue_depth":  "64",
+			"/sys/block/sdc/queue/scheduler":     "mq-deadline",
+		}))
+}
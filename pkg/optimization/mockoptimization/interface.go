@@ -65,15 +65,57 @@ func (mr *MockInterfaceMockRecorder) DiskSupportsPerfOptimization(diskPerfProfil
 }
 
 // OptimizeDiskPerformance mocks base method.
-func (m *MockInterface) OptimizeDiskPerformance(nodeInfo *optimization.NodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string) error {
+func (m *MockInterface) OptimizeDiskPerformance(nodeInfo *optimization.NodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string, deviceSettingsFromCtx map[string]string, stateFile string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "OptimizeDiskPerformance", nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx)
+	ret := m.ctrl.Call(m, "OptimizeDiskPerformance", nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx, stateFile)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // OptimizeDiskPerformance indicates an expected call of OptimizeDiskPerformance.
-func (mr *MockInterfaceMockRecorder) OptimizeDiskPerformance(nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx interface{}) *gomock.Call {
+func (mr *MockInterfaceMockRecorder) OptimizeDiskPerformance(nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx, stateFile interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OptimizeDiskPerformance", reflect.TypeOf((*MockInterface)(nil).OptimizeDiskPerformance), nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OptimizeDiskPerformance", reflect.TypeOf((*MockInterface)(nil).OptimizeDiskPerformance), nodeInfo, devicePath, perfProfile, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr, deviceSettingsFromCtx, stateFile)
+}
+
+// ReapplyDeviceSettings mocks base method.
+func (m *MockInterface) ReapplyDeviceSettings(stateFile string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReapplyDeviceSettings", stateFile)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReapplyDeviceSettings indicates an expected call of ReapplyDeviceSettings.
+func (mr *MockInterfaceMockRecorder) ReapplyDeviceSettings(stateFile interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReapplyDeviceSettings", reflect.TypeOf((*MockInterface)(nil).ReapplyDeviceSettings), stateFile)
+}
+
+// RestoreDeviceSettings mocks base method.
+func (m *MockInterface) RestoreDeviceSettings(stateFile string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RestoreDeviceSettings", stateFile)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RestoreDeviceSettings indicates an expected call of RestoreDeviceSettings.
+func (mr *MockInterfaceMockRecorder) RestoreDeviceSettings(stateFile interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreDeviceSettings", reflect.TypeOf((*MockInterface)(nil).RestoreDeviceSettings), stateFile)
+}
+
+// TuneDeviceSettings mocks base method.
+func (m *MockInterface) TuneDeviceSettings(stateFile string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TuneDeviceSettings", stateFile)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// TuneDeviceSettings indicates an expected call of TuneDeviceSettings.
+func (mr *MockInterfaceMockRecorder) TuneDeviceSettings(stateFile interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TuneDeviceSettings", reflect.TypeOf((*MockInterface)(nil).TuneDeviceSettings), stateFile)
 }
@@ -0,0 +1,397 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	maxValueOfMaxSharesCapability        = "maxvalueofmaxshares"
+	maxBurstIopsCapability               = "maxburstiops"
+	maxIOpsCapability                    = "maxiops"
+	maxBandwidthMBpsCapability           = "maxbandwidthmbps"
+	maxBurstBandwidthMBpsCapability      = "maxburstbandwidthmbps"
+	maxSizeGiBCapability                 = "maxsizegib"
+	uncachedDiskIOPSCapability           = "uncacheddiskiops"
+	uncachedDiskBytesPerSecondCapability = "uncacheddiskbytespersecond"
+	maxDataDiskCountCapability           = "maxdatadiskcount"
+	vCPUsCapability                      = "vcpus"
+
+	resourceTypeDisks           = "disks"
+	resourceTypeVirtualMachines = "virtualmachines"
+)
+
+// skuCatalog is the catalog used by NewNodeInfo, GetProvisionedDiskPerf and device settings optimization,
+// it only contains the embedded maps until LoadSkuCatalog is called
+var skuCatalog = NewSkuCatalog()
+
+// ResourceSKULister lists the resource SKUs available in a location
+type ResourceSKULister interface {
+	List(ctx context.Context, location string) ([]*armcompute.ResourceSKU, error)
+}
+
+// SkuCatalogConfig configures the sources of the SKU catalog
+type SkuCatalogConfig struct {
+	// Location filters the SKUs listed from the Resource SKUs API
+	Location string
+	// CacheFile caches the SKUs listed from the Resource SKUs API, empty means no cache
+	CacheFile string
+	// CacheTTL is the duration in which the cache file is used without calling the Resource SKUs API
+	CacheTTL time.Duration
+	// OverrideFile is an operator-provided file of SKUs in the format of `az vm list-skus -o json`, JSON or YAML
+	OverrideFile string
+}
+
+// SkuCatalog serves VM and disk SKU information, the SKUs loaded from the Resource SKUs API, the on-disk cache
+// and the override file take precedence over the embedded NodeInfoMap and DiskSkuMap
+type SkuCatalog struct {
+	lock     sync.RWMutex
+	vmSkus   map[string]NodeInfo
+	diskSkus map[string]map[string]DiskSkuInfo
+}
+
+// NewSkuCatalog returns a SKU catalog which only contains the embedded maps
+func NewSkuCatalog() *SkuCatalog {
+	return &SkuCatalog{
+		vmSkus:   map[string]NodeInfo{},
+		diskSkus: map[string]map[string]DiskSkuInfo{},
+	}
+}
+
+// GetSkuCatalog returns the SKU catalog in use
+func GetSkuCatalog() *SkuCatalog {
+	return skuCatalog
+}
+
+// LoadSkuCatalog loads the SKU catalog in use from the Resource SKUs API, the cache file and the override file.
+// Failures of a source are logged and the next source is used, lister could be nil if the API should not be called.
+func LoadSkuCatalog(ctx context.Context, lister ResourceSKULister, config SkuCatalogConfig) {
+	skuCatalog.Load(ctx, lister, config)
+}
+
+// Load replaces the dynamic SKUs of the catalog with the SKUs from the Resource SKUs API, or the cache file if it's
+// still fresh or the API call fails, and then applies the override file on top
+func (c *SkuCatalog) Load(ctx context.Context, lister ResourceSKULister, config SkuCatalogConfig) {
+	catalog := NewSkuCatalog()
+	if skus, err := listResourceSkus(ctx, lister, config); err != nil {
+		klog.Warningf("SkuCatalog: failed to load SKUs from the Resource SKUs API or cache file, falling back to the embedded SKU maps: %v", err)
+	} else {
+		catalog.add(skus, "resource SKUs")
+	}
+
+	if config.OverrideFile != "" {
+		if skus, err := readResourceSkus(config.OverrideFile); err != nil {
+			klog.Errorf("SkuCatalog: failed to read SKU override file %s: %v", config.OverrideFile, err)
+		} else {
+			catalog.add(skus, config.OverrideFile)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.vmSkus = catalog.vmSkus
+	c.diskSkus = catalog.diskSkus
+	klog.V(2).Infof("SkuCatalog: loaded %d VM SKUs and %d disk SKU families", len(c.vmSkus), len(c.diskSkus))
+}
+
+// GetVMSku returns the information of a VM size, case insensitive
+func (c *SkuCatalog) GetVMSku(vmSize string) (NodeInfo, bool) {
+	vmSizeLower := strings.ToLower(vmSize)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if vmSku, ok := c.vmSkus[vmSizeLower]; ok {
+		return vmSku, true
+	}
+	vmSku, ok := NodeInfoMap[vmSizeLower]
+	return vmSku, ok
+}
+
+// GetLoadedVMSku returns the information of a VM size loaded from the Resource SKUs API, the cache file or the
+// override file, the embedded NodeInfoMap is not used
+func (c *SkuCatalog) GetLoadedVMSku(vmSize string) (NodeInfo, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	vmSku, ok := c.vmSkus[strings.ToLower(vmSize)]
+	return vmSku, ok
+}
+
+// GetDiskSkus returns the disk SKUs keyed by lower case account type and disk size, e.g. premium_lrs and p10,
+// the returned map must not be modified
+func (c *SkuCatalog) GetDiskSkus() map[string]map[string]DiskSkuInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.diskSkus) == 0 {
+		return DiskSkuMap
+	}
+	diskSkus := make(map[string]map[string]DiskSkuInfo, len(DiskSkuMap)+len(c.diskSkus))
+	for account, sizes := range DiskSkuMap {
+		diskSkus[account] = sizes
+	}
+	for account, sizes := range c.diskSkus {
+		merged := make(map[string]DiskSkuInfo, len(DiskSkuMap[account])+len(sizes))
+		for size, sku := range DiskSkuMap[account] {
+			merged[size] = sku
+		}
+		for size, sku := range sizes {
+			merged[size] = sku
+		}
+		diskSkus[account] = merged
+	}
+	return diskSkus
+}
+
+// add adds the VM and disk SKUs in skus to the catalog, the SKUs which could not be parsed are skipped
+func (c *SkuCatalog) add(skus []*armcompute.ResourceSKU, source string) {
+	// the same SKU is listed once per location, only the first one is used
+	added := map[string]bool{}
+	for _, sku := range skus {
+		if sku == nil || sku.ResourceType == nil || sku.Name == nil {
+			continue
+		}
+		switch strings.ToLower(*sku.ResourceType) {
+		case resourceTypeDisks:
+			if sku.Size == nil {
+				continue
+			}
+			account, diskSize := strings.ToLower(*sku.Name), strings.ToLower(*sku.Size)
+			if added[account+"/"+diskSize] {
+				continue
+			}
+			diskSku, err := NewDiskSkuInfo(sku)
+			if err != nil {
+				klog.Warningf("SkuCatalog: skip disk SKU %s %s in %s: %v", *sku.Name, *sku.Size, source, err)
+				continue
+			}
+			if _, ok := c.diskSkus[account]; !ok {
+				c.diskSkus[account] = map[string]DiskSkuInfo{}
+			}
+			c.diskSkus[account][diskSize] = diskSku
+			added[account+"/"+diskSize] = true
+		case resourceTypeVirtualMachines:
+			vmSize := strings.ToLower(*sku.Name)
+			if added[vmSize] {
+				continue
+			}
+			vmSku, err := NewNodeInfoFromResourceSku(sku)
+			if err != nil {
+				klog.Warningf("SkuCatalog: skip VM SKU %s in %s: %v", *sku.Name, source, err)
+				continue
+			}
+			c.vmSkus[vmSize] = vmSku
+			added[vmSize] = true
+		}
+	}
+}
+
+// listResourceSkus lists the resource SKUs from the cache file if it's fresh, otherwise from the Resource SKUs API
+// and writes them to the cache file, a stale cache file is used if the API call fails
+func listResourceSkus(ctx context.Context, lister ResourceSKULister, config SkuCatalogConfig) ([]*armcompute.ResourceSKU, error) {
+	if config.CacheFile != "" {
+		if info, err := os.Stat(config.CacheFile); err == nil && time.Since(info.ModTime()) < config.CacheTTL {
+			skus, err := readResourceSkus(config.CacheFile)
+			if err == nil {
+				klog.V(2).Infof("SkuCatalog: using cached SKUs in %s", config.CacheFile)
+				return skus, nil
+			}
+			klog.Warningf("SkuCatalog: failed to read cache file %s: %v", config.CacheFile, err)
+		}
+	}
+
+	if lister == nil {
+		if config.CacheFile == "" {
+			return nil, fmt.Errorf("neither Resource SKUs API nor cache file is available")
+		}
+		return readResourceSkus(config.CacheFile)
+	}
+
+	skus, err := lister.List(ctx, config.Location)
+	if err != nil {
+		if config.CacheFile == "" {
+			return nil, err
+		}
+		klog.Warningf("SkuCatalog: failed to list SKUs in location %s, using stale cache file %s: %v", config.Location, config.CacheFile, err)
+		return readResourceSkus(config.CacheFile)
+	}
+
+	if config.CacheFile != "" {
+		if err := writeResourceSkus(config.CacheFile, skus); err != nil {
+			klog.Warningf("SkuCatalog: failed to write cache file %s: %v", config.CacheFile, err)
+		}
+	}
+	return skus, nil
+}
+
+// readResourceSkus reads resource SKUs from a JSON or YAML file
+func readResourceSkus(path string) ([]*armcompute.ResourceSKU, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err = yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	var skus []*armcompute.ResourceSKU
+	if err := json.Unmarshal(content, &skus); err != nil {
+		return nil, err
+	}
+	return skus, nil
+}
+
+// writeResourceSkus writes resource SKUs to a JSON file, the file is replaced atomically
+func writeResourceSkus(path string, skus []*armcompute.ResourceSKU) error {
+	content, err := json.Marshal(skus)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
+
+// NewNodeInfoFromResourceSku returns the VM information of a virtualMachines resource SKU
+func NewNodeInfoFromResourceSku(sku *armcompute.ResourceSKU) (nodeInfo NodeInfo, err error) {
+	if sku.Name != nil {
+		nodeInfo.SkuName = *sku.Name
+	}
+	for _, capability := range sku.Capabilities {
+		if capability == nil || capability.Name == nil || capability.Value == nil {
+			continue
+		}
+		switch strings.ToLower(*capability.Name) {
+		case uncachedDiskIOPSCapability:
+			nodeInfo.MaxIops, err = strconv.Atoi(*capability.Value)
+		case uncachedDiskBytesPerSecondCapability:
+			var bw int
+			bw, err = strconv.Atoi(*capability.Value)
+			nodeInfo.MaxBwMbps = bw / (1024 * 1024)
+		case maxDataDiskCountCapability:
+			nodeInfo.MaxDataDiskCount, err = strconv.Atoi(*capability.Value)
+		case vCPUsCapability:
+			nodeInfo.VCpus, err = strconv.Atoi(*capability.Value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nodeInfo, fmt.Errorf("failed to parse node capability %s. Error: %v", *capability.Name, err)
+		}
+	}
+
+	// If node doesn't support burst capabilities.
+	// Set the burst limits as regular limits
+	if nodeInfo.MaxBurstIops < nodeInfo.MaxIops {
+		nodeInfo.MaxBurstIops = nodeInfo.MaxIops
+	}
+	if nodeInfo.MaxBurstBwMbps < nodeInfo.MaxBwMbps {
+		nodeInfo.MaxBurstBwMbps = nodeInfo.MaxBwMbps
+	}
+	return nodeInfo, nil
+}
+
+// NewDiskSkuInfo returns the disk SKU information of a disks resource SKU
+func NewDiskSkuInfo(sku *armcompute.ResourceSKU) (diskSku DiskSkuInfo, err error) {
+	if sku.Name != nil {
+		diskSku.StorageAccountType = *sku.Name
+	}
+	if sku.Tier != nil {
+		diskSku.StorageTier = *sku.Tier
+	}
+	if sku.Size != nil {
+		diskSku.DiskSize = *sku.Size
+	}
+	for _, capability := range sku.Capabilities {
+		if capability == nil || capability.Name == nil || capability.Value == nil {
+			continue
+		}
+		switch strings.ToLower(*capability.Name) {
+		case maxValueOfMaxSharesCapability:
+			diskSku.MaxAllowedShares, err = strconv.Atoi(*capability.Value)
+		case maxBurstIopsCapability:
+			diskSku.MaxBurstIops, err = strconv.Atoi(*capability.Value)
+		case maxIOpsCapability:
+			diskSku.MaxIops, err = strconv.Atoi(*capability.Value)
+		case maxBandwidthMBpsCapability:
+			diskSku.MaxBwMbps, err = strconv.Atoi(*capability.Value)
+		case maxBurstBandwidthMBpsCapability:
+			diskSku.MaxBurstBwMbps, err = strconv.Atoi(*capability.Value)
+		case maxSizeGiBCapability:
+			diskSku.MaxSizeGiB, err = strconv.Atoi(*capability.Value)
+		default:
+			continue
+		}
+		if err != nil {
+			return diskSku, fmt.Errorf("failed to parse disk capability %s. Error: %v", *capability.Name, err)
+		}
+	}
+
+	// If disk doesn't support burst capabilities.
+	// Set the burst limits as regular limits
+	if diskSku.MaxBurstIops < diskSku.MaxIops {
+		diskSku.MaxBurstIops = diskSku.MaxIops
+	}
+	if diskSku.MaxBurstBwMbps < diskSku.MaxBwMbps {
+		diskSku.MaxBurstBwMbps = diskSku.MaxBwMbps
+	}
+	return diskSku, nil
+}
+
+// resourceSKUPagerLister lists resource SKUs with a ResourceSKUsClient
+type resourceSKUPagerLister struct {
+	client *armcompute.ResourceSKUsClient
+}
+
+// NewResourceSKULister returns a ResourceSKULister backed by the Resource SKUs API
+func NewResourceSKULister(client *armcompute.ResourceSKUsClient) ResourceSKULister {
+	return &resourceSKUPagerLister{client: client}
+}
+
+// List lists the resource SKUs in location, all locations are listed if location is empty
+func (l *resourceSKUPagerLister) List(ctx context.Context, location string) ([]*armcompute.ResourceSKU, error) {
+	options := &armcompute.ResourceSKUsClientListOptions{}
+	if location != "" {
+		filter := fmt.Sprintf("location eq '%s'", location)
+		options.Filter = &filter
+	}
+	var skus []*armcompute.ResourceSKU
+	pager := l.client.NewListPager(options)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		skus = append(skus, page.Value...)
+	}
+	return skus, nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package optimization
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type fakeResourceSKULister struct {
+	skus  []*armcompute.ResourceSKU
+	err   error
+	calls int
+}
+
+func (f *fakeResourceSKULister) List(_ context.Context, _ string) ([]*armcompute.ResourceSKU, error) {
+	f.calls++
+	return f.skus, f.err
+}
+
+func newTestVMSku(name string, maxDataDiskCount string) *armcompute.ResourceSKU {
+	return &armcompute.ResourceSKU{
+		ResourceType: to.Ptr("virtualMachines"),
+		Name:         to.Ptr(name),
+		Capabilities: []*armcompute.ResourceSKUCapabilities{
+			{Name: to.Ptr("vCPUs"), Value: to.Ptr("4")},
+			{Name: to.Ptr("MaxDataDiskCount"), Value: to.Ptr(maxDataDiskCount)},
+			{Name: to.Ptr("UncachedDiskIOPS"), Value: to.Ptr("6400")},
+			{Name: to.Ptr("UncachedDiskBytesPerSecond"), Value: to.Ptr("150994944")},
+		},
+	}
+}
+
+func newTestDiskSku(name, size, maxSizeGiB, maxIops string) *armcompute.ResourceSKU {
+	return &armcompute.ResourceSKU{
+		ResourceType: to.Ptr("disks"),
+		Name:         to.Ptr(name),
+		Tier:         to.Ptr("Premium"),
+		Size:         to.Ptr(size),
+		Capabilities: []*armcompute.ResourceSKUCapabilities{
+			{Name: to.Ptr("MaxSizeGiB"), Value: to.Ptr(maxSizeGiB)},
+			{Name: to.Ptr("MaxIOps"), Value: to.Ptr(maxIops)},
+			{Name: to.Ptr("MaxBandwidthMBps"), Value: to.Ptr("100")},
+		},
+	}
+}
+
+func TestNewNodeInfoFromResourceSku(t *testing.T) {
+	nodeInfo, err := NewNodeInfoFromResourceSku(newTestVMSku("Standard_X4s_v9", "16"))
+	assert.NoError(t, err)
+	assert.Equal(t, NodeInfo{SkuName: "Standard_X4s_v9", MaxDataDiskCount: 16, VCpus: 4, MaxBurstIops: 6400, MaxIops: 6400, MaxBwMbps: 144, MaxBurstBwMbps: 144}, nodeInfo)
+
+	_, err = NewNodeInfoFromResourceSku(newTestVMSku("Standard_X4s_v9", "invalid"))
+	assert.Error(t, err)
+}
+
+func TestNewDiskSkuInfo(t *testing.T) {
+	diskSku, err := NewDiskSkuInfo(newTestDiskSku("Premium_LRS", "P10", "128", "500"))
+	assert.NoError(t, err)
+	assert.Equal(t, DiskSkuInfo{StorageAccountType: "Premium_LRS", StorageTier: "Premium", DiskSize: "P10", MaxBurstIops: 500, MaxIops: 500, MaxBwMbps: 100, MaxBurstBwMbps: 100, MaxSizeGiB: 128}, diskSku)
+
+	_, err = NewDiskSkuInfo(newTestDiskSku("Premium_LRS", "P10", "invalid", "500"))
+	assert.Error(t, err)
+}
+
+func TestSkuCatalogEmbeddedFallback(t *testing.T) {
+	catalog := NewSkuCatalog()
+	vmSku, ok := catalog.GetVMSku("Standard_DS14")
+	assert.True(t, ok)
+	assert.Equal(t, NodeInfoMap["standard_ds14"], vmSku)
+	_, ok = catalog.GetLoadedVMSku("Standard_DS14")
+	assert.False(t, ok)
+	_, ok = catalog.GetVMSku("Standard_X4s_v9")
+	assert.False(t, ok)
+	assert.Equal(t, DiskSkuMap, catalog.GetDiskSkus())
+}
+
+func TestSkuCatalogLoad(t *testing.T) {
+	ctx := context.Background()
+	cacheFile := filepath.Join(t.TempDir(), "cache", "skus.json")
+	lister := &fakeResourceSKULister{
+		skus: []*armcompute.ResourceSKU{
+			newTestVMSku("Standard_X4s_v9", "16"),
+			// the same SKU in another zone of the location is ignored
+			newTestVMSku("Standard_X4s_v9", "8"),
+			newTestVMSku("Standard_DS14", "32"),
+			newTestDiskSku("Premium_LRS", "P10", "128", "600"),
+			newTestDiskSku("PremiumV3_LRS", "P10", "128", "3000"),
+			{ResourceType: to.Ptr("availabilitySets"), Name: to.Ptr("Aligned")},
+			newTestVMSku("Standard_Invalid", "invalid"),
+		},
+	}
+	config := SkuCatalogConfig{Location: "eastus", CacheFile: cacheFile, CacheTTL: time.Hour}
+
+	// load from the API and write the cache file
+	catalog := NewSkuCatalog()
+	catalog.Load(ctx, lister, config)
+	assert.Equal(t, 1, lister.calls)
+	assert.FileExists(t, cacheFile)
+	vmSku, ok := catalog.GetVMSku("standard_x4s_v9")
+	assert.True(t, ok)
+	assert.Equal(t, 16, vmSku.MaxDataDiskCount)
+	vmSku, ok = catalog.GetLoadedVMSku("Standard_DS14")
+	assert.True(t, ok)
+	assert.Equal(t, 32, vmSku.MaxDataDiskCount)
+	_, ok = catalog.GetVMSku("Standard_Invalid")
+	assert.False(t, ok)
+	diskSkus := catalog.GetDiskSkus()
+	assert.Equal(t, 600, diskSkus["premium_lrs"]["p10"].MaxIops)
+	assert.Equal(t, DiskSkuMap["premium_lrs"]["p20"], diskSkus["premium_lrs"]["p20"])
+	assert.Equal(t, 3000, diskSkus["premiumv3_lrs"]["p10"].MaxIops)
+	assert.Equal(t, 500, DiskSkuMap["premium_lrs"]["p10"].MaxIops)
+
+	// the fresh cache file is used without calling the API
+	catalog = NewSkuCatalog()
+	catalog.Load(ctx, lister, config)
+	assert.Equal(t, 1, lister.calls)
+	_, ok = catalog.GetLoadedVMSku("Standard_X4s_v9")
+	assert.True(t, ok)
+
+	// the stale cache file is used if the API call fails
+	staleTime := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(cacheFile, staleTime, staleTime))
+	failingLister := &fakeResourceSKULister{err: errors.New("throttled")}
+	catalog = NewSkuCatalog()
+	catalog.Load(ctx, failingLister, config)
+	assert.Equal(t, 1, failingLister.calls)
+	_, ok = catalog.GetLoadedVMSku("Standard_X4s_v9")
+	assert.True(t, ok)
+
+	// the embedded maps are used if both the API and the cache file fail
+	catalog = NewSkuCatalog()
+	catalog.Load(ctx, failingLister, SkuCatalogConfig{})
+	_, ok = catalog.GetLoadedVMSku("Standard_X4s_v9")
+	assert.False(t, ok)
+	_, ok = catalog.GetVMSku("Standard_DS14")
+	assert.True(t, ok)
+}
+
+func TestSkuCatalogOverrideFile(t *testing.T) {
+	overrideFile := filepath.Join(t.TempDir(), "override.yaml")
+	assert.NoError(t, os.WriteFile(overrideFile, []byte(`
+- resourceType: virtualMachines
+  name: Standard_X4s_v9
+  capabilities:
+  - name: MaxDataDiskCount
+    value: "24"
+- resourceType: disks
+  name: Premium_LRS
+  tier: Premium
+  size: P10
+  capabilities:
+  - name: MaxSizeGiB
+    value: "128"
+  - name: MaxIOps
+    value: "700"
+`), 0644))
+	lister := &fakeResourceSKULister{skus: []*armcompute.ResourceSKU{newTestVMSku("Standard_X4s_v9", "16"), newTestVMSku("Standard_X8s_v9", "32")}}
+
+	catalog := NewSkuCatalog()
+	catalog.Load(context.Background(), lister, SkuCatalogConfig{OverrideFile: overrideFile})
+	vmSku, ok := catalog.GetVMSku("Standard_X4s_v9")
+	assert.True(t, ok)
+	assert.Equal(t, 24, vmSku.MaxDataDiskCount)
+	vmSku, ok = catalog.GetVMSku("Standard_X8s_v9")
+	assert.True(t, ok)
+	assert.Equal(t, 32, vmSku.MaxDataDiskCount)
+	assert.Equal(t, 700, catalog.GetDiskSkus()["premium_lrs"]["p10"].MaxIops)
+
+	// an invalid override file is ignored
+	assert.NoError(t, os.WriteFile(overrideFile, []byte("{invalid"), 0644))
+	catalog.Load(context.Background(), lister, SkuCatalogConfig{OverrideFile: overrideFile})
+	vmSku, ok = catalog.GetVMSku("Standard_X4s_v9")
+	assert.True(t, ok)
+	assert.Equal(t, 16, vmSku.MaxDataDiskCount)
+}
+
+func TestNewNodeInfoWithLoadedSku(t *testing.T) {
+	t.Cleanup(func() {
+		LoadSkuCatalog(context.Background(), nil, SkuCatalogConfig{})
+	})
+	LoadSkuCatalog(context.Background(), &fakeResourceSKULister{skus: []*armcompute.ResourceSKU{newTestVMSku("Standard_X4s_v9", "16")}}, SkuCatalogConfig{})
+
+	cloud := &fakeCloud{}
+	cloud.InstanceTypes = map[types.NodeName]string{"new-vm-size": "Standard_X4s_v9"}
+	nodeInfo, err := NewNodeInfo(context.Background(), cloud, "new-vm-size")
+	assert.NoError(t, err)
+	assert.Equal(t, 16, nodeInfo.MaxDataDiskCount)
+	assert.Equal(t, 6400, nodeInfo.MaxIops)
+}
@@ -19,6 +19,7 @@ package optimization
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"google.golang.org/grpc/codes"
@@ -29,6 +30,15 @@ import (
 	"k8s.io/klog/v2"
 )
 
+const (
+	// baseline performance of a Premium SSD v2 disk if DiskIOPSReadWrite or DiskMBpsReadWrite is not set
+	defaultPremiumV2DiskIops   = 3000
+	defaultPremiumV2DiskBwMbps = 125
+	// performance of an Ultra disk created by the driver if DiskIOPSReadWrite or DiskMBpsReadWrite is not set
+	defaultUltraDiskIops   = 500
+	defaultUltraDiskBwMbps = 100
+)
+
 // NodeInfo stores VM/Node specific static information
 // VM information is present in sku.json in below format
 //
@@ -135,9 +145,9 @@ func NewNodeInfo(ctx context.Context, cloud cloudprovider.Interface, nodeID stri
 
 	nodeSkuNameLower := strings.ToLower(nodeInfo.SkuName)
 
-	vmSku, ok := NodeInfoMap[nodeSkuNameLower]
+	vmSku, ok := skuCatalog.GetVMSku(nodeSkuNameLower)
 	if !ok {
-		return nil, fmt.Errorf("NewNodeInfo: Could not find SKU %s in the sku map", nodeSkuNameLower)
+		return nil, fmt.Errorf("NewNodeInfo: Could not find SKU %s in the sku catalog", nodeSkuNameLower)
 	}
 
 	nodeInfo.MaxBurstBwMbps = vmSku.MaxBurstBwMbps
@@ -151,7 +161,144 @@ func NewNodeInfo(ctx context.Context, cloud cloudprovider.Interface, nodeID stri
 }
 
 func GetDiskSkuInfoMap() map[string]map[string]DiskSkuInfo {
-	return DiskSkuMap
+	return skuCatalog.GetDiskSkus()
+}
+
+// GetProvisionedDiskPerf returns the provisioned IOPS and bandwidth in MBps of a disk, the IOPS and bandwidth set explicitly,
+// e.g. on PremiumV2_LRS and UltraSSD_LRS, are returned as is, otherwise they are looked up from the disk SKU
+func GetProvisionedDiskPerf(accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string) (iops, bwMbps int, err error) {
+	iops, _ = strconv.Atoi(diskIopsStr)
+	bwMbps, _ = strconv.Atoi(diskBwMbpsStr)
+	if iops > 0 && bwMbps > 0 {
+		return iops, bwMbps, nil
+	}
+
+	diskSku, err := getDiskSku(skuCatalog.GetDiskSkus(), accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if diskSku == nil {
+		return 0, 0, fmt.Errorf("could not find sku for account %s size %s. Error: sku not found", accountType, diskSizeGibStr)
+	}
+	if iops <= 0 {
+		iops = diskSku.MaxIops
+	}
+	if bwMbps <= 0 {
+		bwMbps = diskSku.MaxBwMbps
+	}
+	return iops, bwMbps, nil
+}
+
+// GetDiskSkuInfo returns the SKU with the provisioned and burst limits of a disk from the SKU catalog
+func GetDiskSkuInfo(accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string) (*DiskSkuInfo, error) {
+	diskSku, err := getDiskSku(skuCatalog.GetDiskSkus(), accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+	if err != nil {
+		return nil, err
+	}
+	if diskSku == nil {
+		return nil, fmt.Errorf("could not find sku for account %s size %s. Error: sku not found", accountType, diskSizeGibStr)
+	}
+	return diskSku, nil
+}
+
+// getDiskSku gets the SKU of a disk, the SKU of a disk with provisioned performance, e.g. PremiumV2_LRS and UltraSSD_LRS,
+// is built from the IOPS and bandwidth set on the disk since there are no fixed tiers
+func getDiskSku(diskSkus map[string]map[string]DiskSkuInfo, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string) (*DiskSkuInfo, error) {
+	if isProvisionedPerfAccountType(accountType) {
+		return getProvisionedDiskSku(accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+	}
+	return getMatchingDiskSku(diskSkus, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr)
+}
+
+// isProvisionedPerfAccountType checks whether the IOPS and bandwidth of the account type are provisioned independently of the disk size
+func isProvisionedPerfAccountType(accountType string) bool {
+	accountTypeLower := strings.ToLower(accountType)
+	return strings.HasPrefix(accountTypeLower, "premiumv2") || strings.HasPrefix(accountTypeLower, "ultrassd")
+}
+
+// getProvisionedDiskSku returns the SKU of a Premium SSD v2 or Ultra disk with the provisioned IOPS and bandwidth,
+// the default performance of the account type is used if they are not set. These disks do not burst.
+func getProvisionedDiskSku(accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string) (*DiskSkuInfo, error) {
+	diskSizeGb, err := strconv.Atoi(diskSizeGibStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse disk size %s. Error: incorrect sku size", diskSizeGibStr)
+	}
+
+	diskIops, bwMbps := defaultPremiumV2DiskIops, defaultPremiumV2DiskBwMbps
+	if strings.HasPrefix(strings.ToLower(accountType), "ultrassd") {
+		diskIops, bwMbps = defaultUltraDiskIops, defaultUltraDiskBwMbps
+	}
+	if diskIopsStr != "" {
+		if diskIops, err = strconv.Atoi(diskIopsStr); err != nil || diskIops <= 0 {
+			return nil, fmt.Errorf("could not parse disk IOPS %s of account %s", diskIopsStr, accountType)
+		}
+	}
+	if diskBwMbpsStr != "" {
+		if bwMbps, err = strconv.Atoi(diskBwMbpsStr); err != nil || bwMbps <= 0 {
+			return nil, fmt.Errorf("could not parse disk bandwidth %s of account %s", diskBwMbpsStr, accountType)
+		}
+	}
+
+	return &DiskSkuInfo{
+		StorageAccountType: accountType,
+		MaxIops:            diskIops,
+		MaxBurstIops:       diskIops,
+		MaxBwMbps:          bwMbps,
+		MaxBurstBwMbps:     bwMbps,
+		MaxSizeGiB:         diskSizeGb,
+	}, nil
+}
+
+// getMatchingDiskSku gets the smallest SKU which matches the size, io and bw requirement
+// TODO: Query the disk size (e.g. P10, P30 etc) and use that to find the sku
+func getMatchingDiskSku(diskSkus map[string]map[string]DiskSkuInfo, accountType, diskSizeGibStr, diskIopsStr, diskBwMbpsStr string) (matchingSku *DiskSkuInfo, err error) {
+	accountTypeLower := strings.ToLower(accountType)
+	skus, ok := diskSkus[accountTypeLower]
+
+	if !ok || skus == nil || len(diskSkus[accountTypeLower]) <= 0 {
+		return nil, fmt.Errorf("could not find sku for account %s. Error: sku not found", accountType)
+	}
+
+	diskSizeGb, err := strconv.Atoi(diskSizeGibStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse disk size %s. Error: incorrect sku size", diskSizeGibStr)
+	}
+
+	// Treating these as non required field, as they come as part of the provisioned size
+	// If these are explicitly set then that will be used to get the best possible match
+	diskIops, err := strconv.Atoi(diskIopsStr)
+	if err != nil {
+		diskIops = 0
+	}
+	diskBwMbps, err := strconv.Atoi(diskBwMbpsStr)
+	if err != nil {
+		diskBwMbps = 0
+	}
+
+	for _, sku := range diskSkus[accountTypeLower] {
+		// Use the smallest sku size which can fulfil Size, IOs and BW requirements
+		if meetsRequest(&sku, diskSizeGb, diskIops, diskBwMbps) {
+			if matchingSku == nil || sku.MaxSizeGiB < matchingSku.MaxSizeGiB {
+				tempSku := sku
+				matchingSku = &tempSku
+			}
+		}
+	}
+
+	return matchingSku, nil
+}
+
+// meetsRequest checks to see if given SKU meets\has enough size, iops and bw limits
+func meetsRequest(sku *DiskSkuInfo, diskSizeGb, diskIops, diskBwMbps int) bool {
+	if sku == nil {
+		return false
+	}
+
+	if sku.MaxSizeGiB >= diskSizeGb && sku.MaxBwMbps >= diskBwMbps && sku.MaxIops >= diskIops {
+		return true
+	}
+
+	return false
 }
 
 // GetRandomIOLatencyInSec gets the estimated random IP latency for a small write for a disk size
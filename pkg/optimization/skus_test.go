@@ -127,3 +127,115 @@ func TestNewNodeInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestGetProvisionedDiskPerf(t *testing.T) {
+	tests := []struct {
+		desc           string
+		accountType    string
+		diskSizeGibStr string
+		diskIopsStr    string
+		diskBwMbpsStr  string
+		expectedIops   int
+		expectedBwMbps int
+		expectedErr    bool
+	}{
+		{
+			desc:           "P10 premium disk",
+			accountType:    "Premium_LRS",
+			diskSizeGibStr: "128",
+			expectedIops:   500,
+			expectedBwMbps: 100,
+		},
+		{
+			desc:           "explicit IOPS and bandwidth",
+			accountType:    "PremiumV2_LRS",
+			diskSizeGibStr: "100",
+			diskIopsStr:    "5000",
+			diskBwMbpsStr:  "200",
+			expectedIops:   5000,
+			expectedBwMbps: 200,
+		},
+		{
+			desc:           "explicit IOPS only",
+			accountType:    "Premium_LRS",
+			diskSizeGibStr: "128",
+			diskIopsStr:    "300",
+			expectedIops:   300,
+			expectedBwMbps: 100,
+		},
+		{
+			desc:           "baseline performance of PremiumV2 disk",
+			accountType:    "PremiumV2_LRS",
+			diskSizeGibStr: "100",
+			expectedIops:   3000,
+			expectedBwMbps: 125,
+		},
+		{
+			desc:           "explicit IOPS of Ultra disk",
+			accountType:    "UltraSSD_LRS",
+			diskSizeGibStr: "100",
+			diskIopsStr:    "8000",
+			expectedIops:   8000,
+			expectedBwMbps: 100,
+		},
+		{
+			desc:           "invalid IOPS of PremiumV2 disk",
+			accountType:    "PremiumV2_LRS",
+			diskSizeGibStr: "100",
+			diskIopsStr:    "abc",
+			expectedErr:    true,
+		},
+		{
+			desc:           "unknown account type",
+			accountType:    "Unknown_LRS",
+			diskSizeGibStr: "128",
+			expectedErr:    true,
+		},
+		{
+			desc:           "invalid disk size",
+			accountType:    "Premium_LRS",
+			diskSizeGibStr: "abc",
+			expectedErr:    true,
+		},
+	}
+	for _, test := range tests {
+		iops, bwMbps, err := GetProvisionedDiskPerf(test.accountType, test.diskSizeGibStr, test.diskIopsStr, test.diskBwMbpsStr)
+		assert.Equal(t, test.expectedErr, err != nil, "desc: %s, err: %v", test.desc, err)
+		if !test.expectedErr {
+			assert.Equal(t, test.expectedIops, iops, test.desc)
+			assert.Equal(t, test.expectedBwMbps, bwMbps, test.desc)
+		}
+	}
+}
+
+func TestGetDiskSkuInfo(t *testing.T) {
+	diskSku, err := GetDiskSkuInfo("Premium_LRS", "100", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "P10", diskSku.DiskSize)
+	assert.Equal(t, 3500, diskSku.MaxBurstIops)
+
+	_, err = GetDiskSkuInfo("Premium_LRS", "100000", "", "")
+	assert.Error(t, err)
+	_, err = GetDiskSkuInfo("Unknown_LRS", "100", "", "")
+	assert.Error(t, err)
+}
+
+func TestGetDiskSku(t *testing.T) {
+	diskSku, err := getDiskSku(DiskSkuMap, "PremiumV2_LRS", "1024", "20000", "600")
+	assert.NoError(t, err)
+	assert.Equal(t, &DiskSkuInfo{StorageAccountType: "PremiumV2_LRS", MaxIops: 20000, MaxBurstIops: 20000, MaxBwMbps: 600, MaxBurstBwMbps: 600, MaxSizeGiB: 1024}, diskSku)
+
+	diskSku, err = getDiskSku(DiskSkuMap, "UltraSSD_LRS", "1024", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 500, diskSku.MaxIops)
+	assert.Equal(t, 100, diskSku.MaxBwMbps)
+
+	diskSku, err = getDiskSku(DiskSkuMap, "StandardSSD_LRS", "100", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "E10", diskSku.DiskSize)
+
+	_, err = getDiskSku(DiskSkuMap, "PremiumV2_LRS", "abc", "", "")
+	assert.Error(t, err)
+	_, err = getDiskSku(DiskSkuMap, "UltraSSD_LRS", "1024", "", "0")
+	assert.Error(t, err)
+}
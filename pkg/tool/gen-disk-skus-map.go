@@ -32,19 +32,6 @@ import (
 	"sigs.k8s.io/azuredisk-csi-driver/pkg/optimization"
 )
 
-var (
-	MaxValueOfMaxSharesCapability        = "maxvalueofmaxshares"
-	MaxBurstIopsCapability               = "maxburstiops"
-	MaxIOpsCapability                    = "maxiops"
-	MaxBandwidthMBpsCapability           = "maxbandwidthmbps"
-	MaxBurstBandwidthMBpsCapability      = "maxburstbandwidthmbps"
-	MaxSizeGiBCapability                 = "maxsizegib"
-	UncachedDiskIOPSCapability           = "uncacheddiskiops"
-	UncachedDiskBytesPerSecondCapability = "uncacheddiskbytespersecond"
-	MaxDataDiskCountCapability           = "maxdatadiskcount"
-	VCPUsCapability                      = "vcpus"
-)
-
 func init() {
 	klog.InitFlags(nil)
 }
@@ -134,16 +121,14 @@ import (
 			if _, ok := diskSkuInfoMap[account]; !ok {
 				diskSkuInfoMap[account] = map[string]optimization.DiskSkuInfo{}
 			}
-			diskSkuInfoMap[account][diskSize], err = getDiskCapabilities(sku)
+			diskSkuInfoMap[account][diskSize], err = optimization.NewDiskSkuInfo(sku)
 			if err != nil {
 				klog.Errorf("populateSkuMap: Failed to get disk capabilities for disk %s %s %s. Error: %v", *sku.Name, *sku.Size, *sku.Tier, err)
 				os.Exit(1)
 			}
 		} else if resType == "virtualmachines" {
 
-			nodeInfo := optimization.NodeInfo{}
-			nodeInfo.SkuName = *sku.Name
-			err = populateNodeCapabilities(sku, &nodeInfo)
+			nodeInfo, err := optimization.NewNodeInfoFromResourceSku(sku)
 			if err != nil {
 				klog.Errorf("populateSkuMap: Failed to populate node capabilities. Error: %v", err)
 				os.Exit(1)
@@ -235,97 +220,6 @@ func getAllSkus(filePath string) (err error) {
 	return err
 }
 
-// populateNodeCapabilities populates node capabilities from SkuInfo
-func populateNodeCapabilities(sku *armcompute.ResourceSKU, nodeInfo *optimization.NodeInfo) (err error) {
-	if sku.Capabilities != nil {
-		for _, capability := range sku.Capabilities {
-			err = nil
-			if capability.Name != nil {
-				switch strings.ToLower(*capability.Name) {
-				case UncachedDiskIOPSCapability:
-					nodeInfo.MaxIops, err = strconv.Atoi(*capability.Value)
-				case UncachedDiskBytesPerSecondCapability:
-					bw, err := strconv.Atoi(*capability.Value)
-					nodeInfo.MaxBwMbps = bw / (1024 * 1024)
-					if err != nil {
-						return fmt.Errorf("PopulateNodeCapabilities: Failed to parse node capability %s. Error: %v", *capability.Name, err)
-					}
-				case MaxDataDiskCountCapability:
-					nodeInfo.MaxDataDiskCount, err = strconv.Atoi(*capability.Value)
-				case VCPUsCapability:
-					nodeInfo.VCpus, err = strconv.Atoi(*capability.Value)
-				default:
-					continue
-				}
-			}
-
-			if err != nil {
-				return fmt.Errorf("PopulateNodeCapabilities: Failed to parse node capability %s. Error: %v", *capability.Name, err)
-			}
-		}
-	}
-
-	// If node doesn't support burst capabilities.
-	// Set the burst limits as regular limits
-	if nodeInfo.MaxBurstIops < nodeInfo.MaxIops {
-		nodeInfo.MaxBurstIops = nodeInfo.MaxIops
-	}
-
-	if nodeInfo.MaxBurstBwMbps < nodeInfo.MaxBwMbps {
-		nodeInfo.MaxBurstBwMbps = nodeInfo.MaxBwMbps
-	}
-
-	return nil
-}
-
-// getDiskCapabilities gets disk capabilities from SkuInfo
-func getDiskCapabilities(sku *armcompute.ResourceSKU) (diskSku optimization.DiskSkuInfo, err error) {
-	diskSku = optimization.DiskSkuInfo{}
-	diskSku.StorageAccountType = *sku.Name
-	diskSku.StorageTier = *sku.Tier
-	diskSku.DiskSize = *sku.Size
-
-	if sku.Capabilities != nil {
-		for _, capability := range sku.Capabilities {
-			err = nil
-			if capability.Name != nil {
-				switch strings.ToLower(*capability.Name) {
-				case MaxValueOfMaxSharesCapability:
-					diskSku.MaxAllowedShares, err = strconv.Atoi(*capability.Value)
-				case MaxBurstIopsCapability:
-					diskSku.MaxBurstIops, err = strconv.Atoi(*capability.Value)
-				case MaxIOpsCapability:
-					diskSku.MaxIops, err = strconv.Atoi(*capability.Value)
-				case MaxBandwidthMBpsCapability:
-					diskSku.MaxBwMbps, err = strconv.Atoi(*capability.Value)
-				case MaxBurstBandwidthMBpsCapability:
-					diskSku.MaxBurstBwMbps, err = strconv.Atoi(*capability.Value)
-				case MaxSizeGiBCapability:
-					diskSku.MaxSizeGiB, err = strconv.Atoi(*capability.Value)
-				default:
-					continue
-				}
-			}
-
-			if err != nil {
-				return diskSku, fmt.Errorf("GetDiskCapabilities: Failed to parse disk capability %s. Error: %v", *capability.Name, err)
-			}
-		}
-	}
-
-	// If disk doesn't support burst capabilities.
-	// Set the burst limits as regular limits
-	if diskSku.MaxBurstIops < diskSku.MaxIops {
-		diskSku.MaxBurstIops = diskSku.MaxIops
-	}
-
-	if diskSku.MaxBurstBwMbps < diskSku.MaxBwMbps {
-		diskSku.MaxBurstBwMbps = diskSku.MaxBwMbps
-	}
-
-	return diskSku, nil
-}
-
 func appendWithErrCheck(sb *strings.Builder, strToAppend string) {
 	if _, err := sb.WriteString(strToAppend); err != nil {
 		panic(err)